@@ -10,6 +10,7 @@ require (
 	github.com/gorilla/sessions v1.2.1
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/justinas/alice v1.2.0
+	github.com/lib/pq v1.10.2
 	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/stripe/stripe-go/v72 v72.56.0
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
@@ -0,0 +1,64 @@
+package appsettings
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
+)
+
+//BackupsEnabled returns true if the db can be backed up from the gui
+//this is only true for sqlite deployments with a backup directory set
+func BackupsEnabled() bool {
+	return sqliteutils.BackupsEnabled()
+}
+
+//ListBackupsAPI returns the list of backups of the db, newest first
+func ListBackupsAPI(w http.ResponseWriter, r *http.Request) {
+	list, err := sqliteutils.ListBackups()
+	if err != nil {
+		output.Error(err, "Could not get the list of backups.", w)
+		return
+	}
+
+	output.Success("listBackups", list, w)
+}
+
+//BackupAPI makes a backup of the db when an admin clicks the button in the gui
+func BackupAPI(w http.ResponseWriter, r *http.Request) {
+	b, err := sqliteutils.Backup()
+	if err != nil {
+		output.Error(err, "Could not make a backup.", w)
+		return
+	}
+
+	output.Success("backup", b, w)
+}
+
+//DownloadBackup sends a backup file to the client
+func DownloadBackup(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	p, err := sqliteutils.BackupPath(name)
+	if err != nil {
+		output.Error(err, "Could not find this backup.", w)
+		return
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		output.Error(err, "Could not open this backup.", w)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		output.Error(err, "Could not open this backup.", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
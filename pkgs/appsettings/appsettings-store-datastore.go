@@ -0,0 +1,53 @@
+package appsettings
+
+import (
+	"context"
+	"log"
+
+	"cloud.google.com/go/datastore"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
+)
+
+//datastoreStore saves and retrieves the app settings from the google cloud datastore
+type datastoreStore struct{}
+
+//NewDatastoreStore returns a Store that uses the google cloud datastore
+func NewDatastoreStore() Store {
+	return datastoreStore{}
+}
+
+//Get returns the saved app settings
+func (s datastoreStore) Get(ctx context.Context) (Settings, error) {
+	result := Settings{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	//get the key we are looking up
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityAppSettings, datastoreKeyName)
+
+	//get data
+	err = client.Get(ctx, key, &result)
+	if err == datastore.ErrNoSuchEntity {
+		//no app settings exist yet
+		//return default values
+		log.Println("appsettings.Get", "App settings don't exist yet.  Returning default values.")
+		return defaultAppSettings, nil
+	}
+
+	return result, err
+}
+
+//Save saves the app settings under the one and only key
+func (s datastoreStore) Save(ctx context.Context, d Settings) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityAppSettings, datastoreKeyName)
+	_, err = client.Put(ctx, key, &d)
+	return err
+}
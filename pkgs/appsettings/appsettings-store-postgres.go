@@ -0,0 +1,57 @@
+package appsettings
+
+import (
+	"context"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/postgresutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//postgresStore saves and retrieves the app settings from a postgres db
+type postgresStore struct {
+	c *sqlx.DB
+}
+
+//NewPostgresStore returns a Store that uses the given postgres db connection
+func NewPostgresStore(c *sqlx.DB) Store {
+	return postgresStore{c: c}
+}
+
+//Get returns the saved app settings
+//the one and only row is inserted when the db is deployed
+func (s postgresStore) Get(ctx context.Context) (Settings, error) {
+	result := Settings{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableAppSettings + `
+		WHERE ID=$1
+	`
+	err := s.c.GetContext(ctx, &result, q, postgresutils.DefaultAppSettingsID)
+	return result, err
+}
+
+//Save updates the one and only row of app settings
+func (s postgresStore) Save(ctx context.Context, d Settings) error {
+	q := `
+		UPDATE ` + postgresutils.TableAppSettings + ` SET
+			RequireCustomerID=$1,
+			CustomerIDFormat=$2,
+			CustomerIDRegex=$3,
+			ReportTimezone=$4,
+			APIKey=$5,
+			DefaultCurrency=$6
+		WHERE ID=$7
+	`
+	_, err := s.c.ExecContext(
+		ctx,
+		q,
+		d.RequireCustomerID,
+		d.CustomerIDFormat,
+		d.CustomerIDRegex,
+		d.ReportTimezone,
+		d.APIKey,
+		d.DefaultCurrency,
+		postgresutils.DefaultAppSettingsID,
+	)
+	return err
+}
@@ -0,0 +1,61 @@
+package appsettings
+
+import (
+	"context"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//sqliteStore saves and retrieves the app settings from a sqlite db
+type sqliteStore struct {
+	c *sqlx.DB
+}
+
+//NewSQLiteStore returns a Store that uses the given sqlite db connection
+func NewSQLiteStore(c *sqlx.DB) Store {
+	return sqliteStore{c: c}
+}
+
+//Get returns the saved app settings
+//the one and only row is inserted when the db is deployed
+func (s sqliteStore) Get(ctx context.Context) (Settings, error) {
+	result := Settings{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableAppSettings + `
+		WHERE ID=?
+	`
+	err := s.c.Get(&result, q, sqliteutils.DefaultAppSettingsID)
+	return result, err
+}
+
+//Save updates the one and only row of app settings
+func (s sqliteStore) Save(ctx context.Context, d Settings) error {
+	q := `
+		UPDATE ` + sqliteutils.TableAppSettings + ` SET
+			RequireCustomerID=?,
+			CustomerIDFormat=?,
+			CustomerIDRegex=?,
+			ReportTimezone=?,
+			APIKey=?,
+			DefaultCurrency=?
+		WHERE ID = ?
+	`
+	stmt, err := s.c.Prepare(q)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		d.RequireCustomerID,
+		d.CustomerIDFormat,
+		d.CustomerIDRegex,
+		d.ReportTimezone,
+		d.APIKey,
+		d.DefaultCurrency,
+
+		sqliteutils.DefaultAppSettingsID,
+	)
+	return err
+}
@@ -0,0 +1,26 @@
+package appsettings
+
+import (
+	"context"
+)
+
+//Store is the set of functions used to save and retrieve the app settings from a database.
+//Each database we support has its own implementation of this interface.  The
+//implementation to use is chosen once in package main init() via SetStore.
+type Store interface {
+	//Get returns the saved app settings, the default settings are returned if none
+	//have been saved yet
+	Get(ctx context.Context) (Settings, error)
+
+	//Save saves the app settings, overwriting any existing settings
+	Save(ctx context.Context, s Settings) error
+}
+
+//store is the Store that is used to save and retrieve the app settings
+//this is set in package main init() via SetStore
+var store Store
+
+//SetStore saves the database implementation used to save and retrieve the app settings
+func SetStore(s Store) {
+	store = s
+}
@@ -16,10 +16,7 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
 )
 
 //datastoreKeyName is the name of the the entity we save the app settings under
@@ -28,11 +25,12 @@ const datastoreKeyName = "appSettingsKey"
 
 //Settings is used for setting or getting the app settings from the datastore
 type Settings struct {
-	RequireCustomerID bool   `json:"require_cust_id"` //is the customer id field required when adding a new card
-	CustomerIDFormat  string `json:"cust_id_format"`  //the format of the customer id from a CRM system.  This shows up in the gui.
-	CustomerIDRegex   string `json:"cust_id_regex"`   //the regex to check the customer id against.
-	ReportTimezone    string `json:"report_timezone"` //the tz database name of the timezone we want to show reports and receipt times in
-	APIKey            string `json:"api_key"`         //the api key to access this app to automatically charge cards
+	RequireCustomerID bool   `json:"require_cust_id"`  //is the customer id field required when adding a new card
+	CustomerIDFormat  string `json:"cust_id_format"`   //the format of the customer id from a CRM system.  This shows up in the gui.
+	CustomerIDRegex   string `json:"cust_id_regex"`    //the regex to check the customer id against.
+	ReportTimezone    string `json:"report_timezone"`  //the tz database name of the timezone we want to show reports and receipt times in
+	APIKey            string `json:"api_key"`          //the api key to access this app to automatically charge cards
+	DefaultCurrency   string `json:"default_currency"` //the currency customers without their own currency are charged in
 
 	//fields not used in cloud datastore
 	ID int64 `json:"sqlite_user_id"`
@@ -45,14 +43,21 @@ var defaultAppSettings = Settings{
 	CustomerIDRegex:   "",
 	ReportTimezone:    "UTC",
 	APIKey:            "",
+	DefaultCurrency:   defaultCurrency,
 }
 
 //defaultTimezone is the timezone we use when a user hasn't set one in app settings
 var defaultTimezone = "UTC"
 
+//defaultCurrency is the currency we use when a user hasn't set one in app settings
+const defaultCurrency = "usd"
+
 //ErrAppSettingsDoNotExist is thrown when no app settings exist yet
 var ErrAppSettingsDoNotExist = errors.New("appsettings: info does not exist")
 
+//errInvalidCurrency is thrown when the default currency isn't a three letter currency code
+var errInvalidCurrency = errors.New("appsettings: invalid currency")
+
 //GetAPI is used when viewing the data in the gui or on a receipt
 func GetAPI(w http.ResponseWriter, r *http.Request) {
 	//get info
@@ -68,49 +73,23 @@ func GetAPI(w http.ResponseWriter, r *http.Request) {
 //Get actually retrienves the information from the datastore
 //putting this into a separate func cleans up code elsewhere
 func Get(r *http.Request) (Settings, error) {
-	//placeholder
-	result := Settings{}
-	var err error
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT * 
-			FROM ` + sqliteutils.TableAppSettings + ` 
-			WHERE ID=?
-		`
-		err = c.Get(&result, q, sqliteutils.DefaultAppSettingsID)
-	} else {
-
-		//connect to datastore
-		c := r.Context()
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			return result, err
-		}
-
-		//get the key we are looking up
-		key := datastoreutils.GetKeyFromName(datastoreutils.EntityAppSettings, datastoreKeyName)
-
-		//get data
-		err = client.Get(c, key, &result)
-		if err == datastore.ErrNoSuchEntity {
-			//no app settings exist yet
-			//return default values
-			log.Println("appsettings.Get", "App settings don't exist yet.  Returning default values.")
-			return defaultAppSettings, nil
-		}
-
-		//handle times when timezone is unset
-		//upgrade from older version of this app since user's won't have this value set
-		if result.ReportTimezone == "" {
-			result.ReportTimezone = defaultTimezone
-		}
+	c := r.Context()
+	result, err := store.Get(c)
+	if err != nil {
+		return result, err
+	}
+
+	//handle times when timezone is unset
+	//upgrade from older version of this app since user's won't have this value set
+	if result.ReportTimezone == "" {
+		result.ReportTimezone = defaultTimezone
+	}
+	if result.DefaultCurrency == "" {
+		result.DefaultCurrency = defaultCurrency
 	}
 
 	//returl data found
-	return result, err
+	return result, nil
 }
 
 //SaveAPI saves new or updates existing company info in the datastore
@@ -120,11 +99,22 @@ func SaveAPI(w http.ResponseWriter, r *http.Request) {
 	custIDFormat := strings.TrimSpace(r.FormValue("custIDFormat"))
 	custIDRegex := strings.TrimSpace(r.FormValue("custIDRegex"))
 	guiTimezone := strings.TrimSpace(r.FormValue("guiTimezone"))
+	currency := strings.ToLower(strings.TrimSpace(r.FormValue("defaultCurrency")))
 
 	//set defaults
 	if guiTimezone == "" {
 		guiTimezone = defaultTimezone
 	}
+	if currency == "" {
+		currency = defaultCurrency
+	}
+
+	//make sure the currency looks like a currency code
+	//stripe uses lowercase three letter iso codes
+	if len(currency) != 3 || strings.Trim(currency, "abcdefghijklmnopqrstuvwxyz") != "" {
+		output.Error(errInvalidCurrency, "The default currency must be a three letter currency code, i.e.: USD.", w)
+		return
+	}
 
 	//build entity to save
 	//or update existing entity
@@ -133,6 +123,7 @@ func SaveAPI(w http.ResponseWriter, r *http.Request) {
 	data.CustomerIDFormat = custIDFormat
 	data.CustomerIDRegex = custIDRegex
 	data.ReportTimezone = guiTimezone
+	data.DefaultCurrency = currency
 
 	//get current api key
 	//otherwise nothing will be set since data about has a blank api key
@@ -157,54 +148,7 @@ func SaveAPI(w http.ResponseWriter, r *http.Request) {
 
 //save does the actual saving to the datastore
 func save(c context.Context, d Settings) error {
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			UPDATE ` + sqliteutils.TableAppSettings + ` SET 
-				RequireCustomerID=?,
-				CustomerIDFormat=?,
-				CustomerIDRegex=?,
-				ReportTimezone=?,
-				APIKey=?
-			WHERE ID = ?
-		`
-		stmt, err := c.Prepare(q)
-		if err != nil {
-			return err
-		}
-
-		_, err = stmt.Exec(
-			d.RequireCustomerID,
-			d.CustomerIDFormat,
-			d.CustomerIDRegex,
-			d.ReportTimezone,
-			d.APIKey,
-
-			sqliteutils.DefaultAppSettingsID,
-		)
-		if err != nil {
-			return err
-		}
-
-	} else {
-		//connect to datastore
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			return err
-		}
-
-		//get the key we are saving to
-		key := datastoreutils.GetKeyFromName(datastoreutils.EntityAppSettings, datastoreKeyName)
-
-		//save company info
-		_, err = client.Put(c, key, &d)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return store.Save(c, d)
 }
 
 //SaveDefaultInfo sets some default data when a company first starts using this app
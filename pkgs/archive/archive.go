@@ -0,0 +1,559 @@
+/*
+Package archive implements exporting all of the app's data to a portable file and importing
+that file into a database.
+
+This is used to move an install of this app between deployment types, for example from
+appengine (cloud datastore) to sqlite.  The archive is a newline delimited JSON file.  The
+first line is a header describing the archive, every following line is one record tagged with
+the kind of entity it holds.
+
+Unlike the JSON returned to the gui, the archive includes every field needed to fully restore
+the data: bcrypt password hashes, Stripe customer tokens, and the last used timestamp of each
+card.  Treat an archive file as you would the database itself.
+
+Datastore and database ids are not kept.  Each record is given a new id when it is imported.
+*/
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/card"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/users"
+)
+
+//formatVersion is the version of the archive format
+//this is incremented if the format of a record changes in a way older versions can't read
+const formatVersion = 1
+
+//kinds of records in an archive
+//these match the entity names used in the cloud datastore
+const (
+	kindHeader      = "header"
+	kindUsers       = "users"
+	kindCards       = "card"
+	kindCompanyInfo = "companyInfo"
+	kindAppSettings = "appSettings"
+)
+
+//maxLineSize is the longest a single record in an archive can be
+const maxLineSize = 1024 * 1024
+
+//errors
+var (
+	errMissingHeader       = errors.New("archive: file does not start with an archive header")
+	errUnsupportedVersion  = errors.New("archive: archive format version is not supported")
+	errUnknownKind         = errors.New("archive: unknown record kind")
+	errDatabaseNotEmpty    = errors.New("archive: the database already has users or cards, import into a new database")
+	errMissingPasswordHash = errors.New("archive: user is missing a bcrypt password hash")
+	errMissingStripeToken  = errors.New("archive: card is missing a stripe customer token")
+)
+
+//Stores is the set of database implementations data is exported from or imported into
+type Stores struct {
+	Cards       card.Store
+	Users       users.Store
+	Company     company.Store
+	AppSettings appsettings.Store
+}
+
+//header is the first line of an archive
+type header struct {
+	FormatVersion int    `json:"format_version"`
+	Exported      string `json:"datetime_exported"` //when the archive was created
+	Source        string `json:"source"`            //the deployment type the data was exported from
+}
+
+//record is one line of an archive
+type record struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+//userRecord is the archived format of a user
+//this differs from users.User since that hides the password from json
+type userRecord struct {
+	Username       string `json:"username"`
+	PasswordHash   string `json:"password_hash"`
+	AddCards       bool   `json:"add_cards"`
+	RemoveCards    bool   `json:"remove_cards"`
+	ChargeCards    bool   `json:"charge_cards"`
+	ViewReports    bool   `json:"view_reports"`
+	ManageDisputes bool   `json:"manage_disputes"`
+	Administrator  bool   `json:"is_admin"`
+	Active         bool   `json:"is_active"`
+	Created        string `json:"datetime_created"`
+}
+
+//cardRecord is the archived format of a card
+//this differs from card.CustomerDatastore since that hides the stripe token and timestamps from json
+type cardRecord struct {
+	CustomerID          string `json:"customer_id"`
+	CustomerName        string `json:"customer_name"`
+	Cardholder          string `json:"cardholder_name"`
+	CardExpiration      string `json:"card_expiration"`
+	CardLast4           string `json:"card_last4"`
+	StripeCustomerToken string `json:"stripe_customer_token"`
+	DatetimeCreated     string `json:"datetime_created"`
+	AddedByUser         string `json:"added_by"`
+	LastUsedTimestamp   int64  `json:"last_used_timestamp"`
+	Currency            string `json:"currency,omitempty"`
+	BillingEmail        string `json:"billing_email,omitempty"`
+
+	//the cards saved for this customer, blank for customers with just the one card above
+	Cards []savedCardRecord `json:"cards,omitempty"`
+
+	//the customer's scheduled charges
+	Schedules []scheduledChargeRecord `json:"scheduled_charges,omitempty"`
+}
+
+//savedCardRecord is the archived format of one of a customer's saved cards
+//this differs from card.SavedCard since that hides the stripe card id from json
+type savedCardRecord struct {
+	StripeCardID    string `json:"stripe_card_id"`
+	Cardholder      string `json:"cardholder_name"`
+	CardExpiration  string `json:"card_expiration"`
+	CardLast4       string `json:"card_last4"`
+	CardBrand       string `json:"card_brand"`
+	IsDefault       bool   `json:"is_default"`
+	DatetimeCreated string `json:"datetime_created"`
+	AddedByUser     string `json:"added_by"`
+	DatetimeUpdated string `json:"datetime_updated"`
+	UpdatedByUser   string `json:"updated_by"`
+}
+
+//scheduledChargeRecord is the archived format of one of a customer's scheduled charges
+//the card is saved as its position in the customer's cards since card ids aren't kept, the runs of
+//a schedule aren't archived since the charges they made are kept in Stripe
+type scheduledChargeRecord struct {
+	Card            int    `json:"card"` //the position of the charged card in Cards starting at 1, 0 for the customer's default card
+	AmountCents     int64  `json:"amount_cents"`
+	Currency        string `json:"currency"`
+	Interval        string `json:"interval"`
+	IntervalDays    int64  `json:"interval_days"`
+	StartDate       string `json:"start_date"`
+	EndDate         string `json:"end_date"`
+	InvoiceTemplate string `json:"invoice_template"`
+	PoTemplate      string `json:"po_template"`
+	NextRunDate     string `json:"next_run_date"`
+	Active          bool   `json:"active"`
+	RunCount        int64  `json:"run_count"`
+	LastRunDate     string `json:"last_run_date"`
+	LastRunStatus   string `json:"last_run_status"`
+	DatetimeCreated string `json:"datetime_created"`
+	CreatedByUser   string `json:"created_by"`
+}
+
+//Counts is the number of records of each kind that were exported or imported
+type Counts struct {
+	Users       int
+	Cards       int
+	CompanyInfo int
+	AppSettings int
+}
+
+//Export writes every user, card, the company info, and the app settings to w
+//source is the deployment type the data is being exported from and is only saved for reference
+func Export(ctx context.Context, s Stores, source string, w io.Writer) (Counts, error) {
+	counts := Counts{}
+	enc := json.NewEncoder(w)
+
+	//header
+	err := writeRecord(enc, kindHeader, header{
+		FormatVersion: formatVersion,
+		Exported:      timestamps.ISO8601(),
+		Source:        source,
+	})
+	if err != nil {
+		return counts, err
+	}
+
+	//users
+	userList, err := s.Users.FindAll(ctx)
+	if err != nil {
+		return counts, err
+	}
+	for _, u := range userList {
+		err := writeRecord(enc, kindUsers, userRecord{
+			Username:       u.Username,
+			PasswordHash:   u.Password,
+			AddCards:       u.AddCards,
+			RemoveCards:    u.RemoveCards,
+			ChargeCards:    u.ChargeCards,
+			ViewReports:    u.ViewReports,
+			ManageDisputes: u.ManageDisputes,
+			Administrator:  u.Administrator,
+			Active:         u.Active,
+			Created:        u.Created,
+		})
+		if err != nil {
+			return counts, err
+		}
+		counts.Users++
+	}
+
+	//cards
+	cards, err := s.Cards.FindAll(ctx)
+	if err != nil {
+		return counts, err
+	}
+	for _, c := range cards {
+		rec := cardRecord{
+			CustomerID:          c.CustomerID,
+			CustomerName:        c.CustomerName,
+			Cardholder:          c.Cardholder,
+			CardExpiration:      c.CardExpiration,
+			CardLast4:           c.CardLast4,
+			StripeCustomerToken: c.StripeCustomerToken,
+			DatetimeCreated:     c.DatetimeCreated,
+			AddedByUser:         c.AddedByUser,
+			LastUsedTimestamp:   c.LastUsedTimestamp,
+			Currency:            c.Currency,
+			BillingEmail:        c.BillingEmail,
+		}
+
+		savedCards, err := s.Cards.FindSavedCards(ctx, c.ID)
+		if err != nil {
+			return counts, err
+		}
+		for _, sc := range savedCards {
+			rec.Cards = append(rec.Cards, savedCardRecord{
+				StripeCardID:    sc.StripeCardID,
+				Cardholder:      sc.Cardholder,
+				CardExpiration:  sc.CardExpiration,
+				CardLast4:       sc.CardLast4,
+				CardBrand:       sc.CardBrand,
+				IsDefault:       sc.IsDefault,
+				DatetimeCreated: sc.DatetimeCreated,
+				AddedByUser:     sc.AddedByUser,
+				DatetimeUpdated: sc.DatetimeUpdated,
+				UpdatedByUser:   sc.UpdatedByUser,
+			})
+		}
+
+		schedules, err := s.Cards.FindScheduledCharges(ctx, c.ID)
+		if err != nil {
+			return counts, err
+		}
+		for _, sc := range schedules {
+			cardPosition := 0
+			for i, saved := range savedCards {
+				if saved.ID == sc.SavedCardID {
+					cardPosition = i + 1
+				}
+			}
+
+			rec.Schedules = append(rec.Schedules, scheduledChargeRecord{
+				Card:            cardPosition,
+				AmountCents:     sc.AmountCents,
+				Currency:        sc.Currency,
+				Interval:        sc.Interval,
+				IntervalDays:    sc.IntervalDays,
+				StartDate:       sc.StartDate,
+				EndDate:         sc.EndDate,
+				InvoiceTemplate: sc.InvoiceTemplate,
+				PoTemplate:      sc.PoTemplate,
+				NextRunDate:     sc.NextRunDate,
+				Active:          sc.Active,
+				RunCount:        sc.RunCount,
+				LastRunDate:     sc.LastRunDate,
+				LastRunStatus:   sc.LastRunStatus,
+				DatetimeCreated: sc.DatetimeCreated,
+				CreatedByUser:   sc.CreatedByUser,
+			})
+		}
+
+		err = writeRecord(enc, kindCards, rec)
+		if err != nil {
+			return counts, err
+		}
+		counts.Cards++
+	}
+
+	//company info
+	info, err := s.Company.Get(ctx)
+	if err != nil {
+		return counts, err
+	}
+	err = writeRecord(enc, kindCompanyInfo, info)
+	if err != nil {
+		return counts, err
+	}
+	counts.CompanyInfo++
+
+	//app settings
+	settings, err := s.AppSettings.Get(ctx)
+	if err != nil {
+		return counts, err
+	}
+	err = writeRecord(enc, kindAppSettings, settings)
+	if err != nil {
+		return counts, err
+	}
+	counts.AppSettings++
+
+	return counts, nil
+}
+
+//writeRecord writes one line to the archive
+func writeRecord(enc *json.Encoder, kind string, data interface{}) error {
+	j, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return enc.Encode(record{Kind: kind, Data: j})
+}
+
+//Import reads an archive from r and saves every record into the database
+//The database must not have any users or cards yet since ids are not kept and we
+//don't want to end up with duplicates.  The company info and app settings are
+//overwritten.  Every record is checked before anything is saved so that a bad
+//archive doesn't leave the database partially imported.
+func Import(ctx context.Context, s Stores, r io.Reader) (Counts, error) {
+	counts := Counts{}
+
+	//read and validate the full archive
+	var (
+		userList  []users.User
+		cards     []card.CustomerDatastore
+		saved     [][]card.SavedCard        //the saved cards of each card, same order as cards
+		schedules [][]scheduledChargeRecord //the scheduled charges of each card, same order as cards
+		info      *company.Info
+		settings  *appsettings.Settings
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	lineNum := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		lineNum++
+
+		var rec record
+		err := json.Unmarshal([]byte(line), &rec)
+		if err != nil {
+			log.Println("archive.Import - Could not parse line", lineNum)
+			return counts, err
+		}
+
+		//the first line must be the header
+		if lineNum == 1 {
+			if rec.Kind != kindHeader {
+				return counts, errMissingHeader
+			}
+
+			var h header
+			err := json.Unmarshal(rec.Data, &h)
+			if err != nil {
+				return counts, err
+			}
+			if h.FormatVersion < 1 || h.FormatVersion > formatVersion {
+				return counts, errUnsupportedVersion
+			}
+
+			log.Println("archive.Import - Archive exported from", h.Source, "at", h.Exported)
+			continue
+		}
+
+		switch rec.Kind {
+		case kindUsers:
+			var u userRecord
+			err := json.Unmarshal(rec.Data, &u)
+			if err != nil {
+				return counts, err
+			}
+			if !strings.HasPrefix(u.PasswordHash, "$2") {
+				log.Println("archive.Import - User", u.Username, "on line", lineNum)
+				return counts, errMissingPasswordHash
+			}
+
+			userList = append(userList, users.User{
+				Username:       u.Username,
+				Password:       u.PasswordHash,
+				AddCards:       u.AddCards,
+				RemoveCards:    u.RemoveCards,
+				ChargeCards:    u.ChargeCards,
+				ViewReports:    u.ViewReports,
+				ManageDisputes: u.ManageDisputes,
+				Administrator:  u.Administrator,
+				Active:         u.Active,
+				Created:        u.Created,
+			})
+
+		case kindCards:
+			var c cardRecord
+			err := json.Unmarshal(rec.Data, &c)
+			if err != nil {
+				return counts, err
+			}
+			if c.StripeCustomerToken == "" {
+				log.Println("archive.Import - Card for", c.CustomerName, "on line", lineNum)
+				return counts, errMissingStripeToken
+			}
+
+			cards = append(cards, card.CustomerDatastore{
+				CustomerID:          c.CustomerID,
+				CustomerName:        c.CustomerName,
+				Cardholder:          c.Cardholder,
+				CardExpiration:      c.CardExpiration,
+				CardLast4:           c.CardLast4,
+				StripeCustomerToken: c.StripeCustomerToken,
+				DatetimeCreated:     c.DatetimeCreated,
+				AddedByUser:         c.AddedByUser,
+				LastUsedTimestamp:   c.LastUsedTimestamp,
+				Currency:            c.Currency,
+				BillingEmail:        c.BillingEmail,
+			})
+
+			var savedCards []card.SavedCard
+			for _, sc := range c.Cards {
+				savedCards = append(savedCards, card.SavedCard{
+					StripeCardID:    sc.StripeCardID,
+					Cardholder:      sc.Cardholder,
+					CardExpiration:  sc.CardExpiration,
+					CardLast4:       sc.CardLast4,
+					CardBrand:       sc.CardBrand,
+					IsDefault:       sc.IsDefault,
+					DatetimeCreated: sc.DatetimeCreated,
+					AddedByUser:     sc.AddedByUser,
+					DatetimeUpdated: sc.DatetimeUpdated,
+					UpdatedByUser:   sc.UpdatedByUser,
+				})
+			}
+			saved = append(saved, savedCards)
+			schedules = append(schedules, c.Schedules)
+
+		case kindCompanyInfo:
+			var i company.Info
+			err := json.Unmarshal(rec.Data, &i)
+			if err != nil {
+				return counts, err
+			}
+			info = &i
+
+		case kindAppSettings:
+			var a appsettings.Settings
+			err := json.Unmarshal(rec.Data, &a)
+			if err != nil {
+				return counts, err
+			}
+			settings = &a
+
+		default:
+			log.Println("archive.Import - Kind", rec.Kind, "on line", lineNum)
+			return counts, errUnknownKind
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return counts, err
+	}
+	if lineNum == 0 {
+		return counts, errMissingHeader
+	}
+
+	//make sure the database is empty
+	existingUsers, err := s.Users.FindAll(ctx)
+	if err != nil {
+		return counts, err
+	}
+	existingCards, err := s.Cards.GetAll(ctx)
+	if err != nil {
+		return counts, err
+	}
+	if len(existingUsers) > 0 || len(existingCards) > 0 {
+		return counts, errDatabaseNotEmpty
+	}
+
+	//save the data
+	for _, u := range userList {
+		_, err := s.Users.Add(ctx, u)
+		if err != nil {
+			log.Println("archive.Import - Could not save user", u.Username)
+			return counts, err
+		}
+		counts.Users++
+	}
+
+	for i, c := range cards {
+		datastoreID, err := s.Cards.Add(ctx, c)
+		if err != nil {
+			log.Println("archive.Import - Could not save card for", c.CustomerName)
+			return counts, err
+		}
+		counts.Cards++
+
+		savedCardIDs := []int64{}
+		for _, sc := range saved[i] {
+			sc.CustomerDatastoreID = datastoreID
+			id, err := s.Cards.AddSavedCard(ctx, sc)
+			if err != nil {
+				log.Println("archive.Import - Could not save saved card for", c.CustomerName)
+				return counts, err
+			}
+			savedCardIDs = append(savedCardIDs, id)
+		}
+
+		//a schedule whose card isn't in the archive charges the default card
+		for _, sc := range schedules[i] {
+			var savedCardID int64
+			if sc.Card > 0 && sc.Card <= len(savedCardIDs) {
+				savedCardID = savedCardIDs[sc.Card-1]
+			}
+
+			_, err := s.Cards.AddScheduledCharge(ctx, card.ScheduledCharge{
+				CustomerDatastoreID: datastoreID,
+				SavedCardID:         savedCardID,
+				AmountCents:         sc.AmountCents,
+				Currency:            sc.Currency,
+				Interval:            sc.Interval,
+				IntervalDays:        sc.IntervalDays,
+				StartDate:           sc.StartDate,
+				EndDate:             sc.EndDate,
+				InvoiceTemplate:     sc.InvoiceTemplate,
+				PoTemplate:          sc.PoTemplate,
+				NextRunDate:         sc.NextRunDate,
+				Active:              sc.Active,
+				RunCount:            sc.RunCount,
+				LastRunDate:         sc.LastRunDate,
+				LastRunStatus:       sc.LastRunStatus,
+				DatetimeCreated:     sc.DatetimeCreated,
+				CreatedByUser:       sc.CreatedByUser,
+			})
+			if err != nil {
+				log.Println("archive.Import - Could not save scheduled charge for", c.CustomerName)
+				return counts, err
+			}
+		}
+	}
+
+	if info != nil {
+		err := s.Company.Save(ctx, *info)
+		if err != nil {
+			return counts, err
+		}
+		counts.CompanyInfo++
+	}
+
+	if settings != nil {
+		err := s.AppSettings.Save(ctx, *settings)
+		if err != nil {
+			return counts, err
+		}
+		counts.AppSettings++
+	}
+
+	return counts, nil
+}
@@ -23,11 +23,47 @@ type CustomerDatastore struct {
 	DatetimeCreated     string `json:"-"`                                  //when was this card added to the app
 	AddedByUser         string `json:"added_by"`                           //which user of the app saved the card
 	LastUsedTimestamp   int64  `json:"-"`                                  //the unix timestamp of the time the card was last charged, used to remove cards we don't use anymore (lost customer)
+	Currency            string `json:"currency"`                           //the currency this customer is charged in, blank to use the default currency from the app settings
+	BillingEmail        string `json:"billing_email"`                      //the email address of the customer's billing contact, optional, used to notify the customer
 
 	//fields not used in cloud datastore
 	ID int64 `json:"sqlite_user_id"`
 }
 
+//SavedCard is one of the cards saved for a customer
+//Every card for a customer is attached to the customer's one Stripe customer.  One card is the
+//default and is charged unless a different card is chosen.  The default card's details are also
+//saved to the CustomerDatastore so everything that only knows about one card keeps working.
+//Customers added before a customer could have more than one card don't have any saved cards
+//until a second card is added to them, see FindCards.
+//A saved card can also be a US bank account that is charged via ACH.  Bank accounts use the
+//same fields as cards: the cardholder is the account holder, the brand is the bank's name, and
+//there is no expiration.
+type SavedCard struct {
+	CustomerDatastoreID int64  `json:"customer_datastore_id"` //the datastore id of the customer this card belongs to
+	StripeCardID        string `json:"-"`                     //the id of the card on the Stripe customer, a PaymentMethod (pm_) or a legacy card source (card_), blank for the card of a customer without any saved cards
+	Cardholder          string `json:"cardholder_name"`       //the name on the card
+	CardExpiration      string `json:"card_expiration"`       //MM/YYYY
+	CardLast4           string `json:"card_last4"`
+	CardBrand           string `json:"card_brand"`
+	IsDefault           bool   `json:"is_default"` //true if this is the card that is charged if no card is chosen
+	DatetimeCreated     string `json:"-"`
+	AddedByUser         string `json:"added_by"`
+	DatetimeUpdated     string `json:"datetime_updated"`    //when the card was last replaced or changed, blank if never
+	UpdatedByUser       string `json:"updated_by"`          //which user of the app replaced the card, or "stripe" if the card's bank updated the card
+	PaymentType         string `json:"payment_type"`        //paymentTypeCard or paymentTypeBankAccount, blank for cards saved before bank accounts could be saved
+	BankAccountStatus   string `json:"bank_account_status"` //the status of a bank account on Stripe, a bank account can only be charged once it is verified, blank for cards
+
+	//fields not used in cloud datastore
+	ID int64 `datastore:"-" json:"id"`
+}
+
+//customerCards is a customer and all of its cards, used to build the gui
+type customerCards struct {
+	CustomerDatastore
+	Cards []SavedCard `json:"cards"` //the default card is first
+}
+
 //chargeSuccessful is used to return data to the gui when a charge is processed
 //This data shows which card was processed and some confirmation details.
 type chargeSuccessful struct {
@@ -36,11 +72,28 @@ type chargeSuccessful struct {
 	CardExpiration string `json:"card_expiration"`
 	CardLast4      string `json:"card_last4"`
 	Amount         string `json:"amount"`          //the amount of the charge as a dollar amount string
+	Currency       string `json:"currency"`        //the currency the amount was charged in
+	CurrencySymbol string `json:"currency_symbol"` //shown in front of the amount
 	Invoice        string `json:"invoice"`         //the invoice number to reference for this charge
 	Po             string `json:"po"`              //the po number to reference for this charge
 	Datetime       string `json:"datetime"`        //when the charge was processed
 	ChargeID       string `json:"charge_id"`       //the unique id returned by stripe for this charge, used to show a receipt if needed or process a refund
 	AuthorizedOnly bool   `json:"authorized_only"` //true if charge was authorized but not charged
+	PaymentType    string `json:"payment_type"`    //paymentTypeCard or paymentTypeBankAccount
+	Pending        bool   `json:"pending"`         //true if the charge was made but the money hasn't arrived yet, bank account (ACH) charges are pending for a few business days
+
+	//emailed receipt, blank if a receipt wasn't emailed
+	ReceiptEmailedTo  []string `json:"receipt_emailed_to,omitempty"`
+	ReceiptEmailError string   `json:"receipt_email_error,omitempty"` //a message for the user if the receipt could not be emailed
+}
+
+//refundSuccessful is the data returned when a refund is made
+type refundSuccessful struct {
+	RefundID string `json:"refund_id"`
+
+	//emailed receipt, blank if a receipt wasn't emailed
+	ReceiptEmailedTo  []string `json:"receipt_emailed_to,omitempty"`
+	ReceiptEmailError string   `json:"receipt_email_error,omitempty"` //a message for the user if the receipt could not be emailed
 }
 
 //List is used to return the list of cards available to be charged to build the gui
@@ -56,6 +109,8 @@ type ChargeData struct {
 	ID                 string              `json:"charge_id,omitempty"`          //the stripe charge id
 	AmountCents        int64               `json:"amount_cents,omitempty"`       //the amount of the charge in cents
 	AmountDollars      string              `json:"amount_dollars,omitempty"`     //amount of the charge in dollars (without $ symbol)
+	Currency           string              `json:"currency,omitempty"`           //lowercase three letter currency code
+	CurrencySymbol     string              `json:"currency_symbol,omitempty"`    //shown in front of amounts
 	Captured           bool                `json:"captured,omitempty"`           //determines if the charge was successfully placed on a real credit card
 	CapturedStr        string              `json:"captured_string,omitempty"`    //see above
 	Timestamp          string              `json:"timestamp,omitempty"`          //unix timestamp of the time that stripe charged the card
@@ -72,6 +127,13 @@ type ChargeData struct {
 	Level3DataProvided bool                `json:"level3_provided"`              //metadata from charge on if we provided level3 data
 	Level3             stripe.ChargeLevel3 `json:"level3"`                       //any level 3 charge data
 
+	//fees for a captured charge, from the Stripe balance transaction
+	FeeCents     int64  `json:"fee_cents,omitempty"`
+	FeeDollars   string `json:"fee_dollars,omitempty"`
+	NetCents     int64  `json:"net_cents,omitempty"` //the amount charged less the fee
+	NetDollars   string `json:"net_dollars,omitempty"`
+	FeeEstimated bool   `json:"fee_estimated"` //true if Stripe hasn't given us the fee yet so it was estimated from the company info fees
+
 	//data for automatically completed charges (api request charges)
 	AutoCharge         bool   `json:"auto_charge,omitempty"`          //true if we made this charge automatically through api request
 	AutoChargeReferrer string `json:"auto_charge_referrer,omitempty"` //the name of the app that requested the charge
@@ -82,6 +144,21 @@ type ChargeData struct {
 	AuthorizedDatetime string `json:"authorized_datetime"`
 	ProcessedDatetime  string `json:"processed_datetime"`
 
+	//data about an authorization that was released instead of captured
+	//an authorization that expired is released as well but without a user or reason
+	Released         bool   `json:"released"`
+	ReleasedByUser   string `json:"released_by_user"`
+	ReleasedDatetime string `json:"released_datetime"`
+	ReleaseReason    string `json:"release_reason"`
+
+	//data about how the customer paid
+	//bank account (ACH) charges are pending until the money arrives, the customer's bank can
+	//return the payment (i.e.: insufficient funds) while it is pending and the charge fails
+	PaymentType string `json:"payment_type"` //paymentTypeCard or paymentTypeBankAccount
+	Status      string `json:"status"`       //succeeded, pending, or failed
+	Pending     bool   `json:"pending"`
+	Returned    bool   `json:"returned"` //true if a bank account charge was returned by the customer's bank
+
 	//data used to differentiate between a not captured and failed charge and a non captured but authorized charge
 	//null if charge is successful or charge was authorized, if charged failed there will be some info
 	FailureCode    string
@@ -91,30 +168,387 @@ type ChargeData struct {
 //RefundData is the data from a refund that we use the build the gui
 //Stripe returns more info thatn we need so we use our own struct to organize the data better
 type RefundData struct {
-	Refunded      bool   //was this a refund, should always be true
-	AmountCents   int64  //the amount of the refund in cents, this amount can be less than or equal to the corresponding charge
-	AmountDollars string //amount of the refund in dollars (without $ symbol)
-	Timestamp     string //unix timestamp of the time that stripe refunded the card
-	Invoice       string //metadata field with extra info on the charge
-	LastFour      string //used to identify the card when looking at a report
-	Expiration    string //" " " "
-	Customer      string //name of the customer from the app engine datastore, name of the customer we charged
-	User          string //username of the user who refunded the card
-	Reason        string //why was the card refunded, this is a special value dictated by stripe
+	ID             string `json:"refund_id"`       //the stripe refund id
+	ChargeID       string `json:"charge_id"`       //the stripe charge id of the charge that was refunded
+	Refunded       bool   `json:"refunded"`        //was this a refund, should always be true
+	AmountCents    int64  `json:"amount_cents"`    //the amount of the refund in cents, this amount can be less than or equal to the corresponding charge
+	AmountDollars  string `json:"amount_dollars"`  //amount of the refund in dollars (without $ symbol)
+	Currency       string `json:"currency"`        //lowercase three letter currency code
+	CurrencySymbol string `json:"currency_symbol"` //shown in front of amounts
+	Timestamp      string `json:"timestamp"`       //unix timestamp of the time that stripe refunded the card
+	Invoice        string `json:"invoice_num"`     //metadata field with extra info on the charge
+	Po             string `json:"po_num"`          //" " " "
+	LastFour       string `json:"last4"`           //used to identify the card when looking at a report
+	Expiration     string `json:"expiration"`      //" " " "
+	CardBrand      string `json:"card_brand"`      //" " " "
+	Customer       string `json:"customer_name"`   //name of the customer from the app engine datastore, name of the customer we charged
+	CustomerID     string `json:"customer_id"`     //the CRM ID of the customer
+	User           string `json:"username"`        //username of the user who refunded the card
+	Reason         string `json:"reason"`          //why was the card refunded, this is a special value dictated by stripe
+	FeeCents       int64  `json:"fee_cents"`       //the fee Stripe returned to us for this refund, usually 0
+	FeeDollars     string `json:"fee_dollars"`
+	NetCents       int64  `json:"net_cents"` //the amount taken from our Stripe balance for this refund, the amount refunded less the fee returned
+	NetDollars     string `json:"net_dollars"`
+	FeeEstimated   bool   `json:"fee_estimated"` //true if Stripe hasn't given us the balance transaction for this refund yet
+}
+
+//dailyTotal is the total of the charges and refunds on one day of a report
+//The net amount is what Stripe will pay out to the bank for the day, assuming daily payouts.
+type dailyTotal struct {
+	Date           string `json:"date"`     //yyyy-mm-dd in the report's timezone
+	Currency       string `json:"currency"` //the currency of the amounts, a day has one total for each currency
+	CurrencySymbol string `json:"currency_symbol"`
+	Charges        string `json:"charges"` //total charged, in dollars
+	Refunds        string `json:"refunds"` //total refunded, in dollars
+	Fees           string `json:"fees"`    //fees for charges less fees returned for refunds, in dollars
+	Net            string `json:"net"`     //charges less refunds and fees, in dollars
+}
+
+//currencyTotal is the total of the charges or refunds in a report in one currency
+type currencyTotal struct {
+	Currency       string `json:"currency"`
+	CurrencySymbol string `json:"currency_symbol"`
+	Count          uint16 `json:"count"`     //number of charges or refunds in this currency
+	Amount         string `json:"amount"`    //total charged or refunded, in dollars
+	Fees           string `json:"fees"`      //fees Stripe took for charges, or returned for refunds, in dollars
+	LessFees       string `json:"less_fees"` //amount less fees, what we actually get from or pay to Stripe, in dollars
+
+	amountCents, feeCents, netCents int64
+}
+
+//payoutData is the data on one Stripe payout to the bank
+type payoutData struct {
+	ID             string //the stripe payout id
+	ArrivalDate    string //yyyy-mm-dd the payout is expected to arrive in the bank
+	AmountCents    int64  //the amount deposited in the bank
+	AmountDollars  string //amount deposited in dollars (without $ symbol)
+	Currency       string //the currency of the payout, every transaction in the payout is in this currency
+	CurrencySymbol string
+	Status         string //paid, pending, in_transit, canceled, or failed
+	Method         string //standard or instant
+	Description    string
+	Automatic      bool   //true if Stripe made the payout on the account's payout schedule, only these can be broken down into transactions
+	FailureMessage string //why the payout failed
+}
+
+//payoutsReportData is the data used to build the list of payouts
+type payoutsReportData struct {
+	StartDate    time.Time    //the range of arrival dates we are listing payouts for
+	EndDate      time.Time    // " " " "
+	Payouts      []payoutData //newest first, as Stripe returns them
+	NumPayouts   uint16
+	TotalPaidOut []currencyTotal //the total of paid and pending payouts for each currency, failed and canceled payouts are not included
+}
+
+//payoutLine is one transaction that makes up a payout
+//Charges and refunds are linked to the charge in the ledger so we can show the customer,
+//invoice, and po and link to the receipt.
+type payoutLine struct {
+	BalanceTransactionID string
+	Category             string //charge, refund, fee, or adjustment
+	Type                 string //the type of balance transaction from Stripe, gives more detail than category
+	Description          string
+	Timestamp            string //when the transaction was created, in the gui's timezone
+	AmountCents          int64  //positive for money added to our balance, negative for money taken out
+	AmountDollars        string
+	FeeCents             int64 //the fee Stripe took for this transaction, negative if a fee was returned to us
+	FeeDollars           string
+	NetCents             int64 //amount less fee, this is what the transaction adds to the payout
+	NetDollars           string
+	CurrencySymbol       string
+	SourceID             string //the stripe id of the charge, refund, dispute, etc. this transaction is for
+	ChargeID             string //the charge the transaction is for, used to link to the receipt
+	Customer             string
+	Invoice              string
+	Po                   string
+	LastFour             string
+}
+
+//payoutDetailData is the data used to build the breakdown of one payout
+type payoutDetailData struct {
+	Payout            payoutData
+	Lines             []payoutLine //oldest first
+	TotalCharges      string       //the amount charged, in dollars
+	TotalRefunds      string       //the amount refunded, in dollars, as a positive number
+	TotalFees         string       //fees for charges and any separate Stripe fees less fees returned, in dollars
+	TotalAdjustments  string       //disputes and other adjustments, in dollars, negative if money was taken from our balance
+	TotalNet          string       //what the transactions add up to, should match the payout amount
+	Reconciled        bool         //true if the transactions add up to the payout amount
+	NumCharges        uint16
+	NumRefunds        uint16
+	ReportGUITimezone string //this is the timezone used to format the timestamps
+}
+
+//disputeData is the data on one dispute of a charge
+//The dispute is linked to the charge in the ledger so we can show the customer, invoice, and po
+//and link to the receipt.
+type disputeData struct {
+	ID                  string //the stripe dispute id
+	ChargeID            string //the charge that was disputed, used to link to the receipt
+	Status              string //needs_response, under_review, won, lost, etc.
+	Reason              string //why the cardholder disputed the charge
+	NeedsResponse       bool   //true if evidence can still be saved and submitted
+	Created             string //when the dispute was opened, in the gui's timezone
+	DueBy               string //when evidence must be submitted by, in the gui's timezone
+	DaysLeft            int64  //days until evidence is due, negative once the due date has passed
+	PastDue             bool
+	AmountCents         int64 //the amount disputed, this is taken from our balance until the dispute is won
+	AmountDollars       string
+	CurrencySymbol      string
+	Customer            string
+	Invoice             string
+	Po                  string
+	LastFour            string
+	ChargedBy           string //the user who processed the disputed charge
+	HasEvidence         bool   //true if evidence has been saved for this dispute
+	SubmissionCount     int64  //the number of times evidence was submitted
+	Notes               string //the notes saved as evidence
+	ReceiptFileID       string //the stripe file saved as the receipt
+	AuthorizationFileID string //the stripe file saved as the cardholder's signed authorization
+	EvidenceBy          string //the user who last saved evidence
+	SubmittedBy         string //the user who submitted the evidence
+
+	dueBy int64 //unix timestamp of DueBy, used for sorting
+}
+
+//disputesListData is the data used to build the list of open disputes
+type disputesListData struct {
+	Disputes          []disputeData //disputes needing a response, soonest due first, then disputes under review
+	NumDisputes       uint16
+	NumNeedResponse   uint16
+	ReportGUITimezone string //this is the timezone used to format the timestamps
+}
+
+//disputeDetailData is the data used to build the page for one dispute
+type disputeDetailData struct {
+	Dispute           disputeData
+	MaxEvidenceSizeMB int    //the largest total size of the evidence files, shown to the user
+	ReportGUITimezone string //this is the timezone used to format the timestamps
+}
+
+//expiringCard is a card that expires soon
+//this is used in the expiring cards report and in the emails sent about expiring cards
+type expiringCard struct {
+	CustomerDatastoreID int64
+	CustomerID          string
+	CustomerName        string
+	BillingEmail        string
+	Cardholder          string
+	CardBrand           string
+	CardLast4           string
+	CardExpiration      string //MM/YYYY
+	IsDefault           bool
+	DaysLeft            int //the number of days until the end of the month the card expires in
+	OtherCards          int //the number of the customer's other cards that don't expire soon, if 0 the customer can't be charged once this card expires
+
+	//used for sorting
+	expires time.Time
+}
+
+//expiringCardsData is the data used to build the expiring cards report
+type expiringCardsData struct {
+	Months       int    //cards expiring in this month and the next Months-1 months are listed
+	Through      string //the last month cards are listed for, i.e.: January 2025
+	MonthChoices []int
+	Cards        []expiringCard //soonest to expire first
+	NumCards     int
+	NumNoOther   int //the number of cards whose customer has no other card that can be charged
+}
+
+//openAuthorization is a charge that was authorized but not captured or released yet
+type openAuthorization struct {
+	ChargeData
+	Expires     string //when Stripe releases the authorization if it isn't captured, in the gui's timezone
+	HoursLeft   int    //hours until the authorization expires
+	ExpiresSoon bool   //true if the authorization expires within authorizationWarning
+
+	expires time.Time
+}
+
+//authorizationsData is the data used to build the open authorizations page
+type authorizationsData struct {
+	UserData          users.User          //the logged in user, to show the capture and release links only if the user can charge cards
+	Authorizations    []openAuthorization //soonest to expire first
+	Totals            []currencyTotal     //the total amount authorized in each currency
+	NumAuthorizations int
+	NumExpiringSoon   int
+	EmailEnabled      bool
+	ReportGUITimezone string
+}
+
+//LedgerEntry is a charge or refund saved in our own db
+//Every charge, capture, and refund made through this app is saved to the ledger so that reports
+//and receipts don't need to look data up from Stripe.  Entries are always built from the charge
+//or refund object Stripe returns so an entry can be overwritten when it is synced again.
+type LedgerEntry struct {
+	StripeID             string //the id of the charge or refund in Stripe, this uniquely identifies an entry
+	Type                 string //ledgerTypeCharge or ledgerTypeRefund
+	StripeChargeID       string //the charge this entry is for, same as StripeID for charges
+	StripeCustomerToken  string //the stripe customer that was charged, used to filter reports by customer
+	CustomerID           string //the CRM ID of the customer, from the charge metadata
+	CustomerName         string //" " " "
+	AmountCents          int64  //the amount charged or refunded
+	AmountRefundedCents  int64  //the total amount refunded from a charge, always 0 for refunds
+	Currency             string
+	BalanceTransactionID string //the balance transaction for the charge or refund, blank until a charge is captured
+	FeeCents             int64  //the fee Stripe took for a charge, or returned for a refund as a negative number, from the balance transaction
+	NetCents             int64  //the amount after fees, negative for refunds
+	AvailableOn          int64  //unix timestamp of when the net amount can be paid out to the bank
+	Status               string //the status Stripe gives the charge or refund (succeeded, pending, failed)
+	Captured             bool   //false if a charge was only authorized or failed
+	FailureCode          string
+	FailureMessage       string `datastore:",noindex"`
+	Invoice              string
+	Po                   string
+	Cardholder           string
+	CardBrand            string
+	CardLast4            string
+	CardExpiration       string
+	PaymentType          string //paymentTypeCard or paymentTypeBankAccount, blank for entries saved before bank accounts could be charged
+	Username             string //the user who processed the charge or refund
+	AuthorizedByUser     string
+	AuthorizedDatetime   string
+	ProcessedDatetime    string
+	AutoCharge           bool
+	AutoChargeReferrer   string
+	AutoChargeReason     string
+	Level3Provided       bool
+	Reason               string //why a refund was made, blank for charges
+	Metadata             string `datastore:",noindex"` //all the metadata saved with the charge or refund as json
+	Created              int64  //unix timestamp of when Stripe created the charge or refund
+	DatetimeSynced       string //when this entry was last saved from Stripe's data
+
+	//fields not used in cloud datastore
+	ID int64 `datastore:"-"`
+}
+
+//WebhookEvent is an event from Stripe that was received via the webhook and handled
+//Stripe can send the same event more than once so events are saved to skip any event that
+//was already handled.
+type WebhookEvent struct {
+	StripeEventID     string //the id of the event in Stripe, this uniquely identifies an event
+	Type              string //the type of event, i.e.: charge.refunded
+	Created           int64  //unix timestamp of when Stripe created the event
+	DatetimeProcessed string //when the event was handled
+
+	//fields not used in cloud datastore
+	ID int64 `datastore:"-"`
+}
+
+//ScheduledCharge is a charge that is made on a repeating schedule, such as a monthly service contract
+//The scheduler charges every schedule whose NextRunDate is today or earlier.  Dates are
+//yyyy-mm-dd in the timezone set in the app settings.
+type ScheduledCharge struct {
+	CustomerDatastoreID int64  `json:"customer_datastore_id"` //the datastore id of the customer to charge
+	SavedCardID         int64  `json:"saved_card_id"`         //the saved card to charge, 0 to charge the customer's default card at the time of each charge
+	AmountCents         int64  `json:"amount_cents"`          //the amount to charge in the currency's smallest unit
+	Currency            string `json:"currency"`
+	Interval            string `json:"interval"`      //scheduleIntervalWeekly, scheduleIntervalMonthly, or scheduleIntervalCustom
+	IntervalDays        int64  `json:"interval_days"` //the number of days between charges for a custom interval, 0 otherwise
+	StartDate           string `json:"start_date"`    //the date of the first charge, later charges are counted from this date
+	EndDate             string `json:"end_date"`      //no charges are made after this date, blank to charge until the schedule is removed
+	InvoiceTemplate     string `json:"invoice_template"`
+	PoTemplate          string `json:"po_template"`
+	NextRunDate         string `json:"next_run_date"` //the date of the next charge, blank if the schedule has ended
+	Active              bool   `json:"active"`        //false if the schedule is paused or has ended
+	RunCount            int64  `json:"run_count"`     //the number of charges attempted, used for the {run} placeholder
+	LastRunDate         string `json:"last_run_date"`
+	LastRunStatus       string `json:"last_run_status"`
+	DatetimeCreated     string `json:"datetime_created"`
+	CreatedByUser       string `json:"created_by"`
+
+	//fields not used in cloud datastore
+	ID int64 `datastore:"-" json:"id"`
+}
+
+//ScheduledChargeRun is one attempt at charging a scheduled charge
+//A run is saved before the card is charged so the same date can't be charged twice, even if the
+//scheduler is run by more than one server at once.
+type ScheduledChargeRun struct {
+	ScheduledChargeID int64  `json:"scheduled_charge_id"`
+	RunDate           string `json:"run_date"`  //the date the charge was scheduled for, yyyy-mm-dd
+	Status            string `json:"status"`    //scheduleRunPending, scheduleRunSucceeded, or scheduleRunFailed
+	ChargeID          string `json:"charge_id"` //the id of the charge on Stripe, blank if the charge failed
+	AmountCents       int64  `json:"amount_cents"`
+	Currency          string `json:"currency"`
+	Invoice           string `json:"invoice"`
+	Po                string `json:"po"`
+	Error             string `json:"error" datastore:",noindex"` //why the charge failed
+	IdempotencyKey    string `json:"-"`
+	DatetimeStarted   string `json:"datetime_started"`
+	DatetimeFinished  string `json:"datetime_finished"`
+
+	//fields not used in cloud datastore
+	ID int64 `datastore:"-" json:"id"`
+}
+
+//BatchJob is a csv file of charges that is charged in the background
+//Charging a batch isn't tied to the request that started it so the rows are still charged if the
+//user leaves the page.  The id is a hash of the file so the same file is only charged once.
+type BatchJob struct {
+	BatchID          string `json:"batch_id"`
+	NumRows          int    `json:"num_rows"` //every row in the file, including the rows that are skipped
+	Username         string `json:"username"` //the user who charged the batch
+	DatetimeStarted  string `json:"datetime_started"`
+	DatetimeFinished string `json:"datetime_finished"` //blank until every row is charged or failed
+
+	//fields not used in cloud datastore
+	ID int64 `datastore:"-" json:"id"`
+}
+
+//BatchRow is one row of a csv file of charges and the outcome of charging it
+type BatchRow struct {
+	BatchID             string `json:"-"`
+	RowNumber           int    `json:"row"` //the row in the file, the header is row 1 if the file has one
+	CustomerID          string `json:"customer_id"`
+	CustomerName        string `json:"customer_name"`
+	CustomerDatastoreID int64  `json:"-"` //the customer to charge, looked up when the file is previewed
+	SavedCardID         int64  `json:"-"` //the card to charge, 0 charges the customer's default card
+	CardLast4           string `json:"card_last4"`
+	Amount              string `json:"amount"` //the amount formatted with the currency's decimal places
+	AmountCents         int64  `json:"amount_cents"`
+	Currency            string `json:"currency"`
+	Invoice             string `json:"invoice"`
+	Po                  string `json:"po"`
+	Level3              bool   `json:"level3_provided"`
+	Level3Params        string `json:"-" datastore:",noindex"`           //the level 3 data as json
+	Status              string `json:"status"`                           //valid or invalid in a preview, then pending, charging, charged, failed, or skipped once charged
+	ChargeID            string `json:"charge_id"`                        //the id of the charge on Stripe
+	Error               string `json:"error" datastore:",noindex"`       //why the row is invalid or the decline reason if the charge failed
+	EmailError          string `json:"email_error" datastore:",noindex"` //why the receipt couldn't be emailed, the row was still charged
+	DatetimeStarted     string `json:"datetime_started"`                 //when charging the row started, used to tell if the server charging it stopped
+	DatetimeFinished    string `json:"datetime_finished"`
+
+	//fields not used in cloud datastore
+	ID int64 `datastore:"-" json:"id"`
+}
+
+//LedgerFilter is the set of filters used to look up entries in the ledger
+type LedgerFilter struct {
+	Type                string //ledgerTypeCharge or ledgerTypeRefund
+	Start               int64  //unix timestamp, inclusive
+	End                 int64  //unix timestamp, inclusive
+	StripeCustomerToken string //optional, only return entries for this stripe customer
+	AfterCreated        int64  //optional, with AfterStripeID only return entries after this entry, used to get a page of entries
+	AfterStripeID       string //" " " "
+	Limit               int    //optional, the most entries to return, 0 returns every entry
 }
 
 //reportData is used to build the report UI
 type reportData struct {
-	UserData             users.User   `json:"user_data"`              //the data for the logged in user, so we can show/hide certain UI elements based on the user's access rights.
-	StartDate            time.Time    `json:"start_datetime"`         //The datetime we are filtering for getting report data to limit the days a report gets data for.
-	EndDate              time.Time    `json:"end_datetime"`           // " " " "
-	Charges              []ChargeData `json:"charges"`                //Data for each charge for the report, this is a bunch of "rows" from Stripe
-	Refunds              []RefundData `json:"refunds"`                //Data for each refund for the report, similar to Charges above
-	TotalCharges         string       `json:"total_amount"`           //The total amount of all charges within the report date range
-	TotalChargesLessFees string       `json:"total_amount_less_fees"` //Deducting fees to show what amount we will actually get from Stripe
-	TotalRefunds         string       `json:"total_refund"`           //How much money we refunded.
-	TotalRefundsLessFees string       `json:"total_refund_less_fees"` //How much money we will actually get back from Stripe.
-	NumCharges           uint16       `json:"num_charges"`            //Number of charges within the report date range
-	NumRefunds           uint16       `json:"num_refunds"`            //Same as above but for refunds
-	ReportGUITimezone    string       `json:"reprot_gui_timezone"`    //this is the timezone used to format the timestamps on the report
+	UserData          users.User      `json:"user_data"`           //the data for the logged in user, so we can show/hide certain UI elements based on the user's access rights.
+	StartDate         time.Time       `json:"start_datetime"`      //The datetime we are filtering for getting report data to limit the days a report gets data for.
+	EndDate           time.Time       `json:"end_datetime"`        // " " " "
+	Charges           []ChargeData    `json:"charges"`             //Data for each charge for the report, this is a bunch of "rows" from Stripe
+	Refunds           []RefundData    `json:"refunds"`             //Data for each refund for the report, similar to Charges above
+	ChargeTotals      []currencyTotal `json:"charge_totals"`       //The total amount of charges, the fees Stripe took, and the amount less fees for each currency
+	RefundTotals      []currencyTotal `json:"refund_totals"`       //The total amount refunded, the fees Stripe returned, and the amount taken from our Stripe balance for each currency
+	DailyTotals       []dailyTotal    `json:"daily_totals"`        //The net amount for each day, this should match the amount deposited in the bank for the day
+	NumEstimatedFees  uint16          `json:"num_estimated_fees"`  //Number of charges and refunds whose fees were estimated
+	NumCharges        uint16          `json:"num_charges"`         //Number of charges within the report date range
+	NumRefunds        uint16          `json:"num_refunds"`         //Same as above but for refunds
+	ReportGUITimezone string          `json:"reprot_gui_timezone"` //this is the timezone used to format the timestamps on the report
+	EmailEnabled      bool            `json:"email_enabled"`       //true if emails can be sent, used to show the input for emailing a refund's receipt
+	Timezone          string          `json:"timezone"`            //the user's timezone the report was requested in, used to export the report with the same filters
+	CustomerFilterID  string          `json:"customer_filter_id"`  //the datastore id of the customer the report is filtered by, blank for all customers, " " " "
 }
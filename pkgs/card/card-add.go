@@ -6,13 +6,13 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
 	"github.com/stripe/stripe-go/v72"
 )
@@ -23,7 +23,15 @@ import (
 //The card token was generated client side by stripe.js.  Stripe.js takes the card
 //number, expiration, and security code and sends it to Stripe.  It returns a token
 //for us to use.  This makes it so we never "touch" or save the actually card information.
+//The token is saved to the Stripe customer as a PaymentMethod set up for off session
+//charges, see savePaymentMethod.
 //The customer ID that we get back from Stripe is used to process charges in the future.
+//If a customer with the same customer ID already exists, the card is added to that customer
+//instead so a customer can have more than one card.
+//A US bank account can be added instead of a card.  stripe.js creates a bank account token from
+//the routing and account numbers and the bank account is saved the same as a card, see
+//saveBankAccount.  Bank accounts don't expire, are only charged in USD, and must be verified
+//before they can be charged, see VerifyBankAccount.
 func Add(w http.ResponseWriter, r *http.Request) {
 	//get form values
 	customerID := r.FormValue("customerId")     //a unique key for the card, not the datastore id or stripe customer id
@@ -32,6 +40,13 @@ func Add(w http.ResponseWriter, r *http.Request) {
 	cardToken := r.FormValue("cardToken")       //from stripe.js
 	cardExp := r.FormValue("cardExp")           //from stripe.js, not from html input
 	cardLast4 := r.FormValue("cardLast4")       //from stripe.js, not from html input
+	currency := r.FormValue("currency")         //the currency this customer is charged in, blank to use the default currency
+	billingEmail := r.FormValue("billingEmail") //the customer's billing contact, optional
+	paymentType := r.FormValue("paymentType")   //card or bank_account, blank for a card
+	bankName := r.FormValue("bankName")         //from stripe.js, only for bank accounts
+
+	//only used when adding a card to an existing customer
+	makeDefault, _ := strconv.ParseBool(r.FormValue("makeDefault"))
 
 	//make sure all form values were given
 	if len(customerName) == 0 {
@@ -46,7 +61,14 @@ func Add(w http.ResponseWriter, r *http.Request) {
 		output.Error(errMissingCardToken, "A serious error occured; the card token is missing. Please refresh the page and try again.", w)
 		return
 	}
-	if len(cardExp) == 0 {
+	if paymentType == "" {
+		paymentType = paymentTypeCard
+	}
+	if paymentType != paymentTypeCard && paymentType != paymentTypeBankAccount {
+		output.Error(errMissingInput, "The payment type must be card or bank_account.", w)
+		return
+	}
+	if len(cardExp) == 0 && paymentType == paymentTypeCard {
 		output.Error(errMissingExpiration, "The card's expiration date is missing from Stripe. Please refresh the page and try again.", w)
 		return
 	}
@@ -54,6 +76,27 @@ func Add(w http.ResponseWriter, r *http.Request) {
 		output.Error(errMissingLast4, "The card's last four digits are missing from Stripe. Please refresh the page and try again.", w)
 		return
 	}
+	currency, err := normalizeCurrency(currency)
+	if err != nil {
+		output.Error(err, "The currency must be a three letter currency code, i.e.: USD. Leave it blank to use the default currency.", w)
+		return
+	}
+
+	//bank accounts are only charged in usd so customers added with a bank account are charged in usd
+	if paymentType == paymentTypeBankAccount {
+		if currency != "" && currency != bankAccountCurrency {
+			output.Error(errBankAccountCurrency, "Bank accounts can only be charged in USD. Leave the currency blank or use USD.", w)
+			return
+		}
+
+		currency = bankAccountCurrency
+		cardExp = ""
+	}
+	billingEmail = strings.TrimSpace(billingEmail)
+	if billingEmail != "" && !emailutils.IsValidAddress(billingEmail) {
+		output.Error(errInvalidBillingEmail, "The billing email must be a single, valid email address. Leave it blank if the customer does not have one.", w)
+		return
+	}
 
 	//need to adjust context deadline in case stripe takes longer than 5 seconds
 	//default timeout is 5 seconds
@@ -65,17 +108,47 @@ func Add(w http.ResponseWriter, r *http.Request) {
 	c, cancelFunc := context.WithTimeout(c, 10*time.Second)
 	defer cancelFunc()
 
-	//if customerID was given, make sure it is unique
+	//get username of logged in user
+	//used for tracking who added a card, just for diagnostics
+	username := sessionutils.GetUsername(r)
+
+	//the card or bank account being added
+	newCard := newSavedCard(cardholder, cardExp, cardLast4, username)
+	newCard.PaymentType = paymentType
+	if paymentType == paymentTypeBankAccount {
+		newCard.CardBrand = bankName
+	}
+
+	//if customerID was given, check if this customer already exists
 	//this id should be unique in the company's crm
 	//the customerID is used to autofill the charge card panel when performing the api-like semi-automated charges or fully automatic charges
+	//if the customer exists, the card is added to the existing customer as another card instead
 	if len(customerID) != 0 {
-		_, err := FindByCustomerID(c, customerID)
+		existing, err := FindByCustomerID(c, customerID)
 		if err == nil {
-			//customer already exists
-			output.Error(errCustIDAlreadyExists, "This customer ID is already in use. Please double check your records or remove the customer with this customer ID first.", w)
+			_, err := addCardToCustomer(c, existing, newCard, cardToken, makeDefault)
+			if err == errCardAlreadyExists {
+				output.Error(err, "This card or bank account is already saved for this customer.", w)
+				return
+			} else if err != nil {
+				errorErr, errorMsg := addError(err)
+				output.Error(errorErr, errorMsg, w)
+				return
+			}
+
+			//save the billing email if one was given so it can be added to existing customers
+			//not returning on error since the card was already saved
+			if billingEmail != "" && billingEmail != existing.BillingEmail {
+				err = store.UpdateBillingEmail(c, existing.ID, billingEmail)
+				if err != nil {
+					log.Println("card.Add - could not save billing email", err)
+				}
+			}
+
+			output.Success("addCardToCustomer", nil, w)
 			return
 		} else if err != errCustomerNotFound {
-			output.Error(err, "An error occured while verifying this customer ID does not already exist. Please try again or leave the customer ID blank.", w)
+			output.Error(err, "An error occured while checking if this customer ID already exists. Please try again or leave the customer ID blank.", w)
 			return
 		}
 	}
@@ -84,47 +157,34 @@ func Add(w http.ResponseWriter, r *http.Request) {
 	sc := CreateStripeClient(c)
 
 	//create the customer on stripe
-	//assigns the card via the cardToken to this customer
+	//the card is saved to the customer as a payment method via a setup intent, a bank account is
+	//saved as a source
 	//this card is used when making charges to this customer
-	custParams := &stripe.CustomerParams{
+	cust, err := sc.Customers.New(&stripe.CustomerParams{
 		Description: stripe.String(customerName),
+	})
+	if err != nil {
+		errorErr, errorMsg := addError(err)
+		output.Error(errorErr, errorMsg, w)
+		return
 	}
-	custParams.SetSource(cardToken)
-	cust, err := sc.Customers.New(custParams)
+
+	err = saveToStripe(sc, cust.ID, cardToken, &newCard)
 	if err != nil {
-		var errorErr error
-		errorMsg := ""
-
-		switch err.(type) {
-		default:
-			errorErr = errors.New("unknown error while adding card")
-			errorMsg = "There was an error adding this card.  Please contact the administrator."
-
-		case *stripe.Error:
-			stripeError := err.(*stripe.Error)
-			stripeErrorErr := stripeError.Err
-			stripeErrorMsg := stripeError.Msg
-			log.Println("card.Add", stripeError)
-
-			errorErr = stripeErrorErr
-			errorMsg = stripeErrorMsg
-
-		case *url.Error:
-			urlError := err.(*url.Error)
-			urlErrorErr := urlError.Err
-			log.Println("card.Add", urlError)
-
-			errorErr = urlErrorErr
-			errorMsg = "A url error occured (" + urlError.Error() + "). Contact the administrator to diagnose this issue."
-		}
+		//remove the customer so we don't leave a customer without a card on stripe
+		removeFromStripe(c, cust.ID)
 
+		errorErr, errorMsg := addError(err)
 		output.Error(errorErr, errorMsg, w)
 		return
 	}
 
-	//get username of logged in user
-	//used for tracking who added a card, just for diagnostics
-	username := sessionutils.GetUsername(r)
+	//make the card the default so charges made from the stripe dashboard use it
+	//not returning on error since we always charge the saved card by its id
+	err = setDefaultOnStripe(sc, cust.ID, newCard.StripeCardID)
+	if err != nil {
+		log.Println("card.Add - could not set default card on stripe", err)
+	}
 
 	//gather data to save to db
 	newCustomer := CustomerDatastore{
@@ -137,81 +197,51 @@ func Add(w http.ResponseWriter, r *http.Request) {
 		DatetimeCreated:     timestamps.ISO8601(),
 		AddedByUser:         username,
 		LastUsedTimestamp:   timestamps.Unix(),
+		Currency:            currency,
+		BillingEmail:        billingEmail,
 	}
 
-	//use correct db for saving
-	if sqliteutils.Config.UseSQLite {
-		_, err = saveSqlite(newCustomer)
-	} else {
-		newCustKey := datastoreutils.GetNewIncompleteKey(datastoreutils.EntityCards)
-		_, err = saveDatatore(c, newCustKey, newCustomer)
-	}
-
+	//save to db
+	datastoreID, err := store.Add(c, newCustomer)
 	if err != nil {
 		output.Error(err, "There was an error while saving this customer/card. Please try again.", w)
 		return
 	}
 
+	//save the card as the customer's default card
+	//the customer is already saved so just log an error, the card is still saved on the customer
+	newCard.CustomerDatastoreID = datastoreID
+	newCard.IsDefault = true
+	_, err = store.AddSavedCard(c, newCard)
+	if err != nil {
+		log.Println("card.Add - could not save card for new customer", err)
+	}
+
 	//customer saved
 	//return to client
 	output.Success("createCustomer", nil, w)
 }
 
-//saveDatatore saves a new card to the cloud datastore db
-func saveDatatore(c context.Context, key *datastore.Key, customer CustomerDatastore) (*datastore.Key, error) {
-	//connect to datastore
-	client, err := datastoreutils.Connect(c)
-	if err != nil {
-		return key, err
+//addError gets the error and message to show when a card could not be added on Stripe
+func addError(err error) (error, string) {
+	if err == errRequiresAction {
+		return err, "The cardholder's bank requires the cardholder to authenticate this card (3-D Secure) before it can be saved. This cannot be done here, please use a different card."
 	}
 
-	//save to datastore
-	completeKey, err := client.Put(c, key, &customer)
-	if err != nil {
-		return completeKey, err
-	}
+	switch err.(type) {
+	default:
+		return errors.New("unknown error while adding card"), "There was an error adding this card.  Please contact the administrator."
 
-	//done
-	return completeKey, nil
-}
+	case *stripe.Error:
+		stripeError := err.(*stripe.Error)
+		log.Println("card.Add", stripeError)
 
-//saveSqlite saves a new card to the sqlite db
-func saveSqlite(d CustomerDatastore) (int64, error) {
-	c := sqliteutils.Connection
-	q := `
-		INSERT INTO ` + sqliteutils.TableCards + ` (
-			CustomerID,
-			CustomerName,
-			Cardholder,
-			CardExpiration,
-			CardLast4,
-			StripeCustomerToken,
-			DatetimeCreated,
-			AddedByUser,
-			LastUsedTimestamp
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
-
-	stmt, err := c.Prepare(q)
-	if err != nil {
-		return 0, err
-	}
-
-	res, err := stmt.Exec(
-		d.CustomerID,
-		d.CustomerName,
-		d.Cardholder,
-		d.CardExpiration,
-		d.CardLast4,
-		d.StripeCustomerToken,
-		d.DatetimeCreated,
-		d.AddedByUser,
-		d.LastUsedTimestamp,
-	)
-	if err != nil {
-		return 0, err
-	}
+		return stripeError.Err, stripeError.Msg
 
-	id, err := res.LastInsertId()
-	return id, err
+	case *url.Error:
+		urlError := err.(*url.Error)
+		log.Println("card.Add", urlError)
+
+		return urlError.Err, "A url error occured (" + urlError.Error() + "). Contact the administrator to diagnose this issue."
+	}
 }
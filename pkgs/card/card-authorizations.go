@@ -0,0 +1,308 @@
+package card
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/users"
+	"github.com/stripe/stripe-go/v72"
+)
+
+//authorizationLifetime is how long Stripe holds the funds of a charge that was authorized but not captured
+//Stripe releases the authorization once this time has passed and the charge can't be captured anymore.
+const authorizationLifetime = 7 * 24 * time.Hour
+
+//authorizationWarning is how long before an authorization expires that it is shown as expiring soon
+//and included in the email warning about expiring authorizations
+const authorizationWarning = 24 * time.Hour
+
+//authorizationExpiresFormat is the format of the time an authorization expires in the gui and emails
+const authorizationExpiresFormat = "2006-01-02 @ 3:04PM MST"
+
+//maxReleaseNotesLength is the longest notes saved when releasing an authorization
+//Stripe limits metadata values to 500 characters
+const maxReleaseNotesLength = 500
+
+//authorization errors
+var (
+	errAlreadyCaptured       = errors.New("card: charge already captured")
+	errAuthorizationReleased = errors.New("card: authorization already released")
+	errInvalidCaptureAmount  = errors.New("card: invalid amount to capture")
+	errInvalidReleaseReason  = errors.New("card: invalid release reason")
+)
+
+//releaseReasons are the reasons an authorization can be released for
+//these are the cancellation reasons Stripe accepts for a payment intent
+var releaseReasons = map[string]bool{
+	string(stripe.PaymentIntentCancellationReasonAbandoned):           true,
+	string(stripe.PaymentIntentCancellationReasonDuplicate):           true,
+	string(stripe.PaymentIntentCancellationReasonFraudulent):          true,
+	string(stripe.PaymentIntentCancellationReasonRequestedByCustomer): true,
+}
+
+//Release releases the hold on a card from a charge that was authorized but not captured
+//The charge is never captured and the customer's bank removes the hold on the funds right away
+//instead of waiting for the authorization to expire.  Who released the hold, when, and why are
+//saved to the charge's metadata.  Authorizations made via a payment intent are released by
+//canceling the payment intent.  Older authorizations without one are released by refunding them.
+func Release(w http.ResponseWriter, r *http.Request) {
+	//get inputs
+	chargeID := strings.TrimSpace(r.FormValue("chargeID"))
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	notes := strings.TrimSpace(r.FormValue("notes"))
+
+	//validation
+	if chargeID == "" {
+		output.Error(errMissingInput, "A charge ID was not provided. This is a serious error. Please contact an administrator.", w)
+		return
+	}
+	if reason == "" {
+		reason = string(stripe.PaymentIntentCancellationReasonAbandoned)
+	}
+	if !releaseReasons[reason] {
+		output.Error(errInvalidReleaseReason, "The reason must be abandoned, duplicate, fraudulent, or requested_by_customer.", w)
+		return
+	}
+	if len(notes) > maxReleaseNotesLength {
+		notes = notes[:maxReleaseNotesLength]
+	}
+
+	//get stripe client
+	ctx := r.Context()
+	sc := CreateStripeClient(ctx)
+
+	//make sure the charge can be released
+	authChg, err := sc.Charges.Get(chargeID, nil)
+	if err != nil {
+		output.Error(err, "Could not look up the charge to release.", w)
+		return
+	}
+	if authChg.Captured {
+		output.Error(errAlreadyCaptured, "This charge was already captured. Refund the charge instead.", w)
+		return
+	}
+	if authChg.Refunded {
+		output.Error(errAuthorizationReleased, "This authorization was already released.", w)
+		return
+	}
+
+	//note who released the hold and why
+	//this is done before releasing so the notes are saved even if the webhook saves the charge first
+	username := sessionutils.GetUsername(r)
+	params := &stripe.ChargeParams{}
+	params.AddMetadata("released_by", username)
+	params.AddMetadata("released_date", timestamps.ISO8601())
+	params.AddMetadata("release_reason", reason)
+	params.AddMetadata("release_notes", notes)
+	_, err = sc.Charges.Update(chargeID, params)
+	if err != nil {
+		output.Error(err, "Could not save who released this authorization. The authorization was not released.", w)
+		return
+	}
+
+	//release the hold
+	if authChg.PaymentIntent != nil {
+		_, err = sc.PaymentIntents.Cancel(authChg.PaymentIntent.ID, &stripe.PaymentIntentCancelParams{
+			CancellationReason: stripe.String(reason),
+		})
+	} else {
+		refundParams := &stripe.RefundParams{
+			Charge: stripe.String(chargeID),
+		}
+		if reason != string(stripe.PaymentIntentCancellationReasonAbandoned) {
+			refundParams.Reason = stripe.String(reason)
+		}
+		_, err = sc.Refunds.New(refundParams)
+	}
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			output.Error(errStripe, "Could not release this authorization: "+stripeErr.Msg, w)
+			return
+		}
+
+		output.Error(err, "Could not release this authorization.", w)
+		return
+	}
+
+	log.Println("card.Release - authorization", chargeID, "released by", username, "reason", reason)
+
+	//update the charge in the ledger so it is no longer shown as waiting to be captured
+	err = syncCharge(ctx, chargeID)
+	if err != nil {
+		log.Println("card.Release - could not save charge to ledger", err)
+	}
+
+	output.Success("authorizationReleased", nil, w)
+}
+
+//Authorizations lists the charges that were authorized but not captured or released yet
+//Each authorization shows how long is left before Stripe releases it, the ones that expire
+//soonest first, so they can be captured or released before they are forgotten.
+func Authorizations(w http.ResponseWriter, r *http.Request) {
+	c := r.Context()
+	guiLoc, timezone := guiTimezone(r)
+	auths, err := findOpenAuthorizations(c, time.Now(), guiLoc)
+	if err != nil {
+		output.Error(err, "Could not look up the open authorizations.", w)
+		return
+	}
+
+	sums := currencySums{}
+	numExpiringSoon := 0
+	for _, a := range auths {
+		sums.add(a.Currency, a.AmountCents, 0, 0)
+		if a.ExpiresSoon {
+			numExpiringSoon++
+		}
+	}
+
+	//get logged in user's data
+	//the capture and release links are only shown if the user can charge cards
+	userdata, _ := users.Find(c, sessionutils.GetUserID(r))
+
+	result := authorizationsData{
+		UserData:          userdata,
+		Authorizations:    auths,
+		Totals:            sums.totals(),
+		NumAuthorizations: len(auths),
+		NumExpiringSoon:   numExpiringSoon,
+		EmailEnabled:      emailutils.Enabled(),
+		ReportGUITimezone: timezone,
+	}
+
+	templates.Load(w, "authorizations", result)
+}
+
+//NotifyExpiringAuthorizations emails the app's administrators a list of the authorizations that
+//expire within a day so they can be captured or released before Stripe releases them.  Nothing is
+//sent if no authorizations expire soon.
+//This is designed to be run once a day as a cron task, each authorization is then listed in one email.
+func NotifyExpiringAuthorizations(w http.ResponseWriter, r *http.Request) {
+	if !emailutils.Enabled() {
+		output.Error(errEmailNotEnabled, "An SMTP server is not set in app.yaml so emails cannot be sent.", w)
+		return
+	}
+
+	c := r.Context()
+	guiLoc, _ := guiTimezone(r)
+	auths, err := findOpenAuthorizations(c, time.Now(), guiLoc)
+	if err != nil {
+		output.Error(err, "Could not look up the open authorizations.", w)
+		return
+	}
+
+	expiring := []openAuthorization{}
+	for _, a := range auths {
+		if a.ExpiresSoon {
+			expiring = append(expiring, a)
+		}
+	}
+	if len(expiring) == 0 {
+		log.Println("card.NotifyExpiringAuthorizations - No authorizations expire soon")
+		output.Success("expiringAuthorizationsNotified", map[string]int{"authorizations": 0, "admins": 0}, w)
+		return
+	}
+
+	admins, err := users.FindAdminEmails(c)
+	if err != nil {
+		output.Error(err, "Could not look up the administrators to email.", w)
+		return
+	}
+	if len(admins) == 0 {
+		log.Println("card.NotifyExpiringAuthorizations - No administrators have an email address as their username")
+		output.Success("expiringAuthorizationsNotified", map[string]int{"authorizations": len(expiring), "admins": 0}, w)
+		return
+	}
+
+	err = emailutils.Send(emailutils.Message{
+		To:      admins,
+		Subject: strconv.Itoa(len(expiring)) + " authorization(s) expire within " + strconv.Itoa(int(authorizationWarning.Hours())) + " hours",
+		Body:    expiringAuthorizationsDigest(expiring),
+	})
+	if err != nil {
+		log.Println("card.NotifyExpiringAuthorizations - Could not email administrators", err)
+		output.Error(err, "Could not email the administrators.", w)
+		return
+	}
+
+	log.Println("card.NotifyExpiringAuthorizations...done", len(expiring), "authorization(s),", len(admins), "administrator(s)")
+	output.Success("expiringAuthorizationsNotified", map[string]int{"authorizations": len(expiring), "admins": len(admins)}, w)
+}
+
+//findOpenAuthorizations looks up the charges that were authorized but not captured, released,
+//or expired yet from the ledger
+func findOpenAuthorizations(ctx context.Context, now time.Time, guiLoc *time.Location) ([]openAuthorization, error) {
+	entries, err := store.FindLedgerEntries(ctx, LedgerFilter{
+		Type:  ledgerTypeCharge,
+		Start: now.Add(-authorizationLifetime).Unix(),
+		End:   now.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	auths := []openAuthorization{}
+	for _, e := range entries {
+		d := e.chargeData()
+		if d.Captured || d.Released || d.FailureCode != "" {
+			continue
+		}
+
+		expires := time.Unix(e.Created, 0).Add(authorizationLifetime)
+		if !expires.After(now) {
+			continue
+		}
+
+		if t, err := reportTimestamp(d.Timestamp, guiLoc, "2006-01-02 @ 3:04:05PM"); err == nil {
+			d.Timestamp = t
+		}
+
+		left := expires.Sub(now)
+		auths = append(auths, openAuthorization{
+			ChargeData:  d,
+			Expires:     expires.In(guiLoc).Format(authorizationExpiresFormat),
+			HoursLeft:   int(left.Hours()),
+			ExpiresSoon: left <= authorizationWarning,
+			expires:     expires,
+		})
+	}
+
+	sort.SliceStable(auths, func(i, j int) bool {
+		return auths[i].expires.Before(auths[j].expires)
+	})
+
+	return auths, nil
+}
+
+//expiringAuthorizationsDigest builds the body of the email sent to administrators
+func expiringAuthorizationsDigest(auths []openAuthorization) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "The following %d authorization(s) expire within %d hours.\n", len(auths), int(authorizationWarning.Hours()))
+	b.WriteString("Capture or release each one from Open Authorizations in the Reports panel before it expires.\n")
+	b.WriteString("Once an authorization expires the hold on the customer's funds is released and the charge can't be captured.\n\n")
+
+	for _, a := range auths {
+		fmt.Fprintf(&b, "%s%s %s - %s", a.CurrencySymbol, a.AmountDollars, strings.ToUpper(a.Currency), a.Customer)
+		if a.CustomerID != "" {
+			fmt.Fprintf(&b, " [%s]", a.CustomerID)
+		}
+		fmt.Fprintf(&b, "\n    expires %s (%d hour(s) left)\n", a.Expires, a.HoursLeft)
+		fmt.Fprintf(&b, "    authorized by %s on %s, invoice %s, po %s\n", a.AuthorizedByUser, a.Timestamp, a.Invoice, a.Po)
+		fmt.Fprintf(&b, "    charge %s\n", a.ID)
+	}
+
+	return b.String()
+}
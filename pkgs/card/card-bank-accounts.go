@@ -0,0 +1,208 @@
+package card
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+//payment types
+//these are the kinds of things a customer can be charged with
+const (
+	paymentTypeCard        = "card"
+	paymentTypeBankAccount = "bank_account" //a US bank account charged via ACH
+)
+
+//bankAccountCurrency is the only currency a bank account can be charged in
+//ACH payments are only made from US bank accounts in USD
+const bankAccountCurrency = "usd"
+
+//bank account errors
+var (
+	errBankAccountNotVerified    = errors.New("card: bank account not verified")
+	errBankAccountCurrency       = errors.New("card: bank accounts can only be charged in usd")
+	errBankAccountAuthorizeOnly  = errors.New("card: bank accounts cannot be authorized only")
+	errNotBankAccount            = errors.New("card: not a bank account")
+	errInvalidVerificationAmount = errors.New("card: invalid verification amount")
+)
+
+//isBankAccount checks if a saved card is a bank account
+func (c SavedCard) isBankAccount() bool {
+	return c.PaymentType == paymentTypeBankAccount
+}
+
+//isBankAccountID checks if a Stripe card id is for a bank account
+//Bank accounts are saved to a Stripe customer as a source (ba_...) since stripe.js creates a
+//bank account token.  They are charged, set as the default, and removed like a legacy card source.
+func isBankAccountID(stripeCardID string) bool {
+	return strings.HasPrefix(stripeCardID, "ba_")
+}
+
+//saveBankAccount saves a bank account to a Stripe customer so it can be charged later
+//The bank account token from stripe.js is added to the customer as a source.  The bank account
+//can't be charged until it is verified.  Stripe makes two small deposits to the bank account
+//and the customer tells us the amounts, see VerifyBankAccount.
+func saveBankAccount(sc *client.API, stripeCustomerID, bankToken string) (*stripe.BankAccount, error) {
+	return sc.BankAccounts.New(&stripe.BankAccountParams{
+		Customer: stripe.String(stripeCustomerID),
+		Token:    stripe.String(bankToken),
+	})
+}
+
+//defaultBankAccount fills in the details of a bank account that is a customer's default on
+//Stripe but isn't saved in the app
+//Customers without saved cards are charged using their default on Stripe, which could be a bank
+//account.  The bank account's status is looked up so it is only charged once it is verified.
+func defaultBankAccount(sc *client.API, stripeCustomerID, stripeCardID string, c *SavedCard) error {
+	ba, err := sc.BankAccounts.Get(stripeCardID, &stripe.BankAccountParams{
+		Customer: stripe.String(stripeCustomerID),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.PaymentType = paymentTypeBankAccount
+	c.StripeCardID = ba.ID
+	c.CardBrand = ba.BankName
+	c.CardLast4 = ba.Last4
+	c.CardExpiration = ""
+	c.BankAccountStatus = string(ba.Status)
+	return nil
+}
+
+//VerifyBankAccount verifies a customer's bank account with the amounts of the two small
+//deposits Stripe made to the bank account
+//Stripe makes the deposits a day or two after the bank account is added.  The customer looks
+//at their bank statement and tells us the amounts.  Once verified the bank account can be
+//charged.  Stripe only allows a few wrong guesses before the bank account can't be verified
+//anymore and has to be removed and added again.
+func VerifyBankAccount(w http.ResponseWriter, r *http.Request) {
+	//get form values
+	datastoreID, _ := strconv.ParseInt(r.FormValue("customerId"), 10, 64)
+	cardID, _ := strconv.ParseInt(r.FormValue("cardId"), 10, 64)
+	amount1, err1 := strconv.ParseInt(strings.TrimSpace(r.FormValue("amount1")), 10, 64) //in cents
+	amount2, err2 := strconv.ParseInt(strings.TrimSpace(r.FormValue("amount2")), 10, 64) //in cents
+
+	//validation
+	if datastoreID == 0 || cardID == 0 {
+		output.Error(errMissingInput, "A customer's datastore ID and bank account ID must be given but were missing. These should have been submitted automatically.", w)
+		return
+	}
+	if err1 != nil || err2 != nil || amount1 <= 0 || amount2 <= 0 || amount1 >= 100 || amount2 >= 100 {
+		output.Error(errInvalidVerificationAmount, "Each deposit amount must be a whole number of cents between 1 and 99, i.e.: 32 for $0.32.", w)
+		return
+	}
+
+	c := r.Context()
+	customer, err := findByDatastoreID(c, datastoreID)
+	if err != nil {
+		output.Error(err, "Could not find this customer's data.", w)
+		return
+	}
+
+	cards, err := store.FindSavedCards(c, datastoreID)
+	if err != nil {
+		output.Error(err, "Could not look up this customer's bank accounts.", w)
+		return
+	}
+
+	bank, err := selectCard(cards, cardID, "")
+	if err != nil {
+		output.Error(err, "Could not find this bank account for this customer.", w)
+		return
+	}
+	if !bank.isBankAccount() {
+		output.Error(errNotBankAccount, "Only bank accounts need to be verified. This is a card.", w)
+		return
+	}
+	if bank.BankAccountStatus == string(stripe.BankAccountStatusVerified) {
+		output.Success("bankAccountVerified", bank, w)
+		return
+	}
+
+	//verify the bank account
+	sc := CreateStripeClient(c)
+	_, err = sc.PaymentSource.Verify(bank.StripeCardID, &stripe.SourceVerifyParams{
+		Customer: stripe.String(customer.StripeCustomerToken),
+		Amounts:  [2]int64{amount1, amount2},
+	})
+
+	//save the status of the bank account even if verifying failed
+	//too many wrong amounts and Stripe won't let the bank account be verified anymore
+	ba, getErr := sc.BankAccounts.Get(bank.StripeCardID, &stripe.BankAccountParams{
+		Customer: stripe.String(customer.StripeCustomerToken),
+	})
+	if getErr != nil {
+		log.Println("card.VerifyBankAccount - could not look up bank account status", bank.StripeCardID, getErr)
+	} else if string(ba.Status) != bank.BankAccountStatus {
+		bank.BankAccountStatus = string(ba.Status)
+		bank.DatetimeUpdated = timestamps.ISO8601()
+		bank.UpdatedByUser = sessionutils.GetUsername(r)
+
+		saveErr := store.UpdateSavedCard(c, bank)
+		if saveErr != nil {
+			log.Println("card.VerifyBankAccount - could not save bank account status", bank.ID, saveErr)
+		}
+	}
+
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			output.Error(errStripe, "Could not verify this bank account: "+stripeErr.Msg, w)
+			return
+		}
+
+		output.Error(err, "Could not verify this bank account.", w)
+		return
+	}
+
+	log.Println("card.VerifyBankAccount - bank account", bank.StripeCardID, "verified for customer", customer.ID)
+
+	//done
+	output.Success("bankAccountVerified", bank, w)
+}
+
+//chargeBankAccount charges a customer's bank account via ACH
+//Bank accounts are sources so they are charged with a charge instead of a payment intent.  The
+//charge is pending until the money arrives from the customer's bank, usually within five
+//business days.  The charge fails, and is marked as returned, if the customer's bank returns
+//the payment.  The webhook updates the charge in the ledger when it succeeds or fails.
+func chargeBankAccount(sc *client.API, input processChargeInputs, stripeCardID string) (chg *stripe.Charge, errMsg string, err error) {
+	if input.authorizeOnly {
+		return nil, "Bank accounts cannot be authorized only. Charge the bank account instead.", errBankAccountAuthorizeOnly
+	}
+	if input.cardData.BankAccountStatus != string(stripe.BankAccountStatusVerified) {
+		return nil, "This bank account has not been verified yet. Verify it with the amounts of the two small deposits Stripe made to the bank account.", errBankAccountNotVerified
+	}
+	if input.currency != bankAccountCurrency {
+		return nil, "Bank accounts can only be charged in USD.", errBankAccountCurrency
+	}
+
+	params := &stripe.ChargeParams{
+		Customer:    stripe.String(input.customerData.StripeCustomerToken),
+		Amount:      stripe.Int64(int64(input.amountCents)),
+		Currency:    stripe.String(input.currency),
+		Description: stripe.String(chargeDescription(input)),
+	}
+	params.SetSource(stripeCardID)
+	addChargeMetadata(&params.Params, input)
+
+	//get the fees so they can be saved to the ledger
+	params.AddExpand("balance_transaction")
+
+	chg, err = sc.Charges.New(params)
+	if err != nil {
+		err, errMsg = chargeError(err)
+		return
+	}
+
+	log.Println("card.chargeBankAccount - charge", chg.ID, chg.Status)
+	return
+}
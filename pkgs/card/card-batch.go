@@ -0,0 +1,709 @@
+package card
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+)
+
+//maxBatchFileSize is the largest csv file that can be uploaded to charge a batch of cards
+const maxBatchFileSize = 1 << 20
+
+//batchWorkers is the number of charges made at the same time when charging a batch
+//this is kept low so a batch doesn't hit Stripe's rate limits
+const batchWorkers = 4
+
+//statuses of a row in a batch
+const (
+	batchRowValid    = "valid"
+	batchRowInvalid  = "invalid"
+	batchRowPending  = "pending" //saved to be charged in the background
+	batchRowCharging = "charging"
+	batchRowCharged  = "charged"
+	batchRowFailed   = "failed"
+	batchRowSkipped  = "skipped" //the row was invalid so it wasn't charged
+)
+
+//batchReferrer is saved as the auto charge referrer of charges made from a batch
+//this lets batch charges be picked out in the reports and the Stripe dashboard
+const batchReferrer = "batch"
+
+//batch errors
+var (
+	errBatchFileTooLarge = errors.New("card: batch file too large")
+	errInvalidBatchFile  = errors.New("card: invalid batch file")
+	errBatchChanged      = errors.New("card: batch file changed")
+	errBatchJobExists    = errors.New("card: batch already charged")
+	errBatchJobNotFound  = errors.New("card: batch not found")
+	errBatchRowStarted   = errors.New("card: batch row already started")
+)
+
+//batchResultsHeader is the first row of the results file of a batch
+var batchResultsHeader = []interface{}{
+	"Row",
+	"Customer ID",
+	"Customer",
+	"Currency",
+	"Amount",
+	"Invoice",
+	"PO",
+	"Status",
+	"Charge ID",
+	"Error",
+	"Email Error",
+}
+
+//batchTotal is the number of rows and total amount to charge in one currency
+type batchTotal struct {
+	Currency    string `json:"currency"`
+	Count       int    `json:"count"`
+	AmountCents int64  `json:"amount_cents"`
+	Amount      string `json:"amount"`
+}
+
+//batch is a csv file of charges after it is parsed and validated, or the progress of charging it
+//the id is a hash of the file so the same file is only charged once
+type batch struct {
+	ID         string       `json:"id"`
+	Rows       []BatchRow   `json:"rows"`
+	Totals     []batchTotal `json:"totals"` //totals of the valid rows in a preview or the charged rows once charging starts
+	NumValid   int          `json:"num_valid"`
+	NumInvalid int          `json:"num_invalid"`
+	NumPending int          `json:"num_pending"` //rows that are waiting to be charged or are being charged
+	NumCharged int          `json:"num_charged"`
+	NumFailed  int          `json:"num_failed"`
+	Started    bool         `json:"started"` //true once the file is being charged, the rows show the progress
+	Done       bool         `json:"done"`    //true once every row was charged or failed
+	Username   string       `json:"username"`
+}
+
+//BatchPreview validates an uploaded csv file of charges and shows what will be charged
+//Each row is customer_id, amount, invoice, po, and optional level 3 data as json.  The amount
+//is in dollars (or the currency's main unit) and is charged in the customer's currency.  Nothing
+//is charged here, the preview lets the user check the rows and totals before charging.
+func BatchPreview(w http.ResponseWriter, r *http.Request) {
+	b, errMsg, err := readBatch(w, r)
+	if err != nil {
+		output.Error(err, errMsg, w)
+		return
+	}
+
+	//show the progress of a file that was already charged so it isn't charged again
+	progress, err := batchProgress(r.Context(), b.ID)
+	if err == nil {
+		output.Success("batchPreview", progress, w)
+		return
+	} else if err != errBatchJobNotFound {
+		output.Error(err, "Could not check if this file was already charged.", w)
+		return
+	}
+
+	output.Success("batchPreview", b, w)
+}
+
+//BatchCharge starts charging each valid row of an uploaded csv file of charges
+//The file must be the same file that was previewed, the id from the preview is checked so a
+//changed file isn't charged without being previewed.  Invalid rows are skipped.  The rows are
+//saved and then charged in the background so a batch can be any size and leaving the page doesn't
+//stop it.  The progress is returned, use BatchStatus to keep checking it and BatchResults to
+//download the results.  Uploading a file that was already charged returns its progress instead
+//of charging it again.
+func BatchCharge(w http.ResponseWriter, r *http.Request) {
+	b, errMsg, err := readBatch(w, r)
+	if err != nil {
+		output.Error(err, errMsg, w)
+		return
+	}
+	if b.ID != r.FormValue("batchId") {
+		output.Error(errBatchChanged, "The file changed since it was previewed. Please preview the file again before charging.", w)
+		return
+	}
+	if b.NumValid == 0 {
+		output.Error(errInvalidBatchFile, "None of the rows can be charged. Please fix the file and preview it again.", w)
+		return
+	}
+
+	username := sessionutils.GetUsername(r)
+	job := BatchJob{
+		BatchID:         b.ID,
+		NumRows:         len(b.Rows),
+		Username:        username,
+		DatetimeStarted: timestamps.ISO8601(),
+	}
+	for i := range b.Rows {
+		b.Rows[i].BatchID = b.ID
+		if b.Rows[i].Status == batchRowValid {
+			b.Rows[i].Status = batchRowPending
+		} else {
+			b.Rows[i].Status = batchRowSkipped
+		}
+	}
+
+	err = store.AddBatchJob(r.Context(), job, b.Rows)
+	if err == errBatchJobExists {
+		log.Println("card.BatchCharge - batch", b.ID, "was already charged")
+	} else if err != nil {
+		output.Error(err, "Could not save the file to charge it. Please try again.", w)
+		return
+	} else {
+		log.Println("card.BatchCharge - charging batch", b.ID, "with", b.NumValid, "rows by", username)
+		go func() {
+			if err := runBatchJob(b.ID); err != nil {
+				log.Println("card.BatchCharge - could not charge batch", b.ID, err)
+			}
+		}()
+	}
+
+	progress, err := batchProgress(r.Context(), b.ID)
+	if err != nil {
+		output.Error(err, "The file is being charged but its progress could not be looked up.", w)
+		return
+	}
+
+	output.Success("batchCharging", progress, w)
+}
+
+//BatchStatus returns the progress of charging a batch
+//this is polled by the gui while a batch is charged
+func BatchStatus(w http.ResponseWriter, r *http.Request) {
+	b, err := batchProgress(r.Context(), r.FormValue("batchId"))
+	if err == errBatchJobNotFound {
+		output.Error(err, "This batch could not be found.", w)
+		return
+	} else if err != nil {
+		output.Error(err, "Could not look up the progress of this batch.", w)
+		return
+	}
+
+	output.Success("batchStatus", b, w)
+}
+
+//BatchResults downloads the results of charging a batch as a csv file
+//this can be downloaded while a batch is still being charged, rows that weren't charged yet are
+//shown as pending
+func BatchResults(w http.ResponseWriter, r *http.Request) {
+	batchID := r.FormValue("batchId")
+	job, err := store.FindBatchJob(r.Context(), batchID)
+	if err == errBatchJobNotFound {
+		output.Error(err, "This batch could not be found.", w)
+		return
+	} else if err != nil {
+		output.Error(err, "Could not look up this batch.", w)
+		return
+	}
+
+	rows, err := store.FindBatchRows(r.Context(), batchID)
+	if err != nil {
+		output.Error(err, "Could not look up the rows of this batch.", w)
+		return
+	}
+
+	var b bytes.Buffer
+	err = batchResultsCSV(&b, rows)
+	if err != nil {
+		output.Error(err, "Could not build the results file.", w)
+		return
+	}
+
+	filename := "batch-results-" + job.DatetimeStarted[:10] + ".csv"
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.Write(b.Bytes())
+}
+
+//RunBatchJobs charges the rows of every batch that wasn't finished
+//Batches are charged in the background as soon as they are uploaded.  This picks up batches that
+//were stopped part way through, such as by the server restarting, and is designed to be run by
+//cron every few minutes.
+func RunBatchJobs(w http.ResponseWriter, r *http.Request) {
+	n, err := runUnfinishedBatchJobs(r.Context())
+	if err != nil {
+		output.Error(err, "Could not look up the batches that weren't finished.", w)
+		return
+	}
+
+	output.Success("batchJobsRun", map[string]int{"batches": n}, w)
+}
+
+//RunBatchJobsEvery charges the rows of every batch that wasn't finished on an interval
+//This is used when the app isn't deployed on appengine so batches are picked up without having to
+//set up cron.  This blocks so it should be run in a goroutine.
+func RunBatchJobsEvery(d time.Duration) {
+	log.Println("card.RunBatchJobsEvery: Checking for unfinished batches every", d)
+
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for range t.C {
+		n, err := runUnfinishedBatchJobs(context.Background())
+		if err != nil {
+			log.Println("card.RunBatchJobsEvery: Could not charge unfinished batches.", err)
+			continue
+		}
+		if n > 0 {
+			log.Println("card.RunBatchJobsEvery:", n, "unfinished batches charged")
+		}
+	}
+}
+
+//runUnfinishedBatchJobs charges the rows of every batch that wasn't finished
+//An error charging one batch is logged and the other batches are still charged.  The number of
+//batches that were looked at is returned.
+func runUnfinishedBatchJobs(c context.Context) (int, error) {
+	jobs, err := store.FindUnfinishedBatchJobs(c)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, j := range jobs {
+		if err := runBatchJob(j.BatchID); err != nil {
+			log.Println("card.runUnfinishedBatchJobs - could not charge batch", j.BatchID, err)
+		}
+	}
+
+	return len(jobs), nil
+}
+
+//runBatchJob charges the pending rows of a batch
+//Rows are charged batchWorkers at a time and the outcome of each row is saved as soon as it is
+//charged so the progress can be shown.  This doesn't use the context of the request that started
+//the batch so the batch keeps being charged after the request finishes.  A row that was being
+//charged by a server that stopped is failed instead of charged again, the same as a scheduled
+//charge, since we don't know if the card was charged.  The batch is finished once every row was
+//charged or failed.
+func runBatchJob(batchID string) error {
+	//settings and company info are looked up from a request so build one
+	r, err := http.NewRequest("POST", "/card/batch/charge/", nil)
+	if err != nil {
+		return err
+	}
+	c := r.Context()
+
+	job, err := store.FindBatchJob(c, batchID)
+	if err != nil {
+		return err
+	}
+	rows, err := store.FindBatchRows(c, batchID)
+	if err != nil {
+		return err
+	}
+
+	//charge the rows using a fixed number of workers
+	pending := make(chan BatchRow)
+	var wg sync.WaitGroup
+	for i := 0; i < batchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range pending {
+				chargeBatchRow(r, job, row)
+			}
+		}()
+	}
+
+	for _, row := range rows {
+		switch row.Status {
+		case batchRowPending:
+			pending <- row
+		case batchRowCharging:
+			failStaleBatchRow(c, row)
+		}
+	}
+	close(pending)
+	wg.Wait()
+
+	//rows another server is still charging are finished by the next run
+	rows, err = store.FindBatchRows(c, batchID)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.Status == batchRowPending || row.Status == batchRowCharging {
+			return nil
+		}
+	}
+
+	log.Println("card.runBatchJob - batch", batchID, "done")
+	return store.FinishBatchJob(c, batchID, timestamps.ISO8601())
+}
+
+//failStaleBatchRow fails a row that has been charging for so long that the server charging it
+//must have stopped
+func failStaleBatchRow(c context.Context, row BatchRow) {
+	started, err := time.Parse(time.RFC3339, row.DatetimeStarted)
+	if err == nil && time.Since(started) < staleRunAfter {
+		return
+	}
+
+	row.Status = batchRowFailed
+	row.Error = "Charging stopped before this row finished. Please check the Report to see if this charge was successful."
+	row.DatetimeFinished = timestamps.ISO8601()
+	err = store.UpdateBatchRow(c, row)
+	if err != nil {
+		log.Println("card.failStaleBatchRow - could not save row", row.RowNumber, "of batch", row.BatchID, err)
+	}
+}
+
+//chargeBatchRow charges one row of a batch and saves the outcome
+//the row is marked as charging first so another server checking the batch doesn't charge it too
+func chargeBatchRow(r *http.Request, job BatchJob, row BatchRow) {
+	row.Status = batchRowCharging
+	row.DatetimeStarted = timestamps.ISO8601()
+	err := store.StartBatchRow(r.Context(), row)
+	if err == errBatchRowStarted {
+		return
+	} else if err != nil {
+		log.Println("card.chargeBatchRow - could not start row", row.RowNumber, "of batch", row.BatchID, err)
+		return
+	}
+
+	chargeStartedBatchRow(r, job, &row)
+
+	row.DatetimeFinished = timestamps.ISO8601()
+	err = store.UpdateBatchRow(r.Context(), row)
+	if err != nil {
+		log.Println("card.chargeBatchRow - could not save row", row.RowNumber, "of batch", row.BatchID, err)
+	}
+}
+
+//chargeStartedBatchRow charges the card for one row of a batch and saves the result to the row
+func chargeStartedBatchRow(r *http.Request, job BatchJob, row *BatchRow) {
+	row.Status = batchRowFailed
+
+	c, cancelFunc := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancelFunc()
+
+	//the customer and card were looked up when the file was previewed
+	customer, err := findByDatastoreID(c, row.CustomerDatastoreID)
+	if err != nil {
+		log.Println("card.chargeStartedBatchRow - could not find customer", row.CustomerDatastoreID, err)
+		row.Error = "Could not look up the customer's Stripe information."
+		return
+	}
+	cards, err := FindCards(c, customer)
+	if err != nil {
+		log.Println("card.chargeStartedBatchRow - could not find cards", row.CustomerDatastoreID, err)
+		row.Error = "Could not look up the customer's cards."
+		return
+	}
+	card, err := selectCard(cards, row.SavedCardID, "")
+	if err != nil {
+		row.Error = "The customer's card was removed after the file was previewed."
+		return
+	}
+
+	var level3Params chargeLevel3ParamsJSON
+	if row.Level3 {
+		err = json.Unmarshal([]byte(row.Level3Params), &level3Params)
+		if err != nil {
+			row.Error = "The level 3 data is not valid JSON."
+			return
+		}
+	}
+
+	inputs := processChargeInputs{
+		context:              c,
+		amountCents:          uint64(row.AmountCents),
+		currency:             row.Currency,
+		invoiceNum:           row.Invoice,
+		poNum:                row.Po,
+		customerData:         customer,
+		cardData:             card,
+		userProcessingCharge: job.Username,
+		autoChargeReferrer:   batchReferrer,
+		autoChargeReason:     "batch " + row.BatchID + " row " + strconv.Itoa(row.RowNumber),
+		authorizeOnly:        false,
+		level3Params:         level3Params,
+		level3Provided:       row.Level3,
+		idempotencyKey:       "batch--" + row.BatchID + "--" + strconv.Itoa(row.RowNumber),
+	}
+	out, errMsg, err := processCharge(inputs)
+	if err != nil {
+		log.Println("card.chargeStartedBatchRow - could not charge row", row.RowNumber, "of batch", row.BatchID, err)
+		row.Error = errMsg
+		return
+	}
+
+	row.Status = batchRowCharged
+	row.ChargeID = out.ChargeID
+
+	//email the receipt to the customer's billing email
+	//a failed email doesn't fail the row since the card was charged
+	_, row.EmailError = emailReceipt(r, out.ChargeID, nil, nil, customer)
+}
+
+//batchProgress builds the progress of charging a batch from its saved rows
+//errBatchJobNotFound is returned if the batch wasn't charged
+func batchProgress(c context.Context, batchID string) (b batch, err error) {
+	job, err := store.FindBatchJob(c, batchID)
+	if err != nil {
+		return
+	}
+	rows, err := store.FindBatchRows(c, batchID)
+	if err != nil {
+		return
+	}
+
+	b = batch{
+		ID:       batchID,
+		Rows:     rows,
+		Started:  true,
+		Done:     job.DatetimeFinished != "",
+		Username: job.Username,
+	}
+	for _, row := range rows {
+		switch row.Status {
+		case batchRowPending, batchRowCharging:
+			b.NumPending++
+		case batchRowCharged:
+			b.NumCharged++
+		case batchRowFailed:
+			b.NumFailed++
+		default:
+			b.NumInvalid++
+		}
+	}
+	b.NumValid = b.NumPending + b.NumCharged + b.NumFailed
+	b.Totals = batchTotals(rows, batchRowCharged)
+
+	return b, nil
+}
+
+//readBatch reads and validates the csv file uploaded in the "file" field
+func readBatch(w http.ResponseWriter, r *http.Request) (b batch, errMsg string, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchFileSize+(1<<20))
+	err = r.ParseMultipartForm(maxBatchFileSize)
+	if err != nil {
+		err = errBatchFileTooLarge
+		errMsg = "The file is too large. The file must be less than " + strconv.Itoa(maxBatchFileSize>>20) + "MB."
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		errMsg = "Please choose a CSV file to upload."
+		return
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxBatchFileSize+1))
+	if err != nil {
+		errMsg = "Could not read the file. Please try again."
+		return
+	}
+	if len(data) > maxBatchFileSize {
+		err = errBatchFileTooLarge
+		errMsg = "The file is too large. The file must be less than " + strconv.Itoa(maxBatchFileSize>>20) + "MB."
+		return
+	}
+
+	return parseBatch(r, data)
+}
+
+//parseBatch parses a csv file of charges and validates each row
+//A row that can't be charged is marked invalid with the reason, the other rows can still be
+//charged.  An error is only returned if the file itself can't be used.
+func parseBatch(r *http.Request, data []byte) (b batch, errMsg string, err error) {
+	sum := sha256.Sum256(data)
+	b.ID = hex.EncodeToString(sum[:16])
+
+	//spreadsheet apps may save csv files with a byte order mark
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		err = errInvalidBatchFile
+		errMsg = "The file is not a valid CSV file."
+		return
+	}
+
+	//skip the header row if the file has one
+	firstRow := 1
+	if len(records) > 0 && len(records[0]) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "customer_id") {
+		records = records[1:]
+		firstRow = 2
+	}
+	if len(records) == 0 {
+		err = errInvalidBatchFile
+		errMsg = "The file does not have any charges."
+		return
+	}
+
+	c := r.Context()
+	seen := map[string]int{}
+	b.Rows = make([]BatchRow, 0, len(records))
+	for i, record := range records {
+		row := parseBatchRow(c, r, record)
+		row.RowNumber = firstRow + i
+
+		//the same charge twice in one file is most likely a mistake
+		if row.Status == batchRowValid {
+			key := row.CustomerID + "--" + row.Invoice + "--" + row.Po + "--" + strconv.FormatInt(row.AmountCents, 10) + "--" + row.Currency
+			if dup, ok := seen[key]; ok {
+				row.Status = batchRowInvalid
+				row.Error = "This is the same customer, amount, invoice, and PO as row " + strconv.Itoa(dup) + "."
+			} else {
+				seen[key] = row.RowNumber
+			}
+		}
+
+		if row.Status == batchRowValid {
+			b.NumValid++
+		} else {
+			b.NumInvalid++
+		}
+		b.Rows = append(b.Rows, row)
+	}
+
+	b.Totals = batchTotals(b.Rows, batchRowValid)
+	return
+}
+
+//parseBatchRow validates one row of a csv file of charges and looks up the customer and card
+func parseBatchRow(c context.Context, r *http.Request, record []string) (row BatchRow) {
+	field := func(i int) string {
+		if i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	row.CustomerID = field(0)
+	row.Invoice = field(2)
+	row.Po = field(3)
+	row.Status = batchRowInvalid
+
+	if row.CustomerID == "" {
+		row.Error = "No customer ID was provided."
+		return
+	}
+
+	customer, err := FindByCustomerID(c, row.CustomerID)
+	if err == errCustomerNotFound {
+		row.Error = "No customer has this customer ID."
+		return
+	} else if err != nil {
+		row.Error = "An error occured while looking up the customer."
+		return
+	}
+	row.CustomerDatastoreID = customer.ID
+	row.CustomerName = customer.CustomerName
+
+	cards, err := FindCards(c, customer)
+	if err != nil {
+		row.Error = "An error occured while looking up the customer's cards."
+		return
+	}
+	card, err := selectCard(cards, 0, "")
+	if err != nil {
+		row.Error = "The customer does not have a card to charge."
+		return
+	}
+	row.SavedCardID = card.ID
+	row.CardLast4 = card.CardLast4
+
+	row.Currency, err = ChargeCurrency(r, "", customer)
+	if err != nil {
+		row.Error = "The customer's currency is not valid."
+		return
+	}
+
+	amountCents, err := getAmountAsIntCents(field(1), row.Currency)
+	if err != nil {
+		row.Error = amountErrorMessage(err, row.Currency)
+		return
+	}
+	if amountCents == 0 {
+		row.Error = "The amount must be a number greater than zero."
+		return
+	}
+	row.AmountCents = int64(amountCents)
+	row.Amount = FormatAmount(row.AmountCents, row.Currency)
+
+	if l3 := field(4); l3 != "" {
+		var level3Params chargeLevel3ParamsJSON
+		err = json.Unmarshal([]byte(l3), &level3Params)
+		if err != nil {
+			row.Error = "The level 3 data is not valid JSON."
+			return
+		}
+		row.Level3 = true
+		row.Level3Params = l3
+	}
+
+	row.Status = batchRowValid
+	return
+}
+
+//batchTotals totals the rows with a status for each currency
+func batchTotals(rows []BatchRow, status string) []batchTotal {
+	byCurrency := map[string]*batchTotal{}
+	for _, row := range rows {
+		if row.Status != status {
+			continue
+		}
+
+		t, ok := byCurrency[row.Currency]
+		if !ok {
+			t = &batchTotal{Currency: row.Currency}
+			byCurrency[row.Currency] = t
+		}
+		t.Count++
+		t.AmountCents += row.AmountCents
+	}
+
+	totals := make([]batchTotal, 0, len(byCurrency))
+	for _, t := range byCurrency {
+		t.Amount = FormatAmount(t.AmountCents, t.Currency)
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i].Currency < totals[j].Currency
+	})
+
+	return totals
+}
+
+//batchResultsCSV builds the results file of a batch with the charge id or error of each row
+func batchResultsCSV(b *bytes.Buffer, rows []BatchRow) error {
+	records := [][]interface{}{batchResultsHeader}
+	for _, row := range rows {
+		records = append(records, []interface{}{
+			strconv.Itoa(row.RowNumber),
+			row.CustomerID,
+			row.CustomerName,
+			strings.ToUpper(row.Currency),
+			row.Amount,
+			row.Invoice,
+			row.Po,
+			row.Status,
+			row.ChargeID,
+			row.Error,
+			row.EmailError,
+		})
+	}
+
+	return writeCSV(b, records)
+}
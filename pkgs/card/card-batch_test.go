@@ -0,0 +1,330 @@
+package card
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
+)
+
+//batchTestStore is a Store with the customers and cards used to test parsing a batch
+//only the methods used when parsing a batch are implemented
+type batchTestStore struct {
+	Store
+	customers map[string]CustomerDatastore
+}
+
+func (s batchTestStore) FindByCustomerID(ctx context.Context, customerID string) (CustomerDatastore, error) {
+	c, ok := s.customers[customerID]
+	if !ok {
+		return c, errCustomerNotFound
+	}
+
+	return c, nil
+}
+
+func (s batchTestStore) FindSavedCards(ctx context.Context, customerDatastoreID int64) ([]SavedCard, error) {
+	return []SavedCard{}, nil
+}
+
+//useBatchTestStore sets the store used by the package for the length of a test
+func useBatchTestStore(t *testing.T) {
+	t.Helper()
+
+	old := store
+	SetStore(batchTestStore{
+		customers: map[string]CustomerDatastore{
+			"cust-usd": {ID: 1, CustomerID: "cust-usd", CustomerName: "US Customer", CardLast4: "4242", Currency: "usd"},
+			"cust-jpy": {ID: 2, CustomerID: "cust-jpy", CustomerName: "JP Customer", CardLast4: "1881", Currency: "jpy"},
+		},
+	})
+	t.Cleanup(func() { SetStore(old) })
+}
+
+func TestParseBatch(t *testing.T) {
+	useBatchTestStore(t)
+
+	data := strings.Join([]string{
+		"customer_id,amount,invoice,po,level3",
+		"cust-usd,10.50,INV-1,PO-1",
+		"cust-jpy,1000,INV-2,PO-2",
+		",10.00,INV-3,PO-3",
+		"cust-unknown,10.00,INV-4,PO-4",
+		"cust-usd,abc,INV-5,PO-5",
+		"cust-usd,0,INV-6,PO-6",
+		"cust-usd,10.50,INV-1,PO-1",
+		`cust-usd,5.25,INV-8,PO-8,"{""merchant_reference"":""INV-8""}"`,
+		"cust-usd,5.00,INV-9,PO-9,{not json",
+	}, "\n")
+
+	r := httptest.NewRequest("POST", "/card/batch/preview/", nil)
+	b, errMsg, err := parseBatch(r, []byte(data))
+	if err != nil {
+		t.Fatalf("parseBatch() error = %v, %s", err, errMsg)
+	}
+
+	want := []struct {
+		status      string
+		amountCents int64
+		currency    string
+		errContains string
+	}{
+		{batchRowValid, 1050, "usd", ""},
+		{batchRowValid, 1000, "jpy", ""},
+		{batchRowInvalid, 0, "", "No customer ID"},
+		{batchRowInvalid, 0, "", "No customer has this customer ID"},
+		{batchRowInvalid, 0, "usd", "amount"},
+		{batchRowInvalid, 0, "usd", "amount"},
+		{batchRowInvalid, 1050, "usd", "same customer, amount, invoice, and PO as row 2"},
+		{batchRowValid, 525, "usd", ""},
+		{batchRowInvalid, 500, "usd", "level 3"},
+	}
+	if len(b.Rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(b.Rows), len(want))
+	}
+
+	for i, w := range want {
+		row := b.Rows[i]
+		if row.RowNumber != i+2 {
+			t.Errorf("row %d: RowNumber = %d, want %d", i, row.RowNumber, i+2)
+		}
+		if row.Status != w.status {
+			t.Errorf("row %d: Status = %q, want %q (error %q)", row.RowNumber, row.Status, w.status, row.Error)
+		}
+		if row.AmountCents != w.amountCents {
+			t.Errorf("row %d: AmountCents = %d, want %d", row.RowNumber, row.AmountCents, w.amountCents)
+		}
+		if row.Currency != w.currency {
+			t.Errorf("row %d: Currency = %q, want %q", row.RowNumber, row.Currency, w.currency)
+		}
+		if w.errContains != "" && !strings.Contains(row.Error, w.errContains) {
+			t.Errorf("row %d: Error = %q, want it to contain %q", row.RowNumber, row.Error, w.errContains)
+		}
+		if w.errContains == "" && row.Error != "" {
+			t.Errorf("row %d: Error = %q, want none", row.RowNumber, row.Error)
+		}
+	}
+
+	if b.NumValid != 3 || b.NumInvalid != 6 {
+		t.Errorf("NumValid, NumInvalid = %d, %d, want 3, 6", b.NumValid, b.NumInvalid)
+	}
+	if !b.Rows[7].Level3 || b.Rows[7].Level3Params != `{"merchant_reference":"INV-8"}` {
+		t.Errorf("row 9: level 3 data not read, got %v %q", b.Rows[7].Level3, b.Rows[7].Level3Params)
+	}
+	if b.Rows[1].CustomerDatastoreID != 2 {
+		t.Errorf("row 3: CustomerDatastoreID = %d, want 2", b.Rows[1].CustomerDatastoreID)
+	}
+
+	wantTotals := []batchTotal{
+		{Currency: "jpy", Count: 1, AmountCents: 1000, Amount: "1000"},
+		{Currency: "usd", Count: 2, AmountCents: 1575, Amount: "15.75"},
+	}
+	if len(b.Totals) != len(wantTotals) {
+		t.Fatalf("got totals %+v, want %+v", b.Totals, wantTotals)
+	}
+	for i := range wantTotals {
+		if b.Totals[i] != wantTotals[i] {
+			t.Errorf("total %d = %+v, want %+v", i, b.Totals[i], wantTotals[i])
+		}
+	}
+}
+
+func TestParseBatchFile(t *testing.T) {
+	useBatchTestStore(t)
+
+	//a month end run can be hundreds of customers
+	many := []string{}
+	for i := 0; i < 500; i++ {
+		many = append(many, "cust-usd,1.00,INV-"+strconv.Itoa(i)+",PO")
+	}
+
+	tests := []struct {
+		name      string
+		data      string
+		wantErr   error
+		wantFirst int
+	}{
+		{"no header", "cust-usd,10.00,INV-1,PO-1", nil, 1},
+		{"header", "customer_id,amount,invoice,po\ncust-usd,10.00,INV-1,PO-1", nil, 2},
+		{"byte order mark and header", "\xef\xbb\xbfcustomer_id,amount,invoice,po\ncust-usd,10.00,INV-1,PO-1", nil, 2},
+		{"only a header", "customer_id,amount,invoice,po\n", errInvalidBatchFile, 0},
+		{"empty", "", errInvalidBatchFile, 0},
+		{"not csv", "cust-usd,\"10.00,INV-1", errInvalidBatchFile, 0},
+		{"hundreds of rows", strings.Join(many, "\n"), nil, 1},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/card/batch/preview/", nil)
+		b, _, err := parseBatch(r, []byte(tt.data))
+		if err != tt.wantErr {
+			t.Errorf("%s: parseBatch() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if b.Rows[0].RowNumber != tt.wantFirst {
+			t.Errorf("%s: first RowNumber = %d, want %d", tt.name, b.Rows[0].RowNumber, tt.wantFirst)
+		}
+		if b.Rows[0].Status != batchRowValid {
+			t.Errorf("%s: first row Status = %q, want %q (error %q)", tt.name, b.Rows[0].Status, batchRowValid, b.Rows[0].Error)
+		}
+	}
+}
+
+func TestParseBatchID(t *testing.T) {
+	useBatchTestStore(t)
+
+	r := httptest.NewRequest("POST", "/card/batch/preview/", nil)
+	a, _, _ := parseBatch(r, []byte("cust-usd,10.00,INV-1,PO-1"))
+	b, _, _ := parseBatch(r, []byte("cust-usd,10.00,INV-1,PO-1"))
+	c, _, _ := parseBatch(r, []byte("cust-usd,10.01,INV-1,PO-1"))
+
+	if a.ID == "" || a.ID != b.ID {
+		t.Errorf("the same file has ids %q and %q, want the same id", a.ID, b.ID)
+	}
+	if a.ID == c.ID {
+		t.Errorf("different files have the same id %q", a.ID)
+	}
+}
+
+//batchJobTestStore is a sqlite Store where no customers can be found so rows can be charged
+//without calling Stripe
+type batchJobTestStore struct {
+	Store
+}
+
+func (s batchJobTestStore) FindByID(ctx context.Context, datastoreID int64) (CustomerDatastore, error) {
+	return CustomerDatastore{}, errCustomerNotFound
+}
+
+func TestRunBatchJob(t *testing.T) {
+	old := store
+	SetStore(batchJobTestStore{openTestSQLiteStore(t, sqliteutils.CreateTableBatchJob)})
+	defer SetStore(old)
+
+	c := context.Background()
+	now := time.Now().UTC()
+	job := BatchJob{BatchID: "batch-1", NumRows: 4, Username: "admin", DatetimeStarted: now.Format(time.RFC3339)}
+	rows := []BatchRow{
+		{BatchID: "batch-1", RowNumber: 2, CustomerID: "cust-usd", AmountCents: 1000, Amount: "10.00", Currency: "usd", Status: batchRowPending},
+		{BatchID: "batch-1", RowNumber: 3, CustomerID: "", Status: batchRowSkipped, Error: "No customer ID was provided."},
+		{BatchID: "batch-1", RowNumber: 4, CustomerID: "cust-usd", AmountCents: 500, Amount: "5.00", Currency: "usd", Status: batchRowCharging, DatetimeStarted: now.Add(-2 * staleRunAfter).Format(time.RFC3339)},
+		{BatchID: "batch-1", RowNumber: 5, CustomerID: "cust-usd", AmountCents: 250, Amount: "2.50", Currency: "usd", Status: batchRowCharging, DatetimeStarted: now.Format(time.RFC3339)},
+	}
+	if err := store.AddBatchJob(c, job, rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddBatchJob(c, job, rows); err != errBatchJobExists {
+		t.Errorf("AddBatchJob() twice error = %v, want %v", err, errBatchJobExists)
+	}
+
+	//row 5 is still being charged by another server so the job isn't finished
+	if err := runBatchJob("batch-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.FindBatchRows(c, "batch-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		status      string
+		errContains string
+	}{
+		{batchRowFailed, "Could not look up the customer"},
+		{batchRowSkipped, "No customer ID"},
+		{batchRowFailed, "Charging stopped"},
+		{batchRowCharging, ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Status != w.status || !strings.Contains(got[i].Error, w.errContains) {
+			t.Errorf("row %d: Status, Error = %q, %q, want %q, %q", got[i].RowNumber, got[i].Status, got[i].Error, w.status, w.errContains)
+		}
+	}
+	if got[0].DatetimeFinished == "" {
+		t.Error("row 2: DatetimeFinished not set")
+	}
+
+	unfinished, err := store.FindUnfinishedBatchJobs(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished) != 1 {
+		t.Fatalf("got %d unfinished jobs, want 1", len(unfinished))
+	}
+
+	//a row can only be started once
+	if err := store.StartBatchRow(c, got[3]); err != errBatchRowStarted {
+		t.Errorf("StartBatchRow() on a charging row error = %v, want %v", err, errBatchRowStarted)
+	}
+
+	b, err := batchProgress(c, "batch-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Done || b.NumPending != 1 || b.NumFailed != 2 || b.NumInvalid != 1 || b.NumValid != 3 {
+		t.Errorf("progress = done %v, %d pending, %d failed, %d invalid, %d valid, want false, 1, 2, 1, 3", b.Done, b.NumPending, b.NumFailed, b.NumInvalid, b.NumValid)
+	}
+
+	//once the other server saves row 5 the next run finishes the job
+	got[3].Status = batchRowCharged
+	got[3].ChargeID = "ch_123"
+	if err := store.UpdateBatchRow(c, got[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBatchJob("batch-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = batchProgress(c, "batch-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Done || b.NumCharged != 1 || b.NumPending != 0 {
+		t.Errorf("progress = done %v, %d charged, %d pending, want true, 1, 0", b.Done, b.NumCharged, b.NumPending)
+	}
+	if len(b.Totals) != 1 || b.Totals[0].AmountCents != 250 {
+		t.Errorf("totals = %+v, want only the charged row", b.Totals)
+	}
+
+	unfinished, err = store.FindUnfinishedBatchJobs(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished) != 0 {
+		t.Errorf("got %d unfinished jobs, want 0", len(unfinished))
+	}
+}
+
+func TestBatchResultsCSV(t *testing.T) {
+	rows := []BatchRow{
+		{RowNumber: 2, CustomerID: "cust-usd", CustomerName: "US Customer", Currency: "usd", Amount: "10.00", Invoice: "INV-1", Po: "PO-1", Status: batchRowCharged, ChargeID: "ch_123"},
+		{RowNumber: 3, CustomerID: "cust-usd", CustomerName: "US Customer", Currency: "usd", Amount: "5.00", Invoice: "INV-2", Po: "PO-2", Status: batchRowFailed, Error: "Your card was declined."},
+	}
+
+	var b bytes.Buffer
+	if err := batchResultsCSV(&b, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 rows: %q", len(lines), b.String())
+	}
+	if !strings.HasPrefix(lines[1], "2,cust-usd,US Customer,USD,10.00,INV-1,PO-1,charged,ch_123") {
+		t.Errorf("line 2 = %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "failed,,Your card was declined.") {
+		t.Errorf("line 3 = %q", lines[2])
+	}
+}
@@ -11,14 +11,12 @@ import (
 	"strings"
 	"time"
 
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
 	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
 )
 
 //processChargeInputs is the data used in the processCharge func
@@ -26,10 +24,12 @@ import (
 type processChargeInputs struct {
 	context              context.Context
 	amountCents          uint64
+	currency             string
 	invoiceNum           string
 	poNum                string
 	companyData          company.Info
 	customerData         CustomerDatastore
+	cardData             SavedCard
 	userProcessingCharge string
 	autoChargeReferrer   string
 	autoChargeReason     string
@@ -67,10 +67,13 @@ func ManualCharge(w http.ResponseWriter, r *http.Request) {
 	//get inputs
 	datastoreID, _ := strconv.ParseInt(r.FormValue("datastoreId"), 10, 64) //id from datastore
 	amount := r.FormValue("amount")                                        //in dollars
+	currency := r.FormValue("currency")                                    //the customer's currency or the default currency is used if not given
 	invoice := r.FormValue("invoice")
 	poNum := r.FormValue("po")
 	chargeAndRemove, _ := strconv.ParseBool(r.FormValue("chargeAndRemove")) //true if card should be removed after charging
 	authorizeOnly, _ := strconv.ParseBool(r.FormValue("authorizeOnly"))     //true if we don't want to capture the card, just check if funds are available
+	cardID, _ := strconv.ParseInt(r.FormValue("cardId"), 10, 64)            //the saved card to charge, the customer's default card is charged if not given
+	emailReceiptTo := r.FormValue("emailReceipt")                           //comma separated addresses to email the receipt to, the customer's billing email is used if not given
 
 	//validation
 	if datastoreID == 0 {
@@ -81,19 +84,16 @@ func ManualCharge(w http.ResponseWriter, r *http.Request) {
 		output.Error(errMissingInput, "No amount was provided. You cannot charge a card nothing!", w)
 		return
 	}
+	receiptTo, err := parseReceiptEmails(emailReceiptTo)
+	if err != nil {
+		output.Error(err, "One of the email addresses to send the receipt to is not valid.", w)
+		return
+	}
 
 	//get username of logged in user
 	//we record this data so we can see who processed a charge in the reports
 	username := sessionutils.GetUsername(r)
 
-	//get amount as cents
-	//stripe requires the amount as a whole number
-	amountCents, err := getAmountAsIntCents(amount)
-	if err != nil {
-		output.Error(err, "An error occured while converting the amount to charge into cents. Please try again or contact an administrator.", w)
-		return
-	}
-
 	//create context
 	//need to adjust deadline in case stripe takes longer than 5 seconds
 	c := r.Context()
@@ -107,12 +107,41 @@ func ManualCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//get the card to charge
+	cards, err := FindCards(c, custData)
+	if err != nil {
+		output.Error(err, "An error occured while looking up the customer's cards.", w)
+		return
+	}
+	card, err := selectCard(cards, cardID, "")
+	if err != nil {
+		output.Error(err, "Could not find the chosen card for this customer. Please refresh the page and try again.", w)
+		return
+	}
+
+	//get the currency to charge in
+	currency, err = ChargeCurrency(r, currency, custData)
+	if err != nil {
+		output.Error(err, "The currency must be a three letter currency code, i.e.: USD.", w)
+		return
+	}
+
+	//get amount as cents
+	//stripe requires the amount as a whole number in the currency's smallest unit
+	amountCents, err := getAmountAsIntCents(amount, currency)
+	if err != nil {
+		output.Error(err, amountErrorMessage(err, currency), w)
+		return
+	}
+
 	inputs := processChargeInputs{
 		context:              c,
 		amountCents:          amountCents,
+		currency:             currency,
 		invoiceNum:           invoice,
 		poNum:                poNum,
 		customerData:         custData,
+		cardData:             card,
 		userProcessingCharge: username,
 		autoChargeReferrer:   "",
 		autoChargeReason:     "",
@@ -125,10 +154,15 @@ func ManualCharge(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//charge successful
+	//email the receipt, authorizations aren't emailed since the card hasn't been charged yet
+	if !authorizeOnly {
+		out.ReceiptEmailedTo, out.ReceiptEmailError = emailReceipt(r, out.ChargeID, nil, receiptTo, custData)
+	}
+
 	//check if we need to remove this card
-	//remove it if necessary
+	//remove it if necessary, the customer is removed if this was the customer's only card
 	if chargeAndRemove {
-		err := remove(c, datastoreID)
+		err := removeCardOrCustomer(c, custData, card.ID)
 		if err != nil {
 			log.Println("Error removing card after charge.", err)
 		}
@@ -142,10 +176,14 @@ func ManualCharge(w http.ResponseWriter, r *http.Request) {
 func AutoCharge(w http.ResponseWriter, r *http.Request) {
 	//get inputs
 	customerID := r.FormValue("customer_id") //the id in the CRM system, not the datastore ID since we dont store that off of appengine
-	amount := r.FormValue("amount")          //in cents
+	amount := r.FormValue("amount")          //in cents, or the smallest unit of the currency
+	currency := r.FormValue("currency")      //optional, the customer's currency or the default currency is used if not given
 	invoice := r.FormValue("invoice")
 	poNum := r.FormValue("po")
 	idempotencyKey := strings.TrimSpace(r.FormValue("idempotecy_key"))
+	cardID, _ := strconv.ParseInt(r.FormValue("card_id"), 10, 64) //the saved card to charge, optional
+	cardLast4 := r.FormValue("card_last4")                        //the last four digits of the saved card to charge, optional, used if card_id isn't given
+	emailReceiptTo := r.FormValue("email_receipt")                //comma separated addresses to email the receipt to, optional, the customer's billing email is used if not given
 
 	//above inputs are the same for manual or auto charges
 	//below are for auto charges only
@@ -165,6 +203,11 @@ func AutoCharge(w http.ResponseWriter, r *http.Request) {
 		output.Error(errMissingInput, "No amount was provided.", w)
 		return
 	}
+	receiptTo, err := parseReceiptEmails(emailReceiptTo)
+	if err != nil {
+		output.Error(err, "One of the addresses in 'email_receipt' is not a valid email address.", w)
+		return
+	}
 	if !autoCharge {
 		output.Error(errMissingInput, "The 'auto_charge' value was not provided. This is required when trying to automatically process a charge.", w)
 		return
@@ -177,19 +220,11 @@ func AutoCharge(w http.ResponseWriter, r *http.Request) {
 		output.Error(errMissingInput, "There was no 'reason' given.  This should be the function of the app that made this auto-charge request.  This is used for logging.", w)
 		return
 	}
-	if len(apiKey) == 0 {
-		output.Error(errMissingAPIKey, "There was no api given. This must be given in the 'api_key' field to authenticate this request.", w)
-		return
-	}
 
 	//verify api key
-	settings, err := appsettings.Get(r)
+	errMsg, err := verifyAPIKey(r, apiKey)
 	if err != nil {
-		output.Error(err, "Could not get app settings to verify api key.", w)
-		return
-	}
-	if settings.APIKey != apiKey {
-		output.Error(errInvalidAPIKey, "The api key provided in the request is not correct.", w)
+		output.Error(err, errMsg, w)
 		return
 	}
 
@@ -213,6 +248,30 @@ func AutoCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//get the card to charge
+	//the customer's default card is charged if a card wasn't chosen
+	cards, err := FindCards(c, custData)
+	if err != nil {
+		output.Error(err, "An error occured while looking up the customer's cards.", w)
+		return
+	}
+	card, err := selectCard(cards, cardID, cardLast4)
+	if err != nil {
+		output.Error(err, "Could not find the chosen card for this customer.", w)
+		return
+	}
+
+	//get the currency to charge in
+	currency, err = ChargeCurrency(r, currency, custData)
+	if err != nil {
+		output.Error(err, "The 'currency' must be a three letter currency code.", w)
+		return
+	}
+	if minorUnits(currency) == 3 && amountCents%10 != 0 {
+		output.Error(errAmountNotMultipleOfTen, "The 'amount' in a three-decimal currency must end in a zero since it is in thousandths, i.e.: 1230 for 1.230.", w)
+		return
+	}
+
 	//get statement descriptor from company info
 	companyInfo, err := company.Get(r)
 	if err != nil {
@@ -227,10 +286,12 @@ func AutoCharge(w http.ResponseWriter, r *http.Request) {
 	inputs := processChargeInputs{
 		context:              c,
 		amountCents:          amountCents,
+		currency:             currency,
 		invoiceNum:           invoice,
 		poNum:                poNum,
 		companyData:          companyInfo,
 		customerData:         custData,
+		cardData:             card,
 		userProcessingCharge: "api",
 		autoChargeReferrer:   referrer,
 		autoChargeReason:     reason,
@@ -258,6 +319,9 @@ func AutoCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//email the receipt
+	out.ReceiptEmailedTo, out.ReceiptEmailError = emailReceipt(r, out.ChargeID, nil, receiptTo, custData)
+
 	output.Success("cardCharged", out, w)
 }
 
@@ -287,128 +351,49 @@ func processCharge(input processChargeInputs) (out chargeSuccessful, errMsg stri
 		input.poNum = "*not provided*"
 	}
 
-	//capture is the opposite of authorize
-	capture := !input.authorizeOnly
-
-	//build charge object
-	chargeParams := &stripe.ChargeParams{
-		Customer:    stripe.String(input.customerData.StripeCustomerToken),
-		Amount:      stripe.Int64(int64(input.amountCents)),
-		Currency:    stripe.String(currency),
-		Description: stripe.String("Charge for invoice: " + input.invoiceNum + ", purchase order: " + input.poNum + "."),
-		Capture:     stripe.Bool(capture),
-	}
-
-	//set idempotency key
-	//This prevents duplicate charges from occuring.
-	//A value for this key may have been provided via api auto-charge, if it was
-	//use it. Otherwise, create it. Create it from provided charge data so that
-	//if a duplicate charge is attempted we can catch it.
-	if input.idempotencyKey != "" {
-		chargeParams.SetIdempotencyKey(input.idempotencyKey)
-		chargeParams.AddMetadata("idenpotency_set", "via provided value")
-	} else {
-		chargeParams.SetIdempotencyKey(input.customerData.StripeCustomerToken + "--" + input.invoiceNum + "--" + input.poNum + "--" + strconv.FormatUint(input.amountCents, 10))
-		chargeParams.AddMetadata("idenpotency_set", "app generated")
-	}
-
-	//add metadata
-	chargeParams.AddMetadata("customer_name", input.customerData.CustomerName)
-	chargeParams.AddMetadata("customer_id", input.customerData.CustomerID)
-	chargeParams.AddMetadata("invoice_num", input.invoiceNum)
-	chargeParams.AddMetadata("po_num", input.poNum)
-
-	//add level 3 data if needed
-	//We have to repackage all the data in a Stripe format since stripe uses *string instead of
-	//string and uses `form` struct tags instead of `json` which causes some issues.
-	//Have to chop inputs to correct length per https://stripe.com/docs/level3.
-	if input.level3Provided {
-		chargeParams.AddMetadata("level3_provided", "true")
-
-		if len(input.level3Params.CustomerReference) > 17 {
-			input.level3Params.CustomerReference = input.level3Params.CustomerReference[:17]
-		}
-		if len(input.level3Params.MerchantReference) > 25 {
-			input.level3Params.MerchantReference = input.level3Params.MerchantReference[:25]
-		}
-
-		l3 := stripe.ChargeLevel3Params{
-			CustomerReference:  stripe.String(input.level3Params.CustomerReference),
-			MerchantReference:  stripe.String(input.level3Params.MerchantReference),
-			ShippingAddressZip: stripe.String(input.level3Params.ShippingAddressZip),
-			ShippingFromZip:    stripe.String(input.level3Params.ShippingFromZip),
-			ShippingAmount:     stripe.Int64(input.level3Params.ShippingAmount),
+	//charge the chosen card
+	//customers without saved cards don't have a card id, the stripe customer's default card is charged
+	stripeCardID := input.cardData.StripeCardID
+	if stripeCardID == "" {
+		stripeCardID, err = defaultStripeCardID(input.context, input.customerData.StripeCustomerToken)
+		if err != nil {
+			errMsg = "Could not find the card to charge for this customer on Stripe."
+			return
 		}
+	}
 
-		l3Items := []*stripe.ChargeLevel3LineItemsParams{}
-		for _, v := range input.level3Params.LineItems {
-			if len(v.ProductCode) > 12 {
-				v.ProductCode = v.ProductCode[:12]
-			}
-			if len(v.ProductDescription) > 26 {
-				v.ProductDescription = v.ProductDescription[:26]
-			}
-
-			item := stripe.ChargeLevel3LineItemsParams{
-				DiscountAmount:     stripe.Int64(v.DiscountAmount),
-				Quantity:           stripe.Int64(v.Quantity),
-				TaxAmount:          stripe.Int64(v.TaxAmount),
-				UnitCost:           stripe.Int64(v.UnitCost),
-				ProductCode:        stripe.String(v.ProductCode),
-				ProductDescription: stripe.String(v.ProductDescription),
-			}
-
-			l3Items = append(l3Items, &item)
+	//the customer's default on Stripe could be a bank account
+	//look it up so it is charged as a bank account and only if it is verified
+	if !input.cardData.isBankAccount() && isBankAccountID(stripeCardID) {
+		err = defaultBankAccount(sc, input.customerData.StripeCustomerToken, stripeCardID, &input.cardData)
+		if err != nil {
+			errMsg = "Could not look up the bank account to charge for this customer on Stripe."
+			return
 		}
-
-		l3.LineItems = l3Items
-		chargeParams.Level3 = &l3
 	}
 
-	if input.authorizeOnly {
-		chargeParams.AddMetadata("authorized_by", input.userProcessingCharge)
-		chargeParams.AddMetadata("authorized_date", timestamps.ISO8601())
+	//charge the card, or the bank account
+	var chg *stripe.Charge
+	if input.cardData.isBankAccount() {
+		chg, errMsg, err = chargeBankAccount(sc, input, stripeCardID)
 	} else {
-		chargeParams.AddMetadata("processed_by", input.userProcessingCharge)
-	}
-
-	if input.userProcessingCharge == "api" {
-		chargeParams.AddMetadata("auto_charge", "true")
-		chargeParams.AddMetadata("auto_charge_referrer", input.autoChargeReferrer)
-		chargeParams.AddMetadata("auto_charge_reason", input.autoChargeReason)
+		chg, errMsg, err = chargeCard(sc, input, stripeCardID)
 	}
-
-	//process the charge
-	chg, err := sc.Charges.New(chargeParams)
-
-	//handle errors
-	//*url.Error can be thrown if urlfetch reaches timeout (request took too long to complete)
-	//*stripe.Error is a error with the stripe api and should return a human readable error message
 	if err != nil {
-		switch err.(type) {
-		default:
-			errMsg = "There was an error processing this charge. Please check the Report to see if this charge was successful."
-			return
-		case *url.Error:
-			errMsg = "Charging this card timed out. The charge may have succeeded anyway. Please check the Report to see if this charge was successful."
-			return
-		case *stripe.Error:
-			//err returned form sc.Charges.New is a struct/json.
-			//extract the actual error message for err.  prepend with "stripe:" so we know where this error came from
-			//use the textual error message for errMsg but add some text for context in other apps
-			stripeErr := err.(*stripe.Error)
-			err = errors.New("stripe: " + string(stripeErr.Type))
-			errMsg = "Stripe returned an error: " + stripeErr.Msg + " (" + string(stripeErr.Code) + ")"
-
-			log.Println("card.charge: stripe.Error")
-			log.Printf("%+v", stripeErr)
-			return
-		}
+		return
 	}
 
 	log.Printf("%+v", chg.APIResource)
 	log.Println("ERR", err)
 
+	//save the charge to the ledger
+	//don't return on an error since the charge was successful, the resync task will fill it in later
+	err = saveChargeToLedger(input.context, chg)
+	if err != nil {
+		log.Println("card.processCharge - could not save charge to ledger", err)
+		err = nil
+	}
+
 	//update the last charge/used timestamp
 	//don't return on an error since this isn't a huge issue if it doesn't work
 	err = updateCardLastUsed(input.context, input.customerData.ID)
@@ -420,23 +405,211 @@ func processCharge(input processChargeInputs) (out chargeSuccessful, errMsg stri
 	//build struct to output a success message to the client
 	out = chargeSuccessful{
 		CustomerName:   input.customerData.CustomerName,
-		Cardholder:     input.customerData.Cardholder,
-		CardExpiration: input.customerData.CardExpiration,
-		CardLast4:      input.customerData.CardLast4,
-		Amount:         strconv.Itoa(int(input.amountCents) / 100),
+		Cardholder:     input.cardData.Cardholder,
+		CardExpiration: input.cardData.CardExpiration,
+		CardLast4:      input.cardData.CardLast4,
+		Amount:         FormatAmount(int64(input.amountCents), input.currency),
+		Currency:       input.currency,
+		CurrencySymbol: currencySymbol(input.currency),
 		Invoice:        input.invoiceNum,
 		Po:             input.poNum,
 		Datetime:       timestamps.ISO8601(),
 		ChargeID:       chg.ID,
 		AuthorizedOnly: input.authorizeOnly,
+		PaymentType:    paymentTypeCard,
+		Pending:        chg.Status == "pending",
+	}
+	if input.cardData.isBankAccount() {
+		out.PaymentType = paymentTypeBankAccount
+	}
+	return
+}
+
+//chargeCard charges a card with a payment intent
+//the payment intent is confirmed right away as an off session payment since the cardholder
+//isn't around to authenticate the charge, an authorization is captured later via Capture
+func chargeCard(sc *client.API, input processChargeInputs, stripeCardID string) (chg *stripe.Charge, errMsg string, err error) {
+	//build payment intent
+	piParams := &stripe.PaymentIntentParams{
+		Customer:           stripe.String(input.customerData.StripeCustomerToken),
+		PaymentMethod:      stripe.String(stripeCardID),
+		PaymentMethodTypes: stripe.StringSlice([]string{string(stripe.PaymentMethodTypeCard)}),
+		Amount:             stripe.Int64(int64(input.amountCents)),
+		Currency:           stripe.String(input.currency),
+		Description:        stripe.String(chargeDescription(input)),
+		Confirm:            stripe.Bool(true),
+		OffSession:         stripe.Bool(true),
+	}
+	if input.authorizeOnly {
+		piParams.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+	}
+
+	addChargeMetadata(&piParams.Params, input)
+
+	//add level 3 data if needed
+	//stripe-go doesn't have level 3 params for payment intents so the data is added as extra
+	//form values in the same format as level 3 data for charges.
+	//Have to chop inputs to correct length per https://stripe.com/docs/level3.
+	if input.level3Provided {
+		piParams.AddMetadata("level3_provided", "true")
+		addLevel3Params(&piParams.Params, input.level3Params)
+	}
+
+	//get the charge and its fees so they can be saved to the ledger
+	piParams.AddExpand("charges.data.balance_transaction")
+
+	//process the charge
+	pi, err := sc.PaymentIntents.New(piParams)
+	if err != nil {
+		err, errMsg = chargeError(err)
+		return
+	}
+
+	//the payment intent should either succeed or error since it is off session but make sure
+	//the charge was actually made
+	if pi.Status == stripe.PaymentIntentStatusRequiresAction {
+		err, errMsg = requiresActionError(pi)
+		return
 	}
+	if pi.Charges == nil || len(pi.Charges.Data) == 0 {
+		err = errors.New("stripe: payment intent " + string(pi.Status))
+		errMsg = "Stripe did not charge this card (" + string(pi.Status) + "). Please check the Report to see if this charge was successful."
+		return
+	}
+
+	chg = pi.Charges.Data[0]
 	return
 }
 
+//chargeDescription is the description of a charge shown in the Stripe dashboard
+func chargeDescription(input processChargeInputs) string {
+	return "Charge for invoice: " + input.invoiceNum + ", purchase order: " + input.poNum + "."
+}
+
+//addChargeMetadata sets the idempotency key and the metadata saved with every charge
+//this is used for payment intents when charging a card and charges when charging a bank account
+func addChargeMetadata(params *stripe.Params, input processChargeInputs) {
+	//set idempotency key
+	//This prevents duplicate charges from occuring.
+	//A value for this key may have been provided via api auto-charge, if it was
+	//use it. Otherwise, create it. Create it from provided charge data so that
+	//if a duplicate charge is attempted we can catch it.
+	if input.idempotencyKey != "" {
+		params.SetIdempotencyKey(input.idempotencyKey)
+		params.AddMetadata("idenpotency_set", "via provided value")
+	} else {
+		key := input.customerData.StripeCustomerToken + "--" + input.invoiceNum + "--" + input.poNum + "--" + strconv.FormatUint(input.amountCents, 10) + "--" + input.currency
+		if input.cardData.StripeCardID != "" {
+			key += "--" + input.cardData.StripeCardID
+		}
+
+		params.SetIdempotencyKey(key)
+		params.AddMetadata("idenpotency_set", "app generated")
+	}
+
+	//add metadata
+	params.AddMetadata("customer_name", input.customerData.CustomerName)
+	params.AddMetadata("customer_id", input.customerData.CustomerID)
+	params.AddMetadata("invoice_num", input.invoiceNum)
+	params.AddMetadata("po_num", input.poNum)
+
+	if input.authorizeOnly {
+		params.AddMetadata("authorized_by", input.userProcessingCharge)
+		params.AddMetadata("authorized_date", timestamps.ISO8601())
+	} else {
+		params.AddMetadata("processed_by", input.userProcessingCharge)
+	}
+
+	//charges made via the api or by a schedule, not by a user
+	if input.autoChargeReferrer != "" {
+		params.AddMetadata("auto_charge", "true")
+		params.AddMetadata("auto_charge_referrer", input.autoChargeReferrer)
+		params.AddMetadata("auto_charge_reason", input.autoChargeReason)
+	}
+}
+
+//chargeError gets the error and message to return when Stripe could not make a charge
+//*url.Error can be thrown if urlfetch reaches timeout (request took too long to complete)
+//*stripe.Error is a error with the stripe api and should return a human readable error message
+func chargeError(err error) (error, string) {
+	switch err.(type) {
+	default:
+		return err, "There was an error processing this charge. Please check the Report to see if this charge was successful."
+	case *url.Error:
+		return err, "Charging this card timed out. The charge may have succeeded anyway. Please check the Report to see if this charge was successful."
+	case *stripe.Error:
+		//extract the actual error message for err.  prepend with "stripe:" so we know where this error came from
+		//use the textual error message for errMsg but add some text for context in other apps
+		stripeErr := err.(*stripe.Error)
+		log.Println("card.charge: stripe.Error")
+		log.Printf("%+v", stripeErr)
+
+		//the card's bank wants the cardholder to authenticate this charge
+		if stripeErr.Code == stripe.ErrorCodeAuthenticationRequired {
+			return requiresActionError(stripeErr.PaymentIntent)
+		}
+
+		return errors.New("stripe: " + string(stripeErr.Type)), "Stripe returned an error: " + stripeErr.Msg + " (" + string(stripeErr.Code) + ")"
+	}
+}
+
+//requiresActionError builds the error returned when a charge needs the cardholder to authenticate it
+//Charges are made off session so the cardholder can't authenticate the charge (3-D Secure).
+//errRequiresAction is returned, instead of a generic Stripe error, so the gui and apps using
+//auto-charge can tell that the card itself is fine but the bank wants the cardholder involved.
+func requiresActionError(pi *stripe.PaymentIntent) (error, string) {
+	errMsg := "The cardholder's bank requires the cardholder to authenticate this charge (3-D Secure). This cannot be done here, please ask the cardholder for a different card or to pay another way."
+	if pi != nil {
+		errMsg += " (" + pi.ID + ")"
+	}
+
+	return errRequiresAction, errMsg
+}
+
+//addLevel3Params adds level 3 data to a payment intent
+//The data is added as extra form values since stripe-go only has level 3 params for charges.
+//We have to repackage all the data since the json struct tags don't match the form fields
+//stripe uses.  Inputs are chopped to the correct length per https://stripe.com/docs/level3.
+func addLevel3Params(params *stripe.Params, l3 chargeLevel3ParamsJSON) {
+	if len(l3.CustomerReference) > 17 {
+		l3.CustomerReference = l3.CustomerReference[:17]
+	}
+	if len(l3.MerchantReference) > 25 {
+		l3.MerchantReference = l3.MerchantReference[:25]
+	}
+
+	params.AddExtra("level3[customer_reference]", l3.CustomerReference)
+	params.AddExtra("level3[merchant_reference]", l3.MerchantReference)
+	params.AddExtra("level3[shipping_address_zip]", l3.ShippingAddressZip)
+	params.AddExtra("level3[shipping_from_zip]", l3.ShippingFromZip)
+	params.AddExtra("level3[shipping_amount]", strconv.FormatInt(l3.ShippingAmount, 10))
+
+	for i, v := range l3.LineItems {
+		if len(v.ProductCode) > 12 {
+			v.ProductCode = v.ProductCode[:12]
+		}
+		if len(v.ProductDescription) > 26 {
+			v.ProductDescription = v.ProductDescription[:26]
+		}
+
+		prefix := "level3[line_items][" + strconv.Itoa(i) + "]"
+		params.AddExtra(prefix+"[discount_amount]", strconv.FormatInt(v.DiscountAmount, 10))
+		params.AddExtra(prefix+"[quantity]", strconv.FormatInt(v.Quantity, 10))
+		params.AddExtra(prefix+"[tax_amount]", strconv.FormatInt(v.TaxAmount, 10))
+		params.AddExtra(prefix+"[unit_cost]", strconv.FormatInt(v.UnitCost, 10))
+		params.AddExtra(prefix+"[product_code]", v.ProductCode)
+		params.AddExtra(prefix+"[product_description]", v.ProductDescription)
+	}
+}
+
 //Capture captures a previous authorized charge
+//Authorizations made via a payment intent are captured through the payment intent.  Charges
+//authorized before we used payment intents don't have one and are captured directly.  An
+//amount less than the amount authorized can be captured, the rest of the hold is released.
 func Capture(w http.ResponseWriter, r *http.Request) {
 	//get input
 	chargeID := strings.TrimSpace(r.FormValue("chargeID"))
+	amount := strings.TrimSpace(r.FormValue("amount")) //optional, the amount authorized is captured if not given
 
 	//get stripe client
 	ctx := r.Context()
@@ -446,11 +619,46 @@ func Capture(w http.ResponseWriter, r *http.Request) {
 	//we record this data so we can see who processed a charge in the reports
 	username := sessionutils.GetUsername(r)
 
+	//look up the charge
+	//this also gets the payment intent the charge was made with
+	authChg, err := sc.Charges.Get(chargeID, nil)
+	if err != nil {
+		output.Error(err, "Could not look up charge to capture.", w)
+		return
+	}
+	if authChg.Captured {
+		output.Error(errAlreadyCaptured, "This charge was already captured.", w)
+		return
+	}
+	if authChg.Refunded {
+		output.Error(errAuthorizationReleased, "This authorization was released and can no longer be captured.", w)
+		return
+	}
+
+	//get the amount to capture
+	//this is in the same currency as the authorization and can't be more than was authorized
+	amountCents := authChg.Amount
+	if amount != "" {
+		cents, err := getAmountAsIntCents(amount, string(authChg.Currency))
+		if err != nil {
+			output.Error(err, amountErrorMessage(err, string(authChg.Currency)), w)
+			return
+		}
+		if cents == 0 || int64(cents) > authChg.Amount {
+			output.Error(errInvalidCaptureAmount, "The amount to capture must be greater than zero and no more than the "+FormatAmount(authChg.Amount, string(authChg.Currency))+" authorized.", w)
+			return
+		}
+
+		amountCents = int64(cents)
+	}
+
 	//update the charge with some notes
+	//this is only done once we know the charge can be captured so the notes on a charge that was
+	//already captured or released aren't changed
 	params := &stripe.ChargeParams{}
 	params.AddMetadata("processed_by", username)
 	params.AddMetadata("processed_date", timestamps.ISO8601())
-	_, err := sc.Charges.Update(chargeID, params)
+	_, err = sc.Charges.Update(chargeID, params)
 	if err != nil {
 		log.Println("card.Capture: error updating charge", err)
 		//we don't return here since if we can't update the charge it isn't the worse thing in the world
@@ -458,59 +666,46 @@ func Capture(w http.ResponseWriter, r *http.Request) {
 
 	//capture the charge
 	//this actual charges the card
-	_, err = sc.Charges.Capture(chargeID, nil)
-	if err != nil {
-		output.Error(err, "Could not capture charge.", w)
-		return
-	}
-
-	output.Success("cardCharged", nil, w)
-}
-
-//updateCardLastUsed updates the LastUsedTimestamp of a card
-func updateCardLastUsed(ctx context.Context, customerID int64) error {
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			UPDATE ` + sqliteutils.TableCards + `
-			SET LastUsedTimestamp=?
-			WHERE ID=?
-		`
-		stmt, err := c.Prepare(q)
-		if err != nil {
-			return err
+	//the balance transaction is created when the charge is captured
+	var chg *stripe.Charge
+	if authChg.PaymentIntent != nil {
+		captureParams := &stripe.PaymentIntentCaptureParams{
+			AmountToCapture: stripe.Int64(amountCents),
 		}
-
-		_, err = stmt.Exec(
-			timestamps.Unix(),
-			customerID,
-		)
+		captureParams.AddExpand("charges.data.balance_transaction")
+		pi, err := sc.PaymentIntents.Capture(authChg.PaymentIntent.ID, captureParams)
 		if err != nil {
-			return err
+			output.Error(err, "Could not capture charge.", w)
+			return
+		}
+		if pi.Charges == nil || len(pi.Charges.Data) == 0 {
+			output.Error(errCardNotFound, "Stripe did not return the captured charge. Please check the Report to see if this charge was captured.", w)
+			return
 		}
 
+		chg = pi.Charges.Data[0]
 	} else {
-		fullKey := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, customerID)
-		client, err := datastoreutils.Connect(ctx)
-		if err != nil {
-			return err
+		captureParams := &stripe.CaptureParams{
+			Amount: stripe.Int64(amountCents),
 		}
-
-		//look up card info first since datastore can't do updates
-		cardData := CustomerDatastore{}
-		err = client.Get(ctx, fullKey, &cardData)
+		captureParams.AddExpand("balance_transaction")
+		chg, err = sc.Charges.Capture(chargeID, captureParams)
 		if err != nil {
-			return err
+			output.Error(err, "Could not capture charge.", w)
+			return
 		}
+	}
 
-		//update timestamp
-		cardData.LastUsedTimestamp = timestamps.Unix()
-		_, err = client.Put(ctx, fullKey, &cardData)
-		if err != nil {
-			return err
-		}
+	//update the charge in the ledger
+	err = saveChargeToLedger(ctx, chg)
+	if err != nil {
+		log.Println("card.Capture - could not save charge to ledger", err)
 	}
 
-	return nil
+	output.Success("cardCharged", nil, w)
+}
+
+//updateCardLastUsed updates the LastUsedTimestamp of a card
+func updateCardLastUsed(ctx context.Context, customerID int64) error {
+	return store.UpdateLastUsed(ctx, customerID, timestamps.Unix())
 }
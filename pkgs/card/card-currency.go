@@ -0,0 +1,173 @@
+package card
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
+)
+
+//defaultCurrency is the currency used when a default currency isn't set in the app settings
+const defaultCurrency = "usd"
+
+//currency and amount errors
+var (
+	errInvalidCurrency        = errors.New("card: invalid currency")
+	errInvalidAmount          = errors.New("card: invalid amount")
+	errNegativeAmount         = errors.New("card: amount is negative")
+	errAmountTooPrecise       = errors.New("card: amount has more decimal places than the currency")
+	errAmountNotMultipleOfTen = errors.New("card: three-decimal amount does not end in zero")
+)
+
+//zeroDecimalCurrencies are the currencies Stripe takes amounts for in whole units, there are
+//no cents.  An amount of 500 JPY is sent to Stripe as 500, not 50000.
+//https://stripe.com/docs/currencies#zero-decimal
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true,
+	"clp": true,
+	"djf": true,
+	"gnf": true,
+	"jpy": true,
+	"kmf": true,
+	"krw": true,
+	"mga": true,
+	"pyg": true,
+	"rwf": true,
+	"ugx": true,
+	"vnd": true,
+	"vuv": true,
+	"xaf": true,
+	"xof": true,
+	"xpf": true,
+}
+
+//threeDecimalCurrencies are the currencies Stripe takes amounts for in thousandths of a unit
+//https://stripe.com/docs/currencies#three-decimal
+var threeDecimalCurrencies = map[string]bool{
+	"bhd": true,
+	"jod": true,
+	"kwd": true,
+	"omr": true,
+	"tnd": true,
+}
+
+//currencySymbols are the symbols shown in front of amounts in the gui
+//currencies not in this list are shown with their code instead
+var currencySymbols = map[string]string{
+	"usd": "$",
+	"cad": "CA$",
+	"aud": "A$",
+	"nzd": "NZ$",
+	"eur": "€",
+	"gbp": "£",
+	"jpy": "¥",
+	"inr": "₹",
+	"mxn": "MX$",
+}
+
+//Currencies is the list of currencies suggested in the gui
+//any currency Stripe supports can be used, these are just the common ones
+var Currencies = []string{"usd", "cad", "eur", "gbp", "aud", "nzd", "chf", "jpy", "mxn", "sek", "nok", "dkk"}
+
+//normalizeCurrency cleans up a currency code given by a user and makes sure it looks valid
+//Stripe uses lowercase three letter ISO codes.  A blank currency is returned as blank so the
+//caller can fall back to a default.
+func normalizeCurrency(currency string) (string, error) {
+	currency = strings.ToLower(strings.TrimSpace(currency))
+	if currency == "" {
+		return "", nil
+	}
+
+	if len(currency) != 3 {
+		return "", errInvalidCurrency
+	}
+	for _, r := range currency {
+		if r < 'a' || r > 'z' {
+			return "", errInvalidCurrency
+		}
+	}
+
+	return currency, nil
+}
+
+//minorUnits returns the number of decimal places Stripe uses for a currency
+func minorUnits(currency string) int {
+	currency = strings.ToLower(currency)
+	if zeroDecimalCurrencies[currency] {
+		return 0
+	}
+	if threeDecimalCurrencies[currency] {
+		return 3
+	}
+
+	return 2
+}
+
+//amountErrorMessage returns the message shown to the user when an amount can't be converted
+//to cents
+func amountErrorMessage(err error, currency string) string {
+	code := strings.ToUpper(currency)
+
+	switch err {
+	case errAmountTooPrecise:
+		units := minorUnits(currency)
+		if units == 0 {
+			return code + " amounts must be a whole number without decimal places."
+		}
+		return code + " amounts can't have more than " + strconv.Itoa(units) + " decimal places."
+	case errAmountNotMultipleOfTen:
+		return code + " amounts must end in a zero, i.e.: 1.230 instead of 1.234."
+	default:
+		return "The amount must be a number greater than zero."
+	}
+}
+
+//currencySymbol returns the symbol shown in front of amounts in a currency
+func currencySymbol(currency string) string {
+	currency = strings.ToLower(currency)
+	if s, ok := currencySymbols[currency]; ok {
+		return s
+	}
+
+	return strings.ToUpper(currency) + " "
+}
+
+//FormatAmount formats an amount in the smallest unit of a currency (cents) as a decimal string
+//without a currency symbol, i.e.: 1050 usd is "10.50" and 1050 jpy is "1050"
+func FormatAmount(cents int64, currency string) string {
+	units := minorUnits(currency)
+	return strconv.FormatFloat(float64(cents)/math.Pow10(units), 'f', units, 64)
+}
+
+//defaultChargeCurrency returns the currency set in the app settings
+//this is used for customers without a currency and when the app settings can't be read
+func defaultChargeCurrency(r *http.Request) string {
+	settings, err := appsettings.Get(r)
+	if err != nil || settings.DefaultCurrency == "" {
+		return defaultCurrency
+	}
+
+	return settings.DefaultCurrency
+}
+
+//ChargeCurrency picks the currency to charge a customer in
+//the currency given with the charge is used first, then the customer's currency, and then
+//the default currency from the app settings
+func ChargeCurrency(r *http.Request, given string, customer CustomerDatastore) (string, error) {
+	currency, err := normalizeCurrency(given)
+	if err != nil {
+		return "", err
+	}
+	if currency != "" {
+		return currency, nil
+	}
+
+	if customer.Currency != "" {
+		return customer.Currency, nil
+	}
+
+	return defaultChargeCurrency(r), nil
+}
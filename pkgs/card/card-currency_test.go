@@ -0,0 +1,148 @@
+package card
+
+import "testing"
+
+func TestMinorUnits(t *testing.T) {
+	tests := []struct {
+		currency string
+		want     int
+	}{
+		{"usd", 2},
+		{"USD", 2},
+		{"eur", 2},
+		{"jpy", 0},
+		{"JPY", 0},
+		{"krw", 0},
+		{"kwd", 3},
+		{"bhd", 3},
+		{"", 2},
+	}
+
+	for _, tt := range tests {
+		if got := minorUnits(tt.currency); got != tt.want {
+			t.Errorf("minorUnits(%q) = %d, want %d", tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestGetAmountAsIntCents(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     uint64
+		wantErr  error
+	}{
+		{"10.50", "usd", 1050, nil},
+		{"32.55", "usd", 3255, nil},
+		{"32.52", "usd", 3252, nil},
+		{"0.01", "usd", 1, nil},
+		{"0", "usd", 0, nil},
+		{"10", "usd", 1000, nil},
+		{"10.5", "usd", 1050, nil},
+		{"10.", "usd", 1000, nil},
+		{".5", "usd", 50, nil},
+		{" 10.50 ", "usd", 1050, nil},
+		{"10.505", "usd", 0, errAmountTooPrecise},
+		{"1000", "jpy", 1000, nil},
+		{"1000.4", "jpy", 0, errAmountTooPrecise},
+		{"1000.5", "jpy", 0, errAmountTooPrecise},
+		{"1000.0", "jpy", 0, errAmountTooPrecise},
+		{"1.23", "kwd", 1230, nil},
+		{"1.230", "kwd", 1230, nil},
+		{"12.5", "kwd", 12500, nil},
+		{"1.234", "kwd", 0, errAmountNotMultipleOfTen},
+		{"0.005", "kwd", 0, errAmountNotMultipleOfTen},
+		{"1.2345", "kwd", 0, errAmountTooPrecise},
+		{"-10.50", "usd", 0, errNegativeAmount},
+		{"-1000", "jpy", 0, errNegativeAmount},
+		{"abc", "usd", 0, errInvalidAmount},
+		{"", "usd", 0, errInvalidAmount},
+		{".", "usd", 0, errInvalidAmount},
+		{"1,000.00", "usd", 0, errInvalidAmount},
+		{"1e3", "usd", 0, errInvalidAmount},
+		{"+10", "usd", 0, errInvalidAmount},
+		{"10.5.0", "usd", 0, errInvalidAmount},
+		{"999999999999999999999", "usd", 0, errInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		got, err := getAmountAsIntCents(tt.amount, tt.currency)
+		if err != tt.wantErr {
+			t.Errorf("getAmountAsIntCents(%q, %q) error = %v, want %v", tt.amount, tt.currency, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("getAmountAsIntCents(%q, %q) = %d, want %d", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		cents    int64
+		currency string
+		want     string
+	}{
+		{1050, "usd", "10.50"},
+		{5, "usd", "0.05"},
+		{0, "usd", "0.00"},
+		{1050, "jpy", "1050"},
+		{0, "jpy", "0"},
+		{1234, "kwd", "1.234"},
+		{5, "kwd", "0.005"},
+		{-1050, "usd", "-10.50"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatAmount(tt.cents, tt.currency); got != tt.want {
+			t.Errorf("FormatAmount(%d, %q) = %q, want %q", tt.cents, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+	tests := []struct {
+		currency string
+		want     string
+		wantErr  bool
+	}{
+		{"usd", "usd", false},
+		{" EUR ", "eur", false},
+		{"", "", false},
+		{"us", "", true},
+		{"usdd", "", true},
+		{"us1", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeCurrency(tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeCurrency(%q) error = %v, want error %t", tt.currency, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeCurrency(%q) = %q, want %q", tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestAmountErrorMessage(t *testing.T) {
+	tests := []struct {
+		err      error
+		currency string
+		want     string
+	}{
+		{errAmountTooPrecise, "jpy", "JPY amounts must be a whole number without decimal places."},
+		{errAmountTooPrecise, "usd", "USD amounts can't have more than 2 decimal places."},
+		{errAmountTooPrecise, "kwd", "KWD amounts can't have more than 3 decimal places."},
+		{errAmountNotMultipleOfTen, "kwd", "KWD amounts must end in a zero, i.e.: 1.230 instead of 1.234."},
+		{errNegativeAmount, "usd", "The amount must be a number greater than zero."},
+		{errInvalidAmount, "usd", "The amount must be a number greater than zero."},
+	}
+
+	for _, tt := range tests {
+		if got := amountErrorMessage(tt.err, tt.currency); got != tt.want {
+			t.Errorf("amountErrorMessage(%v, %q) = %q, want %q", tt.err, tt.currency, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package card
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+//maxEvidenceSize is the largest total size of the files uploaded as evidence for a dispute
+//Stripe won't accept more than 5MB of files as the evidence for one dispute.
+const maxEvidenceSize = 5 << 20
+
+//evidenceFileTypes are the types of files Stripe accepts as dispute evidence
+var evidenceFileTypes = []string{"application/pdf", "image/jpeg", "image/png"}
+
+//dispute errors
+var (
+	errDisputeNotOpen      = errors.New("card: dispute is not waiting for evidence")
+	errInvalidEvidenceFile = errors.New("card: evidence file must be a pdf, jpg, or png")
+	errEvidenceTooLarge    = errors.New("card: evidence files are too large")
+	errNoEvidence          = errors.New("card: no evidence provided")
+)
+
+//Disputes lists the disputes that are still open
+//Disputes that need evidence are listed first, the dispute that is due soonest first, and then
+//the disputes that Stripe or the card's bank is reviewing.  Each dispute is linked to the charge
+//in the ledger so we can show the customer, invoice, and po and link to the receipt.
+func Disputes(w http.ResponseWriter, r *http.Request) {
+	c := r.Context()
+	sc := CreateStripeClient(c)
+	params := &stripe.DisputeListParams{}
+	params.Filters.AddFilter("limit", "", "100")
+	params.AddExpand("data.charge")
+
+	guiLoc, timezone := guiTimezone(r)
+
+	var disputes []disputeData
+	var numDisputes, numNeedResponse uint16
+	list := sc.Disputes.List(params)
+	for list.Next() {
+		d := list.Dispute()
+		if !isDisputeOpen(d.Status) {
+			continue
+		}
+
+		dd := extractDataFromDispute(c, d, guiLoc)
+		disputes = append(disputes, dd)
+		numDisputes++
+		if dd.NeedsResponse {
+			numNeedResponse++
+		}
+	}
+	if err := list.Err(); err != nil {
+		output.Error(err, "Could not get the list of disputes from Stripe.", w)
+		return
+	}
+
+	sort.SliceStable(disputes, func(i, j int) bool {
+		if disputes[i].NeedsResponse != disputes[j].NeedsResponse {
+			return disputes[i].NeedsResponse
+		}
+		return disputes[i].dueBy < disputes[j].dueBy
+	})
+
+	result := disputesListData{
+		Disputes:          disputes,
+		NumDisputes:       numDisputes,
+		NumNeedResponse:   numNeedResponse,
+		ReportGUITimezone: timezone,
+	}
+
+	templates.Load(w, "disputes", result)
+}
+
+//DisputeDetail shows one dispute along with the evidence that has been saved for it
+//Evidence can be uploaded and submitted from this page while the dispute needs a response.
+func DisputeDetail(w http.ResponseWriter, r *http.Request) {
+	disputeID := r.FormValue("dispute_id")
+	if len(disputeID) == 0 {
+		output.Error(errMissingInput, "You must supply a 'dispute_id'.", w)
+		return
+	}
+
+	c := r.Context()
+	sc := CreateStripeClient(c)
+	params := &stripe.DisputeParams{}
+	params.AddExpand("charge")
+	d, err := sc.Disputes.Get(disputeID, params)
+	if err != nil {
+		stripeErr, ok := err.(*stripe.Error)
+		if ok {
+			output.Error(err, stripeErr.Msg, w)
+			return
+		}
+
+		output.Error(err, "Could not look up this dispute.", w)
+		return
+	}
+
+	guiLoc, timezone := guiTimezone(r)
+	result := disputeDetailData{
+		Dispute:           extractDataFromDispute(c, d, guiLoc),
+		MaxEvidenceSizeMB: maxEvidenceSize >> 20,
+		ReportGUITimezone: timezone,
+	}
+
+	templates.Load(w, "dispute", result)
+}
+
+//DisputeEvidence uploads evidence for a dispute to Stripe
+//The evidence is a receipt, a signed authorization from the cardholder, and notes explaining
+//why the charge is valid.  Evidence can be saved without submitting it so more evidence can be
+//added later.  Once evidence is submitted it can't be changed and the dispute is sent to the
+//card's bank to be reviewed.  Files are only replaced if a new file is uploaded.
+func DisputeEvidence(w http.ResponseWriter, r *http.Request) {
+	//the notes and form encoding are small, the extra space keeps us from cutting off files
+	//that are close to the max size
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvidenceSize+(1<<20))
+	tooLargeMsg := "The files are too large. The files for a dispute must be less than " + strconv.Itoa(maxEvidenceSize>>20) + "MB in total."
+	err := r.ParseMultipartForm(maxEvidenceSize)
+	if err != nil {
+		output.Error(errEvidenceTooLarge, tooLargeMsg, w)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var totalSize int64
+	for _, files := range r.MultipartForm.File {
+		for _, fh := range files {
+			totalSize += fh.Size
+		}
+	}
+	if totalSize > maxEvidenceSize {
+		output.Error(errEvidenceTooLarge, tooLargeMsg, w)
+		return
+	}
+
+	//get form values
+	disputeID := r.FormValue("disputeId")
+	notes := strings.TrimSpace(r.FormValue("notes"))
+	submit, _ := strconv.ParseBool(r.FormValue("submit"))
+
+	if len(disputeID) == 0 {
+		output.Error(errMissingInput, "A dispute ID was not provided. This should have been submitted automatically.", w)
+		return
+	}
+
+	//make sure the dispute still needs evidence
+	//Stripe doesn't allow evidence to be changed once it is submitted
+	c := r.Context()
+	sc := CreateStripeClient(c)
+	d, err := sc.Disputes.Get(disputeID, nil)
+	if err != nil {
+		stripeErr, ok := err.(*stripe.Error)
+		if ok {
+			output.Error(err, stripeErr.Msg, w)
+			return
+		}
+
+		output.Error(err, "Could not look up this dispute.", w)
+		return
+	}
+	if !disputeNeedsResponse(d.Status) {
+		output.Error(errDisputeNotOpen, "This dispute is not waiting for evidence. Evidence cannot be changed once it has been submitted.", w)
+		return
+	}
+
+	//upload the files
+	receiptFileID, err := uploadEvidenceFile(sc, r, "receipt")
+	if err != nil {
+		output.Error(err, "The receipt could not be uploaded. It must be a PDF, JPG, or PNG.", w)
+		return
+	}
+
+	authorizationFileID, err := uploadEvidenceFile(sc, r, "authorization")
+	if err != nil {
+		output.Error(err, "The signed authorization could not be uploaded. It must be a PDF, JPG, or PNG.", w)
+		return
+	}
+
+	//make sure there is some evidence to submit
+	hasEvidence := d.EvidenceDetails != nil && d.EvidenceDetails.HasEvidence
+	if notes == "" && receiptFileID == "" && authorizationFileID == "" && !hasEvidence {
+		output.Error(errNoEvidence, "You must provide notes, a receipt, or a signed authorization.", w)
+		return
+	}
+
+	//save the evidence to the dispute
+	evidence := &stripe.DisputeEvidenceParams{}
+	if notes != "" {
+		evidence.UncategorizedText = stripe.String(notes)
+	}
+	if receiptFileID != "" {
+		evidence.Receipt = stripe.String(receiptFileID)
+	}
+	if authorizationFileID != "" {
+		evidence.CustomerSignature = stripe.String(authorizationFileID)
+	}
+
+	//record who provided the evidence like we do for charges
+	username := sessionutils.GetUsername(r)
+	params := &stripe.DisputeParams{
+		Evidence: evidence,
+		Submit:   stripe.Bool(submit),
+	}
+	params.AddMetadata("evidence_by", username)
+	params.AddMetadata("evidence_date", timestamps.ISO8601())
+	if submit {
+		params.AddMetadata("submitted_by", username)
+		params.AddMetadata("submitted_date", timestamps.ISO8601())
+	}
+
+	_, err = sc.Disputes.Update(disputeID, params)
+	if err != nil {
+		stripeErr, ok := err.(*stripe.Error)
+		if ok {
+			output.Error(err, stripeErr.Msg, w)
+			return
+		}
+
+		output.Error(err, "Could not save the evidence for this dispute.", w)
+		return
+	}
+
+	//done
+	if submit {
+		log.Println("card.DisputeEvidence - evidence submitted for dispute", disputeID, "by", username)
+		output.Success("disputeEvidenceSubmitted", nil, w)
+		return
+	}
+
+	output.Success("disputeEvidenceSaved", nil, w)
+}
+
+//uploadEvidenceFile uploads a file from a form to Stripe to be used as evidence for a dispute
+//The id of the uploaded file is returned.  An empty id is returned if no file was chosen.
+func uploadEvidenceFile(sc *client.API, r *http.Request, field string) (string, error) {
+	f, header, err := r.FormFile(field)
+	if err == http.ErrMissingFile {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	//check the type of file by its contents since the type the browser sends isn't reliable
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if !isEvidenceFileType(http.DetectContentType(head[:n])) {
+		return "", errInvalidEvidenceFile
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := sc.Files.New(&stripe.FileParams{
+		FileReader: f,
+		Filename:   stripe.String(header.Filename),
+		Purpose:    stripe.String(string(stripe.FilePurposeDisputeEvidence)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return file.ID, nil
+}
+
+//isEvidenceFileType checks if a file is a type Stripe accepts as dispute evidence
+func isEvidenceFileType(contentType string) bool {
+	for _, t := range evidenceFileTypes {
+		if t == contentType {
+			return true
+		}
+	}
+
+	return false
+}
+
+//isDisputeOpen checks if a dispute hasn't been won or lost yet
+func isDisputeOpen(status stripe.DisputeStatus) bool {
+	return disputeNeedsResponse(status) ||
+		status == stripe.DisputeStatusUnderReview ||
+		status == stripe.DisputeStatusWarningUnderReview
+}
+
+//disputeNeedsResponse checks if a dispute is waiting for us to submit evidence
+//warnings are inquiries from the card's bank that become disputes if they aren't answered
+func disputeNeedsResponse(status stripe.DisputeStatus) bool {
+	return status == stripe.DisputeStatusNeedsResponse || status == stripe.DisputeStatusWarningNeedsResponse
+}
+
+//extractDataFromDispute gets the data we show for a dispute
+//The disputed charge is looked up in the ledger first since the ledger has the customer,
+//invoice, and po for charges made in this app.  If the charge isn't in the ledger the data is
+//taken from the charge expanded on the dispute.
+func extractDataFromDispute(c context.Context, d *stripe.Dispute, guiLoc *time.Location) disputeData {
+	dd := disputeData{
+		ID:             d.ID,
+		Status:         string(d.Status),
+		Reason:         strings.Replace(string(d.Reason), "_", " ", -1),
+		NeedsResponse:  disputeNeedsResponse(d.Status),
+		Created:        time.Unix(d.Created, 0).In(guiLoc).Format("2006-01-02 @ 3:04:05PM"),
+		AmountCents:    d.Amount,
+		AmountDollars:  FormatAmount(d.Amount, string(d.Currency)),
+		CurrencySymbol: currencySymbol(string(d.Currency)),
+		EvidenceBy:     d.Metadata["evidence_by"],
+		SubmittedBy:    d.Metadata["submitted_by"],
+	}
+
+	if d.EvidenceDetails != nil {
+		details := d.EvidenceDetails
+		dd.dueBy = details.DueBy
+		dd.PastDue = details.PastDue
+		dd.HasEvidence = details.HasEvidence
+		dd.SubmissionCount = details.SubmissionCount
+
+		if details.DueBy != 0 {
+			dueBy := time.Unix(details.DueBy, 0)
+			dd.DueBy = dueBy.In(guiLoc).Format("2006-01-02 @ 3:04PM")
+			dd.DaysLeft = int64(math.Ceil(time.Until(dueBy).Hours() / 24))
+		}
+	}
+
+	if d.Evidence != nil {
+		dd.Notes = d.Evidence.UncategorizedText
+		if d.Evidence.Receipt != nil {
+			dd.ReceiptFileID = d.Evidence.Receipt.ID
+		}
+		if d.Evidence.CustomerSignature != nil {
+			dd.AuthorizationFileID = d.Evidence.CustomerSignature.ID
+		}
+	}
+
+	if d.Charge == nil {
+		return dd
+	}
+	dd.ChargeID = d.Charge.ID
+
+	//look up the charge in the ledger
+	e, err := store.FindLedgerEntry(c, dd.ChargeID)
+	if err == nil {
+		dd.Customer = e.CustomerName
+		dd.Invoice = e.Invoice
+		dd.Po = e.Po
+		dd.LastFour = e.CardLast4
+		dd.ChargedBy = e.Username
+		return dd
+	} else if err != errLedgerEntryNotFound {
+		log.Println("card.extractDataFromDispute - could not look up charge in ledger", dd.ChargeID, err)
+	}
+
+	//use the charge from stripe
+	if d.Charge.Created != 0 {
+		data := ExtractDataFromCharge(d.Charge)
+		dd.Customer = data.Customer
+		dd.Invoice = data.Invoice
+		dd.Po = data.Po
+		dd.LastFour = data.LastFour
+		dd.ChargedBy = data.User
+	}
+
+	return dd
+}
@@ -0,0 +1,444 @@
+package card
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/users"
+)
+
+const (
+	//defaultExpiringMonths is the number of months to look ahead for expiring cards when
+	//a number isn't given, this is the current month and the next month
+	defaultExpiringMonths = 2
+
+	//maxExpiringMonths is the furthest ahead we will look for expiring cards
+	maxExpiringMonths = 12
+)
+
+//expiringMonthChoices are the number of months a user can choose from in the gui
+var expiringMonthChoices = []int{1, 2, 3, 6, 12}
+
+//expiring card errors
+var (
+	errInvalidExpiringMonths = errors.New("card: invalid number of months")
+	errInvalidExpiration     = errors.New("card: invalid card expiration")
+	errEmailNotEnabled       = errors.New("card: sending emails is not enabled")
+)
+
+//ExpiringCards lists the cards that expire this month or within the next few months
+//This is used to ask customers for a new card before charges start failing.  Expired cards
+//are removed by RemoveExpiredCards once the month they expire in is over.
+func ExpiringCards(w http.ResponseWriter, r *http.Request) {
+	months, err := parseExpiringMonths(r.FormValue("months"))
+	if err != nil {
+		output.Error(err, "The number of months must be between 1 and "+strconv.Itoa(maxExpiringMonths)+".", w)
+		return
+	}
+
+	cards, err := findExpiringCards(r.Context(), time.Now(), months)
+	if err != nil {
+		output.Error(err, "Could not look up the cards that expire soon.", w)
+		return
+	}
+
+	numNoOther := 0
+	for _, c := range cards {
+		if c.OtherCards == 0 {
+			numNoOther++
+		}
+	}
+
+	result := expiringCardsData{
+		Months:       months,
+		Through:      lastExpirationMonth(time.Now(), months),
+		MonthChoices: expiringMonthChoices,
+		Cards:        cards,
+		NumCards:     len(cards),
+		NumNoOther:   numNoOther,
+	}
+
+	templates.Load(w, "expiring", result)
+}
+
+//NotifyExpiringCards emails a list of the cards that expire soon to the app's administrators
+//Each administrator whose username is an email address gets the list.  If "customers" is true,
+//each customer with a billing email is also sent an email asking for a new card.
+//Nothing is sent if no cards expire soon.
+//This is designed to be run monthly as a cron task.
+func NotifyExpiringCards(w http.ResponseWriter, r *http.Request) {
+	if !emailutils.Enabled() {
+		output.Error(errEmailNotEnabled, "An SMTP server is not set in app.yaml so emails cannot be sent.", w)
+		return
+	}
+
+	months, err := parseExpiringMonths(r.FormValue("months"))
+	if err != nil {
+		output.Error(err, "The number of months must be between 1 and "+strconv.Itoa(maxExpiringMonths)+".", w)
+		return
+	}
+	notifyCustomers, _ := strconv.ParseBool(r.FormValue("customers"))
+
+	c := r.Context()
+	cards, err := findExpiringCards(c, time.Now(), months)
+	if err != nil {
+		output.Error(err, "Could not look up the cards that expire soon.", w)
+		return
+	}
+	if len(cards) == 0 {
+		log.Println("card.NotifyExpiringCards - No cards expire in the next", months, "month(s)")
+		output.Success("expiringCardsNotified", map[string]int{"cards": 0, "admins": 0, "customers": 0}, w)
+		return
+	}
+
+	//email the administrators
+	admins, err := users.FindAdminEmails(c)
+	if err != nil {
+		output.Error(err, "Could not look up the administrators to email.", w)
+		return
+	}
+	if len(admins) > 0 {
+		err = emailutils.Send(emailutils.Message{
+			To:      admins,
+			Subject: strconv.Itoa(len(cards)) + " card(s) expire soon",
+			Body:    expiringCardsDigest(cards, lastExpirationMonth(time.Now(), months)),
+		})
+		if err != nil {
+			log.Println("card.NotifyExpiringCards - Could not email administrators", err)
+			output.Error(err, "Could not email the administrators.", w)
+			return
+		}
+	} else {
+		log.Println("card.NotifyExpiringCards - No administrators have an email address as their username")
+	}
+
+	//email each customer's billing contact
+	//an error for one customer is logged so the other customers are still emailed
+	numCustomers := 0
+	if notifyCustomers {
+		info, err := company.Get(r)
+		if err != nil {
+			output.Error(err, "Could not look up the company info to email customers.", w)
+			return
+		}
+
+		for _, customerCards := range groupByCustomer(cards) {
+			to := customerCards[0].BillingEmail
+			if to == "" {
+				continue
+			}
+
+			err = emailutils.Send(emailutils.Message{
+				To:      []string{to},
+				Subject: "The card we have on file for " + customerCards[0].CustomerName + " expires soon",
+				Body:    expiringCardsCustomerEmail(customerCards, info),
+			})
+			if err != nil {
+				log.Println("card.NotifyExpiringCards - Could not email customer", customerCards[0].CustomerDatastoreID, err)
+				continue
+			}
+
+			numCustomers++
+		}
+	}
+
+	log.Println("card.NotifyExpiringCards...done", len(cards), "card(s),", len(admins), "administrator(s),", numCustomers, "customer(s)")
+	output.Success("expiringCardsNotified", map[string]int{"cards": len(cards), "admins": len(admins), "customers": numCustomers}, w)
+}
+
+//parseExpiringMonths gets the number of months to look ahead for expiring cards
+func parseExpiringMonths(s string) (int, error) {
+	if s == "" {
+		return defaultExpiringMonths, nil
+	}
+
+	months, err := strconv.Atoi(s)
+	if err != nil || months < 1 || months > maxExpiringMonths {
+		return 0, errInvalidExpiringMonths
+	}
+
+	return months, nil
+}
+
+//expirationMonths returns the card expirations, as M/YYYY, for the current month and the following months
+//the month isn't zero padded since that is how expirations are saved
+func expirationMonths(now time.Time, months int) []string {
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	out := make([]string, 0, months)
+	for i := 0; i < months; i++ {
+		m := first.AddDate(0, i, 0)
+		out = append(out, strconv.Itoa(int(m.Month()))+"/"+strconv.Itoa(m.Year()))
+	}
+
+	return out
+}
+
+//lastExpirationMonth returns the last month cards are looked up for, i.e.: January 2025
+func lastExpirationMonth(now time.Time, months int) string {
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return first.AddDate(0, months-1, 0).Format("January 2006")
+}
+
+//parseExpiration gets the time a card stops working from the card's expiration
+//cards work through the last day of the month they expire in so this is the first day of the
+//next month.  Expirations are saved as M/YYYY but MM/YYYY is accepted as well.
+func parseExpiration(exp string) (time.Time, error) {
+	parts := strings.Split(strings.TrimSpace(exp), "/")
+	if len(parts) != 2 {
+		return time.Time{}, errInvalidExpiration
+	}
+
+	month, err := strconv.Atoi(parts[0])
+	if err != nil || month < 1 || month > 12 {
+		return time.Time{}, errInvalidExpiration
+	}
+	year, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return time.Time{}, errInvalidExpiration
+	}
+
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0), nil
+}
+
+//findExpiringCards looks up the cards that expire this month or in the following months
+//Saved cards are looked up along with the cards of customers that don't have saved cards.  A
+//customer with saved cards also has its default card's expiration saved on the customer so
+//these customers are skipped when looking up customers to not list a card twice.
+func findExpiringCards(ctx context.Context, now time.Time, months int) ([]expiringCard, error) {
+	//customers and their cards are looked up once even if more than one card expires
+	customers := map[int64]CustomerDatastore{}
+	cardsByCustomer := map[int64][]SavedCard{}
+	findCustomer := func(id int64) (CustomerDatastore, error) {
+		if c, ok := customers[id]; ok {
+			return c, nil
+		}
+
+		c, err := findByDatastoreID(ctx, id)
+		if err != nil {
+			return c, err
+		}
+
+		customers[id] = c
+		return c, nil
+	}
+	findSavedCards := func(id int64) ([]SavedCard, error) {
+		if cards, ok := cardsByCustomer[id]; ok {
+			return cards, nil
+		}
+
+		cards, err := store.FindSavedCards(ctx, id)
+		if err != nil {
+			return cards, err
+		}
+
+		cardsByCustomer[id] = cards
+		return cards, nil
+	}
+
+	monthYears := expirationMonths(now, months)
+	expiring := []expiringCard{}
+	for _, monthYear := range monthYears {
+		savedCards, err := store.FindSavedCardsByExpiration(ctx, monthYear)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sc := range savedCards {
+			customer, err := findCustomer(sc.CustomerDatastoreID)
+			if err != nil {
+				log.Println("card.findExpiringCards - Could not look up customer for saved card with ID", sc.ID, err)
+				continue
+			}
+
+			expiring = append(expiring, newExpiringCard(customer, sc))
+		}
+
+		customerCards, err := store.FindByExpiration(ctx, monthYear)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cc := range customerCards {
+			cards, err := findSavedCards(cc.ID)
+			if err != nil {
+				return nil, err
+			}
+			if len(cards) > 0 {
+				continue
+			}
+
+			customer, err := findCustomer(cc.ID)
+			if err != nil {
+				log.Println("card.findExpiringCards - Could not look up customer with ID", cc.ID, err)
+				continue
+			}
+
+			cards, err = FindCards(ctx, customer)
+			if err != nil {
+				return nil, err
+			}
+
+			expiring = append(expiring, newExpiringCard(customer, cards[0]))
+		}
+	}
+
+	//count each customer's cards that don't expire soon
+	//these are the cards that can still be charged once the expiring card expires
+	for i, e := range expiring {
+		cards, err := findSavedCards(e.CustomerDatastoreID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range cards {
+			if !containsString(monthYears, normalizeExpiration(c.CardExpiration)) {
+				expiring[i].OtherCards++
+			}
+		}
+	}
+
+	//calculate days left and sort, soonest to expire first
+	for i, e := range expiring {
+		expires, err := parseExpiration(e.CardExpiration)
+		if err != nil {
+			continue
+		}
+
+		expiring[i].expires = expires
+		expiring[i].DaysLeft = int(expires.Sub(now).Hours() / 24)
+	}
+
+	sort.SliceStable(expiring, func(i, j int) bool {
+		if !expiring[i].expires.Equal(expiring[j].expires) {
+			return expiring[i].expires.Before(expiring[j].expires)
+		}
+
+		return strings.ToLower(expiring[i].CustomerName) < strings.ToLower(expiring[j].CustomerName)
+	})
+
+	return expiring, nil
+}
+
+//newExpiringCard builds the data about an expiring card from the customer and the card
+func newExpiringCard(customer CustomerDatastore, c SavedCard) expiringCard {
+	return expiringCard{
+		CustomerDatastoreID: customer.ID,
+		CustomerID:          customer.CustomerID,
+		CustomerName:        customer.CustomerName,
+		BillingEmail:        customer.BillingEmail,
+		Cardholder:          c.Cardholder,
+		CardBrand:           c.CardBrand,
+		CardLast4:           c.CardLast4,
+		CardExpiration:      c.CardExpiration,
+		IsDefault:           c.IsDefault,
+	}
+}
+
+//normalizeExpiration removes the zero padding from the month of an expiration
+//i.e.: 01/2025 becomes 1/2025
+func normalizeExpiration(exp string) string {
+	return strings.TrimPrefix(strings.TrimSpace(exp), "0")
+}
+
+//containsString checks if a string is in a list of strings
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+//groupByCustomer groups expiring cards by the customer they belong to
+//customers are in the order of their soonest expiring card
+func groupByCustomer(cards []expiringCard) [][]expiringCard {
+	index := map[int64]int{}
+	groups := [][]expiringCard{}
+	for _, c := range cards {
+		i, ok := index[c.CustomerDatastoreID]
+		if !ok {
+			i = len(groups)
+			index[c.CustomerDatastoreID] = i
+			groups = append(groups, []expiringCard{})
+		}
+
+		groups[i] = append(groups[i], c)
+	}
+
+	return groups
+}
+
+//describeCard builds a short description of a card for emails
+//i.e.: visa ending in 4242 (expires 1/2025)
+func describeCard(c expiringCard) string {
+	d := "ending in " + c.CardLast4 + " (expires " + c.CardExpiration + ")"
+	if c.CardBrand != "" {
+		d = c.CardBrand + " " + d
+	}
+
+	return d
+}
+
+//expiringCardsDigest builds the body of the email sent to administrators
+func expiringCardsDigest(cards []expiringCard, through string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "The following %d card(s) expire by the end of %s.\n", len(cards), through)
+	b.WriteString("Ask these customers for a new card and update the card in the app before it expires.\n")
+	b.WriteString("Customers marked with * don't have another card that can be charged.\n\n")
+
+	for _, c := range cards {
+		noOther := ""
+		if c.OtherCards == 0 {
+			noOther = "* "
+		}
+
+		fmt.Fprintf(&b, "%s%s", noOther, c.CustomerName)
+		if c.CustomerID != "" {
+			fmt.Fprintf(&b, " [%s]", c.CustomerID)
+		}
+		fmt.Fprintf(&b, "\n    %s, cardholder %s\n", describeCard(c), c.Cardholder)
+		if c.BillingEmail != "" {
+			fmt.Fprintf(&b, "    billing contact: %s\n", c.BillingEmail)
+		}
+	}
+
+	b.WriteString("\nExpired cards are removed automatically after the month they expire in.\n")
+	return b.String()
+}
+
+//expiringCardsCustomerEmail builds the body of the email sent to a customer's billing contact
+//the company's contact info is included so the customer knows who to send a new card to
+func expiringCardsCustomerEmail(cards []expiringCard, info company.Info) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Hello,\n\nThe following card(s) we have on file for %s expire soon:\n\n", cards[0].CustomerName)
+	for _, c := range cards {
+		fmt.Fprintf(&b, "    %s\n", describeCard(c))
+	}
+
+	b.WriteString("\nPlease contact us to provide a new card so we can continue to process your orders without interruption.\n\n")
+	b.WriteString("Thank you,\n")
+	b.WriteString(info.CompanyName + "\n")
+	if info.PhoneNum != "" {
+		b.WriteString(info.PhoneNum + "\n")
+	}
+	if info.Email != "" {
+		b.WriteString(info.Email + "\n")
+	}
+
+	return b.String()
+}
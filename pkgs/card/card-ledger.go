@@ -0,0 +1,437 @@
+package card
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+//types of ledger entries
+const (
+	ledgerTypeCharge = "charge"
+	ledgerTypeRefund = "refund"
+)
+
+//defaultResyncDays is how many days back the resync cron task looks for charges and refunds
+const defaultResyncDays = 3
+
+//maxResyncDays is the furthest back the resync cron task can look
+//each charge and refund is looked up from Stripe so resyncing a long range takes too long for a
+//request, longer ranges are resynced with the resync command
+const maxResyncDays = 31
+
+//ledger errors
+var (
+	errInvalidResyncRange    = errors.New("card: invalid date range to resync the ledger")
+	errResyncRangeNotAllowed = errors.New("card: a date range can only be resynced with the resync command")
+)
+
+//entryFromCharge builds a ledger entry from a stripe charge
+func entryFromCharge(chg *stripe.Charge) LedgerEntry {
+	d := ExtractDataFromCharge(chg)
+	meta, _ := json.Marshal(chg.Metadata)
+
+	//the part of a partially captured charge that wasn't captured is counted as refunded by Stripe
+	//but it was never charged, only the amount captured and real refunds are saved
+	amountRefunded := chg.AmountRefunded - (chg.Amount - d.AmountCents)
+	if amountRefunded < 0 {
+		amountRefunded = 0
+	}
+
+	e := LedgerEntry{
+		StripeID:            chg.ID,
+		Type:                ledgerTypeCharge,
+		StripeChargeID:      chg.ID,
+		StripeCustomerToken: d.StripeCustID,
+		CustomerID:          d.CustomerID,
+		CustomerName:        d.Customer,
+		AmountCents:         d.AmountCents,
+		AmountRefundedCents: amountRefunded,
+		Currency:            string(chg.Currency),
+		Status:              chg.Status,
+		Captured:            chg.Captured,
+		FailureCode:         chg.FailureCode,
+		FailureMessage:      chg.FailureMessage,
+		Invoice:             d.Invoice,
+		Po:                  d.Po,
+		Cardholder:          d.Cardholder,
+		CardBrand:           d.CardBrand,
+		CardLast4:           d.LastFour,
+		CardExpiration:      d.Expiration,
+		PaymentType:         d.PaymentType,
+		Username:            d.User,
+		AuthorizedByUser:    d.AuthorizedByUser,
+		AuthorizedDatetime:  d.AuthorizedDatetime,
+		ProcessedDatetime:   d.ProcessedDatetime,
+		AutoCharge:          d.AutoCharge,
+		AutoChargeReferrer:  d.AutoChargeReferrer,
+		AutoChargeReason:    d.AutoChargeReason,
+		Level3Provided:      d.Level3DataProvided,
+		Metadata:            string(meta),
+		Created:             chg.Created,
+	}
+
+	e.setBalanceTransaction(chg.BalanceTransaction)
+	return e
+}
+
+//entryFromRefund builds a ledger entry from a stripe refund
+//chg is the charge the refund was made against, this is used to fill in the customer, card,
+//and invoice info since a refund doesn't hold this data.  If chg is nil the charge from the
+//refund is used which only has data if it was expanded when the refund was retrieved.
+func entryFromRefund(ref *stripe.Refund, chg *stripe.Charge) LedgerEntry {
+	if chg == nil {
+		chg = ref.Charge
+	}
+
+	e := LedgerEntry{}
+	if chg != nil {
+		e = entryFromCharge(chg)
+	}
+
+	//refunds made in the Stripe dashboard won't have a reason or user
+	reason := string(ref.Reason)
+	if reason == "" {
+		reason = "unknown"
+	}
+	username := ref.Metadata["processed_by"]
+	if username == "" {
+		username = "unknown"
+	}
+
+	meta, _ := json.Marshal(ref.Metadata)
+
+	e.StripeID = ref.ID
+	e.Type = ledgerTypeRefund
+	e.AmountCents = ref.Amount
+	e.AmountRefundedCents = 0
+	e.Currency = string(ref.Currency)
+	e.Status = string(ref.Status)
+	e.Captured = false
+	e.FailureCode = ""
+	e.FailureMessage = string(ref.FailureReason)
+	e.Username = username
+	e.AuthorizedByUser = ""
+	e.AuthorizedDatetime = ""
+	e.ProcessedDatetime = ""
+	e.Reason = reason
+	e.Metadata = string(meta)
+	e.Created = ref.Created
+	e.setBalanceTransaction(ref.BalanceTransaction)
+	return e
+}
+
+//setBalanceTransaction saves the fee and net amount of a charge or refund from its balance transaction
+//The balance transaction is only an id unless it was expanded when the charge or refund was
+//retrieved from Stripe, so every call to Stripe for a charge or refund that is saved to the
+//ledger must expand the balance transaction.  Charges that are authorized only don't have a
+//balance transaction yet.
+func (e *LedgerEntry) setBalanceTransaction(bt *stripe.BalanceTransaction) {
+	if bt == nil {
+		e.BalanceTransactionID = ""
+		e.FeeCents = 0
+		e.NetCents = 0
+		e.AvailableOn = 0
+		return
+	}
+
+	e.BalanceTransactionID = bt.ID
+	e.FeeCents = bt.Fee
+	e.NetCents = bt.Net
+	e.AvailableOn = bt.AvailableOn
+}
+
+//feeKnown returns true if the fee and net amount were saved from the balance transaction
+func (e LedgerEntry) feeKnown() bool {
+	return e.BalanceTransactionID != "" && e.AvailableOn != 0
+}
+
+//chargeData converts a ledger entry for a charge into the format used to build the gui
+//this matches what ExtractDataFromCharge returns except for the level 3 details
+func (e LedgerEntry) chargeData() ChargeData {
+	d := ChargeData{
+		ID:                 e.StripeID,
+		AmountCents:        e.AmountCents,
+		AmountDollars:      FormatAmount(e.AmountCents, e.Currency),
+		Currency:           e.Currency,
+		CurrencySymbol:     currencySymbol(e.Currency),
+		Captured:           e.Captured,
+		CapturedStr:        strconv.FormatBool(e.Captured),
+		Timestamp:          time.Unix(e.Created, 0).UTC().Format("2006-01-02T15:04:05.000Z"),
+		Invoice:            e.Invoice,
+		Po:                 e.Po,
+		StripeCustID:       e.StripeCustomerToken,
+		Customer:           e.CustomerName,
+		CustomerID:         e.CustomerID,
+		User:               e.Username,
+		Cardholder:         e.Cardholder,
+		LastFour:           e.CardLast4,
+		Expiration:         e.CardExpiration,
+		CardBrand:          e.CardBrand,
+		Level3DataProvided: e.Level3Provided,
+
+		AutoCharge:         e.AutoCharge,
+		AutoChargeReferrer: e.AutoChargeReferrer,
+		AutoChargeReason:   e.AutoChargeReason,
+
+		AuthorizedByUser:   e.AuthorizedByUser,
+		AuthorizedDatetime: e.AuthorizedDatetime,
+		ProcessedDatetime:  e.ProcessedDatetime,
+
+		Released: !e.Captured && e.FailureCode == "" && e.AmountRefundedCents > 0,
+
+		PaymentType: e.PaymentType,
+		Status:      e.Status,
+		Pending:     e.Status == "pending",
+
+		FailureCode:    e.FailureCode,
+		FailureMessage: e.FailureMessage,
+	}
+
+	//entries saved before bank accounts could be charged are all cards
+	if d.PaymentType == "" {
+		d.PaymentType = paymentTypeCard
+	}
+	d.Returned = d.PaymentType == paymentTypeBankAccount && e.Status == "failed"
+
+	//who released an authorization and why is only saved in the metadata
+	if d.Released {
+		meta := map[string]string{}
+		json.Unmarshal([]byte(e.Metadata), &meta)
+		d.ReleasedByUser = meta["released_by"]
+		d.ReleasedDatetime = meta["released_date"]
+		d.ReleaseReason = meta["release_reason"]
+	}
+
+	if e.feeKnown() {
+		d.FeeCents = e.FeeCents
+		d.FeeDollars = FormatAmount(e.FeeCents, e.Currency)
+		d.NetCents = e.NetCents
+		d.NetDollars = FormatAmount(e.NetCents, e.Currency)
+	}
+
+	return d
+}
+
+//refundData converts a ledger entry for a refund into the format used to build the gui
+//the fee and net amount are flipped to positive numbers since they are shown next to the
+//amount refunded, Stripe records them as negative numbers since money is leaving our balance
+func (e LedgerEntry) refundData() RefundData {
+	d := RefundData{
+		ID:             e.StripeID,
+		ChargeID:       e.StripeChargeID,
+		Refunded:       true,
+		AmountCents:    e.AmountCents,
+		AmountDollars:  FormatAmount(e.AmountCents, e.Currency),
+		Currency:       e.Currency,
+		CurrencySymbol: currencySymbol(e.Currency),
+		Timestamp:      time.Unix(e.Created, 0).UTC().Format("2006-01-02T15:04:05.000Z"),
+		Invoice:        e.Invoice,
+		Po:             e.Po,
+		LastFour:       e.CardLast4,
+		Expiration:     e.CardExpiration,
+		CardBrand:      e.CardBrand,
+		Customer:       e.CustomerName,
+		CustomerID:     e.CustomerID,
+		User:           e.Username,
+		Reason:         e.Reason,
+	}
+
+	if e.feeKnown() {
+		d.FeeCents = -e.FeeCents
+		d.NetCents = -e.NetCents
+	} else {
+		d.FeeCents = 0
+		d.NetCents = e.AmountCents
+		d.FeeEstimated = true
+	}
+	d.FeeDollars = FormatAmount(d.FeeCents, e.Currency)
+	d.NetDollars = FormatAmount(d.NetCents, e.Currency)
+
+	return d
+}
+
+//saveChargeToLedger saves a charge returned from Stripe to the ledger
+func saveChargeToLedger(ctx context.Context, chg *stripe.Charge) error {
+	e := entryFromCharge(chg)
+	e.DatetimeSynced = timestamps.ISO8601()
+	return store.SaveLedgerEntry(ctx, e)
+}
+
+//saveRefundToLedger saves a refund returned from Stripe to the ledger
+//Releasing an authorization, or the part of an authorization that wasn't captured, is recorded
+//by Stripe as a refund without a balance transaction since no money moved.  These refunds aren't
+//saved since they would show as refunds of money that was never charged.
+func saveRefundToLedger(ctx context.Context, ref *stripe.Refund, chg *stripe.Charge) error {
+	if ref.BalanceTransaction == nil {
+		return nil
+	}
+
+	e := entryFromRefund(ref, chg)
+	e.DatetimeSynced = timestamps.ISO8601()
+	return store.SaveLedgerEntry(ctx, e)
+}
+
+//GetChargeData returns the data for a charge, used to build a receipt
+//The charge is looked up in the ledger first.  If the charge isn't in the ledger, it was
+//probably made before the ledger existed, so it is retrieved from Stripe and saved.
+func GetChargeData(ctx context.Context, chargeID string) (ChargeData, error) {
+	e, err := store.FindLedgerEntry(ctx, chargeID)
+	if err == nil && e.Type == ledgerTypeCharge {
+		return e.chargeData(), nil
+	} else if err != nil && err != errLedgerEntryNotFound {
+		log.Println("card.GetChargeData - could not look up charge in ledger, using Stripe", err)
+	}
+
+	sc := CreateStripeClient(ctx)
+	params := &stripe.ChargeParams{}
+	params.AddExpand("balance_transaction")
+	chg, err := sc.Charges.Get(chargeID, params)
+	if err != nil {
+		return ChargeData{}, err
+	}
+
+	err = saveChargeToLedger(ctx, chg)
+	if err != nil {
+		log.Println("card.GetChargeData - could not save charge to ledger", err)
+	}
+
+	return ExtractDataFromCharge(chg), nil
+}
+
+//ResyncLedger is used to fill in the ledger with any charges or refunds we missed
+//This is run via a cron job.  By default this looks at the last few days, up to
+//maxResyncDays can be given as days.  Charges and refunds made in the Stripe dashboard
+//are saved as well.  Older date ranges are resynced with the resync command instead.
+func ResyncLedger(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("start") != "" || r.FormValue("end") != "" {
+		output.Error(errResyncRangeNotAllowed, "A date range can't be resynced from a url. Use the resync command instead.", w)
+		return
+	}
+
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	if days < 1 {
+		days = defaultResyncDays
+	}
+	if days > maxResyncDays {
+		days = maxResyncDays
+	}
+
+	end := time.Now().UTC()
+	start := end.AddDate(0, 0, -days)
+
+	c := r.Context()
+	numCharges, numRefunds, err := ResyncLedgerRange(c, start, end)
+	if err != nil {
+		output.Error(err, "Could not resync the ledger.", w)
+		return
+	}
+
+	output.Success("resyncLedger", map[string]int{"charges": numCharges, "refunds": numRefunds}, w)
+}
+
+//ParseResyncRange parses the yyyy-mm-dd start and end dates used to resync the ledger
+//the end date is inclusive so the returned end is the last second of that day
+func ParseResyncRange(startString, endString string) (start, end time.Time, err error) {
+	start, err = time.Parse("2006-01-02", startString)
+	if err != nil {
+		return
+	}
+
+	end, err = time.Parse("2006-01-02", endString)
+	if err != nil {
+		return
+	}
+	end = end.Add(24*time.Hour - time.Second)
+
+	if end.Before(start) {
+		err = errInvalidResyncRange
+	}
+	return
+}
+
+//ResyncLedgerRange saves every charge and refund created within a date range to the ledger
+//Entries that already exist are updated.  This is safe to run as often as needed.
+func ResyncLedgerRange(c context.Context, start, end time.Time) (numCharges, numRefunds int, err error) {
+	sc := CreateStripeClient(c)
+	startUnix := strconv.FormatInt(start.Unix(), 10)
+	endUnix := strconv.FormatInt(end.Unix(), 10)
+
+	numCharges, err = resyncCharges(c, sc, startUnix, endUnix)
+	if err != nil {
+		return
+	}
+
+	numRefunds, err = resyncRefunds(c, sc, startUnix, endUnix)
+	if err != nil {
+		return
+	}
+
+	log.Println("card.ResyncLedgerRange - Saved", numCharges, "charges and", numRefunds, "refunds between", start.Format(time.RFC3339), "and", end.Format(time.RFC3339))
+	return
+}
+
+//resyncCharges saves the charges made within a date range to the ledger
+func resyncCharges(c context.Context, sc *client.API, startUnix, endUnix string) (numCharges int, err error) {
+	params := &stripe.ChargeListParams{}
+	params.Filters.AddFilter("created", "gte", startUnix)
+	params.Filters.AddFilter("created", "lte", endUnix)
+	params.Filters.AddFilter("limit", "", "100")
+	params.AddExpand("data.balance_transaction")
+
+	charges := sc.Charges.List(params)
+	for charges.Next() {
+		err = saveChargeToLedger(c, charges.Charge())
+		if err != nil {
+			return
+		}
+		numCharges++
+	}
+
+	err = charges.Err()
+	return
+}
+
+//resyncRefunds saves the refunds made within a date range to the ledger
+//The charge each refund was made against is expanded so the refund can be saved with the
+//customer, card, and invoice info from the charge.  The balance transactions of both are
+//expanded to get the fees.  A charge can be refunded long after it was made so the charge
+//is saved again to update the amount refunded.
+func resyncRefunds(c context.Context, sc *client.API, startUnix, endUnix string) (numRefunds int, err error) {
+	params := &stripe.RefundListParams{}
+	params.Filters.AddFilter("created", "gte", startUnix)
+	params.Filters.AddFilter("created", "lte", endUnix)
+	params.Filters.AddFilter("limit", "", "100")
+	params.AddExpand("data.balance_transaction")
+	params.AddExpand("data.charge.balance_transaction")
+
+	refunds := sc.Refunds.List(params)
+	for refunds.Next() {
+		ref := refunds.Refund()
+		err = saveRefundToLedger(c, ref, ref.Charge)
+		if err != nil {
+			return
+		}
+		numRefunds++
+
+		//the charge is only an id if it couldn't be expanded, don't overwrite the charge's entry with it
+		if ref.Charge != nil && ref.Charge.Created != 0 {
+			err = saveChargeToLedger(c, ref.Charge)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	err = refunds.Err()
+	return
+}
@@ -0,0 +1,160 @@
+package card
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+//payment method errors
+var (
+	errRequiresAction = errors.New("card: requires_action")
+)
+
+//isPaymentMethod checks if a Stripe card id is for a PaymentMethod or a legacy card source
+//Cards saved before we used SetupIntents are sources on the Stripe customer (card_...).  Cards
+//saved since are PaymentMethods attached to the Stripe customer (pm_...).  Both can be charged
+//with a PaymentIntent but they are set as the default and removed differently.  Bank accounts
+//are sources too (ba_...), see isBankAccountID.
+func isPaymentMethod(stripeCardID string) bool {
+	return strings.HasPrefix(stripeCardID, "pm_")
+}
+
+//savePaymentMethod saves a card to a Stripe customer so it can be charged later
+//The card token from stripe.js is turned into a PaymentMethod and then confirmed with a
+//SetupIntent for off session use.  The SetupIntent lets the card's bank authenticate the card
+//once now so that later charges made without the cardholder present are less likely to need
+//authentication (SCA).  If the bank wants the cardholder to authenticate the card now,
+//errRequiresAction is returned and the PaymentMethod is removed since the cardholder isn't
+//around to authenticate the card.
+func savePaymentMethod(sc *client.API, stripeCustomerID, cardToken string) (*stripe.PaymentMethod, error) {
+	pm, err := sc.PaymentMethods.New(&stripe.PaymentMethodParams{
+		Type: stripe.String(string(stripe.PaymentMethodTypeCard)),
+		Card: &stripe.PaymentMethodCardParams{
+			Token: stripe.String(cardToken),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//confirming the setup intent attaches the payment method to the customer
+	si, err := sc.SetupIntents.New(&stripe.SetupIntentParams{
+		Customer:           stripe.String(stripeCustomerID),
+		PaymentMethod:      stripe.String(pm.ID),
+		PaymentMethodTypes: stripe.StringSlice([]string{string(stripe.PaymentMethodTypeCard)}),
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+		Confirm:            stripe.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if si.Status != stripe.SetupIntentStatusSucceeded {
+		log.Println("card.savePaymentMethod - setup intent not successful", si.ID, si.Status)
+
+		_, err := sc.SetupIntents.Cancel(si.ID, nil)
+		if err != nil {
+			log.Println("card.savePaymentMethod - could not cancel setup intent", si.ID, err)
+		}
+		detachFromStripe(sc, stripeCustomerID, pm.ID)
+
+		return nil, errRequiresAction
+	}
+
+	return pm, nil
+}
+
+//saveToStripe saves a card or bank account to a Stripe customer and fills in the Stripe
+//details of the saved card
+//c.PaymentType decides if token is a card token or a bank account token from stripe.js.
+func saveToStripe(sc *client.API, stripeCustomerID, token string, c *SavedCard) error {
+	if c.isBankAccount() {
+		ba, err := saveBankAccount(sc, stripeCustomerID, token)
+		if err != nil {
+			return err
+		}
+
+		c.StripeCardID = ba.ID
+		c.CardBrand = ba.BankName
+		c.BankAccountStatus = string(ba.Status)
+		return nil
+	}
+
+	pm, err := savePaymentMethod(sc, stripeCustomerID, token)
+	if err != nil {
+		return err
+	}
+
+	c.PaymentType = paymentTypeCard
+	c.StripeCardID = pm.ID
+	c.BankAccountStatus = ""
+	if pm.Card != nil {
+		c.CardBrand = string(pm.Card.Brand)
+	}
+	return nil
+}
+
+//setDefaultOnStripe makes a card the Stripe customer's default card
+//PaymentMethods are set as the default for invoices, legacy card sources are set as the default
+//source.  The default is what is charged from the Stripe dashboard and what we charge for
+//customers without saved cards.
+func setDefaultOnStripe(sc *client.API, stripeCustomerID, stripeCardID string) error {
+	params := &stripe.CustomerParams{}
+	if isPaymentMethod(stripeCardID) {
+		params.InvoiceSettings = &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(stripeCardID),
+		}
+	} else {
+		params.DefaultSource = stripe.String(stripeCardID)
+	}
+
+	_, err := sc.Customers.Update(stripeCustomerID, params)
+	return err
+}
+
+//detachFromStripe removes a card from a Stripe customer
+//errors are logged and not returned since this is only used when we are removing the card
+//from our db anyway
+func detachFromStripe(sc *client.API, stripeCustomerID, stripeCardID string) {
+	var err error
+	if isPaymentMethod(stripeCardID) {
+		_, err = sc.PaymentMethods.Detach(stripeCardID, nil)
+	} else if isBankAccountID(stripeCardID) {
+		_, err = sc.BankAccounts.Del(stripeCardID, &stripe.BankAccountParams{
+			Customer: stripe.String(stripeCustomerID),
+		})
+	} else {
+		_, err = sc.Cards.Del(stripeCardID, &stripe.CardParams{
+			Customer: stripe.String(stripeCustomerID),
+		})
+	}
+
+	if err != nil {
+		log.Println("card.detachFromStripe - Could not remove card from stripe", stripeCardID, err)
+	}
+}
+
+//defaultStripeCardID looks up the id of a Stripe customer's default card
+//This is used for customers without saved cards since we don't know the id of their card.
+//The default PaymentMethod is used first and then the default source.
+func defaultStripeCardID(ctx context.Context, stripeCustomerID string) (string, error) {
+	sc := CreateStripeClient(ctx)
+	stripeCust, err := sc.Customers.Get(stripeCustomerID, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if stripeCust.InvoiceSettings != nil && stripeCust.InvoiceSettings.DefaultPaymentMethod != nil {
+		return stripeCust.InvoiceSettings.DefaultPaymentMethod.ID, nil
+	}
+	if stripeCust.DefaultSource != nil {
+		return stripeCust.DefaultSource.ID, nil
+	}
+
+	return "", errCardNotFound
+}
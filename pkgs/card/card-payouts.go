@@ -0,0 +1,320 @@
+package card
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
+	"github.com/stripe/stripe-go/v72"
+)
+
+//categories of the transactions that make up a payout
+//these match the reporting categories Stripe uses except that everything that isn't a
+//charge, refund, or fee is grouped together as an adjustment (disputes, reversals, etc.)
+const (
+	payoutCategoryCharge     = "charge"
+	payoutCategoryRefund     = "refund"
+	payoutCategoryFee        = "fee"
+	payoutCategoryAdjustment = "adjustment"
+)
+
+//payout errors
+var (
+	errPayoutNotAutomatic = errors.New("card: payout was not made automatically so it cannot be broken down")
+)
+
+//Payouts lists the payouts Stripe made to the bank within a date range
+//This is used to match deposits in the bank to the charges and refunds in the reports.
+//Payouts are filtered by the date they arrive in the bank, not the date they were created,
+//since that is the date on the bank statement.  Date range is inclusive of start and end day.
+func Payouts(w http.ResponseWriter, r *http.Request) {
+	//get form values
+	startString := r.FormValue("start-date")
+	endString := r.FormValue("end-date")
+
+	//make sure inputs are given
+	if len(startString) == 0 {
+		output.Error(errMissingInput, "You must supply a 'start-date'.", w)
+		return
+	}
+	if len(endString) == 0 {
+		output.Error(errMissingInput, "You must supply a 'end-date'.", w)
+		return
+	}
+
+	//get datetimes from provided start and end date strings
+	//arrival dates are dates, not times, and Stripe gives them as midnight UTC so the
+	//user's timezone isn't used here like it is for the reports
+	startDt, err := time.Parse("2006-01-02", startString)
+	if err != nil {
+		output.Error(err, "Could not convert start date to a time.Time datetime.", w)
+		return
+	}
+	endDt, err := time.Parse("2006-01-02", endString)
+	if err != nil {
+		output.Error(err, "Could not convert end date to a time.Time datetime.", w)
+		return
+	}
+
+	//get end of day datetime
+	endDt = endDt.Add((24*60-1)*time.Minute + (59 * time.Second))
+
+	//get list of payouts from stripe
+	c := r.Context()
+	sc := CreateStripeClient(c)
+	params := &stripe.PayoutListParams{}
+	params.Filters.AddFilter("arrival_date", "gte", strconv.FormatInt(startDt.Unix(), 10))
+	params.Filters.AddFilter("arrival_date", "lte", strconv.FormatInt(endDt.Unix(), 10))
+	params.Filters.AddFilter("limit", "", "100")
+
+	var payouts []payoutData
+	var numPayouts uint16
+	totals := currencySums{}
+	list := sc.Payouts.List(params)
+	for list.Next() {
+		p := extractDataFromPayout(list.Payout())
+		payouts = append(payouts, p)
+		numPayouts++
+
+		if p.Status != string(stripe.PayoutStatusFailed) && p.Status != string(stripe.PayoutStatusCanceled) {
+			totals.add(p.Currency, p.AmountCents, 0, p.AmountCents)
+		}
+	}
+	if err := list.Err(); err != nil {
+		output.Error(err, "Could not get the list of payouts from Stripe.", w)
+		return
+	}
+
+	result := payoutsReportData{
+		StartDate:    startDt,
+		EndDate:      endDt,
+		Payouts:      payouts,
+		NumPayouts:   numPayouts,
+		TotalPaidOut: totals.totals(),
+	}
+
+	templates.Load(w, "payouts", result)
+}
+
+//PayoutDetail breaks down a payout into the charges, refunds, fees, and adjustments that it is made up of
+//Each charge and refund is looked up in the ledger to show the customer, invoice, and po.
+//Stripe can only list the transactions for payouts it made automatically on the account's
+//payout schedule.
+func PayoutDetail(w http.ResponseWriter, r *http.Request) {
+	payoutID := r.FormValue("payout_id")
+	if len(payoutID) == 0 {
+		output.Error(errMissingInput, "You must supply a 'payout_id'.", w)
+		return
+	}
+
+	//get the payout
+	c := r.Context()
+	sc := CreateStripeClient(c)
+	p, err := sc.Payouts.Get(payoutID, nil)
+	if err != nil {
+		stripeErr, ok := err.(*stripe.Error)
+		if ok {
+			output.Error(err, stripeErr.Msg, w)
+			return
+		}
+
+		output.Error(err, "Could not look up this payout.", w)
+		return
+	}
+
+	payout := extractDataFromPayout(p)
+	if !payout.Automatic {
+		output.Error(errPayoutNotAutomatic, "This payout was made manually so Stripe cannot list the transactions it includes.", w)
+		return
+	}
+
+	//get the transactions that make up the payout
+	//the source is expanded so we can get the charge for transactions not in the ledger
+	params := &stripe.BalanceTransactionListParams{
+		Payout: stripe.String(payoutID),
+	}
+	params.Filters.AddFilter("limit", "", "100")
+	params.AddExpand("data.source")
+
+	guiLoc, timezone := guiTimezone(r)
+
+	var lines []payoutLine
+	var numCharges, numRefunds uint16
+	var chargesCents, refundsCents, feesCents, adjustmentsCents, netCents int64
+	list := sc.BalanceTransaction.List(params)
+	for list.Next() {
+		bt := list.BalanceTransaction()
+
+		//the payout itself is included in the list of transactions, skip it
+		if bt.Type == stripe.BalanceTransactionTypePayout {
+			continue
+		}
+
+		l := lineFromBalanceTransaction(c, bt, guiLoc)
+		lines = append(lines, l)
+
+		//totals
+		switch l.Category {
+		case payoutCategoryCharge:
+			chargesCents += l.AmountCents
+			numCharges++
+		case payoutCategoryRefund:
+			refundsCents -= l.AmountCents
+			numRefunds++
+		case payoutCategoryFee:
+			feesCents -= l.AmountCents
+		default:
+			adjustmentsCents += l.AmountCents
+		}
+		feesCents += l.FeeCents
+		netCents += l.NetCents
+	}
+	if err := list.Err(); err != nil {
+		output.Error(err, "Could not get the list of transactions for this payout from Stripe.", w)
+		return
+	}
+
+	//show oldest first, Stripe returns the newest first
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+
+	//a payout is made in one currency and every transaction in it is in that currency
+	cur := payout.Currency
+	result := payoutDetailData{
+		Payout:            payout,
+		Lines:             lines,
+		TotalCharges:      FormatAmount(chargesCents, cur),
+		TotalRefunds:      FormatAmount(refundsCents, cur),
+		TotalFees:         FormatAmount(feesCents, cur),
+		TotalAdjustments:  FormatAmount(adjustmentsCents, cur),
+		TotalNet:          FormatAmount(netCents, cur),
+		Reconciled:        netCents == payout.AmountCents,
+		NumCharges:        numCharges,
+		NumRefunds:        numRefunds,
+		ReportGUITimezone: timezone,
+	}
+
+	templates.Load(w, "payout", result)
+}
+
+//extractDataFromPayout gets the data we show for a payout
+func extractDataFromPayout(p *stripe.Payout) payoutData {
+	d := payoutData{
+		ID:             p.ID,
+		ArrivalDate:    time.Unix(p.ArrivalDate, 0).UTC().Format("2006-01-02"),
+		AmountCents:    p.Amount,
+		AmountDollars:  FormatAmount(p.Amount, string(p.Currency)),
+		Currency:       string(p.Currency),
+		CurrencySymbol: currencySymbol(string(p.Currency)),
+		Status:         string(p.Status),
+		Method:         string(p.Method),
+		Automatic:      p.Automatic,
+		FailureMessage: p.FailureMessage,
+	}
+
+	if p.Description != nil {
+		d.Description = *p.Description
+	}
+
+	return d
+}
+
+//lineFromBalanceTransaction builds a line of a payout's breakdown from a balance transaction
+//The charge the transaction is for is looked up in the ledger first since the ledger has the
+//customer, invoice, and po for charges made in this app.  If the charge isn't in the ledger
+//the data is taken from the expanded source of the balance transaction.
+func lineFromBalanceTransaction(c context.Context, bt *stripe.BalanceTransaction, guiLoc *time.Location) payoutLine {
+	l := payoutLine{
+		BalanceTransactionID: bt.ID,
+		Category:             payoutCategory(bt.ReportingCategory),
+		Type:                 string(bt.Type),
+		Description:          bt.Description,
+		Timestamp:            time.Unix(bt.Created, 0).In(guiLoc).Format("2006-01-02 @ 3:04:05PM"),
+		AmountCents:          bt.Amount,
+		AmountDollars:        FormatAmount(bt.Amount, string(bt.Currency)),
+		FeeCents:             bt.Fee,
+		FeeDollars:           FormatAmount(bt.Fee, string(bt.Currency)),
+		NetCents:             bt.Net,
+		NetDollars:           FormatAmount(bt.Net, string(bt.Currency)),
+		CurrencySymbol:       currencySymbol(string(bt.Currency)),
+	}
+
+	if bt.Source == nil {
+		return l
+	}
+	l.SourceID = bt.Source.ID
+
+	//get the charge this transaction is for
+	var chg *stripe.Charge
+	switch {
+	case bt.Source.Charge != nil:
+		chg = bt.Source.Charge
+	case bt.Source.Refund != nil:
+		chg = bt.Source.Refund.Charge
+	case bt.Source.Dispute != nil:
+		chg = bt.Source.Dispute.Charge
+	}
+	if chg != nil {
+		l.ChargeID = chg.ID
+	}
+
+	//look up the charge or refund in the ledger
+	//disputes, and refunds made before the ledger existed, aren't in the ledger but the
+	//charge they are for might be
+	ids := []string{l.SourceID}
+	if l.ChargeID != "" && l.ChargeID != l.SourceID {
+		ids = append(ids, l.ChargeID)
+	}
+
+	for _, id := range ids {
+		e, err := store.FindLedgerEntry(c, id)
+		if err == errLedgerEntryNotFound {
+			continue
+		} else if err != nil {
+			log.Println("card.lineFromBalanceTransaction - could not look up transaction in ledger", id, err)
+			break
+		}
+
+		if e.Type == ledgerTypeRefund {
+			l.ChargeID = e.StripeChargeID
+		}
+
+		l.Customer = e.CustomerName
+		l.Invoice = e.Invoice
+		l.Po = e.Po
+		l.LastFour = e.CardLast4
+		return l
+	}
+
+	//use the charge from stripe
+	//the charge of a refund or dispute is only an id since it can't be expanded that deep
+	if chg != nil && chg.Created != 0 {
+		d := ExtractDataFromCharge(chg)
+		l.Customer = d.Customer
+		l.Invoice = d.Invoice
+		l.Po = d.Po
+		l.LastFour = d.LastFour
+	}
+
+	return l
+}
+
+//payoutCategory groups Stripe's reporting categories into the categories we show for a payout
+func payoutCategory(rc stripe.BalanceTransactionReportingCategory) string {
+	switch rc {
+	case stripe.BalanceTransactionReportingCategoryCharge:
+		return payoutCategoryCharge
+	case stripe.BalanceTransactionReportingCategoryRefund:
+		return payoutCategoryRefund
+	case stripe.BalanceTransactionReportingCategoryFee:
+		return payoutCategoryFee
+	default:
+		return payoutCategoryAdjustment
+	}
+}
@@ -0,0 +1,139 @@
+package card
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/stripe/stripe-go/v72"
+)
+
+//ReceiptBuilder builds the email for the receipt of a charge, or of a refund of the charge
+//refund is nil when the receipt is for the charge
+type ReceiptBuilder func(r *http.Request, chargeID string, refund *stripe.Refund) (emailutils.Message, error)
+
+//buildReceipt is the ReceiptBuilder used to email receipts
+//this is set in package main via SetReceiptBuilder since receipts are built in package receipt
+//which imports this package
+var buildReceipt ReceiptBuilder
+
+//SetReceiptBuilder saves the func used to build emailed receipts
+func SetReceiptBuilder(b ReceiptBuilder) {
+	buildReceipt = b
+}
+
+//maxMetadataValueLength is the longest value Stripe allows for a metadata value
+const maxMetadataValueLength = 500
+
+//receipt errors
+var (
+	errInvalidReceiptEmail = errors.New("card: invalid receipt email")
+	errNoReceiptBuilder    = errors.New("card: receipt builder not set")
+)
+
+//parseReceiptEmails parses the addresses entered to email a receipt to
+//this is done before charging or refunding so a typo doesn't leave the user wondering if the
+//charge or refund went through
+func parseReceiptEmails(list string) ([]string, error) {
+	to, err := emailutils.ParseAddressList(list)
+	if err != nil {
+		return nil, errInvalidReceiptEmail
+	}
+
+	return to, nil
+}
+
+//emailReceipt emails the receipt of a charge, or a refund of the charge, and logs the result against the charge
+//The receipt is sent to the addresses entered when charging or refunding, or to the customer's
+//billing email if no addresses were entered.  Nothing is sent if emails aren't enabled or there
+//is no one to send to.  The addresses the receipt was sent to and a message for the user if the
+//email could not be sent are returned.  A failed email doesn't fail the charge or refund.
+func emailReceipt(r *http.Request, chargeID string, refund *stripe.Refund, to []string, customer CustomerDatastore) (sentTo []string, errMsg string) {
+	if !emailutils.Enabled() {
+		return
+	}
+
+	if len(to) == 0 && customer.BillingEmail != "" {
+		to = []string{customer.BillingEmail}
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	err := sendReceipt(r, chargeID, refund, to)
+	if err != nil {
+		log.Println("card.emailReceipt - could not email receipt", chargeID, err)
+		errMsg = "The receipt could not be emailed to " + strings.Join(to, ", ") + "."
+	} else {
+		sentTo = to
+	}
+
+	logReceiptEmail(r.Context(), chargeID, refund, to, err)
+	return
+}
+
+//sendReceipt builds and sends the email for a receipt
+func sendReceipt(r *http.Request, chargeID string, refund *stripe.Refund, to []string) error {
+	if buildReceipt == nil {
+		return errNoReceiptBuilder
+	}
+
+	m, err := buildReceipt(r, chargeID, refund)
+	if err != nil {
+		return err
+	}
+
+	m.To = to
+	return emailutils.Send(m)
+}
+
+//logReceiptEmail saves who a receipt was emailed to, and if the email was sent, to the charge's
+//metadata
+//The metadata is shown in the Stripe dashboard and saved with the charge in the ledger.  Receipts
+//for refunds use their own keys so the charge's receipt isn't overwritten.
+func logReceiptEmail(ctx context.Context, chargeID string, refund *stripe.Refund, to []string, sendErr error) {
+	prefix := "receipt_email"
+	if refund != nil {
+		prefix = "refund_receipt_email"
+	}
+
+	result := "sent"
+	if sendErr != nil {
+		result = "failed: " + sendErr.Error()
+	}
+
+	params := &stripe.ChargeParams{}
+	params.AddMetadata(prefix+"_to", truncateMetadata(strings.Join(to, ", ")))
+	params.AddMetadata(prefix+"_date", timestamps.ISO8601())
+	params.AddMetadata(prefix+"_result", truncateMetadata(result))
+	if refund != nil {
+		params.AddMetadata(prefix+"_refund_id", refund.ID)
+	}
+	params.AddExpand("balance_transaction")
+
+	sc := CreateStripeClient(ctx)
+	chg, err := sc.Charges.Update(chargeID, params)
+	if err != nil {
+		log.Println("card.logReceiptEmail - could not update charge", chargeID, err)
+		return
+	}
+
+	//update the charge in the ledger so the ledger has the metadata too
+	err = saveChargeToLedger(ctx, chg)
+	if err != nil {
+		log.Println("card.logReceiptEmail - could not save charge to ledger", err)
+	}
+}
+
+//truncateMetadata shortens a value to the longest length Stripe allows for metadata
+func truncateMetadata(v string) string {
+	if len(v) > maxMetadataValueLength {
+		return v[:maxMetadataValueLength]
+	}
+
+	return v
+}
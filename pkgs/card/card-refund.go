@@ -1,6 +1,8 @@
 package card
 
 import (
+	"context"
+	"log"
 	"net/http"
 
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
@@ -14,6 +16,7 @@ func Refund(w http.ResponseWriter, r *http.Request) {
 	chargeID := r.FormValue("chargeId")
 	amount := r.FormValue("amount")
 	reason := r.FormValue("reason")
+	emailReceiptTo := r.FormValue("emailReceipt") //comma separated addresses to email the receipt to, the customer's billing email is used if not given
 
 	//make sure inputs were given
 	if len(chargeID) == 0 {
@@ -24,12 +27,29 @@ func Refund(w http.ResponseWriter, r *http.Request) {
 		output.Error(errMissingInput, "No amount was given to refund.", w)
 		return
 	}
+	receiptTo, err := parseReceiptEmails(emailReceiptTo)
+	if err != nil {
+		output.Error(err, "One of the email addresses to send the receipt to is not valid.", w)
+		return
+	}
+
+	//init stripe
+	c := r.Context()
+	sc := CreateStripeClient(c)
+
+	//get the currency the charge was made in
+	//the amount to refund is in the same currency as the charge
+	currency, err := chargeCurrencyByID(c, chargeID)
+	if err != nil {
+		output.Error(err, "Could not look up the charge to refund.", w)
+		return
+	}
 
 	//convert refund amount to cents
 	//stripe requires amount in a whole number
-	amountCents, err := getAmountAsIntCents(amount)
+	amountCents, err := getAmountAsIntCents(amount, currency)
 	if err != nil {
-		output.Error(err, "An error occured while converting the amount to charge into cents. Please try again or contact an administrator.", w)
+		output.Error(err, amountErrorMessage(err, currency), w)
 		return
 	}
 
@@ -47,6 +67,11 @@ func Refund(w http.ResponseWriter, r *http.Request) {
 	//same field name as when creating a charge
 	params.AddMetadata("processed_by", username)
 
+	//get the charge with the refund so the ledger has the charge's updated refunded amount
+	//get the balance transactions so the ledger has the fees for each
+	params.AddExpand("balance_transaction")
+	params.AddExpand("charge.balance_transaction")
+
 	//get reason code for refund
 	//these are defined by stripe
 	switch reason {
@@ -58,12 +83,8 @@ func Refund(w http.ResponseWriter, r *http.Request) {
 		params.Reason = stripe.String(string(stripe.RefundReasonFraudulent))
 	}
 
-	//init stripe
-	c := r.Context()
-	sc := CreateStripeClient(c)
-
 	//create refund with stripe
-	_, err = sc.Refunds.New(params)
+	ref, err := sc.Refunds.New(params)
 	if err != nil {
 		stripeErr := err.(*stripe.Error)
 		stripeErrMsg := stripeErr.Msg
@@ -71,6 +92,63 @@ func Refund(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//save the refund, and the refunded charge, to the ledger
+	err = saveRefundToLedger(c, ref, ref.Charge)
+	if err != nil {
+		log.Println("card.Refund - could not save refund to ledger", err)
+	}
+	if ref.Charge != nil && ref.Charge.Created != 0 {
+		err = saveChargeToLedger(c, ref.Charge)
+		if err != nil {
+			log.Println("card.Refund - could not save charge to ledger", err)
+		}
+	}
+
+	//email the receipt
+	//the customer is looked up from the charge to get the customer's billing email
+	out := refundSuccessful{
+		RefundID: ref.ID,
+	}
+	if ref.Status != stripe.RefundStatusFailed {
+		customer := refundCustomer(c, ref.Charge)
+		out.ReceiptEmailedTo, out.ReceiptEmailError = emailReceipt(r, chargeID, ref, receiptTo, customer)
+	}
+
 	//done
-	output.Success("refund-done", nil, w)
+	output.Success("refund-done", out, w)
+}
+
+//refundCustomer returns the customer a refunded charge was made for
+//the customer is found by the customer id saved in the charge's metadata, a blank customer is
+//returned if the customer can't be found since the customer may have been removed
+func refundCustomer(ctx context.Context, chg *stripe.Charge) CustomerDatastore {
+	if chg == nil || chg.Metadata["customer_id"] == "" {
+		return CustomerDatastore{}
+	}
+
+	customer, err := FindByCustomerID(ctx, chg.Metadata["customer_id"])
+	if err != nil && err != errCustomerNotFound {
+		log.Println("card.refundCustomer - could not look up customer", err)
+	}
+
+	return customer
+}
+
+//chargeCurrencyByID returns the currency a charge was made in
+//the charge is looked up in the ledger first, and then from Stripe for charges not in the ledger
+func chargeCurrencyByID(ctx context.Context, chargeID string) (string, error) {
+	e, err := store.FindLedgerEntry(ctx, chargeID)
+	if err == nil && e.Currency != "" {
+		return e.Currency, nil
+	} else if err != nil && err != errLedgerEntryNotFound {
+		log.Println("card.chargeCurrencyByID - could not look up charge in ledger", err)
+	}
+
+	sc := CreateStripeClient(ctx)
+	chg, err := sc.Charges.Get(chargeID, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(chg.Currency), nil
 }
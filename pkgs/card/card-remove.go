@@ -7,22 +7,18 @@ import (
 	"strconv"
 	"time"
 
-	"cloud.google.com/go/datastore"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
-	"github.com/jmoiron/sqlx"
 	"github.com/stripe/stripe-go/v72"
-	"google.golang.org/api/iterator"
 )
 
 //RemoveAPI removes a card from the datastore and stripe
 //This removes a card based upon the datastore ID.  This ID is tied into
-//one Stripe customer and one card.
+//one Stripe customer and all of the customer's cards.  If a card ID is given
+//only that card is removed and the customer is kept.
 func RemoveAPI(w http.ResponseWriter, r *http.Request) {
 	//get form values
 	datastoreID, _ := strconv.ParseInt(r.FormValue("customerId"), 10, 64)
+	cardID, _ := strconv.ParseInt(r.FormValue("cardId"), 10, 64)
 
 	//make sure an id was given
 	if datastoreID == 0 {
@@ -30,8 +26,29 @@ func RemoveAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//remove the card
+	//remove just one card
 	c := r.Context()
+	if cardID != 0 {
+		custData, err := findByDatastoreID(c, datastoreID)
+		if err != nil {
+			output.Error(err, "Could not find this customer's data.", w)
+			return
+		}
+
+		err = removeCard(c, custData, cardID)
+		if err == errLastCard {
+			output.Error(err, "This is the customer's only card. Remove the customer instead.", w)
+			return
+		} else if err != nil {
+			output.Error(err, "There was an error while trying to delete this card. Please try again.", w)
+			return
+		}
+
+		output.Success("removeCard", nil, w)
+		return
+	}
+
+	//remove the card
 	err := remove(c, datastoreID)
 	if err != nil {
 		output.Error(err, "There was an error while trying to delete this customer. Please try again.", w)
@@ -58,25 +75,10 @@ func remove(ctx context.Context, datastoreID int64) error {
 		log.Println("card.remove - Could not remove card from stripe", err)
 	}
 
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		err := removeFromSQLite(c, datastoreID)
-		if err != nil {
-			return err
-		}
-
-	} else {
-		client, err := datastoreutils.Connect(ctx)
-		if err != nil {
-			return err
-		}
-
-		completeKey := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, datastoreID)
-		err = removeFromDatastore(ctx, client, completeKey)
-		if err != nil {
-			return err
-		}
+	//remove from db
+	err = store.Remove(ctx, datastoreID)
+	if err != nil {
+		return err
 	}
 
 	//customer removed
@@ -93,27 +95,6 @@ func removeFromStripe(ctx context.Context, stripeCustomerID string) error {
 	return nil
 }
 
-//removeFromSQLite removes a card/customer from the SQLite db
-func removeFromSQLite(c *sqlx.DB, id int64) error {
-	q := `
-		DELETE FROM ` + sqliteutils.TableCards + ` 
-		WHERE ID = ?
-	`
-	stmt, err := c.Prepare(q)
-	if err != nil {
-		return err
-	}
-
-	_, err = stmt.Exec(id)
-	return err
-}
-
-//removeFromDatastore removes a card/customer from cloud datastore
-func removeFromDatastore(ctx context.Context, datastoreClient *datastore.Client, datastoreKey *datastore.Key) error {
-	err := datastoreClient.Delete(ctx, datastoreKey)
-	return err
-}
-
 //RemoveExpiredCards removes old cards
 //This works by looking up cards whose expiration is a given month/year string.  Unfortunately
 //this means that if this func doesn't run or encounters an error, cards older than the
@@ -121,6 +102,8 @@ func removeFromDatastore(ctx context.Context, datastoreClient *datastore.Client,
 //RemoveUnusedCards.
 //We do a "select" then a "delete" because we need the Stripe information to remove the
 //card from Stripe.
+//Each expired saved card is removed from its customer first, the customer is only removed
+//if the expired card was the customer's only card.
 //This is designed to be run monthly as a cron task.
 func RemoveExpiredCards(w http.ResponseWriter, r *http.Request) {
 	//get previous month as a 1 or 2 digit number
@@ -140,79 +123,49 @@ func RemoveExpiredCards(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("card.RemoveExpiredCards - Removing expired cards for: ", monthYear)
 
-	//use correct db
+	//get list of expired saved cards
 	ctx := r.Context()
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT 
-				ID,
-				StripeCustomerToken
-			FROM ` + sqliteutils.TableCards + ` 
-			WHERE CardExpiration = ?
-		`
-
-		potentialOldCards := []CustomerDatastore{}
-		err := c.Select(&potentialOldCards, q, monthYear)
+	expiredSavedCards, err := store.FindSavedCardsByExpiration(ctx, monthYear)
+	if err != nil {
+		log.Println("card.RemoveExpiredCards - Could not get list of old saved cards", err)
+		return
+	}
+
+	//iterate through each saved card, removing each from its customer
+	for _, savedCard := range expiredSavedCards {
+		custData, err := findByDatastoreID(ctx, savedCard.CustomerDatastoreID)
 		if err != nil {
-			log.Println("card.RemoveExpiredCards - Could not get list of old cards 2", err)
+			log.Println("card.RemoveExpiredCards - Could not look up customer for saved card with ID", savedCard.ID, err)
 			return
 		}
 
-		//iterate through each card, removing each from Stripe and the db
-		for _, p := range potentialOldCards {
-			err := removeFromStripe(ctx, p.StripeCustomerToken)
-			if err != nil {
-				log.Println("card.RemoveExpiredCards - Could not remove card from Stripe with ID", p.StripeCustomerToken, err)
-				return
-			}
-
-			err = removeFromSQLite(c, p.ID)
-			if err != nil {
-				log.Println("card.RemoveExpiredCards - Could not remove card from database with ID", p.ID, err)
-				return
-			}
+		err = removeCardOrCustomer(ctx, custData, savedCard.ID)
+		if err != nil {
+			log.Println("card.RemoveExpiredCards - Could not remove saved card with ID", savedCard.ID, err)
+			return
 		}
+	}
+
+	//get list of expired cards
+	//these are customers without saved cards
+	expiredCards, err := store.FindByExpiration(ctx, monthYear)
+	if err != nil {
+		log.Println("card.RemoveExpiredCards - Could not get list of old cards", err)
+		return
+	}
 
-	} else {
-		//connect to datastore
-		c := r.Context()
-		client, err := datastoreutils.Connect(c)
+	//iterate through each card, removing each from Stripe and the db
+	for _, p := range expiredCards {
+		err := removeFromStripe(ctx, p.StripeCustomerToken)
 		if err != nil {
-			log.Println("card.RemoveExpiredCards - Could not connect to datastore", err)
+			log.Println("card.RemoveExpiredCards - Could not remove card from Stripe with ID", p.StripeCustomerToken, err)
 			return
 		}
 
-		//query datastore
-		//cant do keys only since we need Stripe token to remove card from stripe
-		fields := []string{"StripeCustomerToken"}
-		q := datastore.NewQuery(datastoreutils.EntityCards).Filter("CardExpiration =", monthYear).Project(fields...)
-		//iterate through results
-		//only results should be cards that expired last month
-		i := client.Run(c, q)
-		for {
-			customer := CustomerDatastore{}
-			key, err := i.Next(&customer)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				log.Println("card.RemoveExpiredCards - Could not retrieve customer data. ", err)
-				return
-			}
-
-			//remove the card from the datastore and from stripe
-			err = removeFromStripe(ctx, customer.StripeCustomerToken)
-			if err != nil {
-				log.Println("card.RemoveExpiredCards - Could not remove card from Stripe with ID", customer.StripeCustomerToken, err)
-				return
-			}
-
-			err = removeFromDatastore(ctx, client, key)
-			if err != nil {
-				log.Println("card.RemoveExpiredCards - Could not remove card from datastore with ID", key.ID, err)
-				return
-			}
+		err = store.Remove(ctx, p.ID)
+		if err != nil {
+			log.Println("card.RemoveExpiredCards - Could not remove card from database with ID", p.ID, err)
+			return
 		}
 	}
 
@@ -238,95 +191,27 @@ func RemoveUnusedCards(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("card.RemoveUnusedCards - removing cards that haven't been used since", minAgeTimestamp)
 
-	//use correct db
+	//get list of unused cards
 	ctx := r.Context()
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT 
-				ID,
-				StripeCustomerToken
-			FROM ` + sqliteutils.TableCards + ` 
-			WHERE LastUsedTimestamp < ?
-		`
-
-		unusedCards := []CustomerDatastore{}
-		err := c.Select(&unusedCards, q, minAgeTimestamp)
+	unusedCards, err := store.FindUnused(ctx, minAgeTimestamp)
+	if err != nil {
+		log.Println("card.RemoveUnusedCards - Could not get list of unusued cards", err)
+		return
+	}
+
+	//iterate through each card, removing each from Stripe and the db
+	for _, p := range unusedCards {
+		err := removeFromStripe(ctx, p.StripeCustomerToken)
 		if err != nil {
-			log.Println("card.RemoveUnusedCards - Could not get list of unusued cards 2", err)
+			log.Println("card.RemoveUnusedCards - Could not remove card from Stripe with ID", p.StripeCustomerToken, err)
 			return
 		}
 
-		//iterate through each card, removing each from Stripe and the db
-		for _, p := range unusedCards {
-			err := removeFromStripe(ctx, p.StripeCustomerToken)
-			if err != nil {
-				log.Println("card.RemoveUnusedCards - Could not remove card from Stripe with ID", p.StripeCustomerToken, err)
-				return
-			}
-
-			err = removeFromSQLite(c, p.ID)
-			if err != nil {
-				log.Println("card.RemoveUnusedCards - Could not remove card from database with ID", p.ID, err)
-				return
-			}
-		}
-
-	} else {
-		//connect to datastore
-		c := r.Context()
-		client, err := datastoreutils.Connect(c)
+		err = store.Remove(ctx, p.ID)
 		if err != nil {
-			log.Println("card.RemoveUnusedCards - couldn't connect to datastore", err)
+			log.Println("card.RemoveUnusedCards - Could not remove card from database with ID", p.ID, err)
 			return
 		}
-
-		//query datastore
-		//cant do keys only since we need Stripe token to remove card from stripe
-		fields := []string{"StripeCustomerToken"}
-		q := datastore.NewQuery(datastoreutils.EntityCards).Filter("LastUsedTimestamp <", minAgeTimestamp).Project(fields...)
-		i := client.Run(c, q)
-		for {
-			customer := CustomerDatastore{}
-			key, err := i.Next(&customer)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				log.Println("card.RemoveUnusedCards - couldn't look up card to remove", err)
-				return
-			}
-
-			//ignore cards whose LastUsedTimestamp is zero
-			//cards that were added to this app prior to the LastUsedTimestamp existing will always return zero
-			//so instead, update the card's LastUsedTimestamp to now
-			//have to get full info for the card
-			err = client.Get(c, key, &customer)
-			if err != nil {
-				log.Println("card.RemoveUnusedCards - Error while updating a zero LastUsedTimestamp 1", err)
-				return
-			}
-			customer.LastUsedTimestamp = timestamps.Unix()
-			_, err = saveDatatore(ctx, key, customer)
-			if err != nil {
-				log.Println("card.RemoveUnusedCards - Error while updating a zero LastUsedTimestamp 2", err)
-				return
-			}
-
-			//remove the card from the datastore and from stripe
-			err = removeFromStripe(ctx, customer.StripeCustomerToken)
-			if err != nil {
-				log.Println("card.RemoveUnusedCards - Could not remove card from Stripe with ID", customer.StripeCustomerToken, err)
-				return
-			}
-
-			//remove the old card
-			err = client.Delete(c, key)
-			if err != nil {
-				log.Println("card.RemoveUnusedCards - couldn't note delete unused card", err)
-				return
-			}
-		}
 	}
 
 	log.Println("card.RemoveUnusedCards...done")
@@ -0,0 +1,362 @@
+package card
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+)
+
+const (
+	//defaultAPIPageSize is the number of charges or refunds returned per request when a limit isn't given
+	defaultAPIPageSize = 100
+
+	//maxAPIPageSize is the most charges or refunds returned per request
+	maxAPIPageSize = 500
+)
+
+//reporting api errors
+var (
+	errInvalidCursor = errors.New("card: invalid cursor")
+	errInvalidLimit  = errors.New("card: invalid limit")
+)
+
+//apiReportRequest is the date range, customer, and page a request to the reporting api is for
+type apiReportRequest struct {
+	startDate           string //yyyy-mm-dd, as given
+	endDate             string //" " " "
+	start               int64  //unix timestamp of the start of the first day, in the app's report timezone
+	end                 int64  //unix timestamp of the end of the last day, " " " "
+	guiLoc              *time.Location
+	timezone            string //the name of the app's report timezone
+	customerID          string //the CRM ID of the customer to filter by, blank for all customers
+	stripeCustomerToken string
+	limit               int          //the most charges or refunds to return
+	cursor              ledgerCursor //the last charge or refund on the previous page, blank for the first page
+}
+
+//ledgerCursor points to the last charge or refund on a page
+type ledgerCursor struct {
+	created  int64 //unix timestamp of when Stripe created the charge or refund
+	stripeID string
+}
+
+//apiChargesPage is one page of charges returned by the reporting api
+//the totals for every charge in the date range are returned by the totals endpoint
+type apiChargesPage struct {
+	StartDate  string       `json:"start_date"`
+	EndDate    string       `json:"end_date"`
+	Timezone   string       `json:"timezone"` //the timezone the dates are in, from the app settings
+	CustomerID string       `json:"customer_id,omitempty"`
+	Charges    []ChargeData `json:"charges"`
+	HasMore    bool         `json:"has_more"`    //true if there are more charges after this page
+	NextCursor string       `json:"next_cursor"` //give as "cursor" to get the next page, blank if there are no more charges
+}
+
+//apiRefundsPage is one page of refunds returned by the reporting api
+type apiRefundsPage struct {
+	StartDate  string       `json:"start_date"`
+	EndDate    string       `json:"end_date"`
+	Timezone   string       `json:"timezone"`
+	CustomerID string       `json:"customer_id,omitempty"`
+	Refunds    []RefundData `json:"refunds"`
+	HasMore    bool         `json:"has_more"`
+	NextCursor string       `json:"next_cursor"`
+}
+
+//apiReportTotals is the totals of a report returned by the reporting api
+//this matches the totals shown on the reports page
+type apiReportTotals struct {
+	StartDate        string          `json:"start_date"`
+	EndDate          string          `json:"end_date"`
+	Timezone         string          `json:"timezone"`
+	CustomerID       string          `json:"customer_id,omitempty"`
+	ChargeTotals     []currencyTotal `json:"charge_totals"`
+	RefundTotals     []currencyTotal `json:"refund_totals"`
+	DailyTotals      []dailyTotal    `json:"daily_totals"`
+	NumCharges       uint16          `json:"num_charges"`
+	NumRefunds       uint16          `json:"num_refunds"`
+	NumEstimatedFees uint16          `json:"num_estimated_fees"`
+}
+
+//ReportChargesAPI returns the charges in a date range, optionally for one customer, as JSON
+//This is used by other systems, such as an ERP, to pull charge data without logging in.  The
+//request is authenticated by the api key in the app settings.  Charges are returned oldest first
+//a page at a time, use the returned cursor to get the next page.
+func ReportChargesAPI(w http.ResponseWriter, r *http.Request) {
+	f, errMsg, err := parseAPIReportRequest(r)
+	if err != nil {
+		output.Error(err, errMsg, w)
+		return
+	}
+
+	entries, hasMore, err := findLedgerPage(r.Context(), ledgerTypeCharge, f)
+	if err != nil {
+		output.Error(err, "Could not get the list of charges.", w)
+		return
+	}
+
+	//get fees used to estimate fees that Stripe hasn't given us
+	companyInfo, _ := company.Get(r)
+	charges, _, _ := chargesFromLedger(entries, companyInfo)
+
+	out := apiChargesPage{
+		StartDate:  f.startDate,
+		EndDate:    f.endDate,
+		Timezone:   f.timezone,
+		CustomerID: f.customerID,
+		Charges:    append([]ChargeData{}, charges...),
+		HasMore:    hasMore,
+	}
+	if hasMore {
+		last := entries[len(entries)-1]
+		out.NextCursor = encodeCursor(last.Created, last.StripeID)
+	}
+
+	output.Success("reportCharges", out, w)
+}
+
+//ReportRefundsAPI returns the refunds in a date range, optionally for one customer, as JSON
+//this works the same as ReportChargesAPI
+func ReportRefundsAPI(w http.ResponseWriter, r *http.Request) {
+	f, errMsg, err := parseAPIReportRequest(r)
+	if err != nil {
+		output.Error(err, errMsg, w)
+		return
+	}
+
+	entries, hasMore, err := findLedgerPage(r.Context(), ledgerTypeRefund, f)
+	if err != nil {
+		output.Error(err, "Could not get the list of refunds.", w)
+		return
+	}
+
+	refunds, _, _ := refundsFromLedger(entries)
+
+	out := apiRefundsPage{
+		StartDate:  f.startDate,
+		EndDate:    f.endDate,
+		Timezone:   f.timezone,
+		CustomerID: f.customerID,
+		Refunds:    append([]RefundData{}, refunds...),
+		HasMore:    hasMore,
+	}
+	if hasMore {
+		last := entries[len(entries)-1]
+		out.NextCursor = encodeCursor(last.Created, last.StripeID)
+	}
+
+	output.Success("reportRefunds", out, w)
+}
+
+//ReportTotalsAPI returns the totals of the charges and refunds in a date range, optionally for
+//one customer, as JSON
+//This includes the net amount for each day which should match the amount paid out to the bank.
+func ReportTotalsAPI(w http.ResponseWriter, r *http.Request) {
+	f, errMsg, err := parseAPIReportRequest(r)
+	if err != nil {
+		output.Error(err, errMsg, w)
+		return
+	}
+
+	c := r.Context()
+	charges, numCharges, chargeTotals, err := getListOfCharges(c, r, f.stripeCustomerToken, f.start, f.end)
+	if err != nil {
+		output.Error(err, "Could not get the list of charges.", w)
+		return
+	}
+
+	refunds, numRefunds, refundTotals, err := getListOfRefunds(c, f.stripeCustomerToken, f.start, f.end)
+	if err != nil {
+		output.Error(err, "Could not get the list of refunds.", w)
+		return
+	}
+
+	//daily totals are grouped by the day in the app's report timezone, same as the reports page
+	var numEstimatedFees uint16
+	for i, d := range charges {
+		if d.FeeEstimated {
+			numEstimatedFees++
+		}
+		if t, err := reportTimestamp(d.Timestamp, f.guiLoc, "2006-01-02"); err == nil {
+			charges[i].Timestamp = t
+		}
+	}
+	for i, d := range refunds {
+		if d.FeeEstimated {
+			numEstimatedFees++
+		}
+		if t, err := reportTimestamp(d.Timestamp, f.guiLoc, "2006-01-02"); err == nil {
+			refunds[i].Timestamp = t
+		}
+	}
+
+	out := apiReportTotals{
+		StartDate:        f.startDate,
+		EndDate:          f.endDate,
+		Timezone:         f.timezone,
+		CustomerID:       f.customerID,
+		ChargeTotals:     chargeTotals,
+		RefundTotals:     refundTotals,
+		DailyTotals:      dailyTotals(charges, refunds),
+		NumCharges:       numCharges,
+		NumRefunds:       numRefunds,
+		NumEstimatedFees: numEstimatedFees,
+	}
+
+	output.Success("reportTotals", out, w)
+}
+
+//parseAPIReportRequest verifies the api key and gets the filters and page of a request to the
+//reporting api
+//Dates are yyyy-mm-dd, inclusive, and in the report timezone set in the app settings.  A message
+//for the caller is returned with any error.
+func parseAPIReportRequest(r *http.Request) (f apiReportRequest, errMsg string, err error) {
+	//the api key is only read from a header so it isn't saved in logs along with the url
+	apiKey := apiKeyFromHeader(r)
+	if apiKey == "" {
+		return f, "There was no api key given. This must be given in the 'Authorization: Bearer' or 'X-API-Key' header to authenticate this request.", errMissingAPIKey
+	}
+
+	errMsg, err = verifyAPIKey(r, apiKey)
+	if err != nil {
+		return
+	}
+
+	f.startDate = strings.TrimSpace(r.FormValue("start_date"))
+	f.endDate = strings.TrimSpace(r.FormValue("end_date"))
+	f.customerID = strings.TrimSpace(r.FormValue("customer_id"))
+	if f.startDate == "" {
+		return f, "You must supply a 'start_date'.", errMissingInput
+	}
+	if f.endDate == "" {
+		return f, "You must supply an 'end_date'.", errMissingInput
+	}
+
+	f.guiLoc, f.timezone = guiTimezone(r)
+	startDt, err := time.ParseInLocation("2006-01-02", f.startDate, f.guiLoc)
+	if err != nil {
+		return f, "The 'start_date' must be in the format yyyy-mm-dd.", err
+	}
+	endDt, err := time.ParseInLocation("2006-01-02", f.endDate, f.guiLoc)
+	if err != nil {
+		return f, "The 'end_date' must be in the format yyyy-mm-dd.", err
+	}
+
+	//include the whole last day
+	f.start = startDt.Unix()
+	f.end = endDt.AddDate(0, 0, 1).Unix() - 1
+
+	//look up the stripe customer to filter by
+	if f.customerID != "" {
+		custData, err := FindByCustomerID(r.Context(), f.customerID)
+		if err != nil {
+			return f, "Could not find a customer with this 'customer_id'.", err
+		}
+
+		f.stripeCustomerToken = custData.StripeCustomerToken
+	}
+
+	f.limit = defaultAPIPageSize
+	if l := r.FormValue("limit"); l != "" {
+		f.limit, err = strconv.Atoi(l)
+		if err != nil || f.limit < 1 || f.limit > maxAPIPageSize {
+			return f, "The 'limit' must be between 1 and " + strconv.Itoa(maxAPIPageSize) + ".", errInvalidLimit
+		}
+	}
+
+	if c := r.FormValue("cursor"); c != "" {
+		f.cursor, err = decodeCursor(c)
+		if err != nil {
+			return f, "The 'cursor' is not valid.  Use the 'next_cursor' from the previous page.", err
+		}
+	}
+
+	return f, "", nil
+}
+
+//apiKeyFromHeader gets the api key from the "Authorization: Bearer <key>" or "X-API-Key" header
+//a blank string is returned if neither header was given
+func apiKeyFromHeader(r *http.Request) string {
+	const bearer = "Bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(bearer) && strings.EqualFold(h[:len(bearer)], bearer) {
+		return strings.TrimSpace(h[len(bearer):])
+	}
+
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+//verifyAPIKey checks that the api key given with a request matches the api key in the app settings
+//A message for the caller is returned with any error.
+func verifyAPIKey(r *http.Request, apiKey string) (errMsg string, err error) {
+	if len(apiKey) == 0 {
+		return "There was no api given. This must be given in the 'api_key' field to authenticate this request.", errMissingAPIKey
+	}
+
+	settings, err := appsettings.Get(r)
+	if err != nil {
+		return "Could not get app settings to verify api key.", err
+	}
+	if settings.APIKey == "" || subtle.ConstantTimeCompare([]byte(settings.APIKey), []byte(apiKey)) != 1 {
+		return "The api key provided in the request is not correct.", errInvalidAPIKey
+	}
+
+	return "", nil
+}
+
+//findLedgerPage gets a page of charges or refunds from the ledger starting after the cursor
+//One more entry than the limit is looked up to tell if there is another page.
+func findLedgerPage(ctx context.Context, ledgerType string, f apiReportRequest) (entries []LedgerEntry, hasMore bool, err error) {
+	entries, err = store.FindLedgerEntries(ctx, LedgerFilter{
+		Type:                ledgerType,
+		Start:               f.start,
+		End:                 f.end,
+		StripeCustomerToken: f.stripeCustomerToken,
+		AfterCreated:        f.cursor.created,
+		AfterStripeID:       f.cursor.stripeID,
+		Limit:               f.limit + 1,
+	})
+	if err != nil {
+		return
+	}
+
+	if len(entries) > f.limit {
+		entries = entries[:f.limit]
+		hasMore = true
+	}
+
+	return
+}
+
+//encodeCursor builds the cursor pointing to a charge or refund
+func encodeCursor(created int64, stripeID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(created, 10) + "|" + stripeID))
+}
+
+//decodeCursor gets the created timestamp and Stripe id of a charge or refund from a cursor
+func decodeCursor(c string) (ledgerCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return ledgerCursor{}, errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return ledgerCursor{}, errInvalidCursor
+	}
+
+	created, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || created < 0 {
+		return ledgerCursor{}, errInvalidCursor
+	}
+
+	return ledgerCursor{created: created, stripeID: parts[1]}, nil
+}
@@ -0,0 +1,176 @@
+package card
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestCursor(t *testing.T) {
+	tests := []struct {
+		created int64
+		id      string
+	}{
+		{1792152000, "ch_123"},
+		{0, "re_456"},
+		{1792172825, "ch_with|pipe"},
+	}
+
+	for _, tt := range tests {
+		c := encodeCursor(tt.created, tt.id)
+		got, err := decodeCursor(c)
+		if err != nil {
+			t.Errorf("decodeCursor(encodeCursor(%d, %q)) error = %v", tt.created, tt.id, err)
+			continue
+		}
+		if got.created != tt.created || got.stripeID != tt.id {
+			t.Errorf("decodeCursor(encodeCursor(%d, %q)) = %+v", tt.created, tt.id, got)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("1792152000|ch_12"))},
+		{"no separator", base64.RawURLEncoding.EncodeToString([]byte("1792152000"))},
+		{"no timestamp", base64.RawURLEncoding.EncodeToString([]byte("|ch_1"))},
+		{"timestamp not a number", base64.RawURLEncoding.EncodeToString([]byte("2026-10-16|ch_1"))},
+		{"negative timestamp", base64.RawURLEncoding.EncodeToString([]byte("-1|ch_1"))},
+		{"no id", base64.RawURLEncoding.EncodeToString([]byte("1792152000|"))},
+		{"blank", ""},
+	}
+
+	for _, tt := range tests {
+		if _, err := decodeCursor(tt.cursor); err != errInvalidCursor {
+			t.Errorf("%s: decodeCursor(%q) error = %v, want %v", tt.name, tt.cursor, err, errInvalidCursor)
+		}
+	}
+}
+
+func TestAPIKeyFromHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"bearer", map[string]string{"Authorization": "Bearer key_1"}, "key_1"},
+		{"bearer lowercase", map[string]string{"Authorization": "bearer key_1"}, "key_1"},
+		{"x-api-key", map[string]string{"X-API-Key": "key_2"}, "key_2"},
+		{"bearer before x-api-key", map[string]string{"Authorization": "Bearer key_1", "X-API-Key": "key_2"}, "key_1"},
+		{"other authorization", map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}, ""},
+		{"bearer without key", map[string]string{"Authorization": "Bearer "}, ""},
+		{"none", nil, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/card/report/api/charges/?api_key=query_key", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+
+		if got := apiKeyFromHeader(r); got != tt.want {
+			t.Errorf("%s: apiKeyFromHeader() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+//openTestSQLiteStore creates a sqlite db with the given tables for the length of a test and
+//returns a Store that uses it
+func openTestSQLiteStore(t *testing.T, createTables ...func(c *sqlx.DB) error) Store {
+	t.Helper()
+
+	c, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.MapperFunc(func(s string) string { return s })
+
+	for _, f := range createTables {
+		if err := f(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewSQLiteStore(c)
+}
+
+func TestFindLedgerPage(t *testing.T) {
+	oldStore := store
+	SetStore(openTestSQLiteStore(t, sqliteutils.CreateTableLedger))
+	defer SetStore(oldStore)
+
+	//saved out of order, charges created at the same time are paged by their id
+	entries := []LedgerEntry{
+		{StripeID: "ch_e", Type: ledgerTypeCharge, Created: 400},
+		{StripeID: "ch_b", Type: ledgerTypeCharge, Created: 100},
+		{StripeID: "ch_a", Type: ledgerTypeCharge, Created: 100},
+		{StripeID: "ch_d", Type: ledgerTypeCharge, Created: 300, StripeCustomerToken: "cus_1"},
+		{StripeID: "ch_c", Type: ledgerTypeCharge, Created: 200},
+		{StripeID: "ch_f", Type: ledgerTypeCharge, Created: 900},
+		{StripeID: "re_a", Type: ledgerTypeRefund, Created: 250},
+	}
+	for _, e := range entries {
+		if err := store.SaveLedgerEntry(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		limit    int
+		cursor   ledgerCursor
+		customer string
+		want     []string
+		wantMore bool
+	}{
+		{"first page", 2, ledgerCursor{}, "", []string{"ch_a", "ch_b"}, true},
+		{"after a charge", 2, ledgerCursor{100, "ch_b"}, "", []string{"ch_c", "ch_d"}, true},
+		{"same time as cursor", 2, ledgerCursor{100, "ch_a"}, "", []string{"ch_b", "ch_c"}, true},
+		{"last page", 2, ledgerCursor{300, "ch_d"}, "", []string{"ch_e"}, false},
+		{"page exactly fills the rest", 3, ledgerCursor{100, "ch_b"}, "", []string{"ch_c", "ch_d", "ch_e"}, false},
+		{"after the last charge", 2, ledgerCursor{400, "ch_e"}, "", []string{}, false},
+		{"cursor charge no longer exists", 2, ledgerCursor{150, "ch_gone"}, "", []string{"ch_c", "ch_d"}, true},
+		{"limit larger than results", 10, ledgerCursor{}, "", []string{"ch_a", "ch_b", "ch_c", "ch_d", "ch_e"}, false},
+		{"one customer", 10, ledgerCursor{}, "cus_1", []string{"ch_d"}, false},
+	}
+
+	for _, tt := range tests {
+		f := apiReportRequest{
+			start:               100,
+			end:                 400,
+			limit:               tt.limit,
+			cursor:              tt.cursor,
+			stripeCustomerToken: tt.customer,
+		}
+		page, hasMore, err := findLedgerPage(context.Background(), ledgerTypeCharge, f)
+		if err != nil {
+			t.Errorf("%s: findLedgerPage() error = %v", tt.name, err)
+			continue
+		}
+
+		got := []string{}
+		for _, e := range page {
+			got = append(got, e.StripeID)
+		}
+		if len(got) != len(tt.want) || hasMore != tt.wantMore {
+			t.Errorf("%s: findLedgerPage() = %v, %v, want %v, %v", tt.name, got, hasMore, tt.want, tt.wantMore)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: findLedgerPage() = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package card
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/xlsxutils"
+)
+
+//export formats and types
+const (
+	exportFormatCSV  = "csv"
+	exportFormatXLSX = "xlsx"
+
+	exportTypeCharges = "charges"
+	exportTypeRefunds = "refunds"
+)
+
+//exportTimestampFormat is the format of timestamps in exports
+//this is a format spreadsheet apps recognize as a date and time
+const exportTimestampFormat = "2006-01-02 15:04:05"
+
+//export errors
+var (
+	errInvalidExportFormat = errors.New("card: invalid export format")
+	errInvalidExportType   = errors.New("card: invalid export type")
+)
+
+//chargeExportHeader is the first row of an export of charges
+var chargeExportHeader = []interface{}{
+	"Charge ID",
+	"Timestamp",
+	"Currency",
+	"Amount",
+	"Fee",
+	"Net",
+	"Fee Estimated",
+	"Captured",
+	"Customer",
+	"Customer ID",
+	"Invoice",
+	"PO",
+	"User",
+	"Auto Charge Referrer",
+	"Auto Charge Reason",
+	"Card Brand",
+	"Card Last 4",
+	"Payment Type",
+	"Status",
+}
+
+//refundExportHeader is the first row of an export of refunds
+var refundExportHeader = []interface{}{
+	"Refund ID",
+	"Charge ID",
+	"Timestamp",
+	"Currency",
+	"Amount",
+	"Fee Returned",
+	"Net",
+	"Fee Estimated",
+	"Reason",
+	"Customer",
+	"Customer ID",
+	"Invoice",
+	"PO",
+	"User",
+	"Card Brand",
+	"Card Last 4",
+}
+
+//ExportReport downloads the charges and refunds in a report as a CSV or Excel file
+//This uses the same filters (date range, customer, and timezone) as Report so the file matches
+//what is shown on the reports page.  Timestamps are in the timezone set in the app settings.
+//A CSV file has either the charges or refunds, chosen by the "type", since a CSV file can only
+//have one table.  An Excel file has the charges and refunds on separate sheets.
+func ExportReport(w http.ResponseWriter, r *http.Request) {
+	format := strings.ToLower(r.FormValue("format"))
+	if format != exportFormatCSV && format != exportFormatXLSX {
+		output.Error(errInvalidExportFormat, "The 'format' must be csv or xlsx.", w)
+		return
+	}
+
+	exportType := strings.ToLower(r.FormValue("type"))
+	if exportType == "" {
+		exportType = exportTypeCharges
+	}
+	if format == exportFormatCSV && exportType != exportTypeCharges && exportType != exportTypeRefunds {
+		output.Error(errInvalidExportType, "The 'type' must be charges or refunds.", w)
+		return
+	}
+
+	f, errMsg, err := parseReportFilter(r)
+	if err != nil {
+		output.Error(err, errMsg, w)
+		return
+	}
+
+	//get data on charges and refunds
+	//fees for charges Stripe hasn't given us the fee for yet are estimated same as on the report
+	c := r.Context()
+	charges, _, _, err := getListOfCharges(c, r, f.stripeCustomerToken, f.start.Unix(), f.end.Unix())
+	if err != nil {
+		output.Error(err, "Could not get the list of charges.", w)
+		return
+	}
+
+	refunds, _, _, err := getListOfRefunds(c, f.stripeCustomerToken, f.start.Unix(), f.end.Unix())
+	if err != nil {
+		output.Error(err, "Could not get the list of refunds.", w)
+		return
+	}
+
+	//build the rows
+	guiLoc, _ := guiTimezone(r)
+
+	chargeRows := [][]interface{}{chargeExportHeader}
+	for _, d := range charges {
+		timestamp, err := reportTimestamp(d.Timestamp, guiLoc, exportTimestampFormat)
+		if err != nil {
+			log.Println("card.ExportReport, charges: time reformat error", err)
+			timestamp = d.Timestamp
+		}
+
+		chargeRows = append(chargeRows, []interface{}{
+			d.ID,
+			timestamp,
+			strings.ToUpper(d.Currency),
+			exportAmount(d.AmountDollars),
+			exportAmount(d.FeeDollars),
+			exportAmount(d.NetDollars),
+			d.FeeEstimated,
+			d.Captured,
+			d.Customer,
+			d.CustomerID,
+			d.Invoice,
+			d.Po,
+			d.User,
+			d.AutoChargeReferrer,
+			d.AutoChargeReason,
+			d.CardBrand,
+			d.LastFour,
+			d.PaymentType,
+			d.Status,
+		})
+	}
+
+	refundRows := [][]interface{}{refundExportHeader}
+	for _, d := range refunds {
+		timestamp, err := reportTimestamp(d.Timestamp, guiLoc, exportTimestampFormat)
+		if err != nil {
+			log.Println("card.ExportReport, refunds: time reformat error", err)
+			timestamp = d.Timestamp
+		}
+
+		refundRows = append(refundRows, []interface{}{
+			d.ID,
+			d.ChargeID,
+			timestamp,
+			strings.ToUpper(d.Currency),
+			exportAmount(d.AmountDollars),
+			exportAmount(d.FeeDollars),
+			exportAmount(d.NetDollars),
+			d.FeeEstimated,
+			d.Reason,
+			d.Customer,
+			d.CustomerID,
+			d.Invoice,
+			d.Po,
+			d.User,
+			d.CardBrand,
+			d.LastFour,
+		})
+	}
+
+	//build the file
+	//the file is built before anything is written to the response so an error can still be shown
+	filename := "report-" + f.start.Format("2006-01-02") + "-to-" + f.end.Format("2006-01-02")
+	var b bytes.Buffer
+	contentType := ""
+
+	switch format {
+	case exportFormatCSV:
+		rows := chargeRows
+		if exportType == exportTypeRefunds {
+			rows = refundRows
+		}
+
+		err = writeCSV(&b, rows)
+		contentType = "text/csv; charset=utf-8"
+		filename += "-" + exportType + ".csv"
+
+	case exportFormatXLSX:
+		err = xlsxutils.Write(&b, []xlsxutils.Sheet{
+			{Name: "Charges", Rows: chargeRows},
+			{Name: "Refunds", Rows: refundRows},
+		})
+		contentType = xlsxutils.ContentType
+		filename += ".xlsx"
+	}
+	if err != nil {
+		output.Error(err, "Could not build the export file.", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.Write(b.Bytes())
+}
+
+//exportAmount returns an amount as a number for an export
+//amounts that aren't known, such as the fee for a charge that was never captured, are left blank
+func exportAmount(dollars string) interface{} {
+	if dollars == "" {
+		return ""
+	}
+
+	return xlsxutils.Number(dollars)
+}
+
+//writeCSV writes rows to a CSV file
+//Text that a spreadsheet app would treat as a formula, such as a customer name starting with =,
+//is prefixed with a ' so the text is shown as is instead of being run.
+func writeCSV(b *bytes.Buffer, rows [][]interface{}) error {
+	cw := csv.NewWriter(b)
+	for _, row := range rows {
+		record := make([]string, 0, len(row))
+		for _, v := range row {
+			switch v := v.(type) {
+			case xlsxutils.Number:
+				record = append(record, string(v))
+			case bool:
+				record = append(record, strconv.FormatBool(v))
+			case string:
+				record = append(record, escapeCSVFormula(v))
+			}
+		}
+
+		cw.Write(record)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+//escapeCSVFormula prefixes text that starts like a formula with a ' so spreadsheet apps show the text
+func escapeCSVFormula(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return s
+	}
+
+	return "'" + s
+}
@@ -5,80 +5,46 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/users"
-	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
 )
 
 //Report gets the data for charges and refunds by the defined filters (date range and customer) and builds the reports page
 //The reports show up in a different page so they are easily printable and more easily inspected.
 //Date range is inclusive of start and end day.
+//The data comes from the ledger, not Stripe, so anything missing from the ledger needs to be
+//filled in by the resync cron task.
 func Report(w http.ResponseWriter, r *http.Request) {
-	//get form values
-	datastoreID := r.FormValue("customer-id")
-	startString := r.FormValue("start-date")
-	endString := r.FormValue("end-date")
-	hoursToUTC := r.FormValue("timezone")
-
-	//get report data form stripe
-	//make sure inputs are given
-	if len(startString) == 0 {
-		output.Error(errMissingInput, "You must supply a 'start-date'.", w)
-		return
-	}
-	if len(endString) == 0 {
-		output.Error(errMissingInput, "You must supply a 'end-date'.", w)
-		return
-	}
-	if len(hoursToUTC) == 0 {
-		output.Error(errMissingInput, "You must supply a 'timezone'.", w)
+	f, errMsg, err := parseReportFilter(r)
+	if err != nil {
+		output.Error(err, errMsg, w)
 		return
 	}
 
-	//get timezone offset
-	//adjust for the local timezone the user is in so that the date range is correct
-	//hoursToUTC is a number generated by JS (-4 for EST)
-	tzOffset := calcTzOffset(hoursToUTC)
-
-	//get datetimes from provided start and end date strings
-	startDt, err := time.Parse("2006-01-02 -0700", startString+" "+tzOffset)
+	//get data on charges
+	c := r.Context()
+	charges, numCharges, chargeTotals, err := getListOfCharges(c, r, f.stripeCustomerToken, f.start.Unix(), f.end.Unix())
 	if err != nil {
-		output.Error(err, "Could not convert start date to a time.Time datetime.", w)
+		output.Error(err, "Could not get the list of charges.", w)
 		return
 	}
-	endDt, err := time.Parse("2006-01-02 -0700", endString+" "+tzOffset)
+
+	//get data on refunds
+	refunds, numRefunds, refundTotals, err := getListOfRefunds(c, f.stripeCustomerToken, f.start.Unix(), f.end.Unix())
 	if err != nil {
-		output.Error(err, "Could not convert end date to a time.Time datetime.", w)
+		output.Error(err, "Could not get the list of refunds.", w)
 		return
 	}
 
-	//get end of day datetime
-	//need to get 23:59:59 so we include the whole day
-	endDt = endDt.Add((24*60-1)*time.Minute + (59 * time.Second))
-
-	//get unix timestamps
-	//stripe only accepts timestamps for filtering charges
-	startUnix := startDt.Unix()
-	endUnix := endDt.Unix()
-
-	//init stripe
-	c := r.Context()
-	sc := CreateStripeClient(c)
-
-	//get data on charges
-	charges, numCharges, totalCharged, totalChargedLessFees := getListOfCharges(c, sc, r, datastoreID, startUnix, endUnix)
-
-	//get data on refunds
-	refunds, numRefunds, totalRefunded := getListOfRefunds(sc, startUnix, endUnix)
-
 	//get logged in user's data
 	//for determining if receipt/refund buttons need to be hidden or shown based on user's access rights
 	userID := sessionutils.GetUserID(r)
@@ -86,64 +52,58 @@ func Report(w http.ResponseWriter, r *http.Request) {
 
 	//format timestamps
 	//show timestamps in timezone set in app settings and change the format to be a bit nicer to look at
-	//utcLoc is the timezone Stripe records charges in.  Stripe always uses UTC
-	//guiLoc is the timezone we want to show charges in to make sense to users. this is set in app settings.
-	utcLoc, err := time.LoadLocation("UTC")
-	if err != nil {
-		log.Println("card.Report: could not get UTC timezone location", err)
-	}
-
-	appData, err := appsettings.Get(r)
-	timezone := "UTC" //default value
-	if err != nil {
-		log.Println("card.Report: could not get appsettings timezone", err)
-	} else {
-		timezone = appData.ReportTimezone
-	}
-
-	guiLoc, err := time.LoadLocation(timezone)
-	if err != nil {
-		log.Println("card.Report: could not get gui timezone location", err)
-	}
+	guiLoc, timezone := guiTimezone(r)
 
 	for index, c := range charges {
-		originalTime := c.Timestamp
-		originalTimeTime, err := time.ParseInLocation("2006-01-02T15:04:05.000Z", originalTime, utcLoc)
+		newTime, err := reportTimestamp(c.Timestamp, guiLoc, "2006-01-02 @ 3:04:05PM")
 		if err != nil {
 			log.Println("card.Report, charges: time reformat error", err)
 			continue
 		}
 
-		newTime := originalTimeTime.In(guiLoc).Format("2006-01-02 @ 3:04:05PM")
 		charges[index].Timestamp = newTime
 	}
 
 	for index, c := range refunds {
-		originalTime := c.Timestamp
-		originalTimeTime, err := time.ParseInLocation("2006-01-02T15:04:05.000Z", originalTime, utcLoc)
+		newTime, err := reportTimestamp(c.Timestamp, guiLoc, "2006-01-02 @ 3:04:05PM")
 		if err != nil {
 			log.Println("card.Report, refunds: time reformat error", err)
 			continue
 		}
 
-		newTime := originalTimeTime.In(guiLoc).Format("2006-01-02 @ 3:04:05PM")
 		refunds[index].Timestamp = newTime
 	}
 
+	//count the fees we had to estimate so we can show a note in the report
+	var numEstimatedFees uint16
+	for _, c := range charges {
+		if c.FeeEstimated {
+			numEstimatedFees++
+		}
+	}
+	for _, r := range refunds {
+		if r.FeeEstimated {
+			numEstimatedFees++
+		}
+	}
+
 	//store data for building template
 	result := reportData{
-		UserData:             userdata,
-		StartDate:            startDt,
-		EndDate:              endDt,
-		Charges:              charges,
-		Refunds:              refunds,
-		TotalCharges:         totalCharged,
-		TotalChargesLessFees: totalChargedLessFees,
-		TotalRefunds:         totalRefunded,
-		TotalRefundsLessFees: "",
-		NumCharges:           numCharges,
-		NumRefunds:           numRefunds,
-		ReportGUITimezone:    timezone,
+		UserData:          userdata,
+		StartDate:         f.start,
+		EndDate:           f.end,
+		Charges:           charges,
+		Refunds:           refunds,
+		ChargeTotals:      chargeTotals,
+		RefundTotals:      refundTotals,
+		DailyTotals:       dailyTotals(charges, refunds),
+		NumEstimatedFees:  numEstimatedFees,
+		NumCharges:        numCharges,
+		NumRefunds:        numRefunds,
+		ReportGUITimezone: timezone,
+		EmailEnabled:      emailutils.Enabled(),
+		Timezone:          f.hoursToUTC,
+		CustomerFilterID:  f.datastoreID,
 	}
 
 	//build template to display report
@@ -151,121 +111,311 @@ func Report(w http.ResponseWriter, r *http.Request) {
 	templates.Load(w, "report", result)
 }
 
-//getListOfCharges gets the list of charges and returns data about them
-//This filters the list of charges by date range and customer.
-//The returned data includes the total amount of the charges with and without fees
-//and the number of charges.
-func getListOfCharges(c context.Context, sc *client.API, r *http.Request, datastoreID string, start, end int64) (data []ChargeData, numCharges uint16, total, totalLessFees string) {
-	//retrieve data from stripe
-	//date is a range inclusive of the days the user chose
-	//limit of 100 is the max per stripe
-	params := &stripe.ChargeListParams{}
-	params.Filters.AddFilter("created", "gte", strconv.FormatInt(start, 10))
-	params.Filters.AddFilter("created", "lte", strconv.FormatInt(end, 10))
-	params.Filters.AddFilter("limit", "", "100")
+//reportFilter is the date range and customer a report, or an export of a report, is for
+type reportFilter struct {
+	start               time.Time //start of the first day, in the user's timezone
+	end                 time.Time //end of the last day, 23:59:59 in the user's timezone
+	hoursToUTC          string    //the user's timezone as provided by JS, -4 for EST
+	datastoreID         string    //the customer to filter by, blank for all customers
+	stripeCustomerToken string    //the stripe customer looked up from the datastoreID
+}
+
+//parseReportFilter gets the date range and customer a report is for from the request
+//Date range is inclusive of start and end day.  A message for the user is returned with any error.
+func parseReportFilter(r *http.Request) (f reportFilter, errMsg string, err error) {
+	//get form values
+	f.datastoreID = r.FormValue("customer-id")
+	startString := r.FormValue("start-date")
+	endString := r.FormValue("end-date")
+	f.hoursToUTC = r.FormValue("timezone")
+
+	//make sure inputs are given
+	if len(startString) == 0 {
+		return f, "You must supply a 'start-date'.", errMissingInput
+	}
+	if len(endString) == 0 {
+		return f, "You must supply a 'end-date'.", errMissingInput
+	}
+	if len(f.hoursToUTC) == 0 {
+		return f, "You must supply a 'timezone'.", errMissingInput
+	}
+
+	//get timezone offset
+	//adjust for the local timezone the user is in so that the date range is correct
+	//hoursToUTC is a number generated by JS (-4 for EST)
+	tzOffset := calcTzOffset(f.hoursToUTC)
+
+	//get datetimes from provided start and end date strings
+	f.start, err = time.Parse("2006-01-02 -0700", startString+" "+tzOffset)
+	if err != nil {
+		return f, "Could not convert start date to a time.Time datetime.", err
+	}
+	f.end, err = time.Parse("2006-01-02 -0700", endString+" "+tzOffset)
+	if err != nil {
+		return f, "Could not convert end date to a time.Time datetime.", err
+	}
+
+	//get end of day datetime
+	//need to get 23:59:59 so we include the whole day
+	f.end = f.end.Add((24*60-1)*time.Minute + (59 * time.Second))
 
 	//check if we need to filter by a specific customer
 	//look up stripe customer id by the datastore id
-	if len(datastoreID) != 0 {
-		datastoreIDInt, _ := strconv.ParseInt(datastoreID, 10, 64)
-		custData, err := findByDatastoreID(c, datastoreIDInt)
+	if len(f.datastoreID) != 0 {
+		datastoreIDInt, _ := strconv.ParseInt(f.datastoreID, 10, 64)
+		custData, err := findByDatastoreID(r.Context(), datastoreIDInt)
 		if err != nil {
-			return
+			return f, "Could not find this customer's data.", err
 		}
 
-		params.Filters.AddFilter("customer", "", custData.StripeCustomerToken)
+		f.stripeCustomerToken = custData.StripeCustomerToken
+	}
+
+	return f, "", nil
+}
+
+//reportTimestamp converts the timestamp of a charge or refund from the ledger to the timezone
+//set in the app settings
+//Stripe always records charges in UTC.  The timestamp is returned in the given format.
+func reportTimestamp(timestamp string, guiLoc *time.Location, format string) (string, error) {
+	t, err := time.ParseInLocation("2006-01-02T15:04:05.000Z", timestamp, time.UTC)
+	if err != nil {
+		return "", err
 	}
 
-	//get list of charges
+	return t.In(guiLoc).Format(format), nil
+}
+
+//getListOfCharges gets the list of charges and returns data about them
+//This filters the list of charges by date range and, if a stripe customer token is
+//given, by customer.  The returned data includes the total amount of the charges, the
+//fees, and the total less fees for each currency, and the number of charges.
+//The fees are the actual fees from Stripe.  If Stripe hasn't given us the fee for a charge
+//yet, the fee is estimated from the fees in the company info.
+func getListOfCharges(c context.Context, r *http.Request, stripeCustomerToken string, start, end int64) (data []ChargeData, numCharges uint16, totals []currencyTotal, err error) {
+	//retrieve data from the ledger
+	//date is a range inclusive of the days the user chose
+	entries, err := store.FindLedgerEntries(c, LedgerFilter{
+		Type:                ledgerTypeCharge,
+		Start:               start,
+		End:                 end,
+		StripeCustomerToken: stripeCustomerToken,
+	})
+	if err != nil {
+		return
+	}
+
+	//get fees used to estimate fees that Stripe hasn't given us
+	companyInfo, _ := company.Get(r)
+
+	data, numCharges, totals = chargesFromLedger(entries, companyInfo)
+	return
+}
+
+//chargesFromLedger gets the charge data for charges in the ledger and totals them up
+//Only captured charges are counted and totaled.  Fees Stripe hasn't given us yet are
+//estimated from the fees in the company info.
+func chargesFromLedger(entries []LedgerEntry, companyInfo company.Info) (data []ChargeData, numCharges uint16, totals []currencyTotal) {
 	//loop through each charge and extract charge data
-	//add up total amount of all charges
-	charges := sc.Charges.List(params)
-	var amountTotal int64
-	for charges.Next() {
+	//add up total amount of all charges in each currency
+	sums := currencySums{}
+	for _, e := range entries {
 		//get each charges data
-		chg := charges.Charge()
-		d := ExtractDataFromCharge(chg)
+		d := e.chargeData()
 
 		//only total up amount and number of charges for charges that were captured
-		if d.Captured {
-			amountTotal += d.AmountCents
+		//bank account charges are captured right away but fail if the customer's bank returns the payment
+		if d.Captured && d.FailureCode == "" {
+			if !e.feeKnown() {
+				d.FeeCents = estimateFee(d.AmountCents, d.Currency, companyInfo)
+				d.FeeDollars = FormatAmount(d.FeeCents, d.Currency)
+				d.NetCents = d.AmountCents - d.FeeCents
+				d.NetDollars = FormatAmount(d.NetCents, d.Currency)
+				d.FeeEstimated = true
+			}
+
+			sums.add(d.Currency, d.AmountCents, d.FeeCents, d.AmountCents-d.FeeCents)
 			numCharges++
 		}
 
 		data = append(data, d)
 	}
 
-	//calculate fees
-	//fees should be returned as a dollar.cents number
-	companyInfo, _ := company.Get(r)
-
-	fixedFee := float64(numCharges) * companyInfo.FixedFee
-	percentFee := float64(amountTotal) / 100 * companyInfo.PercentFee
-	percentFeeRounded := round(percentFee)
-	fees := fixedFee + percentFeeRounded
+	totals = sums.totals()
+	return
+}
 
-	//convert amounts to dollars
-	amountTotalFloat := (float64(amountTotal) / 100)
-	total = strconv.FormatFloat(amountTotalFloat, 'f', 2, 64)
-	totalLessFees = strconv.FormatFloat(amountTotalFloat-fees, 'f', 2, 64)
+//getListOfRefunds gets the list of refunds and returns data about them
+//This filters the list of refunds by date range and, if a stripe customer token is
+//given, by customer.  The returned data includes the total amount refunded, the fees
+//Stripe returned to us, and the total taken from our Stripe balance for each currency.
+func getListOfRefunds(c context.Context, stripeCustomerToken string, start, end int64) (refunds []RefundData, numRefunds uint16, totals []currencyTotal, err error) {
+	//retrieve refunds from the ledger
+	entries, err := store.FindLedgerEntries(c, LedgerFilter{
+		Type:                ledgerTypeRefund,
+		Start:               start,
+		End:                 end,
+		StripeCustomerToken: stripeCustomerToken,
+	})
+	if err != nil {
+		return
+	}
 
+	refunds, numRefunds, totals = refundsFromLedger(entries)
 	return
 }
 
-//getListOfRefunds gets the list of refunds and returns data about them
-//This filters the list of refunds by date range.
-//We cannot filter by company when looking up refunds, unfortunately (Stripe issue).
-//This looks up refunds by iterating through the list of events that
-//happened on our Stripe account.
-func getListOfRefunds(sc *client.API, start, end int64) (refunds []RefundData, numRefunds uint16, total string) {
-	//retrieve refunds
-	eventParams := &stripe.EventListParams{}
-	eventParams.Filters.AddFilter("created", "gte", strconv.FormatInt(start, 10))
-	eventParams.Filters.AddFilter("created", "lte", strconv.FormatInt(end, 10))
-	eventParams.Filters.AddFilter("limit", "", "100")
-	eventParams.Filters.AddFilter("type", "", "charge.refunded")
-
-	events := sc.Events.List(eventParams)
-	refunds = ExtractRefundsFromEvents(events)
-
-	var amountTotal int64
-	for _, v := range refunds {
+//refundsFromLedger gets the refund data for refunds in the ledger and totals them up
+func refundsFromLedger(entries []LedgerEntry) (refunds []RefundData, numRefunds uint16, totals []currencyTotal) {
+	sums := currencySums{}
+	for _, e := range entries {
+		d := e.refundData()
+		refunds = append(refunds, d)
 		numRefunds++
-		amountTotal += v.AmountCents
+		sums.add(d.Currency, d.AmountCents, d.FeeCents, d.NetCents)
+	}
+
+	totals = sums.totals()
+	return
+}
+
+//currencySums adds up amounts separately for each currency
+//amounts in different currencies can't be added together
+type currencySums map[string]*currencyTotal
+
+//add adds an amount, fee, and net amount to the total for a currency
+func (s currencySums) add(currency string, amount, fee, net int64) {
+	t, ok := s[currency]
+	if !ok {
+		t = &currencyTotal{
+			Currency:       currency,
+			CurrencySymbol: currencySymbol(currency),
+		}
+		s[currency] = t
 	}
 
-	//calculate total less fees
-	/*
-	 * Cannot do this since we don't know if a refund was a full refund or partial refund.
-	 * Fixed fees are only refunded on full refunds.
-	 * We can get a list of all refunds...but what if a charge was refunded on two transaction on different days?
-	 * We would need some way to check this and know which day the fixed fees were refunded on.
-	 *
-	 */
+	t.Count++
+	t.amountCents += amount
+	t.feeCents += fee
+	t.netCents += net
+}
 
-	//convert amount to dollars
-	total = strconv.FormatFloat((float64(amountTotal) / 100), 'f', 2, 64)
+//totals returns the total for each currency with the amounts formatted, sorted by currency
+func (s currencySums) totals() []currencyTotal {
+	currencies := make([]string, 0, len(s))
+	for c := range s {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+
+	totals := make([]currencyTotal, 0, len(currencies))
+	for _, c := range currencies {
+		t := *s[c]
+		t.Amount = FormatAmount(t.amountCents, c)
+		t.Fees = FormatAmount(t.feeCents, c)
+		t.LessFees = FormatAmount(t.netCents, c)
+		totals = append(totals, t)
+	}
 
-	return
+	return totals
 }
 
-//round rounds a number to two decimal places
-//this is used when calculating the percentage fees for a charge
-func round(f float64) float64 {
+//guiTimezone returns the timezone set in the app settings that timestamps in reports are shown in
+//UTC is returned if the app settings can't be read.
+func guiTimezone(r *http.Request) (*time.Location, string) {
+	timezone := "UTC" //default value
+	appData, err := appsettings.Get(r)
+	if err != nil {
+		log.Println("card.guiTimezone: could not get appsettings timezone", err)
+	} else {
+		timezone = appData.ReportTimezone
+	}
 
-	//the number of digits after the decimal point we want
-	const sigfigs float64 = 2
+	guiLoc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Println("card.guiTimezone: could not get gui timezone location", err)
+		return time.UTC, "UTC"
+	}
 
-	//the number we multiply by to shift the decimal point
-	//shift = 100, this will result in us getting the number as cents
-	var shift = 10 * sigfigs
+	return guiLoc, timezone
+}
 
-	//shift the decimal to the right
-	fShiftedRight := f * shift
+//estimateFee estimates the fee for a charge from the fees saved in the company info
+//this is only used until Stripe gives us the actual fee for a charge
+//the fixed fee is treated as being in the charge's currency, which is close enough for an estimate
+func estimateFee(amountCents int64, currency string, info company.Info) int64 {
+	percentFee := math.Floor(float64(amountCents)*info.PercentFee + 0.5)
+	fixedFee := math.Floor(info.FixedFee*math.Pow10(minorUnits(currency)) + 0.5)
+	return int64(percentFee + fixedFee)
+}
 
-	//round
-	fCentsRounded := math.Floor(fShiftedRight + 0.5)
+//dailyTotals totals up the charges and refunds in a report for each day
+//The timestamps of the charges and refunds must already be formatted in the gui's timezone.
+//Only captured charges are included.  Days are returned oldest first, a day with charges or
+//refunds in more than one currency has a total for each currency.
+func dailyTotals(charges []ChargeData, refunds []RefundData) []dailyTotal {
+	type sums struct {
+		charges, refunds, fees, net int64
+	}
+	type dayKey struct {
+		date, currency string
+	}
+	days := map[dayKey]*sums{}
+	getDay := func(timestamp, currency string) *sums {
+		//timestamps are formatted as yyyy-mm-dd @ h:mm:ssPM
+		date := timestamp
+		if len(date) > len("2006-01-02") {
+			date = date[:len("2006-01-02")]
+		}
+		k := dayKey{date, currency}
+		if days[k] == nil {
+			days[k] = &sums{}
+		}
+		return days[k]
+	}
+
+	for _, d := range charges {
+		if !d.Captured || d.FailureCode != "" {
+			continue
+		}
+
+		day := getDay(d.Timestamp, d.Currency)
+		day.charges += d.AmountCents
+		day.fees += d.FeeCents
+		day.net += d.NetCents
+	}
+
+	for _, d := range refunds {
+		day := getDay(d.Timestamp, d.Currency)
+		day.refunds += d.AmountCents
+		day.fees -= d.FeeCents
+		day.net -= d.NetCents
+	}
+
+	keys := make([]dayKey, 0, len(days))
+	for k := range days {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].date != keys[j].date {
+			return keys[i].date < keys[j].date
+		}
+		return keys[i].currency < keys[j].currency
+	})
+
+	totals := make([]dailyTotal, 0, len(keys))
+	for _, k := range keys {
+		day := days[k]
+		totals = append(totals, dailyTotal{
+			Date:           k.date,
+			Currency:       k.currency,
+			CurrencySymbol: currencySymbol(k.currency),
+			Charges:        FormatAmount(day.charges, k.currency),
+			Refunds:        FormatAmount(day.refunds, k.currency),
+			Fees:           FormatAmount(day.fees, k.currency),
+			Net:            FormatAmount(day.net, k.currency),
+		})
+	}
 
-	//shift the decimal back to the left to get dollar.cents value
-	return fCentsRounded / shift
+	return totals
 }
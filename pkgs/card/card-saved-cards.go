@@ -0,0 +1,288 @@
+package card
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+)
+
+//saved card errors
+var (
+	errCardNotFound      = errors.New("card: saved card not found")
+	errLastCard          = errors.New("card: cannot remove the only card of a customer")
+	errCardAlreadyExists = errors.New("card: card already saved for customer")
+)
+
+//FindCards returns every card saved for a customer, the default card first
+//Customers added before a customer could have more than one card don't have any saved cards.
+//For these customers the card saved on the customer is returned instead.  This card doesn't have
+//an id or a Stripe card id and charging it charges the Stripe customer's default card.
+func FindCards(ctx context.Context, customer CustomerDatastore) ([]SavedCard, error) {
+	cards, err := store.FindSavedCards(ctx, customer.ID)
+	if err != nil {
+		return cards, err
+	}
+
+	if len(cards) == 0 {
+		cards = append(cards, SavedCard{
+			CustomerDatastoreID: customer.ID,
+			Cardholder:          customer.Cardholder,
+			CardExpiration:      customer.CardExpiration,
+			CardLast4:           customer.CardLast4,
+			IsDefault:           true,
+			DatetimeCreated:     customer.DatetimeCreated,
+			AddedByUser:         customer.AddedByUser,
+		})
+	}
+
+	return cards, nil
+}
+
+//selectCard picks the card to charge from a customer's cards
+//A card can be chosen by its id or by its last four digits.  If neither is given the default
+//card is used.  The default card is always first in the list of cards.
+func selectCard(cards []SavedCard, cardID int64, last4 string) (SavedCard, error) {
+	if len(cards) == 0 {
+		return SavedCard{}, errCardNotFound
+	}
+
+	if cardID == 0 && last4 == "" {
+		return cards[0], nil
+	}
+
+	for _, c := range cards {
+		if cardID != 0 && c.ID == cardID {
+			return c, nil
+		}
+		if cardID == 0 && c.CardLast4 == last4 {
+			return c, nil
+		}
+	}
+
+	return SavedCard{}, errCardNotFound
+}
+
+//saveExistingCard saves the card of a customer without any saved cards as a saved card
+//This is needed before a second card is added to a customer so that we know the Stripe
+//card id of the customer's original card and can choose between the cards when charging.
+func saveExistingCard(ctx context.Context, customer CustomerDatastore) (SavedCard, error) {
+	stripeCardID, err := defaultStripeCardID(ctx, customer.StripeCustomerToken)
+	if err != nil {
+		return SavedCard{}, err
+	}
+
+	c := SavedCard{
+		CustomerDatastoreID: customer.ID,
+		StripeCardID:        stripeCardID,
+		Cardholder:          customer.Cardholder,
+		CardExpiration:      customer.CardExpiration,
+		CardLast4:           customer.CardLast4,
+		IsDefault:           true,
+		DatetimeCreated:     customer.DatetimeCreated,
+		AddedByUser:         customer.AddedByUser,
+	}
+
+	//the customer's default on Stripe could be a bank account
+	if isBankAccountID(stripeCardID) {
+		err = defaultBankAccount(CreateStripeClient(ctx), customer.StripeCustomerToken, stripeCardID, &c)
+		if err != nil {
+			return SavedCard{}, err
+		}
+	}
+
+	c.ID, err = store.AddSavedCard(ctx, c)
+	return c, err
+}
+
+//addCardToCustomer attaches a new card to an existing customer
+//The card is added to the customer's Stripe customer and saved as one of the customer's cards.
+//cardToken is a bank account token if newCard is a bank account.
+func addCardToCustomer(ctx context.Context, customer CustomerDatastore, newCard SavedCard, cardToken string, makeDefault bool) (SavedCard, error) {
+	cards, err := store.FindSavedCards(ctx, customer.ID)
+	if err != nil {
+		return newCard, err
+	}
+
+	//save the customer's existing card before adding another
+	if len(cards) == 0 {
+		existing, err := saveExistingCard(ctx, customer)
+		if err != nil {
+			log.Println("card.addCardToCustomer - could not save the customer's existing card", err)
+			return newCard, err
+		}
+
+		cards = append(cards, existing)
+	}
+
+	//don't add the same card twice
+	for _, c := range cards {
+		if c.CardLast4 == newCard.CardLast4 && c.CardExpiration == newCard.CardExpiration && c.isBankAccount() == newCard.isBankAccount() {
+			return newCard, errCardAlreadyExists
+		}
+	}
+
+	//add the card to the stripe customer
+	sc := CreateStripeClient(ctx)
+	err = saveToStripe(sc, customer.StripeCustomerToken, cardToken, &newCard)
+	if err != nil {
+		return newCard, err
+	}
+
+	newCard.CustomerDatastoreID = customer.ID
+	newCard.IsDefault = false
+	newCard.ID, err = store.AddSavedCard(ctx, newCard)
+	if err != nil {
+		return newCard, err
+	}
+
+	if makeDefault {
+		err = setDefaultCard(ctx, customer, newCard)
+		if err != nil {
+			return newCard, err
+		}
+		newCard.IsDefault = true
+	}
+
+	return newCard, nil
+}
+
+//setDefaultCard makes a card the one that is charged when no card is chosen
+//the card is set as the default of the Stripe customer so charges made from the Stripe
+//dashboard use the same card
+func setDefaultCard(ctx context.Context, customer CustomerDatastore, c SavedCard) error {
+	if c.StripeCardID != "" {
+		sc := CreateStripeClient(ctx)
+		err := setDefaultOnStripe(sc, customer.StripeCustomerToken, c.StripeCardID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.UpdateDefaultCard(ctx, c)
+}
+
+//removeCard removes one card from a customer
+//errLastCard is returned if this is the customer's only card since a customer without a card
+//can't be charged, the customer should be removed instead.  If the default card is removed,
+//the oldest remaining card becomes the default.
+func removeCard(ctx context.Context, customer CustomerDatastore, cardID int64) error {
+	cards, err := store.FindSavedCards(ctx, customer.ID)
+	if err != nil {
+		return err
+	}
+	if len(cards) <= 1 {
+		return errLastCard
+	}
+
+	var toRemove SavedCard
+	var remaining []SavedCard
+	for _, c := range cards {
+		if c.ID == cardID {
+			toRemove = c
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	if toRemove.ID == 0 {
+		return errCardNotFound
+	}
+
+	//remove the card from stripe
+	//continue on stripe error so we still remove the card from our db
+	sc := CreateStripeClient(ctx)
+	detachFromStripe(sc, customer.StripeCustomerToken, toRemove.StripeCardID)
+
+	err = store.RemoveSavedCard(ctx, toRemove.ID)
+	if err != nil {
+		return err
+	}
+
+	if !toRemove.IsDefault {
+		return nil
+	}
+
+	//Stripe makes another card the default when the default source is removed, or leaves the
+	//customer without a default when a PaymentMethod is removed, make sure the default on
+	//Stripe is the same card we use as the default
+	//the card is saved as the default first so our db is correct even if Stripe can't be updated
+	err = store.UpdateDefaultCard(ctx, remaining[0])
+	if err != nil {
+		return err
+	}
+
+	err = setDefaultOnStripe(sc, customer.StripeCustomerToken, remaining[0].StripeCardID)
+	if err != nil {
+		log.Println("card.removeCard - Could not set default card on stripe", err)
+	}
+
+	return nil
+}
+
+//removeCardOrCustomer removes one card from a customer, or the customer if it is the customer's only card
+//this is used when a card should be removed no matter what, i.e.: it expired
+func removeCardOrCustomer(ctx context.Context, customer CustomerDatastore, cardID int64) error {
+	err := removeCard(ctx, customer, cardID)
+	if err == errLastCard {
+		return remove(ctx, customer.ID)
+	}
+
+	return err
+}
+
+//SetDefault changes which of a customer's cards is charged if no card is chosen
+func SetDefault(w http.ResponseWriter, r *http.Request) {
+	//get form values
+	datastoreID, _ := strconv.ParseInt(r.FormValue("customerId"), 10, 64)
+	cardID, _ := strconv.ParseInt(r.FormValue("cardId"), 10, 64)
+
+	//make sure ids were given
+	if datastoreID == 0 || cardID == 0 {
+		output.Error(errMissingInput, "A customer's datastore ID and card ID must be given but were missing. These should have been submitted automatically.", w)
+		return
+	}
+
+	c := r.Context()
+	customer, err := findByDatastoreID(c, datastoreID)
+	if err != nil {
+		output.Error(err, "Could not find this customer's data.", w)
+		return
+	}
+
+	cards, err := store.FindSavedCards(c, datastoreID)
+	if err != nil {
+		output.Error(err, "Could not look up this customer's cards.", w)
+		return
+	}
+
+	card, err := selectCard(cards, cardID, "")
+	if err != nil {
+		output.Error(err, "Could not find this card for this customer.", w)
+		return
+	}
+
+	err = setDefaultCard(c, customer, card)
+	if err != nil {
+		output.Error(err, "There was an error while changing the default card. Please try again.", w)
+		return
+	}
+
+	//done
+	output.Success("cardSetDefault", nil, w)
+}
+
+//newSavedCard builds the saved card for a card that is being added to a customer
+func newSavedCard(cardholder, cardExp, cardLast4, username string) SavedCard {
+	return SavedCard{
+		Cardholder:      cardholder,
+		CardExpiration:  cardExp,
+		CardLast4:       cardLast4,
+		PaymentType:     paymentTypeCard,
+		DatetimeCreated: timestamps.ISO8601(),
+		AddedByUser:     username,
+	}
+}
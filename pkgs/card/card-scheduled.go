@@ -0,0 +1,642 @@
+package card
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+)
+
+//intervals a scheduled charge can repeat on
+const (
+	scheduleIntervalWeekly  = "weekly"
+	scheduleIntervalMonthly = "monthly"
+	scheduleIntervalCustom  = "custom"
+)
+
+//statuses of a run of a scheduled charge
+const (
+	scheduleRunPending   = "pending"
+	scheduleRunSucceeded = "succeeded"
+	scheduleRunFailed    = "failed"
+)
+
+//scheduleDateFormat is the format of the dates of a scheduled charge
+const scheduleDateFormat = "2006-01-02"
+
+//maxScheduleIntervalDays is the most days allowed between charges for a custom interval
+const maxScheduleIntervalDays = 366
+
+//maxCatchUpRuns is the most missed dates of one schedule that are charged each time the scheduler runs
+//Dates are missed if the scheduler wasn't run for a while.  This stops a schedule from charging a card
+//many times at once, the remaining dates are charged the next time the scheduler runs.
+const maxCatchUpRuns = 12
+
+//numRecentRuns is the number of runs shown with each scheduled charge
+const numRecentRuns = 10
+
+//staleRunAfter is how long a run can be pending before we assume the server charging it stopped
+//a charge takes seconds so a run pending this long was interrupted, not still running
+const staleRunAfter = 1 * time.Hour
+
+//scheduledChargeUser is the user saved as processing charges made by the scheduler
+const scheduledChargeUser = "scheduler"
+
+//scheduled charge errors
+var (
+	errScheduledChargeNotFound      = errors.New("card: scheduled charge not found")
+	errScheduledChargeRunExists     = errors.New("card: scheduled charge run already exists")
+	errScheduledChargeRunNotFound   = errors.New("card: scheduled charge run not found")
+	errScheduledChargeRunInProgress = errors.New("card: scheduled charge run in progress")
+	errScheduledChargeMoved         = errors.New("card: scheduled charge was moved to another date")
+	errInvalidScheduleInterval      = errors.New("card: invalid schedule interval")
+	errInvalidScheduleDate          = errors.New("card: invalid schedule date")
+	errScheduleEnded                = errors.New("card: schedule ended")
+)
+
+//scheduledChargeDetails is a scheduled charge and the details shown with it in the gui
+type scheduledChargeDetails struct {
+	ScheduledCharge
+	Amount string               `json:"amount"` //the amount formatted with the currency's decimal places
+	Card   SavedCard            `json:"card"`   //the card that is charged, blank if the card was removed
+	Runs   []ScheduledChargeRun `json:"runs"`   //the most recent runs, newest first
+}
+
+//ScheduledCharges returns the scheduled charges of a customer and each one's recent runs
+func ScheduledCharges(w http.ResponseWriter, r *http.Request) {
+	datastoreID, _ := strconv.ParseInt(r.FormValue("customerId"), 10, 64)
+	if datastoreID == 0 {
+		output.Error(errMissingInput, "A customer ID should have been submitted automatically but was not. Please contact an administrator.", w)
+		return
+	}
+
+	c := r.Context()
+	customer, err := findByDatastoreID(c, datastoreID)
+	if err != nil {
+		output.Error(err, "Could not find this customer's data.", w)
+		return
+	}
+
+	cards, err := FindCards(c, customer)
+	if err != nil {
+		output.Error(err, "Could not look up this customer's cards.", w)
+		return
+	}
+
+	schedules, err := store.FindScheduledCharges(c, datastoreID)
+	if err != nil {
+		output.Error(err, "Could not look up this customer's scheduled charges.", w)
+		return
+	}
+
+	details := []scheduledChargeDetails{}
+	for _, s := range schedules {
+		runs, err := store.FindScheduledChargeRuns(c, s.ID, numRecentRuns)
+		if err != nil {
+			output.Error(err, "Could not look up the charges made by a schedule.", w)
+			return
+		}
+
+		d := scheduledChargeDetails{
+			ScheduledCharge: s,
+			Amount:          FormatAmount(s.AmountCents, s.Currency),
+			Runs:            runs,
+		}
+		if s.SavedCardID != 0 {
+			d.Card, _ = selectCard(cards, s.SavedCardID, "")
+		}
+
+		details = append(details, d)
+	}
+
+	output.Success("scheduledCharges", details, w)
+}
+
+//AddScheduledCharge saves a new scheduled charge for a customer
+//The first charge is made on the start date.  Dates are in the timezone set in the app settings.
+//If no card is chosen the customer's default card at the time of each charge is charged.
+func AddScheduledCharge(w http.ResponseWriter, r *http.Request) {
+	//get inputs
+	datastoreID, _ := strconv.ParseInt(r.FormValue("customerId"), 10, 64)
+	cardID, _ := strconv.ParseInt(r.FormValue("cardId"), 10, 64) //0 to charge the default card
+	amount := r.FormValue("amount")
+	currency := r.FormValue("currency")
+	interval := strings.ToLower(r.FormValue("interval"))
+	intervalDays, _ := strconv.ParseInt(r.FormValue("intervalDays"), 10, 64)
+	startDate := strings.TrimSpace(r.FormValue("startDate"))
+	endDate := strings.TrimSpace(r.FormValue("endDate"))
+	invoice := strings.TrimSpace(r.FormValue("invoice"))
+	po := strings.TrimSpace(r.FormValue("po"))
+
+	//validation
+	if datastoreID == 0 {
+		output.Error(errMissingInput, "A customer ID should have been submitted automatically but was not. Please contact an administrator.", w)
+		return
+	}
+	if len(amount) == 0 {
+		output.Error(errMissingInput, "No amount was provided. You cannot charge a card nothing!", w)
+		return
+	}
+
+	switch interval {
+	case scheduleIntervalWeekly, scheduleIntervalMonthly:
+		intervalDays = 0
+	case scheduleIntervalCustom:
+		if intervalDays < 1 || intervalDays > maxScheduleIntervalDays {
+			output.Error(errInvalidScheduleInterval, "The number of days between charges must be between 1 and "+strconv.Itoa(maxScheduleIntervalDays)+".", w)
+			return
+		}
+	default:
+		output.Error(errInvalidScheduleInterval, "The interval must be weekly, monthly, or custom.", w)
+		return
+	}
+
+	guiLoc, _ := guiTimezone(r)
+	today := time.Now().In(guiLoc).Format(scheduleDateFormat)
+	if _, err := time.Parse(scheduleDateFormat, startDate); err != nil {
+		output.Error(errInvalidScheduleDate, "The start date must be a date in the format yyyy-mm-dd.", w)
+		return
+	}
+	if startDate < today {
+		output.Error(errInvalidScheduleDate, "The start date cannot be in the past.", w)
+		return
+	}
+	if endDate != "" {
+		if _, err := time.Parse(scheduleDateFormat, endDate); err != nil {
+			output.Error(errInvalidScheduleDate, "The end date must be a date in the format yyyy-mm-dd.", w)
+			return
+		}
+		if endDate < startDate {
+			output.Error(errInvalidScheduleDate, "The end date cannot be before the start date.", w)
+			return
+		}
+	}
+
+	//look up the customer and card
+	c := r.Context()
+	customer, err := findByDatastoreID(c, datastoreID)
+	if err != nil {
+		output.Error(err, "An error occured while looking up the customer's Stripe information.", w)
+		return
+	}
+
+	if cardID != 0 {
+		cards, err := FindCards(c, customer)
+		if err != nil {
+			output.Error(err, "An error occured while looking up the customer's cards.", w)
+			return
+		}
+		_, err = selectCard(cards, cardID, "")
+		if err != nil {
+			output.Error(err, "Could not find the chosen card for this customer. Please refresh the page and try again.", w)
+			return
+		}
+	}
+
+	//get the currency and amount to charge
+	currency, err = ChargeCurrency(r, currency, customer)
+	if err != nil {
+		output.Error(err, "The currency must be a three letter currency code, i.e.: USD.", w)
+		return
+	}
+
+	amountCents, err := getAmountAsIntCents(amount, currency)
+	if err != nil {
+		output.Error(err, amountErrorMessage(err, currency), w)
+		return
+	}
+	if amountCents == 0 {
+		output.Error(errMissingInput, "The amount must be a number greater than zero.", w)
+		return
+	}
+
+	//save the schedule
+	s := ScheduledCharge{
+		CustomerDatastoreID: datastoreID,
+		SavedCardID:         cardID,
+		AmountCents:         int64(amountCents),
+		Currency:            currency,
+		Interval:            interval,
+		IntervalDays:        intervalDays,
+		StartDate:           startDate,
+		EndDate:             endDate,
+		InvoiceTemplate:     invoice,
+		PoTemplate:          po,
+		NextRunDate:         startDate,
+		Active:              true,
+		DatetimeCreated:     timestamps.ISO8601(),
+		CreatedByUser:       sessionutils.GetUsername(r),
+	}
+	s.ID, err = store.AddScheduledCharge(c, s)
+	if err != nil {
+		output.Error(err, "There was an error while saving this scheduled charge. Please try again.", w)
+		return
+	}
+
+	output.Success("scheduledChargeAdded", s, w)
+}
+
+//PauseScheduledCharge stops a scheduled charge from charging the card until it is resumed
+func PauseScheduledCharge(w http.ResponseWriter, r *http.Request) {
+	setScheduledChargeActive(w, r, false)
+}
+
+//ResumeScheduledCharge starts charging a paused scheduled charge again
+//Dates that were missed while the schedule was paused are skipped, the next charge is made on the
+//next date in the schedule from today.
+func ResumeScheduledCharge(w http.ResponseWriter, r *http.Request) {
+	setScheduledChargeActive(w, r, true)
+}
+
+//setScheduledChargeActive pauses or resumes a scheduled charge
+func setScheduledChargeActive(w http.ResponseWriter, r *http.Request, active bool) {
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if id == 0 {
+		output.Error(errMissingInput, "A scheduled charge ID should have been submitted automatically but was not. Please contact an administrator.", w)
+		return
+	}
+
+	c := r.Context()
+	s, err := store.FindScheduledCharge(c, id)
+	if err != nil {
+		output.Error(err, "Could not find this scheduled charge.", w)
+		return
+	}
+
+	if active {
+		//make sure the card still exists so the next charge doesn't just fail
+		customer, err := findByDatastoreID(c, s.CustomerDatastoreID)
+		if err != nil {
+			output.Error(err, "Could not find this customer's data.", w)
+			return
+		}
+		cards, err := FindCards(c, customer)
+		if err != nil {
+			output.Error(err, "Could not look up this customer's cards.", w)
+			return
+		}
+		if _, err := selectCard(cards, s.SavedCardID, ""); err != nil {
+			output.Error(err, "The card for this schedule was removed. Please remove this schedule and add a new one with another card.", w)
+			return
+		}
+
+		//skip dates that were missed while paused
+		guiLoc, _ := guiTimezone(r)
+		yesterday := time.Now().In(guiLoc).AddDate(0, 0, -1).Format(scheduleDateFormat)
+		if s.NextRunDate == "" || s.NextRunDate <= yesterday {
+			s.NextRunDate, err = nextScheduledRunDate(s, yesterday)
+			if err != nil {
+				output.Error(err, "Could not calculate the date of the next charge.", w)
+				return
+			}
+		}
+		if s.NextRunDate == "" {
+			output.Error(errScheduleEnded, "This schedule has ended, there are no more dates to charge.", w)
+			return
+		}
+	}
+
+	s.Active = active
+	err = store.UpdateScheduledCharge(c, s)
+	if err != nil {
+		output.Error(err, "There was an error while saving this scheduled charge. Please try again.", w)
+		return
+	}
+
+	output.Success("scheduledChargeUpdated", s, w)
+}
+
+//RemoveScheduledCharge deletes a scheduled charge
+//charges that were already made are not refunded and are still shown in the reports
+func RemoveScheduledCharge(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if id == 0 {
+		output.Error(errMissingInput, "A scheduled charge ID should have been submitted automatically but was not. Please contact an administrator.", w)
+		return
+	}
+
+	err := store.RemoveScheduledCharge(r.Context(), id)
+	if err != nil {
+		output.Error(err, "There was an error while removing this scheduled charge. Please try again.", w)
+		return
+	}
+
+	output.Success("scheduledChargeRemoved", nil, w)
+}
+
+//RunScheduledCharges charges every scheduled charge that is due
+//This is designed to be run by cron, hourly, so charges are made early on the day they are due.
+//Running this more than once, or on more than one server at once, never charges the same date of
+//a schedule twice.
+func RunScheduledCharges(w http.ResponseWriter, r *http.Request) {
+	succeeded, failed, err := runDueScheduledCharges(r)
+	if err != nil {
+		output.Error(err, "Could not look up the scheduled charges that are due.", w)
+		return
+	}
+
+	output.Success("scheduledChargesRun", map[string]int{"succeeded": succeeded, "failed": failed}, w)
+}
+
+//RunScheduledChargesEvery runs the scheduled charges that are due on an interval
+//This is used when the app isn't deployed on appengine so schedules are charged without having to
+//set up cron.  This blocks so it should be run in a goroutine.
+func RunScheduledChargesEvery(d time.Duration) {
+	log.Println("card.RunScheduledChargesEvery: Running scheduled charges every", d)
+
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for range t.C {
+		//settings and company info are looked up from a request so build one
+		r, err := http.NewRequest("GET", "/cron/run-scheduled-charges/", nil)
+		if err != nil {
+			log.Println("card.RunScheduledChargesEvery: Could not build request.", err)
+			continue
+		}
+
+		succeeded, failed, err := runDueScheduledCharges(r)
+		if err != nil {
+			log.Println("card.RunScheduledChargesEvery: Could not run scheduled charges.", err)
+			continue
+		}
+		if succeeded > 0 || failed > 0 {
+			log.Println("card.RunScheduledChargesEvery:", succeeded, "succeeded,", failed, "failed")
+		}
+	}
+}
+
+//runDueScheduledCharges charges every scheduled charge whose next run date is today or earlier
+//An error charging one schedule is recorded on its run and the other schedules are still charged.
+//The number of runs that succeeded and failed is returned.
+func runDueScheduledCharges(r *http.Request) (succeeded, failed int, err error) {
+	guiLoc, _ := guiTimezone(r)
+	today := time.Now().In(guiLoc).Format(scheduleDateFormat)
+
+	schedules, err := store.FindDueScheduledCharges(r.Context(), today)
+	if err != nil {
+		return
+	}
+
+	for _, s := range schedules {
+		for i := 0; i < maxCatchUpRuns && s.Active && s.NextRunDate != "" && s.NextRunDate <= today; i++ {
+			run, err := runScheduledCharge(r, &s)
+			if err == errScheduledChargeRunInProgress || err == errScheduledChargeMoved {
+				break
+			} else if err != nil {
+				log.Println("card.runDueScheduledCharges - could not run scheduled charge", s.ID, s.NextRunDate, err)
+				break
+			}
+
+			if run.Status == scheduleRunSucceeded {
+				succeeded++
+			} else {
+				failed++
+			}
+		}
+	}
+
+	log.Println("card.runDueScheduledCharges...done", succeeded, "succeeded,", failed, "failed")
+	return succeeded, failed, nil
+}
+
+//runScheduledCharge charges the next run date of a scheduled charge and moves the schedule to the
+//following date
+//The run is saved before charging so the same date can't be charged twice.  If a run already
+//exists for the date, the schedule wasn't moved to the next date after that run finished so the
+//schedule is just moved forward.  errScheduledChargeRunInProgress is returned if another server is
+//charging the date right now and errScheduledChargeMoved is returned if another server already moved
+//the schedule past the date.
+func runScheduledCharge(r *http.Request, s *ScheduledCharge) (ScheduledChargeRun, error) {
+	c := r.Context()
+	runDate := s.NextRunDate
+
+	run := ScheduledChargeRun{
+		ScheduledChargeID: s.ID,
+		RunDate:           runDate,
+		Status:            scheduleRunPending,
+		AmountCents:       s.AmountCents,
+		Currency:          s.Currency,
+		Invoice:           fillScheduleTemplate(s.InvoiceTemplate, runDate, s.RunCount+1),
+		Po:                fillScheduleTemplate(s.PoTemplate, runDate, s.RunCount+1),
+		IdempotencyKey:    "scheduled-charge--" + strconv.FormatInt(s.ID, 10) + "--" + runDate,
+		DatetimeStarted:   timestamps.ISO8601(),
+	}
+
+	pause := false
+	err := store.AddScheduledChargeRun(c, run)
+	if err == errScheduledChargeRunExists {
+		run, err = store.FindScheduledChargeRun(c, s.ID, runDate)
+		if err != nil {
+			return run, err
+		}
+
+		if run.Status == scheduleRunPending {
+			started, err := time.Parse(time.RFC3339, run.DatetimeStarted)
+			if err == nil && time.Since(started) < staleRunAfter {
+				return run, errScheduledChargeRunInProgress
+			}
+
+			//we don't know if the card was charged so don't try again
+			run.Status = scheduleRunFailed
+			run.Error = "The scheduler stopped before this charge finished. Please check the Report to see if this charge was successful."
+			run.DatetimeFinished = timestamps.ISO8601()
+			err = store.UpdateScheduledChargeRun(c, run)
+			if err != nil {
+				return run, err
+			}
+		}
+	} else if err != nil {
+		return run, err
+	} else {
+		pause = chargeScheduledRun(r, *s, &run)
+
+		run.DatetimeFinished = timestamps.ISO8601()
+		err = store.UpdateScheduledChargeRun(c, run)
+		if err != nil {
+			log.Println("card.runScheduledCharge - could not save run", s.ID, runDate, err)
+		}
+	}
+
+	//move the schedule to the next date
+	//the schedule is moved forward even if the charge failed so a declined card isn't charged
+	//again and again, failed runs are shown in the gui
+	//s was looked up before the run was saved so the schedule is only moved if it is still on
+	//this date, otherwise another server already moved it
+	next, err := nextScheduledRunDate(*s, runDate)
+	if err != nil {
+		return run, err
+	}
+
+	moved := *s
+	moved.LastRunDate = runDate
+	moved.LastRunStatus = run.Status
+	moved.NextRunDate = next
+	if next == "" || pause {
+		moved.Active = false
+	}
+
+	err = store.AdvanceScheduledCharge(c, moved, runDate)
+	if err != nil {
+		return run, err
+	}
+
+	moved.RunCount++
+	*s = moved
+	return run, nil
+}
+
+//chargeScheduledRun charges the card for one run of a scheduled charge
+//The outcome is saved to the run.  True is returned if the schedule should be paused because the
+//card it charges was removed.
+func chargeScheduledRun(r *http.Request, s ScheduledCharge, run *ScheduledChargeRun) (pause bool) {
+	run.Status = scheduleRunFailed
+
+	//need to adjust deadline in case stripe takes longer than 5 seconds
+	c, cancelFunc := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancelFunc()
+
+	customer, err := findByDatastoreID(c, s.CustomerDatastoreID)
+	if err != nil {
+		log.Println("card.chargeScheduledRun - could not find customer", s.CustomerDatastoreID, err)
+		run.Error = "Could not look up the customer's Stripe information."
+		return
+	}
+
+	cards, err := FindCards(c, customer)
+	if err != nil {
+		log.Println("card.chargeScheduledRun - could not find cards", s.CustomerDatastoreID, err)
+		run.Error = "Could not look up the customer's cards."
+		return
+	}
+	card, err := selectCard(cards, s.SavedCardID, "")
+	if err != nil {
+		run.Error = "The card for this schedule was removed so the schedule was paused."
+		return true
+	}
+
+	inputs := processChargeInputs{
+		context:              c,
+		amountCents:          uint64(s.AmountCents),
+		currency:             s.Currency,
+		invoiceNum:           run.Invoice,
+		poNum:                run.Po,
+		customerData:         customer,
+		cardData:             card,
+		userProcessingCharge: scheduledChargeUser,
+		autoChargeReferrer:   "scheduled charge",
+		autoChargeReason:     "schedule " + strconv.FormatInt(s.ID, 10) + " for " + run.RunDate,
+		idempotencyKey:       run.IdempotencyKey,
+	}
+	out, errMsg, err := processCharge(inputs)
+	if err != nil {
+		log.Println("card.chargeScheduledRun - charge failed", s.ID, run.RunDate, err)
+		run.Error = errMsg
+		if run.Error == "" {
+			run.Error = err.Error()
+		}
+		return
+	}
+
+	run.Status = scheduleRunSucceeded
+	run.ChargeID = out.ChargeID
+
+	//email the receipt to the customer's billing email
+	//a failed email is logged on the charge and doesn't fail the run
+	emailReceipt(r, out.ChargeID, nil, nil, customer)
+	return
+}
+
+//nextScheduledRunDate returns the first date of a schedule after a given yyyy-mm-dd date
+//Dates are counted from the start date so a monthly schedule that starts on the 31st is charged on
+//the last day of shorter months and on the 31st again in longer months.  A blank date is
+//returned if the schedule ends before the next date.
+func nextScheduledRunDate(s ScheduledCharge, after string) (string, error) {
+	start, err := time.Parse(scheduleDateFormat, s.StartDate)
+	if err != nil {
+		return "", errInvalidScheduleDate
+	}
+	a, err := time.Parse(scheduleDateFormat, after)
+	if err != nil {
+		return "", errInvalidScheduleDate
+	}
+
+	next := start
+	if !a.Before(start) {
+		switch s.Interval {
+		case scheduleIntervalMonthly:
+			months := (a.Year()-start.Year())*12 + int(a.Month()) - int(start.Month())
+			next = addMonths(start, months)
+			if !next.After(a) {
+				next = addMonths(start, months+1)
+			}
+
+		case scheduleIntervalWeekly, scheduleIntervalCustom:
+			days := 7
+			if s.Interval == scheduleIntervalCustom {
+				days = int(s.IntervalDays)
+			}
+			if days < 1 {
+				return "", errInvalidScheduleInterval
+			}
+
+			elapsed := int(a.Sub(start).Hours() / 24)
+			next = start.AddDate(0, 0, (elapsed/days+1)*days)
+
+		default:
+			return "", errInvalidScheduleInterval
+		}
+	}
+
+	date := next.Format(scheduleDateFormat)
+	if s.EndDate != "" && date > s.EndDate {
+		return "", nil
+	}
+
+	return date, nil
+}
+
+//addMonths adds months to a date
+//the day is moved to the last day of the month if the month is shorter, Jan 31 plus one month is
+//Feb 28 instead of Mar 3
+func addMonths(t time.Time, months int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+
+	lastDay := first.AddDate(0, 1, -1).Day()
+	if d > lastDay {
+		d = lastDay
+	}
+
+	return time.Date(first.Year(), first.Month(), d, 0, 0, 0, 0, time.UTC)
+}
+
+//fillScheduleTemplate fills in the placeholders in an invoice or po template for a run
+//{date} is the yyyy-mm-dd date of the run, {year}, {month}, {month_name}, and {day} are parts of the
+//date, and {run} is the number of the charge starting at 1.  Ex: "INV-{year}{month}" is "INV-202610".
+func fillScheduleTemplate(template, runDate string, runNumber int64) string {
+	if template == "" {
+		return ""
+	}
+
+	d, err := time.Parse(scheduleDateFormat, runDate)
+	if err != nil {
+		return template
+	}
+
+	replacer := strings.NewReplacer(
+		"{date}", runDate,
+		"{year}", d.Format("2006"),
+		"{month}", d.Format("01"),
+		"{month_name}", d.Format("January"),
+		"{day}", d.Format("02"),
+		"{run}", strconv.FormatInt(runNumber, 10),
+	)
+	return replacer.Replace(template)
+}
@@ -0,0 +1,101 @@
+package card
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddMonths(t *testing.T) {
+	tests := []struct {
+		date   string
+		months int
+		want   string
+	}{
+		{"2026-01-15", 1, "2026-02-15"},
+		{"2026-01-31", 1, "2026-02-28"},
+		{"2028-01-31", 1, "2028-02-29"},
+		{"2026-01-31", 2, "2026-03-31"},
+		{"2026-03-31", 1, "2026-04-30"},
+		{"2026-11-30", 3, "2027-02-28"},
+		{"2026-12-31", 1, "2027-01-31"},
+		{"2026-05-31", 12, "2027-05-31"},
+		{"2026-05-31", 0, "2026-05-31"},
+	}
+
+	for _, tt := range tests {
+		d, err := time.Parse(scheduleDateFormat, tt.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := addMonths(d, tt.months).Format(scheduleDateFormat)
+		if got != tt.want {
+			t.Errorf("addMonths(%s, %d) = %s, want %s", tt.date, tt.months, got, tt.want)
+		}
+	}
+}
+
+func TestNextScheduledRunDate(t *testing.T) {
+	monthly31 := ScheduledCharge{Interval: scheduleIntervalMonthly, StartDate: "2026-01-31"}
+	weekly := ScheduledCharge{Interval: scheduleIntervalWeekly, StartDate: "2026-10-01"}
+	custom := ScheduledCharge{Interval: scheduleIntervalCustom, IntervalDays: 10, StartDate: "2026-10-01"}
+	ending := ScheduledCharge{Interval: scheduleIntervalMonthly, StartDate: "2026-10-15", EndDate: "2026-12-15"}
+
+	tests := []struct {
+		name    string
+		s       ScheduledCharge
+		after   string
+		want    string
+		wantErr error
+	}{
+		{"before start", monthly31, "2026-01-01", "2026-01-31", nil},
+		{"month end to february", monthly31, "2026-01-31", "2026-02-28", nil},
+		{"back to the 31st after february", monthly31, "2026-02-28", "2026-03-31", nil},
+		{"month end to 30 day month", monthly31, "2026-03-31", "2026-04-30", nil},
+		{"leap year", ScheduledCharge{Interval: scheduleIntervalMonthly, StartDate: "2028-01-31"}, "2028-01-31", "2028-02-29", nil},
+		{"mid month", monthly31, "2026-05-15", "2026-05-31", nil},
+		{"over the year", monthly31, "2026-12-31", "2027-01-31", nil},
+		{"weekly", weekly, "2026-10-01", "2026-10-08", nil},
+		{"weekly between dates", weekly, "2026-10-10", "2026-10-15", nil},
+		{"custom", custom, "2026-10-01", "2026-10-11", nil},
+		{"custom between dates", custom, "2026-10-12", "2026-10-21", nil},
+		{"last date before end", ending, "2026-11-15", "2026-12-15", nil},
+		{"after end", ending, "2026-12-15", "", nil},
+		{"invalid custom interval", ScheduledCharge{Interval: scheduleIntervalCustom, StartDate: "2026-10-01"}, "2026-10-01", "", errInvalidScheduleInterval},
+		{"unknown interval", ScheduledCharge{Interval: "yearly", StartDate: "2026-10-01"}, "2026-10-01", "", errInvalidScheduleInterval},
+		{"invalid start", ScheduledCharge{Interval: scheduleIntervalWeekly, StartDate: "10/01/2026"}, "2026-10-01", "", errInvalidScheduleDate},
+		{"invalid after", weekly, "", "", errInvalidScheduleDate},
+	}
+
+	for _, tt := range tests {
+		got, err := nextScheduledRunDate(tt.s, tt.after)
+		if err != tt.wantErr {
+			t.Errorf("%s: nextScheduledRunDate() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: nextScheduledRunDate(%s) = %q, want %q", tt.name, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestFillScheduleTemplate(t *testing.T) {
+	tests := []struct {
+		template  string
+		runDate   string
+		runNumber int64
+		want      string
+	}{
+		{"INV-{year}{month}", "2026-10-05", 1, "INV-202610"},
+		{"{month_name} {day} #{run}", "2026-03-09", 12, "March 09 #12"},
+		{"{date}", "2026-10-05", 1, "2026-10-05"},
+		{"PO-1", "2026-10-05", 1, "PO-1"},
+		{"", "2026-10-05", 1, ""},
+	}
+
+	for _, tt := range tests {
+		if got := fillScheduleTemplate(tt.template, tt.runDate, tt.runNumber); got != tt.want {
+			t.Errorf("fillScheduleTemplate(%q, %s, %d) = %q, want %q", tt.template, tt.runDate, tt.runNumber, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1057 @@
+package card
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+
+	"cloud.google.com/go/datastore"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
+	"google.golang.org/api/iterator"
+)
+
+//datastoreStore saves and retrieves cards from the google cloud datastore
+type datastoreStore struct{}
+
+//NewDatastoreStore returns a Store that uses the google cloud datastore
+func NewDatastoreStore() Store {
+	return datastoreStore{}
+}
+
+//GetAll returns the datastore id and customer name for every card
+//only need to get entity keys and customer names which cuts down on datastore usage
+func (s datastoreStore) GetAll(ctx context.Context) ([]List, error) {
+	list := []List{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return list, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityCards).Order("CustomerName").Project("CustomerName")
+	i := client.Run(ctx, q)
+	for {
+		one := CustomerDatastore{}
+		key, err := i.Next(&one)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return list, err
+		}
+
+		l := List{
+			CustomerName: one.CustomerName,
+			ID:           key.ID,
+		}
+		list = append(list, l)
+	}
+
+	return list, nil
+}
+
+//FindAll returns the full data for every card
+func (s datastoreStore) FindAll(ctx context.Context) ([]CustomerDatastore, error) {
+	cards := []CustomerDatastore{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return cards, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityCards)
+	i := client.Run(ctx, q)
+	for {
+		customer := CustomerDatastore{}
+		key, err := i.Next(&customer)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return cards, err
+		}
+
+		customer.ID = key.ID
+		cards = append(cards, customer)
+	}
+
+	return cards, nil
+}
+
+//FindByID looks up a card by its datastore id
+func (s datastoreStore) FindByID(ctx context.Context, datastoreID int64) (CustomerDatastore, error) {
+	data := CustomerDatastore{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return data, err
+	}
+
+	key := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, datastoreID)
+	err = client.Get(ctx, key, &data)
+
+	//save the datastore id into the return value so we can use it elsewhere
+	//cloud datastore doesn't have an "ID" field like a SQL table so this value isn't returned in a query
+	data.ID = datastoreID
+	return data, err
+}
+
+//FindByCustomerID looks up a card by the id from a CRM system
+//only getting the fields we need to show data in the charge card panel
+func (s datastoreStore) FindByCustomerID(ctx context.Context, customerID string) (CustomerDatastore, error) {
+	data := CustomerDatastore{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return data, err
+	}
+
+	//look up the key and then get the full entity
+	//a projection query would skip customers saved before a projected field existed (Currency)
+	q := datastore.NewQuery(datastoreutils.EntityCards).Filter("CustomerId =", customerID).Limit(1).KeysOnly()
+	keys, err := client.GetAll(ctx, q, nil)
+	if err != nil {
+		log.Println("card.FindByCustomerID-1", err)
+		return data, err
+	}
+
+	//check if no results were found
+	if len(keys) == 0 {
+		return data, errCustomerNotFound
+	}
+
+	err = client.Get(ctx, keys[0], &data)
+	if err != nil {
+		log.Println("card.FindByCustomerID-2", err)
+		return data, err
+	}
+
+	//save the datastore id into the return value so we can use it elsewhere
+	data.ID = keys[0].ID
+
+	return data, nil
+}
+
+//Add saves a new card to the cloud datastore
+func (s datastoreStore) Add(ctx context.Context, customer CustomerDatastore) (int64, error) {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	key := datastoreutils.GetNewIncompleteKey(datastoreutils.EntityCards)
+	completeKey, err := client.Put(ctx, key, &customer)
+	if err != nil {
+		return 0, err
+	}
+
+	return completeKey.ID, nil
+}
+
+//UpdateLastUsed sets the LastUsedTimestamp for a card
+//look up card info first since datastore can't do updates
+func (s datastoreStore) UpdateLastUsed(ctx context.Context, datastoreID, timestamp int64) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	fullKey := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, datastoreID)
+	cardData := CustomerDatastore{}
+	err = client.Get(ctx, fullKey, &cardData)
+	if err != nil {
+		return err
+	}
+
+	cardData.LastUsedTimestamp = timestamp
+	_, err = client.Put(ctx, fullKey, &cardData)
+	return err
+}
+
+//UpdateBillingEmail sets the email address of a customer's billing contact
+func (s datastoreStore) UpdateBillingEmail(ctx context.Context, datastoreID int64, billingEmail string) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	fullKey := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, datastoreID)
+	cardData := CustomerDatastore{}
+	err = client.Get(ctx, fullKey, &cardData)
+	if err != nil {
+		return err
+	}
+
+	cardData.BillingEmail = billingEmail
+	_, err = client.Put(ctx, fullKey, &cardData)
+	return err
+}
+
+//Remove deletes a card and the customer's saved cards and scheduled charges from the cloud datastore
+func (s datastoreStore) Remove(ctx context.Context, datastoreID int64) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntitySavedCards).Filter("CustomerDatastoreID =", datastoreID).KeysOnly()
+	keys, err := client.GetAll(ctx, q, nil)
+	if err != nil {
+		return err
+	}
+
+	q = datastore.NewQuery(datastoreutils.EntityScheduledCharges).Filter("CustomerDatastoreID =", datastoreID).KeysOnly()
+	scheduleKeys, err := client.GetAll(ctx, q, nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range scheduleKeys {
+		q = datastore.NewQuery(datastoreutils.EntityScheduledChargeRuns).Filter("ScheduledChargeID =", k.ID).KeysOnly()
+		runKeys, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, runKeys...)
+	}
+	keys = append(keys, scheduleKeys...)
+
+	completeKey := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, datastoreID)
+	keys = append(keys, completeKey)
+	return deleteKeys(ctx, client, keys)
+}
+
+//FindByExpiration returns the cards that expire on a given MM/YYYY
+//cant do keys only since we need Stripe token to remove card from stripe
+func (s datastoreStore) FindByExpiration(ctx context.Context, monthYear string) ([]CustomerDatastore, error) {
+	cards := []CustomerDatastore{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return cards, err
+	}
+
+	fields := []string{"StripeCustomerToken"}
+	q := datastore.NewQuery(datastoreutils.EntityCards).Filter("CardExpiration =", monthYear).Project(fields...)
+	i := client.Run(ctx, q)
+	for {
+		customer := CustomerDatastore{}
+		key, err := i.Next(&customer)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return cards, err
+		}
+
+		customer.ID = key.ID
+		cards = append(cards, customer)
+	}
+
+	return cards, nil
+}
+
+//FindUnused returns the cards that haven't been used since a given unix timestamp
+//Cards that were added to this app prior to the LastUsedTimestamp existing will always
+//have a zero value so these cards are returned as well, the same as with sqlite.
+func (s datastoreStore) FindUnused(ctx context.Context, minTimestamp int64) ([]CustomerDatastore, error) {
+	cards := []CustomerDatastore{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return cards, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityCards).Filter("LastUsedTimestamp <", minTimestamp)
+	i := client.Run(ctx, q)
+	for {
+		customer := CustomerDatastore{}
+		key, err := i.Next(&customer)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return cards, err
+		}
+
+		customer.ID = key.ID
+		cards = append(cards, customer)
+	}
+
+	return cards, nil
+}
+
+//FindSavedCards returns the cards saved for a customer, the default card first
+//the cards are sorted here instead of in the query so we don't need a composite index
+func (s datastoreStore) FindSavedCards(ctx context.Context, customerDatastoreID int64) ([]SavedCard, error) {
+	cards := []SavedCard{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return cards, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntitySavedCards).Filter("CustomerDatastoreID =", customerDatastoreID)
+	keys, err := client.GetAll(ctx, q, &cards)
+	if err != nil {
+		return cards, err
+	}
+
+	for i, k := range keys {
+		cards[i].ID = k.ID
+	}
+
+	sort.SliceStable(cards, func(i, j int) bool {
+		if cards[i].IsDefault != cards[j].IsDefault {
+			return cards[i].IsDefault
+		}
+		return cards[i].DatetimeCreated < cards[j].DatetimeCreated
+	})
+
+	return cards, nil
+}
+
+//AddSavedCard saves a new card for a customer to the cloud datastore
+func (s datastoreStore) AddSavedCard(ctx context.Context, c SavedCard) (int64, error) {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	key := datastoreutils.GetNewIncompleteKey(datastoreutils.EntitySavedCards)
+	completeKey, err := client.Put(ctx, key, &c)
+	if err != nil {
+		return 0, err
+	}
+
+	return completeKey.ID, nil
+}
+
+//UpdateDefaultCard marks a saved card as the default and copies its details to the customer
+//look up the cards and customer first since datastore can't do updates
+func (s datastoreStore) UpdateDefaultCard(ctx context.Context, c SavedCard) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		q := datastore.NewQuery(datastoreutils.EntitySavedCards).Filter("CustomerDatastoreID =", c.CustomerDatastoreID).KeysOnly()
+		keys, err := client.GetAll(ctx, q, nil)
+		if err != nil {
+			return err
+		}
+
+		cards := make([]SavedCard, len(keys))
+		err = tx.GetMulti(keys, cards)
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			cards[i].IsDefault = k.ID == c.ID
+		}
+		_, err = tx.PutMulti(keys, cards)
+		if err != nil {
+			return err
+		}
+
+		customerKey := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, c.CustomerDatastoreID)
+		customer := CustomerDatastore{}
+		err = tx.Get(customerKey, &customer)
+		if err != nil {
+			return err
+		}
+
+		customer.Cardholder = c.Cardholder
+		customer.CardExpiration = c.CardExpiration
+		customer.CardLast4 = c.CardLast4
+		_, err = tx.Put(customerKey, &customer)
+		return err
+	})
+	return err
+}
+
+//FindSavedCardByStripeID looks up a saved card by the id of the card on Stripe
+func (s datastoreStore) FindSavedCardByStripeID(ctx context.Context, stripeCardID string) (SavedCard, error) {
+	c := SavedCard{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return c, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntitySavedCards).Filter("StripeCardID =", stripeCardID).Limit(1)
+	cards := []SavedCard{}
+	keys, err := client.GetAll(ctx, q, &cards)
+	if err != nil {
+		return c, err
+	}
+	if len(keys) == 0 {
+		return c, errCardNotFound
+	}
+
+	c = cards[0]
+	c.ID = keys[0].ID
+	return c, nil
+}
+
+//UpdateSavedCard saves changes to a card's details to the cloud datastore
+//look up the card and customer first since datastore can't do updates
+func (s datastoreStore) UpdateSavedCard(ctx context.Context, c SavedCard) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		key := datastoreutils.GetKeyFromID(datastoreutils.EntitySavedCards, c.ID)
+		existing := SavedCard{}
+		err := tx.Get(key, &existing)
+		if err != nil {
+			return err
+		}
+
+		existing.StripeCardID = c.StripeCardID
+		existing.Cardholder = c.Cardholder
+		existing.CardExpiration = c.CardExpiration
+		existing.CardLast4 = c.CardLast4
+		existing.CardBrand = c.CardBrand
+		existing.DatetimeUpdated = c.DatetimeUpdated
+		existing.UpdatedByUser = c.UpdatedByUser
+		existing.PaymentType = c.PaymentType
+		existing.BankAccountStatus = c.BankAccountStatus
+		_, err = tx.Put(key, &existing)
+		if err != nil {
+			return err
+		}
+
+		if !c.IsDefault {
+			return nil
+		}
+
+		customerKey := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, c.CustomerDatastoreID)
+		customer := CustomerDatastore{}
+		err = tx.Get(customerKey, &customer)
+		if err != nil {
+			return err
+		}
+
+		customer.Cardholder = c.Cardholder
+		customer.CardExpiration = c.CardExpiration
+		customer.CardLast4 = c.CardLast4
+		_, err = tx.Put(customerKey, &customer)
+		return err
+	})
+	return err
+}
+
+//RemoveSavedCard deletes one saved card from the cloud datastore
+func (s datastoreStore) RemoveSavedCard(ctx context.Context, id int64) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	completeKey := datastoreutils.GetKeyFromID(datastoreutils.EntitySavedCards, id)
+	return client.Delete(ctx, completeKey)
+}
+
+//FindSavedCardsByExpiration returns the saved cards that expire on a given MM/YYYY
+func (s datastoreStore) FindSavedCardsByExpiration(ctx context.Context, monthYear string) ([]SavedCard, error) {
+	cards := []SavedCard{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return cards, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntitySavedCards).Filter("CardExpiration =", monthYear)
+	keys, err := client.GetAll(ctx, q, &cards)
+	if err != nil {
+		return cards, err
+	}
+
+	for i, k := range keys {
+		cards[i].ID = k.ID
+	}
+
+	return cards, nil
+}
+
+//SaveLedgerEntry saves a charge or refund to the ledger
+//the entity's key is the Stripe id so saving an entry again overwrites the existing entity
+func (s datastoreStore) SaveLedgerEntry(ctx context.Context, e LedgerEntry) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityLedger, e.StripeID)
+	_, err = client.Put(ctx, key, &e)
+	return err
+}
+
+//FindLedgerEntry looks up a ledger entry by its Stripe id
+func (s datastoreStore) FindLedgerEntry(ctx context.Context, stripeID string) (LedgerEntry, error) {
+	e := LedgerEntry{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return e, err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityLedger, stripeID)
+	err = client.Get(ctx, key, &e)
+	if err == datastore.ErrNoSuchEntity {
+		return e, errLedgerEntryNotFound
+	}
+
+	return e, err
+}
+
+//FindLedgerEntries returns the ledger entries matching a filter, oldest first
+//Entries created at the same time are sorted by their Stripe id so pages of entries don't overlap.
+//This requires the composite indexes on the ledger in index.yaml.
+func (s datastoreStore) FindLedgerEntries(ctx context.Context, f LedgerFilter) ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return entries, err
+	}
+
+	query := func() *datastore.Query {
+		q := datastore.NewQuery(datastoreutils.EntityLedger).Filter("Type =", f.Type)
+		if f.StripeCustomerToken != "" {
+			q = q.Filter("StripeCustomerToken =", f.StripeCustomerToken)
+		}
+		return q
+	}
+
+	//the datastore can't filter by "created after or created at the same time with a greater id"
+	//in one query, so get the rest of the entries created at the same time as the cursor's entry
+	//first and then the entries created after it
+	start := f.Start
+	if f.AfterStripeID != "" {
+		if f.AfterCreated >= f.Start && f.AfterCreated <= f.End {
+			q := query().Filter("Created =", f.AfterCreated).Filter("StripeID >", f.AfterStripeID).Order("StripeID")
+			if f.Limit > 0 {
+				q = q.Limit(f.Limit)
+			}
+
+			entries, err = appendLedgerEntries(ctx, client, q, entries)
+			if err != nil {
+				return entries, err
+			}
+		}
+
+		if f.AfterCreated >= start {
+			start = f.AfterCreated + 1
+		}
+	}
+
+	if f.Limit > 0 && len(entries) >= f.Limit {
+		return entries, nil
+	}
+
+	q := query().Filter("Created >=", start).Filter("Created <=", f.End).Order("Created").Order("StripeID")
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit - len(entries))
+	}
+
+	return appendLedgerEntries(ctx, client, q, entries)
+}
+
+//appendLedgerEntries runs a query on the ledger and adds the entries found to a list of entries
+func appendLedgerEntries(ctx context.Context, client *datastore.Client, q *datastore.Query, entries []LedgerEntry) ([]LedgerEntry, error) {
+	i := client.Run(ctx, q)
+	for {
+		e := LedgerEntry{}
+		_, err := i.Next(&e)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+//FindWebhookEvent looks up a handled webhook event by its Stripe id
+func (s datastoreStore) FindWebhookEvent(ctx context.Context, stripeEventID string) (WebhookEvent, error) {
+	e := WebhookEvent{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return e, err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityWebhookEvents, stripeEventID)
+	err = client.Get(ctx, key, &e)
+	if err == datastore.ErrNoSuchEntity {
+		return e, errWebhookEventNotFound
+	}
+
+	return e, err
+}
+
+//SaveWebhookEvent records that a webhook event was handled
+//the entity's key is the Stripe id so saving an event again overwrites the existing entity
+func (s datastoreStore) SaveWebhookEvent(ctx context.Context, e WebhookEvent) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityWebhookEvents, e.StripeEventID)
+	_, err = client.Put(ctx, key, &e)
+	return err
+}
+
+//maxDeleteMulti is the most entities the datastore allows to be deleted at once
+const maxDeleteMulti = 500
+
+//deleteKeys deletes entities in batches so more than maxDeleteMulti entities can be deleted
+func deleteKeys(ctx context.Context, client *datastore.Client, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteMulti {
+			n = maxDeleteMulti
+		}
+
+		err := client.DeleteMulti(ctx, keys[:n])
+		if err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+//FindScheduledCharges returns the scheduled charges for a customer from the cloud datastore
+func (s datastoreStore) FindScheduledCharges(ctx context.Context, customerDatastoreID int64) ([]ScheduledCharge, error) {
+	schedules := []ScheduledCharge{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return schedules, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityScheduledCharges).Filter("CustomerDatastoreID =", customerDatastoreID)
+	keys, err := client.GetAll(ctx, q, &schedules)
+	if err != nil {
+		return schedules, err
+	}
+
+	for i, k := range keys {
+		schedules[i].ID = k.ID
+	}
+
+	sort.SliceStable(schedules, func(i, j int) bool {
+		return schedules[i].DatetimeCreated < schedules[j].DatetimeCreated
+	})
+
+	return schedules, nil
+}
+
+//FindScheduledCharge looks up a scheduled charge by its id in the cloud datastore
+func (s datastoreStore) FindScheduledCharge(ctx context.Context, id int64) (ScheduledCharge, error) {
+	sc := ScheduledCharge{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return sc, err
+	}
+
+	key := datastoreutils.GetKeyFromID(datastoreutils.EntityScheduledCharges, id)
+	err = client.Get(ctx, key, &sc)
+	if err == datastore.ErrNoSuchEntity {
+		return sc, errScheduledChargeNotFound
+	}
+
+	sc.ID = id
+	return sc, err
+}
+
+//FindDueScheduledCharges returns the active scheduled charges that are due from the cloud datastore
+//only the next run date is filtered on so no composite index is needed, paused schedules are skipped here
+func (s datastoreStore) FindDueScheduledCharges(ctx context.Context, date string) ([]ScheduledCharge, error) {
+	due := []ScheduledCharge{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return due, err
+	}
+
+	schedules := []ScheduledCharge{}
+	q := datastore.NewQuery(datastoreutils.EntityScheduledCharges).Filter("NextRunDate <=", date)
+	keys, err := client.GetAll(ctx, q, &schedules)
+	if err != nil {
+		return due, err
+	}
+
+	for i, k := range keys {
+		if !schedules[i].Active || schedules[i].NextRunDate == "" {
+			continue
+		}
+
+		schedules[i].ID = k.ID
+		due = append(due, schedules[i])
+	}
+
+	return due, nil
+}
+
+//AddScheduledCharge saves a new scheduled charge to the cloud datastore
+func (s datastoreStore) AddScheduledCharge(ctx context.Context, sc ScheduledCharge) (int64, error) {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	key := datastoreutils.GetNewIncompleteKey(datastoreutils.EntityScheduledCharges)
+	completeKey, err := client.Put(ctx, key, &sc)
+	if err != nil {
+		return 0, err
+	}
+
+	return completeKey.ID, nil
+}
+
+//UpdateScheduledCharge saves changes to a scheduled charge in the cloud datastore
+func (s datastoreStore) UpdateScheduledCharge(ctx context.Context, sc ScheduledCharge) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromID(datastoreutils.EntityScheduledCharges, sc.ID)
+	_, err = client.Put(ctx, key, &sc)
+	return err
+}
+
+//AdvanceScheduledCharge moves a scheduled charge to its next run date in the cloud datastore
+//a transaction is used so the schedule isn't changed if another server already moved it, only the
+//fields the scheduler changes are saved so changes made in the gui aren't lost
+func (s datastoreStore) AdvanceScheduledCharge(ctx context.Context, sc ScheduledCharge, runDate string) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromID(datastoreutils.EntityScheduledCharges, sc.ID)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		existing := ScheduledCharge{}
+		err := tx.Get(key, &existing)
+		if err == datastore.ErrNoSuchEntity {
+			return errScheduledChargeNotFound
+		} else if err != nil {
+			return err
+		}
+		if existing.NextRunDate != runDate {
+			return errScheduledChargeMoved
+		}
+
+		existing.NextRunDate = sc.NextRunDate
+		existing.Active = existing.Active && sc.Active
+		existing.RunCount++
+		existing.LastRunDate = sc.LastRunDate
+		existing.LastRunStatus = sc.LastRunStatus
+
+		_, err = tx.Put(key, &existing)
+		return err
+	})
+	return err
+}
+
+//RemoveScheduledCharge deletes a scheduled charge and its runs from the cloud datastore
+func (s datastoreStore) RemoveScheduledCharge(ctx context.Context, id int64) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityScheduledChargeRuns).Filter("ScheduledChargeID =", id).KeysOnly()
+	keys, err := client.GetAll(ctx, q, nil)
+	if err != nil {
+		return err
+	}
+
+	keys = append(keys, datastoreutils.GetKeyFromID(datastoreutils.EntityScheduledCharges, id))
+	return deleteKeys(ctx, client, keys)
+}
+
+//scheduledChargeRunKey returns the key of the run of a scheduled charge for a date
+//the key is built from the schedule and date so a second run for the same date uses the same key
+func scheduledChargeRunKey(scheduledChargeID int64, runDate string) *datastore.Key {
+	return datastoreutils.GetKeyFromName(datastoreutils.EntityScheduledChargeRuns, strconv.FormatInt(scheduledChargeID, 10)+"-"+runDate)
+}
+
+//AddScheduledChargeRun records the start of a run in the cloud datastore
+//a transaction is used so two servers can't both save a run for the same date
+func (s datastoreStore) AddScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := scheduledChargeRunKey(run.ScheduledChargeID, run.RunDate)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		existing := ScheduledChargeRun{}
+		err := tx.Get(key, &existing)
+		if err == nil {
+			return errScheduledChargeRunExists
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err = tx.Put(key, &run)
+		return err
+	})
+	return err
+}
+
+//FindScheduledChargeRun looks up the run of a scheduled charge for a date in the cloud datastore
+func (s datastoreStore) FindScheduledChargeRun(ctx context.Context, scheduledChargeID int64, runDate string) (ScheduledChargeRun, error) {
+	run := ScheduledChargeRun{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return run, err
+	}
+
+	err = client.Get(ctx, scheduledChargeRunKey(scheduledChargeID, runDate), &run)
+	if err == datastore.ErrNoSuchEntity {
+		return run, errScheduledChargeRunNotFound
+	}
+
+	return run, err
+}
+
+//UpdateScheduledChargeRun saves the outcome of a run to the cloud datastore
+func (s datastoreStore) UpdateScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Put(ctx, scheduledChargeRunKey(run.ScheduledChargeID, run.RunDate), &run)
+	return err
+}
+
+//FindScheduledChargeRuns returns the most recent runs of a scheduled charge from the cloud datastore
+//runs are sorted here so no composite index is needed
+func (s datastoreStore) FindScheduledChargeRuns(ctx context.Context, scheduledChargeID int64, limit int) ([]ScheduledChargeRun, error) {
+	runs := []ScheduledChargeRun{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return runs, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityScheduledChargeRuns).Filter("ScheduledChargeID =", scheduledChargeID)
+	_, err = client.GetAll(ctx, q, &runs)
+	if err != nil {
+		return runs, err
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].RunDate > runs[j].RunDate
+	})
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	return runs, nil
+}
+
+//maxPutMulti is the most entities the datastore allows to be saved at once
+const maxPutMulti = 500
+
+//batchRowKey returns the key of a row of a batch
+//the key is built from the batch and row number so saving a row again replaces the row
+func batchRowKey(batchID string, rowNumber int) *datastore.Key {
+	return datastoreutils.GetKeyFromName(datastoreutils.EntityBatchRows, batchID+"-"+strconv.Itoa(rowNumber))
+}
+
+//AddBatchJob saves a batch and its rows to the cloud datastore before the rows are charged
+//A batch can have more rows than can be saved in one transaction so the rows are saved first and
+//the batch is saved last in a transaction.  Rows are only charged once their batch is saved.  If
+//the same file is saved twice at once the rows are saved twice but they are the same rows and each
+//row's idempotency key stops it from being charged twice.
+func (s datastoreStore) AddBatchJob(ctx context.Context, j BatchJob, rows []BatchRow) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityBatchJobs, j.BatchID)
+	err = client.Get(ctx, key, &BatchJob{})
+	if err == nil {
+		return errBatchJobExists
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > maxPutMulti {
+			n = maxPutMulti
+		}
+
+		keys := make([]*datastore.Key, n)
+		for i, row := range rows[:n] {
+			keys[i] = batchRowKey(row.BatchID, row.RowNumber)
+		}
+		_, err = client.PutMulti(ctx, keys, rows[:n])
+		if err != nil {
+			return err
+		}
+
+		rows = rows[n:]
+	}
+
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		err := tx.Get(key, &BatchJob{})
+		if err == nil {
+			return errBatchJobExists
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err = tx.Put(key, &j)
+		return err
+	})
+	return err
+}
+
+//FindBatchJob looks up a batch by its id in the cloud datastore
+func (s datastoreStore) FindBatchJob(ctx context.Context, batchID string) (BatchJob, error) {
+	j := BatchJob{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return j, err
+	}
+
+	err = client.Get(ctx, datastoreutils.GetKeyFromName(datastoreutils.EntityBatchJobs, batchID), &j)
+	if err == datastore.ErrNoSuchEntity {
+		return j, errBatchJobNotFound
+	}
+
+	return j, err
+}
+
+//FindUnfinishedBatchJobs returns the batches in the cloud datastore that still have rows to charge
+//batches are sorted here so no composite index is needed
+func (s datastoreStore) FindUnfinishedBatchJobs(ctx context.Context) ([]BatchJob, error) {
+	jobs := []BatchJob{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return jobs, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityBatchJobs).Filter("DatetimeFinished =", "")
+	_, err = client.GetAll(ctx, q, &jobs)
+	if err != nil {
+		return jobs, err
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].DatetimeStarted < jobs[j].DatetimeStarted
+	})
+	return jobs, nil
+}
+
+//FinishBatchJob notes that every row of a batch in the cloud datastore was charged or failed
+func (s datastoreStore) FinishBatchJob(ctx context.Context, batchID, datetimeFinished string) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityBatchJobs, batchID)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		j := BatchJob{}
+		err := tx.Get(key, &j)
+		if err == datastore.ErrNoSuchEntity {
+			return errBatchJobNotFound
+		} else if err != nil {
+			return err
+		}
+
+		j.DatetimeFinished = datetimeFinished
+		_, err = tx.Put(key, &j)
+		return err
+	})
+	return err
+}
+
+//FindBatchRows returns the rows of a batch from the cloud datastore in the order they are in the file
+//rows are sorted here so no composite index is needed
+func (s datastoreStore) FindBatchRows(ctx context.Context, batchID string) ([]BatchRow, error) {
+	rows := []BatchRow{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return rows, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityBatchRows).Filter("BatchID =", batchID)
+	_, err = client.GetAll(ctx, q, &rows)
+	if err != nil {
+		return rows, err
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].RowNumber < rows[j].RowNumber
+	})
+	return rows, nil
+}
+
+//StartBatchRow saves the status and start time of a row in the cloud datastore that is about to be
+//charged
+//a transaction is used so two servers never charge the same row
+func (s datastoreStore) StartBatchRow(ctx context.Context, row BatchRow) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := batchRowKey(row.BatchID, row.RowNumber)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		existing := BatchRow{}
+		err := tx.Get(key, &existing)
+		if err != nil {
+			return err
+		}
+		if existing.Status != batchRowPending {
+			return errBatchRowStarted
+		}
+
+		existing.Status = row.Status
+		existing.DatetimeStarted = row.DatetimeStarted
+		_, err = tx.Put(key, &existing)
+		return err
+	})
+	return err
+}
+
+//UpdateBatchRow saves the outcome of charging a row to the cloud datastore
+func (s datastoreStore) UpdateBatchRow(ctx context.Context, row BatchRow) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Put(ctx, batchRowKey(row.BatchID, row.RowNumber), &row)
+	return err
+}
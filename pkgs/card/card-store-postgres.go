@@ -0,0 +1,1120 @@
+package card
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/postgresutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//postgresStore saves and retrieves cards from a postgres db
+type postgresStore struct {
+	c *sqlx.DB
+}
+
+//NewPostgresStore returns a Store that uses the given postgres db connection
+func NewPostgresStore(c *sqlx.DB) Store {
+	return postgresStore{c: c}
+}
+
+//GetAll returns the datastore id and customer name for every card
+func (s postgresStore) GetAll(ctx context.Context) ([]List, error) {
+	list := []List{}
+	q := `
+		SELECT ID, CustomerName
+		FROM ` + postgresutils.TableCards + `
+		ORDER BY CustomerName
+	`
+	err := s.c.SelectContext(ctx, &list, q)
+	return list, err
+}
+
+//FindAll returns the full data for every card
+func (s postgresStore) FindAll(ctx context.Context) ([]CustomerDatastore, error) {
+	cards := []CustomerDatastore{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableCards + `
+		ORDER BY ID
+	`
+	err := s.c.SelectContext(ctx, &cards, q)
+	return cards, err
+}
+
+//FindByID looks up a card by its datastore id
+func (s postgresStore) FindByID(ctx context.Context, datastoreID int64) (CustomerDatastore, error) {
+	data := CustomerDatastore{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableCards + `
+		WHERE ID=$1
+	`
+	err := s.c.GetContext(ctx, &data, q, datastoreID)
+	return data, err
+}
+
+//FindByCustomerID looks up a card by the id from a CRM system
+func (s postgresStore) FindByCustomerID(ctx context.Context, customerID string) (CustomerDatastore, error) {
+	data := CustomerDatastore{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableCards + `
+		WHERE CustomerID=$1
+		LIMIT 1
+	`
+	err := s.c.GetContext(ctx, &data, q, customerID)
+	if err == sql.ErrNoRows {
+		return data, errCustomerNotFound
+	}
+
+	return data, err
+}
+
+//Add saves a new card to the postgres db
+//postgres doesn't support LastInsertId so the new id is returned from the insert
+func (s postgresStore) Add(ctx context.Context, d CustomerDatastore) (int64, error) {
+	q := `
+		INSERT INTO ` + postgresutils.TableCards + ` (
+			CustomerID,
+			CustomerName,
+			Cardholder,
+			CardExpiration,
+			CardLast4,
+			StripeCustomerToken,
+			DatetimeCreated,
+			AddedByUser,
+			LastUsedTimestamp,
+			Currency,
+			BillingEmail
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING ID
+	`
+
+	var id int64
+	err := s.c.QueryRowxContext(
+		ctx,
+		q,
+		d.CustomerID,
+		d.CustomerName,
+		d.Cardholder,
+		d.CardExpiration,
+		d.CardLast4,
+		d.StripeCustomerToken,
+		d.DatetimeCreated,
+		d.AddedByUser,
+		d.LastUsedTimestamp,
+		d.Currency,
+		d.BillingEmail,
+	).Scan(&id)
+	return id, err
+}
+
+//UpdateLastUsed sets the LastUsedTimestamp for a card
+func (s postgresStore) UpdateLastUsed(ctx context.Context, datastoreID, timestamp int64) error {
+	q := `
+		UPDATE ` + postgresutils.TableCards + `
+		SET LastUsedTimestamp=$1
+		WHERE ID=$2
+	`
+	_, err := s.c.ExecContext(ctx, q, timestamp, datastoreID)
+	return err
+}
+
+//UpdateBillingEmail sets the email address of a customer's billing contact
+func (s postgresStore) UpdateBillingEmail(ctx context.Context, datastoreID int64, billingEmail string) error {
+	q := `
+		UPDATE ` + postgresutils.TableCards + `
+		SET BillingEmail=$1
+		WHERE ID=$2
+	`
+	_, err := s.c.ExecContext(ctx, q, billingEmail, datastoreID)
+	return err
+}
+
+//Remove deletes a card and the customer's saved cards and scheduled charges from the postgres db
+func (s postgresStore) Remove(ctx context.Context, datastoreID int64) error {
+	tx, err := s.c.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		DELETE FROM ` + postgresutils.TableSavedCards + `
+		WHERE CustomerDatastoreID=$1
+	`
+	_, err = tx.ExecContext(ctx, q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + postgresutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID IN (
+			SELECT ID
+			FROM ` + postgresutils.TableScheduledCharges + `
+			WHERE CustomerDatastoreID=$1
+		)
+	`
+	_, err = tx.ExecContext(ctx, q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + postgresutils.TableScheduledCharges + `
+		WHERE CustomerDatastoreID=$1
+	`
+	_, err = tx.ExecContext(ctx, q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + postgresutils.TableCards + `
+		WHERE ID=$1
+	`
+	_, err = tx.ExecContext(ctx, q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//FindByExpiration returns the cards that expire on a given MM/YYYY
+func (s postgresStore) FindByExpiration(ctx context.Context, monthYear string) ([]CustomerDatastore, error) {
+	q := `
+		SELECT
+			ID,
+			StripeCustomerToken
+		FROM ` + postgresutils.TableCards + `
+		WHERE CardExpiration=$1
+	`
+
+	cards := []CustomerDatastore{}
+	err := s.c.SelectContext(ctx, &cards, q, monthYear)
+	return cards, err
+}
+
+//FindUnused returns the cards that haven't been used since a given unix timestamp
+func (s postgresStore) FindUnused(ctx context.Context, minTimestamp int64) ([]CustomerDatastore, error) {
+	q := `
+		SELECT
+			ID,
+			StripeCustomerToken
+		FROM ` + postgresutils.TableCards + `
+		WHERE LastUsedTimestamp < $1
+	`
+
+	cards := []CustomerDatastore{}
+	err := s.c.SelectContext(ctx, &cards, q, minTimestamp)
+	return cards, err
+}
+
+//FindSavedCards returns the cards saved for a customer, the default card first
+func (s postgresStore) FindSavedCards(ctx context.Context, customerDatastoreID int64) ([]SavedCard, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableSavedCards + `
+		WHERE CustomerDatastoreID=$1
+		ORDER BY IsDefault DESC, ID
+	`
+
+	cards := []SavedCard{}
+	err := s.c.SelectContext(ctx, &cards, q, customerDatastoreID)
+	return cards, err
+}
+
+//AddSavedCard saves a new card for a customer to the postgres db
+func (s postgresStore) AddSavedCard(ctx context.Context, c SavedCard) (int64, error) {
+	q := `
+		INSERT INTO ` + postgresutils.TableSavedCards + ` (
+			CustomerDatastoreID,
+			StripeCardID,
+			Cardholder,
+			CardExpiration,
+			CardLast4,
+			CardBrand,
+			IsDefault,
+			DatetimeCreated,
+			AddedByUser,
+			DatetimeUpdated,
+			UpdatedByUser,
+			PaymentType,
+			BankAccountStatus
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING ID
+	`
+
+	var id int64
+	err := s.c.QueryRowxContext(
+		ctx,
+		q,
+		c.CustomerDatastoreID,
+		c.StripeCardID,
+		c.Cardholder,
+		c.CardExpiration,
+		c.CardLast4,
+		c.CardBrand,
+		c.IsDefault,
+		c.DatetimeCreated,
+		c.AddedByUser,
+		c.DatetimeUpdated,
+		c.UpdatedByUser,
+		c.PaymentType,
+		c.BankAccountStatus,
+	).Scan(&id)
+	return id, err
+}
+
+//UpdateDefaultCard marks a saved card as the default and copies its details to the customer
+//this is done in a transaction so the customer never has two, or zero, default cards
+func (s postgresStore) UpdateDefaultCard(ctx context.Context, c SavedCard) error {
+	tx, err := s.c.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		UPDATE ` + postgresutils.TableSavedCards + `
+		SET IsDefault = (ID = $1)
+		WHERE CustomerDatastoreID=$2
+	`
+	_, err = tx.ExecContext(ctx, q, c.ID, c.CustomerDatastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		UPDATE ` + postgresutils.TableCards + `
+		SET
+			Cardholder=$1,
+			CardExpiration=$2,
+			CardLast4=$3
+		WHERE ID=$4
+	`
+	_, err = tx.ExecContext(ctx, q, c.Cardholder, c.CardExpiration, c.CardLast4, c.CustomerDatastoreID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//FindSavedCardByStripeID looks up a saved card by the id of the card on Stripe
+func (s postgresStore) FindSavedCardByStripeID(ctx context.Context, stripeCardID string) (SavedCard, error) {
+	c := SavedCard{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableSavedCards + `
+		WHERE StripeCardID=$1
+	`
+	err := s.c.GetContext(ctx, &c, q, stripeCardID)
+	if err == sql.ErrNoRows {
+		return c, errCardNotFound
+	}
+
+	return c, err
+}
+
+//UpdateSavedCard saves changes to a card's details to the postgres db
+//this is done in a transaction so the customer's copy of the default card's details matches
+func (s postgresStore) UpdateSavedCard(ctx context.Context, c SavedCard) error {
+	tx, err := s.c.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		UPDATE ` + postgresutils.TableSavedCards + `
+		SET
+			StripeCardID=$1,
+			Cardholder=$2,
+			CardExpiration=$3,
+			CardLast4=$4,
+			CardBrand=$5,
+			DatetimeUpdated=$6,
+			UpdatedByUser=$7,
+			PaymentType=$8,
+			BankAccountStatus=$9
+		WHERE ID=$10
+	`
+	_, err = tx.ExecContext(ctx, q, c.StripeCardID, c.Cardholder, c.CardExpiration, c.CardLast4, c.CardBrand, c.DatetimeUpdated, c.UpdatedByUser, c.PaymentType, c.BankAccountStatus, c.ID)
+	if err != nil {
+		return err
+	}
+
+	if c.IsDefault {
+		q = `
+			UPDATE ` + postgresutils.TableCards + `
+			SET
+				Cardholder=$1,
+				CardExpiration=$2,
+				CardLast4=$3
+			WHERE ID=$4
+		`
+		_, err = tx.ExecContext(ctx, q, c.Cardholder, c.CardExpiration, c.CardLast4, c.CustomerDatastoreID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//RemoveSavedCard deletes one saved card from the postgres db
+func (s postgresStore) RemoveSavedCard(ctx context.Context, id int64) error {
+	q := `
+		DELETE FROM ` + postgresutils.TableSavedCards + `
+		WHERE ID=$1
+	`
+	_, err := s.c.ExecContext(ctx, q, id)
+	return err
+}
+
+//FindSavedCardsByExpiration returns the saved cards that expire on a given MM/YYYY
+func (s postgresStore) FindSavedCardsByExpiration(ctx context.Context, monthYear string) ([]SavedCard, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableSavedCards + `
+		WHERE CardExpiration=$1
+	`
+
+	cards := []SavedCard{}
+	err := s.c.SelectContext(ctx, &cards, q, monthYear)
+	return cards, err
+}
+
+//SaveLedgerEntry saves a charge or refund to the ledger
+//an existing entry for the same charge or refund is overwritten with the newer data
+func (s postgresStore) SaveLedgerEntry(ctx context.Context, e LedgerEntry) error {
+	q := `
+		INSERT INTO ` + postgresutils.TableLedger + ` (
+			StripeID,
+			Type,
+			StripeChargeID,
+			StripeCustomerToken,
+			CustomerID,
+			CustomerName,
+			AmountCents,
+			AmountRefundedCents,
+			Currency,
+			BalanceTransactionID,
+			FeeCents,
+			NetCents,
+			AvailableOn,
+			Status,
+			Captured,
+			FailureCode,
+			FailureMessage,
+			Invoice,
+			Po,
+			Cardholder,
+			CardBrand,
+			CardLast4,
+			CardExpiration,
+			Username,
+			AuthorizedByUser,
+			AuthorizedDatetime,
+			ProcessedDatetime,
+			AutoCharge,
+			AutoChargeReferrer,
+			AutoChargeReason,
+			Level3Provided,
+			Reason,
+			Metadata,
+			Created,
+			DatetimeSynced,
+			PaymentType
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36)
+		ON CONFLICT (StripeID) DO UPDATE SET
+			Type=excluded.Type,
+			StripeChargeID=excluded.StripeChargeID,
+			StripeCustomerToken=excluded.StripeCustomerToken,
+			CustomerID=excluded.CustomerID,
+			CustomerName=excluded.CustomerName,
+			AmountCents=excluded.AmountCents,
+			AmountRefundedCents=excluded.AmountRefundedCents,
+			Currency=excluded.Currency,
+			BalanceTransactionID=excluded.BalanceTransactionID,
+			FeeCents=excluded.FeeCents,
+			NetCents=excluded.NetCents,
+			AvailableOn=excluded.AvailableOn,
+			Status=excluded.Status,
+			Captured=excluded.Captured,
+			FailureCode=excluded.FailureCode,
+			FailureMessage=excluded.FailureMessage,
+			Invoice=excluded.Invoice,
+			Po=excluded.Po,
+			Cardholder=excluded.Cardholder,
+			CardBrand=excluded.CardBrand,
+			CardLast4=excluded.CardLast4,
+			CardExpiration=excluded.CardExpiration,
+			Username=excluded.Username,
+			AuthorizedByUser=excluded.AuthorizedByUser,
+			AuthorizedDatetime=excluded.AuthorizedDatetime,
+			ProcessedDatetime=excluded.ProcessedDatetime,
+			AutoCharge=excluded.AutoCharge,
+			AutoChargeReferrer=excluded.AutoChargeReferrer,
+			AutoChargeReason=excluded.AutoChargeReason,
+			Level3Provided=excluded.Level3Provided,
+			Reason=excluded.Reason,
+			Metadata=excluded.Metadata,
+			Created=excluded.Created,
+			DatetimeSynced=excluded.DatetimeSynced,
+			PaymentType=excluded.PaymentType
+	`
+	_, err := s.c.ExecContext(
+		ctx,
+		q,
+		e.StripeID,
+		e.Type,
+		e.StripeChargeID,
+		e.StripeCustomerToken,
+		e.CustomerID,
+		e.CustomerName,
+		e.AmountCents,
+		e.AmountRefundedCents,
+		e.Currency,
+		e.BalanceTransactionID,
+		e.FeeCents,
+		e.NetCents,
+		e.AvailableOn,
+		e.Status,
+		e.Captured,
+		e.FailureCode,
+		e.FailureMessage,
+		e.Invoice,
+		e.Po,
+		e.Cardholder,
+		e.CardBrand,
+		e.CardLast4,
+		e.CardExpiration,
+		e.Username,
+		e.AuthorizedByUser,
+		e.AuthorizedDatetime,
+		e.ProcessedDatetime,
+		e.AutoCharge,
+		e.AutoChargeReferrer,
+		e.AutoChargeReason,
+		e.Level3Provided,
+		e.Reason,
+		e.Metadata,
+		e.Created,
+		e.DatetimeSynced,
+		e.PaymentType,
+	)
+	return err
+}
+
+//FindLedgerEntry looks up a ledger entry by its Stripe id
+func (s postgresStore) FindLedgerEntry(ctx context.Context, stripeID string) (LedgerEntry, error) {
+	e := LedgerEntry{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableLedger + `
+		WHERE StripeID=$1
+	`
+	err := s.c.GetContext(ctx, &e, q, stripeID)
+	if err == sql.ErrNoRows {
+		return e, errLedgerEntryNotFound
+	}
+
+	return e, err
+}
+
+//FindLedgerEntries returns the ledger entries matching a filter, oldest first
+//entries created at the same time are sorted by their Stripe id so pages of entries don't overlap
+func (s postgresStore) FindLedgerEntries(ctx context.Context, f LedgerFilter) ([]LedgerEntry, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableLedger + `
+		WHERE Type=$1
+		AND Created >= $2
+		AND Created <= $3
+	`
+	b := []interface{}{f.Type, f.Start, f.End}
+	if f.StripeCustomerToken != "" {
+		b = append(b, f.StripeCustomerToken)
+		q += ` AND StripeCustomerToken=$` + strconv.Itoa(len(b))
+	}
+	if f.AfterStripeID != "" {
+		b = append(b, f.AfterCreated, f.AfterStripeID)
+		created, stripeID := `$`+strconv.Itoa(len(b)-1), `$`+strconv.Itoa(len(b))
+		q += ` AND (Created > ` + created + ` OR (Created = ` + created + ` AND StripeID > ` + stripeID + `))`
+	}
+	q += ` ORDER BY Created, StripeID`
+	if f.Limit > 0 {
+		b = append(b, f.Limit)
+		q += ` LIMIT $` + strconv.Itoa(len(b))
+	}
+
+	entries := []LedgerEntry{}
+	err := s.c.SelectContext(ctx, &entries, q, b...)
+	return entries, err
+}
+
+//FindWebhookEvent looks up a handled webhook event by its Stripe id
+func (s postgresStore) FindWebhookEvent(ctx context.Context, stripeEventID string) (WebhookEvent, error) {
+	e := WebhookEvent{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableWebhookEvents + `
+		WHERE StripeEventID=$1
+	`
+	err := s.c.GetContext(ctx, &e, q, stripeEventID)
+	if err == sql.ErrNoRows {
+		return e, errWebhookEventNotFound
+	}
+
+	return e, err
+}
+
+//SaveWebhookEvent records that a webhook event was handled
+//an event that was already saved is ignored
+func (s postgresStore) SaveWebhookEvent(ctx context.Context, e WebhookEvent) error {
+	q := `
+		INSERT INTO ` + postgresutils.TableWebhookEvents + ` (
+			StripeEventID,
+			Type,
+			Created,
+			DatetimeProcessed
+		) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (StripeEventID) DO NOTHING
+	`
+
+	_, err := s.c.ExecContext(ctx, q, e.StripeEventID, e.Type, e.Created, e.DatetimeProcessed)
+	return err
+}
+
+//FindScheduledCharges returns the scheduled charges for a customer from the postgres db
+func (s postgresStore) FindScheduledCharges(ctx context.Context, customerDatastoreID int64) ([]ScheduledCharge, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableScheduledCharges + `
+		WHERE CustomerDatastoreID=$1
+		ORDER BY ID
+	`
+
+	schedules := []ScheduledCharge{}
+	err := s.c.SelectContext(ctx, &schedules, q, customerDatastoreID)
+	return schedules, err
+}
+
+//FindScheduledCharge looks up a scheduled charge by its id in the postgres db
+func (s postgresStore) FindScheduledCharge(ctx context.Context, id int64) (ScheduledCharge, error) {
+	sc := ScheduledCharge{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableScheduledCharges + `
+		WHERE ID=$1
+	`
+	err := s.c.GetContext(ctx, &sc, q, id)
+	if err == sql.ErrNoRows {
+		return sc, errScheduledChargeNotFound
+	}
+
+	return sc, err
+}
+
+//FindDueScheduledCharges returns the active scheduled charges that are due from the postgres db
+func (s postgresStore) FindDueScheduledCharges(ctx context.Context, date string) ([]ScheduledCharge, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableScheduledCharges + `
+		WHERE Active=TRUE AND NextRunDate<>'' AND NextRunDate<=$1
+		ORDER BY NextRunDate, ID
+	`
+
+	schedules := []ScheduledCharge{}
+	err := s.c.SelectContext(ctx, &schedules, q, date)
+	return schedules, err
+}
+
+//AddScheduledCharge saves a new scheduled charge to the postgres db
+func (s postgresStore) AddScheduledCharge(ctx context.Context, sc ScheduledCharge) (int64, error) {
+	q := `
+		INSERT INTO ` + postgresutils.TableScheduledCharges + ` (
+			CustomerDatastoreID,
+			SavedCardID,
+			AmountCents,
+			Currency,
+			Interval,
+			IntervalDays,
+			StartDate,
+			EndDate,
+			InvoiceTemplate,
+			PoTemplate,
+			NextRunDate,
+			Active,
+			RunCount,
+			LastRunDate,
+			LastRunStatus,
+			DatetimeCreated,
+			CreatedByUser
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING ID
+	`
+
+	var id int64
+	err := s.c.QueryRowxContext(
+		ctx,
+		q,
+		sc.CustomerDatastoreID,
+		sc.SavedCardID,
+		sc.AmountCents,
+		sc.Currency,
+		sc.Interval,
+		sc.IntervalDays,
+		sc.StartDate,
+		sc.EndDate,
+		sc.InvoiceTemplate,
+		sc.PoTemplate,
+		sc.NextRunDate,
+		sc.Active,
+		sc.RunCount,
+		sc.LastRunDate,
+		sc.LastRunStatus,
+		sc.DatetimeCreated,
+		sc.CreatedByUser,
+	).Scan(&id)
+	return id, err
+}
+
+//UpdateScheduledCharge saves changes to a scheduled charge in the postgres db
+//the customer, who created the schedule, and when can't be changed
+func (s postgresStore) UpdateScheduledCharge(ctx context.Context, sc ScheduledCharge) error {
+	q := `
+		UPDATE ` + postgresutils.TableScheduledCharges + `
+		SET
+			SavedCardID=$1,
+			AmountCents=$2,
+			Currency=$3,
+			Interval=$4,
+			IntervalDays=$5,
+			StartDate=$6,
+			EndDate=$7,
+			InvoiceTemplate=$8,
+			PoTemplate=$9,
+			NextRunDate=$10,
+			Active=$11,
+			RunCount=$12,
+			LastRunDate=$13,
+			LastRunStatus=$14
+		WHERE ID=$15
+	`
+
+	_, err := s.c.ExecContext(
+		ctx,
+		q,
+		sc.SavedCardID,
+		sc.AmountCents,
+		sc.Currency,
+		sc.Interval,
+		sc.IntervalDays,
+		sc.StartDate,
+		sc.EndDate,
+		sc.InvoiceTemplate,
+		sc.PoTemplate,
+		sc.NextRunDate,
+		sc.Active,
+		sc.RunCount,
+		sc.LastRunDate,
+		sc.LastRunStatus,
+		sc.ID,
+	)
+	return err
+}
+
+//AdvanceScheduledCharge moves a scheduled charge to its next run date in the postgres db
+//only the columns the scheduler changes are saved so changes made in the gui while the card was
+//being charged aren't lost, and a schedule paused in the gui stays paused
+func (s postgresStore) AdvanceScheduledCharge(ctx context.Context, sc ScheduledCharge, runDate string) error {
+	q := `
+		UPDATE ` + postgresutils.TableScheduledCharges + `
+		SET
+			NextRunDate=$1,
+			Active=(Active AND $2),
+			RunCount=RunCount+1,
+			LastRunDate=$3,
+			LastRunStatus=$4
+		WHERE ID=$5 AND NextRunDate=$6
+	`
+
+	res, err := s.c.ExecContext(
+		ctx,
+		q,
+		sc.NextRunDate,
+		sc.Active,
+		sc.LastRunDate,
+		sc.LastRunStatus,
+		sc.ID,
+		runDate,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errScheduledChargeMoved
+	}
+
+	return nil
+}
+
+//RemoveScheduledCharge deletes a scheduled charge and its runs from the postgres db
+func (s postgresStore) RemoveScheduledCharge(ctx context.Context, id int64) error {
+	tx, err := s.c.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		DELETE FROM ` + postgresutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID=$1
+	`
+	_, err = tx.ExecContext(ctx, q, id)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + postgresutils.TableScheduledCharges + `
+		WHERE ID=$1
+	`
+	_, err = tx.ExecContext(ctx, q, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//AddScheduledChargeRun records the start of a run in the postgres db
+//the unique index on the schedule and date means only one run is saved if two are started at once
+func (s postgresStore) AddScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error {
+	q := `
+		INSERT INTO ` + postgresutils.TableScheduledChargeRuns + ` (
+			ScheduledChargeID,
+			RunDate,
+			Status,
+			ChargeID,
+			AmountCents,
+			Currency,
+			Invoice,
+			Po,
+			Error,
+			IdempotencyKey,
+			DatetimeStarted,
+			DatetimeFinished
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (ScheduledChargeID, RunDate) DO NOTHING
+	`
+
+	res, err := s.c.ExecContext(
+		ctx,
+		q,
+		run.ScheduledChargeID,
+		run.RunDate,
+		run.Status,
+		run.ChargeID,
+		run.AmountCents,
+		run.Currency,
+		run.Invoice,
+		run.Po,
+		run.Error,
+		run.IdempotencyKey,
+		run.DatetimeStarted,
+		run.DatetimeFinished,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errScheduledChargeRunExists
+	}
+
+	return nil
+}
+
+//FindScheduledChargeRun looks up the run of a scheduled charge for a date in the postgres db
+func (s postgresStore) FindScheduledChargeRun(ctx context.Context, scheduledChargeID int64, runDate string) (ScheduledChargeRun, error) {
+	run := ScheduledChargeRun{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID=$1 AND RunDate=$2
+	`
+	err := s.c.GetContext(ctx, &run, q, scheduledChargeID, runDate)
+	if err == sql.ErrNoRows {
+		return run, errScheduledChargeRunNotFound
+	}
+
+	return run, err
+}
+
+//UpdateScheduledChargeRun saves the outcome of a run to the postgres db
+func (s postgresStore) UpdateScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error {
+	q := `
+		UPDATE ` + postgresutils.TableScheduledChargeRuns + `
+		SET
+			Status=$1,
+			ChargeID=$2,
+			AmountCents=$3,
+			Currency=$4,
+			Invoice=$5,
+			Po=$6,
+			Error=$7,
+			IdempotencyKey=$8,
+			DatetimeStarted=$9,
+			DatetimeFinished=$10
+		WHERE ScheduledChargeID=$11 AND RunDate=$12
+	`
+
+	_, err := s.c.ExecContext(
+		ctx,
+		q,
+		run.Status,
+		run.ChargeID,
+		run.AmountCents,
+		run.Currency,
+		run.Invoice,
+		run.Po,
+		run.Error,
+		run.IdempotencyKey,
+		run.DatetimeStarted,
+		run.DatetimeFinished,
+		run.ScheduledChargeID,
+		run.RunDate,
+	)
+	return err
+}
+
+//FindScheduledChargeRuns returns the most recent runs of a scheduled charge from the postgres db
+func (s postgresStore) FindScheduledChargeRuns(ctx context.Context, scheduledChargeID int64, limit int) ([]ScheduledChargeRun, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID=$1
+		ORDER BY RunDate DESC
+		LIMIT $2
+	`
+
+	runs := []ScheduledChargeRun{}
+	err := s.c.SelectContext(ctx, &runs, q, scheduledChargeID, limit)
+	return runs, err
+}
+
+//AddBatchJob saves a batch and its rows to the postgres db before the rows are charged
+//this is done in a transaction so a batch is never saved without its rows
+func (s postgresStore) AddBatchJob(ctx context.Context, j BatchJob, rows []BatchRow) error {
+	tx, err := s.c.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		INSERT INTO ` + postgresutils.TableBatchJobs + ` (
+			BatchID,
+			NumRows,
+			Username,
+			DatetimeStarted,
+			DatetimeFinished
+		) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (BatchID) DO NOTHING
+	`
+	res, err := tx.ExecContext(ctx, q, j.BatchID, j.NumRows, j.Username, j.DatetimeStarted, j.DatetimeFinished)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errBatchJobExists
+	}
+
+	q = `
+		INSERT INTO ` + postgresutils.TableBatchRows + ` (
+			BatchID,
+			RowNumber,
+			CustomerID,
+			CustomerName,
+			CustomerDatastoreID,
+			SavedCardID,
+			CardLast4,
+			Amount,
+			AmountCents,
+			Currency,
+			Invoice,
+			Po,
+			Level3,
+			Level3Params,
+			Status,
+			ChargeID,
+			Error,
+			EmailError,
+			DatetimeStarted,
+			DatetimeFinished
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+	`
+	for _, row := range rows {
+		_, err = tx.ExecContext(
+			ctx, q,
+			row.BatchID,
+			row.RowNumber,
+			row.CustomerID,
+			row.CustomerName,
+			row.CustomerDatastoreID,
+			row.SavedCardID,
+			row.CardLast4,
+			row.Amount,
+			row.AmountCents,
+			row.Currency,
+			row.Invoice,
+			row.Po,
+			row.Level3,
+			row.Level3Params,
+			row.Status,
+			row.ChargeID,
+			row.Error,
+			row.EmailError,
+			row.DatetimeStarted,
+			row.DatetimeFinished,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//FindBatchJob looks up a batch by its id in the postgres db
+func (s postgresStore) FindBatchJob(ctx context.Context, batchID string) (BatchJob, error) {
+	j := BatchJob{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableBatchJobs + `
+		WHERE BatchID = $1
+	`
+	err := s.c.GetContext(ctx, &j, q, batchID)
+	if err == sql.ErrNoRows {
+		return j, errBatchJobNotFound
+	}
+
+	return j, err
+}
+
+//FindUnfinishedBatchJobs returns the batches in the postgres db that still have rows to charge
+func (s postgresStore) FindUnfinishedBatchJobs(ctx context.Context) ([]BatchJob, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableBatchJobs + `
+		WHERE DatetimeFinished = ''
+		ORDER BY ID
+	`
+
+	jobs := []BatchJob{}
+	err := s.c.SelectContext(ctx, &jobs, q)
+	return jobs, err
+}
+
+//FinishBatchJob notes that every row of a batch in the postgres db was charged or failed
+func (s postgresStore) FinishBatchJob(ctx context.Context, batchID, datetimeFinished string) error {
+	q := `
+		UPDATE ` + postgresutils.TableBatchJobs + `
+		SET DatetimeFinished = $1
+		WHERE BatchID = $2
+	`
+
+	_, err := s.c.ExecContext(ctx, q, datetimeFinished, batchID)
+	return err
+}
+
+//FindBatchRows returns the rows of a batch from the postgres db in the order they are in the file
+func (s postgresStore) FindBatchRows(ctx context.Context, batchID string) ([]BatchRow, error) {
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableBatchRows + `
+		WHERE BatchID = $1
+		ORDER BY RowNumber
+	`
+
+	rows := []BatchRow{}
+	err := s.c.SelectContext(ctx, &rows, q, batchID)
+	return rows, err
+}
+
+//StartBatchRow saves the status and start time of a row in the postgres db that is about to be charged
+//the row is only changed if it is still pending so two servers never charge the same row
+func (s postgresStore) StartBatchRow(ctx context.Context, row BatchRow) error {
+	q := `
+		UPDATE ` + postgresutils.TableBatchRows + `
+		SET
+			Status = $1,
+			DatetimeStarted = $2
+		WHERE BatchID = $3 AND RowNumber = $4 AND Status = $5
+	`
+
+	res, err := s.c.ExecContext(ctx, q, row.Status, row.DatetimeStarted, row.BatchID, row.RowNumber, batchRowPending)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errBatchRowStarted
+	}
+
+	return nil
+}
+
+//UpdateBatchRow saves the outcome of charging a row to the postgres db
+func (s postgresStore) UpdateBatchRow(ctx context.Context, row BatchRow) error {
+	q := `
+		UPDATE ` + postgresutils.TableBatchRows + `
+		SET
+			Status = $1,
+			ChargeID = $2,
+			Error = $3,
+			EmailError = $4,
+			DatetimeStarted = $5,
+			DatetimeFinished = $6
+		WHERE BatchID = $7 AND RowNumber = $8
+	`
+
+	_, err := s.c.ExecContext(
+		ctx, q,
+		row.Status,
+		row.ChargeID,
+		row.Error,
+		row.EmailError,
+		row.DatetimeStarted,
+		row.DatetimeFinished,
+		row.BatchID,
+		row.RowNumber,
+	)
+	return err
+}
@@ -0,0 +1,1131 @@
+package card
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//sqliteStore saves and retrieves cards from a sqlite db
+type sqliteStore struct {
+	c *sqlx.DB
+}
+
+//NewSQLiteStore returns a Store that uses the given sqlite db connection
+func NewSQLiteStore(c *sqlx.DB) Store {
+	return sqliteStore{c: c}
+}
+
+//GetAll returns the datastore id and customer name for every card
+func (s sqliteStore) GetAll(ctx context.Context) ([]List, error) {
+	list := []List{}
+	q := `
+		SELECT ID, CustomerName
+		FROM ` + sqliteutils.TableCards + `
+		ORDER BY CustomerName
+	`
+	err := s.c.Select(&list, q)
+	return list, err
+}
+
+//FindAll returns the full data for every card
+func (s sqliteStore) FindAll(ctx context.Context) ([]CustomerDatastore, error) {
+	cards := []CustomerDatastore{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableCards + `
+		ORDER BY ID
+	`
+	err := s.c.Select(&cards, q)
+	return cards, err
+}
+
+//FindByID looks up a card by its datastore id
+func (s sqliteStore) FindByID(ctx context.Context, datastoreID int64) (CustomerDatastore, error) {
+	data := CustomerDatastore{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableCards + `
+		WHERE ID=?
+	`
+	err := s.c.Get(&data, q, datastoreID)
+	return data, err
+}
+
+//FindByCustomerID looks up a card by the id from a CRM system
+func (s sqliteStore) FindByCustomerID(ctx context.Context, customerID string) (CustomerDatastore, error) {
+	data := CustomerDatastore{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableCards + `
+		WHERE CustomerID=?
+	`
+	err := s.c.Get(&data, q, customerID)
+	if err == sql.ErrNoRows {
+		return data, errCustomerNotFound
+	}
+
+	return data, err
+}
+
+//Add saves a new card to the sqlite db
+func (s sqliteStore) Add(ctx context.Context, d CustomerDatastore) (int64, error) {
+	q := `
+		INSERT INTO ` + sqliteutils.TableCards + ` (
+			CustomerID,
+			CustomerName,
+			Cardholder,
+			CardExpiration,
+			CardLast4,
+			StripeCustomerToken,
+			DatetimeCreated,
+			AddedByUser,
+			LastUsedTimestamp,
+			Currency,
+			BillingEmail
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	stmt, err := s.c.Prepare(q)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(
+		d.CustomerID,
+		d.CustomerName,
+		d.Cardholder,
+		d.CardExpiration,
+		d.CardLast4,
+		d.StripeCustomerToken,
+		d.DatetimeCreated,
+		d.AddedByUser,
+		d.LastUsedTimestamp,
+		d.Currency,
+		d.BillingEmail,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return id, err
+}
+
+//UpdateLastUsed sets the LastUsedTimestamp for a card
+func (s sqliteStore) UpdateLastUsed(ctx context.Context, datastoreID, timestamp int64) error {
+	q := `
+		UPDATE ` + sqliteutils.TableCards + `
+		SET LastUsedTimestamp=?
+		WHERE ID=?
+	`
+	stmt, err := s.c.Prepare(q)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		timestamp,
+		datastoreID,
+	)
+	return err
+}
+
+//UpdateBillingEmail sets the email address of a customer's billing contact
+func (s sqliteStore) UpdateBillingEmail(ctx context.Context, datastoreID int64, billingEmail string) error {
+	q := `
+		UPDATE ` + sqliteutils.TableCards + `
+		SET BillingEmail=?
+		WHERE ID=?
+	`
+	_, err := s.c.Exec(q, billingEmail, datastoreID)
+	return err
+}
+
+//Remove deletes a card and the customer's saved cards and scheduled charges from the sqlite db
+func (s sqliteStore) Remove(ctx context.Context, datastoreID int64) error {
+	tx, err := s.c.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		DELETE FROM ` + sqliteutils.TableSavedCards + `
+		WHERE CustomerDatastoreID = ?
+	`
+	_, err = tx.Exec(q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + sqliteutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID IN (
+			SELECT ID
+			FROM ` + sqliteutils.TableScheduledCharges + `
+			WHERE CustomerDatastoreID = ?
+		)
+	`
+	_, err = tx.Exec(q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + sqliteutils.TableScheduledCharges + `
+		WHERE CustomerDatastoreID = ?
+	`
+	_, err = tx.Exec(q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + sqliteutils.TableCards + `
+		WHERE ID = ?
+	`
+	_, err = tx.Exec(q, datastoreID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//FindByExpiration returns the cards that expire on a given MM/YYYY
+func (s sqliteStore) FindByExpiration(ctx context.Context, monthYear string) ([]CustomerDatastore, error) {
+	q := `
+		SELECT
+			ID,
+			StripeCustomerToken
+		FROM ` + sqliteutils.TableCards + `
+		WHERE CardExpiration = ?
+	`
+
+	cards := []CustomerDatastore{}
+	err := s.c.Select(&cards, q, monthYear)
+	return cards, err
+}
+
+//FindUnused returns the cards that haven't been used since a given unix timestamp
+func (s sqliteStore) FindUnused(ctx context.Context, minTimestamp int64) ([]CustomerDatastore, error) {
+	q := `
+		SELECT
+			ID,
+			StripeCustomerToken
+		FROM ` + sqliteutils.TableCards + `
+		WHERE LastUsedTimestamp < ?
+	`
+
+	cards := []CustomerDatastore{}
+	err := s.c.Select(&cards, q, minTimestamp)
+	return cards, err
+}
+
+//FindSavedCards returns the cards saved for a customer, the default card first
+func (s sqliteStore) FindSavedCards(ctx context.Context, customerDatastoreID int64) ([]SavedCard, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableSavedCards + `
+		WHERE CustomerDatastoreID = ?
+		ORDER BY IsDefault DESC, ID
+	`
+
+	cards := []SavedCard{}
+	err := s.c.Select(&cards, q, customerDatastoreID)
+	return cards, err
+}
+
+//AddSavedCard saves a new card for a customer to the sqlite db
+func (s sqliteStore) AddSavedCard(ctx context.Context, c SavedCard) (int64, error) {
+	q := `
+		INSERT INTO ` + sqliteutils.TableSavedCards + ` (
+			CustomerDatastoreID,
+			StripeCardID,
+			Cardholder,
+			CardExpiration,
+			CardLast4,
+			CardBrand,
+			IsDefault,
+			DatetimeCreated,
+			AddedByUser,
+			DatetimeUpdated,
+			UpdatedByUser,
+			PaymentType,
+			BankAccountStatus
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	res, err := s.c.Exec(
+		q,
+		c.CustomerDatastoreID,
+		c.StripeCardID,
+		c.Cardholder,
+		c.CardExpiration,
+		c.CardLast4,
+		c.CardBrand,
+		c.IsDefault,
+		c.DatetimeCreated,
+		c.AddedByUser,
+		c.DatetimeUpdated,
+		c.UpdatedByUser,
+		c.PaymentType,
+		c.BankAccountStatus,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+//UpdateDefaultCard marks a saved card as the default and copies its details to the customer
+//this is done in a transaction so the customer never has two, or zero, default cards
+func (s sqliteStore) UpdateDefaultCard(ctx context.Context, c SavedCard) error {
+	tx, err := s.c.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		UPDATE ` + sqliteutils.TableSavedCards + `
+		SET IsDefault = (ID = ?)
+		WHERE CustomerDatastoreID = ?
+	`
+	_, err = tx.Exec(q, c.ID, c.CustomerDatastoreID)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		UPDATE ` + sqliteutils.TableCards + `
+		SET
+			Cardholder=?,
+			CardExpiration=?,
+			CardLast4=?
+		WHERE ID=?
+	`
+	_, err = tx.Exec(q, c.Cardholder, c.CardExpiration, c.CardLast4, c.CustomerDatastoreID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//FindSavedCardByStripeID looks up a saved card by the id of the card on Stripe
+func (s sqliteStore) FindSavedCardByStripeID(ctx context.Context, stripeCardID string) (SavedCard, error) {
+	c := SavedCard{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableSavedCards + `
+		WHERE StripeCardID=?
+	`
+	err := s.c.Get(&c, q, stripeCardID)
+	if err == sql.ErrNoRows {
+		return c, errCardNotFound
+	}
+
+	return c, err
+}
+
+//UpdateSavedCard saves changes to a card's details to the sqlite db
+//this is done in a transaction so the customer's copy of the default card's details matches
+func (s sqliteStore) UpdateSavedCard(ctx context.Context, c SavedCard) error {
+	tx, err := s.c.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		UPDATE ` + sqliteutils.TableSavedCards + `
+		SET
+			StripeCardID=?,
+			Cardholder=?,
+			CardExpiration=?,
+			CardLast4=?,
+			CardBrand=?,
+			DatetimeUpdated=?,
+			UpdatedByUser=?,
+			PaymentType=?,
+			BankAccountStatus=?
+		WHERE ID=?
+	`
+	_, err = tx.Exec(q, c.StripeCardID, c.Cardholder, c.CardExpiration, c.CardLast4, c.CardBrand, c.DatetimeUpdated, c.UpdatedByUser, c.PaymentType, c.BankAccountStatus, c.ID)
+	if err != nil {
+		return err
+	}
+
+	if c.IsDefault {
+		q = `
+			UPDATE ` + sqliteutils.TableCards + `
+			SET
+				Cardholder=?,
+				CardExpiration=?,
+				CardLast4=?
+			WHERE ID=?
+		`
+		_, err = tx.Exec(q, c.Cardholder, c.CardExpiration, c.CardLast4, c.CustomerDatastoreID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//RemoveSavedCard deletes one saved card from the sqlite db
+func (s sqliteStore) RemoveSavedCard(ctx context.Context, id int64) error {
+	q := `
+		DELETE FROM ` + sqliteutils.TableSavedCards + `
+		WHERE ID = ?
+	`
+	_, err := s.c.Exec(q, id)
+	return err
+}
+
+//FindSavedCardsByExpiration returns the saved cards that expire on a given MM/YYYY
+func (s sqliteStore) FindSavedCardsByExpiration(ctx context.Context, monthYear string) ([]SavedCard, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableSavedCards + `
+		WHERE CardExpiration = ?
+	`
+
+	cards := []SavedCard{}
+	err := s.c.Select(&cards, q, monthYear)
+	return cards, err
+}
+
+//SaveLedgerEntry saves a charge or refund to the ledger
+//an existing entry for the same charge or refund is overwritten with the newer data
+func (s sqliteStore) SaveLedgerEntry(ctx context.Context, e LedgerEntry) error {
+	q := `
+		INSERT INTO ` + sqliteutils.TableLedger + ` (
+			StripeID,
+			Type,
+			StripeChargeID,
+			StripeCustomerToken,
+			CustomerID,
+			CustomerName,
+			AmountCents,
+			AmountRefundedCents,
+			Currency,
+			BalanceTransactionID,
+			FeeCents,
+			NetCents,
+			AvailableOn,
+			Status,
+			Captured,
+			FailureCode,
+			FailureMessage,
+			Invoice,
+			Po,
+			Cardholder,
+			CardBrand,
+			CardLast4,
+			CardExpiration,
+			Username,
+			AuthorizedByUser,
+			AuthorizedDatetime,
+			ProcessedDatetime,
+			AutoCharge,
+			AutoChargeReferrer,
+			AutoChargeReason,
+			Level3Provided,
+			Reason,
+			Metadata,
+			Created,
+			DatetimeSynced,
+			PaymentType
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (StripeID) DO UPDATE SET
+			Type=excluded.Type,
+			StripeChargeID=excluded.StripeChargeID,
+			StripeCustomerToken=excluded.StripeCustomerToken,
+			CustomerID=excluded.CustomerID,
+			CustomerName=excluded.CustomerName,
+			AmountCents=excluded.AmountCents,
+			AmountRefundedCents=excluded.AmountRefundedCents,
+			Currency=excluded.Currency,
+			BalanceTransactionID=excluded.BalanceTransactionID,
+			FeeCents=excluded.FeeCents,
+			NetCents=excluded.NetCents,
+			AvailableOn=excluded.AvailableOn,
+			Status=excluded.Status,
+			Captured=excluded.Captured,
+			FailureCode=excluded.FailureCode,
+			FailureMessage=excluded.FailureMessage,
+			Invoice=excluded.Invoice,
+			Po=excluded.Po,
+			Cardholder=excluded.Cardholder,
+			CardBrand=excluded.CardBrand,
+			CardLast4=excluded.CardLast4,
+			CardExpiration=excluded.CardExpiration,
+			Username=excluded.Username,
+			AuthorizedByUser=excluded.AuthorizedByUser,
+			AuthorizedDatetime=excluded.AuthorizedDatetime,
+			ProcessedDatetime=excluded.ProcessedDatetime,
+			AutoCharge=excluded.AutoCharge,
+			AutoChargeReferrer=excluded.AutoChargeReferrer,
+			AutoChargeReason=excluded.AutoChargeReason,
+			Level3Provided=excluded.Level3Provided,
+			Reason=excluded.Reason,
+			Metadata=excluded.Metadata,
+			Created=excluded.Created,
+			DatetimeSynced=excluded.DatetimeSynced,
+			PaymentType=excluded.PaymentType
+	`
+	stmt, err := s.c.Prepare(q)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		e.StripeID,
+		e.Type,
+		e.StripeChargeID,
+		e.StripeCustomerToken,
+		e.CustomerID,
+		e.CustomerName,
+		e.AmountCents,
+		e.AmountRefundedCents,
+		e.Currency,
+		e.BalanceTransactionID,
+		e.FeeCents,
+		e.NetCents,
+		e.AvailableOn,
+		e.Status,
+		e.Captured,
+		e.FailureCode,
+		e.FailureMessage,
+		e.Invoice,
+		e.Po,
+		e.Cardholder,
+		e.CardBrand,
+		e.CardLast4,
+		e.CardExpiration,
+		e.Username,
+		e.AuthorizedByUser,
+		e.AuthorizedDatetime,
+		e.ProcessedDatetime,
+		e.AutoCharge,
+		e.AutoChargeReferrer,
+		e.AutoChargeReason,
+		e.Level3Provided,
+		e.Reason,
+		e.Metadata,
+		e.Created,
+		e.DatetimeSynced,
+		e.PaymentType,
+	)
+	return err
+}
+
+//FindLedgerEntry looks up a ledger entry by its Stripe id
+func (s sqliteStore) FindLedgerEntry(ctx context.Context, stripeID string) (LedgerEntry, error) {
+	e := LedgerEntry{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableLedger + `
+		WHERE StripeID=?
+	`
+	err := s.c.Get(&e, q, stripeID)
+	if err == sql.ErrNoRows {
+		return e, errLedgerEntryNotFound
+	}
+
+	return e, err
+}
+
+//FindLedgerEntries returns the ledger entries matching a filter, oldest first
+//entries created at the same time are sorted by their Stripe id so pages of entries don't overlap
+func (s sqliteStore) FindLedgerEntries(ctx context.Context, f LedgerFilter) ([]LedgerEntry, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableLedger + `
+		WHERE Type=?
+		AND Created >= ?
+		AND Created <= ?
+	`
+	b := sqliteutils.Bindvars{f.Type, f.Start, f.End}
+	if f.StripeCustomerToken != "" {
+		q += ` AND StripeCustomerToken=?`
+		b = append(b, f.StripeCustomerToken)
+	}
+	if f.AfterStripeID != "" {
+		q += ` AND (Created > ? OR (Created = ? AND StripeID > ?))`
+		b = append(b, f.AfterCreated, f.AfterCreated, f.AfterStripeID)
+	}
+	q += ` ORDER BY Created, StripeID`
+	if f.Limit > 0 {
+		q += ` LIMIT ?`
+		b = append(b, f.Limit)
+	}
+
+	entries := []LedgerEntry{}
+	err := s.c.Select(&entries, q, b...)
+	return entries, err
+}
+
+//FindWebhookEvent looks up a handled webhook event by its Stripe id
+func (s sqliteStore) FindWebhookEvent(ctx context.Context, stripeEventID string) (WebhookEvent, error) {
+	e := WebhookEvent{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableWebhookEvents + `
+		WHERE StripeEventID=?
+	`
+	err := s.c.Get(&e, q, stripeEventID)
+	if err == sql.ErrNoRows {
+		return e, errWebhookEventNotFound
+	}
+
+	return e, err
+}
+
+//SaveWebhookEvent records that a webhook event was handled
+//an event that was already saved is ignored
+func (s sqliteStore) SaveWebhookEvent(ctx context.Context, e WebhookEvent) error {
+	q := `
+		INSERT INTO ` + sqliteutils.TableWebhookEvents + ` (
+			StripeEventID,
+			Type,
+			Created,
+			DatetimeProcessed
+		) VALUES (?, ?, ?, ?)
+		ON CONFLICT(StripeEventID) DO NOTHING
+	`
+
+	_, err := s.c.Exec(q, e.StripeEventID, e.Type, e.Created, e.DatetimeProcessed)
+	return err
+}
+
+//FindScheduledCharges returns the scheduled charges for a customer from the sqlite db
+func (s sqliteStore) FindScheduledCharges(ctx context.Context, customerDatastoreID int64) ([]ScheduledCharge, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableScheduledCharges + `
+		WHERE CustomerDatastoreID = ?
+		ORDER BY ID
+	`
+
+	schedules := []ScheduledCharge{}
+	err := s.c.Select(&schedules, q, customerDatastoreID)
+	return schedules, err
+}
+
+//FindScheduledCharge looks up a scheduled charge by its id in the sqlite db
+func (s sqliteStore) FindScheduledCharge(ctx context.Context, id int64) (ScheduledCharge, error) {
+	sc := ScheduledCharge{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableScheduledCharges + `
+		WHERE ID = ?
+	`
+	err := s.c.Get(&sc, q, id)
+	if err == sql.ErrNoRows {
+		return sc, errScheduledChargeNotFound
+	}
+
+	return sc, err
+}
+
+//FindDueScheduledCharges returns the active scheduled charges that are due from the sqlite db
+func (s sqliteStore) FindDueScheduledCharges(ctx context.Context, date string) ([]ScheduledCharge, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableScheduledCharges + `
+		WHERE Active = 1 AND NextRunDate != '' AND NextRunDate <= ?
+		ORDER BY NextRunDate, ID
+	`
+
+	schedules := []ScheduledCharge{}
+	err := s.c.Select(&schedules, q, date)
+	return schedules, err
+}
+
+//AddScheduledCharge saves a new scheduled charge to the sqlite db
+func (s sqliteStore) AddScheduledCharge(ctx context.Context, sc ScheduledCharge) (int64, error) {
+	q := `
+		INSERT INTO ` + sqliteutils.TableScheduledCharges + ` (
+			CustomerDatastoreID,
+			SavedCardID,
+			AmountCents,
+			Currency,
+			Interval,
+			IntervalDays,
+			StartDate,
+			EndDate,
+			InvoiceTemplate,
+			PoTemplate,
+			NextRunDate,
+			Active,
+			RunCount,
+			LastRunDate,
+			LastRunStatus,
+			DatetimeCreated,
+			CreatedByUser
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	res, err := s.c.Exec(
+		q,
+		sc.CustomerDatastoreID,
+		sc.SavedCardID,
+		sc.AmountCents,
+		sc.Currency,
+		sc.Interval,
+		sc.IntervalDays,
+		sc.StartDate,
+		sc.EndDate,
+		sc.InvoiceTemplate,
+		sc.PoTemplate,
+		sc.NextRunDate,
+		sc.Active,
+		sc.RunCount,
+		sc.LastRunDate,
+		sc.LastRunStatus,
+		sc.DatetimeCreated,
+		sc.CreatedByUser,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+//UpdateScheduledCharge saves changes to a scheduled charge in the sqlite db
+//the customer, who created the schedule, and when can't be changed
+func (s sqliteStore) UpdateScheduledCharge(ctx context.Context, sc ScheduledCharge) error {
+	q := `
+		UPDATE ` + sqliteutils.TableScheduledCharges + `
+		SET
+			SavedCardID = ?,
+			AmountCents = ?,
+			Currency = ?,
+			Interval = ?,
+			IntervalDays = ?,
+			StartDate = ?,
+			EndDate = ?,
+			InvoiceTemplate = ?,
+			PoTemplate = ?,
+			NextRunDate = ?,
+			Active = ?,
+			RunCount = ?,
+			LastRunDate = ?,
+			LastRunStatus = ?
+		WHERE ID = ?
+	`
+
+	_, err := s.c.Exec(
+		q,
+		sc.SavedCardID,
+		sc.AmountCents,
+		sc.Currency,
+		sc.Interval,
+		sc.IntervalDays,
+		sc.StartDate,
+		sc.EndDate,
+		sc.InvoiceTemplate,
+		sc.PoTemplate,
+		sc.NextRunDate,
+		sc.Active,
+		sc.RunCount,
+		sc.LastRunDate,
+		sc.LastRunStatus,
+		sc.ID,
+	)
+	return err
+}
+
+//AdvanceScheduledCharge moves a scheduled charge to its next run date in the sqlite db
+//only the columns the scheduler changes are saved so changes made in the gui while the card was
+//being charged aren't lost, and a schedule paused in the gui stays paused
+func (s sqliteStore) AdvanceScheduledCharge(ctx context.Context, sc ScheduledCharge, runDate string) error {
+	q := `
+		UPDATE ` + sqliteutils.TableScheduledCharges + `
+		SET
+			NextRunDate = ?,
+			Active = (Active AND ?),
+			RunCount = RunCount + 1,
+			LastRunDate = ?,
+			LastRunStatus = ?
+		WHERE ID = ? AND NextRunDate = ?
+	`
+
+	res, err := s.c.Exec(
+		q,
+		sc.NextRunDate,
+		sc.Active,
+		sc.LastRunDate,
+		sc.LastRunStatus,
+		sc.ID,
+		runDate,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errScheduledChargeMoved
+	}
+
+	return nil
+}
+
+//RemoveScheduledCharge deletes a scheduled charge and its runs from the sqlite db
+func (s sqliteStore) RemoveScheduledCharge(ctx context.Context, id int64) error {
+	tx, err := s.c.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		DELETE FROM ` + sqliteutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID = ?
+	`
+	_, err = tx.Exec(q, id)
+	if err != nil {
+		return err
+	}
+
+	q = `
+		DELETE FROM ` + sqliteutils.TableScheduledCharges + `
+		WHERE ID = ?
+	`
+	_, err = tx.Exec(q, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//AddScheduledChargeRun records the start of a run in the sqlite db
+//the unique index on the schedule and date means only one run is saved if two are started at once
+func (s sqliteStore) AddScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error {
+	q := `
+		INSERT INTO ` + sqliteutils.TableScheduledChargeRuns + ` (
+			ScheduledChargeID,
+			RunDate,
+			Status,
+			ChargeID,
+			AmountCents,
+			Currency,
+			Invoice,
+			Po,
+			Error,
+			IdempotencyKey,
+			DatetimeStarted,
+			DatetimeFinished
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(ScheduledChargeID, RunDate) DO NOTHING
+	`
+
+	res, err := s.c.Exec(
+		q,
+		run.ScheduledChargeID,
+		run.RunDate,
+		run.Status,
+		run.ChargeID,
+		run.AmountCents,
+		run.Currency,
+		run.Invoice,
+		run.Po,
+		run.Error,
+		run.IdempotencyKey,
+		run.DatetimeStarted,
+		run.DatetimeFinished,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errScheduledChargeRunExists
+	}
+
+	return nil
+}
+
+//FindScheduledChargeRun looks up the run of a scheduled charge for a date in the sqlite db
+func (s sqliteStore) FindScheduledChargeRun(ctx context.Context, scheduledChargeID int64, runDate string) (ScheduledChargeRun, error) {
+	run := ScheduledChargeRun{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID = ? AND RunDate = ?
+	`
+	err := s.c.Get(&run, q, scheduledChargeID, runDate)
+	if err == sql.ErrNoRows {
+		return run, errScheduledChargeRunNotFound
+	}
+
+	return run, err
+}
+
+//UpdateScheduledChargeRun saves the outcome of a run to the sqlite db
+func (s sqliteStore) UpdateScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error {
+	q := `
+		UPDATE ` + sqliteutils.TableScheduledChargeRuns + `
+		SET
+			Status = ?,
+			ChargeID = ?,
+			AmountCents = ?,
+			Currency = ?,
+			Invoice = ?,
+			Po = ?,
+			Error = ?,
+			IdempotencyKey = ?,
+			DatetimeStarted = ?,
+			DatetimeFinished = ?
+		WHERE ScheduledChargeID = ? AND RunDate = ?
+	`
+
+	_, err := s.c.Exec(
+		q,
+		run.Status,
+		run.ChargeID,
+		run.AmountCents,
+		run.Currency,
+		run.Invoice,
+		run.Po,
+		run.Error,
+		run.IdempotencyKey,
+		run.DatetimeStarted,
+		run.DatetimeFinished,
+		run.ScheduledChargeID,
+		run.RunDate,
+	)
+	return err
+}
+
+//FindScheduledChargeRuns returns the most recent runs of a scheduled charge from the sqlite db
+func (s sqliteStore) FindScheduledChargeRuns(ctx context.Context, scheduledChargeID int64, limit int) ([]ScheduledChargeRun, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableScheduledChargeRuns + `
+		WHERE ScheduledChargeID = ?
+		ORDER BY RunDate DESC
+		LIMIT ?
+	`
+
+	runs := []ScheduledChargeRun{}
+	err := s.c.Select(&runs, q, scheduledChargeID, limit)
+	return runs, err
+}
+
+//AddBatchJob saves a batch and its rows to the sqlite db before the rows are charged
+//this is done in a transaction so a batch is never saved without its rows
+func (s sqliteStore) AddBatchJob(ctx context.Context, j BatchJob, rows []BatchRow) error {
+	tx, err := s.c.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+		INSERT INTO ` + sqliteutils.TableBatchJobs + ` (
+			BatchID,
+			NumRows,
+			Username,
+			DatetimeStarted,
+			DatetimeFinished
+		) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(BatchID) DO NOTHING
+	`
+	res, err := tx.Exec(q, j.BatchID, j.NumRows, j.Username, j.DatetimeStarted, j.DatetimeFinished)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errBatchJobExists
+	}
+
+	q = `
+		INSERT INTO ` + sqliteutils.TableBatchRows + ` (
+			BatchID,
+			RowNumber,
+			CustomerID,
+			CustomerName,
+			CustomerDatastoreID,
+			SavedCardID,
+			CardLast4,
+			Amount,
+			AmountCents,
+			Currency,
+			Invoice,
+			Po,
+			Level3,
+			Level3Params,
+			Status,
+			ChargeID,
+			Error,
+			EmailError,
+			DatetimeStarted,
+			DatetimeFinished
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	for _, row := range rows {
+		_, err = tx.Exec(
+			q,
+			row.BatchID,
+			row.RowNumber,
+			row.CustomerID,
+			row.CustomerName,
+			row.CustomerDatastoreID,
+			row.SavedCardID,
+			row.CardLast4,
+			row.Amount,
+			row.AmountCents,
+			row.Currency,
+			row.Invoice,
+			row.Po,
+			row.Level3,
+			row.Level3Params,
+			row.Status,
+			row.ChargeID,
+			row.Error,
+			row.EmailError,
+			row.DatetimeStarted,
+			row.DatetimeFinished,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//FindBatchJob looks up a batch by its id in the sqlite db
+func (s sqliteStore) FindBatchJob(ctx context.Context, batchID string) (BatchJob, error) {
+	j := BatchJob{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableBatchJobs + `
+		WHERE BatchID = ?
+	`
+	err := s.c.Get(&j, q, batchID)
+	if err == sql.ErrNoRows {
+		return j, errBatchJobNotFound
+	}
+
+	return j, err
+}
+
+//FindUnfinishedBatchJobs returns the batches in the sqlite db that still have rows to charge
+func (s sqliteStore) FindUnfinishedBatchJobs(ctx context.Context) ([]BatchJob, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableBatchJobs + `
+		WHERE DatetimeFinished = ''
+		ORDER BY ID
+	`
+
+	jobs := []BatchJob{}
+	err := s.c.Select(&jobs, q)
+	return jobs, err
+}
+
+//FinishBatchJob notes that every row of a batch in the sqlite db was charged or failed
+func (s sqliteStore) FinishBatchJob(ctx context.Context, batchID, datetimeFinished string) error {
+	q := `
+		UPDATE ` + sqliteutils.TableBatchJobs + `
+		SET DatetimeFinished = ?
+		WHERE BatchID = ?
+	`
+
+	_, err := s.c.Exec(q, datetimeFinished, batchID)
+	return err
+}
+
+//FindBatchRows returns the rows of a batch from the sqlite db in the order they are in the file
+func (s sqliteStore) FindBatchRows(ctx context.Context, batchID string) ([]BatchRow, error) {
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableBatchRows + `
+		WHERE BatchID = ?
+		ORDER BY RowNumber
+	`
+
+	rows := []BatchRow{}
+	err := s.c.Select(&rows, q, batchID)
+	return rows, err
+}
+
+//StartBatchRow saves the status and start time of a row in the sqlite db that is about to be charged
+//the row is only changed if it is still pending so two servers never charge the same row
+func (s sqliteStore) StartBatchRow(ctx context.Context, row BatchRow) error {
+	q := `
+		UPDATE ` + sqliteutils.TableBatchRows + `
+		SET
+			Status = ?,
+			DatetimeStarted = ?
+		WHERE BatchID = ? AND RowNumber = ? AND Status = ?
+	`
+
+	res, err := s.c.Exec(q, row.Status, row.DatetimeStarted, row.BatchID, row.RowNumber, batchRowPending)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errBatchRowStarted
+	}
+
+	return nil
+}
+
+//UpdateBatchRow saves the outcome of charging a row to the sqlite db
+func (s sqliteStore) UpdateBatchRow(ctx context.Context, row BatchRow) error {
+	q := `
+		UPDATE ` + sqliteutils.TableBatchRows + `
+		SET
+			Status = ?,
+			ChargeID = ?,
+			Error = ?,
+			EmailError = ?,
+			DatetimeStarted = ?,
+			DatetimeFinished = ?
+		WHERE BatchID = ? AND RowNumber = ?
+	`
+
+	_, err := s.c.Exec(
+		q,
+		row.Status,
+		row.ChargeID,
+		row.Error,
+		row.EmailError,
+		row.DatetimeStarted,
+		row.DatetimeFinished,
+		row.BatchID,
+		row.RowNumber,
+	)
+	return err
+}
@@ -0,0 +1,161 @@
+package card
+
+import (
+	"context"
+)
+
+//Store is the set of functions used to save and retrieve cards from a database.
+//Each database we support (cloud datastore, sqlite) has its own implementation of
+//this interface.  The implementation to use is chosen once in package main init()
+//and saved via SetStore so that handlers never have to check which database is used.
+type Store interface {
+	//GetAll returns the datastore id and customer name for every card
+	GetAll(ctx context.Context) ([]List, error)
+
+	//FindAll returns the full data for every card
+	FindAll(ctx context.Context) ([]CustomerDatastore, error)
+
+	//FindByID looks up a card by its datastore id
+	FindByID(ctx context.Context, datastoreID int64) (CustomerDatastore, error)
+
+	//FindByCustomerID looks up a card by the id from a CRM system, errCustomerNotFound
+	//is returned if no card exists with this id
+	FindByCustomerID(ctx context.Context, customerID string) (CustomerDatastore, error)
+
+	//Add saves a new card and returns the new card's datastore id
+	Add(ctx context.Context, customer CustomerDatastore) (int64, error)
+
+	//UpdateLastUsed sets the LastUsedTimestamp for a card
+	UpdateLastUsed(ctx context.Context, datastoreID, timestamp int64) error
+
+	//UpdateBillingEmail sets the email address of a customer's billing contact
+	UpdateBillingEmail(ctx context.Context, datastoreID int64, billingEmail string) error
+
+	//Remove deletes a card by its datastore id, the customer's saved cards and scheduled charges
+	//are deleted as well
+	Remove(ctx context.Context, datastoreID int64) error
+
+	//FindSavedCards returns the cards saved for a customer, the default card first and then
+	//oldest first
+	FindSavedCards(ctx context.Context, customerDatastoreID int64) ([]SavedCard, error)
+
+	//AddSavedCard saves a new card for a customer and returns the card's id
+	AddSavedCard(ctx context.Context, c SavedCard) (int64, error)
+
+	//UpdateDefaultCard marks a saved card as the customer's default card and copies the card's
+	//details to the customer
+	UpdateDefaultCard(ctx context.Context, c SavedCard) error
+
+	//FindSavedCardByStripeID looks up a saved card by the id of the card on Stripe,
+	//errCardNotFound is returned if no card has this id
+	FindSavedCardByStripeID(ctx context.Context, stripeCardID string) (SavedCard, error)
+
+	//UpdateSavedCard saves changes to a card (stripe card id, cardholder, expiration, last4, brand,
+	//and who updated the card and when), the details are copied to the customer as well if this
+	//is the customer's default card
+	UpdateSavedCard(ctx context.Context, c SavedCard) error
+
+	//RemoveSavedCard deletes one saved card by its id
+	RemoveSavedCard(ctx context.Context, id int64) error
+
+	//FindSavedCardsByExpiration returns the saved cards that expire on a given MM/YYYY
+	FindSavedCardsByExpiration(ctx context.Context, monthYear string) ([]SavedCard, error)
+
+	//FindByExpiration returns the cards that expire on a given MM/YYYY
+	//only the ID and StripeCustomerToken fields are filled in
+	FindByExpiration(ctx context.Context, monthYear string) ([]CustomerDatastore, error)
+
+	//FindUnused returns the cards that haven't been used since a given unix timestamp
+	//only the ID and StripeCustomerToken fields are filled in
+	FindUnused(ctx context.Context, minTimestamp int64) ([]CustomerDatastore, error)
+
+	//SaveLedgerEntry saves a charge or refund to the ledger, replacing any existing entry
+	//with the same StripeID
+	SaveLedgerEntry(ctx context.Context, e LedgerEntry) error
+
+	//FindLedgerEntry looks up a ledger entry by its Stripe id, errLedgerEntryNotFound is
+	//returned if the entry doesn't exist
+	FindLedgerEntry(ctx context.Context, stripeID string) (LedgerEntry, error)
+
+	//FindLedgerEntries returns the ledger entries matching a filter, oldest first
+	FindLedgerEntries(ctx context.Context, f LedgerFilter) ([]LedgerEntry, error)
+
+	//FindWebhookEvent looks up a handled webhook event by its Stripe id, errWebhookEventNotFound
+	//is returned if the event hasn't been handled
+	FindWebhookEvent(ctx context.Context, stripeEventID string) (WebhookEvent, error)
+
+	//SaveWebhookEvent records that a webhook event was handled
+	SaveWebhookEvent(ctx context.Context, e WebhookEvent) error
+
+	//FindScheduledCharges returns the scheduled charges for a customer, oldest first
+	FindScheduledCharges(ctx context.Context, customerDatastoreID int64) ([]ScheduledCharge, error)
+
+	//FindScheduledCharge looks up a scheduled charge by its id, errScheduledChargeNotFound is
+	//returned if the scheduled charge doesn't exist
+	FindScheduledCharge(ctx context.Context, id int64) (ScheduledCharge, error)
+
+	//FindDueScheduledCharges returns the active scheduled charges with a NextRunDate on or
+	//before a given yyyy-mm-dd date
+	FindDueScheduledCharges(ctx context.Context, date string) ([]ScheduledCharge, error)
+
+	//AddScheduledCharge saves a new scheduled charge and returns its id
+	AddScheduledCharge(ctx context.Context, s ScheduledCharge) (int64, error)
+
+	//UpdateScheduledCharge saves changes to a scheduled charge
+	UpdateScheduledCharge(ctx context.Context, s ScheduledCharge) error
+
+	//AdvanceScheduledCharge saves the outcome of a run to a scheduled charge and moves it to its
+	//next run date, the schedule is only changed if its NextRunDate is still runDate otherwise
+	//errScheduledChargeMoved is returned
+	AdvanceScheduledCharge(ctx context.Context, s ScheduledCharge, runDate string) error
+
+	//RemoveScheduledCharge deletes a scheduled charge and its runs
+	RemoveScheduledCharge(ctx context.Context, id int64) error
+
+	//AddScheduledChargeRun records the start of a run, errScheduledChargeRunExists is returned
+	//if a run was already recorded for the same scheduled charge and date
+	AddScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error
+
+	//FindScheduledChargeRun looks up the run of a scheduled charge for a date,
+	//errScheduledChargeRunNotFound is returned if the run doesn't exist
+	FindScheduledChargeRun(ctx context.Context, scheduledChargeID int64, runDate string) (ScheduledChargeRun, error)
+
+	//UpdateScheduledChargeRun saves the outcome of a run, the run is found by its scheduled
+	//charge and date
+	UpdateScheduledChargeRun(ctx context.Context, run ScheduledChargeRun) error
+
+	//FindScheduledChargeRuns returns the most recent runs of a scheduled charge, newest first
+	FindScheduledChargeRuns(ctx context.Context, scheduledChargeID int64, limit int) ([]ScheduledChargeRun, error)
+
+	//AddBatchJob saves a batch and its rows before the rows are charged, errBatchJobExists is
+	//returned if a batch with the same id was already saved
+	AddBatchJob(ctx context.Context, j BatchJob, rows []BatchRow) error
+
+	//FindBatchJob looks up a batch by its id, errBatchJobNotFound is returned if the batch doesn't exist
+	FindBatchJob(ctx context.Context, batchID string) (BatchJob, error)
+
+	//FindUnfinishedBatchJobs returns the batches that still have rows to charge, oldest first
+	FindUnfinishedBatchJobs(ctx context.Context) ([]BatchJob, error)
+
+	//FinishBatchJob notes that every row of a batch was charged or failed
+	FinishBatchJob(ctx context.Context, batchID, datetimeFinished string) error
+
+	//FindBatchRows returns the rows of a batch in the order they are in the file
+	FindBatchRows(ctx context.Context, batchID string) ([]BatchRow, error)
+
+	//StartBatchRow saves the status and start time of a row that is about to be charged, the row
+	//is only changed if it is still pending otherwise errBatchRowStarted is returned
+	StartBatchRow(ctx context.Context, row BatchRow) error
+
+	//UpdateBatchRow saves the outcome of charging a row, the row is found by its batch and row number
+	UpdateBatchRow(ctx context.Context, row BatchRow) error
+}
+
+//store is the Store that is used to save and retrieve cards
+//this is set in package main init() via SetStore
+var store Store
+
+//SetStore saves the database implementation used to save and retrieve cards
+func SetStore(s Store) {
+	store = s
+}
@@ -0,0 +1,164 @@
+package card
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+)
+
+//UpdateCard replaces one of a customer's cards with a new card
+//This is used when a card expired or was replaced by the card's bank.  The new card is attached
+//to the customer's existing Stripe customer so the customer's past charges stay linked to the
+//customer.  The saved card is updated in place and the old card is removed from Stripe.
+//The card token was generated client side by stripe.js, the same as when adding a card.
+func UpdateCard(w http.ResponseWriter, r *http.Request) {
+	//get form values
+	datastoreID, _ := strconv.ParseInt(r.FormValue("customerId"), 10, 64)
+	cardID, _ := strconv.ParseInt(r.FormValue("cardId"), 10, 64) //0 for customers added before a customer could have more than one card
+	cardholder := r.FormValue("cardholder")                      //name on card as it appears
+	cardToken := r.FormValue("cardToken")                        //from stripe.js
+	cardExp := r.FormValue("cardExp")                            //from stripe.js, not from html input
+	cardLast4 := r.FormValue("cardLast4")                        //from stripe.js, not from html input
+
+	//make sure all form values were given
+	if datastoreID == 0 {
+		output.Error(errMissingInput, "A customer's datastore ID must be given but was missing. This value should have been submitted automatically.", w)
+		return
+	}
+	if len(cardholder) == 0 {
+		output.Error(errMissingCustomerName, "You did not provide the cardholer's name.", w)
+		return
+	}
+	if len(cardToken) == 0 {
+		output.Error(errMissingCardToken, "A serious error occured; the card token is missing. Please refresh the page and try again.", w)
+		return
+	}
+	if len(cardExp) == 0 {
+		output.Error(errMissingExpiration, "The card's expiration date is missing from Stripe. Please refresh the page and try again.", w)
+		return
+	}
+	if len(cardLast4) == 0 {
+		output.Error(errMissingLast4, "The card's last four digits are missing from Stripe. Please refresh the page and try again.", w)
+		return
+	}
+
+	//need to adjust context deadline in case stripe takes longer than 5 seconds
+	//see Add
+	c := r.Context()
+	c, cancelFunc := context.WithTimeout(c, 10*time.Second)
+	defer cancelFunc()
+
+	customer, err := findByDatastoreID(c, datastoreID)
+	if err != nil {
+		output.Error(err, "Could not find this customer's data.", w)
+		return
+	}
+
+	//get username of logged in user
+	//used for tracking who replaced a card
+	username := sessionutils.GetUsername(r)
+
+	updated, err := replaceCard(c, customer, cardID, cardholder, cardExp, cardLast4, cardToken, username)
+	if err == errCardNotFound {
+		output.Error(err, "Could not find this card for this customer.", w)
+		return
+	} else if err == errCardAlreadyExists {
+		output.Error(err, "This card is already saved for this customer.", w)
+		return
+	} else if err != nil {
+		errorErr, errorMsg := addError(err)
+		output.Error(errorErr, errorMsg, w)
+		return
+	}
+
+	//done
+	output.Success("updateCard", updated, w)
+}
+
+//replaceCard swaps one of a customer's saved cards for a new card
+//The new card is saved on Stripe before anything is changed in our db, and the old card is
+//only removed from Stripe once our db is updated.  This way the customer always has a card
+//that can be charged even if one of the steps fails.
+func replaceCard(ctx context.Context, customer CustomerDatastore, cardID int64, cardholder, cardExp, cardLast4, cardToken, username string) (SavedCard, error) {
+	cards, err := store.FindSavedCards(ctx, customer.ID)
+	if err != nil {
+		return SavedCard{}, err
+	}
+
+	//save the customer's existing card first so we know which card on Stripe is being replaced
+	if len(cards) == 0 {
+		existing, err := saveExistingCard(ctx, customer)
+		if err != nil {
+			log.Println("card.replaceCard - could not save the customer's existing card", err)
+			return SavedCard{}, err
+		}
+
+		cards = append(cards, existing)
+		cardID = existing.ID
+	}
+
+	card, err := selectCard(cards, cardID, "")
+	if err != nil {
+		return SavedCard{}, err
+	}
+
+	//don't save the same card twice
+	for _, c := range cards {
+		if c.ID == card.ID {
+			continue
+		}
+		if c.CardLast4 == cardLast4 && c.CardExpiration == cardExp {
+			return SavedCard{}, errCardAlreadyExists
+		}
+	}
+
+	//add the new card to the stripe customer
+	sc := CreateStripeClient(ctx)
+	pm, err := savePaymentMethod(sc, customer.StripeCustomerToken, cardToken)
+	if err != nil {
+		return SavedCard{}, err
+	}
+
+	oldStripeCardID := card.StripeCardID
+
+	card.StripeCardID = pm.ID
+	card.Cardholder = cardholder
+	card.CardExpiration = cardExp
+	card.CardLast4 = cardLast4
+	card.CardBrand = ""
+	card.PaymentType = paymentTypeCard
+	card.BankAccountStatus = ""
+	if pm.Card != nil {
+		card.CardBrand = string(pm.Card.Brand)
+	}
+	card.DatetimeUpdated = timestamps.ISO8601()
+	card.UpdatedByUser = username
+
+	err = store.UpdateSavedCard(ctx, card)
+	if err != nil {
+		//remove the new card so the stripe customer doesn't have a card we don't know about
+		detachFromStripe(sc, customer.StripeCustomerToken, pm.ID)
+		return SavedCard{}, err
+	}
+
+	//make the new card the default on stripe so charges made from the stripe dashboard use it
+	//not returning on error since we always charge the saved card by its id
+	if card.IsDefault {
+		err = setDefaultOnStripe(sc, customer.StripeCustomerToken, pm.ID)
+		if err != nil {
+			log.Println("card.replaceCard - could not set default card on stripe", err)
+		}
+	}
+
+	//remove the old card from stripe
+	//this is done last so the webhook for the removed card doesn't find the card in our db
+	detachFromStripe(sc, customer.StripeCustomerToken, oldStripeCardID)
+
+	return card, nil
+}
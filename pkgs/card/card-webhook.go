@@ -0,0 +1,374 @@
+package card
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+//maxWebhookBodySize is the largest webhook request body we will read
+//Stripe's events are much smaller than this, this just stops someone from sending a huge request
+const maxWebhookBodySize = 65536
+
+//webhook errors
+var (
+	errWebhookNotConfigured    = errors.New("card: webhook signing secret not set")
+	errInvalidWebhookSignature = errors.New("card: invalid webhook signature")
+	errWebhookEventNotFound    = errors.New("card: webhook event not found")
+)
+
+//webhookHandler is the signature of a func that handles one type of Stripe event
+type webhookHandler func(ctx context.Context, event stripe.Event) error
+
+//webhookHandlers are the funcs that handle each type of event, chosen by the start of the event's type
+//The first matching prefix is used so charge.dispute.* and charge.refund.* events must be listed
+//before charge.* events.  Events that don't match any prefix are ignored.
+var webhookHandlers = []struct {
+	prefix  string
+	handler webhookHandler
+}{
+	{"charge.dispute.", handleDisputeEvent},
+	{"charge.refund.", handleRefundEvent},
+	{"charge.", handleChargeEvent},
+	{"customer.source.", handleSourceEvent},
+	{"payment_method.", handlePaymentMethodEvent},
+}
+
+//Webhook receives events from Stripe
+//This is how we learn about things that happen in Stripe after we made a request to Stripe's
+//api, or that didn't happen through this app at all, such as refunds finishing, disputes, charges
+//captured in the dashboard, and cards updated by the card's bank.  The Stripe-Signature header is
+//verified with the signing secret from app.yaml so we know the event came from Stripe.
+//Events are saved once they are handled so an event Stripe sends more than once is only handled
+//once.  An error is returned to Stripe if an event can't be handled so Stripe sends it again later.
+func Webhook(w http.ResponseWriter, r *http.Request) {
+	if Config.StripeWebhookSecret == "" {
+		output.Error(errWebhookNotConfigured, "The Stripe webhook signing secret is not set in app.yaml.", w)
+		return
+	}
+
+	//read and verify the event
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		output.Error(err, "Could not read the webhook request.", w)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), Config.StripeWebhookSecret)
+	if err != nil {
+		log.Println("card.Webhook - could not verify event", err)
+		output.Error(errInvalidWebhookSignature, "The webhook signature could not be verified.", w)
+		return
+	}
+
+	//skip events we already handled
+	c := r.Context()
+	_, err = store.FindWebhookEvent(c, event.ID)
+	if err == nil {
+		output.Success("webhookAlreadyHandled", nil, w)
+		return
+	} else if err != errWebhookEventNotFound {
+		output.Error(err, "Could not check if this event was already handled.", w)
+		return
+	}
+
+	//handle the event
+	err = handleWebhookEvent(c, event)
+	if err != nil {
+		log.Println("card.Webhook - could not handle event", event.ID, event.Type, err)
+		output.Error(err, "Could not handle this event.", w)
+		return
+	}
+
+	//remember this event was handled
+	//not returning an error since handling an event again is harmless
+	err = store.SaveWebhookEvent(c, WebhookEvent{
+		StripeEventID:     event.ID,
+		Type:              event.Type,
+		Created:           event.Created,
+		DatetimeProcessed: timestamps.ISO8601(),
+	})
+	if err != nil {
+		log.Println("card.Webhook - could not save event", event.ID, err)
+	}
+
+	output.Success("webhookHandled", nil, w)
+}
+
+//handleWebhookEvent passes an event to the func that handles its type of event
+func handleWebhookEvent(ctx context.Context, event stripe.Event) error {
+	if event.Data == nil {
+		return nil
+	}
+
+	for _, h := range webhookHandlers {
+		if strings.HasPrefix(event.Type, h.prefix) {
+			return h.handler(ctx, event)
+		}
+	}
+
+	return nil
+}
+
+//handleChargeEvent saves a charge to the ledger when it is created, captured, refunded, or updated
+//The charge is retrieved from Stripe instead of using the charge in the event so we save the
+//charge's latest data along with its balance transaction.
+func handleChargeEvent(ctx context.Context, event stripe.Event) error {
+	var chg stripe.Charge
+	err := json.Unmarshal(event.Data.Raw, &chg)
+	if err != nil {
+		return err
+	}
+
+	return syncCharge(ctx, chg.ID)
+}
+
+//handleRefundEvent saves a refund to the ledger when its status changes
+//i.e.: a refund that was pending succeeded or failed
+func handleRefundEvent(ctx context.Context, event stripe.Event) error {
+	var ref stripe.Refund
+	err := json.Unmarshal(event.Data.Raw, &ref)
+	if err != nil {
+		return err
+	}
+	if ref.Charge == nil {
+		return nil
+	}
+
+	return syncCharge(ctx, ref.Charge.ID)
+}
+
+//handleDisputeEvent saves the disputed charge to the ledger when a dispute is opened, changes, or is closed
+//a dispute that is lost refunds the charge so the amount refunded of the charge changes
+func handleDisputeEvent(ctx context.Context, event stripe.Event) error {
+	var d stripe.Dispute
+	err := json.Unmarshal(event.Data.Raw, &d)
+	if err != nil {
+		return err
+	}
+	if d.Charge == nil {
+		return nil
+	}
+
+	log.Println("card.handleDisputeEvent -", event.Type, d.ID, "for charge", d.Charge.ID, "status", d.Status)
+	return syncCharge(ctx, d.Charge.ID)
+}
+
+//syncCharge saves a charge and its refunds to the ledger
+//Entries that already exist are updated.  The refunds are always looked up, even if nothing
+//was refunded, since a refund that failed is no longer counted in the amount refunded.
+func syncCharge(ctx context.Context, chargeID string) error {
+	sc := CreateStripeClient(ctx)
+	params := &stripe.ChargeParams{}
+	params.AddExpand("balance_transaction")
+	chg, err := sc.Charges.Get(chargeID, params)
+	if err != nil {
+		return err
+	}
+
+	err = saveChargeToLedger(ctx, chg)
+	if err != nil {
+		return err
+	}
+
+	refundParams := &stripe.RefundListParams{
+		Charge: stripe.String(chargeID),
+	}
+	refundParams.Filters.AddFilter("limit", "", "100")
+	refundParams.AddExpand("data.balance_transaction")
+
+	refunds := sc.Refunds.List(refundParams)
+	for refunds.Next() {
+		err = saveRefundToLedger(ctx, refunds.Refund(), chg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return refunds.Err()
+}
+
+//handleSourceEvent updates or removes a saved card when the card is changed on Stripe
+//Cards saved before we used PaymentMethods are sources on the Stripe customer.  A card's bank
+//can update the card's expiration or number, and a card can be removed in the Stripe dashboard.
+//Bank accounts are sources as well, a bank account is updated when it is verified or can't be
+//charged anymore (i.e.: the account was closed).
+func handleSourceEvent(ctx context.Context, event stripe.Event) error {
+	switch event.GetObjectValue("object") {
+	case "card":
+	case "bank_account":
+		return handleBankAccountEvent(ctx, event)
+	default:
+		return nil
+	}
+
+	var card stripe.Card
+	err := json.Unmarshal(event.Data.Raw, &card)
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case "customer.source.updated", "customer.source.expiring":
+		return updateSavedCard(ctx, card.ID, card.Name, uint64(card.ExpMonth), uint64(card.ExpYear), card.Last4, string(card.Brand))
+	case "customer.source.deleted":
+		return forgetCard(ctx, card.ID)
+	}
+
+	return nil
+}
+
+//handleBankAccountEvent updates or removes a saved bank account when the bank account is changed on Stripe
+func handleBankAccountEvent(ctx context.Context, event stripe.Event) error {
+	var ba stripe.BankAccount
+	err := json.Unmarshal(event.Data.Raw, &ba)
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case "customer.source.updated":
+		c, err := store.FindSavedCardByStripeID(ctx, ba.ID)
+		if err == errCardNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if ba.AccountHolderName != "" {
+			c.Cardholder = ba.AccountHolderName
+		}
+		c.CardLast4 = ba.Last4
+		c.CardBrand = ba.BankName
+		c.BankAccountStatus = string(ba.Status)
+		c.DatetimeUpdated = timestamps.ISO8601()
+		c.UpdatedByUser = updatedByStripe
+
+		return store.UpdateSavedCard(ctx, c)
+	case "customer.source.deleted":
+		return forgetCard(ctx, ba.ID)
+	}
+
+	return nil
+}
+
+//handlePaymentMethodEvent updates or removes a saved card when the card is changed on Stripe
+//A card's bank can update the card's expiration or number (automatically_updated), and a card
+//can be removed in the Stripe dashboard (detached).
+func handlePaymentMethodEvent(ctx context.Context, event stripe.Event) error {
+	var pm stripe.PaymentMethod
+	err := json.Unmarshal(event.Data.Raw, &pm)
+	if err != nil {
+		return err
+	}
+	if pm.Card == nil {
+		return nil
+	}
+
+	switch event.Type {
+	case "payment_method.updated", "payment_method.automatically_updated":
+		cardholder := ""
+		if pm.BillingDetails != nil {
+			cardholder = pm.BillingDetails.Name
+		}
+
+		return updateSavedCard(ctx, pm.ID, cardholder, pm.Card.ExpMonth, pm.Card.ExpYear, pm.Card.Last4, string(pm.Card.Brand))
+	case "payment_method.detached":
+		return forgetCard(ctx, pm.ID)
+	}
+
+	return nil
+}
+
+//updatedByStripe is saved as the user who updated a card when the card was changed on Stripe
+//i.e.: the card's bank sent Stripe a new expiration
+const updatedByStripe = "stripe"
+
+//updateSavedCard saves the new details of a card that was changed on Stripe
+//cards that aren't saved in this app are ignored, the cardholder is only changed if one is given
+func updateSavedCard(ctx context.Context, stripeCardID, cardholder string, expMonth, expYear uint64, last4, brand string) error {
+	c, err := store.FindSavedCardByStripeID(ctx, stripeCardID)
+	if err == errCardNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if cardholder != "" {
+		c.Cardholder = cardholder
+	}
+	c.CardExpiration = strconv.FormatUint(expMonth, 10) + "/" + strconv.FormatUint(expYear, 10)
+	c.CardLast4 = last4
+	c.CardBrand = brand
+	c.DatetimeUpdated = timestamps.ISO8601()
+	c.UpdatedByUser = updatedByStripe
+
+	return store.UpdateSavedCard(ctx, c)
+}
+
+//forgetCard removes a saved card that was removed from the Stripe customer
+//The card is removed from our db but nothing is removed from Stripe.  If the default card was
+//removed, the oldest remaining card becomes the default.  A customer's only card is kept so the
+//customer still shows up in the gui, charging it will fail until the card is replaced.
+func forgetCard(ctx context.Context, stripeCardID string) error {
+	c, err := store.FindSavedCardByStripeID(ctx, stripeCardID)
+	if err == errCardNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cards, err := store.FindSavedCards(ctx, c.CustomerDatastoreID)
+	if err != nil {
+		return err
+	}
+	if len(cards) <= 1 {
+		log.Println("card.forgetCard - the only card of customer", c.CustomerDatastoreID, "was removed on Stripe")
+		return nil
+	}
+
+	err = store.RemoveSavedCard(ctx, c.ID)
+	if err != nil {
+		return err
+	}
+
+	if !c.IsDefault {
+		return nil
+	}
+
+	for _, remaining := range cards {
+		if remaining.ID == c.ID {
+			continue
+		}
+
+		//the card is saved as the default first so our db is correct even if Stripe can't be updated
+		err = store.UpdateDefaultCard(ctx, remaining)
+		if err != nil {
+			return err
+		}
+
+		customer, err := findByDatastoreID(ctx, c.CustomerDatastoreID)
+		if err != nil {
+			return err
+		}
+
+		sc := CreateStripeClient(ctx)
+		err = setDefaultOnStripe(sc, customer.StripeCustomerToken, remaining.StripeCardID)
+		if err != nil {
+			log.Println("card.forgetCard - Could not set default card on stripe", err)
+		}
+		return nil
+	}
+
+	return nil
+}
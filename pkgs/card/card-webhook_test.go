@@ -0,0 +1,250 @@
+package card
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestHandleWebhookEventPrefix(t *testing.T) {
+	//keep the real prefixes, in the real order, but record which one was chosen
+	var handled []string
+	old := webhookHandlers
+	webhookHandlers = append(webhookHandlers[:0:0], old...)
+	for i := range webhookHandlers {
+		prefix := webhookHandlers[i].prefix
+		webhookHandlers[i].handler = func(ctx context.Context, event stripe.Event) error {
+			handled = append(handled, prefix)
+			return nil
+		}
+	}
+	defer func() { webhookHandlers = old }()
+
+	tests := []struct {
+		eventType string
+		want      string
+	}{
+		{"charge.dispute.created", "charge.dispute."},
+		{"charge.dispute.funds_withdrawn", "charge.dispute."},
+		{"charge.refund.updated", "charge.refund."},
+		{"charge.refunded", "charge."},
+		{"charge.captured", "charge."},
+		{"charge.succeeded", "charge."},
+		{"customer.source.updated", "customer.source."},
+		{"customer.source.deleted", "customer.source."},
+		{"payment_method.detached", "payment_method."},
+		{"customer.created", ""},
+		{"invoice.paid", ""},
+	}
+
+	for _, tt := range tests {
+		handled = nil
+		event := stripe.Event{Type: tt.eventType, Data: &stripe.EventData{}}
+		if err := handleWebhookEvent(context.Background(), event); err != nil {
+			t.Errorf("%s: handleWebhookEvent() error = %v", tt.eventType, err)
+			continue
+		}
+
+		got := ""
+		if len(handled) > 1 {
+			t.Errorf("%s: handled by %v, want only %q", tt.eventType, handled, tt.want)
+			continue
+		} else if len(handled) == 1 {
+			got = handled[0]
+		}
+		if got != tt.want {
+			t.Errorf("%s: handled by %q, want %q", tt.eventType, got, tt.want)
+		}
+	}
+
+	//events without any data are ignored
+	handled = nil
+	if err := handleWebhookEvent(context.Background(), stripe.Event{Type: "charge.captured"}); err != nil || len(handled) != 0 {
+		t.Errorf("event without data: handled by %v, error = %v, want it ignored", handled, err)
+	}
+}
+
+//webhookTestStore is a Store with the saved cards used to test forgetting a card
+//only the methods used when forgetting a card are implemented
+type webhookTestStore struct {
+	Store
+	customers map[int64]CustomerDatastore
+	cards     []SavedCard
+}
+
+func (s *webhookTestStore) FindByID(ctx context.Context, datastoreID int64) (CustomerDatastore, error) {
+	c, ok := s.customers[datastoreID]
+	if !ok {
+		return c, errCustomerNotFound
+	}
+
+	return c, nil
+}
+
+func (s *webhookTestStore) FindSavedCardByStripeID(ctx context.Context, stripeCardID string) (SavedCard, error) {
+	for _, c := range s.cards {
+		if c.StripeCardID == stripeCardID {
+			return c, nil
+		}
+	}
+
+	return SavedCard{}, errCardNotFound
+}
+
+func (s *webhookTestStore) FindSavedCards(ctx context.Context, customerDatastoreID int64) ([]SavedCard, error) {
+	cards := []SavedCard{}
+	for _, c := range s.cards {
+		if c.CustomerDatastoreID == customerDatastoreID {
+			cards = append(cards, c)
+		}
+	}
+
+	sort.SliceStable(cards, func(i, j int) bool {
+		if cards[i].IsDefault != cards[j].IsDefault {
+			return cards[i].IsDefault
+		}
+		return cards[i].ID < cards[j].ID
+	})
+	return cards, nil
+}
+
+func (s *webhookTestStore) RemoveSavedCard(ctx context.Context, id int64) error {
+	for i, c := range s.cards {
+		if c.ID == id {
+			s.cards = append(s.cards[:i], s.cards[i+1:]...)
+			return nil
+		}
+	}
+
+	return errCardNotFound
+}
+
+func (s *webhookTestStore) UpdateDefaultCard(ctx context.Context, c SavedCard) error {
+	for i := range s.cards {
+		if s.cards[i].CustomerDatastoreID == c.CustomerDatastoreID {
+			s.cards[i].IsDefault = s.cards[i].ID == c.ID
+		}
+	}
+
+	return nil
+}
+
+//stripeTestTransport records the requests made to Stripe instead of sending them
+type stripeTestTransport struct {
+	requests []string
+}
+
+func (tr *stripeTestTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := ""
+	if r.Body != nil {
+		b, _ := ioutil.ReadAll(r.Body)
+		body, _ = url.QueryUnescape(string(b))
+	}
+	tr.requests = append(tr.requests, r.Method+" "+r.URL.Path+" "+body)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"id": "cus_1", "object": "customer"}`)),
+		Request:    r,
+	}, nil
+}
+
+func TestForgetCard(t *testing.T) {
+	newStore := func() *webhookTestStore {
+		return &webhookTestStore{
+			customers: map[int64]CustomerDatastore{
+				1: {ID: 1, StripeCustomerToken: "cus_1"},
+				2: {ID: 2, StripeCustomerToken: "cus_2"},
+			},
+			cards: []SavedCard{
+				{ID: 10, CustomerDatastoreID: 1, StripeCardID: "pm_default", IsDefault: true},
+				{ID: 11, CustomerDatastoreID: 1, StripeCardID: "card_older"},
+				{ID: 12, CustomerDatastoreID: 1, StripeCardID: "pm_newer"},
+				{ID: 20, CustomerDatastoreID: 2, StripeCardID: "pm_only", IsDefault: true},
+			},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		stripeCardID string
+		wantCards    []int64 //ids of the cards left, the default card first
+		wantRequests []string
+	}{
+		{
+			name:         "card not saved in this app",
+			stripeCardID: "pm_unknown",
+			wantCards:    []int64{10, 11, 12, 20},
+		},
+		{
+			name:         "customer's only card is kept",
+			stripeCardID: "pm_only",
+			wantCards:    []int64{10, 11, 12, 20},
+		},
+		{
+			name:         "card that isn't the default",
+			stripeCardID: "pm_newer",
+			wantCards:    []int64{10, 11, 20},
+		},
+		{
+			name:         "default card is handed over to the oldest card",
+			stripeCardID: "pm_default",
+			wantCards:    []int64{11, 12, 20},
+			wantRequests: []string{"POST /v1/customers/cus_1 default_source=card_older"},
+		},
+	}
+
+	oldStore := store
+	oldTransport := http.DefaultClient.Transport
+	defer func() {
+		SetStore(oldStore)
+		http.DefaultClient.Transport = oldTransport
+	}()
+
+	for _, tt := range tests {
+		s := newStore()
+		SetStore(s)
+		tr := &stripeTestTransport{}
+		http.DefaultClient.Transport = tr
+
+		if err := forgetCard(context.Background(), tt.stripeCardID); err != nil {
+			t.Errorf("%s: forgetCard() error = %v", tt.name, err)
+			continue
+		}
+
+		got := []int64{}
+		for _, customerID := range []int64{1, 2} {
+			cards, _ := s.FindSavedCards(context.Background(), customerID)
+			for _, c := range cards {
+				got = append(got, c.ID)
+			}
+		}
+		if len(got) != len(tt.wantCards) {
+			t.Errorf("%s: cards left %v, want %v", tt.name, got, tt.wantCards)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.wantCards[i] {
+				t.Errorf("%s: cards left %v, want %v", tt.name, got, tt.wantCards)
+				break
+			}
+		}
+
+		if len(tr.requests) != len(tt.wantRequests) {
+			t.Errorf("%s: requests to Stripe %q, want %q", tt.name, tr.requests, tt.wantRequests)
+			continue
+		}
+		for i := range tr.requests {
+			if tr.requests[i] != tt.wantRequests[i] {
+				t.Errorf("%s: request to Stripe %q, want %q", tt.name, tr.requests[i], tt.wantRequests[i])
+			}
+		}
+	}
+}
@@ -25,24 +25,16 @@ package card
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
 	"errors"
-	"log"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/datastore"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
 	"github.com/stripe/stripe-go/v72"
 	"github.com/stripe/stripe-go/v72/client"
-	"github.com/stripe/stripe-go/v72/event"
-	"google.golang.org/api/iterator"
 )
 
 //config is the set of configuraton option for processing charges on cards
@@ -50,22 +42,20 @@ import (
 type config struct {
 	StripeSecretKey      string //a 32 character long string starting with "sk_live_" or "sk_test_"
 	StripePublishableKey string //a 32 character long string starting with "pk_live_" or "pk_test_"
+	StripeWebhookSecret  string //the signing secret of the webhook endpoint, starts with "whsec_", the webhook is disabled if blank
 }
 
 //Config is a copy of the config struct with some defaults set
 var Config = config{
 	StripeSecretKey:      "",
 	StripePublishableKey: "",
+	StripeWebhookSecret:  "",
 }
 
 const (
 	//stripeKeyLength is the required size of the stripe keys
 	stripeKeyLength = 32
 
-	//currency for transactions
-	//this should be a simple change for other currencies, but you will need to change the "$" symbol elsewhere in this code base
-	currency = "usd"
-
 	//minCharge is the lowest charge the app will allow
 	//Stripe takes $0.30 + 2.9% of transactions so it is not worth collecting a charge that will cost us more then we will make
 	//this is in cents
@@ -74,7 +64,8 @@ const (
 
 //configuration errors
 var (
-	errSecretKeyInvalid = errors.New("card: the stripe secret key in app.yaml is invalid")
+	errSecretKeyInvalid     = errors.New("card: the stripe secret key in app.yaml is invalid")
+	errWebhookSecretInvalid = errors.New("card: the stripe webhook secret in app.yaml is invalid")
 	// errPublishableKeyInvalid      = errors.New("card: the stripe publishable key in app.yaml is invalid")
 	errMissingStatementDescriptor = errors.New("company: missing statement descriptor")
 )
@@ -93,6 +84,8 @@ var (
 	// errChargeAmountTooLow   = errors.New("card: amount less than min charge")
 	errCustomerNotFound    = errors.New("card: customer not found")
 	errCustIDAlreadyExists = errors.New("card: customer id already exists")
+	errLedgerEntryNotFound = errors.New("card: ledger entry not found")
+	errInvalidBillingEmail = errors.New("card: invalid billing email")
 )
 
 //SetConfig saves the configuration options for charging cards
@@ -109,6 +102,12 @@ func SetConfig(c config) error {
 		return errSecretKeyInvalid
 	}
 
+	//the webhook is optional
+	c.StripeWebhookSecret = strings.TrimSpace(c.StripeWebhookSecret)
+	if c.StripeWebhookSecret != "" && !strings.HasPrefix(c.StripeWebhookSecret, "whsec_") {
+		return errWebhookSecretInvalid
+	}
+
 	//save config to package variable
 	Config = c
 
@@ -119,51 +118,12 @@ func SetConfig(c config) error {
 //This only gets the datastore id and customer name.
 //This is used to build the datalist in the gui of customers who we can process a charge for.
 func GetAll(w http.ResponseWriter, r *http.Request) {
-	//placeholder
-	list := []List{}
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT ID, CustomerName 
-			FROM ` + sqliteutils.TableCards
-		err := c.Select(&list, q)
-		if err != nil {
-			output.Error(err, "Error retrieving list of cards from sqlite.", w)
-			return
-		}
-
-	} else {
-		//connect to datastore
-		c := r.Context()
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			output.Error(err, "Could not connect to datastore", w)
-			return
-		}
-
-		//get list from datastore
-		//only need to get entity keys and customer names which cuts down on datastore usage
-		q := datastore.NewQuery(datastoreutils.EntityCards).Order("CustomerName").Project("CustomerName")
-		i := client.Run(c, q)
-		for {
-			one := CustomerDatastore{}
-			key, err := i.Next(&one)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				output.Error(err, "Error retrieving list of cards from datastore.", w)
-				return
-			}
-
-			l := List{
-				CustomerName: one.CustomerName,
-				ID:           key.ID,
-			}
-			list = append(list, l)
-		}
+	//get list from db
+	c := r.Context()
+	list, err := store.GetAll(c)
+	if err != nil {
+		output.Error(err, "Error retrieving list of cards.", w)
+		return
 	}
 
 	//return data to client
@@ -185,114 +145,28 @@ func GetOne(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//get the customer's cards so the user can choose which card to charge
+	cards, err := FindCards(c, data)
+	if err != nil {
+		output.Error(err, "Could not find this customer's cards.", w)
+		return
+	}
+
 	//return data to client
-	output.Success("cardFound", data, w)
+	output.Success("cardFound", customerCards{data, cards}, w)
 }
 
 //findByDatastoreID retrieves a card's information by its datastore id
 //This returns all the info on a card that is needed to build the ui.
 func findByDatastoreID(c context.Context, datastoreID int64) (CustomerDatastore, error) {
-	//placeholder
-	data := CustomerDatastore{}
-	var err error
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT * 
-			FROM ` + sqliteutils.TableCards + `
-			WHERE ID=?
-		`
-		err = c.Get(&data, q, datastoreID)
-
-	} else {
-		//connect to datastore
-		client, err1 := datastoreutils.Connect(c)
-		if err1 != nil {
-			return data, err1
-		}
-
-		//get complete key
-		key := datastoreutils.GetKeyFromID(datastoreutils.EntityCards, datastoreID)
-
-		//query
-		err1 = client.Get(c, key, &data)
-		err = err1
-
-		//save the datastore id into the return value so we can use it elsewhere
-		//cloud datastore doesn't have an "ID" field like a SQL table so this value isn't returned in a query
-		//we use this value when running card.updateCardLastUsed() called when running a manual charge
-		data.ID = datastoreID
-	}
-
-	return data, err
-
+	return store.FindByID(c, datastoreID)
 }
 
 //FindByCustomerID retrieves a card's information by the unique id from a CRM system
 //This id was provided when a card was added to this app.
 //This func is used when making api style request to semi-automate the charging of a card.
-//only getting the fields we need to show data in the charge card panel
 func FindByCustomerID(c context.Context, customerID string) (CustomerDatastore, error) {
-	//placeholder
-	data := CustomerDatastore{}
-	var err error
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT * 
-			FROM ` + sqliteutils.TableCards + `
-			WHERE CustomerID=?
-		`
-		err = c.Get(&data, q, customerID)
-		if err == sql.ErrNoRows {
-			return data, errCustomerNotFound
-		}
-
-	} else {
-		//connect to datastore
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			return data, err
-		}
-
-		//query
-		fields := []string{"CustomerName", "Cardholder", "CardLast4", "CardExpiration", "StripeCustomerToken"}
-		q := datastore.NewQuery(datastoreutils.EntityCards).Filter("CustomerId =", customerID).Limit(1).Project(fields...)
-		i := client.Run(c, q)
-		var numResults int
-		for {
-			var tempCardData CustomerDatastore
-			key, err := i.Next(&tempCardData)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				log.Println("card.FindByCustomerID-1", err)
-				return data, err
-			}
-
-			//save data to variables outside iterator
-			data = tempCardData
-			numResults++
-
-			//save the datastore id into the return value so we can use it elsewhere
-			//cloud datastore doesn't have an "ID" field like a SQL table so this value isn't returned in query
-			//we use this value when running card.updateCardLastUsed() called when running an automated charged
-			data.ID = key.ID
-		}
-
-		//check if no results were found
-		if numResults == 0 {
-			return data, errCustomerNotFound
-		}
-	}
-
-	//one result was found
-	return data, err
+	return store.FindByCustomerID(c, customerID)
 }
 
 //calcTzOffset takes a string value input of the hours from UTC and outputs a timezone offset usable in golang
@@ -348,40 +222,65 @@ func CreateStripeClient(c context.Context) *client.API {
 //getAmountAsIntCents converts a dollar amount as a string into a cents integer value
 //Amounts typed in UI form are dollars as a string (12.56).
 //Need amounts as cents to process payments via Stripe (1256).
-//Make sure value doesn't add or lose decimal places during type conversions due to
-//conversions from floats to int and different precisions.
-func getAmountAsIntCents(amount string) (uint64, error) {
-	//convert string to float
-	amountFloat, err := strconv.ParseFloat(amount, 64)
-	if err != nil {
-		return 0, err
+//Cents is the smallest unit of the currency, this is the same as the amount for zero-decimal
+//currencies (500 JPY is 500) and thousandths for three-decimal currencies.
+//The amount is read digit by digit instead of as a float so it is never rounded.  An amount
+//with more decimal places than the currency has is an error instead of being rounded, and
+//three-decimal amounts must end in a zero since Stripe only charges these in tens.
+func getAmountAsIntCents(amount, currency string) (uint64, error) {
+	amount = strings.TrimSpace(amount)
+	if strings.HasPrefix(amount, "-") {
+		return 0, errNegativeAmount
 	}
 
-	//multiply float to get amount in cents
-	//may return value short one penny but with .99999 fraction of a cent, i.e.: 32.55 -> 3254.9999999999995
-	//or with additional penny but with fractions of a cent, i.e: 32.52 -> 3252.0000000000005
-	amountFloatCents := amountFloat * 100
+	//split the amount into whole units and the decimal places
+	whole, decimals := amount, ""
+	if i := strings.Index(amount, "."); i != -1 {
+		whole, decimals = amount[:i], amount[i+1:]
+	}
 
-	//get rid of strange cents
-	//add half a cent to number to "jump" to next cent if float amount was .99999 (if amount was .000005 this will not "jump" to the next cent)
-	//then round down to the nearest whole number (removing the .599999 or .5000005)
-	amountFloatCentsRounded := math.Floor(amountFloatCents + 0.5)
+	digits := whole + decimals
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, errInvalidAmount
+	}
 
-	//convert float to uint64
-	//because thats what Stripe wants to process charges
-	amountIntCents := uint64(amountFloatCentsRounded)
+	units := minorUnits(currency)
+	if len(decimals) > units {
+		return 0, errAmountTooPrecise
+	}
+
+	//pad the decimal places so the digits are the amount in cents, i.e.: 12.5 -> 1250
+	digits += strings.Repeat("0", units-len(decimals))
+	amountIntCents, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, errInvalidAmount
+	}
+
+	if units == 3 && amountIntCents%10 != 0 {
+		return 0, errAmountNotMultipleOfTen
+	}
 
-	//done
 	return amountIntCents, nil
 }
 
+//chargedAmount returns the amount a charge actually charged
+//A charge that was partially captured only charged the amount captured, the rest of the
+//authorization was released.  Charges that weren't captured return the amount authorized.
+func chargedAmount(chg *stripe.Charge) int64 {
+	if chg.Captured && chg.AmountCaptured > 0 && chg.AmountCaptured < chg.Amount {
+		return chg.AmountCaptured
+	}
+
+	return chg.Amount
+}
+
 //ExtractDataFromCharge pulls out the fields of data we want from a stripe charge object
 //we only need certain info from the stripe charge object, this pulls the needed fields out
 //also does some formating for using the data in the gui
 func ExtractDataFromCharge(chg *stripe.Charge) (data ChargeData) {
 	//charge info
 	id := chg.ID
-	amountInt := chg.Amount
+	amountInt := chargedAmount(chg)
 	captured := chg.Captured
 	capturedStr := strconv.FormatBool(captured)
 
@@ -399,29 +298,58 @@ func ExtractDataFromCharge(chg *stripe.Charge) (data ChargeData) {
 	authorizedByUser := meta["authorized_by"]
 	authorizedDate := meta["authorized_date"]
 	processedDate := meta["processed_date"]
+	releasedByUser := meta["released_by"]
+	releasedDate := meta["released_date"]
+	releaseReason := meta["release_reason"]
 
 	level3DataProvided, _ := strconv.ParseBool(meta["level3_provided"])
 
 	//customer info
-	customer := chg.Customer
-	j, _ := json.Marshal(customer)
-	customer.UnmarshalJSON(j)
-	stripeCustID := customer.ID
+	//customer is missing for charges made outside of this app without a saved card
+	stripeCustID := ""
+	if chg.Customer != nil {
+		stripeCustID = chg.Customer.ID
+	}
 
 	//card info
-	source := chg.Source
-	j2, _ := json.Marshal(source)
-	source.UnmarshalJSON(j2)
-	card := source.Card
-	cardholder := card.Name
-	expMonth := strconv.FormatInt(int64(card.ExpMonth), 10)
-	expYear := strconv.FormatInt(int64(card.ExpYear), 10)
-	exp := expMonth + "/" + expYear
-	last4 := card.Last4
-	cardBrand := string(card.Brand)
+	//charges made with a saved card have the card as the source, otherwise the card
+	//is only in the payment method details
+	//bank accounts don't expire, the bank's name is used as the card brand
+	var cardholder, exp, last4, cardBrand string
+	paymentType := paymentTypeCard
+	if chg.Source != nil && chg.Source.BankAccount != nil {
+		bank := chg.Source.BankAccount
+		paymentType = paymentTypeBankAccount
+		cardholder = bank.AccountHolderName
+		last4 = bank.Last4
+		cardBrand = bank.BankName
+	} else if chg.PaymentMethodDetails != nil && chg.PaymentMethodDetails.AchDebit != nil {
+		bank := chg.PaymentMethodDetails.AchDebit
+		paymentType = paymentTypeBankAccount
+		if chg.BillingDetails != nil {
+			cardholder = chg.BillingDetails.Name
+		}
+		last4 = bank.Last4
+		cardBrand = bank.BankName
+	} else if chg.Source != nil && chg.Source.Card != nil {
+		card := chg.Source.Card
+		cardholder = card.Name
+		exp = strconv.FormatUint(uint64(card.ExpMonth), 10) + "/" + strconv.FormatUint(uint64(card.ExpYear), 10)
+		last4 = card.Last4
+		cardBrand = string(card.Brand)
+	} else if chg.PaymentMethodDetails != nil && chg.PaymentMethodDetails.Card != nil {
+		card := chg.PaymentMethodDetails.Card
+		if chg.BillingDetails != nil {
+			cardholder = chg.BillingDetails.Name
+		}
+		exp = strconv.FormatUint(card.ExpMonth, 10) + "/" + strconv.FormatUint(card.ExpYear, 10)
+		last4 = card.Last4
+		cardBrand = string(card.Brand)
+	}
 
 	//convert amount to dollars
-	amountDollars := strconv.FormatFloat((float64(amountInt) / 100), 'f', 2, 64)
+	currency := string(chg.Currency)
+	amountDollars := FormatAmount(amountInt, currency)
 
 	//get timestamp charge was completed
 	//convert timetamp to datetime
@@ -435,6 +363,8 @@ func ExtractDataFromCharge(chg *stripe.Charge) (data ChargeData) {
 		ID:                 id,
 		AmountCents:        amountInt,
 		AmountDollars:      amountDollars,
+		Currency:           currency,
+		CurrencySymbol:     currencySymbol(currency),
 		Captured:           captured,
 		CapturedStr:        capturedStr,
 		Timestamp:          datetime,
@@ -459,85 +389,19 @@ func ExtractDataFromCharge(chg *stripe.Charge) (data ChargeData) {
 		AuthorizedDatetime: authorizedDate,
 		ProcessedDatetime:  processedDate,
 
-		FailureCode:    chg.FailureCode,
-		FailureMessage: chg.FailureMessage,
-	}
+		Released:         !captured && chg.Refunded,
+		ReleasedByUser:   releasedByUser,
+		ReleasedDatetime: releasedDate,
+		ReleaseReason:    releaseReason,
 
-	return
-}
+		PaymentType: paymentType,
+		Status:      chg.Status,
+		Pending:     chg.Status == "pending",
+		Returned:    paymentType == paymentTypeBankAccount && chg.Status == "failed",
 
-//ExtractRefundsFromEvents pulls out the data for each refund from the list of events and formats the data as needed
-//stripe does not allow easy retrieving of refund data like charge data
-//have to search in the "history" aka event log for refunds
-//then have to parse the data since the data is in json format and there is no easy way to convert the data to a struct
-//note: there can be many refunds for a single charge (that total less than or equal to the total amount charged)
-func ExtractRefundsFromEvents(eventList *event.Iter) (r []RefundData) {
-	//loop through each refund event
-	//each event is a charge
-	//each charge can have one or more refunds
-	for eventList.Next() {
-		event := eventList.Event()
-		charge := event.Data.Object
-
-		//get charge data
-		//*must* use map[string]interface and then type assert to .(string)...go throws errors otherwise
-		card := charge["source"].(map[string]interface{})
-		lastFour := card["last4"].(string)
-		expMonth := strconv.FormatInt(int64(card["exp_month"].(float64)), 10)
-		expYear := strconv.FormatInt(int64(card["exp_year"].(float64)), 10)
-		expiration := expMonth + "/" + expYear
-
-		//charge meta data
-		meta := charge["metadata"].(map[string]interface{})
-		custName := meta["customer_name"].(string)
-		invoice := meta["invoice_num"].(string)
-
-		//get refund data
-		//have to check for "null" fields
-		refundData := charge["refunds"].(map[string]interface{})
-		refundList := refundData["data"].([]interface{})
-		for _, v := range refundList {
-			refund := v.(map[string]interface{})
-			refundedAmountInt := refund["amount"].(float64)
-			refundedTimestamp := refund["created"].(float64)
-
-			refundReason := "unknown"
-			if refund["reason"] != nil {
-				refundReason = refund["reason"].(string)
-			}
-
-			refundedBy := "unknown"
-			if refund["metadata"] != nil {
-				rdMeta := refund["metadata"].(map[string]interface{})
-				if rdMeta["processed_by"] != nil {
-					refundedBy = rdMeta["processed_by"].(string)
-				}
-			}
-
-			//get refunded amount in dollars
-			refundedDollars := strconv.FormatFloat((refundedAmountInt / 100), 'f', 2, 64)
-
-			//convert timestamp to datetime
-			datetime := time.Unix(int64(refundedTimestamp), 0).Format("2006-01-02T15:04:05.000Z")
-
-			//build struct to build template with
-			rr := RefundData{
-				Refunded:      true,
-				AmountCents:   int64(refundedAmountInt),
-				AmountDollars: refundedDollars,
-				Timestamp:     datetime,
-				Invoice:       invoice,
-				LastFour:      lastFour,
-				Expiration:    expiration,
-				Customer:      custName,
-				User:          refundedBy,
-				Reason:        refundReason,
-			}
-
-			r = append(r, rr)
-		}
+		FailureCode:    chg.FailureCode,
+		FailureMessage: chg.FailureMessage,
 	}
 
-	//return list of refunds
 	return
 }
@@ -0,0 +1,51 @@
+package company
+
+import (
+	"context"
+	"log"
+
+	"cloud.google.com/go/datastore"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
+)
+
+//datastoreStore saves and retrieves the company info from the google cloud datastore
+type datastoreStore struct{}
+
+//NewDatastoreStore returns a Store that uses the google cloud datastore
+func NewDatastoreStore() Store {
+	return datastoreStore{}
+}
+
+//Get returns the saved company info
+func (s datastoreStore) Get(ctx context.Context) (Info, error) {
+	data := Info{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return data, err
+	}
+
+	//get data
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityCompanyInfo, datastoreKeyName)
+	err = client.Get(ctx, key, &data)
+	if err == datastore.ErrNoSuchEntity {
+		//no company info exists yet
+		//return default values
+		log.Println("company.Get", "Company info doesn't exist yet.  Returning default values.")
+		return defaultCompanyInfo, nil
+	}
+
+	return data, err
+}
+
+//Save saves the company info under the one and only key
+func (s datastoreStore) Save(ctx context.Context, i Info) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromName(datastoreutils.EntityCompanyInfo, datastoreKeyName)
+	_, err = client.Put(ctx, key, &i)
+	return err
+}
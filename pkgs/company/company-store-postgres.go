@@ -0,0 +1,69 @@
+package company
+
+import (
+	"context"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/postgresutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//postgresStore saves and retrieves the company info from a postgres db
+type postgresStore struct {
+	c *sqlx.DB
+}
+
+//NewPostgresStore returns a Store that uses the given postgres db connection
+func NewPostgresStore(c *sqlx.DB) Store {
+	return postgresStore{c: c}
+}
+
+//Get returns the saved company info
+//the one and only row is inserted when the db is deployed
+func (s postgresStore) Get(ctx context.Context) (Info, error) {
+	data := Info{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableCompanyInfo + `
+		WHERE ID=$1
+	`
+	err := s.c.GetContext(ctx, &data, q, postgresutils.DefaultCompanyInfoID)
+	return data, err
+}
+
+//Save updates the one and only row of company info
+func (s postgresStore) Save(ctx context.Context, i Info) error {
+	q := `
+		UPDATE ` + postgresutils.TableCompanyInfo + ` SET
+			CompanyName=$1,
+			Street=$2,
+			Suite=$3,
+			City=$4,
+			State=$5,
+			PostalCode=$6,
+			Country=$7,
+			PhoneNum=$8,
+			Email=$9,
+			PercentFee=$10,
+			FixedFee=$11,
+			StatementDescriptor=$12
+		WHERE ID=$13
+	`
+	_, err := s.c.ExecContext(
+		ctx,
+		q,
+		i.CompanyName,
+		i.Street,
+		i.Suite,
+		i.City,
+		i.State,
+		i.PostalCode,
+		i.Country,
+		i.PhoneNum,
+		i.Email,
+		i.PercentFee,
+		i.FixedFee,
+		i.StatementDescriptor,
+		postgresutils.DefaultCompanyInfoID,
+	)
+	return err
+}
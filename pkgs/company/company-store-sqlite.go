@@ -0,0 +1,72 @@
+package company
+
+import (
+	"context"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//sqliteStore saves and retrieves the company info from a sqlite db
+type sqliteStore struct {
+	c *sqlx.DB
+}
+
+//NewSQLiteStore returns a Store that uses the given sqlite db connection
+func NewSQLiteStore(c *sqlx.DB) Store {
+	return sqliteStore{c: c}
+}
+
+//Get returns the saved company info
+//the one and only row is inserted when the db is deployed
+func (s sqliteStore) Get(ctx context.Context) (Info, error) {
+	data := Info{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableCompanyInfo + `
+		WHERE ID=?
+	`
+	err := s.c.Get(&data, q, sqliteutils.DefaultCompanyInfoID)
+	return data, err
+}
+
+//Save updates the one and only row of company info
+func (s sqliteStore) Save(ctx context.Context, i Info) error {
+	q := `
+		UPDATE ` + sqliteutils.TableCompanyInfo + ` SET
+			CompanyName=?,
+			Street=?,
+			Suite=?,
+			City=?,
+			State=?,
+			PostalCode=?,
+			Country=?,
+			PhoneNum=?,
+			Email=?,
+			PercentFee=?,
+			FixedFee=?,
+			StatementDescriptor=?
+		WHERE ID = ?
+	`
+	stmt, err := s.c.Prepare(q)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		i.CompanyName,
+		i.Street,
+		i.Suite,
+		i.City,
+		i.State,
+		i.PostalCode,
+		i.Country,
+		i.PhoneNum,
+		i.Email,
+		i.PercentFee,
+		i.FixedFee,
+		i.StatementDescriptor,
+		sqliteutils.DefaultCompanyInfoID,
+	)
+	return err
+}
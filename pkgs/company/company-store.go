@@ -0,0 +1,26 @@
+package company
+
+import (
+	"context"
+)
+
+//Store is the set of functions used to save and retrieve the company info from a database.
+//Each database we support has its own implementation of this interface.  The
+//implementation to use is chosen once in package main init() via SetStore.
+type Store interface {
+	//Get returns the saved company info, the default info is returned if none has
+	//been saved yet
+	Get(ctx context.Context) (Info, error)
+
+	//Save saves the company info, overwriting any existing info
+	Save(ctx context.Context, i Info) error
+}
+
+//store is the Store that is used to save and retrieve the company info
+//this is set in package main init() via SetStore
+var store Store
+
+//SetStore saves the database implementation used to save and retrieve the company info
+func SetStore(s Store) {
+	store = s
+}
@@ -11,15 +11,11 @@ package company
 import (
 	"context"
 	"errors"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
-	"cloud.google.com/go/datastore"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
 )
 
 //datastoreKeyName is the name of the entity we save company settings under
@@ -90,43 +86,8 @@ func GetAPI(w http.ResponseWriter, r *http.Request) {
 //Get actually retrienves the information from the datastore
 //putting this into a separate func cleans up code elsewhere
 func Get(r *http.Request) (Info, error) {
-	//placeholder
-	data := Info{}
-	var err error
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT *
-			FROM ` + sqliteutils.TableCompanyInfo + ` 
-			WHERE ID=?
-		`
-		err = c.Get(&data, q, sqliteutils.DefaultCompanyInfoID)
-
-	} else {
-		//connect to datastore
-		c := r.Context()
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			return data, err
-		}
-
-		//get from datastore
-		key := datastore.NameKey(datastoreutils.EntityCompanyInfo, datastoreKeyName, nil)
-
-		//get data
-		err = client.Get(c, key, &data)
-		if err == datastore.ErrNoSuchEntity {
-			//no company info exists yet
-			//return default values
-			log.Println("company.Get", "Company info doesn't exist yet.  Returning default values.")
-			return defaultCompanyInfo, nil
-		}
-	}
-
-	//return data found
-	return data, err
+	c := r.Context()
+	return store.Get(c)
 }
 
 //SaveAPI saves new or updates existing company info in the datastore
@@ -185,67 +146,7 @@ func SaveAPI(w http.ResponseWriter, r *http.Request) {
 
 //save does the actual saving to the datastore
 func save(c context.Context, i Info) error {
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			UPDATE ` + sqliteutils.TableCompanyInfo + ` SET 
-				CompanyName=?,
-				Street=?,
-				Suite=?,
-				City=?,
-				State=?,
-				PostalCode=?,
-				Country=?,
-				PhoneNum=?,
-				Email=?,
-				PercentFee=?,
-				FixedFee=?,
-				StatementDescriptor=?
-			WHERE ID = ?
-		`
-		stmt, err := c.Prepare(q)
-		if err != nil {
-			return err
-		}
-
-		_, err = stmt.Exec(
-			i.CompanyName,
-			i.Street,
-			i.Suite,
-			i.City,
-			i.State,
-			i.PostalCode,
-			i.Country,
-			i.PhoneNum,
-			i.Email,
-			i.PercentFee,
-			i.FixedFee,
-			i.StatementDescriptor,
-			sqliteutils.DefaultCompanyInfoID,
-		)
-		if err != nil {
-			return err
-		}
-
-	} else {
-		//connect to datastore
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			return err
-		}
-
-		//get full key
-		key := datastore.NameKey(datastoreutils.EntityCompanyInfo, datastoreKeyName, nil)
-
-		//save company info
-		_, err = client.Put(c, key, &i)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return store.Save(c, i)
 }
 
 //SaveDefaultInfo sets some default data when a company first starts using this app
@@ -32,10 +32,17 @@ var (
 //entity types are like tables
 //variables, not constants, because we can edit them in SetConfig
 var (
-	EntityUsers       = "users"
-	EntityCards       = "card"
-	EntityCompanyInfo = "companyInfo"
-	EntityAppSettings = "appSettings"
+	EntityUsers               = "users"
+	EntityCards               = "card"
+	EntityCompanyInfo         = "companyInfo"
+	EntityAppSettings         = "appSettings"
+	EntityLedger              = "ledger"
+	EntitySavedCards          = "savedCard"
+	EntityWebhookEvents       = "webhookEvent"
+	EntityScheduledCharges    = "scheduledCharge"
+	EntityScheduledChargeRuns = "scheduledChargeRun"
+	EntityBatchJobs           = "batchJob"
+	EntityBatchRows           = "batchRow"
 )
 
 //SetConfig saves the configuration for the datastore
@@ -51,6 +58,13 @@ func SetConfig(c config) error {
 		EntityCards = "dev-" + EntityCards
 		EntityCompanyInfo = "dev-" + EntityCompanyInfo
 		EntityAppSettings = "dev-" + EntityAppSettings
+		EntityLedger = "dev-" + EntityLedger
+		EntitySavedCards = "dev-" + EntitySavedCards
+		EntityWebhookEvents = "dev-" + EntityWebhookEvents
+		EntityScheduledCharges = "dev-" + EntityScheduledCharges
+		EntityScheduledChargeRuns = "dev-" + EntityScheduledChargeRuns
+		EntityBatchJobs = "dev-" + EntityBatchJobs
+		EntityBatchRows = "dev-" + EntityBatchRows
 	}
 
 	//save config to package variable
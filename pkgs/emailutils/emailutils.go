@@ -0,0 +1,285 @@
+/*
+Package emailutils is used to send emails through an SMTP server.
+
+Emails are used to notify people of things that need attention, such as cards that are about to
+expire.  Sending emails is optional, if no SMTP server is set in app.yaml nothing is sent.
+
+Any SMTP server can be used, including a local server used for testing that doesn't require a
+username or password.  The connection is upgraded to TLS if the server supports it.
+*/
+package emailutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//config is the set of configuration options for sending emails
+//this struct is used when SetConfig is run in package main init()
+type config struct {
+	Host     string //the SMTP server's hostname, ex: smtp.example.com, emails are not sent if blank
+	Port     int    //the SMTP server's port, usually 587 or 25
+	Username string //used to log in to the SMTP server, leave blank if the server doesn't require logging in
+	Password string //" "
+	From     string //the address emails are sent from, ex: cards@example.com
+}
+
+//Config is a copy of the config struct with some defaults set
+var Config = config{
+	Host:     "",
+	Port:     defaultPort,
+	Username: "",
+	Password: "",
+	From:     "",
+}
+
+//defaultPort is the port used when a port isn't given
+//this is the submission port most SMTP servers use
+const defaultPort = 587
+
+//configuration and sending errors
+var (
+	errMissingFrom      = errors.New("emailutils: A from address (SMTP_FROM) wasn't given")
+	errInvalidFrom      = errors.New("emailutils: The from address (SMTP_FROM) is not a valid email address")
+	errInvalidPort      = errors.New("emailutils: The SMTP port (SMTP_PORT) must be between 1 and 65535")
+	errNotEnabled       = errors.New("emailutils: sending emails is not enabled, set an SMTP host")
+	errNoRecipients     = errors.New("emailutils: no email addresses to send to")
+	errInvalidRecipient = errors.New("emailutils: invalid email address")
+)
+
+//SetConfig saves the configuration options for sending emails
+//nothing is validated if a host isn't given since sending emails is optional
+func SetConfig(c config) error {
+	c.Host = strings.TrimSpace(c.Host)
+	if c.Host == "" {
+		Config = c
+		return nil
+	}
+
+	//validate config options
+	if c.Port == 0 {
+		c.Port = defaultPort
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return errInvalidPort
+	}
+
+	c.From = strings.TrimSpace(c.From)
+	if c.From == "" {
+		return errMissingFrom
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return errInvalidFrom
+	}
+
+	//save the configuration
+	Config = c
+	return nil
+}
+
+//Enabled returns true if an SMTP server has been set
+func Enabled() bool {
+	return Config.Host != ""
+}
+
+//Message is an email to send
+type Message struct {
+	To          []string //the addresses to send to, each person can see who else the email was sent to
+	Subject     string
+	Body        string //plain text
+	HTML        string //optional, sent along with the plain text body for email clients that show html
+	Attachments []Attachment
+}
+
+//Attachment is a file sent with an email
+type Attachment struct {
+	Filename    string //the name of the file as shown in the email, ex: receipt.pdf
+	ContentType string //the type of file, ex: application/pdf
+	Data        []byte
+}
+
+//Send sends an email through the SMTP server
+func Send(m Message) error {
+	if !Enabled() {
+		return errNotEnabled
+	}
+	if len(m.To) == 0 {
+		return errNoRecipients
+	}
+	for _, to := range m.To {
+		if !IsValidAddress(to) {
+			return errInvalidRecipient
+		}
+	}
+
+	//only log in if a username was given
+	//a local server used for testing usually doesn't require logging in
+	var auth smtp.Auth
+	if Config.Username != "" {
+		auth = smtp.PlainAuth("", Config.Username, Config.Password, Config.Host)
+	}
+
+	addr := net.JoinHostPort(Config.Host, strconv.Itoa(Config.Port))
+	return smtp.SendMail(addr, auth, Config.From, m.To, buildMessage(m))
+}
+
+//IsValidAddress checks if a string is a single email address
+//this is used to check addresses before an email is sent since an invalid address causes the
+//entire email to fail
+func IsValidAddress(address string) bool {
+	if strings.ContainsAny(address, "\r\n") {
+		return false
+	}
+
+	a, err := mail.ParseAddress(address)
+	if err != nil {
+		return false
+	}
+
+	return a.Address == address
+}
+
+//ParseAddressList splits a comma or semicolon separated list of email addresses
+//blank entries are ignored, errInvalidRecipient is returned if any address is invalid
+func ParseAddressList(list string) ([]string, error) {
+	fields := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+
+	addresses := []string{}
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !IsValidAddress(f) {
+			return nil, errInvalidRecipient
+		}
+
+		addresses = append(addresses, f)
+	}
+
+	return addresses, nil
+}
+
+//buildMessage creates the headers and body of an email
+//lines end in \r\n as required by SMTP
+//an email with an html body is sent as multipart/alternative so email clients that don't show
+//html can still show the plain text body, an email with attachments is sent as multipart/mixed
+//with the body as the first part
+func buildMessage(m Message) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: " + Config.From + "\r\n")
+	b.WriteString("To: " + strings.Join(m.To, ", ") + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", m.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	bodyHeader, body := buildBody(m)
+	if len(m.Attachments) == 0 {
+		writeHeader(&b, bodyHeader)
+		b.Write(body)
+		return b.Bytes()
+	}
+
+	mw := multipart.NewWriter(&b)
+	b.WriteString("Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n")
+	b.WriteString("\r\n")
+
+	//writing to a bytes.Buffer doesn't return errors
+	pw, _ := mw.CreatePart(bodyHeader)
+	pw.Write(body)
+
+	for _, a := range m.Attachments {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", mime.FormatMediaType(a.ContentType, map[string]string{"name": a.Filename}))
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+		h.Set("Content-Transfer-Encoding", "base64")
+
+		pw, _ := mw.CreatePart(h)
+		pw.Write(base64Lines(a.Data))
+	}
+	mw.Close()
+
+	return b.Bytes()
+}
+
+//buildBody creates the headers and content of the body of an email, without attachments
+//the plain text body is sent as is unless there is an html body as well
+func buildBody(m Message) (textproto.MIMEHeader, []byte) {
+	h := textproto.MIMEHeader{}
+	if m.HTML == "" {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Content-Transfer-Encoding", "8bit")
+		return h, []byte(crlf(m.Body))
+	}
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	h.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+
+	//the preferred part goes last
+	writePart(mw, "text/plain; charset=utf-8", m.Body)
+	writePart(mw, "text/html; charset=utf-8", m.HTML)
+	mw.Close()
+
+	return h, b.Bytes()
+}
+
+//writeHeader writes the headers for the body of an email followed by the blank line that
+//separates headers from the body
+func writeHeader(b *bytes.Buffer, h textproto.MIMEHeader) {
+	for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if v := h.Get(k); v != "" {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+}
+
+//writePart adds one part to a multipart email
+//parts are quoted-printable encoded since html can have lines longer than SMTP allows
+func writePart(mw *multipart.Writer, contentType, body string) {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	//writing to a bytes.Buffer doesn't return errors
+	pw, _ := mw.CreatePart(h)
+	qw := quotedprintable.NewWriter(pw)
+	qw.Write([]byte(crlf(body)))
+	qw.Close()
+}
+
+//base64Lines encodes a file as base64 split into lines of 76 characters as required for email
+func base64Lines(data []byte) []byte {
+	const lineLength = 76
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var b bytes.Buffer
+	for len(encoded) > lineLength {
+		b.WriteString(encoded[:lineLength] + "\r\n")
+		encoded = encoded[lineLength:]
+	}
+	b.WriteString(encoded + "\r\n")
+
+	return b.Bytes()
+}
+
+//crlf makes sure each line ends in \r\n
+func crlf(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\n", "\r\n", -1)
+}
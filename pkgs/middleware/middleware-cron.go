@@ -0,0 +1,78 @@
+/*
+Package middleware handles authentication and access right to the app.
+
+This file handles authenticating requests to cron tasks.  Cron tasks don't use a session
+since they are requested by appengine's cron service or by a cron job on the server.
+*/
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
+)
+
+//config is the set of configuration options for authenticating cron tasks
+//this struct is used when SetConfig is run in package main init()
+type config struct {
+	TrustAppengineCron bool   //true when deployed on appengine, appengine removes the X-Appengine-Cron header from requests not made by its cron service
+	CronSecret         string //the shared secret given in the X-Cron-Secret header by other cron jobs, cron tasks can only be run by appengine if blank
+}
+
+//Config is a copy of the config struct with some defaults set
+var Config = config{
+	TrustAppengineCron: false,
+	CronSecret:         "",
+}
+
+//cronSecretHeader is the header a cron job gives the shared secret in
+const cronSecretHeader = "X-Cron-Secret"
+
+//minCronSecretLength is the shortest shared secret allowed so the secret can't be guessed
+const minCronSecretLength = 16
+
+//cron errors
+var (
+	errCronSecretTooShort = errors.New("middleware: the cron secret in app.yaml must be at least 16 characters")
+	errNotCron            = errors.New("middleware: request was not made by cron")
+)
+
+//SetConfig saves the configuration options for authenticating cron tasks
+func SetConfig(c config) error {
+	//the secret is optional on appengine since cron requests are identified by a header
+	c.CronSecret = strings.TrimSpace(c.CronSecret)
+	if c.CronSecret != "" && len(c.CronSecret) < minCronSecretLength {
+		return errCronSecretTooShort
+	}
+
+	//save config to package variable
+	Config = c
+
+	return nil
+}
+
+//Cron checks if a request to a cron task was made by cron
+//On appengine, requests made by the cron service have the X-Appengine-Cron header.  Other
+//deployments can't trust this header since anyone can set it so the cron job must give the
+//shared secret from app.yaml in the X-Cron-Secret header instead.
+func Cron(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Config.TrustAppengineCron && r.Header.Get("X-Appengine-Cron") == "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret := r.Header.Get(cronSecretHeader)
+		if Config.CronSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(Config.CronSecret)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Println("middleware.Cron", "Request not made by cron.", r.URL.Path)
+		output.Error(errNotCron, "This task can only be run by cron.", w)
+	})
+}
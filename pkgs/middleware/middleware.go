@@ -173,6 +173,30 @@ func ViewReports(next http.Handler) http.Handler {
 	})
 }
 
+//ManageDisputes checks if the user is allowed to view disputes and submit evidence for them
+func ManageDisputes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//look up user data
+		c := r.Context()
+		userID := sessionutils.GetUserID(r)
+		data, err := users.Find(c, userID)
+		if err != nil {
+			log.Println("middleware.ManageDisputes: ", err)
+			output.Error(err, "An error occurred in the middleware.", w)
+			return
+		}
+
+		//check if user can manage disputes
+		if !data.ManageDisputes {
+			output.Error(errNotAuthorized, "You do not have permission to manage disputes.", w)
+			return
+		}
+
+		//move to next middleware or handler
+		next.ServeHTTP(w, r)
+	})
+}
+
 //Administrator checks if the user is an administrator to the app
 //this allows for adding/removing/changing other users
 //also allows for changing the data that shows up on the receipt
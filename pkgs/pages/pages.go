@@ -11,6 +11,7 @@ import (
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/card"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/users"
@@ -26,13 +27,18 @@ type templateData struct {
 	StripePublishableKey string               //the stripe key used by stripe.js
 	AutofillCard         autofillCardData     //used for autofilling the charge card form
 	HasAutofillData      bool                 //true if AutofillCard is filled out with data to build the gui
+	BackupsEnabled       bool                 //true if the db can be backed up from the gui, sqlite only
+	EmailEnabled         bool                 //true if emails can be sent, used to show the inputs for emailing receipts
+	Currencies           []string             //the currencies suggested when choosing a currency
 	Error                interface{}          //any error messages
 }
 
 //autofillCardData is the data we need to autofill the charge card form
 type autofillCardData struct {
 	CardData card.CustomerDatastore //data on the customer/card we want to charge
-	Amount   float64                //the amount to charge in dollars
+	Cards    []card.SavedCard       //the customer's cards, the default card is first
+	Currency string                 //the currency to charge in
+	Amount   string                 //the amount to charge in dollars, blank if no amount was given
 	Invoice  string                 //invoice number
 	Po       string                 //purchase order number
 }
@@ -171,6 +177,14 @@ func Main(w http.ResponseWriter, r *http.Request) {
 	//this app doesn't have to deal with any <scrip> tags or .js files
 	templateData.StripePublishableKey = card.Config.StripePublishableKey
 
+	//show the backups section in settings if the db can be backed up
+	templateData.BackupsEnabled = appsettings.BackupsEnabled()
+
+	//show the inputs for emailing receipts if emails can be sent
+	templateData.EmailEnabled = emailutils.Enabled()
+
+	templateData.Currencies = card.Currencies
+
 	//check for url form values for autofilling charge panel
 	custID := r.FormValue("customer_id")
 
@@ -188,12 +202,32 @@ func Main(w http.ResponseWriter, r *http.Request) {
 		}
 		autofillData.CardData = custData
 
+		//get the customer's cards so the user can choose which card to charge
+		cards, err := card.FindCards(c, custData)
+		if err != nil {
+			templateData.Error = "The form could not be autofilled because the customer's cards could not be found."
+			templates.Load(w, "main", templateData)
+			return
+		}
+		autofillData.Cards = cards
+
+		//get the currency to charge in
+		//this is the currency given in the url, the customer's currency, or the default currency
+		currency, err := card.ChargeCurrency(r, r.FormValue("currency"), custData)
+		if err != nil {
+			templateData.Error = "The form could not be autofilled because the currency you provided is not a valid currency code."
+			templates.Load(w, "main", templateData)
+			return
+		}
+		autofillData.Currency = currency
+
 		//if amount was given, it is in cents
 		//display it in html input as dollars
 		amountURL := r.FormValue("amount")
-		amountFloat, _ := strconv.ParseFloat(amountURL, 64)
-		amountDollars := amountFloat / 100
-		autofillData.Amount = amountDollars
+		amountCents, _ := strconv.ParseInt(amountURL, 10, 64)
+		if amountCents > 0 {
+			autofillData.Amount = card.FormatAmount(amountCents, currency)
+		}
 
 		//check for other form values and build template
 		autofillData.Invoice = r.FormValue("invoice")
@@ -0,0 +1,218 @@
+/*
+Package pdfutils is used to build simple PDF files from plain text.
+
+The PDFs are built without any third party libraries.  Text is shown in Courier, one of the
+standard fonts every PDF reader has, so no fonts need to be embedded and the spacing of text is
+kept exactly as given.  This is made for documents such as receipts that are already laid out as
+monospaced text.
+
+Only characters in the Windows-1252 character set can be shown, other characters are replaced
+with a question mark.
+*/
+package pdfutils
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//page layout, in points (1/72 of an inch)
+//pages are US Letter size
+const (
+	pageWidth  = 612
+	pageHeight = 792
+	margin     = 54
+	fontSize   = 10
+	lineHeight = 12
+
+	//Courier characters are 60% as wide as the font size
+	charWidth = fontSize * 0.6
+)
+
+//maxLineLength is the number of characters that fit across a page, longer lines are wrapped
+var maxLineLength = int((pageWidth - 2*margin) / charWidth)
+
+//linesPerPage is the number of lines that fit on a page
+var linesPerPage = (pageHeight - 2*margin) / lineHeight
+
+//FromText builds a PDF showing the given text
+//The title is saved in the PDF's properties and is shown by PDF readers as the name of the
+//document.  Lines that are too long to fit on the page are wrapped and text that is too long
+//to fit on one page is continued on additional pages.
+func FromText(title, text string) []byte {
+	pages := paginate(wrap(text))
+
+	var b bytes.Buffer
+	offsets := []int{}
+
+	//startObject saves where an object starts in the file so the cross reference table can
+	//be built, objects are numbered in the order they are written starting at 1
+	startObject := func() int {
+		offsets = append(offsets, b.Len())
+		num := len(offsets)
+		b.WriteString(strconv.Itoa(num) + " 0 obj\n")
+		return num
+	}
+
+	//objects 1-4 are the catalog, the list of pages, the font, and the document info
+	//each page is then written as the page and its content
+	pageObjectNum := func(i int) int {
+		return 5 + i*2
+	}
+
+	b.WriteString("%PDF-1.4\n")
+	b.WriteString("%\xe2\xe3\xcf\xd3\n") //marks the file as binary for programs that transfer files
+
+	startObject()
+	b.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	startObject()
+	kids := []string{}
+	for i := range pages {
+		kids = append(kids, strconv.Itoa(pageObjectNum(i))+" 0 R")
+	}
+	b.WriteString("<< /Type /Pages /Kids [" + strings.Join(kids, " ") + "] /Count " + strconv.Itoa(len(pages)) + " >>\nendobj\n")
+
+	startObject()
+	b.WriteString("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>\nendobj\n")
+
+	startObject()
+	b.WriteString("<< /Title (" + escape(title) + ") /Producer (stripe-appengine-frontend) /CreationDate (D:" + time.Now().UTC().Format("20060102150405") + "Z) >>\nendobj\n")
+
+	for i, lines := range pages {
+		content := pageContent(lines)
+
+		startObject()
+		b.WriteString("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 " + strconv.Itoa(pageWidth) + " " + strconv.Itoa(pageHeight) + "] ")
+		b.WriteString("/Resources << /Font << /F1 3 0 R >> >> /Contents " + strconv.Itoa(pageObjectNum(i)+1) + " 0 R >>\nendobj\n")
+
+		startObject()
+		b.WriteString("<< /Length " + strconv.Itoa(len(content)) + " >>\nstream\n")
+		b.Write(content)
+		b.WriteString("\nendstream\nendobj\n")
+	}
+
+	//cross reference table, each entry must be exactly 20 bytes
+	xref := b.Len()
+	b.WriteString("xref\n0 " + strconv.Itoa(len(offsets)+1) + "\n")
+	b.WriteString("0000000000 65535 f \n")
+	for _, o := range offsets {
+		b.WriteString(leftPad(strconv.Itoa(o), 10) + " 00000 n \n")
+	}
+
+	b.WriteString("trailer\n<< /Size " + strconv.Itoa(len(offsets)+1) + " /Root 1 0 R /Info 4 0 R >>\n")
+	b.WriteString("startxref\n" + strconv.Itoa(xref) + "\n%%EOF\n")
+
+	return b.Bytes()
+}
+
+//pageContent builds the drawing instructions to show lines of text on a page
+//lines are drawn from the top of the page down
+func pageContent(lines []string) []byte {
+	var c bytes.Buffer
+	c.WriteString("BT\n")
+	c.WriteString("/F1 " + strconv.Itoa(fontSize) + " Tf\n")
+	c.WriteString(strconv.Itoa(lineHeight) + " TL\n")
+	c.WriteString(strconv.Itoa(margin) + " " + strconv.Itoa(pageHeight-margin-fontSize) + " Td\n")
+	for _, l := range lines {
+		c.WriteString("(" + escape(l) + ") Tj T*\n")
+	}
+	c.WriteString("ET")
+
+	return c.Bytes()
+}
+
+//wrap splits text into lines that fit on a page
+//tabs are replaced with spaces since Courier doesn't have a tab character
+func wrap(text string) []string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\t", "    ", -1)
+
+	lines := []string{}
+	for _, l := range strings.Split(text, "\n") {
+		for utf8.RuneCountInString(l) > maxLineLength {
+			r := []rune(l)
+			lines = append(lines, string(r[:maxLineLength]))
+			l = string(r[maxLineLength:])
+		}
+
+		lines = append(lines, l)
+	}
+
+	return lines
+}
+
+//paginate splits lines into pages
+//a PDF must have at least one page so an empty page is returned if there are no lines
+func paginate(lines []string) [][]string {
+	pages := [][]string{}
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+
+	return append(pages, lines)
+}
+
+//escape converts text to Windows-1252 and escapes the characters that have special meaning
+//in a PDF string
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+			continue
+		}
+
+		c, ok := toWindows1252(r)
+		if !ok {
+			c = '?'
+		}
+
+		//characters outside of ascii are written as octal codes so the content is plain ascii
+		if c < 0x20 || c > 0x7e {
+			b.WriteString("\\" + leftPad(strconv.FormatInt(int64(c), 8), 3))
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+//windows1252 is the set of characters Windows-1252 has in place of control characters
+//this includes the symbols for some currencies and the punctuation often used in names
+var windows1252 = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b,
+	'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+//toWindows1252 returns the Windows-1252 code for a character
+//false is returned if the character doesn't exist in Windows-1252
+func toWindows1252(r rune) (byte, bool) {
+	if c, ok := windows1252[r]; ok {
+		return c, true
+	}
+	if r < 0x80 || (r >= 0xa0 && r <= 0xff) {
+		return byte(r), true
+	}
+
+	return 0, false
+}
+
+//leftPad adds zeros to the front of s until it is n characters long
+func leftPad(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+
+	return strings.Repeat("0", n-len(s)) + s
+}
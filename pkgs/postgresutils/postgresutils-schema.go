@@ -0,0 +1,532 @@
+/*
+Package postgresutils is used to interact with a PostgreSQL db.
+
+This file holds the SQL code to deploy a new copy of the database.  The SQL code
+should match the tables in sqliteutils-schema.go.  Column names are not quoted so
+postgres stores them as lowercase.
+*/
+package postgresutils
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//these are the names of the tables used to store data
+//these values should match the table names in sqliteutils-schema.go
+const (
+	TableUsers               = "users"
+	TableCards               = "card"
+	TableCompanyInfo         = "companyInfo"
+	TableAppSettings         = "appSettings"
+	TableLedger              = "ledger"
+	TableSavedCards          = "savedCard"
+	TableWebhookEvents       = "webhookEvent"
+	TableScheduledCharges    = "scheduledCharge"
+	TableScheduledChargeRuns = "scheduledChargeRun"
+	TableBatchJobs           = "batchJob"
+	TableBatchRows           = "batchRow"
+)
+
+//these are the default IDs of the rows in the companyInfo and appSettings tables
+//these tables will only ever have one record, so we know what the ID should be
+const (
+	DefaultCompanyInfoID = 1
+	DefaultAppSettingsID = 1
+)
+
+//CreateTableUsers creates the users table
+func CreateTableUsers(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableUsers + `(
+			ID BIGSERIAL PRIMARY KEY,
+			Username TEXT NOT NULL UNIQUE,
+			Password TEXT NOT NULL,
+			AddCards BOOLEAN NOT NULL,
+			RemoveCards BOOLEAN NOT NULL,
+			ChargeCards BOOLEAN NOT NULL,
+			ViewReports BOOLEAN NOT NULL,
+			Administrator BOOLEAN NOT NULL,
+			Active BOOLEAN NOT NULL,
+			Created TEXT NOT NULL,
+			ManageDisputes BOOLEAN NOT NULL DEFAULT FALSE
+		)
+	`
+
+	_, err := tx.Exec(q)
+	log.Println("postgresutils.CreateTableUsers...done")
+	return err
+}
+
+//CreateTableCard creates the card table
+func CreateTableCard(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableCards + `(
+			ID BIGSERIAL PRIMARY KEY,
+			CustomerID TEXT NOT NULL,
+			CustomerName TEXT NOT NULL,
+			Cardholder TEXT NOT NULL,
+			CardExpiration TEXT NOT NULL,
+			CardLast4 TEXT NOT NULL,
+			StripeCustomerToken TEXT NOT NULL,
+			DatetimeCreated TEXT NOT NULL,
+			AddedByUser TEXT NOT NULL,
+			LastUsedTimestamp BIGINT NOT NULL,
+			Currency TEXT NOT NULL DEFAULT '',
+			BillingEmail TEXT NOT NULL DEFAULT ''
+		)
+	`
+
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableCard: creating table", err)
+		return err
+	}
+
+	//index the columns we look up cards by
+	q = `CREATE INDEX IF NOT EXISTS card_customerid_idx ON ` + TableCards + ` (CustomerID)`
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.CreateTableCard...done")
+	return err
+}
+
+//CreateTableCompanyInfo creates the companyInfo table
+//there should only ever be one record in this table
+func CreateTableCompanyInfo(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableCompanyInfo + `(
+			ID BIGINT PRIMARY KEY DEFAULT 1,
+			CompanyName TEXT NOT NULL,
+			Street TEXT NOT NULL,
+			Suite TEXT NOT NULL,
+			City TEXT NOT NULL,
+			State TEXT NOT NULL,
+			PostalCode TEXT NOT NULL,
+			Country TEXT NOT NULL,
+			PhoneNum TEXT NOT NULL,
+			Email TEXT NOT NULL,
+			PercentFee DOUBLE PRECISION NOT NULL,
+			FixedFee DOUBLE PRECISION NOT NULL,
+			StatementDescriptor TEXT NOT NULL
+		)
+	`
+
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableCompanyInfo: creating table", err)
+		return err
+	}
+
+	//save the first and only record
+	//does nothing if the record already exists
+	q = `
+		INSERT INTO ` + TableCompanyInfo + ` (
+			ID,
+			CompanyName,
+			Street,
+			Suite,
+			City,
+			State,
+			PostalCode,
+			Country,
+			PhoneNum,
+			Email,
+			PercentFee,
+			FixedFee,
+			StatementDescriptor
+		) VALUES ($1, '', '', '', '', '', '', '', '', '', 0, 0, '')
+		ON CONFLICT (ID) DO NOTHING
+	`
+	_, err = tx.Exec(q, DefaultCompanyInfoID)
+	if err != nil {
+		log.Println("postgresutils.CreateTableCompanyInfo: inserting initial data", err)
+		return err
+	}
+
+	log.Println("postgresutils.CreateTableCompanyInfo...done")
+	return nil
+}
+
+//CreateTableAppSettings creates the appSettings table
+//there should only ever be one record in this table
+func CreateTableAppSettings(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableAppSettings + `(
+			ID BIGINT PRIMARY KEY DEFAULT 1,
+			RequireCustomerID BOOLEAN NOT NULL,
+			CustomerIDFormat TEXT NOT NULL,
+			CustomerIDRegex TEXT NOT NULL,
+			ReportTimezone TEXT NOT NULL,
+			APIKey TEXT NOT NULL,
+			DefaultCurrency TEXT NOT NULL DEFAULT 'usd'
+		)
+	`
+
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableAppSettings: creating table", err)
+		return err
+	}
+
+	//save the first and only record
+	//does nothing if the record already exists
+	q = `
+		INSERT INTO ` + TableAppSettings + ` (
+			ID,
+			RequireCustomerID,
+			CustomerIDFormat,
+			CustomerIDRegex,
+			ReportTimezone,
+			APIKey
+		) VALUES ($1, false, '', '', '', '')
+		ON CONFLICT (ID) DO NOTHING
+	`
+	_, err = tx.Exec(q, DefaultAppSettingsID)
+	if err != nil {
+		log.Println("postgresutils.CreateTableAppSettings: inserting initial data", err)
+		return err
+	}
+
+	log.Println("postgresutils.CreateTableAppSettings...done")
+	return nil
+}
+
+//CreateTableLedger creates the ledger table
+//the ledger is a local copy of every charge and refund so reports don't need to page through Stripe
+func CreateTableLedger(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableLedger + `(
+			ID BIGSERIAL PRIMARY KEY,
+			StripeID TEXT NOT NULL UNIQUE,
+			Type TEXT NOT NULL,
+			StripeChargeID TEXT NOT NULL,
+			StripeCustomerToken TEXT NOT NULL,
+			CustomerID TEXT NOT NULL,
+			CustomerName TEXT NOT NULL,
+			AmountCents BIGINT NOT NULL,
+			AmountRefundedCents BIGINT NOT NULL,
+			Currency TEXT NOT NULL,
+			BalanceTransactionID TEXT NOT NULL,
+			FeeCents BIGINT NOT NULL,
+			NetCents BIGINT NOT NULL,
+			AvailableOn BIGINT NOT NULL,
+			Status TEXT NOT NULL,
+			Captured BOOLEAN NOT NULL,
+			FailureCode TEXT NOT NULL,
+			FailureMessage TEXT NOT NULL,
+			Invoice TEXT NOT NULL,
+			Po TEXT NOT NULL,
+			Cardholder TEXT NOT NULL,
+			CardBrand TEXT NOT NULL,
+			CardLast4 TEXT NOT NULL,
+			CardExpiration TEXT NOT NULL,
+			Username TEXT NOT NULL,
+			AuthorizedByUser TEXT NOT NULL,
+			AuthorizedDatetime TEXT NOT NULL,
+			ProcessedDatetime TEXT NOT NULL,
+			AutoCharge BOOLEAN NOT NULL,
+			AutoChargeReferrer TEXT NOT NULL,
+			AutoChargeReason TEXT NOT NULL,
+			Level3Provided BOOLEAN NOT NULL,
+			Reason TEXT NOT NULL,
+			Metadata TEXT NOT NULL,
+			Created BIGINT NOT NULL,
+			DatetimeSynced TEXT NOT NULL,
+			PaymentType TEXT NOT NULL DEFAULT ''
+		)
+	`
+
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableLedger: creating table", err)
+		return err
+	}
+
+	//index the columns we look up entries by
+	q = `CREATE INDEX IF NOT EXISTS ledger_type_created_idx ON ` + TableLedger + ` (Type, Created)`
+	_, err = tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableLedger: creating index", err)
+		return err
+	}
+
+	q = `CREATE INDEX IF NOT EXISTS ledger_customer_idx ON ` + TableLedger + ` (StripeCustomerToken, Created)`
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.CreateTableLedger...done")
+	return err
+}
+
+//AddColumnsLedgerFees adds the columns that store the fee and net amount of each charge
+//and refund to a ledger table created before these columns existed
+func AddColumnsLedgerFees(tx *sqlx.Tx) error {
+	q := `
+		ALTER TABLE ` + TableLedger + `
+		ADD COLUMN IF NOT EXISTS BalanceTransactionID TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS FeeCents BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS NetCents BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS AvailableOn BIGINT NOT NULL DEFAULT 0
+	`
+
+	_, err := tx.Exec(q)
+	log.Println("postgresutils.AddColumnsLedgerFees...done")
+	return err
+}
+
+//AddColumnsCurrency adds the columns that store a customer's currency and the default currency
+//to tables created before charges could be made in currencies other than USD
+func AddColumnsCurrency(tx *sqlx.Tx) error {
+	q := `ALTER TABLE ` + TableCards + ` ADD COLUMN IF NOT EXISTS Currency TEXT NOT NULL DEFAULT ''`
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.AddColumnsCurrency: card table", err)
+		return err
+	}
+
+	q = `ALTER TABLE ` + TableAppSettings + ` ADD COLUMN IF NOT EXISTS DefaultCurrency TEXT NOT NULL DEFAULT 'usd'`
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.AddColumnsCurrency...done")
+	return err
+}
+
+//AddColumnManageDisputes adds the column that stores if a user can manage disputes
+//this is for dbs deployed before disputes could be managed in the app
+func AddColumnManageDisputes(tx *sqlx.Tx) error {
+	q := `ALTER TABLE ` + TableUsers + ` ADD COLUMN IF NOT EXISTS ManageDisputes BOOLEAN NOT NULL DEFAULT FALSE`
+	_, err := tx.Exec(q)
+	log.Println("postgresutils.AddColumnManageDisputes...done")
+	return err
+}
+
+//AddColumnsSavedCardUpdated adds the columns that record who replaced a saved card and when
+//this is for dbs deployed before a card could be replaced
+func AddColumnsSavedCardUpdated(tx *sqlx.Tx) error {
+	q := `ALTER TABLE ` + TableSavedCards + ` ADD COLUMN IF NOT EXISTS DatetimeUpdated TEXT NOT NULL DEFAULT ''`
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.AddColumnsSavedCardUpdated: DatetimeUpdated", err)
+		return err
+	}
+
+	q = `ALTER TABLE ` + TableSavedCards + ` ADD COLUMN IF NOT EXISTS UpdatedByUser TEXT NOT NULL DEFAULT ''`
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.AddColumnsSavedCardUpdated...done")
+	return err
+}
+
+//AddColumnBillingEmail adds the column that stores the email address of a customer's billing contact
+//this is for dbs deployed before a customer's billing contact could be notified
+func AddColumnBillingEmail(tx *sqlx.Tx) error {
+	q := `ALTER TABLE ` + TableCards + ` ADD COLUMN IF NOT EXISTS BillingEmail TEXT NOT NULL DEFAULT ''`
+	_, err := tx.Exec(q)
+	log.Println("postgresutils.AddColumnBillingEmail...done")
+	return err
+}
+
+//AddColumnsPaymentType adds the columns that record if a saved card or charge is a card or a bank
+//account, and if a bank account is verified
+//this is for dbs deployed before customers could pay by bank account
+func AddColumnsPaymentType(tx *sqlx.Tx) error {
+	q := `
+		ALTER TABLE ` + TableSavedCards + `
+		ADD COLUMN IF NOT EXISTS PaymentType TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS BankAccountStatus TEXT NOT NULL DEFAULT ''
+	`
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.AddColumnsPaymentType: savedCard table", err)
+		return err
+	}
+
+	q = `ALTER TABLE ` + TableLedger + ` ADD COLUMN IF NOT EXISTS PaymentType TEXT NOT NULL DEFAULT ''`
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.AddColumnsPaymentType...done")
+	return err
+}
+
+//CreateTableSavedCard creates the savedCard table
+//each row is one of the cards attached to a customer in the card table
+func CreateTableSavedCard(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableSavedCards + `(
+			ID BIGSERIAL PRIMARY KEY,
+			CustomerDatastoreID BIGINT NOT NULL,
+			StripeCardID TEXT NOT NULL,
+			Cardholder TEXT NOT NULL,
+			CardExpiration TEXT NOT NULL,
+			CardLast4 TEXT NOT NULL,
+			CardBrand TEXT NOT NULL,
+			IsDefault BOOLEAN NOT NULL,
+			DatetimeCreated TEXT NOT NULL,
+			AddedByUser TEXT NOT NULL,
+			DatetimeUpdated TEXT NOT NULL DEFAULT '',
+			UpdatedByUser TEXT NOT NULL DEFAULT '',
+			PaymentType TEXT NOT NULL DEFAULT '',
+			BankAccountStatus TEXT NOT NULL DEFAULT ''
+		)
+	`
+
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableSavedCard: creating table", err)
+		return err
+	}
+
+	//index the column we look up cards by
+	q = `CREATE INDEX IF NOT EXISTS savedcard_customer_idx ON ` + TableSavedCards + ` (CustomerDatastoreID)`
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.CreateTableSavedCard...done")
+	return err
+}
+
+//CreateTableWebhookEvent creates the webhookEvent table
+//each row is an event from Stripe that was handled so the same event isn't handled twice
+func CreateTableWebhookEvent(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableWebhookEvents + `(
+			ID BIGSERIAL PRIMARY KEY,
+			StripeEventID TEXT NOT NULL UNIQUE,
+			Type TEXT NOT NULL,
+			Created BIGINT NOT NULL,
+			DatetimeProcessed TEXT NOT NULL
+		)
+	`
+
+	_, err := tx.Exec(q)
+	log.Println("postgresutils.CreateTableWebhookEvent...done")
+	return err
+}
+
+//CreateTableScheduledCharge creates the scheduledCharge and scheduledChargeRun tables
+//each scheduledCharge row is a repeating charge of a customer and each scheduledChargeRun row
+//is one attempt at charging it
+func CreateTableScheduledCharge(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableScheduledCharges + `(
+			ID BIGSERIAL PRIMARY KEY,
+			CustomerDatastoreID BIGINT NOT NULL,
+			SavedCardID BIGINT NOT NULL,
+			AmountCents BIGINT NOT NULL,
+			Currency TEXT NOT NULL,
+			Interval TEXT NOT NULL,
+			IntervalDays BIGINT NOT NULL,
+			StartDate TEXT NOT NULL,
+			EndDate TEXT NOT NULL,
+			InvoiceTemplate TEXT NOT NULL,
+			PoTemplate TEXT NOT NULL,
+			NextRunDate TEXT NOT NULL,
+			Active BOOLEAN NOT NULL,
+			RunCount BIGINT NOT NULL,
+			LastRunDate TEXT NOT NULL,
+			LastRunStatus TEXT NOT NULL,
+			DatetimeCreated TEXT NOT NULL,
+			CreatedByUser TEXT NOT NULL
+		)
+	`
+
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableScheduledCharge: creating table", err)
+		return err
+	}
+
+	//index the columns we look up scheduled charges by
+	q = `CREATE INDEX IF NOT EXISTS scheduledcharge_customer_idx ON ` + TableScheduledCharges + ` (CustomerDatastoreID)`
+	_, err = tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableScheduledCharge: creating customer index", err)
+		return err
+	}
+
+	q = `CREATE INDEX IF NOT EXISTS scheduledcharge_next_run_idx ON ` + TableScheduledCharges + ` (Active, NextRunDate)`
+	_, err = tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableScheduledCharge: creating next run index", err)
+		return err
+	}
+
+	//the unique constraint stops the same date of a schedule from being charged twice
+	q = `
+		CREATE TABLE IF NOT EXISTS ` + TableScheduledChargeRuns + `(
+			ID BIGSERIAL PRIMARY KEY,
+			ScheduledChargeID BIGINT NOT NULL,
+			RunDate TEXT NOT NULL,
+			Status TEXT NOT NULL,
+			ChargeID TEXT NOT NULL,
+			AmountCents BIGINT NOT NULL,
+			Currency TEXT NOT NULL,
+			Invoice TEXT NOT NULL,
+			Po TEXT NOT NULL,
+			Error TEXT NOT NULL,
+			IdempotencyKey TEXT NOT NULL,
+			DatetimeStarted TEXT NOT NULL,
+			DatetimeFinished TEXT NOT NULL,
+			UNIQUE (ScheduledChargeID, RunDate)
+		)
+	`
+
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.CreateTableScheduledCharge...done")
+	return err
+}
+
+//CreateTableBatchJob creates the batchJob and batchRow tables
+//each batchJob row is a csv file of charges that is charged in the background and each batchRow
+//row is one charge in the file
+func CreateTableBatchJob(tx *sqlx.Tx) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableBatchJobs + `(
+			ID BIGSERIAL PRIMARY KEY,
+			BatchID TEXT NOT NULL UNIQUE,
+			NumRows BIGINT NOT NULL,
+			Username TEXT NOT NULL,
+			DatetimeStarted TEXT NOT NULL,
+			DatetimeFinished TEXT NOT NULL
+		)
+	`
+
+	_, err := tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableBatchJob: creating table", err)
+		return err
+	}
+
+	//index the column we look up unfinished batches by
+	q = `CREATE INDEX IF NOT EXISTS batchjob_finished_idx ON ` + TableBatchJobs + ` (DatetimeFinished)`
+	_, err = tx.Exec(q)
+	if err != nil {
+		log.Println("postgresutils.CreateTableBatchJob: creating finished index", err)
+		return err
+	}
+
+	q = `
+		CREATE TABLE IF NOT EXISTS ` + TableBatchRows + `(
+			ID BIGSERIAL PRIMARY KEY,
+			BatchID TEXT NOT NULL,
+			RowNumber BIGINT NOT NULL,
+			CustomerID TEXT NOT NULL,
+			CustomerName TEXT NOT NULL,
+			CustomerDatastoreID BIGINT NOT NULL,
+			SavedCardID BIGINT NOT NULL,
+			CardLast4 TEXT NOT NULL,
+			Amount TEXT NOT NULL,
+			AmountCents BIGINT NOT NULL,
+			Currency TEXT NOT NULL,
+			Invoice TEXT NOT NULL,
+			Po TEXT NOT NULL,
+			Level3 BOOLEAN NOT NULL,
+			Level3Params TEXT NOT NULL,
+			Status TEXT NOT NULL,
+			ChargeID TEXT NOT NULL,
+			Error TEXT NOT NULL,
+			EmailError TEXT NOT NULL,
+			DatetimeStarted TEXT NOT NULL,
+			DatetimeFinished TEXT NOT NULL,
+			UNIQUE (BatchID, RowNumber)
+		)
+	`
+
+	_, err = tx.Exec(q)
+	log.Println("postgresutils.CreateTableBatchJob...done")
+	return err
+}
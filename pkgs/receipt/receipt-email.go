@@ -0,0 +1,57 @@
+package receipt
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/pdfutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
+	"github.com/stripe/stripe-go/v72"
+)
+
+//BuildEmail builds the email for the receipt of a charge, or a refund of the charge
+//The html body is the same page as Show and the plain text body is the text of that page so
+//the emailed receipt looks the same as a printed receipt.  The receipt is attached as a PDF as
+//well.  The addresses to send to are set by the caller.
+//This is set as the card package's receipt builder in package main since the card package
+//can't import this package.
+func BuildEmail(r *http.Request, chargeID string, refund *stripe.Refund) (emailutils.Message, error) {
+	d, err := build(r, chargeID, refund)
+	if err != nil {
+		return emailutils.Message{}, err
+	}
+
+	var h bytes.Buffer
+	err = templates.Render(&h, "receipt.html", d)
+	if err != nil {
+		return emailutils.Message{}, err
+	}
+
+	t, err := text(d)
+	if err != nil {
+		return emailutils.Message{}, err
+	}
+
+	subject := "Receipt from " + d.CompanyName
+	if refund != nil {
+		subject = "Refund receipt from " + d.CompanyName
+	}
+	if d.Invoice != "" && d.Invoice != "*not provided*" {
+		subject += " for invoice " + d.Invoice
+	}
+
+	m := emailutils.Message{
+		Subject: subject,
+		Body:    t,
+		HTML:    h.String(),
+		Attachments: []emailutils.Attachment{
+			{
+				Filename:    pdfFilename(chargeID),
+				ContentType: pdfContentType,
+				Data:        pdfutils.FromText(subject, t),
+			},
+		},
+	}
+	return m, nil
+}
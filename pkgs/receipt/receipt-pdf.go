@@ -0,0 +1,56 @@
+package receipt
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/pdfutils"
+)
+
+//pdfContentType is the mime type of a PDF receipt
+const pdfContentType = "application/pdf"
+
+//ShowPDF builds a receipt as a PDF
+//This has the same data as Show but the PDF looks the same no matter which browser or printer
+//is used.  The PDF is shown in the browser and can be downloaded or attached to an email.
+func ShowPDF(w http.ResponseWriter, r *http.Request) {
+	//get charge id from form value
+	chargeID := r.FormValue("chg_id")
+
+	//get receipt data
+	d, err := build(r, chargeID, nil)
+	if err != nil {
+		fmt.Fprint(w, "An error occured and the receipt cannot be displayed.\n")
+		fmt.Fprint(w, err)
+		return
+	}
+
+	writePDF(w, pdfFilename(chargeID), "Receipt from "+d.CompanyName, d)
+}
+
+//PreviewPDF shows a demo receipt as a PDF
+//this is used to check the PDF receipt when saving the company info
+func PreviewPDF(w http.ResponseWriter, r *http.Request) {
+	writePDF(w, "receipt-preview.pdf", "Receipt preview", preview(r))
+}
+
+//writePDF builds a PDF from receipt data and sends it to the client
+func writePDF(w http.ResponseWriter, filename, title string, d receiptData) {
+	t, err := text(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pdf := pdfutils.FromText(title, t)
+
+	w.Header().Set("Content-Type", pdfContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	w.Write(pdf)
+}
+
+//pdfFilename returns the name of the file for a charge's PDF receipt
+func pdfFilename(chargeID string) string {
+	return "receipt-" + chargeID + ".pdf"
+}
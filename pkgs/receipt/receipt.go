@@ -1,13 +1,15 @@
 /*
 Package receipt is used to generate and show a receipt for a specific credit card charge.
-The data for a receipt is taken from Stripe (the charge data) and from the app engine datastore
-(information on the company who runs this app). The company data is used to make the receipt look
+The data for a receipt is taken from the ledger (the charge data, retrieved from Stripe if needed)
+and from the database (information on the company who runs this app). The company data is used to make the receipt look
 legit.
 */
 package receipt
 
 import (
+	"bytes"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"time"
@@ -16,6 +18,13 @@ import (
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/card"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
+	"github.com/stripe/stripe-go/v72"
+)
+
+//transaction types shown on a receipt
+const (
+	transactionSale   = "Sale"
+	transactionRefund = "Refund"
 )
 
 //receiptData is used for showing the receipt in html
@@ -42,61 +51,80 @@ type receiptData struct {
 	Captured,
 	Timestamp,
 	Amount,
+	CurrencySymbol,
 	Invoice,
-	Po string
+	Po,
+
+	//sale or refund, and information about the refund which is blank for a sale
+	TransactionType,
+	RefundAmount,
+	RefundReason,
+	RefundTimestamp string
 
 	//app settings
 	Timezone string
+
+	//charges made to a bank account instead of a card, the status is blank once the money
+	//arrives from the customer's bank
+	BankAccount   bool
+	PaymentStatus string
 }
 
 //Show builds an html page that display a receipt
 //this is a very boring, plain text, monospaced font page designed for easy printing and reading
 //the receipt is generated from the charge id
-//the data for the charge will have to be retrieved from stripe
+//the data for the charge is taken from the ledger, or stripe if the charge isn't in the ledger
 func Show(w http.ResponseWriter, r *http.Request) {
 	//get charge id from form value
 	chargeID := r.FormValue("chg_id")
 
-	//init stripe
-	c := r.Context()
-	sc := card.CreateStripeClient(c)
-
-	//get charge data
-	chg, err := sc.Charges.Get(chargeID, nil)
+	//get receipt data
+	output, err := build(r, chargeID, nil)
 	if err != nil {
 		fmt.Fprint(w, "An error occured and the receipt cannot be displayed.\n")
 		fmt.Fprint(w, err)
 		return
 	}
 
-	//extract charge data
-	d := card.ExtractDataFromCharge(chg)
+	//display receipt
+	templates.Load(w, "receipt", output)
+}
+
+//build gathers the data for the receipt of a charge
+//a refund is given when the receipt is for a refund of the charge, otherwise it is nil
+func build(r *http.Request, chargeID string, refund *stripe.Refund) (receiptData, error) {
+	//get charge data
+	c := r.Context()
+	d, err := card.GetChargeData(c, chargeID)
+	if err != nil {
+		return receiptData{}, err
+	}
 
 	//get company info
 	companyInfo, _ := company.Get(r)
 	if len(companyInfo.CompanyName) == 0 {
 		companyInfo.CompanyName = "**Company info has not been set yet.**"
 		companyInfo.Street = "**Please contact an administrator to fix this.**"
-		log.Println("receipt.Show", "Cannot view receipt because company info hasn't been set yet.")
+		log.Println("receipt.build", "Cannot view receipt because company info hasn't been set yet.")
 	}
 
 	//reformat datetime
 	utcLoc, err := time.LoadLocation("UTC")
 	if err != nil {
-		log.Println("receipt.Show: could not get UTC timezone location", err)
+		log.Println("receipt.build: could not get UTC timezone location", err)
 	}
 
 	appData, err := appsettings.Get(r)
 	timezone := "UTC" //default value
 	if err != nil {
-		log.Println("receipt.Show: could not get appsettings timezone", err)
+		log.Println("receipt.build: could not get appsettings timezone", err)
 	} else {
 		timezone = appData.ReportTimezone
 	}
 
 	guiLoc, err := time.LoadLocation(timezone)
 	if err != nil {
-		log.Println("receipt.Show: could not get gui timezone location", err)
+		log.Println("receipt.build: could not get gui timezone location", err)
 	}
 
 	originalTimeTime, err := time.ParseInLocation("2006-01-02T15:04:05.000Z", d.Timestamp, utcLoc)
@@ -104,12 +132,11 @@ func Show(w http.ResponseWriter, r *http.Request) {
 		//when charge is authorized only, not capture
 		d.Timestamp = "*not captured yet*"
 	} else if err != nil {
-		log.Println("receipt.Show: time reformat error", err)
+		log.Println("receipt.build: time reformat error", err)
 	} else {
 		d.Timestamp = originalTimeTime.In(guiLoc).Format("2006-01-02 @ 3:04:05PM")
 	}
 
-	//display receipt
 	output := receiptData{
 		CompanyName:         companyInfo.CompanyName,
 		Street:              companyInfo.Street,
@@ -129,35 +156,82 @@ func Show(w http.ResponseWriter, r *http.Request) {
 		Captured:            d.CapturedStr,
 		Timestamp:           d.Timestamp,
 		Amount:              d.AmountDollars,
+		CurrencySymbol:      d.CurrencySymbol,
 		Invoice:             d.Invoice,
 		Po:                  d.Po,
+		TransactionType:     transactionSale,
 		Timezone:            appData.ReportTimezone,
+		BankAccount:         d.PaymentType == "bank_account",
+		PaymentStatus:       paymentStatus(d),
 	}
-	templates.Load(w, "receipt", output)
+
+	//add the refund
+	//the refund is in the same currency as the charge
+	if refund != nil {
+		output.TransactionType = transactionRefund
+		output.RefundAmount = card.FormatAmount(refund.Amount, string(refund.Currency))
+		output.RefundReason = refundReason(refund.Reason)
+		output.RefundTimestamp = time.Unix(refund.Created, 0).In(guiLoc).Format("2006-01-02 @ 3:04:05PM")
+	}
+
+	return output, nil
+}
+
+//paymentStatus returns a human readable status for a bank account charge that hasn't settled
+//a bank account charge is pending until the money arrives from the customer's bank and fails if
+//the customer's bank returns the payment
+func paymentStatus(d card.ChargeData) string {
+	if d.Returned {
+		return "Returned by bank (" + d.FailureMessage + ")"
+	}
+	if d.Pending {
+		return "Pending, waiting on funds from bank"
+	}
+
+	return ""
+}
+
+//refundReason returns a human readable reason for a refund
+//the reasons match the choices when refunding a charge
+func refundReason(reason stripe.RefundReason) string {
+	switch reason {
+	case stripe.RefundReasonDuplicate:
+		return "Duplicate Charge"
+	case stripe.RefundReasonRequestedByCustomer:
+		return "Customer Request"
+	case stripe.RefundReasonFraudulent:
+		return "Fraudulent"
+	}
+
+	return "Other/Unknown"
 }
 
 //Preview shows a demo receipt with the company info and fake transaction data
 //this is used to show the receipt when saving the company info.
 func Preview(w http.ResponseWriter, r *http.Request) {
+	templates.Load(w, "receipt", preview(r))
+}
+
+//preview builds the data for a demo receipt
+func preview(r *http.Request) receiptData {
 	//get company info
 	companyInfo, err := company.Get(r)
 	if err != nil {
-		log.Println("receipt.Preview - Could not get company info", err)
+		log.Println("receipt.preview - Could not get company info", err)
 	}
 	if len(companyInfo.CompanyName) == 0 {
 		companyInfo.CompanyName = "**Company info has not been set yet.**"
 		companyInfo.Street = "**Please contact an administrator to fix this.**"
-		log.Println("receipt.Preview", "Cannot preview receipt because company info hasn't been set yet.")
+		log.Println("receipt.preview", "Cannot preview receipt because company info hasn't been set yet.")
 	}
 
 	//get app settings (timezone)
 	appInfo, err := appsettings.Get(r)
 	if err != nil {
-		log.Println("receipt.Preview - Could not get app settings", err)
+		log.Println("receipt.preview - Could not get app settings", err)
 		appInfo.ReportTimezone = "EST (just for preview)"
 	}
 
-	//display receipt
 	output := receiptData{
 		CompanyName:         companyInfo.CompanyName,
 		Street:              companyInfo.Street,
@@ -177,9 +251,23 @@ func Preview(w http.ResponseWriter, r *http.Request) {
 		Captured:            "true",
 		Timestamp:           "2025-01-02T08:16:32.000Z",
 		Amount:              "256.04",
+		CurrencySymbol:      "$",
 		Invoice:             "344402",
 		Po:                  "3345",
+		TransactionType:     transactionSale,
 		Timezone:            appInfo.ReportTimezone,
 	}
-	templates.Load(w, "receipt", output)
+	return output
+}
+
+//text builds the plain text of a receipt
+//this is the same text shown on the html receipt, without the html escaping
+func text(d receiptData) (string, error) {
+	var b bytes.Buffer
+	err := templates.Render(&b, "receipt_text", d)
+	if err != nil {
+		return "", err
+	}
+
+	return html.UnescapeString(b.String()), nil
 }
@@ -0,0 +1,526 @@
+/*
+Package sqliteutils is used to interact with a sqlite db.
+
+This file handles backing up and restoring the db.  Since the entire db is a single file,
+losing that file means losing every link between a customer and their card saved in Stripe.
+
+Backups are made with sqlite's online backup api so the app does not need to be stopped
+while a backup is made.  Each backup is saved as a new, timestamped file in the backup
+directory and old backups are removed based on the retention settings.
+
+Restoring is done when the app is not running since the db file is replaced.
+*/
+package sqliteutils
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	//defaultBackupKeep is the number of backups kept when no value is given
+	defaultBackupKeep = 7
+
+	//backupFilePrefix and backupFileExt are the start and end of a backup file's name
+	//the time the backup was made is between these so that sorting by name sorts by time
+	backupFilePrefix = "sqlite-backup-"
+	backupFileExt    = ".db"
+
+	//backupTimeFormat is the format of the timestamp in a backup file's name
+	backupTimeFormat = "20060102-150405"
+
+	//backupPagesPerStep is the number of pages copied at one time
+	//copying in steps allows other queries to run while a backup is made
+	backupPagesPerStep = 256
+
+	//backupStepDelay is how long to wait between steps or when the db is busy
+	backupStepDelay = 10 * time.Millisecond
+
+	//backupTimeout is how long a backup can take before we give up
+	backupTimeout = 5 * time.Minute
+)
+
+//backup and restore errors
+var (
+	errBackupsDisabled       = errors.New("sqliteutils: backups are not enabled, set a backup directory")
+	errBackupExists          = errors.New("sqliteutils: a backup with this name already exists, try again in a moment")
+	errBackupTimeout         = errors.New("sqliteutils: backup did not complete in time")
+	errInvalidBackupName     = errors.New("sqliteutils: invalid backup name")
+	errRestoreWhileConnected = errors.New("sqliteutils: cannot restore while connected to the db")
+	errIntegrityCheck        = errors.New("sqliteutils: backup failed integrity check")
+	errMissingTable          = errors.New("sqliteutils: backup is missing a table")
+	errMissingColumn         = errors.New("sqliteutils: backup is missing a column")
+	errNewerSchema           = errors.New("sqliteutils: backup has migrations applied which are unknown to this version of the app")
+	errDatabaseInUse         = errors.New("sqliteutils: a journal file exists for the db, make sure the app is stopped")
+)
+
+//baselineTables are the tables every db has had since before migrations existed
+//a backup must have these tables before it is migrated, every other table is added by a
+//migration so a backup made by an older version of the app may not have it yet
+var baselineTables = []string{
+	TableUsers,
+	TableCards,
+	TableCompanyInfo,
+	TableAppSettings,
+}
+
+//backupLock makes sure only one backup is made at a time
+var backupLock sync.Mutex
+
+//BackupFile is the info about a backup shown in the gui
+type BackupFile struct {
+	Name     string `json:"name"`     //the file name, used to download the backup
+	Size     int64  `json:"size"`     //bytes
+	Datetime string `json:"datetime"` //when the backup was made, yyyy-mm-ddThh:mm:ssZ
+}
+
+//BackupsEnabled returns true if a backup directory has been set and we are connected to a db
+func BackupsEnabled() bool {
+	return Config.BackupDirectory != "" && Connection != nil
+}
+
+//Backup makes a copy of the db in the backup directory and removes old backups
+func Backup() (BackupFile, error) {
+	if !BackupsEnabled() {
+		return BackupFile{}, errBackupsDisabled
+	}
+
+	backupLock.Lock()
+	defer backupLock.Unlock()
+
+	err := os.MkdirAll(Config.BackupDirectory, 0700)
+	if err != nil {
+		return BackupFile{}, err
+	}
+
+	//build the file name
+	now := time.Now().UTC()
+	name := backupFilePrefix + now.Format(backupTimeFormat) + backupFileExt
+	finalPath := filepath.Join(Config.BackupDirectory, name)
+	if _, err := os.Stat(finalPath); err == nil {
+		return BackupFile{}, errBackupExists
+	}
+
+	//write the backup to a temp file first so that a partial backup is never listed
+	tempPath := finalPath + ".tmp"
+	err = backupTo(Config.PathToDatabaseFile, tempPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return BackupFile{}, err
+	}
+
+	err = os.Rename(tempPath, finalPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return BackupFile{}, err
+	}
+
+	info, err := os.Stat(finalPath)
+	if err != nil {
+		return BackupFile{}, err
+	}
+
+	log.Println("sqliteutils.Backup: Saved backup", finalPath)
+
+	//remove old backups
+	//a failure here doesn't mean the backup failed so just log it
+	if err := rotateBackups(); err != nil {
+		log.Println("sqliteutils.Backup: Could not remove old backups.", err)
+	}
+
+	return BackupFile{
+		Name:     name,
+		Size:     info.Size(),
+		Datetime: now.Format(time.RFC3339),
+	}, nil
+}
+
+//backupTo copies the db at srcPath to destPath using sqlite's online backup api
+//the connections are opened directly with the driver since the backup api works on
+//the driver's connections, not the pooled connection used elsewhere
+func backupTo(srcPath, destPath string) error {
+	d := &sqlite3.SQLiteDriver{}
+
+	src, err := d.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dest, err := d.Open(destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	srcConn := src.(*sqlite3.SQLiteConn)
+	destConn := dest.(*sqlite3.SQLiteConn)
+
+	b, err := destConn.Backup("main", srcConn, "main")
+	if err != nil {
+		return err
+	}
+
+	//copy the db in steps
+	//if the db is written to while copying, sqlite restarts the backup on the next step
+	//a step also returns not done, with no error, if the db is busy so keep trying until we time out
+	deadline := time.Now().Add(backupTimeout)
+	for {
+		done, err := b.Step(backupPagesPerStep)
+		if err != nil {
+			b.Finish()
+			return err
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			b.Finish()
+			return errBackupTimeout
+		}
+
+		time.Sleep(backupStepDelay)
+	}
+
+	return b.Finish()
+}
+
+//ListBackups returns the backups in the backup directory, newest first
+func ListBackups() ([]BackupFile, error) {
+	list := []BackupFile{}
+	if Config.BackupDirectory == "" {
+		return list, errBackupsDisabled
+	}
+
+	entries, err := os.ReadDir(Config.BackupDirectory)
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return list, err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		t, ok := parseBackupName(e.Name())
+		if !ok {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return list, err
+		}
+
+		list = append(list, BackupFile{
+			Name:     e.Name(),
+			Size:     info.Size(),
+			Datetime: t.Format(time.RFC3339),
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name > list[j].Name
+	})
+
+	return list, nil
+}
+
+//parseBackupName checks if a file name is a backup and returns the time the backup was made
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupFilePrefix) || !strings.HasSuffix(name, backupFileExt) {
+		return time.Time{}, false
+	}
+
+	ts := strings.TrimSuffix(strings.TrimPrefix(name, backupFilePrefix), backupFileExt)
+	t, err := time.Parse(backupTimeFormat, ts)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+//BackupPath returns the full path to a backup by its name
+//the name must be a backup in the backup directory, this stops a user from reading any other file
+func BackupPath(name string) (string, error) {
+	if Config.BackupDirectory == "" {
+		return "", errBackupsDisabled
+	}
+
+	if name != filepath.Base(name) {
+		return "", errInvalidBackupName
+	}
+	if _, ok := parseBackupName(name); !ok {
+		return "", errInvalidBackupName
+	}
+
+	p := filepath.Join(Config.BackupDirectory, name)
+	if _, err := os.Stat(p); err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
+//rotateBackups removes backups based on the retention settings
+//only the newest BackupKeep backups are kept and, if set, backups older than BackupMaxAgeDays
+//are removed.  The newest backup is never removed.
+func rotateBackups() error {
+	list, err := ListBackups()
+	if err != nil {
+		return err
+	}
+
+	minTime := time.Time{}
+	if Config.BackupMaxAgeDays > 0 {
+		minTime = time.Now().UTC().AddDate(0, 0, -Config.BackupMaxAgeDays)
+	}
+
+	for i, b := range list {
+		if i == 0 {
+			continue
+		}
+
+		t, _ := parseBackupName(b.Name)
+		if i < Config.BackupKeep && !t.Before(minTime) {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(Config.BackupDirectory, b.Name))
+		if err != nil {
+			return err
+		}
+
+		log.Println("sqliteutils.rotateBackups: Removed old backup", b.Name)
+	}
+
+	return nil
+}
+
+//ScheduleBackups makes a backup every BackupIntervalHours
+//this blocks so run it in a goroutine
+func ScheduleBackups() {
+	if !BackupsEnabled() || Config.BackupIntervalHours < 1 {
+		return
+	}
+
+	log.Println("sqliteutils.ScheduleBackups: Backing up every", Config.BackupIntervalHours, "hours")
+
+	t := time.NewTicker(time.Duration(Config.BackupIntervalHours) * time.Hour)
+	defer t.Stop()
+	for range t.C {
+		if _, err := Backup(); err != nil {
+			log.Println("sqliteutils.ScheduleBackups: Backup failed.", err)
+		}
+	}
+}
+
+//Restore replaces the db with a backup
+//This must be run when the app is not running and before Connect is called.  The backup
+//is copied next to the db and checked before being swapped in: the copy must pass an
+//integrity check, be migrated to the newest schema, and have every table and column a newly
+//deployed db would have.  The existing db is kept alongside with a ".pre-restore-" suffix
+//and its path is returned.
+func Restore(backupPath string) (string, error) {
+	if Connection != nil {
+		return "", errRestoreWhileConnected
+	}
+
+	//a journal file means the db is in use or the app didn't close cleanly
+	//the journal would be applied to the restored db so don't continue
+	if _, err := os.Stat(Config.PathToDatabaseFile + "-journal"); err == nil {
+		return "", errDatabaseInUse
+	}
+
+	//copy the backup next to the db so the final swap is a rename on the same filesystem
+	//the backup itself is never changed
+	tempPath := Config.PathToDatabaseFile + ".restore-tmp"
+	os.Remove(tempPath)
+	err := copyFile(backupPath, tempPath)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkRestore(tempPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return "", err
+	}
+
+	//keep the existing db in case the restore wasn't wanted
+	previousPath := ""
+	if _, err := os.Stat(Config.PathToDatabaseFile); err == nil {
+		previousPath = Config.PathToDatabaseFile + ".pre-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		if _, err := os.Stat(previousPath); err == nil {
+			os.Remove(tempPath)
+			return "", errBackupExists
+		}
+
+		err := os.Rename(Config.PathToDatabaseFile, previousPath)
+		if err != nil {
+			os.Remove(tempPath)
+			return "", err
+		}
+	}
+
+	err = os.Rename(tempPath, Config.PathToDatabaseFile)
+	if err != nil {
+		//put the existing db back
+		if previousPath != "" {
+			os.Rename(previousPath, Config.PathToDatabaseFile)
+		}
+		os.Remove(tempPath)
+		return "", err
+	}
+
+	log.Println("sqliteutils.Restore: Restored", backupPath)
+	return previousPath, nil
+}
+
+//checkRestore makes sure a copy of a backup can be used as the db
+func checkRestore(path string) error {
+	c, err := sqlx.Open(dbType, path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.MapperFunc(func(s string) string { return s })
+
+	//make sure the file is a valid, uncorrupted db
+	var result string
+	err = c.Get(&result, "PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		log.Println("sqliteutils.checkRestore:", result)
+		return errIntegrityCheck
+	}
+
+	//don't restore a backup made by a newer version of this app
+	applied, err := getAppliedMigrationsIfExists(c)
+	if err != nil {
+		return err
+	}
+	for v := range applied {
+		if len(migrations) == 0 || v > migrations[len(migrations)-1].Version {
+			return errNewerSchema
+		}
+	}
+
+	//get the schema of a newly deployed db to compare the backup to
+	ref, err := sqlx.Open(dbType, ":memory:")
+	if err != nil {
+		return err
+	}
+	defer ref.Close()
+	ref.SetMaxOpenConns(1) //each connection to :memory: is a different db
+
+	for _, f := range deployFuncs {
+		if err := f(ref); err != nil {
+			return err
+		}
+	}
+
+	var tables []string
+	err = ref.Select(&tables, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+
+	//make sure the tables the migrations change exist before migrating
+	//tables added by migrations are checked after migrating
+	for _, t := range baselineTables {
+		have, err := tableColumns(c, t)
+		if err != nil {
+			return err
+		}
+		if len(have) == 0 {
+			log.Println("sqliteutils.checkRestore: Table", t)
+			return errMissingTable
+		}
+	}
+
+	//bring an older backup up to date
+	err = migrate(c)
+	if err != nil {
+		return err
+	}
+
+	//make sure every table and column exists now that the backup is up to date
+	for _, t := range tables {
+		want, err := tableColumns(ref, t)
+		if err != nil {
+			return err
+		}
+
+		have, err := tableColumns(c, t)
+		if err != nil {
+			return err
+		}
+		if len(have) == 0 {
+			log.Println("sqliteutils.checkRestore: Table", t)
+			return errMissingTable
+		}
+
+		for col := range want {
+			if !have[col] {
+				log.Println("sqliteutils.checkRestore: Column", t+"."+col)
+				return errMissingColumn
+			}
+		}
+	}
+
+	return nil
+}
+
+//tableColumns returns the names of the columns in a table
+func tableColumns(c *sqlx.DB, table string) (map[string]bool, error) {
+	var cols []string
+	err := c.Select(&cols, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]bool, len(cols))
+	for _, col := range cols {
+		m[col] = true
+	}
+
+	return m, nil
+}
+
+//copyFile copies a file, the destination must not exist
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
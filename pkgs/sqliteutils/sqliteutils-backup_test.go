@@ -0,0 +1,90 @@
+package sqliteutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		queries []string
+		deploy  bool
+		wantErr error
+	}{
+		{
+			name:    "newest schema",
+			deploy:  true,
+			wantErr: nil,
+		},
+		{
+			name:    "baseline schema without later tables",
+			queries: baselineSchema,
+			wantErr: nil,
+		},
+		{
+			name:    "missing baseline table",
+			queries: baselineSchema[1:4],
+			wantErr: errMissingTable,
+		},
+		{
+			name:    "newer migration applied",
+			deploy:  true,
+			queries: []string{`INSERT INTO schemaMigrations (Version, Description, DatetimeApplied) VALUES (100000, 'future', '2099-01-01T00:00:00Z')`},
+			wantErr: errNewerSchema,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "backup.db")
+			if tt.deploy {
+				deployTestDB(t, path)
+			}
+			createDB(t, path, tt.queries)
+
+			err := checkRestore(path)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRestoreBaselineBackup(t *testing.T) {
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup.db")
+	createDB(t, backupPath, baselineSchema)
+
+	dbPath := filepath.Join(dir, "current.db")
+	deployTestDB(t, dbPath)
+
+	oldPath := Config.PathToDatabaseFile
+	Config.PathToDatabaseFile = dbPath
+	defer func() { Config.PathToDatabaseFile = oldPath }()
+
+	previousPath, err := Restore(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previousPath == "" {
+		t.Fatal("existing db was not kept")
+	}
+	if _, err := os.Stat(previousPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dbPath + ".restore-tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary restore file was not removed")
+	}
+
+	//the restored db should be migrated to the newest schema
+	c := openTestDB(t, dbPath)
+	applied, err := getAppliedMigrations(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("restored db has %d applied migrations, want %d", len(applied), len(migrations))
+	}
+}
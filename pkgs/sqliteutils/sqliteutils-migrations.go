@@ -0,0 +1,485 @@
+/*
+Package sqliteutils is used to interact with a sqlite db.
+
+This file handles versioned changes to the schema of an already deployed database.
+Each change is a numbered migration that is run once, in order, inside a transaction.
+The migrations that have been run are recorded in the migrations table so we know
+which migrations still need to be run when the app starts.
+
+When a migration is added, the deploy funcs in sqliteutils-schema.go should also be
+updated so that a newly deployed database has the same schema as a migrated one.
+*/
+package sqliteutils
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
+	"github.com/jmoiron/sqlx"
+)
+
+//TableMigrations is the name of the table used to record which migrations have been run
+const TableMigrations = "schemaMigrations"
+
+//migration errors
+var (
+	errDuplicateMigration = errors.New("sqliteutils: a migration with this version is already registered")
+	errInvalidMigration   = errors.New("sqliteutils: a migration version must be greater than zero")
+	errDatabaseNotFound   = errors.New("sqliteutils: the database file does not exist")
+)
+
+//migrationFunc is the signature for a function that changes the schema of the db.
+//The func is given the transaction the migration is run in and should use it for
+//every query so that a failed migration doesn't leave a partially changed schema.
+type migrationFunc func(tx *sqlx.Tx) error
+
+//Migration is a single numbered change to the schema of the db.
+type Migration struct {
+	Version     int64         //the order this migration is run in, must be unique and greater than 0
+	Description string        //a short description of what this migration changes, shown in -migrate-status
+	Func        migrationFunc //the func that changes the schema
+}
+
+//migrations is the list of registered migrations.
+var migrations []Migration
+
+//RegisterMigration saves a migration to the list of migrations so it will be run when
+//the db is connected to.  Migrations can be registered in any order, they are always
+//run in order of their version.
+func RegisterMigration(m ...Migration) {
+	for _, v := range m {
+		if v.Version < 1 {
+			log.Fatalln(errInvalidMigration, v.Version)
+		}
+
+		for _, existing := range migrations {
+			if existing.Version == v.Version {
+				log.Fatalln(errDuplicateMigration, v.Version)
+			}
+		}
+
+		migrations = append(migrations, v)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+}
+
+//MigrationStatus is used to show if a migration has been run
+type MigrationStatus struct {
+	Version         int64
+	Description     string
+	Applied         bool
+	DatetimeApplied string
+}
+
+//appliedMigration is a row in the migrations table
+type appliedMigration struct {
+	Version         int64
+	Description     string
+	DatetimeApplied string
+}
+
+//CreateTableMigrations creates the table used to record which migrations have been run
+func CreateTableMigrations(c *sqlx.DB) error {
+	q := `
+		CREATE TABLE IF NOT EXISTS ` + TableMigrations + `(
+			Version INTEGER PRIMARY KEY NOT NULL,
+			Description TEXT NOT NULL,
+			DatetimeApplied TEXT NOT NULL
+		)
+	`
+
+	_, err := c.Exec(q)
+	return err
+}
+
+//getAppliedMigrations returns the migrations that have been run keyed by version
+func getAppliedMigrations(c *sqlx.DB) (map[int64]appliedMigration, error) {
+	q := `
+		SELECT Version, Description, DatetimeApplied
+		FROM ` + TableMigrations + `
+		ORDER BY Version
+	`
+
+	rows := []appliedMigration{}
+	err := c.Select(&rows, q)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]appliedMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+
+	return applied, nil
+}
+
+//getAppliedMigrationsIfExists returns the migrations that have been run without creating the migrations table
+//a db deployed before migrations existed won't have the migrations table, in this case no migrations have been run
+func getAppliedMigrationsIfExists(c *sqlx.DB) (map[int64]appliedMigration, error) {
+	var tableCount int
+	err := c.Get(&tableCount, "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", TableMigrations)
+	if err != nil {
+		return nil, err
+	}
+	if tableCount == 0 {
+		return map[int64]appliedMigration{}, nil
+	}
+
+	return getAppliedMigrations(c)
+}
+
+//recordMigration notes that a migration has been run
+func recordMigration(e sqlx.Execer, m Migration) error {
+	q := `
+		INSERT INTO ` + TableMigrations + ` (
+			Version,
+			Description,
+			DatetimeApplied
+		) VALUES (?, ?, ?)
+	`
+
+	_, err := e.Exec(q, m.Version, m.Description, timestamps.ISO8601())
+	return err
+}
+
+//markMigrationsApplied records every registered migration as run without running them
+//this is used when a new db is deployed since the deploy funcs already create the newest schema
+func markMigrationsApplied(c *sqlx.DB) error {
+	for _, m := range migrations {
+		if err := recordMigration(c, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//migrate runs any migrations that have not been run yet
+//each migration is run in its own transaction along with recording that it was run
+//so a migration is either fully applied and recorded or not applied at all
+func migrate(c *sqlx.DB) error {
+	//make sure the migrations table exists
+	//databases deployed before migrations existed won't have this table
+	err := CreateTableMigrations(c)
+	if err != nil {
+		return err
+	}
+
+	applied, err := getAppliedMigrations(c)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		log.Println("sqliteutils.migrate: Running migration", m.Version, "-", m.Description)
+
+		tx, err := c.Beginx()
+		if err != nil {
+			return err
+		}
+
+		err = m.Func(tx)
+		if err != nil {
+			tx.Rollback()
+			log.Println("sqliteutils.migrate: Migration", m.Version, "failed")
+			return err
+		}
+
+		err = recordMigration(tx, m)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	//warn if the db has been migrated by a newer version of this app
+	for v := range applied {
+		if len(migrations) == 0 || v > migrations[len(migrations)-1].Version {
+			log.Println("sqliteutils.migrate: The database has migration", v, "applied which is unknown to this version of the app.")
+		}
+	}
+
+	log.Println("sqliteutils.migrate...done")
+	return nil
+}
+
+//GetMigrationStatus returns every registered migration and whether or not it has been run
+//This does not run any migrations or deploy the db.  This requires SetConfig be run first.
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	if _, err := os.Stat(Config.PathToDatabaseFile); os.IsNotExist(err) {
+		return nil, errDatabaseNotFound
+	}
+
+	c, err := sqlx.Open(dbType, Config.PathToDatabaseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.MapperFunc(func(s string) string { return s })
+
+	applied, err := getAppliedMigrationsIfExists(c)
+	if err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, m := range migrations {
+		a, ok := applied[m.Version]
+		status = append(status, MigrationStatus{
+			Version:         m.Version,
+			Description:     m.Description,
+			Applied:         ok,
+			DatetimeApplied: a.DatetimeApplied,
+		})
+	}
+
+	return status, nil
+}
+
+//columnExists checks if a column exists in a table
+func columnExists(tx *sqlx.Tx, table, column string) (bool, error) {
+	q := `
+		SELECT COUNT(*)
+		FROM pragma_table_info('` + table + `')
+		WHERE name = ?
+	`
+
+	var count int
+	err := tx.Get(&count, q, column)
+	return count > 0, err
+}
+
+//AddTableLedger adds the ledger table to a db deployed before the ledger existed
+func AddTableLedger(tx *sqlx.Tx) error {
+	_, err := tx.Exec(ledgerSchema)
+	return err
+}
+
+//AddColumnsLedgerFees adds the columns that store the fee and net amount of each
+//charge and refund to the ledger table
+func AddColumnsLedgerFees(tx *sqlx.Tx) error {
+	columns := []struct {
+		name string
+		def  string
+	}{
+		{"BalanceTransactionID", "TEXT NOT NULL DEFAULT ''"},
+		{"FeeCents", "INTEGER NOT NULL DEFAULT 0"},
+		{"NetCents", "INTEGER NOT NULL DEFAULT 0"},
+		{"AvailableOn", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, c := range columns {
+		//check if column already exists
+		//the columns exist if the ledger table was created after they were added to the schema
+		exists, err := columnExists(tx, TableLedger, c.name)
+		if err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+
+		q := `
+			ALTER TABLE ` + TableLedger + `
+			ADD COLUMN ` + c.name + ` ` + c.def
+		_, err = tx.Exec(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//AddColumnsCurrency adds the columns that store a customer's currency and the default currency
+//to a db deployed before charges could be made in currencies other than USD
+//Existing customers get a blank currency so they are charged in the default currency.
+func AddColumnsCurrency(tx *sqlx.Tx) error {
+	columns := []struct {
+		table string
+		name  string
+		def   string
+	}{
+		{TableCards, "Currency", "TEXT NOT NULL DEFAULT ''"},
+		{TableAppSettings, "DefaultCurrency", "TEXT NOT NULL DEFAULT 'usd'"},
+	}
+
+	for _, c := range columns {
+		//check if column already exists
+		exists, err := columnExists(tx, c.table, c.name)
+		if err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+
+		q := `
+			ALTER TABLE ` + c.table + `
+			ADD COLUMN ` + c.name + ` ` + c.def
+		_, err = tx.Exec(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//AddTableSavedCard adds the savedCard table to a db deployed before customers could have more than one card
+//Existing customers don't get a row in this table until a second card is added to them since
+//the id of their card on Stripe has to be looked up.
+func AddTableSavedCard(tx *sqlx.Tx) error {
+	_, err := tx.Exec(savedCardSchema)
+	return err
+}
+
+//AddTableWebhookEvent adds the webhookEvent table to a db deployed before the webhook existed
+func AddTableWebhookEvent(tx *sqlx.Tx) error {
+	_, err := tx.Exec(webhookEventSchema)
+	return err
+}
+
+//AddColumnManageDisputes adds the ManageDisputes permission to the users table
+//existing users can't manage disputes until an administrator gives them the permission
+func AddColumnManageDisputes(tx *sqlx.Tx) error {
+	//check if column already exists
+	exists, err := columnExists(tx, TableUsers, "ManageDisputes")
+	if err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	q := `
+		ALTER TABLE ` + TableUsers + `
+		ADD COLUMN ManageDisputes BOOL NOT NULL DEFAULT 0
+	`
+	_, err = tx.Exec(q)
+	return err
+}
+
+//AddColumnsSavedCardUpdated adds the columns that record who replaced a saved card and when
+func AddColumnsSavedCardUpdated(tx *sqlx.Tx) error {
+	columns := []string{"DatetimeUpdated", "UpdatedByUser"}
+
+	for _, column := range columns {
+		//check if column already exists
+		exists, err := columnExists(tx, TableSavedCards, column)
+		if err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+
+		q := `
+			ALTER TABLE ` + TableSavedCards + `
+			ADD COLUMN ` + column + ` TEXT NOT NULL DEFAULT ''`
+		_, err = tx.Exec(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//AddColumnBillingEmail adds the column that stores the email address of a customer's billing contact
+func AddColumnBillingEmail(tx *sqlx.Tx) error {
+	//check if column already exists
+	exists, err := columnExists(tx, TableCards, "BillingEmail")
+	if err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	q := `
+		ALTER TABLE ` + TableCards + `
+		ADD COLUMN BillingEmail TEXT NOT NULL DEFAULT ''`
+	_, err = tx.Exec(q)
+	return err
+}
+
+//AddColumnsPaymentType adds the columns that record if a saved card or charge is a card or a bank
+//account, and if a bank account is verified
+func AddColumnsPaymentType(tx *sqlx.Tx) error {
+	columns := map[string][]string{
+		TableSavedCards: {"PaymentType", "BankAccountStatus"},
+		TableLedger:     {"PaymentType"},
+	}
+
+	for table, tableColumns := range columns {
+		for _, column := range tableColumns {
+			//check if column already exists
+			exists, err := columnExists(tx, table, column)
+			if err != nil {
+				return err
+			} else if exists {
+				continue
+			}
+
+			q := `
+				ALTER TABLE ` + table + `
+				ADD COLUMN ` + column + ` TEXT NOT NULL DEFAULT ''`
+			_, err = tx.Exec(q)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//AddTableScheduledCharge adds the scheduledCharge and scheduledChargeRun tables to a db deployed
+//before charges could be scheduled
+func AddTableScheduledCharge(tx *sqlx.Tx) error {
+	_, err := tx.Exec(scheduledChargeSchema)
+	return err
+}
+
+//AddTableBatchJob adds the batchJob and batchRow tables to a db deployed before batches were
+//charged in the background
+func AddTableBatchJob(tx *sqlx.Tx) error {
+	_, err := tx.Exec(batchJobSchema)
+	return err
+}
+
+//AddColumnLastUsedTimestamp adds the LastUsedTimestamp column card table if it doesn't already exist
+//The column may already exist if it was added before migrations were used.
+func AddColumnLastUsedTimestamp(tx *sqlx.Tx) error {
+	//column to add
+	column := "LastUsedTimestamp"
+
+	//check if column already exists
+	exists, err := columnExists(tx, TableCards, column)
+	if err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	//add the new column
+	//set the current unix timestamp as a default value so we can check existing cards for age in
+	q := `
+		ALTER TABLE ` + TableCards + `
+		ADD COLUMN ` + column + ` INTEGER NOT NULL DEFAULT ` + strconv.FormatInt(timestamps.Unix(), 10)
+	_, err = tx.Exec(q)
+	return err
+}
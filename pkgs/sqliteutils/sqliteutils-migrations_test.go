@@ -0,0 +1,400 @@
+package sqliteutils
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//baselineSchema is the schema of a db deployed before migrations existed
+var baselineSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		Username TEXT NOT NULL,
+		Password TEXT NOT NULL,
+		AddCards BOOL NOT NULL DEFAULT 0,
+		RemoveCards BOOL NOT NULL DEFAULT 0,
+		ChargeCards BOOL NOT NULL DEFAULT 0,
+		ViewReports BOOL NOT NULL DEFAULT 0,
+		Administrator BOOL NOT NULL DEFAULT 0,
+		Active BOOL NOT NULL DEFAULT 1,
+		Created TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS card (
+		ID TEXT PRIMARY KEY NOT NULL,
+		CustomerID TEXT NOT NULL,
+		CustomerName TEXT NOT NULL,
+		Cardholder TEXT NOT NULL,
+		CardExpiration TEXT NOT NULL,
+		CardLast4 TEXT NOT NULL,
+		StripeCustomerToken TEXT NOT NULL,
+		DatetimeCreated TEXT NOT NULL,
+		AddedByUser TEXT NOT NULL,
+		LastUsedTimestamp INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS companyInfo (
+		ID INTEGER NOT NULL DEFAULT 1,
+		CompanyName TEXT NOT NULL DEFAULT '',
+		Street TEXT NOT NULL DEFAULT '',
+		Suite TEXT NOT NULL DEFAULT '',
+		City TEXT NOT NULL DEFAULT '',
+		State TEXT NOT NULL DEFAULT '',
+		PostalCode TEXT NOT NULL DEFAULT '',
+		Country TEXT NOT NULL DEFAULT '',
+		PhoneNum TEXT NOT NULL DEFAULT '',
+		Email TEXT NOT NULL DEFAULT '',
+		PercentFee REAL NOT NULL DEFAULT 0,
+		FixedFee REAL NOT NULL DEFAULT 0,
+		StatementDescriptor TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS appSettings (
+		ID INTEGER NOT NULL DEFAULT 1,
+		RequireCustomerID BOOL NOT NULL DEFAULT 0,
+		CustomerIDFormat TEXT NOT NULL DEFAULT '',
+		CustomerIDRegex TEXT NOT NULL DEFAULT '',
+		ReportTimezone TEXT NOT NULL DEFAULT '',
+		APIKey TEXT NOT NULL DEFAULT ''
+	)`,
+	`INSERT INTO users (Username, Password, Administrator, Created) VALUES ('administrator', 'x', 1, '2020-01-01T00:00:00Z')`,
+	`INSERT INTO card (ID, CustomerID, CustomerName, Cardholder, CardExpiration, CardLast4, StripeCustomerToken, DatetimeCreated, AddedByUser) VALUES ('1', 'cust1', 'Customer', 'Cardholder', '12/2030', '4242', 'cus_test', '2020-01-01T00:00:00Z', 'administrator')`,
+	`INSERT INTO companyInfo (ID) VALUES (1)`,
+	`INSERT INTO appSettings (ID) VALUES (1)`,
+}
+
+//createDB creates a db file from a list of queries
+func createDB(t *testing.T, path string, queries []string) {
+	t.Helper()
+
+	c, err := sqlx.Open(dbType, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, q := range queries {
+		if _, err := c.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//deployTestDB creates a db file with the newest schema
+func deployTestDB(t *testing.T, path string) {
+	t.Helper()
+
+	c, err := sqlx.Open(dbType, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.MapperFunc(func(s string) string { return s })
+
+	for _, f := range deployFuncs {
+		if err := f(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := markMigrationsApplied(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//openTestDB opens a db file for a test and closes it when the test is done
+func openTestDB(t *testing.T, path string) *sqlx.DB {
+	t.Helper()
+
+	c, err := sqlx.Open(dbType, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.MapperFunc(func(s string) string { return s })
+
+	return c
+}
+
+//useTestMigrations replaces the registered migrations for the length of a test
+func useTestMigrations(t *testing.T, m ...Migration) {
+	t.Helper()
+
+	old := migrations
+	migrations = nil
+	RegisterMigration(m...)
+	t.Cleanup(func() { migrations = old })
+}
+
+//columns returns the names of the columns in a table
+func columns(t *testing.T, c *sqlx.DB, table string) map[string]bool {
+	t.Helper()
+
+	var cols []string
+	err := c.Select(&cols, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make(map[string]bool, len(cols))
+	for _, col := range cols {
+		m[col] = true
+	}
+
+	return m
+}
+
+func TestRegisteredMigrations(t *testing.T) {
+	if len(migrations) == 0 {
+		t.Fatal("no migrations registered")
+	}
+
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Errorf("migration %d is not after migration %d", m.Version, migrations[i-1].Version)
+		}
+		if m.Description == "" {
+			t.Errorf("migration %d has no description", m.Version)
+		}
+		if m.Func == nil {
+			t.Errorf("migration %d has no func", m.Version)
+		}
+	}
+}
+
+func TestMigrateBaselineSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	createDB(t, path, baselineSchema)
+
+	c := openTestDB(t, path)
+
+	//running the migrations a second time should do nothing
+	for i := 0; i < 2; i++ {
+		if err := migrate(c); err != nil {
+			t.Fatalf("migrate run %d: %v", i+1, err)
+		}
+	}
+
+	applied, err := getAppliedMigrations(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("got %d applied migrations, want %d", len(applied), len(migrations))
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			t.Errorf("migration %d not recorded", m.Version)
+		}
+	}
+
+	//existing data must survive the migrations
+	var count int
+	if err := c.Get(&count, "SELECT COUNT(*) FROM "+TableCards); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %d cards, want 1", count)
+	}
+}
+
+func TestMigrateRunsInOrderOnce(t *testing.T) {
+	var ran []int64
+	step := func(v int64, q string) Migration {
+		return Migration{
+			Version:     v,
+			Description: "test migration",
+			Func: func(tx *sqlx.Tx) error {
+				ran = append(ran, v)
+				_, err := tx.Exec(q)
+				return err
+			},
+		}
+	}
+
+	//registered out of order, run in order of version
+	useTestMigrations(t,
+		step(2, "ALTER TABLE t ADD COLUMN b TEXT"),
+		step(1, "CREATE TABLE t (a TEXT)"),
+	)
+
+	c := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	if err := migrate(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 || ran[0] != 1 || ran[1] != 2 {
+		t.Fatalf("ran migrations %v, want [1 2]", ran)
+	}
+
+	//a migration registered later only runs itself
+	RegisterMigration(step(3, "ALTER TABLE t ADD COLUMN c TEXT"))
+	ran = nil
+	if err := migrate(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 1 || ran[0] != 3 {
+		t.Fatalf("ran migrations %v, want [3]", ran)
+	}
+
+	applied, err := getAppliedMigrations(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 3 {
+		t.Errorf("got %d applied migrations, want 3", len(applied))
+	}
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	errTest := errors.New("test migration failed")
+	fail := true
+
+	useTestMigrations(t,
+		Migration{Version: 1, Description: "create a", Func: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("CREATE TABLE a (x TEXT)")
+			return err
+		}},
+		Migration{Version: 2, Description: "create b", Func: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("CREATE TABLE b (x TEXT)")
+			if err != nil {
+				return err
+			}
+			if fail {
+				return errTest
+			}
+			return nil
+		}},
+	)
+
+	c := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	if err := migrate(c); err != errTest {
+		t.Fatalf("migrate() error = %v, want %v", err, errTest)
+	}
+
+	applied, err := getAppliedMigrations(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := applied[1]; !ok {
+		t.Error("migration 1 was not recorded")
+	}
+	if _, ok := applied[2]; ok {
+		t.Error("failed migration 2 was recorded")
+	}
+
+	cols := columns(t, c, "b")
+	if len(cols) != 0 {
+		t.Error("table created by failed migration 2 was not rolled back")
+	}
+
+	//the failed migration is run again next time
+	fail = false
+	if err := migrate(c); err != nil {
+		t.Fatal(err)
+	}
+	applied, err = getAppliedMigrations(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := applied[2]; !ok {
+		t.Error("migration 2 was not recorded after it succeeded")
+	}
+}
+
+func TestMigrateDeployedDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new.db")
+	deployTestDB(t, path)
+
+	c := openTestDB(t, path)
+	before, err := getAppliedMigrations(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != len(migrations) {
+		t.Fatalf("deployed db has %d applied migrations, want %d", len(before), len(migrations))
+	}
+
+	if err := migrate(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigratedSchemaMatchesDeployed(t *testing.T) {
+	dir := t.TempDir()
+
+	deployedPath := filepath.Join(dir, "new.db")
+	deployTestDB(t, deployedPath)
+	deployed := openTestDB(t, deployedPath)
+
+	migratedPath := filepath.Join(dir, "old.db")
+	createDB(t, migratedPath, baselineSchema)
+	migrated := openTestDB(t, migratedPath)
+	if err := migrate(migrated); err != nil {
+		t.Fatal(err)
+	}
+
+	var tables []string
+	err := deployed.Select(&tables, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var migratedTables []string
+	err = migrated.Select(&migratedTables, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != len(migratedTables) {
+		t.Errorf("deployed db has tables %v, migrated db has tables %v", tables, migratedTables)
+	}
+
+	//a column missing from either db means a migration or a deploy func wasn't updated
+	for _, table := range tables {
+		want := columns(t, deployed, table)
+		got := columns(t, migrated, table)
+
+		for col := range want {
+			if !got[col] {
+				t.Errorf("migrated db is missing %s.%s", table, col)
+			}
+		}
+		for col := range got {
+			if !want[col] {
+				t.Errorf("deployed db is missing %s.%s", table, col)
+			}
+		}
+	}
+}
+
+func TestGetMigrationStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	createDB(t, path, baselineSchema)
+
+	oldPath := Config.PathToDatabaseFile
+	Config.PathToDatabaseFile = path
+	defer func() { Config.PathToDatabaseFile = oldPath }()
+
+	status, err := GetMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("got %d statuses, want %d", len(status), len(migrations))
+	}
+	for _, s := range status {
+		if s.Applied {
+			t.Errorf("migration %d is applied on a db that was never migrated", s.Version)
+		}
+	}
+
+	//looking up the status doesn't create the migrations table
+	c := openTestDB(t, path)
+	cols := columns(t, c, TableMigrations)
+	if len(cols) != 0 {
+		t.Error("migrations table was created")
+	}
+
+	Config.PathToDatabaseFile = filepath.Join(t.TempDir(), "missing.db")
+	if _, err := GetMigrationStatus(); err != errDatabaseNotFound {
+		t.Errorf("GetMigrationStatus() error = %v, want %v", err, errDatabaseNotFound)
+	}
+}
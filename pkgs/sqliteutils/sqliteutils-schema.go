@@ -8,22 +8,25 @@ data, ex: card.CustomerDatastore.
 package sqliteutils
 
 import (
-	"database/sql"
-	"errors"
 	"log"
-	"strconv"
 
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
 	"github.com/jmoiron/sqlx"
 )
 
 //these are the names of the tables used to store data
 //these values should match the entity names in datastoreutils.go
 const (
-	TableUsers       = "users"
-	TableCards       = "card"
-	TableCompanyInfo = "companyInfo"
-	TableAppSettings = "appSettings"
+	TableUsers               = "users"
+	TableCards               = "card"
+	TableCompanyInfo         = "companyInfo"
+	TableAppSettings         = "appSettings"
+	TableLedger              = "ledger"
+	TableSavedCards          = "savedCard"
+	TableWebhookEvents       = "webhookEvent"
+	TableScheduledCharges    = "scheduledCharge"
+	TableScheduledChargeRuns = "scheduledChargeRun"
+	TableBatchJobs           = "batchJob"
+	TableBatchRows           = "batchRow"
 )
 
 //these are the default IDs of the rows in the companyInfo and appSettings tables
@@ -33,11 +36,6 @@ const (
 	DefaultAppSettingsID = 1
 )
 
-//deployment or alter schema errors
-var (
-	errNoSuchColumn = errors.New("no such column") //this is the exact text that is returned from a SELECT query where a column doesn't exist in the table
-)
-
 //CreateTableUsers creates the users table
 func CreateTableUsers(c *sqlx.DB) error {
 	q := `
@@ -51,7 +49,8 @@ func CreateTableUsers(c *sqlx.DB) error {
 			ViewReports BOOL NOT NULL,
 			Administrator BOOL NOT NULL,
 			Active BOOL NOT NULL,
-			Created TEXT NOT NULL
+			Created TEXT NOT NULL,
+			ManageDisputes BOOL NOT NULL DEFAULT 0
 		)
 	`
 
@@ -73,7 +72,9 @@ func CreateTableCard(c *sqlx.DB) error {
 			StripeCustomerToken TEXT NOT NULL,
 			DatetimeCreated TEXT NOT NULL,
 			AddedByUser TEXT NOT NULL,
-			LastUsedTimestamp INTEGER NOT NULL
+			LastUsedTimestamp INTEGER NOT NULL,
+			Currency TEXT NOT NULL DEFAULT '',
+			BillingEmail TEXT NOT NULL DEFAULT ''
 		)
 	`
 
@@ -82,6 +83,212 @@ func CreateTableCard(c *sqlx.DB) error {
 	return err
 }
 
+//ledgerSchema is the sql used to create the ledger table and its indexes
+//this is shared between deploying a new db and the migration that adds the table to an existing db
+const ledgerSchema = `
+	CREATE TABLE IF NOT EXISTS ` + TableLedger + `(
+			ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			StripeID TEXT NOT NULL UNIQUE,
+			Type TEXT NOT NULL,
+			StripeChargeID TEXT NOT NULL,
+			StripeCustomerToken TEXT NOT NULL,
+			CustomerID TEXT NOT NULL,
+			CustomerName TEXT NOT NULL,
+			AmountCents INTEGER NOT NULL,
+			AmountRefundedCents INTEGER NOT NULL,
+			Currency TEXT NOT NULL,
+			BalanceTransactionID TEXT NOT NULL,
+			FeeCents INTEGER NOT NULL,
+			NetCents INTEGER NOT NULL,
+			AvailableOn INTEGER NOT NULL,
+			Status TEXT NOT NULL,
+			Captured BOOL NOT NULL,
+			FailureCode TEXT NOT NULL,
+			FailureMessage TEXT NOT NULL,
+			Invoice TEXT NOT NULL,
+			Po TEXT NOT NULL,
+			Cardholder TEXT NOT NULL,
+			CardBrand TEXT NOT NULL,
+			CardLast4 TEXT NOT NULL,
+			CardExpiration TEXT NOT NULL,
+			Username TEXT NOT NULL,
+			AuthorizedByUser TEXT NOT NULL,
+			AuthorizedDatetime TEXT NOT NULL,
+			ProcessedDatetime TEXT NOT NULL,
+			AutoCharge BOOL NOT NULL,
+			AutoChargeReferrer TEXT NOT NULL,
+			AutoChargeReason TEXT NOT NULL,
+			Level3Provided BOOL NOT NULL,
+			Reason TEXT NOT NULL,
+			Metadata TEXT NOT NULL,
+			Created INTEGER NOT NULL,
+			DatetimeSynced TEXT NOT NULL,
+			PaymentType TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS ledger_type_created_idx ON ` + TableLedger + `(Type, Created);
+	CREATE INDEX IF NOT EXISTS ledger_customer_idx ON ` + TableLedger + `(StripeCustomerToken, Created);
+`
+
+//CreateTableLedger creates the ledger table
+//the ledger is a local copy of every charge and refund so reports don't need to page through Stripe
+func CreateTableLedger(c *sqlx.DB) error {
+	_, err := c.Exec(ledgerSchema)
+	log.Println("sqliteutils.CreateTableLedger...done")
+	return err
+}
+
+//savedCardSchema is the sql used to create the savedCard table and its index
+//this is shared between deploying a new db and the migration that adds the table to an existing db
+const savedCardSchema = `
+	CREATE TABLE IF NOT EXISTS ` + TableSavedCards + `(
+			ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			CustomerDatastoreID INTEGER NOT NULL,
+			StripeCardID TEXT NOT NULL,
+			Cardholder TEXT NOT NULL,
+			CardExpiration TEXT NOT NULL,
+			CardLast4 TEXT NOT NULL,
+			CardBrand TEXT NOT NULL,
+			IsDefault BOOL NOT NULL,
+			DatetimeCreated TEXT NOT NULL,
+			AddedByUser TEXT NOT NULL,
+			DatetimeUpdated TEXT NOT NULL DEFAULT '',
+			UpdatedByUser TEXT NOT NULL DEFAULT '',
+			PaymentType TEXT NOT NULL DEFAULT '',
+			BankAccountStatus TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS savedcard_customer_idx ON ` + TableSavedCards + `(CustomerDatastoreID);
+`
+
+//CreateTableSavedCard creates the savedCard table
+//each row is one of the cards attached to a customer in the card table
+func CreateTableSavedCard(c *sqlx.DB) error {
+	_, err := c.Exec(savedCardSchema)
+	log.Println("sqliteutils.CreateTableSavedCard...done")
+	return err
+}
+
+//webhookEventSchema is the sql used to create the webhookEvent table
+//this is shared between deploying a new db and the migration that adds the table to an existing db
+const webhookEventSchema = `
+	CREATE TABLE IF NOT EXISTS ` + TableWebhookEvents + `(
+			ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			StripeEventID TEXT NOT NULL UNIQUE,
+			Type TEXT NOT NULL,
+			Created INTEGER NOT NULL,
+			DatetimeProcessed TEXT NOT NULL
+	);
+`
+
+//CreateTableWebhookEvent creates the webhookEvent table
+//each row is an event from Stripe that was handled so the same event isn't handled twice
+func CreateTableWebhookEvent(c *sqlx.DB) error {
+	_, err := c.Exec(webhookEventSchema)
+	log.Println("sqliteutils.CreateTableWebhookEvent...done")
+	return err
+}
+
+//scheduledChargeSchema is the sql used to create the scheduledCharge and scheduledChargeRun tables
+//this is shared between deploying a new db and the migration that adds the tables to an existing db
+//the unique index on runs stops the same date of a schedule from being charged twice
+const scheduledChargeSchema = `
+	CREATE TABLE IF NOT EXISTS ` + TableScheduledCharges + `(
+			ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			CustomerDatastoreID INTEGER NOT NULL,
+			SavedCardID INTEGER NOT NULL,
+			AmountCents INTEGER NOT NULL,
+			Currency TEXT NOT NULL,
+			Interval TEXT NOT NULL,
+			IntervalDays INTEGER NOT NULL,
+			StartDate TEXT NOT NULL,
+			EndDate TEXT NOT NULL,
+			InvoiceTemplate TEXT NOT NULL,
+			PoTemplate TEXT NOT NULL,
+			NextRunDate TEXT NOT NULL,
+			Active BOOL NOT NULL,
+			RunCount INTEGER NOT NULL,
+			LastRunDate TEXT NOT NULL,
+			LastRunStatus TEXT NOT NULL,
+			DatetimeCreated TEXT NOT NULL,
+			CreatedByUser TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS scheduledcharge_customer_idx ON ` + TableScheduledCharges + `(CustomerDatastoreID);
+	CREATE INDEX IF NOT EXISTS scheduledcharge_next_run_idx ON ` + TableScheduledCharges + `(Active, NextRunDate);
+
+	CREATE TABLE IF NOT EXISTS ` + TableScheduledChargeRuns + `(
+			ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			ScheduledChargeID INTEGER NOT NULL,
+			RunDate TEXT NOT NULL,
+			Status TEXT NOT NULL,
+			ChargeID TEXT NOT NULL,
+			AmountCents INTEGER NOT NULL,
+			Currency TEXT NOT NULL,
+			Invoice TEXT NOT NULL,
+			Po TEXT NOT NULL,
+			Error TEXT NOT NULL,
+			IdempotencyKey TEXT NOT NULL,
+			DatetimeStarted TEXT NOT NULL,
+			DatetimeFinished TEXT NOT NULL,
+			UNIQUE(ScheduledChargeID, RunDate)
+	);
+`
+
+//CreateTableScheduledCharge creates the scheduledCharge and scheduledChargeRun tables
+//each scheduledCharge row is a repeating charge of a customer and each scheduledChargeRun row
+//is one attempt at charging it
+func CreateTableScheduledCharge(c *sqlx.DB) error {
+	_, err := c.Exec(scheduledChargeSchema)
+	log.Println("sqliteutils.CreateTableScheduledCharge...done")
+	return err
+}
+
+//batchJobSchema is the sql used to create the batchJob and batchRow tables
+//this is shared between deploying a new db and the migration that adds the tables to an existing db
+const batchJobSchema = `
+	CREATE TABLE IF NOT EXISTS ` + TableBatchJobs + `(
+			ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			BatchID TEXT NOT NULL UNIQUE,
+			NumRows INTEGER NOT NULL,
+			Username TEXT NOT NULL,
+			DatetimeStarted TEXT NOT NULL,
+			DatetimeFinished TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS batchjob_finished_idx ON ` + TableBatchJobs + `(DatetimeFinished);
+
+	CREATE TABLE IF NOT EXISTS ` + TableBatchRows + `(
+			ID INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			BatchID TEXT NOT NULL,
+			RowNumber INTEGER NOT NULL,
+			CustomerID TEXT NOT NULL,
+			CustomerName TEXT NOT NULL,
+			CustomerDatastoreID INTEGER NOT NULL,
+			SavedCardID INTEGER NOT NULL,
+			CardLast4 TEXT NOT NULL,
+			Amount TEXT NOT NULL,
+			AmountCents INTEGER NOT NULL,
+			Currency TEXT NOT NULL,
+			Invoice TEXT NOT NULL,
+			Po TEXT NOT NULL,
+			Level3 BOOL NOT NULL,
+			Level3Params TEXT NOT NULL,
+			Status TEXT NOT NULL,
+			ChargeID TEXT NOT NULL,
+			Error TEXT NOT NULL,
+			EmailError TEXT NOT NULL,
+			DatetimeStarted TEXT NOT NULL,
+			DatetimeFinished TEXT NOT NULL,
+			UNIQUE(BatchID, RowNumber)
+	);
+`
+
+//CreateTableBatchJob creates the batchJob and batchRow tables
+//each batchJob row is a csv file of charges that is charged in the background and each batchRow
+//row is one charge in the file
+func CreateTableBatchJob(c *sqlx.DB) error {
+	_, err := c.Exec(batchJobSchema)
+	log.Println("sqliteutils.CreateTableBatchJob...done")
+	return err
+}
+
 //CreateTableCompanyInfo creates the companyInfo table
 //there should only ever be one record in this table
 func CreateTableCompanyInfo(c *sqlx.DB) error {
@@ -167,7 +374,8 @@ func CreateTableAppSettings(c *sqlx.DB) error {
 			CustomerIDFormat TEXT NOT NULL,
 			CustomerIDRegex TEXT NOT NULL,
 			ReportTimezone TEXT NOT NULL,
-			APIKey TEXT NOT NULL
+			APIKey TEXT NOT NULL,
+			DefaultCurrency TEXT NOT NULL DEFAULT 'usd'
 		)
 	`
 
@@ -185,8 +393,9 @@ func CreateTableAppSettings(c *sqlx.DB) error {
 		CustomerIDFormat,
 		CustomerIDRegex,
 		ReportTimezone,
-		APIKey
-	) VALUES (?, ?, ?, ?, ?, ?)
+		APIKey,
+		DefaultCurrency
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
 	stmt, err := c.Prepare(q)
 	if err != nil {
@@ -201,6 +410,7 @@ func CreateTableAppSettings(c *sqlx.DB) error {
 		"",
 		"",
 		"",
+		"usd",
 	)
 	if err != nil {
 		log.Println("sqliteutils.CreateTableAppSettings: inserting initial data 2", err)
@@ -210,39 +420,3 @@ func CreateTableAppSettings(c *sqlx.DB) error {
 	log.Println("sqliteutils.CreateTableAppSettings...done")
 	return err
 }
-
-//AddColumnLastUsedTimestamp adds the LastUsedTimestamp column card table if it doesn't already exist
-func AddColumnLastUsedTimestamp(c *sqlx.DB) error {
-	//column to add
-	column := "LastUsedTimestamp"
-
-	//check if column already exists
-	q := `
-		SELECT ` + column + ` 
-		FROM ` + TableCards + `
-		WHERE ID > 0
-		LIMIT 1
-	`
-	var rowValue int64
-	err := c.Get(&rowValue, q)
-	if err == nil || err == sql.ErrNoRows {
-		//column exists, do nothing
-		return nil
-	} else if err.Error() == errNoSuchColumn.Error()+": "+column {
-		//column doesn't exist add it
-		log.Println("sqliteutils.AddColumnLastUsedTimestamp - column doesn't exist, will be added")
-	} else if err != nil {
-		//another error occured
-		log.Println("sqliteutils.AddColumnLastUsedTimestamp", err)
-		return err
-	}
-
-	//add the new column
-	//set the current unix timestamp as a default value so we can check existing cards for age in
-	q = `
-		ALTER TABLE ` + TableCards + ` 
-		ADD COLUMN ` + column + ` INTEGER DEFAULT ` + strconv.FormatInt(timestamps.Unix(), 10)
-	_, err = c.Exec(q)
-	log.Println("sqliteutils.AddColumnLastUsedTimestamp...done")
-	return err
-}
@@ -20,14 +20,20 @@ var Connection *sqlx.DB
 //config is the set of configuration options for interacting with a sqlite db.
 //this struct is used in SetConfig which is run in package main init()
 type config struct {
-	PathToDatabaseFile string //the full path to the file used as the database, defaults to $GOPATH/src/github.com/coreymgilmore/stripe-appengine-frontend/services/process-cards/sqlite.db
-	UseSQLite          bool   //set to true when we want to use sqlite as the storage engine, so we know to use sqlite versus cloud datastore
+	PathToDatabaseFile  string //the full path to the file used as the database, defaults to $GOPATH/src/github.com/coreymgilmore/stripe-appengine-frontend/services/process-cards/sqlite.db
+	BackupDirectory     string //the full path to the directory backups are saved to, backups are disabled if blank
+	BackupIntervalHours int    //how often a backup is automatically made, 0 means backups are only made manually
+	BackupKeep          int    //the number of most recent backups to keep
+	BackupMaxAgeDays    int    //backups older than this are removed, 0 means backups are kept no matter their age
 }
 
 //Config is a copy of the config with some defaults set
 var Config = config{
-	PathToDatabaseFile: "",
-	UseSQLite:          false,
+	PathToDatabaseFile:  "",
+	BackupDirectory:     "",
+	BackupIntervalHours: 0,
+	BackupKeep:          defaultBackupKeep,
+	BackupMaxAgeDays:    0,
 }
 
 //dbType is the type of database we are connecting to
@@ -46,19 +52,56 @@ func SetConfig(c config) {
 		c.PathToDatabaseFile = filepath.FromSlash(c.PathToDatabaseFile)
 	}
 
+	//check backup settings
+	if c.BackupDirectory != "" {
+		c.BackupDirectory = filepath.FromSlash(c.BackupDirectory)
+	}
+	if c.BackupKeep < 1 {
+		c.BackupKeep = defaultBackupKeep
+	}
+	if c.BackupIntervalHours < 0 {
+		c.BackupIntervalHours = 0
+	}
+	if c.BackupMaxAgeDays < 0 {
+		c.BackupMaxAgeDays = 0
+	}
+
 	//save the configuration
-	c.UseSQLite = true
 	Config = c
 
 	log.Println("Using SQLite file:", Config.PathToDatabaseFile)
+	if Config.BackupDirectory != "" {
+		log.Println("Saving SQLite backups to:", Config.BackupDirectory)
+	}
 }
 
 func init() {
 	RegisterDeployFunc(
+		CreateTableMigrations,
 		CreateTableUsers,
 		CreateTableCard,
 		CreateTableCompanyInfo,
 		CreateTableAppSettings,
+		CreateTableLedger,
+		CreateTableSavedCard,
+		CreateTableWebhookEvent,
+		CreateTableScheduledCharge,
+		CreateTableBatchJob,
+	)
+
+	RegisterMigration(
+		Migration{Version: 1, Description: "add LastUsedTimestamp column to card table", Func: AddColumnLastUsedTimestamp},
+		Migration{Version: 2, Description: "add ledger table", Func: AddTableLedger},
+		Migration{Version: 3, Description: "add fee columns to ledger table", Func: AddColumnsLedgerFees},
+		Migration{Version: 4, Description: "add savedCard table", Func: AddTableSavedCard},
+		Migration{Version: 5, Description: "add currency columns to card and appSettings tables", Func: AddColumnsCurrency},
+		Migration{Version: 6, Description: "add webhookEvent table", Func: AddTableWebhookEvent},
+		Migration{Version: 7, Description: "add ManageDisputes column to users table", Func: AddColumnManageDisputes},
+		Migration{Version: 8, Description: "add updated columns to savedCard table", Func: AddColumnsSavedCardUpdated},
+		Migration{Version: 9, Description: "add BillingEmail column to card table", Func: AddColumnBillingEmail},
+		Migration{Version: 10, Description: "add scheduledCharge and scheduledChargeRun tables", Func: AddTableScheduledCharge},
+		Migration{Version: 11, Description: "add payment type columns to savedCard and ledger tables", Func: AddColumnsPaymentType},
+		Migration{Version: 12, Description: "add batchJob and batchRow tables", Func: AddTableBatchJob},
 	)
 }
 
@@ -68,18 +111,19 @@ type Bindvars []interface{}
 
 //Connect establishes and tests a connection to a db
 //if this returns successfully, queries can be run on the db.
+//A new db is deployed if the db file doesn't exist yet and any migrations that
+//haven't been run yet are run.
 func Connect() {
 	//check if the db doesn't exist
 	//sqlite db is simply a file
-	if _, err := os.Stat(Config.PathToDatabaseFile); os.IsNotExist(err) {
-		deployDB()
-	}
+	_, err := os.Stat(Config.PathToDatabaseFile)
+	needsDeploy := os.IsNotExist(err)
 
 	//connect to db
 	c, err := sqlx.Open(dbType, Config.PathToDatabaseFile)
 	if err != nil {
-		log.Fatalln("sqliteutils.Connect: Could not open connection to sqlite db.", err)
 		log.Println("Attempted to use path:", Config.PathToDatabaseFile)
+		log.Fatalln("sqliteutils.Connect: Could not open connection to sqlite db.", err)
 		return
 	}
 
@@ -96,31 +140,29 @@ func Connect() {
 	//this can be overridden after the db connection is established (ex.: in init() in main.go) by redefining the MapperFunc
 	c.MapperFunc(func(s string) string { return s })
 
-	//save connection to global var so we can reuse it
-	Connection = c
+	//deploy the db if needed
+	if needsDeploy {
+		deployDB(c)
+	}
 
-	//make sure schema is correct
-	err = AddColumnLastUsedTimestamp(c)
+	//make sure schema is up to date
+	err = migrate(c)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalln("sqliteutils.Connect: Could not migrate db.", err)
 		return
 	}
 
+	//save connection to global var so we can reuse it
+	Connection = c
+
 	log.Println("sqliteutils.Connect: Connecting...done")
 }
 
 //deployDB deploys the db
-func deployDB() {
+//since the deploy funcs create the newest schema, every migration is noted as already run
+func deployDB(c *sqlx.DB) {
 	log.Println("sqliteutils: Deploying db...")
 
-	c, err := sqlx.Open(dbType, Config.PathToDatabaseFile)
-	if err != nil {
-		log.Fatalln("sqliteutils.deployDB: Could not open connection to sqlite db to deploy.", err)
-		log.Println("Attempted to use path:", Config.PathToDatabaseFile)
-		return
-	}
-	defer c.Close()
-
 	//iterate through deploy funcs
 	for _, f := range deployFuncs {
 		if err := f(c); err != nil {
@@ -128,6 +170,10 @@ func deployDB() {
 		}
 	}
 
+	if err := markMigrationsApplied(c); err != nil {
+		log.Fatalln(err)
+	}
+
 	log.Println("sqliteutils.deployDB: Deploying db...done")
 }
 
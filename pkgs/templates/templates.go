@@ -5,6 +5,7 @@ package templates
 
 import (
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -81,6 +82,17 @@ func build() {
 
 //Load shows a template to the client, show the GUI
 func Load(w http.ResponseWriter, templateName string, data interface{}) {
+	template := templateName + ".html"
+	if err := Render(w, template, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+//Render writes a template to w instead of showing it to the client
+//This is used to build html that isn't served, such as the body of an email.  The name can be a
+//file (receipt.html) or a template defined within a file (receipt_text).
+func Render(w io.Writer, name string, data interface{}) error {
 	//build data struct for serving template
 	//this takes the data value and any configuration options and combines them
 	d := struct {
@@ -91,9 +103,5 @@ func Load(w http.ResponseWriter, templateName string, data interface{}) {
 		Configuration: Config,
 	}
 
-	template := templateName + ".html"
-	if err := htmlTemplates.ExecuteTemplate(w, template, d); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	return htmlTemplates.ExecuteTemplate(w, name, d)
 }
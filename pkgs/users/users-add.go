@@ -1,19 +1,15 @@
 package users
 
 import (
-	"context"
 	"log"
 	"net/http"
 	"strconv"
 
-	"cloud.google.com/go/datastore"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/pwds"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/timestamps"
 )
 
@@ -50,33 +46,22 @@ func CreateAdmin(w http.ResponseWriter, r *http.Request) {
 
 	//gather data
 	u := User{
-		Username:      adminUsername,
-		Password:      hashedPwd,
-		AddCards:      true,
-		RemoveCards:   true,
-		ChargeCards:   true,
-		ViewReports:   true,
-		Administrator: true,
-		Active:        true,
-		Created:       timestamps.ISO8601(),
-	}
-
-	//save to correct database
-	var newUserID int64
-	var outerErr error
-	if sqliteutils.Config.UseSQLite {
-		newUserID, outerErr = addUserSqlite(u)
-
-	} else {
-		//save to datastore
-		ctx := r.Context()
-		incompleteKey := datastoreutils.GetNewIncompleteKey(datastoreutils.EntityUsers)
-		completeKey, err := saveUserDatastore(ctx, incompleteKey, u)
-		outerErr = err
-		newUserID = completeKey.ID
-	}
-
-	if outerErr != nil {
+		Username:       adminUsername,
+		Password:       hashedPwd,
+		AddCards:       true,
+		RemoveCards:    true,
+		ChargeCards:    true,
+		ViewReports:    true,
+		ManageDisputes: true,
+		Administrator:  true,
+		Active:         true,
+		Created:        timestamps.ISO8601(),
+	}
+
+	//save to db
+	ctx := r.Context()
+	newUserID, err := store.Add(ctx, u)
+	if err != nil {
 		notificationPage(w, "panel-danger", "Error", "An error occured while saving the admin user. "+err.Error(), "btn-default", "/setup/", "Try Again")
 		return
 	}
@@ -94,7 +79,6 @@ func CreateAdmin(w http.ResponseWriter, r *http.Request) {
 	//save the default company info
 	//ignore errors since app will still work without this data being set
 	//and user will see errors about missing stuff in the app
-	ctx := r.Context()
 	err = company.SaveDefaultInfo(ctx)
 	if err != nil {
 		log.Println("users.CreateAdmin", "Could not save default company info.", err)
@@ -122,6 +106,7 @@ func Add(w http.ResponseWriter, r *http.Request) {
 	removeCards, _ := strconv.ParseBool(r.FormValue("removeCards"))
 	chargeCards, _ := strconv.ParseBool(r.FormValue("chargeCards"))
 	viewReports, _ := strconv.ParseBool(r.FormValue("reports"))
+	manageDisputes, _ := strconv.ParseBool(r.FormValue("disputes"))
 	isAdmin, _ := strconv.ParseBool(r.FormValue("admin"))
 	isActive, _ := strconv.ParseBool(r.FormValue("active"))
 
@@ -152,25 +137,20 @@ func Add(w http.ResponseWriter, r *http.Request) {
 
 	//gather data to save new user
 	u := User{
-		Username:      username,
-		Password:      hashedPwd,
-		AddCards:      addCards,
-		RemoveCards:   removeCards,
-		ChargeCards:   chargeCards,
-		ViewReports:   viewReports,
-		Administrator: isAdmin,
-		Active:        isActive,
-		Created:       timestamps.ISO8601(),
-	}
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		_, err = addUserSqlite(u)
-	} else {
-		incompleteKey := datastoreutils.GetNewIncompleteKey(datastoreutils.EntityUsers)
-		_, err = saveUserDatastore(c, incompleteKey, u)
-	}
-
+		Username:       username,
+		Password:       hashedPwd,
+		AddCards:       addCards,
+		RemoveCards:    removeCards,
+		ChargeCards:    chargeCards,
+		ViewReports:    viewReports,
+		ManageDisputes: manageDisputes,
+		Administrator:  isAdmin,
+		Active:         isActive,
+		Created:        timestamps.ISO8601(),
+	}
+
+	//save to db
+	_, err = store.Add(c, u)
 	if err != nil {
 		log.Println("users.Add-could not save user", err)
 		output.Error(err, "Could not save user.", w)
@@ -180,62 +160,3 @@ func Add(w http.ResponseWriter, r *http.Request) {
 	//respond to client with success message
 	output.Success("addNewUser", nil, w)
 }
-
-//saveUserDatastore saves a new user to the datastore
-func saveUserDatastore(c context.Context, key *datastore.Key, user User) (*datastore.Key, error) {
-	//connect to datastore
-	client, err := datastoreutils.Connect(c)
-	if err != nil {
-		return key, err
-	}
-
-	//save to datastore
-	completeKey, err := client.Put(c, key, &user)
-	if err != nil {
-		return completeKey, err
-	}
-
-	//done
-	return completeKey, nil
-}
-
-//addUserSqlite saves a new user to the sqlite db
-func addUserSqlite(user User) (int64, error) {
-	c := sqliteutils.Connection
-	q := `
-			INSERT INTO ` + sqliteutils.TableUsers + ` (
-				Username,
-				Password,
-				AddCards,
-				RemoveCards,
-				ChargeCards,
-				ViewReports,
-				Administrator,
-				Active,
-				Created
-			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`
-	stmt, err := c.Prepare(q)
-	if err != nil {
-
-		return 0, err
-	}
-
-	res, err := stmt.Exec(
-		user.Username,
-		user.Password,
-		user.AddCards,
-		user.RemoveCards,
-		user.ChargeCards,
-		user.ViewReports,
-		user.Administrator,
-		user.Active,
-		user.Created,
-	)
-	if err != nil {
-		return 0, err
-	}
-
-	id, err := res.LastInsertId()
-	return id, err
-}
@@ -0,0 +1,159 @@
+package users
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
+	"google.golang.org/api/iterator"
+)
+
+//datastoreStore saves and retrieves users from the google cloud datastore
+type datastoreStore struct{}
+
+//NewDatastoreStore returns a Store that uses the google cloud datastore
+func NewDatastoreStore() Store {
+	return datastoreStore{}
+}
+
+//GetAll returns the id and username of every user
+//only need to get username and entity key to cut down on datastore usage
+func (s datastoreStore) GetAll(ctx context.Context) ([]userList, error) {
+	list := []userList{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return list, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityUsers).Order("Username").Project("Username")
+	i := client.Run(ctx, q)
+	for {
+		one := User{}
+		key, err := i.Next(&one)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return list, err
+		}
+
+		l := userList{
+			Username: one.Username,
+			ID:       key.ID,
+		}
+		list = append(list, l)
+	}
+
+	return list, nil
+}
+
+//FindAll returns the full data for every user
+func (s datastoreStore) FindAll(ctx context.Context) ([]User, error) {
+	list := []User{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return list, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityUsers)
+	i := client.Run(ctx, q)
+	for {
+		one := User{}
+		key, err := i.Next(&one)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return list, err
+		}
+
+		one.ID = key.ID
+		list = append(list, one)
+	}
+
+	return list, nil
+}
+
+//FindByID looks up a user by id
+func (s datastoreStore) FindByID(ctx context.Context, userID int64) (User, error) {
+	u := User{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return u, err
+	}
+
+	key := datastoreutils.GetKeyFromID(datastoreutils.EntityUsers, userID)
+	err = client.Get(ctx, key, &u)
+	return u, err
+}
+
+//FindByUsername looks up a user by username
+//using a query instead of Get because you cannot filter using Get
+func (s datastoreStore) FindByUsername(ctx context.Context, username string) (User, error) {
+	u := User{}
+
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return u, err
+	}
+
+	q := datastore.NewQuery(datastoreutils.EntityUsers).Filter("Username = ", username).Limit(1)
+	i := client.Run(ctx, q)
+	var numResults int
+	var fullKey *datastore.Key
+	for {
+		var tempUserData User
+		tempKey, err := i.Next(&tempUserData)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return u, err
+		}
+
+		//save key and data to variables outside iterator
+		fullKey = tempKey
+		u = tempUserData
+		numResults++
+	}
+
+	//check if no user was found matching this username
+	if numResults == 0 {
+		return u, ErrUserDoesNotExist
+	}
+
+	//user found
+	u.ID = fullKey.ID
+	return u, nil
+}
+
+//Add saves a new user to the cloud datastore
+func (s datastoreStore) Add(ctx context.Context, u User) (int64, error) {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	key := datastoreutils.GetNewIncompleteKey(datastoreutils.EntityUsers)
+	completeKey, err := client.Put(ctx, key, &u)
+	if err != nil {
+		return 0, err
+	}
+
+	return completeKey.ID, nil
+}
+
+//Update saves changes to an existing user in the cloud datastore
+func (s datastoreStore) Update(ctx context.Context, userID int64, u User) error {
+	client, err := datastoreutils.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := datastoreutils.GetKeyFromID(datastoreutils.EntityUsers, userID)
+	_, err = client.Put(ctx, key, &u)
+	return err
+}
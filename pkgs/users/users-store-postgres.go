@@ -0,0 +1,140 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/postgresutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//postgresStore saves and retrieves users from a postgres db
+type postgresStore struct {
+	c *sqlx.DB
+}
+
+//NewPostgresStore returns a Store that uses the given postgres db connection
+func NewPostgresStore(c *sqlx.DB) Store {
+	return postgresStore{c: c}
+}
+
+//GetAll returns the id and username of every user
+func (s postgresStore) GetAll(ctx context.Context) ([]userList, error) {
+	list := []userList{}
+	q := `
+		SELECT ID, Username
+		FROM ` + postgresutils.TableUsers + `
+		ORDER BY Username
+	`
+	err := s.c.SelectContext(ctx, &list, q)
+	return list, err
+}
+
+//FindAll returns the full data for every user
+func (s postgresStore) FindAll(ctx context.Context) ([]User, error) {
+	list := []User{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableUsers + `
+		ORDER BY ID
+	`
+	err := s.c.SelectContext(ctx, &list, q)
+	return list, err
+}
+
+//FindByID looks up a user by id
+func (s postgresStore) FindByID(ctx context.Context, userID int64) (User, error) {
+	u := User{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableUsers + `
+		WHERE ID=$1
+	`
+	err := s.c.GetContext(ctx, &u, q, userID)
+	return u, err
+}
+
+//FindByUsername looks up a user by username
+func (s postgresStore) FindByUsername(ctx context.Context, username string) (User, error) {
+	u := User{}
+	q := `
+		SELECT *
+		FROM ` + postgresutils.TableUsers + `
+		WHERE Username=$1
+	`
+	err := s.c.GetContext(ctx, &u, q, username)
+	if err == sql.ErrNoRows {
+		return u, ErrUserDoesNotExist
+	}
+
+	return u, err
+}
+
+//Add saves a new user to the postgres db
+//postgres doesn't support LastInsertId so the new id is returned from the insert
+func (s postgresStore) Add(ctx context.Context, u User) (int64, error) {
+	q := `
+		INSERT INTO ` + postgresutils.TableUsers + ` (
+			Username,
+			Password,
+			AddCards,
+			RemoveCards,
+			ChargeCards,
+			ViewReports,
+			ManageDisputes,
+			Administrator,
+			Active,
+			Created
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING ID
+	`
+
+	var id int64
+	err := s.c.QueryRowxContext(
+		ctx,
+		q,
+		u.Username,
+		u.Password,
+		u.AddCards,
+		u.RemoveCards,
+		u.ChargeCards,
+		u.ViewReports,
+		u.ManageDisputes,
+		u.Administrator,
+		u.Active,
+		u.Created,
+	).Scan(&id)
+	return id, err
+}
+
+//Update saves changes to an existing user in the postgres db
+func (s postgresStore) Update(ctx context.Context, userID int64, u User) error {
+	q := `
+		UPDATE ` + postgresutils.TableUsers + ` SET
+			Username=$1,
+			Password=$2,
+			AddCards=$3,
+			RemoveCards=$4,
+			ChargeCards=$5,
+			ViewReports=$6,
+			ManageDisputes=$7,
+			Administrator=$8,
+			Active=$9
+		WHERE ID=$10
+	`
+	_, err := s.c.ExecContext(
+		ctx,
+		q,
+		u.Username,
+		u.Password,
+		u.AddCards,
+		u.RemoveCards,
+		u.ChargeCards,
+		u.ViewReports,
+		u.ManageDisputes,
+		u.Administrator,
+		u.Active,
+		userID,
+	)
+	return err
+}
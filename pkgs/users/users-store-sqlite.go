@@ -0,0 +1,147 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
+	"github.com/jmoiron/sqlx"
+)
+
+//sqliteStore saves and retrieves users from a sqlite db
+type sqliteStore struct {
+	c *sqlx.DB
+}
+
+//NewSQLiteStore returns a Store that uses the given sqlite db connection
+func NewSQLiteStore(c *sqlx.DB) Store {
+	return sqliteStore{c: c}
+}
+
+//GetAll returns the id and username of every user
+func (s sqliteStore) GetAll(ctx context.Context) ([]userList, error) {
+	list := []userList{}
+	q := `
+		SELECT ID, Username
+		FROM ` + sqliteutils.TableUsers + `
+		ORDER BY Username
+	`
+	err := s.c.Select(&list, q)
+	return list, err
+}
+
+//FindAll returns the full data for every user
+func (s sqliteStore) FindAll(ctx context.Context) ([]User, error) {
+	list := []User{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableUsers + `
+		ORDER BY ID
+	`
+	err := s.c.Select(&list, q)
+	return list, err
+}
+
+//FindByID looks up a user by id
+func (s sqliteStore) FindByID(ctx context.Context, userID int64) (User, error) {
+	u := User{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableUsers + `
+		WHERE ID = ?
+	`
+	err := s.c.Get(&u, q, userID)
+	return u, err
+}
+
+//FindByUsername looks up a user by username
+func (s sqliteStore) FindByUsername(ctx context.Context, username string) (User, error) {
+	u := User{}
+	q := `
+		SELECT *
+		FROM ` + sqliteutils.TableUsers + `
+		WHERE Username = ?
+	`
+	err := s.c.Get(&u, q, username)
+	if err == sql.ErrNoRows {
+		return u, ErrUserDoesNotExist
+	}
+
+	return u, err
+}
+
+//Add saves a new user to the sqlite db
+func (s sqliteStore) Add(ctx context.Context, u User) (int64, error) {
+	q := `
+		INSERT INTO ` + sqliteutils.TableUsers + ` (
+			Username,
+			Password,
+			AddCards,
+			RemoveCards,
+			ChargeCards,
+			ViewReports,
+			ManageDisputes,
+			Administrator,
+			Active,
+			Created
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	stmt, err := s.c.Prepare(q)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := stmt.Exec(
+		u.Username,
+		u.Password,
+		u.AddCards,
+		u.RemoveCards,
+		u.ChargeCards,
+		u.ViewReports,
+		u.ManageDisputes,
+		u.Administrator,
+		u.Active,
+		u.Created,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	return id, err
+}
+
+//Update saves changes to an existing user in the sqlite db
+func (s sqliteStore) Update(ctx context.Context, userID int64, u User) error {
+	q := `
+		UPDATE ` + sqliteutils.TableUsers + ` SET
+			Username = ?,
+			Password = ?,
+			AddCards = ?,
+			RemoveCards = ?,
+			ChargeCards = ?,
+			ViewReports = ?,
+			ManageDisputes = ?,
+			Administrator = ?,
+			Active = ?
+		WHERE ID = ?
+	`
+	stmt, err := s.c.Prepare(q)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		u.Username,
+		u.Password,
+		u.AddCards,
+		u.RemoveCards,
+		u.ChargeCards,
+		u.ViewReports,
+		u.ManageDisputes,
+		u.Administrator,
+		u.Active,
+		userID,
+	)
+	return err
+}
@@ -0,0 +1,38 @@
+package users
+
+import (
+	"context"
+)
+
+//Store is the set of functions used to save and retrieve users from a database.
+//Each database we support has its own implementation of this interface.  The
+//implementation to use is chosen once in package main init() via SetStore.
+type Store interface {
+	//GetAll returns the id and username of every user
+	GetAll(ctx context.Context) ([]userList, error)
+
+	//FindAll returns the full data for every user
+	FindAll(ctx context.Context) ([]User, error)
+
+	//FindByID looks up a user by id
+	FindByID(ctx context.Context, userID int64) (User, error)
+
+	//FindByUsername looks up a user by username, ErrUserDoesNotExist is returned if
+	//no user exists with this username
+	FindByUsername(ctx context.Context, username string) (User, error)
+
+	//Add saves a new user and returns the new user's id
+	Add(ctx context.Context, u User) (int64, error)
+
+	//Update saves changes to an existing user
+	Update(ctx context.Context, userID int64, u User) error
+}
+
+//store is the Store that is used to save and retrieve users
+//this is set in package main init() via SetStore
+var store Store
+
+//SetStore saves the database implementation used to save and retrieve users
+func SetStore(s Store) {
+	store = s
+}
@@ -4,9 +4,6 @@ import (
 	"net/http"
 	"strconv"
 
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
-
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/pwds"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
@@ -46,15 +43,8 @@ func ChangePwd(w http.ResponseWriter, r *http.Request) {
 	//set new password
 	userData.Password = hashedPwd
 
-	//generate full datastore key for user
-	fullKey := datastoreutils.GetKeyFromID(datastoreutils.EntityUsers, userIDInt)
-
 	//save user
-	if sqliteutils.Config.UseSQLite {
-		err = updateUserSqlite(userIDInt, userData)
-	} else {
-		_, err = saveUserDatastore(c, fullKey, userData)
-	}
+	err = store.Update(c, userIDInt, userData)
 
 	if err != nil {
 		output.Error(err, "Error saving user to database after password change.", w)
@@ -77,6 +67,7 @@ func UpdatePermissions(w http.ResponseWriter, r *http.Request) {
 	removeCards, _ := strconv.ParseBool(r.FormValue("removeCards"))
 	chargeCards, _ := strconv.ParseBool(r.FormValue("chargeCards"))
 	viewReports, _ := strconv.ParseBool(r.FormValue("reports"))
+	manageDisputes, _ := strconv.ParseBool(r.FormValue("disputes"))
 	isAdmin, _ := strconv.ParseBool(r.FormValue("admin"))
 	isActive, _ := strconv.ParseBool(r.FormValue("active"))
 
@@ -115,18 +106,12 @@ func UpdatePermissions(w http.ResponseWriter, r *http.Request) {
 	userData.RemoveCards = removeCards
 	userData.ChargeCards = chargeCards
 	userData.ViewReports = viewReports
+	userData.ManageDisputes = manageDisputes
 	userData.Administrator = isAdmin
 	userData.Active = isActive
 
-	//generate complete key for user
-	fullKey := datastoreutils.GetKeyFromID(datastoreutils.EntityUsers, userIDInt)
-
 	//save user
-	if sqliteutils.Config.UseSQLite {
-		err = updateUserSqlite(userIDInt, userData)
-	} else {
-		_, err = saveUserDatastore(c, fullKey, userData)
-	}
+	err = store.Update(c, userIDInt, userData)
 
 	if err != nil {
 		output.Error(err, "Error saving user to database after permissions change.", w)
@@ -136,35 +121,3 @@ func UpdatePermissions(w http.ResponseWriter, r *http.Request) {
 	//done
 	output.Success("userUpdatePermissins", nil, w)
 }
-
-//updateUserSqlite updates a user in the sqlite db
-func updateUserSqlite(id int64, u User) error {
-	c := sqliteutils.Connection
-	q := `
-		UPDATE ` + sqliteutils.TableUsers + ` SET
-			Username = ?,
-			Password = ?,
-			AddCards = ?,
-			RemoveCards = ?,
-			ViewReports = ?,
-			Administrator = ?,
-			Active = ?
-		WHERE ID = ?
-	`
-	stmt, err := c.Prepare(q)
-	if err != nil {
-		return err
-	}
-
-	_, err = stmt.Exec(
-		u.Username,
-		u.Password,
-		u.AddCards,
-		u.RemoveCards,
-		u.ViewReports,
-		u.Administrator,
-		u.Active,
-		id,
-	)
-	return err
-}
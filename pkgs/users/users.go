@@ -5,18 +5,13 @@ package users
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"net/http"
+	"net/mail"
 	"strconv"
 
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
-
-	"cloud.google.com/go/datastore"
-	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/output"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/templates"
-	"google.golang.org/api/iterator"
 )
 
 const (
@@ -44,15 +39,16 @@ var (
 
 //User is the format for data saved to the datastore about a user
 type User struct {
-	Username      string `json:"username"`         //an email address (exception is for the super-admin created initially)
-	Password      string `json:"-"`                //bcrypt encrypted password
-	AddCards      bool   `json:"add_cards"`        //permissions
-	RemoveCards   bool   `json:"remove_cards"`     //" "
-	ChargeCards   bool   `json:"charge_cards"`     //" "
-	ViewReports   bool   `json:"view_reports"`     //" "
-	Administrator bool   `json:"is_admin"`         //" "
-	Active        bool   `json:"is_active"`        //is the user able to access the app
-	Created       string `json:"datetime_created"` //datetime of when the user was created
+	Username       string `json:"username"`         //an email address (exception is for the super-admin created initially)
+	Password       string `json:"-"`                //bcrypt encrypted password
+	AddCards       bool   `json:"add_cards"`        //permissions
+	RemoveCards    bool   `json:"remove_cards"`     //" "
+	ChargeCards    bool   `json:"charge_cards"`     //" "
+	ViewReports    bool   `json:"view_reports"`     //" "
+	ManageDisputes bool   `json:"manage_disputes"`  //" "
+	Administrator  bool   `json:"is_admin"`         //" "
+	Active         bool   `json:"is_active"`        //is the user able to access the app
+	Created        string `json:"datetime_created"` //datetime of when the user was created
 
 	//fields not used in cloud datastore
 	ID int64 `json:"sqlite_user_id"`
@@ -67,52 +63,12 @@ type userList struct {
 //GetAll retrieves the list of all users in the datastore
 //This is used to populate the select elements in the gui when changing a user's password or access rights.
 func GetAll(w http.ResponseWriter, r *http.Request) {
-	//placeholder
-	list := []userList{}
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT ID, Username
-			FROM ` + sqliteutils.TableUsers
-		err := c.Select(&list, q)
-		if err != nil {
-			output.Error(err, "Error retreiving list of users from sqlite.", w)
-			return
-		}
-
-	} else {
-		//connect to datastore
-		c := r.Context()
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			output.Error(err, "Could not connect to datastore", w)
-			return
-		}
-
-		//get list from datastore
-		//only need to get username and entity key to cut down on datastore usage
-		q := datastore.NewQuery(datastoreutils.EntityUsers).Order("Username").Project("Username")
-		i := client.Run(c, q)
-		for {
-			one := User{}
-			key, err := i.Next(&one)
-
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				output.Error(err, "Error retrieving list of users from datastore.", w)
-				return
-			}
-
-			l := userList{
-				Username: one.Username,
-				ID:       key.ID,
-			}
-			list = append(list, l)
-		}
+	//get list from db
+	c := r.Context()
+	list, err := store.GetAll(c)
+	if err != nil {
+		output.Error(err, "Error retrieving list of users.", w)
+		return
 	}
 
 	//return data to clinet
@@ -155,95 +111,53 @@ func DoesAdminExist(r *http.Request) error {
 
 //getDataByUsername looks up data about a user by the user's username
 func getDataByUsername(c context.Context, username string) (int64, User, error) {
-	//placeholder
-	u := User{}
-
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT *
-			FROM ` + sqliteutils.TableUsers + `
-			WHERE Username = ?
-		`
-		err := c.Get(&u, q, username)
-		if err == sql.ErrNoRows {
-			return 0, u, ErrUserDoesNotExist
-		} else if err != nil {
-			return 0, u, err
-		}
-	} else {
-		//connect to datastore
-		client, err := datastoreutils.Connect(c)
-		if err != nil {
-			return 0, u, err
-		}
-
-		//query
-		//using GetAll instead of Get because you cannot filter using Get
-		q := datastore.NewQuery(datastoreutils.EntityUsers).Filter("Username = ", username).Limit(1)
-		i := client.Run(c, q)
-		var numResults int
-		var fullKey *datastore.Key
-		for {
-			var tempUserData User
-			tempKey, err := i.Next(&tempUserData)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return 0, u, err
-			}
-
-			//save key and data to variables outside iterator
-			fullKey = tempKey
-			u = tempUserData
-			numResults++
-		}
-
-		//check if no user was found matching this username
-		if numResults == 0 {
-			return 0, u, ErrUserDoesNotExist
-		}
-
-		//user found
-		u.ID = fullKey.ID
+	u, err := store.FindByUsername(c, username)
+	if err != nil {
+		return 0, u, err
 	}
 
-	//done
 	return u.ID, u, nil
 }
 
 //Find gets the data for a given user id
 //This returns all the info on a user.
-func Find(c context.Context, userID int64) (u User, err error) {
+//The super-admin always has full permissions, this includes permissions that were added to the
+//app after the super-admin was created and that the super-admin can't be given since it is locked.
+func Find(c context.Context, userID int64) (User, error) {
+	u, err := store.FindByID(c, userID)
+	if err != nil {
+		return u, err
+	}
 
-	//use correct db
-	if sqliteutils.Config.UseSQLite {
-		c := sqliteutils.Connection
-		q := `
-			SELECT * 
-			FROM ` + sqliteutils.TableUsers + `
-			WHERE ID = ?
-		`
-		err = c.Get(&u, q, userID)
-	} else {
-		//connect to datastore
-		client, innerErr := datastoreutils.Connect(c)
-		if innerErr != nil {
-			err = innerErr
-			return
-		}
+	if u.Username == adminUsername {
+		u.ManageDisputes = true
+	}
 
-		//query
-		key := datastoreutils.GetKeyFromID(datastoreutils.EntityUsers, userID)
-		innerErr = client.Get(c, key, &u)
-		if innerErr != nil {
-			err = innerErr
+	return u, nil
+}
+
+//FindAdminEmails returns the usernames of the active administrators that are email addresses
+//This is used to send notifications to the people who manage the app.  The super-admin is
+//skipped since its username isn't an email address.
+func FindAdminEmails(c context.Context) ([]string, error) {
+	all, err := store.FindAll(c)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := []string{}
+	for _, u := range all {
+		if !u.Administrator || !u.Active {
+			continue
 		}
+		if _, err := mail.ParseAddress(u.Username); err != nil {
+			continue
+		}
+
+		emails = append(emails, u.Username)
 	}
 
-	return
+	return emails, nil
 }
 
 //notificationPage is used to show html page for errors
@@ -0,0 +1,278 @@
+/*
+Package xlsxutils is used to build simple Excel workbooks (.xlsx files).
+
+The workbooks are built without any third party libraries.  An .xlsx file is a zip file of XML
+files so only the few files Excel, LibreOffice, and Google Sheets require are written.  Each
+sheet is a list of rows, the first row is shown in bold as the header row.
+
+Cells can be text, numbers, or true/false values.  Numbers are saved as numbers so they can be
+totaled in a spreadsheet without having to convert them from text first.
+*/
+package xlsxutils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//ContentType is the mime type of an .xlsx file
+const ContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+//maxSheetNameLength is the longest name Excel allows for a sheet
+const maxSheetNameLength = 31
+
+//errors
+var (
+	errNoSheets      = errors.New("xlsxutils: a workbook must have at least one sheet")
+	errInvalidNumber = errors.New("xlsxutils: invalid number")
+)
+
+//Sheet is one sheet, or tab, in a workbook
+type Sheet struct {
+	Name string          //shown on the sheet's tab, characters Excel doesn't allow are removed
+	Rows [][]interface{} //each cell is a string, Number, int, int64, float64, bool, or nil for an empty cell, other types are shown as text
+}
+
+//Number is a number saved as text, ex: "12.34"
+//this is used for amounts that are already formatted with the correct number of decimal places
+type Number string
+
+//Write builds a workbook and writes it to w
+func Write(w io.Writer, sheets []Sheet) error {
+	if len(sheets) == 0 {
+		return errNoSheets
+	}
+
+	z := zip.NewWriter(w)
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", contentTypes(len(sheets))},
+		{"_rels/.rels", rootRels},
+		{"xl/workbook.xml", workbook(sheets)},
+		{"xl/_rels/workbook.xml.rels", workbookRels(len(sheets))},
+		{"xl/styles.xml", styles},
+	}
+	for _, f := range files {
+		err := writeFile(z, f.name, f.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, s := range sheets {
+		content, err := worksheet(s)
+		if err != nil {
+			return err
+		}
+
+		err = writeFile(z, "xl/worksheets/sheet"+strconv.Itoa(i+1)+".xml", content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+//writeFile adds one file to the zip file
+func writeFile(z *zip.Writer, name, content string) error {
+	f, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, content)
+	return err
+}
+
+//xmlHeader is at the top of each XML file
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+
+//rootRels points to the workbook
+const rootRels = xmlHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+//styles is the set of formats used by cells
+//style 0 is the default and style 1 is bold, used for the header row
+const styles = xmlHeader + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+	`</styleSheet>`
+
+//contentTypes lists the type of each file in the workbook
+func contentTypes(numSheets int) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	b.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	b.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	b.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	b.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i := 1; i <= numSheets; i++ {
+		b.WriteString(`<Override PartName="/xl/worksheets/sheet` + strconv.Itoa(i) + `.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`)
+	}
+	b.WriteString(`</Types>`)
+
+	return b.String()
+}
+
+//workbook lists the sheets in the workbook
+func workbook(sheets []Sheet) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+
+	used := map[string]bool{}
+	for i, s := range sheets {
+		num := strconv.Itoa(i + 1)
+		name := uniqueName(sheetName(s.Name, "Sheet"+num), used)
+
+		b.WriteString(`<sheet name="` + escape(name) + `" sheetId="` + num + `" r:id="rId` + num + `"/>`)
+	}
+	b.WriteString(`</sheets></workbook>`)
+
+	return b.String()
+}
+
+//workbookRels points to each sheet and the styles
+//sheets are rId1 through rIdN so the styles are given the next id
+func workbookRels(numSheets int) string {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := 1; i <= numSheets; i++ {
+		num := strconv.Itoa(i)
+		b.WriteString(`<Relationship Id="rId` + num + `" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet` + num + `.xml"/>`)
+	}
+	b.WriteString(`<Relationship Id="rId` + strconv.Itoa(numSheets+1) + `" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`)
+	b.WriteString(`</Relationships>`)
+
+	return b.String()
+}
+
+//worksheet builds the rows and cells of a sheet
+func worksheet(s Sheet) (string, error) {
+	var b strings.Builder
+	b.WriteString(xmlHeader + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	for i, row := range s.Rows {
+		rowNum := strconv.Itoa(i + 1)
+
+		//the first row is the header row
+		style := ""
+		if i == 0 {
+			style = ` s="1"`
+		}
+
+		b.WriteString(`<row r="` + rowNum + `">`)
+		for j, v := range row {
+			ref := columnName(j) + rowNum
+
+			switch v := v.(type) {
+			case Number:
+				if _, err := strconv.ParseFloat(string(v), 64); err != nil {
+					return "", errInvalidNumber
+				}
+				b.WriteString(`<c r="` + ref + `"` + style + `><v>` + string(v) + `</v></c>`)
+			case int64:
+				b.WriteString(`<c r="` + ref + `"` + style + `><v>` + strconv.FormatInt(v, 10) + `</v></c>`)
+			case int:
+				b.WriteString(`<c r="` + ref + `"` + style + `><v>` + strconv.Itoa(v) + `</v></c>`)
+			case float64:
+				b.WriteString(`<c r="` + ref + `"` + style + `><v>` + strconv.FormatFloat(v, 'f', -1, 64) + `</v></c>`)
+			case bool:
+				val := "0"
+				if v {
+					val = "1"
+				}
+				b.WriteString(`<c r="` + ref + `"` + style + ` t="b"><v>` + val + `</v></c>`)
+			case nil:
+				b.WriteString(`<c r="` + ref + `"` + style + `/>`)
+			case string:
+				if v == "" {
+					b.WriteString(`<c r="` + ref + `"` + style + `/>`)
+					continue
+				}
+				b.WriteString(inlineString(ref, style, v))
+			default:
+				b.WriteString(inlineString(ref, style, fmt.Sprint(v)))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String(), nil
+}
+
+//inlineString builds a cell holding text
+//text is saved in the cell instead of a shared strings file to keep things simple
+func inlineString(ref, style, v string) string {
+	return `<c r="` + ref + `"` + style + ` t="inlineStr"><is><t xml:space="preserve">` + escape(v) + `</t></is></c>`
+}
+
+//columnName returns the letters used to identify a column, 0 is A, 25 is Z, 26 is AA
+func columnName(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+
+	return name
+}
+
+//sheetName removes the characters Excel doesn't allow in a sheet's name and shortens the name
+//the fallback is used if the name is blank
+func sheetName(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.TrimSpace(name), "'")
+
+	if len([]rune(name)) > maxSheetNameLength {
+		name = string([]rune(name)[:maxSheetNameLength])
+	}
+	if name == "" {
+		return fallback
+	}
+
+	return name
+}
+
+//uniqueName makes sure two sheets don't have the same name
+//Excel doesn't allow duplicate names, even if the case is different
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	for i := 2; used[strings.ToLower(unique)]; i++ {
+		suffix := " (" + strconv.Itoa(i) + ")"
+		r := []rune(name)
+		if len(r)+len(suffix) > maxSheetNameLength {
+			r = r[:maxSheetNameLength-len(suffix)]
+		}
+		unique = string(r) + suffix
+	}
+
+	used[strings.ToLower(unique)] = true
+	return unique
+}
+
+//escape escapes text for use in XML
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -24,6 +24,7 @@ amount or via an api-style http request.
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -32,13 +33,18 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/appsettings"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/archive"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/card"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/company"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/datastoreutils"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/emailutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/middleware"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/pages"
+	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/postgresutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/receipt"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sessionutils"
 	"github.com/coreymgilmore/stripe-appengine-frontend/pkgs/sqliteutils"
@@ -76,11 +82,23 @@ type appYaml struct {
 		CookieDomain         string `yaml:"COOKIE_DOMAINCOOKIE_DOMAIN"` //the domain the session cookie is used for
 		StripeSecretKey      string `yaml:"STRIPE_SECRET_KEY"`          //used for charging cards
 		StripePublishableKey string `yaml:"STRIPE_PUBLISHABLE_KEY"`     //used for creating customers and saving cards
+		StripeWebhookSecret  string `yaml:"STRIPE_WEBHOOK_SECRET"`      //used to verify events sent to the webhook
 		CacheDays            int    `yaml:"CACHE_DAYS"`                 //number of days to cache static files
 		StaticFilePath       string `yaml:"PATH_TO_STATIC_FILES"`       //the full path to the ./website/static/ directory
 		TemplatesPath        string `yaml:"PATH_TO_TEMPLATES"`          //the full path to the templates directory
 		UseLocalFiles        string `yaml:"USE_LOCAL_FILES"`            //true serves css/js/fonts from local domain versus cdn
 		PathToSqliteFile     string `yaml:"PATH_TO_SQLITE_FILE"`        //the full path to the file used for the sqlite db.  If blank, the default path is used
+		PostgresDSN          string `yaml:"POSTGRES_DSN"`               //the connection string for the postgres db
+		SqliteBackupDir      string `yaml:"SQLITE_BACKUP_DIR"`          //the full path to the directory sqlite backups are saved to.  If blank, backups are disabled
+		SqliteBackupInterval int    `yaml:"SQLITE_BACKUP_INTERVAL"`     //how many hours between automatic sqlite backups
+		SqliteBackupKeep     int    `yaml:"SQLITE_BACKUP_KEEP"`         //the number of sqlite backups to keep
+		SqliteBackupMaxAge   int    `yaml:"SQLITE_BACKUP_MAX_AGE"`      //days after which a sqlite backup is removed
+		SMTPHost             string `yaml:"SMTP_HOST"`                  //the SMTP server used to send emails.  If blank, emails are not sent
+		SMTPPort             int    `yaml:"SMTP_PORT"`                  //the SMTP server's port
+		SMTPUsername         string `yaml:"SMTP_USERNAME"`              //used to log in to the SMTP server, blank if the server doesn't require logging in
+		SMTPPassword         string `yaml:"SMTP_PASSWORD"`              //" "
+		SMTPFrom             string `yaml:"SMTP_FROM"`                  //the address emails are sent from
+		CronSecret           string `yaml:"CRON_SECRET"`                //given in the X-Cron-Secret header by cron jobs, not needed on appengine
 	} `yaml:"env_variables"`
 	Handlers []struct {
 		URL       string `yaml:"url"`
@@ -104,6 +122,16 @@ var (
 	pathToAppYaml              string
 	pathToDatastoreCredentials string
 	useDevDatastore            bool
+	migrateStatus              bool
+)
+
+//subcommands
+//these are given after any flags and are run instead of starting the app
+const (
+	commandExport  = "export"
+	commandImport  = "import"
+	commandRestore = "restore"
+	commandResync  = "resync"
 )
 
 //these are the type of deployments we support
@@ -111,6 +139,7 @@ const (
 	deploymentTypeAppengine    = "appengine"
 	deploymentTypeAppengineDev = "appengine-dev"
 	deploymentTypeSqlite       = "sqlite"
+	deploymentTypePostgres     = "postgres"
 )
 
 func init() {
@@ -118,7 +147,8 @@ func init() {
 	//deploymentType: used for changing how this app is deployed:
 	//  - appengine,
 	//  - appengine-dev (locally running but using Cloud datastore),
-	//  - sqlite (future)
+	//  - sqlite (runs anywhere, data stored in a single file),
+	//  - postgres (runs anywhere, data stored in a postgres db shared by many servers)
 	//pathToAppYaml: the full path to the app.yaml file.  This file is
 	//  used for deployment types other than appengine-dev to get
 	//  environmental variables.  This eliminates the need to set
@@ -134,12 +164,33 @@ func init() {
 	//useDevDatastore: this overrides the default "true" value of using the dev datastore
 	//  when in dev mode.  Sometimes you may want to use live/production data even
 	//  though you are developing (for example, dev environment doesn't have any data).
-	flag.StringVar(&deploymentType, "type", "appengine", "Set to appengine or appengine-dev.  In development mode the app.yaml file will be parsed to read the set environmental variables.")
+	//migrateStatus: shows which schema migrations have been run on the sqlite db and exits
+	//  without starting the app or running any migrations.
+	//
+	//subcommands are given after the flags and are run instead of starting the app:
+	//  - export -file=path: saves all data from the database for the deployment type to an archive file,
+	//  - import -file=path: saves all data from an archive file into the database for the deployment type.
+	//  These are used to move data between deployment types, for example from appengine to sqlite.
+	//  - restore -file=path: replaces the sqlite db with a backup.  Only used for the sqlite deployment type.
+	flag.StringVar(&deploymentType, "type", "appengine", "Set to appengine, appengine-dev, sqlite, or postgres.  In development mode the app.yaml file will be parsed to read the set environmental variables.")
 	flag.StringVar(&pathToAppYaml, "path-to-app-yaml", "./app.yaml", "The path to the app.yaml file.")
 	flag.StringVar(&pathToDatastoreCredentials, "path-to-datastore-credentials", "./datastore-service-account.json", "The path to your datastore service account file.  A JSON file.")
 	flag.BoolVar(&useDevDatastore, "use-dev-datastore", true, "Not used for non -dev deployment types. Set to false to use live datastore data in development deployment types.")
+	flag.BoolVar(&migrateStatus, "migrate-status", false, "Only used for the sqlite deployment type. Show which schema migrations have been run and exit.")
 	flag.Parse()
 
+	//migration status is only supported for sqlite
+	if migrateStatus && deploymentType != deploymentTypeSqlite {
+		log.Fatalln("The -migrate-status flag can only be used with the sqlite deployment type.")
+		return
+	}
+
+	//restoring a backup is only supported for sqlite
+	if flag.Arg(0) == commandRestore && deploymentType != deploymentTypeSqlite {
+		log.Fatalln("The restore command can only be used with the sqlite deployment type.")
+		return
+	}
+
 	//set configuration options based on deployment type
 	switch deploymentType {
 	case deploymentTypeAppengine:
@@ -159,12 +210,34 @@ func init() {
 		cc := card.Config
 		cc.StripeSecretKey = os.Getenv("STRIPE_SECRET_KEY")
 		cc.StripePublishableKey = os.Getenv("STRIPE_PUBLISHABLE_KEY")
+		cc.StripeWebhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
 		err = card.SetConfig(cc)
 		if err != nil {
 			log.Fatalln("Could not set configuration for card.", err)
 			return
 		}
 
+		ec := emailutils.Config
+		ec.Host = os.Getenv("SMTP_HOST")
+		ec.Port, _ = strconv.Atoi(os.Getenv("SMTP_PORT"))
+		ec.Username = os.Getenv("SMTP_USERNAME")
+		ec.Password = os.Getenv("SMTP_PASSWORD")
+		ec.From = os.Getenv("SMTP_FROM")
+		err = emailutils.SetConfig(ec)
+		if err != nil {
+			log.Fatalln("Could not set configuration for emailutils.", err)
+			return
+		}
+
+		mc := middleware.Config
+		mc.TrustAppengineCron = true
+		mc.CronSecret = os.Getenv("CRON_SECRET")
+		err = middleware.SetConfig(mc)
+		if err != nil {
+			log.Fatalln("Could not set configuration for middleware.", err)
+			return
+		}
+
 		ccc := datastoreutils.Config
 		ccc.ProjectID = os.Getenv("PROJECT_ID")
 		err = datastoreutils.SetConfig(ccc)
@@ -172,6 +245,7 @@ func init() {
 			log.Fatalln("Could not set configuration for datastore.", err)
 			return
 		}
+		setDatastoreStores()
 
 		cccc := templates.Config
 		cccc.PathToTemplates = "./services/process-cards/website/templates/"
@@ -221,12 +295,33 @@ func init() {
 		cc := card.Config
 		cc.StripeSecretKey = yamlData.EnvVars.StripeSecretKey
 		cc.StripePublishableKey = yamlData.EnvVars.StripePublishableKey
+		cc.StripeWebhookSecret = yamlData.EnvVars.StripeWebhookSecret
 		err = card.SetConfig(cc)
 		if err != nil {
 			log.Fatalln("Could not set configuration for card.", err)
 			return
 		}
 
+		ec := emailutils.Config
+		ec.Host = yamlData.EnvVars.SMTPHost
+		ec.Port = yamlData.EnvVars.SMTPPort
+		ec.Username = yamlData.EnvVars.SMTPUsername
+		ec.Password = yamlData.EnvVars.SMTPPassword
+		ec.From = yamlData.EnvVars.SMTPFrom
+		err = emailutils.SetConfig(ec)
+		if err != nil {
+			log.Fatalln("Could not set configuration for emailutils.", err)
+			return
+		}
+
+		mc := middleware.Config
+		mc.CronSecret = yamlData.EnvVars.CronSecret
+		err = middleware.SetConfig(mc)
+		if err != nil {
+			log.Fatalln("Could not set configuration for middleware.", err)
+			return
+		}
+
 		//connect to the google cloud datastore
 		//need to set an environmental variable here since it provide credentials to the datastore
 		//see https://cloud.google.com/datastore/docs/reference/libraries#client-libraries-install-go
@@ -247,6 +342,7 @@ func init() {
 			log.Fatalln("Could not set configuration for datastore.", err)
 			return
 		}
+		setDatastoreStores()
 
 		cccc := templates.Config
 		cccc.PathToTemplates = yamlData.EnvVars.TemplatesPath
@@ -289,16 +385,57 @@ func init() {
 		cc := card.Config
 		cc.StripeSecretKey = yamlData.EnvVars.StripeSecretKey
 		cc.StripePublishableKey = yamlData.EnvVars.StripePublishableKey
+		cc.StripeWebhookSecret = yamlData.EnvVars.StripeWebhookSecret
 		err = card.SetConfig(cc)
 		if err != nil {
 			log.Fatalln("Could not set configuration for card.", err)
 			return
 		}
 
+		ec := emailutils.Config
+		ec.Host = yamlData.EnvVars.SMTPHost
+		ec.Port = yamlData.EnvVars.SMTPPort
+		ec.Username = yamlData.EnvVars.SMTPUsername
+		ec.Password = yamlData.EnvVars.SMTPPassword
+		ec.From = yamlData.EnvVars.SMTPFrom
+		err = emailutils.SetConfig(ec)
+		if err != nil {
+			log.Fatalln("Could not set configuration for emailutils.", err)
+			return
+		}
+
+		mc := middleware.Config
+		mc.CronSecret = yamlData.EnvVars.CronSecret
+		err = middleware.SetConfig(mc)
+		if err != nil {
+			log.Fatalln("Could not set configuration for middleware.", err)
+			return
+		}
+
 		ccc := sqliteutils.Config
 		ccc.PathToDatabaseFile = yamlData.EnvVars.PathToSqliteFile
+		ccc.BackupDirectory = yamlData.EnvVars.SqliteBackupDir
+		ccc.BackupIntervalHours = yamlData.EnvVars.SqliteBackupInterval
+		ccc.BackupKeep = yamlData.EnvVars.SqliteBackupKeep
+		ccc.BackupMaxAgeDays = yamlData.EnvVars.SqliteBackupMaxAge
 		sqliteutils.SetConfig(ccc)
+
+		//show migration status and exit without connecting
+		//connecting would run any migrations that haven't been run yet
+		if migrateStatus {
+			showMigrationStatus()
+			os.Exit(0)
+		}
+
+		//restore a backup and exit without connecting
+		//the db file can't be in use while it is replaced
+		if flag.Arg(0) == commandRestore {
+			restoreBackup(flag.Args()[1:])
+			os.Exit(0)
+		}
+
 		sqliteutils.Connect()
+		setSQLiteStores()
 
 		cccc := templates.Config
 		cccc.PathToTemplates = yamlData.EnvVars.TemplatesPath
@@ -313,6 +450,83 @@ func init() {
 		//set cache max age
 		cacheDays = yamlData.EnvVars.CacheDays
 
+	case deploymentTypePostgres:
+		//a version of this app that can run without appengine and is backed by postgres
+		//used when running more than one server behind a load balancer
+		//check for and parse the app.yaml file
+		yamlData, err := parseAppYaml(pathToAppYaml)
+		if err != nil {
+			log.Fatalln("Error while parsing app.yaml.", err)
+			return
+		}
+
+		//saved parsed data for use elsewhere
+		parsedAppYaml = yamlData
+
+		//set configuration options using app.yaml
+		c := sessionutils.Config
+		c.SessionAuthKey = yamlData.EnvVars.SessionAuthKey
+		c.SessionEncryptKey = yamlData.EnvVars.SessionEncryptKey
+		c.SessionLifetime = yamlData.EnvVars.SessionLifetime
+		c.CookieDomain = yamlData.EnvVars.CookieDomain
+		err = sessionutils.SetConfig(c)
+		if err != nil {
+			log.Fatalln("Could not set configuration for sessionutils.", err)
+			return
+		}
+
+		cc := card.Config
+		cc.StripeSecretKey = yamlData.EnvVars.StripeSecretKey
+		cc.StripePublishableKey = yamlData.EnvVars.StripePublishableKey
+		cc.StripeWebhookSecret = yamlData.EnvVars.StripeWebhookSecret
+		err = card.SetConfig(cc)
+		if err != nil {
+			log.Fatalln("Could not set configuration for card.", err)
+			return
+		}
+
+		ec := emailutils.Config
+		ec.Host = yamlData.EnvVars.SMTPHost
+		ec.Port = yamlData.EnvVars.SMTPPort
+		ec.Username = yamlData.EnvVars.SMTPUsername
+		ec.Password = yamlData.EnvVars.SMTPPassword
+		ec.From = yamlData.EnvVars.SMTPFrom
+		err = emailutils.SetConfig(ec)
+		if err != nil {
+			log.Fatalln("Could not set configuration for emailutils.", err)
+			return
+		}
+
+		mc := middleware.Config
+		mc.CronSecret = yamlData.EnvVars.CronSecret
+		err = middleware.SetConfig(mc)
+		if err != nil {
+			log.Fatalln("Could not set configuration for middleware.", err)
+			return
+		}
+
+		ccc := postgresutils.Config
+		ccc.DSN = yamlData.EnvVars.PostgresDSN
+		err = postgresutils.SetConfig(ccc)
+		if err != nil {
+			log.Fatalln("Could not set configuration for postgres.", err)
+			return
+		}
+		postgresutils.Connect()
+		setPostgresStores()
+
+		cccc := templates.Config
+		cccc.PathToTemplates = yamlData.EnvVars.TemplatesPath
+		cccc.Development = true
+		cccc.UseLocalFiles, _ = strconv.ParseBool(yamlData.EnvVars.UseLocalFiles)
+		templates.SetConfig(cccc)
+
+		//set path to static files
+		staticLocalDir = yamlData.EnvVars.StaticFilePath
+
+		//set cache max age
+		cacheDays = yamlData.EnvVars.CacheDays
+
 	default:
 		//when an invalid deployment type is given
 		log.Fatalln("An invalid deployment type was given as a flag.")
@@ -329,6 +543,16 @@ func init() {
 }
 
 func main() {
+	//run a subcommand instead of starting the app
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+
+	//receipts are emailed after charges and refunds
+	//the card package can't build receipts itself since package receipt imports package card
+	card.SetReceiptBuilder(receipt.BuildEmail)
+
 	//middleware
 	a := alice.New(middleware.Auth)
 	admin := a.Append(middleware.Administrator)
@@ -336,6 +560,8 @@ func main() {
 	remove := a.Append(middleware.RemoveCards)
 	charge := a.Append(middleware.ChargeCards)
 	reports := a.Append(middleware.ViewReports)
+	disputes := a.Append(middleware.ManageDisputes)
+	cron := alice.New(middleware.Cron)
 
 	//router
 	r := mux.NewRouter()
@@ -349,8 +575,35 @@ func main() {
 	r.HandleFunc("/logout/", users.Logout)
 
 	//cron tasks
-	r.HandleFunc("/cron/remove-expired-cards/", http.HandlerFunc(card.RemoveExpiredCards))
-	r.HandleFunc("/cron/remove-unused-cards/", http.HandlerFunc(card.RemoveUnusedCards))
+	r.Handle("/cron/remove-expired-cards/", cron.Then(http.HandlerFunc(card.RemoveExpiredCards)))
+	r.Handle("/cron/remove-unused-cards/", cron.Then(http.HandlerFunc(card.RemoveUnusedCards)))
+	r.Handle("/cron/resync-ledger/", cron.Then(http.HandlerFunc(card.ResyncLedger)))
+	r.Handle("/cron/notify-expiring-cards/", cron.Then(http.HandlerFunc(card.NotifyExpiringCards)))
+	r.Handle("/cron/run-scheduled-charges/", cron.Then(http.HandlerFunc(card.RunScheduledCharges)))
+	r.Handle("/cron/run-batch-charges/", cron.Then(http.HandlerFunc(card.RunBatchJobs)))
+	r.Handle("/cron/notify-expiring-authorizations/", cron.Then(http.HandlerFunc(card.NotifyExpiringAuthorizations)))
+
+	//events sent from stripe
+	//authenticated by the Stripe-Signature header instead of a session
+	r.HandleFunc("/stripe/webhook/", card.Webhook).Methods("POST")
+
+	//automatic backups of the sqlite db
+	//this does nothing unless a backup directory and interval are set
+	go sqliteutils.ScheduleBackups()
+
+	//scheduled charges
+	//appengine charges these via cron, other deployments charge these in the background so cron
+	//doesn't have to be set up, a date is never charged twice even if cron is set up as well
+	if deploymentType == deploymentTypeSqlite || deploymentType == deploymentTypePostgres {
+		go card.RunScheduledChargesEvery(time.Hour)
+	}
+
+	//batch charges
+	//batches are charged in the background when they are uploaded, this picks up batches that
+	//weren't finished because the server stopped, appengine does this via cron
+	if deploymentType == deploymentTypeSqlite || deploymentType == deploymentTypePostgres {
+		go card.RunBatchJobsEvery(10 * time.Minute)
+	}
 
 	//main app page once user is logged in
 	r.Handle("/main/", a.Then(http.HandlerFunc(pages.Main)))
@@ -368,27 +621,59 @@ func main() {
 	//cards
 	c := r.PathPrefix("/card").Subrouter()
 	c.Handle("/add/", add.Then(http.HandlerFunc(card.Add))).Methods("POST")
+	c.Handle("/default/", add.Then(http.HandlerFunc(card.SetDefault))).Methods("POST")
+	c.Handle("/update/", add.Then(http.HandlerFunc(card.UpdateCard))).Methods("POST")
+	c.Handle("/bank-account/verify/", add.Then(http.HandlerFunc(card.VerifyBankAccount))).Methods("POST")
 	c.Handle("/get/", a.Then(http.HandlerFunc(card.GetOne))).Methods("GET")
 	c.Handle("/get/all/", a.Then(http.HandlerFunc(card.GetAll))).Methods("GET")
 	c.Handle("/remove/", remove.Then(http.HandlerFunc(card.RemoveAPI))).Methods("POST")
 	c.Handle("/charge/", charge.Then(http.HandlerFunc(card.ManualCharge))).Methods("POST")
 	c.Handle("/receipt/", a.Then(http.HandlerFunc(receipt.Show))).Methods("GET")
+	c.Handle("/receipt/pdf/", a.Then(http.HandlerFunc(receipt.ShowPDF))).Methods("GET")
 	c.Handle("/report/", reports.Then(http.HandlerFunc(card.Report))).Methods("GET")
+	c.Handle("/report/export/", reports.Then(http.HandlerFunc(card.ExportReport))).Methods("GET")
+	c.Handle("/payouts/", reports.Then(http.HandlerFunc(card.Payouts))).Methods("GET")
+	c.Handle("/payouts/detail/", reports.Then(http.HandlerFunc(card.PayoutDetail))).Methods("GET")
+	c.Handle("/expiring/", reports.Then(http.HandlerFunc(card.ExpiringCards))).Methods("GET")
+	c.Handle("/authorizations/", reports.Then(http.HandlerFunc(card.Authorizations))).Methods("GET")
+	c.Handle("/disputes/", disputes.Then(http.HandlerFunc(card.Disputes))).Methods("GET")
+	c.Handle("/disputes/detail/", disputes.Then(http.HandlerFunc(card.DisputeDetail))).Methods("GET")
+	c.Handle("/disputes/evidence/", disputes.Then(http.HandlerFunc(card.DisputeEvidence))).Methods("POST")
 	c.Handle("/refund/", charge.Then(http.HandlerFunc(card.Refund))).Methods("POST")
 	c.Handle("/capture/", charge.Then(http.HandlerFunc(card.Capture))).Methods("POST")
+	c.Handle("/release/", charge.Then(http.HandlerFunc(card.Release))).Methods("POST")
+	c.Handle("/scheduled/", charge.Then(http.HandlerFunc(card.ScheduledCharges))).Methods("GET")
+	c.Handle("/scheduled/add/", charge.Then(http.HandlerFunc(card.AddScheduledCharge))).Methods("POST")
+	c.Handle("/scheduled/pause/", charge.Then(http.HandlerFunc(card.PauseScheduledCharge))).Methods("POST")
+	c.Handle("/scheduled/resume/", charge.Then(http.HandlerFunc(card.ResumeScheduledCharge))).Methods("POST")
+	c.Handle("/scheduled/remove/", charge.Then(http.HandlerFunc(card.RemoveScheduledCharge))).Methods("POST")
+	c.Handle("/batch/preview/", charge.Then(http.HandlerFunc(card.BatchPreview))).Methods("POST")
+	c.Handle("/batch/charge/", charge.Then(http.HandlerFunc(card.BatchCharge))).Methods("POST")
+	c.Handle("/batch/status/", charge.Then(http.HandlerFunc(card.BatchStatus))).Methods("GET")
+	c.Handle("/batch/results/", charge.Then(http.HandlerFunc(card.BatchResults))).Methods("GET")
 	c.Handle("/auto-charge/", http.HandlerFunc(card.AutoCharge)).Methods("POST")
 
+	//reporting api for other systems
+	//authenticated by the api key in the app settings instead of a session
+	c.Handle("/report/api/charges/", http.HandlerFunc(card.ReportChargesAPI)).Methods("GET")
+	c.Handle("/report/api/refunds/", http.HandlerFunc(card.ReportRefundsAPI)).Methods("GET")
+	c.Handle("/report/api/totals/", http.HandlerFunc(card.ReportTotalsAPI)).Methods("GET")
+
 	//company info
 	comp := r.PathPrefix("/company").Subrouter()
 	comp.Handle("/get/", a.Then(http.HandlerFunc(company.GetAPI))).Methods("GET")
 	comp.Handle("/set/", admin.Then(http.HandlerFunc(company.SaveAPI))).Methods("POST")
 	comp.Handle("/preview-receipt/", admin.Then(http.HandlerFunc(receipt.Preview))).Methods("GET")
+	comp.Handle("/preview-receipt/pdf/", admin.Then(http.HandlerFunc(receipt.PreviewPDF))).Methods("GET")
 
 	//app settings
 	as := r.PathPrefix("/app-settings").Subrouter()
 	as.Handle("/get/", a.Then(http.HandlerFunc(appsettings.GetAPI))).Methods("GET")
 	as.Handle("/set/", admin.Then(http.HandlerFunc(appsettings.SaveAPI))).Methods("POST")
 	as.Handle("/generate-api-key", admin.Then(http.HandlerFunc(appsettings.GenerateAPIKey))).Methods("GET")
+	as.Handle("/backup/", admin.Then(http.HandlerFunc(appsettings.BackupAPI))).Methods("POST")
+	as.Handle("/backup/list/", admin.Then(http.HandlerFunc(appsettings.ListBackupsAPI))).Methods("GET")
+	as.Handle("/backup/download/", admin.Then(http.HandlerFunc(appsettings.DownloadBackup))).Methods("GET")
 
 	//serve static assets
 	r.PathPrefix(staticWebDir).Handler(setStaticFileHeaders(http.StripPrefix(staticWebDir, http.FileServer(http.Dir(staticLocalDir)))))
@@ -409,6 +694,176 @@ func main() {
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), r))
 }
 
+//stores is the set of database implementations in use
+//this is saved so subcommands can use the same database the app would use
+var stores archive.Stores
+
+//setStores saves the database implementations used to save and retrieve data
+//this is done once here so that no other code needs to check which database is in use
+func setStores(s archive.Stores) {
+	stores = s
+	card.SetStore(s.Cards)
+	users.SetStore(s.Users)
+	company.SetStore(s.Company)
+	appsettings.SetStore(s.AppSettings)
+}
+
+//setDatastoreStores saves the cloud datastore as the database used to save and retrieve data
+func setDatastoreStores() {
+	setStores(archive.Stores{
+		Cards:       card.NewDatastoreStore(),
+		Users:       users.NewDatastoreStore(),
+		Company:     company.NewDatastoreStore(),
+		AppSettings: appsettings.NewDatastoreStore(),
+	})
+}
+
+//setSQLiteStores saves sqlite as the database used to save and retrieve data
+//sqliteutils.Connect() must be called before this so the connection exists
+func setSQLiteStores() {
+	c := sqliteutils.Connection
+	setStores(archive.Stores{
+		Cards:       card.NewSQLiteStore(c),
+		Users:       users.NewSQLiteStore(c),
+		Company:     company.NewSQLiteStore(c),
+		AppSettings: appsettings.NewSQLiteStore(c),
+	})
+}
+
+//setPostgresStores saves postgres as the database used to save and retrieve data
+//postgresutils.Connect() must be called before this so the connection exists
+func setPostgresStores() {
+	c := postgresutils.Connection
+	setStores(archive.Stores{
+		Cards:       card.NewPostgresStore(c),
+		Users:       users.NewPostgresStore(c),
+		Company:     company.NewPostgresStore(c),
+		AppSettings: appsettings.NewPostgresStore(c),
+	})
+}
+
+//runCommand runs a subcommand given after the flags
+func runCommand(args []string) {
+	switch args[0] {
+	case commandExport:
+		fs := flag.NewFlagSet(commandExport, flag.ExitOnError)
+		path := fs.String("file", "", "The path to the archive file to create.")
+		fs.Parse(args[1:])
+		if *path == "" {
+			log.Fatalln("The -file flag is required for export.")
+			return
+		}
+
+		//don't overwrite an existing archive
+		f, err := os.OpenFile(*path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalln("Could not create archive file.", err)
+			return
+		}
+		defer f.Close()
+
+		counts, err := archive.Export(context.Background(), stores, deploymentType, f)
+		if err != nil {
+			//remove the partial archive so it can't be imported by mistake
+			f.Close()
+			os.Remove(*path)
+			log.Fatalln("Could not export data.", err)
+			return
+		}
+
+		log.Printf("Exported %d users, %d cards, %d company info, %d app settings to %s", counts.Users, counts.Cards, counts.CompanyInfo, counts.AppSettings, *path)
+
+	case commandImport:
+		fs := flag.NewFlagSet(commandImport, flag.ExitOnError)
+		path := fs.String("file", "", "The path to the archive file to import.")
+		fs.Parse(args[1:])
+		if *path == "" {
+			log.Fatalln("The -file flag is required for import.")
+			return
+		}
+
+		f, err := os.Open(*path)
+		if err != nil {
+			log.Fatalln("Could not open archive file.", err)
+			return
+		}
+		defer f.Close()
+
+		counts, err := archive.Import(context.Background(), stores, f)
+		if err != nil {
+			log.Fatalln("Could not import data.", err)
+			return
+		}
+
+		log.Printf("Imported %d users, %d cards, %d company info, %d app settings from %s", counts.Users, counts.Cards, counts.CompanyInfo, counts.AppSettings, *path)
+
+	case commandResync:
+		fs := flag.NewFlagSet(commandResync, flag.ExitOnError)
+		startString := fs.String("start", "", "The first day to resync charges and refunds for, yyyy-mm-dd.")
+		endString := fs.String("end", "", "The last day to resync charges and refunds for, yyyy-mm-dd.")
+		fs.Parse(args[1:])
+		if *startString == "" || *endString == "" {
+			log.Fatalln("The -start and -end flags are required for resync.")
+			return
+		}
+
+		start, end, err := card.ParseResyncRange(*startString, *endString)
+		if err != nil {
+			log.Fatalln("Could not parse the date range to resync.", err)
+			return
+		}
+
+		numCharges, numRefunds, err := card.ResyncLedgerRange(context.Background(), start, end)
+		if err != nil {
+			log.Fatalln("Could not resync the ledger.", err)
+			return
+		}
+
+		log.Printf("Resynced %d charges and %d refunds", numCharges, numRefunds)
+
+	default:
+		log.Fatalln("Unknown command.  Use export, import, restore, or resync.", args[0])
+	}
+}
+
+//showMigrationStatus prints the list of sqlite schema migrations and if each has been run
+func showMigrationStatus() {
+	status, err := sqliteutils.GetMigrationStatus()
+	if err != nil {
+		log.Fatalln("Could not get migration status.", err)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tAPPLIED\tDATETIME APPLIED\tDESCRIPTION")
+	for _, m := range status {
+		fmt.Fprintf(tw, "%d\t%t\t%s\t%s\n", m.Version, m.Applied, m.DatetimeApplied, m.Description)
+	}
+	tw.Flush()
+}
+
+//restoreBackup replaces the sqlite db with a backup file
+func restoreBackup(args []string) {
+	fs := flag.NewFlagSet(commandRestore, flag.ExitOnError)
+	path := fs.String("file", "", "The path to the backup file to restore.")
+	fs.Parse(args)
+	if *path == "" {
+		log.Fatalln("The -file flag is required for restore.")
+		return
+	}
+
+	previous, err := sqliteutils.Restore(*path)
+	if err != nil {
+		log.Fatalln("Could not restore backup.", err)
+		return
+	}
+
+	if previous != "" {
+		log.Println("The previous database was saved to", previous)
+	}
+	log.Println("Restored", *path, "to", sqliteutils.Config.PathToDatabaseFile)
+}
+
 //parseAppYaml handles reading the app.yaml file
 func parseAppYaml(path string) (yamlData appYaml, err error) {
 	if len(path) < 1 {
@@ -457,6 +912,9 @@ func diag(w http.ResponseWriter, r *http.Request) {
 		"Static File Cache Lifetime (days)":  strconv.Itoa(parsedAppYaml.EnvVars.CacheDays),
 		"Use Development Database/Datastore": strconv.FormatBool(useDevDatastore),
 		"Use Local Files":                    parsedAppYaml.EnvVars.UseLocalFiles,
+		"Stripe Webhook Enabled":             strconv.FormatBool(card.Config.StripeWebhookSecret != ""),
+		"Email Enabled":                      strconv.FormatBool(emailutils.Enabled()),
+		"Cron Secret Set":                    strconv.FormatBool(middleware.Config.CronSecret != ""),
 
 		//appengine specific stuff
 		//when deployement type = appengine, these fields will have values.  otherwise they are blank
@@ -465,7 +923,7 @@ func diag(w http.ResponseWriter, r *http.Request) {
 		"App Engine Service Version": os.Getenv("GAE_VERSION"),
 		"App Engine Instance ID":     os.Getenv("GAE_INSTANCE"),
 
-		//appengine-dev or sqlite stuff
+		//appengine-dev, sqlite, or postgres stuff
 		//when app is installed in a non-appengine environment
 		"Path to Datastore Credentials": pathToDatastoreCredentials,
 		"Path to Static Files":          parsedAppYaml.EnvVars.StaticFilePath,
@@ -30,6 +30,20 @@ function validateEmail(email) {
 	return regex.test(email);
 }
 
+//CHECK A LIST OF EMAILS
+//true if each email in a comma or semicolon separated list is valid, a blank list is valid
+function validateEmailList(list) {
+	var emails = list.split(/[,;]/);
+	for (var i = 0; i < emails.length; i++) {
+		var email = emails[i].trim();
+		if (email !== '' && validateEmail(email) === false) {
+			return false;
+		}
+	}
+
+	return true;
+}
+
 //CHECK IF TWO PASSWORDS MATCH
 function doWordsMatch (word1, word2) {
 	if (word1 === word2) {
@@ -116,6 +130,7 @@ $('body').on('click', '.action-btn', function() {
 	//CLEAR ALL THE PANELS TO DEFAULT OPTIONS
 	resetAddCardPanel();
 	resetChargeCardPanel(true)
+	resetScheduledChargePanel();
 });
 
 //VALIDATE THE INITIAL ADMIN CREATE FORM
@@ -163,6 +178,9 @@ $(function () {
 		dataType: 'json'
 	});
 
+	//SHOW THE DETAILS OF THE AUTOFILLED CUSTOMER'S DEFAULT CARD
+	$('#charge-card .charge-card-id').trigger('change');
+
 	return;
 });
 
@@ -243,8 +261,8 @@ function getCardIdFromDataList(autocompleteElement) {
 function generateExpirationYears() {
 	console.log("Loading expiration years...");
 
-	//element to displays years in
-	var elem = $('#card-exp-year');
+	//elements to displays years in
+	var elem = $('#card-exp-year, #update-card-exp-year');
 	elem.html('');
 
 	//get current year
@@ -316,6 +334,7 @@ $('#form-new-user').submit(function (e) {
 	var removeCards = 	$('#form-new-user .can-remove-cards input:checked').val();
 	var chargeCards = 	$('#form-new-user .can-charge-cards input:checked').val();
 	var reports = 		$('#form-new-user .can-view-reports input:checked').val();
+	var disputes = 		$('#form-new-user .can-manage-disputes input:checked').val();
 	var admin = 		$('#form-new-user .is-admin input:checked').val();
 	var active = 		$('#form-new-user .is-active input:checked').val();
 	var msgElem = 		$('#form-new-user .msg');
@@ -366,6 +385,7 @@ $('#form-new-user').submit(function (e) {
 			removeCards: 	removeCards,
 			chargeCards: 	chargeCards,
 			reports: 		reports,
+			disputes: 		disputes,
 			admin: 			admin,
 			active: 		active
 		},
@@ -592,6 +612,13 @@ $('#form-update-user').on('change', '.user-list', function() {
 				$('#form-update-user .can-view-reports input[value=false]').attr('checked', true).parent().addClass('active');
 			}
 
+			if (data['manage_disputes']) {
+				$('#form-update-user .can-manage-disputes input[value=true]').attr('checked', true).parent().addClass('active');
+			}
+			else {
+				$('#form-update-user .can-manage-disputes input[value=false]').attr('checked', true).parent().addClass('active');
+			}
+
 			if (data['is_admin']) {
 				$('#form-update-user .is-admin input[value=true]').attr('checked', true).parent().addClass('active');
 			}
@@ -620,6 +647,7 @@ $('#form-update-user').submit(function (e) {
 	var removeCards = 	$('#form-update-user .can-remove-cards label.active input').val();
 	var chargeCards = 	$('#form-update-user .can-charge-cards label.active input').val();
 	var reports = 		$('#form-update-user .can-view-reports label.active input').val();
+	var disputes = 		$('#form-update-user .can-manage-disputes label.active input').val();
 	var admin = 		$('#form-update-user .is-admin label.active input').val();
 	var active = 		$('#form-update-user .is-active label.active input').val();
 	var msgElem = 		$('#form-update-user .msg');
@@ -645,6 +673,7 @@ $('#form-update-user').submit(function (e) {
 			removeCards: 	removeCards,
 			chargeCards: 	chargeCards,
 			reports: 		reports,
+			disputes: 		disputes,
 			admin: 			admin,
 			active: 		active
 		},
@@ -685,9 +714,11 @@ $('#form-update-user').submit(function (e) {
 
 //HIDE "THIS YEAR" IF USER CHOOSES AN EXPIRATION MONTH IN THE PAST
 //user cannot choose an expiration in a past month for this year
-$('#add-card').on('change', '#card-exp-month', function() {
+//used when adding a card and when updating a card
+$('#add-card, #update-card').on('change', '#card-exp-month, #update-card-exp-month', function() {
 	//get value from month chosen
 	var expMonth = 		$(this).val();
+	var yearSelect = 	$(this).closest('form').find('#card-exp-year, #update-card-exp-year');
 
 	//get current month
 	var d = 			new Date();
@@ -697,60 +728,29 @@ $('#add-card').on('change', '#card-exp-month', function() {
 	//check if expiration month is in the past
 	//hide the option for this year if month is in the past
 	if (expMonth < currentMonth) {
-		$('#card-exp-year option[value=' + currentYear + ']').css({"display": "none"});
+		yearSelect.find('option[value=' + currentYear + ']').css({"display": "none"});
 	}
 	else {
-		$('#card-exp-year option[value=' + currentYear + ']').css({"display": "block"});
+		yearSelect.find('option[value=' + currentYear + ']').css({"display": "block"});
 	}
 
 	return;
 });
 
-//ADD A NEW CREDIT CARD
-//validate the card data and save the card via ajax call
-$('#add-card').submit(function (e) {
-	var form = 			$('#add-card');
-	var customerId = 	$('#customer-id').val().trim();
-	var customerName = 	$('#customer-name').val().trim();
-	var cardholder = 	$('#cardholder-name').val().trim();
-	var cardNum = 		$('#card-number').val().trim().replace(' ', '').replace('-', '');
-	var expYear = 		parseInt($('#card-exp-year').val());
-	var expMonth = 		parseInt($('#card-exp-month').val());
-	var cvc = 			$('#card-cvc').val().trim();
-	var postal = 		$('#card-postal-code').val().trim();
-	var cardType = 		Stripe.card.cardType(cardNum);
-	var submitBtn = 	$('#add-card .submit-form-btn');
-	var msg = 			$('#add-card .msg');
-
-	//hide any existing warnings
-	msg.html('');	
-
-	//make sure each input is valid
-	//customer name
-	if (customerName.length < 2) {
-		e.preventDefault();
-		showPanelMessage('You must provide a customer name. This can be the same as the cardholder or the name of a company. This is used to lookup cards when you want to create a charge.', "danger", msg);
-		return false;
-	}
-
-	//cardholder name
-	if (cardholder.length < 2) {
-		e.preventDefault();
-		showPanelMessage('Please provide the name of the cardholder as it is given on the card.', 'danger', msg);
-		return false;
-	}
+//VALIDATE A CARD'S DETAILS
+//checks the card number, expiration, security code, and postal code before a token is created
+//used when adding a card and when updating a card
+//returns an error message to show to the user, or a blank string if the card is valid
+function validateCard(cardNum, expMonth, expYear, cvc, postal) {
+	var cardType = Stripe.card.cardType(cardNum);
 
 	//card number
 	var cardNumLength = cardNum.length;
 	if (cardNumLength < 14 || cardNumLength > 16) {
-		e.preventDefault();
-		showPanelMessage('The card number you provided is ' + cardNumLength + ' digits long, however, it must be exactly 15 or 16 digits.', 'danger', msg);
-		return false;
+		return 'The card number you provided is ' + cardNumLength + ' digits long, however, it must be exactly 15 or 16 digits.';
 	}
 	if (Stripe.card.validateCardNumber(cardNum) === false) {
-		e.preventDefault();
-		showPanelMessage('The card number you provided is not valid.', 'danger', msg);
-		return false;
+		return 'The card number you provided is not valid.';
 	}
 
 	//expiration
@@ -759,68 +759,180 @@ $('#add-card').submit(function (e) {
 	var nowYear = 	d.getFullYear();
 	//month
 	if (expMonth === 0 || expMonth === '0') {
-		e.preventDefault();
-		showPanelMessage('Please choose the card\'s expiration month.', 'danger', msg);
-		return false;
+		return 'Please choose the card\'s expiration month.';
 	}
 	//year
 	if (expYear === 0 || expYear === '0') {
-		e.preventDefault();
-		showPanelMessage('Please choose the card\'s expiration year.', 'danger', msg);
-		return false;
+		return 'Please choose the card\'s expiration year.';
 	}
 	//both
 	if (expYear === nowYear && expMonth < nowMonth) {
-		e.preventDefault();
-		showPanelMessage('The card\'s expiration must be in the future.', 'danger', msg);
-		return false;
+		return 'The card\'s expiration must be in the future.';
 	}
 	if (Stripe.card.validateExpiry(expMonth, expYear) === false) {
-		e.preventDefault();
-		showPanelMessage('The card\'s expiration must be in the future.', 'danger', msg);
-		return false;
+		return 'The card\'s expiration must be in the future.';
 	}
 
 	//cvc
 	if (Stripe.card.validateCVC(cvc) === false) {
-		e.preventDefault();
-		showPanelMessage('The security code you provided is invalid.', 'danger', msg);
-		return false;
+		return 'The security code you provided is invalid.';
 	}
 	if (cardType === "American Express" && cvc.length !== 4) {
+		return 'You provided an American Express card but your security code is invalid. The security code must be exactly 4 numbers long.';
+	}
+	if (cardType !== "American Express" && cvc.length !== 3) {
+		return 'You provided an ' + cardType + ' card but your security code is invalid. The security code must be exactly 3 numbers long.';
+	}
+
+	//postal code
+	if (postal.length < 5 || postal.length > 6) {
+		return 'The postal code must be exactly 5 numeric or 6 alphanumeric characters.';
+	}
+
+	return '';
+}
+
+//SHOW THE CARD OR BANK ACCOUNT INPUTS
+//only the inputs for the chosen payment method are shown and required
+function showAddPaymentTypeFields() {
+	var bankAccount = ($('#add-payment-type').val() === 'bank_account');
+
+	$('#add-card .add-card-fields').toggle(!bankAccount);
+	$('#add-card .add-card-fields input').prop('required', !bankAccount);
+	$('#add-card .add-bank-fields').toggle(bankAccount);
+	$('#add-card .add-bank-fields input').prop('required', bankAccount);
+
+	if (bankAccount) {
+		$('#add-card .cardholder-label').text('Account Holder: ');
+		$('#cardholder-name').attr('placeholder', 'The name on the bank account.');
+	}
+	else {
+		$('#add-card .cardholder-label').text('Cardholder: ');
+		$('#cardholder-name').attr('placeholder', 'The name on the card.');
+	}
+
+	return;
+}
+
+$('#add-card').on('change', '#add-payment-type', function() {
+	showAddPaymentTypeFields();
+	return;
+});
+
+//ADD A NEW CREDIT CARD OR BANK ACCOUNT
+//validate the card data and save the card via ajax call
+//a bank account is tokenized by stripe.js the same as a card and saved the same way
+$('#add-card').submit(function (e) {
+	var form = 			$('#add-card');
+	var paymentType = 	$('#add-payment-type').val();
+	var customerId = 	$('#customer-id').val().trim();
+	var customerName = 	$('#customer-name').val().trim();
+	var cardholder = 	$('#cardholder-name').val().trim();
+	var currency = 		$('#customer-currency').val().trim();
+	var billingEmail = 	$('#customer-billing-email').val().trim();
+	var cardNum = 		$('#card-number').val().trim().replace(' ', '').replace('-', '');
+	var expYear = 		parseInt($('#card-exp-year').val());
+	var expMonth = 		parseInt($('#card-exp-month').val());
+	var cvc = 			$('#card-cvc').val().trim();
+	var postal = 		$('#card-postal-code').val().trim();
+	var routingNum = 	$('#bank-routing-number').val().trim();
+	var accountNum = 	$('#bank-account-number').val().trim();
+	var holderType = 	$('#bank-account-holder-type').val();
+	var makeDefault = 	$('#card-make-default').prop('checked');
+	var submitBtn = 	$('#add-card .submit-form-btn');
+	var msg = 			$('#add-card .msg');
+
+	//hide any existing warnings
+	msg.html('');	
+
+	//make sure each input is valid
+	//customer name
+	if (customerName.length < 2) {
 		e.preventDefault();
-		showPanelMessage('You provided an American Express card but your security code is invalid. The security code must be exactly 4 numbers long.', 'danger', msg);
+		showPanelMessage('You must provide a customer name. This can be the same as the cardholder or the name of a company. This is used to lookup cards when you want to create a charge.', "danger", msg);
 		return false;
 	}
-	if (cardType !== "American Express" && cvc.length !== 3) {
+
+	//cardholder name
+	if (cardholder.length < 2) {
 		e.preventDefault();
-		showPanelMessage('You provided an ' + Stripe.card.cardType(cardNum) + ' card but your security code is invalid. The security code must be exactly 3 numbers long.', 'danger', msg);
+		if (paymentType === 'bank_account') {
+			showPanelMessage('Please provide the name of the account holder as it is given on the bank account.', 'danger', msg);
+		}
+		else {
+			showPanelMessage('Please provide the name of the cardholder as it is given on the card.', 'danger', msg);
+		}
 		return false;
 	}
 
-	//postal code
-	if (postal.length < 5 || postal.length > 6) {
+	//billing email
+	if (billingEmail !== '' && validateEmail(billingEmail) === false) {
 		e.preventDefault();
-		showPanelMessage('The postal code must be exactly 5 numeric or 6 alphanumeric characters.', 'danger', msg);
+		showPanelMessage('The billing email must be a valid email address. Leave it blank if the customer does not have one.', 'danger', msg);
 		return false;
 	}
 
+	//bank accounts are only charged in usd
+	if (paymentType === 'bank_account') {
+		if (currency !== '' && currency.toLowerCase() !== 'usd') {
+			e.preventDefault();
+			showPanelMessage('Bank accounts can only be charged in USD. Leave the currency blank or use USD.', 'danger', msg);
+			return false;
+		}
+
+		//routing and account number
+		if (/^[0-9]{9}$/.test(routingNum) === false) {
+			e.preventDefault();
+			showPanelMessage('The routing number must be 9 digits.', 'danger', msg);
+			return false;
+		}
+		if (/^[0-9]{4,17}$/.test(accountNum) === false) {
+			e.preventDefault();
+			showPanelMessage('The account number must be between 4 and 17 digits.', 'danger', msg);
+			return false;
+		}
+	}
+	else {
+		//card number, expiration, security code, and postal code
+		var cardErr = validateCard(cardNum, expMonth, expYear, cvc, postal);
+		if (cardErr !== '') {
+			e.preventDefault();
+			showPanelMessage(cardErr, 'danger', msg);
+			return false;
+		}
+	}
+
 	//disable the submit button so the user cannot add the same card twice by mistake
 	submitBtn.prop("disabled", true);
 	
 	//clear any error messages
 	//show "adding card" message
-	showPanelMessage('Saving card...', 'info', msg);
-
-	//create card token
-	Stripe.card.createToken({
-		name: 			cardholder,
-		number: 		cardNum,
-		cvc: 			cvc,
-		exp_month: 		expMonth,
-		exp_year: 		expYear,
-		address_zip: 	postal
-	}, createTokenCallback)
+	if (paymentType === 'bank_account') {
+		showPanelMessage('Saving bank account...', 'info', msg);
+
+		//create bank account token
+		Stripe.bankAccount.createToken({
+			country: 				'US',
+			currency: 				'usd',
+			routing_number: 		routingNum,
+			account_number: 		accountNum,
+			account_holder_name: 	cardholder,
+			account_holder_type: 	holderType
+		}, createBankTokenCallback);
+	}
+	else {
+		showPanelMessage('Saving card...', 'info', msg);
+
+		//create card token
+		Stripe.card.createToken({
+			name: 			cardholder,
+			number: 		cardNum,
+			cvc: 			cvc,
+			exp_month: 		expMonth,
+			exp_year: 		expYear,
+			address_zip: 	postal
+		}, createTokenCallback)
+	}
 
 	function createTokenCallback (status, response) {
 		if (response.error) {
@@ -828,20 +940,46 @@ $('#add-card').submit(function (e) {
 			return;
 		}
 
+		addCard({
+			paymentType: 	'card',
+			cardToken: 		response['id'],
+			cardExp: 		response['card']['exp_month'] + "/" + response['card']['exp_year'],
+			cardLast4: 		response['card']['last4']
+		});
+		return;
+	}
+
+	function createBankTokenCallback (status, response) {
+		if (response.error) {
+			showPanelMessage('The bank account could not be saved. Please check the routing and account numbers. Message: ' + response.error.message + '.', 'danger', msg);
+			submitBtn.prop("disabled", false);
+			return;
+		}
+
+		addCard({
+			paymentType: 	'bank_account',
+			cardToken: 		response['id'],
+			cardLast4: 		response['bank_account']['last4'],
+			bankName: 		response['bank_account']['bank_name']
+		});
+		return;
+	}
+
+	function addCard (token) {
 		//perform ajax call
 		//save data to db
-		//create stripe customer using card token
+		//create stripe customer using card or bank account token
 		$.ajax({
 			type: 	"POST",
 			url: 	"/card/add/",
-			data: {
+			data: $.extend({
 				customerId: 	customerId,
 				customerName: 	customerName,
 				cardholder: 	cardholder,
-				cardToken: 		response['id'],
-				cardExp: 		response['card']['exp_month'] + "/" + response['card']['exp_year'],
-				cardLast4: 		response['card']['last4']
-			},
+				currency: 		currency,
+				billingEmail: 	billingEmail,
+				makeDefault: 	makeDefault
+			}, token),
 			error: function (r) {
 				var j = JSON.parse(r['responseText']);
 
@@ -857,7 +995,15 @@ $('#add-card').submit(function (e) {
 				//clear all inputs
 				//show success alert
 				resetAddCardPanel();
-				showPanelMessage("Card was saved!", 'success', msg);
+				if (token['paymentType'] === 'bank_account') {
+					showPanelMessage("Bank account was saved! Verify it once Stripe's two small deposits arrive in the bank account, then it can be charged.", 'success', msg);
+				}
+				else if (r['type'] === "addCardToCustomer") {
+					showPanelMessage("Card was added to the existing customer!", 'success', msg);
+				}
+				else {
+					showPanelMessage("Card was saved!", 'success', msg);
+				}
 
 				//clear the message
 				//reenable the add card button
@@ -887,11 +1033,19 @@ function resetAddCardPanel() {
 	$('#customer-id').val('');
 	$('#customer-name').val('');
 	$('#cardholder-name').val('');
+	$('#customer-currency').val('');
+	$('#customer-billing-email').val('');
 	$('#card-number').val('');
 	$('#card-exp-year').val('0');
 	$('#card-exp-month').val('0');
 	$('#card-cvc').val('');
 	$('#card-postal-code').val('');
+	$('#bank-routing-number').val('');
+	$('#bank-account-number').val('');
+	$('#bank-account-holder-type').val('company');
+	$('#add-payment-type').val('card');
+	$('#card-make-default').prop('checked', false);
+	showAddPaymentTypeFields();
 	return;
 }
 
@@ -903,119 +1057,63 @@ $('#panel-add-card').on('click', '.clear-form-btn', function() {
 });
 
 //*******************************************************************************
-//REMOVE A CARD
-$('#remove-card').submit(function (e) {
-	//get value of autocomplete list
-	var input = 	$('#remove-card .customer-name');
-	var custName = 	input.val();
-	var custId = 	getCardIdFromDataList(input);
+//UPDATE A CARD
 
-	//btn and alerts
-	var btn = 		$('#remove-card .submit-form-btn');
-	var msg = 		$('#remove-card .msg');
+//SHOW A CARD'S DETAILS WHEN IT IS CHOSEN
+//fill in the cardholder and show who last updated the card
+function showUpdateCardDetails() {
+	var option = 	$('#update-card .update-card-id option:selected');
+	var history = 	$('#update-card .update-card-history');
 
-	//quick validation
-	if (custId === 0 || custId === "0" || custId.length === 0) {
-		e.preventDefault();
-		showPanelMessage("You must choose a customer.", "danger", msg);
-		return
+	if (option.length === 0) {
+		$('#update-cardholder-name').val('');
+		history.text('');
+		return;
 	}
 
-	//remove card
-	$.ajax({
-		type: 	"POST",
-		url: 	"/card/remove/",
-		data: {
-			customerId: 	custId,
-			customerName: 	custName
-		},
-		beforeSend: function() {
-			//disable the submit btn and show a message
-			btn.prop('disabled', true);
-			showPanelMessage('Removing card...', 'info', msg);
-			return;
-		},
-		error: function (r) {
-			var j = JSON.parse(r['responseText']);
-			if (j['ok'] === false) {
-				btn.prop('disabled', false);
-				showPanelMessage('An error occured while removing this card. Do not refresh or leave this screen! Please contact an administrator.', 'danger', msg);
-			}
-
-			return;
-		},
-		success: function (j) {
-			//card was removed
-			//show success message
-			btn.prop('disabled', false);
-			showPanelMessage('Card was removed!', 'success', msg);
-
-			//clear the chosen option
-			input.val('');
-			setTimeout(function() {
-				msg.html('');
-
-				//reload list of cards
-				//this was creating problems (list was not up to date) when it was updating right away on success
-				getCards();
-			}, 500);
-
-			return;
-		}
-	});
+	$('#update-cardholder-name').val(option.attr('data-cardholder'));
 
-	e.preventDefault();
-	return false;
-});
+	var updatedBy = option.attr('data-updated-by');
+	if (updatedBy) {
+		history.text('Last updated by ' + updatedBy + ' on ' + option.attr('data-updated') + ' (UTC).');
+	}
+	else {
+		history.text('This card has not been updated before.');
+	}
 
-//*******************************************************************************
-//CHARGE A CARD
+	return;
+}
 
-//LOAD DATA INTO THE PANEL WHEN A CUSTOMER IS CHOSEN
-//typed in or selected from the drop down menu
-$('#charge-card').on('change', '.customer-name', function() {
-	//get value of autocomplete list
-	var input = 	$('#charge-card .customer-name');
+//LOAD THE CUSTOMER'S CARDS WHEN A CUSTOMER IS CHOSEN
+//the default card is first and chosen
+$('#update-card').on('change', '.customer-name', function() {
+	var input = 	$('#update-card .customer-name');
 	var custId = 	getCardIdFromDataList(input);
-	var msg = 		$('#charge-card .msg');
+	var select = 	$('#update-card .update-card-id');
+
+	//reset the list of cards
+	select.html('');
+	showUpdateCardDetails();
 
-	//clear existing wanrings
-	msg.html('');
-	
 	//check if no valid customer was selected
 	if (custId === "" || custId === 0) {
-		showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.", "danger", msg);
 		return;
 	}
 
-	//get customer card data to fill into panel
 	$.ajax({
 		type: 	"GET",
 		url: 	"/card/get/",
 		data: {
 			customerId: custId
 		},
-		beforeSend: function() {
-			//show loading in readonly inputs
-			$('#charge-card .customer-cardholder, #charge-card .card-last-four, #charge-card .card-expiration').val("Loading...");
-			return;
-		},
-		error: function(r) {
-			var  j = JSON.parse(r['responseText']);
-			showPanelMessage(j['data']['error_msg'], "danger", msg);
-			return;
-		},
 		success: function (j) {
-			//put data into readonly form inputs
-			//so a user can verify card information and see some basic data before charging card
-			var data = j['data'];
-			$('#charge-card .customer-cardholder').val(data['cardholder_name']);
-			$('#charge-card .card-last-four').val(data['card_last4']);
-			$('#charge-card .card-expiration').val(data['card_expiration']);
-
-			//enable amount, invoice, po inputs
-			$('#charge-card .charge-amount, #charge-card .charge-invoice, #charge-card .charge-po').prop('disabled', false);
+			//customers without saved cards have one card with an id of 0
+			var cards = j['data']['cards'] || [];
+			cards.forEach(function (card) {
+				select.append(cardOption(card));
+			});
 
+			showUpdateCardDetails();
 			return;
 		}
 	});
@@ -1023,219 +1121,1306 @@ $('#charge-card').on('change', '.customer-name', function() {
 	return;
 });
 
-//CHARGE A CARD
-//validate the amount, invoice, and po inputs
-//create charge via ajax to stripe
-$('#charge-card').submit(function (e) {
-	//gather inputs
-	var customerNameInput = $('#charge-card .customer-name');
-	var customerName = 		customerNameInput.val();
-	var datastoreId = 		getCardIdFromDataList(customerNameInput);
-	var amountElem = 		$('#charge-card .charge-amount');
-	var amount = 			parseFloat(amountElem.val());
-	var invoiceElem = 		$('#charge-card .charge-invoice');
-	var invoice = 			invoiceElem.val();
-	var poElem = 			$('#charge-card .charge-po');
-	var po = 				poElem.val();
-	var msg = 				$('#charge-card .msg');
-	var btn = 				$('#charge-card-submit');
-	var dropdownBtn = 		btn.siblings('.dropdown-toggle');
-	var chargeAndRemove = 	btn.data("chargeandremove") || false;
-	var authorizeOnly = 	btn.data("authorizeonly") || false;
+$('#update-card').on('change', '.update-card-id', function() {
+	showUpdateCardDetails();
+	return;
+});
 
-	//stop form submission
-	e.preventDefault();
+//REPLACE A CARD WITH A NEW CARD
+//validate the card data and save the card via ajax call
+$('#update-card').submit(function (e) {
+	var input = 		$('#update-card .customer-name');
+	var custId = 		getCardIdFromDataList(input);
+	var cardId = 		$('#update-card .update-card-id').val();
+	var cardholder = 	$('#update-cardholder-name').val().trim();
+	var cardNum = 		$('#update-card-number').val().trim().replace(' ', '').replace('-', '');
+	var expYear = 		parseInt($('#update-card-exp-year').val());
+	var expMonth = 		parseInt($('#update-card-exp-month').val());
+	var cvc = 			$('#update-card-cvc').val().trim();
+	var postal = 		$('#update-card-postal-code').val().trim();
+	var submitBtn = 	$('#panel-update-card .submit-form-btn');
+	var msg = 			$('#update-card .msg');
 
-	console.log("charging...", amount, MIN_CHARGE)
+	//hide any existing warnings
+	msg.html('');
 
+	//make sure each input is valid
+	//customer and card
+	if (custId === 0 || custId === "0" || custId.length === 0 || cardId === null) {
+		e.preventDefault();
+		showPanelMessage("You must choose a customer and the card to update.", "danger", msg);
+		return false;
+	}
 
-	//validate
-	if (amount < MIN_CHARGE || isNaN(amount)) {
+	//cardholder name
+	if (cardholder.length < 2) {
+		e.preventDefault();
+		showPanelMessage('Please provide the name of the cardholder as it is given on the card.', 'danger', msg);
+		return false;
+	}
+
+	//card number, expiration, security code, and postal code
+	var cardErr = validateCard(cardNum, expMonth, expYear, cvc, postal);
+	if (cardErr !== '') {
 		e.preventDefault();
-		showPanelMessage("You must provide an amount to charge greater than the minimum charge ($" + MIN_CHARGE + ").", "danger", msg);
+		showPanelMessage(cardErr, 'danger', msg);
+		return false;
+	}
+
+	//disable the submit button so the user cannot submit the same card twice by mistake
+	submitBtn.prop("disabled", true);
+	showPanelMessage('Updating card...', 'info', msg);
+
+	//create card token
+	Stripe.card.createToken({
+		name: 			cardholder,
+		number: 		cardNum,
+		cvc: 			cvc,
+		exp_month: 		expMonth,
+		exp_year: 		expYear,
+		address_zip: 	postal
+	}, createTokenCallback)
+
+	function createTokenCallback (status, response) {
+		if (response.error) {
+			showPanelMessage('The credit card could not be saved. Please contact an administrator. Message: ' + response.error.message + '.', 'danger', msg);
+			submitBtn.prop("disabled", false);
+			return;
+		}
+
+		//perform ajax call
+		//replace the card on the existing stripe customer
+		$.ajax({
+			type: 	"POST",
+			url: 	"/card/update/",
+			data: {
+				customerId: 	custId,
+				cardId: 		cardId,
+				cardholder: 	cardholder,
+				cardToken: 		response['id'],
+				cardExp: 		response['card']['exp_month'] + "/" + response['card']['exp_year'],
+				cardLast4: 		response['card']['last4']
+			},
+			error: function (r) {
+				var j = JSON.parse(r['responseText']);
+
+				if (j['ok'] == false) {
+					showPanelMessage(j['data']['error_msg'], 'danger', msg);
+					submitBtn.prop("disabled", false);
+					return
+				}
+				return;
+			},
+			success: function (r) {
+				//card was updated successfully
+				//clear all inputs
+				//show success alert
+				resetUpdateCardPanel();
+				showPanelMessage("Card was updated!", 'success', msg);
+
+				//clear the message
+				//reenable the update card button
+				setTimeout(function() {
+					msg.html('');
+					submitBtn.prop("disabled", false);
+				}, 500);
+				return;
+			}
+		});
+
 		return;
 	}
 
-	//unset the charge and remove data attribute
-	//so we don't use this by mistake for the next charge or card
-	btn.data("chargeandremove", "");
+	//stop form from submitting since it won't do anything anyway
+	e.preventDefault();
+	return false;
+});
+
+//CLEAR THE UPDATE CARD FORM
+//reset inputs to defaults
+function resetUpdateCardPanel() {
+	$('#update-card .customer-name').val('');
+	$('#update-card .update-card-id').html('');
+	$('#update-card .update-card-history').text('');
+	$('#update-cardholder-name').val('');
+	$('#update-card-number').val('');
+	$('#update-card-exp-year').val('0');
+	$('#update-card-exp-month').val('0');
+	$('#update-card-cvc').val('');
+	$('#update-card-postal-code').val('');
+	return;
+}
+
+//CLEAR THE FORM WHEN THE USER CLICKS THE CLEAR BTN
+$('#panel-update-card').on('click', '.clear-form-btn', function() {
+	resetUpdateCardPanel();
+	$('#update-card .msg').html('');
+	return;
+});
+
+//*******************************************************************************
+//VERIFY A BANK ACCOUNT
+
+//LOAD THE CUSTOMER'S BANK ACCOUNTS THAT STILL NEED TO BE VERIFIED WHEN A CUSTOMER IS CHOSEN
+$('#verify-bank-account').on('change', '.customer-name', function() {
+	var input = 	$('#verify-bank-account .customer-name');
+	var custId = 	getCardIdFromDataList(input);
+	var select = 	$('#verify-bank-account .verify-bank-account-id');
+	var msg = 		$('#verify-bank-account .msg');
+
+	//reset the list of bank accounts
+	select.html('');
+	msg.html('');
+
+	//check if no valid customer was selected
+	if (custId === "" || custId === 0) {
+		return;
+	}
 
-	//charge card via ajax
 	$.ajax({
-		type: 	"POST",
-		url: 	"/card/charge/",
+		type: 	"GET",
+		url: 	"/card/get/",
 		data: {
-			datastoreId: 		datastoreId,
-			customerName: 		customerName,
-			amount: 			amount,
-			invoice: 			invoice, 
-			po: 				po,
-			chargeAndRemove: 	chargeAndRemove,
-			authorizeOnly: 		authorizeOnly,
+			customerId: custId
 		},
-		beforeSend: function() {
-			//disabled the inputs
-			customerNameInput.prop('disabled', true);
-			amountElem.prop('disabled', true);
-			invoiceElem.prop('disabled', true);
-			poElem.prop('disabled', true);
-			btn.prop('disabled', true);
-			dropdownBtn.prop('disabled', true);
+		success: function (j) {
+			var cards = j['data']['cards'] || [];
+			cards.forEach(function (card) {
+				if (card['payment_type'] !== 'bank_account' || card['bank_account_status'] === 'verified') {
+					return;
+				}
 
-			//show working message
-			if (authorizeOnly) {
-				showPanelMessage("Authorizing charge...", 'info', msg);
-			}
-			else {
-				showPanelMessage("Charging card...", 'info', msg);
+				select.append(cardOption(card));
+			});
+
+			if (select.find('option').length === 0) {
+				showPanelMessage('This customer does not have any bank accounts that need to be verified.', 'info', msg);
 			}
-			
-			//clear success panel in case it has old data
-			resetChargeSuccessPanel();
+
+			return;
+		}
+	});
+
+	return;
+});
+
+//VERIFY A BANK ACCOUNT WITH THE AMOUNTS OF THE TWO SMALL DEPOSITS
+$('#verify-bank-account').submit(function (e) {
+	var input = 	$('#verify-bank-account .customer-name');
+	var custId = 	getCardIdFromDataList(input);
+	var cardId = 	$('#verify-bank-account .verify-bank-account-id').val();
+	var amount1 = 	parseInt($('#verify-amount-1').val());
+	var amount2 = 	parseInt($('#verify-amount-2').val());
+	var submitBtn = $('#panel-verify-bank-account .submit-form-btn');
+	var msg = 		$('#verify-bank-account .msg');
+
+	//stop form from submitting since it won't do anything anyway
+	e.preventDefault();
+
+	//hide any existing warnings
+	msg.html('');
+
+	//quick validation
+	if (custId === 0 || custId === "0" || custId.length === 0) {
+		showPanelMessage("You must choose a customer.", "danger", msg);
+		return false;
+	}
+	if (!cardId) {
+		showPanelMessage("You must choose a bank account.", "danger", msg);
+		return false;
+	}
+	if (isNaN(amount1) || isNaN(amount2) || amount1 < 1 || amount1 > 99 || amount2 < 1 || amount2 > 99) {
+		showPanelMessage("Each deposit amount must be a whole number of cents between 1 and 99, i.e.: 32 for $0.32.", "danger", msg);
+		return false;
+	}
+
+	$.ajax({
+		type: 	"POST",
+		url: 	"/card/bank-account/verify/",
+		data: {
+			customerId: custId,
+			cardId: 	cardId,
+			amount1: 	amount1,
+			amount2: 	amount2
+		},
+		beforeSend: function() {
+			submitBtn.prop('disabled', true);
+			showPanelMessage('Verifying bank account...', 'info', msg);
 			return;
 		},
 		error: function (r) {
 			var j = JSON.parse(r['responseText']);
+			submitBtn.prop('disabled', false);
+
 			if (j['ok'] === false) {
 				showPanelMessage(j['data']['error_msg'], 'danger', msg);
 			}
 			return;
 		},
 		success: function (j) {
-			var successPanel = $('#panel-charge-success');
-			
-			//load data into the success panel
-			var data = j['data'];
-			successPanel.find('.customer-name').text(data['customer_name']);
-			successPanel.find('.cardholder').text(data['cardholder_name']);
-			successPanel.find('.card-last4').text(data['card_last4']);
-			successPanel.find('.card-exp').text(data['card_expiration']);
-			successPanel.find('.amount').text("$" + parseFloat(data['amount']).toFixed(2));
-			successPanel.find('.invoice').text(data['invoice']);
-			successPanel.find('.po').text(data['po']);
+			//bank account was verified and can be charged
+			resetVerifyBankAccountPanel();
+			showPanelMessage('Bank account was verified! It can now be charged.', 'success', msg);
 
-			var href = "/card/receipt/?chg_id=" + data['charge_id'];
-			$('#show-receipt').attr('href', href);
+			setTimeout(function() {
+				msg.html('');
+				submitBtn.prop('disabled', false);
+			}, 500);
+			return;
+		}
+	});
 
-			//set correct panel data
-			if (data['authorized_only'] === true) {
-				successPanel.find('.panel-title').text("Authorization Successful!");
-				successPanel.find('.panel-body .info.info-authorize').show();
-				$('#show-receipt').attr('disabled', true);
-			}
-			else {
-				successPanel.find('.panel-title').text("Charge Successful!");
-				successPanel.find('.panel-body .info.info-authorize').hide();
-				$('#show-receipt').attr('disabled', false);
-			}
+	return false;
+});
 
-			//show success panel
-			var chargeCardPanel = 	$('#panel-charge-card');
-			var allBtns = 			$('.action-btn');
-			allBtns.attr("disabled", true).children("input").attr("disabled", true);
-			chargeCardPanel.fadeOut(200, function() {
-				chargeCardPanel.removeClass("show");
+//CLEAR THE VERIFY BANK ACCOUNT FORM
+//reset inputs to defaults
+function resetVerifyBankAccountPanel() {
+	$('#verify-bank-account .customer-name').val('');
+	$('#verify-bank-account .verify-bank-account-id').html('');
+	$('#verify-amount-1').val('');
+	$('#verify-amount-2').val('');
+	return;
+}
 
-				successPanel.fadeIn(200, function() {
-					successPanel.addClass("show");
-					allBtns.attr("disabled", false).children("input").attr("disabled", false);
-				});
+//CLEAR THE FORM WHEN THE USER CLICKS THE CLEAR BTN
+$('#panel-verify-bank-account').on('click', '.clear-form-btn', function() {
+	resetVerifyBankAccountPanel();
+	$('#verify-bank-account .msg').html('');
+	return;
+});
+
+//*******************************************************************************
+//REMOVE A CARD
+
+//LOAD THE CUSTOMER'S CARDS WHEN A CUSTOMER IS CHOSEN
+//so the user can remove just one card instead of the entire customer
+$('#remove-card').on('change', '.customer-name', function() {
+	var input = 	$('#remove-card .customer-name');
+	var custId = 	getCardIdFromDataList(input);
+	var select = 	$('#remove-card .remove-card-id');
+
+	//reset the list of cards
+	select.find('option').not('[value="0"]').remove();
+
+	//check if no valid customer was selected
+	if (custId === "" || custId === 0) {
+		return;
+	}
+
+	$.ajax({
+		type: 	"GET",
+		url: 	"/card/get/",
+		data: {
+			customerId: custId
+		},
+		success: function (j) {
+			var cards = j['data']['cards'] || [];
+
+			//customers without saved cards only have one card, nothing to choose from
+			cards.forEach(function (card) {
+				if (card['id'] === 0) {
+					return;
+				}
+
+				select.append(cardOption(card));
 			});
 
-			//set the "charge" nav button to "unselected"
-			allBtns.removeClass('active');
+			return;
+		}
+	});
+
+	return;
+});
+
+//REMOVE A CARD OR CUSTOMER
+$('#remove-card').submit(function (e) {
+	//get value of autocomplete list
+	var input = 	$('#remove-card .customer-name');
+	var custName = 	input.val();
+	var custId = 	getCardIdFromDataList(input);
+	var cardSelect = 	$('#remove-card .remove-card-id');
+	var cardId = 	cardSelect.val();
+
+	//btn and alerts
+	var btn = 		$('#remove-card .submit-form-btn');
+	var msg = 		$('#remove-card .msg');
+
+	//quick validation
+	if (custId === 0 || custId === "0" || custId.length === 0) {
+		e.preventDefault();
+		showPanelMessage("You must choose a customer.", "danger", msg);
+		return
+	}
+
+	//remove card
+	$.ajax({
+		type: 	"POST",
+		url: 	"/card/remove/",
+		data: {
+			customerId: 	custId,
+			customerName: 	custName,
+			cardId: 		cardId
+		},
+		beforeSend: function() {
+			//disable the submit btn and show a message
+			btn.prop('disabled', true);
+			showPanelMessage('Removing card...', 'info', msg);
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			if (j['ok'] === false) {
+				btn.prop('disabled', false);
+
+				//the customer's only card can't be removed by itself
+				if (j['data']['error_type'] === "card: cannot remove the only card of a customer") {
+					showPanelMessage(j['data']['error_msg'], 'danger', msg);
+					return;
+				}
+
+				showPanelMessage('An error occured while removing this card. Do not refresh or leave this screen! Please contact an administrator.', 'danger', msg);
+			}
+
+			return;
+		},
+		success: function (j) {
+			//card was removed
+			//show success message
+			btn.prop('disabled', false);
+			showPanelMessage('Card was removed!', 'success', msg);
+
+			//clear the chosen option
+			input.val('');
+			cardSelect.find('option').not('[value="0"]').remove();
+			setTimeout(function() {
+				msg.html('');
+
+				//reload list of cards
+				//this was creating problems (list was not up to date) when it was updating right away on success
+				getCards();
+			}, 500);
+
+			return;
+		}
+	});
+
+	e.preventDefault();
+	return false;
+});
+
+//*******************************************************************************
+//CHARGE A CARD
+
+//LOAD DATA INTO THE PANEL WHEN A CUSTOMER IS CHOSEN
+//typed in or selected from the drop down menu
+$('#charge-card').on('change', '.customer-name', function() {
+	//get value of autocomplete list
+	var input = 	$('#charge-card .customer-name');
+	var custId = 	getCardIdFromDataList(input);
+	var msg = 		$('#charge-card .msg');
+
+	//clear existing wanrings
+	msg.html('');
+	
+	//check if no valid customer was selected
+	if (custId === "" || custId === 0) {
+		showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.", "danger", msg);
+		return;
+	}
+
+	//get customer card data to fill into panel
+	$.ajax({
+		type: 	"GET",
+		url: 	"/card/get/",
+		data: {
+			customerId: custId
+		},
+		beforeSend: function() {
+			//show loading in readonly inputs
+			$('#charge-card .customer-cardholder, #charge-card .card-last-four, #charge-card .card-expiration').val("Loading...");
+			$('#charge-card .charge-card-id').html('');
+			return;
+		},
+		error: function(r) {
+			var  j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], "danger", msg);
+			return;
+		},
+		success: function (j) {
+			//put data into readonly form inputs
+			//so a user can verify card information and see some basic data before charging card
+			var data = j['data'];
+			$('#charge-card .customer-cardholder').val(data['cardholder_name']);
+			$('#charge-card .card-last-four').val(data['card_last4']);
+			$('#charge-card .card-expiration').val(data['card_expiration']);
+
+			//list the customer's cards, the default card is first and chosen
+			var select = $('#charge-card .charge-card-id');
+			var cards = data['cards'] || [];
+			cards.forEach(function (card) {
+				select.append(cardOption(card));
+			});
+			select.trigger('change');
+
+			//charge in the customer's currency, or the default currency if the customer doesn't have one
+			var currencyInput = $('#charge-card .charge-currency');
+			currencyInput.val(data['currency'] || currencyInput.data('default'));
+
+			//the receipt is emailed to the customer's billing email if no addresses are entered
+			$('#charge-card .charge-email-receipt').attr('placeholder', data['billing_email'] || 'ap@example.com, buyer@example.com');
+
+			//enable amount, currency, invoice, po, email receipt inputs
+			$('#charge-card .charge-amount, #charge-card .charge-currency, #charge-card .charge-invoice, #charge-card .charge-po, #charge-card .charge-email-receipt').prop('disabled', false);
+
+			return;
+		}
+	});
+
+	return;
+});
+
+//SHOW THE CHOSEN CARD'S DETAILS
+$('#charge-card').on('change', '.charge-card-id', function() {
+	var option = $(this).find('option:selected');
+	if (option.length === 0) {
+		$('#charge-card-make-default').prop('disabled', true);
+		return;
+	}
+
+	$('#charge-card .customer-cardholder').val(option.data('cardholder'));
+	$('#charge-card .card-last-four').val(option.data('last4'));
+	$('#charge-card .card-expiration').val(option.data('expiration'));
+
+	//a card can only be made the default if it is a saved card and not already the default
+	var isDefault = option.data('default') === true || option.data('default') === "true";
+	$('#charge-card-make-default').prop('disabled', isDefault || option.val() === "0");
+	return;
+});
+
+//MAKE THE CHOSEN CARD THE CUSTOMER'S DEFAULT CARD
+$('#charge-card').on('click', '#charge-card-make-default', function() {
+	var input = 	$('#charge-card .customer-name');
+	var custId = 	getCardIdFromDataList(input);
+	var cardId = 	$('#charge-card .charge-card-id').val();
+	var btn = 		$(this);
+	var msg = 		$('#charge-card .msg');
+
+	$.ajax({
+		type: 	"POST",
+		url: 	"/card/default/",
+		data: {
+			customerId: custId,
+			cardId: 	cardId
+		},
+		beforeSend: function() {
+			btn.prop('disabled', true);
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], 'danger', msg);
+			btn.prop('disabled', false);
+			return;
+		},
+		success: function (j) {
+			//reload the customer's cards so the list shows the new default card
+			$('#charge-card .customer-name').trigger('change');
+			return;
+		}
+	});
+
+	return;
+});
+
+//BUILD AN <option> FOR A CARD
+//used in the charge and remove panels to choose a card
+//bank accounts don't expire, they are shown with the bank's name and if they still need to be verified
+function cardOption(card) {
+	var text = "ending in " + card['card_last4'] + " (" + card['card_expiration'] + ")";
+	if (card['payment_type'] === 'bank_account') {
+		text = "Bank account ending in " + card['card_last4'];
+		if (card['card_brand']) {
+			text += " (" + card['card_brand'] + ")";
+		}
+		if (card['bank_account_status'] !== 'verified') {
+			text += " - not verified";
+		}
+	}
+	else if (card['card_brand']) {
+		text = card['card_brand'] + " " + text;
+	}
+	if (card['is_default']) {
+		text += " - default";
+	}
+
+	var option = $('<option>').val(card['id']).text(text);
+	option.attr('data-cardholder', card['cardholder_name']);
+	option.attr('data-last4', card['card_last4']);
+	option.attr('data-expiration', card['card_expiration']);
+	option.attr('data-default', card['is_default']);
+	option.attr('data-updated-by', card['updated_by']);
+	option.attr('data-updated', card['datetime_updated']);
+	return option;
+}
+
+//CHARGE A CARD
+//validate the amount, invoice, and po inputs
+//create charge via ajax to stripe
+$('#charge-card').submit(function (e) {
+	//gather inputs
+	var customerNameInput = $('#charge-card .customer-name');
+	var customerName = 		customerNameInput.val();
+	var datastoreId = 		getCardIdFromDataList(customerNameInput);
+	var cardId = 			$('#charge-card .charge-card-id').val();
+	var amountElem = 		$('#charge-card .charge-amount');
+	var amount = 			parseFloat(amountElem.val());
+	var currencyElem = 		$('#charge-card .charge-currency');
+	var currency = 			currencyElem.val().trim();
+	var invoiceElem = 		$('#charge-card .charge-invoice');
+	var invoice = 			invoiceElem.val();
+	var poElem = 			$('#charge-card .charge-po');
+	var po = 				poElem.val();
+	var emailReceiptElem = 	$('#charge-card .charge-email-receipt');
+	var emailReceipt = 		(emailReceiptElem.val() || '').trim();
+	var msg = 				$('#charge-card .msg');
+	var btn = 				$('#charge-card-submit');
+	var dropdownBtn = 		btn.siblings('.dropdown-toggle');
+	var chargeAndRemove = 	btn.data("chargeandremove") || false;
+	var authorizeOnly = 	btn.data("authorizeonly") || false;
+
+	//stop form submission
+	e.preventDefault();
+
+	console.log("charging...", amount, MIN_CHARGE)
+
+
+	//validate
+	if (amount < MIN_CHARGE || isNaN(amount)) {
+		e.preventDefault();
+		showPanelMessage("You must provide an amount to charge greater than the minimum charge (" + MIN_CHARGE + ").", "danger", msg);
+		return;
+	}
+	if (validateEmailList(emailReceipt) === false) {
+		showPanelMessage("One of the email addresses to send the receipt to is not valid. Separate addresses with commas.", "danger", msg);
+		return;
+	}
+
+	//unset the charge and remove data attribute
+	//so we don't use this by mistake for the next charge or card
+	btn.data("chargeandremove", "");
+
+	//charge card via ajax
+	$.ajax({
+		type: 	"POST",
+		url: 	"/card/charge/",
+		data: {
+			datastoreId: 		datastoreId,
+			cardId: 			cardId,
+			customerName: 		customerName,
+			amount: 			amount,
+			currency: 			currency,
+			invoice: 			invoice, 
+			po: 				po,
+			emailReceipt: 		emailReceipt,
+			chargeAndRemove: 	chargeAndRemove,
+			authorizeOnly: 		authorizeOnly,
+		},
+		beforeSend: function() {
+			//disabled the inputs
+			customerNameInput.prop('disabled', true);
+			amountElem.prop('disabled', true);
+			currencyElem.prop('disabled', true);
+			invoiceElem.prop('disabled', true);
+			poElem.prop('disabled', true);
+			emailReceiptElem.prop('disabled', true);
+			btn.prop('disabled', true);
+			dropdownBtn.prop('disabled', true);
+
+			//show working message
+			if (authorizeOnly) {
+				showPanelMessage("Authorizing charge...", 'info', msg);
+			}
+			else {
+				showPanelMessage("Charging card...", 'info', msg);
+			}
+			
+			//clear success panel in case it has old data
+			resetChargeSuccessPanel();
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			if (j['ok'] === false) {
+				//the card is fine but the cardholder needs to authenticate the charge
+				if (j['data']['error_type'] === "card: requires_action") {
+					showPanelMessage(j['data']['error_msg'], 'warning', msg);
+					return;
+				}
+
+				showPanelMessage(j['data']['error_msg'], 'danger', msg);
+			}
+			return;
+		},
+		success: function (j) {
+			var successPanel = $('#panel-charge-success');
+			
+			//load data into the success panel
+			var data = j['data'];
+			successPanel.find('.customer-name').text(data['customer_name']);
+			successPanel.find('.cardholder').text(data['cardholder_name']);
+			successPanel.find('.card-last4').text(data['card_last4']);
+			successPanel.find('.card-exp').text(data['card_expiration']);
+			successPanel.find('.amount').text(data['currency_symbol'] + data['amount']);
+			successPanel.find('.invoice').text(data['invoice']);
+			successPanel.find('.po').text(data['po']);
+
+			//show who the receipt was emailed to, or why it wasn't
+			var emailedTo = data['receipt_emailed_to'] || [];
+			if (emailedTo.length > 0) {
+				successPanel.find('.receipt-emailed-to').text(emailedTo.join(', '));
+				successPanel.find('.receipt-emailed').show();
+			}
+			if (data['receipt_email_error']) {
+				showPanelMessage(data['receipt_email_error'], 'warning', successPanel.find('.receipt-email-error'));
+			}
+
+			var href = "/card/receipt/?chg_id=" + data['charge_id'];
+			$('#show-receipt').attr('href', href);
+			$('#show-receipt-pdf').attr('href', "/card/receipt/pdf/?chg_id=" + data['charge_id']);
+
+			//bank account charges are pending until the money arrives from the customer's bank
+			successPanel.find('.panel-body .info.info-pending').toggle(data['pending'] === true);
+
+			//set correct panel data
+			if (data['authorized_only'] === true) {
+				successPanel.find('.panel-title').text("Authorization Successful!");
+				successPanel.find('.panel-body .info.info-authorize').show();
+				$('#show-receipt, #show-receipt-pdf').attr('disabled', true);
+			}
+			else {
+				successPanel.find('.panel-title').text("Charge Successful!");
+				successPanel.find('.panel-body .info.info-authorize').hide();
+				$('#show-receipt, #show-receipt-pdf').attr('disabled', false);
+			}
+
+			//show success panel
+			var chargeCardPanel = 	$('#panel-charge-card');
+			var allBtns = 			$('.action-btn');
+			allBtns.attr("disabled", true).children("input").attr("disabled", true);
+			chargeCardPanel.fadeOut(200, function() {
+				chargeCardPanel.removeClass("show");
+
+				successPanel.fadeIn(200, function() {
+					successPanel.addClass("show");
+					allBtns.attr("disabled", false).children("input").attr("disabled", false);
+				});
+			});
+
+			//set the "charge" nav button to "unselected"
+			allBtns.removeClass('active');
+
+			//clear the charge card panel
+			resetChargeCardPanel(true);
+
+			//if this card was a "charge and remove", refresh the list of cards
+			//reload list of cards
+			//this was creating problems (list was not up to date) when it was updating right away on success
+			if (chargeAndRemove) {
+				setTimeout(function() {
+					getCards();
+				}, 500);
+			}
+
+			return;
+		}
+	});
+
+	return false;
+});
+
+//CHARGE A CARD AND REMOVE IT 
+//in case a customer provides a one time card
+//this just sets a data attribute and forces the submit of the form from an <a> link in the dropdown menu
+$('.dropdown-menu.charge-card-options').on('click', '#charge-and-remove-card', function() {
+	//set data attribute so we know to remove this card
+	$('#charge-card-submit').data("chargeandremove", true);
+
+	//submit the form
+	$('#charge-card').submit();
+	return;
+});
+
+//AUTHORIZE A CHARGE, BUT DON'T CHARGE THE CARD
+//allows us to see if a card can be charged for a given amount and holds the amount as pending for 7 days
+//we can then capture the amount at a later date.
+//used for making sure a card has funds available for us if we know we will be charging it in the near future.
+//this just sets a data attribute and forces the submit of the form from an <a> link in the dropdown menu
+$('.dropdown-menu.charge-card-options').on('click', '#auth-charge-only', function() {
+	//set data attribute so we know to remove this card
+	$('#charge-card-submit').data("authorizeonly", true);
+
+	//submit the form
+	$('#charge-card').submit();
+	return;
+});
+
+//RESET THE CHARGE CARD PANEL TO DEFAULTS
+//in: msgRemove: bool, Should the status message be removed
+function resetChargeCardPanel(msgRemove) {
+	//clear elements
+	$('#charge-card .customer-name').val('').prop('disabled', false);
+	$('#charge-card .customer-cardholder').val('');
+	$('#charge-card .card-last-four').val('');
+	$('#charge-card .card-expiration').val('');
+	$('#charge-card .charge-card-id').html('');
+	$('#charge-card-make-default').prop('disabled', true);
+	$('#charge-card .charge-amount').val('');
+	$('#charge-card .charge-currency').val('');
+	$('#charge-card .charge-invoice').val('');
+	$('#charge-card .charge-po').val('');
+	$('#charge-card .charge-email-receipt').val('').attr('placeholder', 'ap@example.com, buyer@example.com');
+	$('#charge-card-submit').prop('disabled', false);
+	$('#charge-card-submit').siblings('.dropdown-toggle').prop('disabled', false);
+
+	//disable inputs
+	$('#charge-card .charge-amount, #charge-card .charge-currency, #charge-card .charge-invoice, #charge-card .charge-po, #charge-card .charge-email-receipt').prop('disabled', true);
+
+	//remove any modifiers to charging card
+	$('#charge-card-submit').removeData();
+
+	//remove status message if needed
+	if (msgRemove) {
+		$('#charge-card .msg').html('');
+	}
+	return;
+}
+
+//CLEAR THE FORM BTN
+$('#panel-charge-card').on('click', '.clear-form-btn', function() {
+	resetChargeCardPanel(true);
+	return;
+});
+
+//RESET THE CHARGE SUCCESSFUL PANEL
+function resetChargeSuccessPanel() {
+	$('#panel-charge-success .customer-name').text('');
+	$('#panel-charge-success .cardholder').text('');
+	$('#panel-charge-success .card-last4').text('');
+	$('#panel-charge-success .card-exp').text('');
+	$('#panel-charge-success .amount').text('');
+	$('#panel-charge-success .invoice').text('');
+	$('#panel-charge-success .po').text('');
+	$('#panel-charge-success .receipt-emailed-to').text('');
+	$('#panel-charge-success .receipt-emailed').hide();
+	$('#panel-charge-success .receipt-email-error').html('');
+	$('#show-receipt, #show-receipt-pdf').attr('href', '');
+	return;
+}
+
+//*******************************************************************************
+//SCHEDULED CHARGES
+
+//LOAD A CUSTOMER'S CARDS AND SCHEDULED CHARGES WHEN A CUSTOMER IS CHOSEN
+$('#scheduled-charge').on('change', '.customer-name', function() {
+	var input = 	$('#scheduled-charge .customer-name');
+	var custId = 	getCardIdFromDataList(input);
+	var msg = 		$('#scheduled-charge .msg');
+
+	msg.html('');
+	resetScheduledChargeCards();
+	$('#scheduled-charges-list').html('');
+
+	if (custId === "" || custId === 0) {
+		showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.", "danger", msg);
+		return;
+	}
+
+	$.ajax({
+		type: 	"GET",
+		url: 	"/card/get/",
+		data: {
+			customerId: custId
+		},
+		error: function(r) {
+			var j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], "danger", msg);
+			return;
+		},
+		success: function (j) {
+			var data = j['data'];
+			var select = $('#scheduled-charge .scheduled-card-id');
+			var cards = data['cards'] || [];
+			cards.forEach(function (card) {
+				select.append(cardOption(card));
+			});
+
+			var currencyInput = $('#scheduled-charge .scheduled-currency');
+			currencyInput.val(data['currency'] || currencyInput.data('default'));
+			return;
+		}
+	});
+
+	getScheduledCharges(custId);
+	return;
+});
+
+//GET AND SHOW A CUSTOMER'S SCHEDULED CHARGES
+function getScheduledCharges(custId) {
+	var list = $('#scheduled-charges-list');
+
+	$.ajax({
+		type: 	"GET",
+		url: 	"/card/scheduled/",
+		data: {
+			customerId: custId
+		},
+		error: function(r) {
+			var j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], "danger", list);
+			return;
+		},
+		success: function (j) {
+			list.html('');
+
+			var schedules = j['data'] || [];
+			if (schedules.length === 0) {
+				return;
+			}
+
+			list.append('<hr class="hr-panel">');
+			schedules.forEach(function (s) {
+				list.append(scheduledChargeRow(s));
+			});
+			return;
+		}
+	});
+
+	return;
+}
+
+//BUILD THE DISPLAY OF ONE SCHEDULED CHARGE
+//text is set with .text() so invoice and po templates are escaped
+function scheduledChargeRow(s) {
+	var repeat = "Monthly";
+	if (s['interval'] === "weekly") {
+		repeat = "Weekly";
+	}
+	else if (s['interval'] === "custom") {
+		repeat = "Every " + s['interval_days'] + " days";
+	}
+
+	var card = "Default card";
+	if (s['saved_card_id'] !== 0) {
+		card = "Card removed";
+		if (s['card']['card_last4']) {
+			card = "Card ending in " + s['card']['card_last4'];
+		}
+	}
+
+	var status = "Paused";
+	if (s['active']) {
+		status = "Next charge " + s['next_run_date'];
+	}
+	else if (s['next_run_date'] === "") {
+		status = "Ended";
+	}
+
+	var row = $('<div class="scheduled-charge">').attr('data-id', s['id']);
+	var heading = $('<p>');
+	heading.append($('<strong>').text(s['amount'] + " " + s['currency'].toUpperCase() + " - " + repeat));
+	heading.append($('<br>'));
+	heading.append(document.createTextNode(card + ", from " + s['start_date'] + (s['end_date'] ? " to " + s['end_date'] : "") + ". " + status + "."));
+	if (s['invoice_template'] || s['po_template']) {
+		heading.append($('<br>'));
+		heading.append(document.createTextNode("Invoice: " + (s['invoice_template'] || "-") + ", PO: " + (s['po_template'] || "-")));
+	}
+	row.append(heading);
+
+	var buttons = $('<div class="btn-group btn-group-sm">');
+	if (s['active']) {
+		buttons.append('<button class="btn btn-default pause-scheduled-charge" type="button">Pause</button>');
+	}
+	else if (s['next_run_date'] !== "" || s['end_date'] === "") {
+		buttons.append('<button class="btn btn-default resume-scheduled-charge" type="button">Resume</button>');
+	}
+	buttons.append('<button class="btn btn-danger remove-scheduled-charge" type="button">Remove</button>');
+	row.append(buttons);
+
+	var runs = s['runs'] || [];
+	if (runs.length > 0) {
+		var table = $('<table class="table table-condensed">');
+		table.append('<thead><tr><th>Date</th><th>Status</th><th>Invoice</th><th>Details</th></tr></thead>');
+		var tbody = $('<tbody>');
+		runs.forEach(function (run) {
+			var tr = $('<tr>');
+			tr.append($('<td>').text(run['run_date']));
+			tr.append($('<td>').text(run['status']));
+			tr.append($('<td>').text(run['invoice']));
+			tr.append($('<td>').text(run['status'] === "failed" ? run['error'] : run['charge_id']));
+			tbody.append(tr);
+		});
+		table.append(tbody);
+		row.append(table);
+	}
+
+	row.append('<hr class="hr-panel">');
+	return row;
+}
+
+//SHOW THE DAYS INPUT ONLY FOR A CUSTOM INTERVAL
+$('#scheduled-charge').on('change', '.scheduled-interval', function() {
+	var group = $('#scheduled-charge .scheduled-interval-days-group');
+	if ($(this).val() === "custom") {
+		group.show();
+	}
+	else {
+		group.hide();
+	}
+
+	return;
+});
+
+//ADD A SCHEDULED CHARGE
+$('#scheduled-charge').submit(function (e) {
+	e.preventDefault();
+
+	var input = 	$('#scheduled-charge .customer-name');
+	var custId = 	getCardIdFromDataList(input);
+	var msg = 		$('#scheduled-charge .msg');
+	var btn = 		$('#panel-scheduled-charges .submit-form-btn');
+
+	if (custId === "" || custId === 0) {
+		showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.", "danger", msg);
+		return;
+	}
+
+	$.ajax({
+		type: 	"POST",
+		url: 	"/card/scheduled/add/",
+		data: {
+			customerId: 	custId,
+			cardId: 		$('#scheduled-charge .scheduled-card-id').val(),
+			amount: 		$('#scheduled-charge .scheduled-amount').val(),
+			currency: 		$('#scheduled-charge .scheduled-currency').val(),
+			interval: 		$('#scheduled-charge .scheduled-interval').val(),
+			intervalDays: 	$('#scheduled-charge .scheduled-interval-days').val(),
+			startDate: 		$('#scheduled-charge .scheduled-start-date').val(),
+			endDate: 		$('#scheduled-charge .scheduled-end-date').val(),
+			invoice: 		$('#scheduled-charge .scheduled-invoice').val(),
+			po: 			$('#scheduled-charge .scheduled-po').val()
+		},
+		beforeSend: function() {
+			btn.prop('disabled', true);
+			msg.html('');
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], "danger", msg);
+			btn.prop('disabled', false);
+			return;
+		},
+		success: function (j) {
+			showPanelMessage("The charge was scheduled.  The first charge will be made on " + j['data']['next_run_date'] + ".", "success", msg);
+			btn.prop('disabled', false);
+			getScheduledCharges(custId);
+			return;
+		}
+	});
+
+	return;
+});
+
+//PAUSE, RESUME, OR REMOVE A SCHEDULED CHARGE
+$('#scheduled-charges-list').on('click', '.pause-scheduled-charge, .resume-scheduled-charge, .remove-scheduled-charge', function() {
+	var btn = 		$(this);
+	var id = 		btn.closest('.scheduled-charge').data('id');
+	var custId = 	getCardIdFromDataList($('#scheduled-charge .customer-name'));
+	var msg = 		$('#scheduled-charge .msg');
+
+	var url = "/card/scheduled/pause/";
+	if (btn.hasClass('resume-scheduled-charge')) {
+		url = "/card/scheduled/resume/";
+	}
+	else if (btn.hasClass('remove-scheduled-charge')) {
+		if (!confirm("Remove this scheduled charge?  No more charges will be made.")) {
+			return;
+		}
+		url = "/card/scheduled/remove/";
+	}
+
+	$.ajax({
+		type: 	"POST",
+		url: 	url,
+		data: {
+			id: id
+		},
+		beforeSend: function() {
+			btn.prop('disabled', true);
+			msg.html('');
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], "danger", msg);
+			btn.prop('disabled', false);
+			return;
+		},
+		success: function (j) {
+			getScheduledCharges(custId);
+			return;
+		}
+	});
+
+	return;
+});
+
+//RESET THE CARD LIST
+//the default card option is always kept
+function resetScheduledChargeCards() {
+	$('#scheduled-charge .scheduled-card-id option').not('[value="0"]').remove();
+	return;
+}
+
+//RESET THE SCHEDULED CHARGES PANEL
+function resetScheduledChargePanel() {
+	resetScheduledChargeCards();
+	$('#scheduled-charge .customer-name, #scheduled-charge .scheduled-amount, #scheduled-charge .scheduled-currency, #scheduled-charge .scheduled-interval-days, #scheduled-charge .scheduled-start-date, #scheduled-charge .scheduled-end-date, #scheduled-charge .scheduled-invoice, #scheduled-charge .scheduled-po').val('');
+	$('#scheduled-charge .scheduled-interval').val('monthly').trigger('change');
+	$('#scheduled-charge .msg').html('');
+	$('#scheduled-charges-list').html('');
+	return;
+}
+
+//CLEAR THE FORM BTN
+$('#panel-scheduled-charges').on('click', '.clear-form-btn', function() {
+	resetScheduledChargePanel();
+	return;
+});
+
+//*******************************************************************************
+//BATCH CHARGE
+
+//PREVIEW A CSV FILE OF CHARGES
+//nothing is charged, the rows and totals are shown so the user can check them before charging
+//a file that was already charged shows its progress instead
+$('#batch-charge').submit(function (e) {
+	e.preventDefault();
+
+	var msg = 		$('#batch-charge .msg');
+	var chargeBtn = $('#panel-batch-charge .batch-charge-submit');
+
+	$.ajax({
+		type: 			"POST",
+		url: 			"/card/batch/preview/",
+		data: 			new FormData(this),
+		processData: 	false,
+		contentType: 	false,
+		beforeSend: function() {
+			showPanelMessage("Checking file...", "info", msg);
+			chargeBtn.prop('disabled', true).removeData('batch-id');
+			stopBatchProgress();
+			$('#panel-batch-charge .batch-download-results').hide();
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], "danger", msg);
+			showBatchRows(null);
+			return;
+		},
+		success: function (j) {
+			var b = j['data'];
+			if (b['started']) {
+				showBatchProgress(b);
+				return;
+			}
 
-			//clear the charge card panel
-			resetChargeCardPanel(true);
+			showBatchRows(b);
 
-			//if this card was a "charge and remove", refresh the list of cards
-			//reload list of cards
-			//this was creating problems (list was not up to date) when it was updating right away on success
-			if (chargeAndRemove) {
-				setTimeout(function() {
-					getCards();
-				}, 500);
+			if (b['num_valid'] === 0) {
+				showPanelMessage("None of the rows can be charged. Please fix the file and preview it again.", "danger", msg);
+				return;
 			}
 
+			var text = b['num_valid'] + " row(s) are ready to charge.";
+			if (b['num_invalid'] > 0) {
+				text += "  " + b['num_invalid'] + " row(s) have errors and will be skipped.";
+			}
+			showPanelMessage(text, b['num_invalid'] > 0 ? "warning" : "success", msg);
+			chargeBtn.text("Charge " + b['num_valid'] + " Card(s)").data('batch-id', b['id']).prop('disabled', false);
 			return;
 		}
 	});
 
-	return false;
+	return;
 });
 
-//CHARGE A CARD AND REMOVE IT 
-//in case a customer provides a one time card
-//this just sets a data attribute and forces the submit of the form from an <a> link in the dropdown menu
-$('.dropdown-menu.charge-card-options').on('click', '#charge-and-remove-card', function() {
-	//set data attribute so we know to remove this card
-	$('#charge-card-submit').data("chargeandremove", true);
-
-	//submit the form
-	$('#charge-card').submit();
+//A NEW FILE MUST BE PREVIEWED BEFORE IT IS CHARGED
+$('#batch-charge').on('change', '.batch-file', function() {
+	stopBatchProgress();
+	$('#batch-charge .msg').html('');
+	$('#panel-batch-charge .batch-charge-submit').text("Charge").prop('disabled', true).removeData('batch-id');
+	$('#panel-batch-charge .batch-download-results').hide();
+	showBatchRows(null);
 	return;
 });
 
-//AUTHORIZE A CHARGE, BUT DON'T CHARGE THE CARD
-//allows us to see if a card can be charged for a given amount and holds the amount as pending for 7 days
-//we can then capture the amount at a later date.
-//used for making sure a card has funds available for us if we know we will be charging it in the near future.
-//this just sets a data attribute and forces the submit of the form from an <a> link in the dropdown menu
-$('.dropdown-menu.charge-card-options').on('click', '#auth-charge-only', function() {
-	//set data attribute so we know to remove this card
-	$('#charge-card-submit').data("authorizeonly", true);
+//CHARGE THE PREVIEWED FILE
+//the same file is uploaded again with the id from the preview so the server can make sure it didn't change
+//the cards are charged in the background, the progress is checked until every row is done
+$('#panel-batch-charge').on('click', '.batch-charge-submit', function() {
+	var btn = 		$(this);
+	var msg = 		$('#batch-charge .msg');
+	var batchId = 	btn.data('batch-id');
+
+	if (!confirm("Charge the cards in this file? This cannot be undone.")) {
+		return;
+	}
+
+	var data = new FormData($('#batch-charge')[0]);
+	data.append('batchId', batchId);
+
+	$.ajax({
+		type: 			"POST",
+		url: 			"/card/batch/charge/",
+		data: 			data,
+		processData: 	false,
+		contentType: 	false,
+		beforeSend: function() {
+			showPanelMessage("Starting to charge cards...", "info", msg);
+			btn.prop('disabled', true);
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			showPanelMessage(j['data']['error_msg'], "danger", msg);
+			btn.prop('disabled', false);
+			return;
+		},
+		success: function (j) {
+			btn.text("Charge").removeData('batch-id');
+			showBatchProgress(j['data']);
+			return;
+		}
+	});
 
-	//submit the form
-	$('#charge-card').submit();
 	return;
 });
 
-//RESET THE CHARGE CARD PANEL TO DEFAULTS
-//in: msgRemove: bool, Should the status message be removed
-function resetChargeCardPanel(msgRemove) {
-	//clear elements
-	$('#charge-card .customer-name').val('').prop('disabled', false);
-	$('#charge-card .customer-cardholder').val('');
-	$('#charge-card .card-last-four').val('');
-	$('#charge-card .card-expiration').val('');
-	$('#charge-card .charge-amount').val('');
-	$('#charge-card .charge-invoice').val('');
-	$('#charge-card .charge-po').val('');
-	$('#charge-card-submit').prop('disabled', false);
-	$('#charge-card-submit').siblings('.dropdown-toggle').prop('disabled', false);
+//SHOW THE PROGRESS OF CHARGING A BATCH
+//the progress is checked again every few seconds until every row was charged or failed
+var batchProgressTimer = null;
+function showBatchProgress(b) {
+	var msg = $('#batch-charge .msg');
 
-	//disable inputs
-	$('#charge-card .charge-amount, #charge-card .charge-invoice, #charge-card .charge-po').prop('disabled', true);
+	showBatchRows(b);
+	$('#panel-batch-charge .batch-download-results').data('batch-id', b['id']).show();
 
-	//remove any modifiers to charging card
-	$('#charge-card-submit').removeData();
+	var text = b['num_charged'] + " card(s) were charged.";
+	if (b['num_failed'] > 0) {
+		text += "  " + b['num_failed'] + " charge(s) failed.";
+	}
 
-	//remove status message if needed
-	if (msgRemove) {
-		$('#charge-card .msg').html('');
+	if (b['done']) {
+		showPanelMessage("This file was charged by " + b['username'] + ".  " + text, b['num_failed'] > 0 ? "warning" : "success", msg);
+		return;
 	}
+
+	showPanelMessage("Charging cards, " + b['num_pending'] + " of " + b['num_valid'] + " left.  " + text + "  The cards are charged in the background so you can leave this page, preview the same file again to see the progress.", "info", msg);
+
+	stopBatchProgress();
+	batchProgressTimer = setTimeout(function() {
+		$.ajax({
+			type: 	"GET",
+			url: 	"/card/batch/status/",
+			data: 	{batchId: b['id']},
+			error: function (r) {
+				var j = JSON.parse(r['responseText']);
+				showPanelMessage(j['data']['error_msg'], "danger", msg);
+				return;
+			},
+			success: function (j) {
+				if (batchProgressTimer !== null) {
+					showBatchProgress(j['data']);
+				}
+				return;
+			}
+		});
+		return;
+	}, 3000);
+
 	return;
 }
 
-//CLEAR THE FORM BTN
-$('#panel-charge-card').on('click', '.clear-form-btn', function() {
-	resetChargeCardPanel(true);
+//STOP CHECKING THE PROGRESS OF A BATCH
+function stopBatchProgress() {
+	clearTimeout(batchProgressTimer);
+	batchProgressTimer = null;
 	return;
-});
+}
 
-//RESET THE CHARGE SUCCESSFUL PANEL
-function resetChargeSuccessPanel() {
-	$('#panel-charge-success .customer-name').text('');
-	$('#panel-charge-success .cardholder').text('');
-	$('#panel-charge-success .card-last4').text('');
-	$('#panel-charge-success .card-exp').text('');
-	$('#panel-charge-success .amount').text('');
-	$('#panel-charge-success .invoice').text('');
-	$('#panel-charge-success .po').text('');
-	$('#show-receipt').attr('href', '');
+//SHOW THE ROWS AND TOTALS OF A BATCH
+//text is set with .text() since the values come from the uploaded file
+function showBatchRows(b) {
+	var table = 	$('#batch-charge-rows');
+	var tbody = 	table.find('tbody');
+	var totals = 	$('#batch-charge-totals');
+
+	tbody.html('');
+	totals.html('');
+	if (b === null) {
+		table.hide();
+		return;
+	}
+
+	b['rows'].forEach(function (row) {
+		var tr = $('<tr>');
+		tr.append($('<td>').text(row['row']));
+		tr.append($('<td>').text(row['customer_name'] || row['customer_id']));
+		tr.append($('<td>').text(row['card_last4']));
+		tr.append($('<td class="charge-amount-column">').text(row['amount'] ? row['amount'] + " " + row['currency'].toUpperCase() : ""));
+		tr.append($('<td>').text(row['invoice']));
+		tr.append($('<td>').text(row['po']));
+		tr.append($('<td>').text(row['status']));
+		var details = row['charge_id'] || row['error'];
+		if (row['email_error']) {
+			details += " (Receipt not emailed: " + row['email_error'] + ")";
+		}
+		tr.append($('<td>').text(details));
+		if (row['status'] === "invalid" || row['status'] === "failed") {
+			tr.addClass('danger');
+		}
+		tbody.append(tr);
+	});
+
+	(b['totals'] || []).forEach(function (t) {
+		totals.append($('<p>').append($('<strong>').text("Total " + t['currency'].toUpperCase() + ": " + t['amount'] + " (" + t['count'] + " charges)")));
+	});
+
+	table.show();
 	return;
 }
 
+//DOWNLOAD THE RESULTS OF A BATCH
+//the results file is built by the server from the saved rows
+$('#panel-batch-charge').on('click', '.batch-download-results', function() {
+	window.location.href = "/card/batch/results/?batchId=" + encodeURIComponent($(this).data('batch-id'));
+	return;
+});
+
+//CLEAR THE FORM BTN
+$('#panel-batch-charge').on('click', '.clear-form-btn', function() {
+	stopBatchProgress();
+	$('#batch-charge .batch-file').val('');
+	$('#batch-charge .msg').html('');
+	$('#panel-batch-charge .batch-charge-submit').text("Charge").prop('disabled', true).removeData('batch-id');
+	$('#panel-batch-charge .batch-download-results').hide();
+	showBatchRows(null);
+	return;
+});
+
 //*******************************************************************************
 //SHOW REPORTS
 
@@ -1295,8 +2480,9 @@ $('#reports').submit(function (e) {
 //when the modal launches
 $('#report-rows').on('click', '.refund', function() {
 	//get amount of charge
+	//the amount is already formatted with the number of decimal places the charge's currency uses
 	var refundBtn = 	$(this);
-	var amountDollars = parseFloat(refundBtn.parent().siblings('td.amount-dollars').children('.amount').text().replace(",","")).toFixed(2);
+	var amountDollars = refundBtn.parent().siblings('td.amount-dollars').children('.amount').first().text().replace(/,/g, "");
 
 	//get charge id
 	var chargeId = 		refundBtn.data("chgid");
@@ -1317,6 +2503,7 @@ $('#form-refund').submit(function (e) {
 	var chargeId = 	$('#refund-chg-id').val();
 	var amount = 	$('#refund-amount').val();
 	var reason = 	$('#refund-reason').val();
+	var emailReceipt = ($('#refund-email-receipt').val() || '').trim();
 	var msg = 		$('#form-refund .msg');
 	var btn = 		$('#refund-submit');
 
@@ -1334,6 +2521,11 @@ $('#form-refund').submit(function (e) {
 		showModalMessage("You must provide an amount to refund that is greater than zero but less than the amount charged.", "danger", msg);
 		return;
 	}
+	if (validateEmailList(emailReceipt) === false) {
+		e.preventDefault();
+		showModalMessage("One of the email addresses to send the receipt to is not valid. Separate addresses with commas.", "danger", msg);
+		return;
+	}
 
 	//stop form submission
 	e.preventDefault();
@@ -1345,7 +2537,8 @@ $('#form-refund').submit(function (e) {
 		data: {
 			chargeId: 	chargeId,
 			amount: 	amount,
-			reason: 	reason
+			reason: 	reason,
+			emailReceipt: emailReceipt
 		},
 		beforeSend: function () {
 			//show working message
@@ -1362,12 +2555,24 @@ $('#form-refund').submit(function (e) {
 			return;
 		},
 		success: function (j) {
-			showModalMessage("Refund successful!", "success", msg);
+			//show who the receipt was emailed to, or why it wasn't
+			var data = j['data'] || {};
+			var emailedTo = data['receipt_emailed_to'] || [];
+			if (data['receipt_email_error']) {
+				showModalMessage("Refund successful! " + data['receipt_email_error'], "warning", msg);
+			}
+			else if (emailedTo.length > 0) {
+				showModalMessage("Refund successful! The receipt was emailed to " + emailedTo.join(', ') + ".", "success", msg);
+			}
+			else {
+				showModalMessage("Refund successful!", "success", msg);
+			}
 			btn.prop('disabled', false);
 
 			//clear inputs and/or disable inputs
 			$('#refund-amount').val("");
 			$('#refund-reason').val("0");
+			$('#refund-email-receipt').val("");
 
 			setTimeout(function() {
 				msg.html('');
@@ -1379,49 +2584,176 @@ $('#form-refund').submit(function (e) {
 	return false;
 });
 
-//AUTOFILL THE CHARGE MODAL
-$('#report-rows').on('click', '.link-to-capture', function() {
+//AUTOFILL THE CAPTURE MODAL
+//the amount authorized is the most that can be captured
+//used on the report and open authorizations pages
+$('body').on('click', '.link-to-capture', function() {
 	//get charge id and save into modal
 	var chargeID = $(this).parents('tr').data("charge-id");
+	var amount = $(this).data('amount');
 	$('#capture-charge-id').val(chargeID);
+	$('#capture-amount').val(amount).attr('max', amount);
+	$('#release-reason').val('abandoned');
+	$('#release-notes').val('');
+	$('#modal-capture .msg').html('');
+	$('#capture-submit, #release-submit').prop('disabled', false);
 	return;
 });
 
 //CAPTURE A PENDING CHARGE
-$('#modal-capture').on('show.bs.modal', function() {
-	//get charge id to charge
-	var chargeID = $('#capture-charge-id').val();
+//the amount authorized, or less, is captured
+$('#form-capture').submit(function (e) {
+	e.preventDefault();
 
 	var msg = $('#modal-capture .msg');
+	var btns = $('#capture-submit, #release-submit');
 
 	//make ajax request to charge the card
 	$.ajax({
 		type: 	"POST",
 		url: 	"/card/capture/",
 		data: {
-			chargeID: 	chargeID,
+			chargeID: 	$('#capture-charge-id').val(),
+			amount: 	$('#capture-amount').val()
 		},
 		beforeSend: function () {
 			//show working message
 			showModalMessage("Capturing...", "info", msg);
+			btns.prop('disabled', true);
 			return;
 		},
 		error: function (r) {
 			var j = JSON.parse(r['responseText']);
 			if (j['ok'] === false) {
 				showModalMessage(j['data']['error_msg'], 'danger', msg);
+				btns.prop('disabled', false);
 			}
 			return;
 		},
 		success: function (j) {
 			showModalMessage("Capture successful!", "success", msg);
+
+			//reload to show the captured charge
+			setTimeout(function() {
+				window.location.reload();
+			}, 1500);
+			return;
+		}
+	});
+
+	return false;
+});
+
+//RELEASE A PENDING CHARGE
+//the hold on the customer's funds is removed and the charge can't be captured anymore
+$('#form-release').submit(function (e) {
+	e.preventDefault();
+
+	var msg = $('#modal-capture .msg');
+	var btns = $('#capture-submit, #release-submit');
+
+	if (!confirm("Release this authorization? It cannot be captured once it is released.")) {
+		return false;
+	}
+
+	$.ajax({
+		type: 	"POST",
+		url: 	"/card/release/",
+		data: {
+			chargeID: 	$('#capture-charge-id').val(),
+			reason: 	$('#release-reason').val(),
+			notes: 		$('#release-notes').val()
+		},
+		beforeSend: function () {
+			showModalMessage("Releasing...", "info", msg);
+			btns.prop('disabled', true);
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			if (j['ok'] === false) {
+				showModalMessage(j['data']['error_msg'], 'danger', msg);
+				btns.prop('disabled', false);
+			}
+			return;
+		},
+		success: function (j) {
+			showModalMessage("Authorization released!", "success", msg);
+
+			//reload to show the released charge
+			setTimeout(function() {
+				window.location.reload();
+			}, 1500);
 			return;
 		}
 	});
 
+	return false;
+});
+
+//*******************************************************************************
+//DISPUTES
+
+//REMEMBER WHICH BUTTON SUBMITTED THE EVIDENCE FORM
+//save or submit to stripe
+$('#form-dispute-evidence').on('click', '.dispute-evidence-submit', function() {
+	$('#form-dispute-evidence').data('submit', $(this).data('submit'));
 	return;
 });
 
+//SAVE OR SUBMIT EVIDENCE FOR A DISPUTE
+//files are sent so the form is submitted as multipart form data
+$('#form-dispute-evidence').submit(function (e) {
+	//stop form submission
+	e.preventDefault();
+
+	var form = 		$(this);
+	var submit = 	form.data('submit') === true;
+	var msg = 		$('#form-dispute-evidence .msg');
+	var btns = 		$('#form-dispute-evidence .dispute-evidence-submit');
+
+	//evidence can't be changed once it is submitted, make sure the user is done
+	if (submit && !confirm("Evidence cannot be changed once it is submitted. Submit this evidence to Stripe?")) {
+		return false;
+	}
+
+	var data = new FormData(this);
+	data.append('submit', submit);
+
+	$.ajax({
+		type: 			"POST",
+		url: 			"/card/disputes/evidence/",
+		data: 			data,
+		processData: 	false,
+		contentType: 	false,
+		beforeSend: function () {
+			//show working message
+			showPanelMessage((submit ? "Submitting" : "Saving") + " evidence...", "info", msg);
+			btns.prop('disabled', true);
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			if (j['ok'] === false) {
+				showPanelMessage(j['data']['error_msg'], 'danger', msg);
+				btns.prop('disabled', false);
+			}
+			return;
+		},
+		success: function (j) {
+			showPanelMessage("Evidence " + (submit ? "submitted" : "saved") + "!", "success", msg);
+
+			//reload to show the saved evidence
+			setTimeout(function() {
+				window.location.reload();
+			}, 1500);
+			return;
+		}
+	});
+
+	return false;
+});
+
 //*******************************************************************************
 //GET AND SET COMPANY INFO
 //in modal in settings panel
@@ -1623,6 +2955,7 @@ $('#modal-app-settings').on('show.bs.modal', function() {
 			$('#modal-app-settings .cust-id-format').val(data['cust_id_format']);
 			$('#modal-app-settings .cust-id-regex').val(data['cust_id_regex']);
 			$('#modal-app-settings .report-timezone').val(data['report_timezone']);
+			$('#modal-app-settings .default-currency').val(data['default_currency']);
 
 			if (data['api_key'] === '') {
 				$('#api-key-displayed').val("Not created yet.");
@@ -1662,6 +2995,7 @@ $('#form-change-app-settings').submit( function (e) {
 	var custIDFormat =  $('#modal-app-settings .cust-id-format').val();
 	var custIDRegex = 	$('#modal-app-settings .cust-id-regex').val();
 	var guiTimezone = 	$('#modal-app-settings .report-timezone').val();
+	var defaultCurrency = $('#modal-app-settings .default-currency').val();
 	var msg = 		 	$('#modal-app-settings .msg');
 	var btn = 		 	$('#app-settings-submit');
 
@@ -1674,6 +3008,7 @@ $('#form-change-app-settings').submit( function (e) {
 			custIDFormat: custIDFormat,
 			custIDRegex: custIDRegex,
 			guiTimezone: guiTimezone,
+			defaultCurrency: defaultCurrency,
 		},
 		beforeSend: function() {
 			showModalMessage("Saving app settings...", "info", msg);
@@ -1741,4 +3076,89 @@ $('#form-change-app-settings').on('click', '#generate-api-key', function() {
 	});
 
 	return;
-});
\ No newline at end of file
+});
+//DATABASE BACKUPS
+//get the list of backups and show them in the modal
+function getBackups() {
+	var msg = 	$('#modal-backups .msg');
+	var list = 	$('#backups-list');
+
+	$.ajax({
+		type: 	"GET",
+		url: 	"/app-settings/backup/list/",
+		beforeSend: function() {
+			showModalMessage("Loading backups...", "info", msg);
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			if (j['ok'] === false) {
+				showModalMessage("An error occured and the list of backups could not be loaded.  Please try again.", "danger", msg);
+				return;
+			}
+		},
+		success: function (j) {
+			var data = j['data'];
+			list.html('');
+
+			if (data.length === 0) {
+				list.append('<tr><td colspan="3">No backups have been made yet.</td></tr>');
+			}
+
+			for (var i = 0; i < data.length; i++) {
+				var b = data[i];
+				var sizeKB = (b['size'] / 1024).toFixed(1) + " KB";
+				var link = '<a href="/app-settings/backup/download/?name=' + encodeURIComponent(b['name']) + '">Download</a>';
+				list.append('<tr><td>' + b['datetime'] + '</td><td>' + sizeKB + '</td><td>' + link + '</td></tr>');
+			}
+
+			msg.html('');
+			return;
+		}
+	});
+
+	return;
+}
+
+$('#modal-backups').on('show.bs.modal', function() {
+	getBackups();
+	return;
+});
+
+//RESET MODAL TO DEFAULTS ON CLOSE
+$('#modal-backups').on('hidden.bs.modal', function() {
+	$('#modal-backups .msg').html('');
+	$('#backups-list').html('');
+	return;
+});
+
+//MAKE A BACKUP NOW
+$('#backup-now').click(function() {
+	var msg = $('#modal-backups .msg');
+	var btn = $(this);
+
+	$.ajax({
+		type: 	"POST",
+		url: 	"/app-settings/backup/",
+		beforeSend: function() {
+			showModalMessage("Backing up the database...", "info", msg);
+			btn.prop('disabled', true);
+			return;
+		},
+		error: function (r) {
+			var j = JSON.parse(r['responseText']);
+			if (j['ok'] === false) {
+				showModalMessage("An error occured and a backup could not be made.  Please try again.", "danger", msg);
+				btn.prop('disabled', false);
+				return;
+			}
+		},
+		success: function (j) {
+			btn.prop('disabled', false);
+			getBackups();
+			return;
+		}
+	});
+
+	return;
+});
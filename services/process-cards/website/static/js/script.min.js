@@ -1 +1 @@
-const MIN_PASSWORD_LENGTH=8,BAD_PASSWORDS=["password","password1","12345678","123456789","123123123","00000000","1234567890","asdfasdf","asdfghjkl","testtest","admin@example.com"],MIN_CHARGE=0.5,MAX_STATEMENT_DESCRIPTOR_LENGTH=22;function validateEmail(a){var b=/^(([^<>()[\]\\.,;:\s@\"]+(\.[^<>()[\]\\.,;:\s@\"]+)*)|(\".+\"))@((\[[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\])|(([a-zA-Z\-0-9]+\.)+[a-zA-Z]{2,}))$/;return b.test(a)}function doWordsMatch(a,b){return!(a!==b)}function isLongPassword(a){return!(a.length<MIN_PASSWORD_LENGTH)}function isSimplePassword(a){return-1!==BAD_PASSWORDS.indexOf(a)}function showPanelMessage(a,b,c){c.html("<div class=\"alert alert-"+b+"\">"+a+"</div>")}function showModalMessage(a,b,c){c.html("<div class=\"alert alert-"+b+"\">"+a+"</div>")}$("body").on("click",".action-btn",function(){const a="fast";var b=$(this).data("action"),c=$("#"+b);if(!c.hasClass("show")){var f=$(".action-panels.show");f.fadeOut(a,function(){return f.removeClass("show"),void c.fadeIn(a,function(){c.addClass("show")})}),resetAddCardPanel(),resetChargeCardPanel(!0)}}),$("#create-init-admin").submit(function(a){var b=$("#password1").val(),c=$("#password2").val(),f=$("#create-init-admin .msg");return!1===doWordsMatch(b,c)?(a.preventDefault(),showPanelMessage("The passwords do not match.","danger",f),!1):!1===isLongPassword(b)?(a.preventDefault(),showPanelMessage("Your password is too short. It must be at least "+MIN_PASSWORD_LENGTH+" characters.","danger",f),!1):!0===isSimplePassword(b)?(a.preventDefault(),showPanelMessage("The password you provided is too simple. Please choose a better password.","danger",f),!1):void 0}),$(function(){return $("[data-toggle=\"tooltip\"]").tooltip(),void $.ajaxSetup({dataType:"json"})});function getCards(){var a=$("#customer-list");$.ajax({type:"GET",url:"/card/get/all/",beforeSend:function(){return console.log("Loading cards..."),void a.html("<option value=\"Loading...\">")},error:function(){a.html("<option value=\"Could Not Load\">")},success:function(b){console.log("Loading cards...done!");var c=b.data;return(a.html(""),null===c||0===c.length)?void a.html("<option value=\"None exist yet!\" data-id=\"0\">"):void c.forEach(function(f){var h=f.customer_name,k=f.id;a.append("<option value=\""+h+"\" data-id=\""+k+"\">")})}})}function getCardIdFromDataList(a){var b=a.val(),c=$("#customer-list option"),f="";return c.each(function(){var g=$(this).val(),h=$(this).data("id");if(b===g)return f=h,!1}),f}function generateExpirationYears(){console.log("Loading expiration years...");var a=$("#card-exp-year");a.html("");var b=new Date,c=b.getFullYear();a.append("<option value=\"0\">Please choose.</option>");for(var f=c;f<c+11;f++)a.append("<option value="+f+">"+f+"</option>");console.log("Loading expiration years...done!")}function getUsers(){var a=$(".user-list");$.ajax({type:"GET",url:"/users/get/all/",beforeSend:function(){a.html("<option value=\"0\">Loading...</option>").attr("disabled",!0)},error:function(){a.html("<option value=\"0\">Error (please see dev tools)</option>")},success:function(b){a.html(""),a.append("<option value='0'>Please choose...</option>").attr("disabled",!1);var c=b.data;c.forEach(function(f){"administrator"!==f.username&&a.append("<option value=\""+f.id+"\">"+f.username+"</option>")})}})}$("#form-new-user").submit(function(a){var b=$("#form-new-user .username").val(),c=$("#form-new-user .password1").val(),f=$("#form-new-user .password2").val(),g=$("#form-new-user .can-add-cards input:checked").val(),h=$("#form-new-user .can-remove-cards input:checked").val(),k=$("#form-new-user .can-charge-cards input:checked").val(),l=$("#form-new-user .can-view-reports input:checked").val(),m=$("#form-new-user .is-admin input:checked").val(),n=$("#form-new-user .is-active input:checked").val(),o=$("#form-new-user .msg"),p=$("#form-new-user-submit");return!1===validateEmail(b)?(a.preventDefault(),showModalMessage("You must provide an email address as a username.","danger",o),!1):!1===doWordsMatch(c,f)?(a.preventDefault(),showModalMessage("The passwords do not match.","danger",o),!1):!1===isLongPassword(c)?(a.preventDefault(),showModalMessage("Your password is too short. It must be at least "+MIN_PASSWORD_LENGTH+" characters.","danger",o),!1):!0===isSimplePassword(c)?(a.preventDefault(),showModalMessage("Your password too simple. Choose a more complex password.","danger",o),!1):(o.html(""),a.preventDefault(),$.ajax({type:"POST",url:"/users/add/",data:{username:b,password1:c,password2:f,addCards:g,removeCards:h,chargeCards:k,reports:l,admin:m,active:n},beforeSend:function(){return p.attr("disabled",!0),void showModalMessage("Saving user...","info",o)},error:function(q){var s=JSON.parse(q.responseText);return!1===s.ok?void showModalMessage(s.data.error_msg,"danger",o):void p.attr("disabled",!1)},success:function(){showModalMessage("New user was saved sucessfully!","success",o),setTimeout(function(){p.attr("disabled",!1),resetAddUserModal()},3e3)}}),!1)});function resetAddUserModal(){return $("#form-new-user .username, #form-new-user .password1, #form-new-user .password2").val(""),$("#form-new-user .default").attr("checked",!0).parent("label").addClass("active").siblings("label").removeClass("active"),void $(".msg").html("")}$("#modal-new-user").on("hidden.bs.modal",function(){resetAddUserModal()}),$("#modal-change-pwd, #modal-update-user").on("show.bs.modal",function(){getUsers()}),$("#form-change-pwd").submit(function(a){var b=$("#form-change-pwd .user-list").val(),c=$("#form-change-pwd .password1").val(),f=$("#form-change-pwd .password2").val(),g=$("#form-change-pwd .msg"),h=$("#change-password-submit");return!1===doWordsMatch(c,f)?(a.preventDefault(),showModalMessage("The passwords do not match.","danger",g),!1):!1===isLongPassword(c)?(a.preventDefault(),showModalMessage("Your password is too short. It must be at least "+MIN_PASSWORD_LENGTH+" characters.","danger",g),!1):!0===isSimplePassword(c)?(a.preventDefault(),showModalMessage("Your password too simple. Choose a more complex password.","danger",g),!1):($.ajax({type:"POST",url:"/users/change-pwd/",data:{userId:b,pass1:c,pass2:f},beforeSend:function(){return h.attr("disabled",!0),void showModalMessage("Saving new password...","info",g)},error:function(){showModalMessage("An error occured while trying to update this user's password.","danger",g)},success:function(){showModalMessage("This user's password has been updated.","success",g),setTimeout(function(){h.attr("disabled",!1),resetChangePwdModal()},3e3)}}),a.preventDefault(),!1)});function resetChangePwdModal(){return $(".user-list").val("0"),$("#form-change-pwd .password1").val(""),$("#form-change-pwd .password2").val(""),void $(".msg").html("")}$("#modal-change-pwd").on("hidden.bs.modal",function(){resetAddUserModal()});function resetUpdateUserModal(){return $("#form-update-user label.btn").attr("disabled",!0).removeClass("active"),$("#form-update-user input[type=radio]").attr("disabled",!0).attr("checked",!1),$(".msg").html(""),void $("#update-user-submit").attr("disabled",!0)}$("#modal-update-user").on("hidden.bs.modal",function(){resetUpdateUserModal()}),$("#form-update-user").on("change",".user-list",function(){var a=$(this).val(),b=$("#form-update-user .msg");return 0===a?void resetUpdateUserModal():void $.ajax({type:"GET",url:"/users/get/",data:{userId:a},beforeSend:function(){return resetUpdateUserModal(),void showModalMessage("Retrieving user's permissions...","info",b)},error:function(){showModalMessage("An error occured while trying to retrieve this users data. Please try again.","danger",b)},success:function(c){b.html(""),$("#form-update-user label.btn").attr("disabled",!1),$("#form-update-user input[type=radio]").attr("disabled",!1),$("#update-user-submit").attr("disabled",!1);var f=c.data;return f.add_cards?$("#form-update-user .can-add-cards input[value=true]").attr("checked",!0).parent().addClass("active"):$("#form-update-user .can-add-cards input[value=false]").attr("checked",!0).parent().addClass("active"),f.remove_cards?$("#form-update-user .can-remove-cards input[value=true]").attr("checked",!0).parent().addClass("active"):$("#form-update-user .can-remove-cards input[value=false]").attr("checked",!0).parent().addClass("active"),f.charge_cards?$("#form-update-user .can-charge-cards input[value=true]").attr("checked",!0).parent().addClass("active"):$("#form-update-user .can-charge-cards input[value=false]").attr("checked",!0).parent().addClass("active"),f.view_reports?$("#form-update-user .can-view-reports input[value=true]").attr("checked",!0).parent().addClass("active"):$("#form-update-user .can-view-reports input[value=false]").attr("checked",!0).parent().addClass("active"),f.is_admin?$("#form-update-user .is-admin input[value=true]").attr("checked",!0).parent().addClass("active"):$("#form-update-user .is-admin input[value=false]").attr("checked",!0).parent().addClass("active"),void(f.is_active?$("#form-update-user .is-active input[value=true]").attr("checked",!0).parent().addClass("active"):$("#form-update-user .is-active input[value=false]").attr("checked",!0).parent().addClass("active"))}})}),$("#form-update-user").submit(function(a){var b=$("#form-update-user .user-list").val(),c=$("#form-update-user .can-add-cards label.active input").val(),f=$("#form-update-user .can-remove-cards label.active input").val(),g=$("#form-update-user .can-charge-cards label.active input").val(),h=$("#form-update-user .can-view-reports label.active input").val(),k=$("#form-update-user .is-admin label.active input").val(),l=$("#form-update-user .is-active label.active input").val(),m=$("#form-update-user .msg"),n=$("#update-user-submit");return 0===b.length?(a.preventDefault(),void showModalMessage("A user must be chosen first.","danger",m)):(a.preventDefault(),$.ajax({type:"POST",url:"/users/update/",data:{userId:b,addCards:c,removeCards:f,chargeCards:g,reports:h,admin:k,active:l},beforeSend:function(){return n.attr("disabled",!0),void showModalMessage("Saving updated permissions...","info",m)},error:function(o){var p=JSON.parse(o.responseText);return!1===p.ok?void showModalMessage(p.data.error_msg,"danger",m):void 0},success:function(){return showModalMessage("User updated successfully!","success",m),void setTimeout(function(){n.attr("disabled",!1),m.html("")},3e3)}}),!1)}),$("#add-card").on("change","#card-exp-month",function(){var a=$(this).val(),b=new Date,c=b.getMonth()+1,f=b.getFullYear();a<c?$("#card-exp-year option[value="+f+"]").css({display:"none"}):$("#card-exp-year option[value="+f+"]").css({display:"block"})}),$("#add-card").submit(function(a){var c=$("#add-card"),f=$("#customer-id").val().trim(),g=$("#customer-name").val().trim(),h=$("#cardholder-name").val().trim(),k=$("#card-number").val().trim().replace(" ","").replace("-",""),l=parseInt($("#card-exp-year").val()),m=parseInt($("#card-exp-month").val()),n=$("#card-cvc").val().trim(),o=$("#card-postal-code").val().trim(),p=Stripe.card.cardType(k),q=$("#add-card .submit-form-btn"),s=$("#add-card .msg");if(s.html(""),2>g.length)return a.preventDefault(),showPanelMessage("You must provide a customer name. This can be the same as the cardholder or the name of a company. This is used to lookup cards when you want to create a charge.","danger",s),!1;if(2>h.length)return a.preventDefault(),showPanelMessage("Please provide the name of the cardholder as it is given on the card.","danger",s),!1;var t=k.length;if(14>t||16<t)return a.preventDefault(),showPanelMessage("The card number you provided is "+t+" digits long, however, it must be exactly 15 or 16 digits.","danger",s),!1;if(!1===Stripe.card.validateCardNumber(k))return a.preventDefault(),showPanelMessage("The card number you provided is not valid.","danger",s),!1;var v=new Date,w=v.getMonth()+1,x=v.getFullYear();return 0===m||"0"===m?(a.preventDefault(),showPanelMessage("Please choose the card's expiration month.","danger",s),!1):0===l||"0"===l?(a.preventDefault(),showPanelMessage("Please choose the card's expiration year.","danger",s),!1):l===x&&m<w?(a.preventDefault(),showPanelMessage("The card's expiration must be in the future.","danger",s),!1):!1===Stripe.card.validateExpiry(m,l)?(a.preventDefault(),showPanelMessage("The card's expiration must be in the future.","danger",s),!1):!1===Stripe.card.validateCVC(n)?(a.preventDefault(),showPanelMessage("The security code you provided is invalid.","danger",s),!1):"American Express"===p&&4!==n.length?(a.preventDefault(),showPanelMessage("You provided an American Express card but your security code is invalid. The security code must be exactly 4 numbers long.","danger",s),!1):"American Express"!==p&&3!==n.length?(a.preventDefault(),showPanelMessage("You provided an "+Stripe.card.cardType(k)+" card but your security code is invalid. The security code must be exactly 3 numbers long.","danger",s),!1):5>o.length||6<o.length?(a.preventDefault(),showPanelMessage("The postal code must be exactly 5 numeric or 6 alphanumeric characters.","danger",s),!1):(q.prop("disabled",!0),showPanelMessage("Saving card...","info",s),Stripe.card.createToken({name:h,number:k,cvc:n,exp_month:m,exp_year:l,address_zip:o},function(y,z){return z.error?void showPanelMessage("The credit card could not be saved. Please contact an administrator. Message: "+z.error.message+".","danger",s):void $.ajax({type:"POST",url:"/card/add/",data:{customerId:f,customerName:g,cardholder:h,cardToken:z.id,cardExp:z.card.exp_month+"/"+z.card.exp_year,cardLast4:z.card.last4},error:function(A){var B=JSON.parse(A.responseText);return!1==B.ok?(showPanelMessage(B.data.error_msg,"danger",s),void q.prop("disabled",!1).text("Add Card")):void 0},success:function(){return resetAddCardPanel(),showPanelMessage("Card was saved!","success",s),void setTimeout(function(){s.html(""),q.prop("disabled",!1).text("Add Card"),getCards()},500)}})}),a.preventDefault(),!1)});function resetAddCardPanel(){return $("#customer-id").val(""),$("#customer-name").val(""),$("#cardholder-name").val(""),$("#card-number").val(""),$("#card-exp-year").val("0"),$("#card-exp-month").val("0"),$("#card-cvc").val(""),void $("#card-postal-code").val("")}$("#panel-add-card").on("click",".clear-form-btn",function(){return resetAddCardPanel(),void $("#add-card .msg").html("")}),$("#remove-card").submit(function(a){var b=$("#remove-card .customer-name"),c=b.val(),f=getCardIdFromDataList(b),g=$("#remove-card .submit-form-btn"),h=$("#remove-card .msg");return 0===f||"0"===f||0===f.length?(a.preventDefault(),void showPanelMessage("You must choose a customer.","danger",h)):($.ajax({type:"POST",url:"/card/remove/",data:{customerId:f,customerName:c},beforeSend:function(){return g.prop("disabled",!0),void showPanelMessage("Removing card...","info",h)},error:function(k){var l=JSON.parse(k.responseText);!1===l.ok&&(g.prop("disabled",!1),showPanelMessage("An error occured while removing this card. Do not refresh or leave this screen! Please contact an administrator.","danger",h))},success:function(){return g.prop("disabled",!1),showPanelMessage("Card was removed!","success",h),b.val(""),void setTimeout(function(){h.html(""),getCards()},500)}}),a.preventDefault(),!1)}),$("#charge-card").on("change",".customer-name",function(){var a=$("#charge-card .customer-name"),b=getCardIdFromDataList(a),c=$("#charge-card .msg");return(c.html(""),""===b||0===b)?void showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.","danger",c):void $.ajax({type:"GET",url:"/card/get/",data:{customerId:b},beforeSend:function(){$("#charge-card .customer-cardholder, #charge-card .card-last-four, #charge-card .card-expiration").val("Loading...")},error:function(f){var g=JSON.parse(f.responseText);showPanelMessage(g.data.error_msg,"danger",c)},success:function(f){var g=f.data;return $("#charge-card .customer-cardholder").val(g.cardholder_name),$("#charge-card .card-last-four").val(g.card_last4),$("#charge-card .card-expiration").val(g.card_expiration),void $("#charge-card .charge-amount, #charge-card .charge-invoice, #charge-card .charge-po").prop("disabled",!1)}})}),$("#charge-card").submit(function(a){var b=$("#charge-card .customer-name"),c=b.val(),f=getCardIdFromDataList(b),g=$("#charge-card .charge-amount"),h=parseFloat(g.val()),k=$("#charge-card .charge-invoice"),l=k.val(),m=$("#charge-card .charge-po"),n=m.val(),o=$("#charge-card .msg"),p=$("#charge-card-submit"),q=p.siblings(".dropdown-toggle"),s=p.data("chargeandremove")||!1,t=p.data("authorizeonly")||!1;return(a.preventDefault(),console.log("charging...",h,MIN_CHARGE),h<MIN_CHARGE||isNaN(h))?(a.preventDefault(),void showPanelMessage("You must provide an amount to charge greater than the minimum charge ($"+MIN_CHARGE+").","danger",o)):(p.data("chargeandremove",""),$.ajax({type:"POST",url:"/card/charge/",data:{datastoreId:f,customerName:c,amount:h,invoice:l,po:n,chargeAndRemove:s,authorizeOnly:t},beforeSend:function(){return b.prop("disabled",!0),g.prop("disabled",!0),k.prop("disabled",!0),m.prop("disabled",!0),p.prop("disabled",!0),q.prop("disabled",!0),t?showPanelMessage("Authorizing charge...","info",o):showPanelMessage("Charging card...","info",o),void resetChargeSuccessPanel()},error:function(v){var w=JSON.parse(v.responseText);!1===w.ok&&showPanelMessage(w.data.error_msg,"danger",o)},success:function(v){var w=$("#panel-charge-success"),x=v.data;w.find(".customer-name").text(x.customer_name),w.find(".cardholder").text(x.cardholder_name),w.find(".card-last4").text(x.card_last4),w.find(".card-exp").text(x.card_expiration),w.find(".amount").text("$"+parseFloat(x.amount).toFixed(2)),w.find(".invoice").text(x.invoice),w.find(".po").text(x.po);var y="/card/receipt/?chg_id="+x.charge_id;$("#show-receipt").attr("href",y),!0===x.authorized_only?(w.find(".panel-title").text("Authorization Successful!"),w.find(".panel-body .info.info-authorize").show(),$("#show-receipt").attr("disabled",!0)):(w.find(".panel-title").text("Charge Successful!"),w.find(".panel-body .info.info-authorize").hide(),$("#show-receipt").attr("disabled",!1));var z=$("#panel-charge-card"),A=$(".action-btn");return A.attr("disabled",!0).children("input").attr("disabled",!0),z.fadeOut(200,function(){z.removeClass("show"),w.fadeIn(200,function(){w.addClass("show"),A.attr("disabled",!1).children("input").attr("disabled",!1)})}),A.removeClass("active"),resetChargeCardPanel(!0),void(s&&setTimeout(function(){getCards()},500))}}),!1)}),$(".dropdown-menu.charge-card-options").on("click","#charge-and-remove-card",function(){return $("#charge-card-submit").data("chargeandremove",!0),void $("#charge-card").submit()}),$(".dropdown-menu.charge-card-options").on("click","#auth-charge-only",function(){return $("#charge-card-submit").data("authorizeonly",!0),void $("#charge-card").submit()});function resetChargeCardPanel(a){return $("#charge-card .customer-name").val("").prop("disabled",!1),$("#charge-card .customer-cardholder").val(""),$("#charge-card .card-last-four").val(""),$("#charge-card .card-expiration").val(""),$("#charge-card .charge-amount").val(""),$("#charge-card .charge-invoice").val(""),$("#charge-card .charge-po").val(""),$("#charge-card-submit").prop("disabled",!1),$("#charge-card-submit").siblings(".dropdown-toggle").prop("disabled",!1),$("#charge-card .charge-amount, #charge-card .charge-invoice, #charge-card .charge-po").prop("disabled",!0),$("#charge-card-submit").removeData(),void(a&&$("#charge-card .msg").html(""))}$("#panel-charge-card").on("click",".clear-form-btn",function(){resetChargeCardPanel(!0)});function resetChargeSuccessPanel(){return $("#panel-charge-success .customer-name").text(""),$("#panel-charge-success .cardholder").text(""),$("#panel-charge-success .card-last4").text(""),$("#panel-charge-success .card-exp").text(""),$("#panel-charge-success .amount").text(""),$("#panel-charge-success .invoice").text(""),$("#panel-charge-success .po").text(""),void $("#show-receipt").attr("href","")}$("#reports").submit(function(a){var b=$("#reports .customer-name"),c=b.val(),f=getCardIdFromDataList(b),g=$("#reports .start-date").val(),h=$("#reports .end-date").val(),k=$("#reports .msg"),l=$("#reports-submit");if(k.html(""),""===g)return a.preventDefault(),void showPanelMessage("You must choose a Start Date.","danger",k);if(""===h)return a.preventDefault(),void showPanelMessage("You must choose an End Date.","danger",k);if(h<g)return a.preventDefault(),void showPanelMessage("The Start Date must be before the End Date.","danger",k);var m=new Date,n=-1*(m.getTimezoneOffset()/60);$("#timezone").val(n);var b=$("#reports .customer-name"),o=getCardIdFromDataList(b);$("#report-customer-id").val(o)}),$("#report-rows").on("click",".refund",function(){var a=$(this),b=parseFloat(a.parent().siblings("td.amount-dollars").children(".amount").text().replace(",","")).toFixed(2),c=a.data("chgid"),f=$("#refund-amount");return f.val(b).attr("max",b),void $("#refund-chg-id").val(c)}),$("#form-refund").submit(function(a){var b=$("#refund-chg-id").val(),c=$("#refund-amount").val(),f=$("#refund-reason").val(),g=$("#form-refund .msg"),h=$("#refund-submit");return(g.html(""),0===b.length)?(a.preventDefault(),void showModalMessage("A charge ID was not submitted.  Please refresh your browser and try again.","danger",g)):0===c.length||0>parseFloat(c)?(a.preventDefault(),void showModalMessage("You must provide an amount to refund that is greater than zero but less than the amount charged.","danger",g)):(a.preventDefault(),$.ajax({type:"POST",url:"/card/refund/",data:{chargeId:b,amount:c,reason:f},beforeSend:function(){return showModalMessage("Refunding charge...","info",g),void h.prop("disabled",!0)},error:function(k){var l=JSON.parse(k.responseText);!1===l.ok&&(showModalMessage(l.data.error_msg,"danger",g),h.prop("disabled",!1))},success:function(){return showModalMessage("Refund successful!","success",g),h.prop("disabled",!1),$("#refund-amount").val(""),$("#refund-reason").val("0"),void setTimeout(function(){g.html("")},2e3)}}),!1)}),$("#report-rows").on("click",".link-to-capture",function(){var a=$(this).parents("tr").data("charge-id");$("#capture-charge-id").val(a)}),$("#modal-capture").on("show.bs.modal",function(){var a=$("#capture-charge-id").val(),b=$("#modal-capture .msg");$.ajax({type:"POST",url:"/card/capture/",data:{chargeID:a},beforeSend:function(){showModalMessage("Capturing...","info",b)},error:function(c){var f=JSON.parse(c.responseText);!1===f.ok&&showModalMessage(f.data.error_msg,"danger",b)},success:function(){showModalMessage("Capture successful!","success",b)}})}),$("#modal-change-company-info").on("show.bs.modal",function(){var a=$("#modal-change-company-info .msg");$.ajax({type:"GET",url:"/company/get/",beforeSend:function(){showModalMessage("Loading company information...","info",a)},error:function(b){var c=JSON.parse(b.responseText);if(!1===c.ok){if("companyInfoDoesNotExist"===c.data.error_type){return void showModalMessage("You do have any company info set. Your recipts will show up blank without setting the fields above.","info",a)}return showModalMessage("An error occured and your company data could not be loaded.  Please try again.","danger",a),void $("#company-info-submit").prop("disabled",!0)}},success:function(b){var c=b.data;return $("#modal-change-company-info .company-name").val(c.company_name),$("#modal-change-company-info .company-street").val(c.street),$("#modal-change-company-info .company-suite").val(c.suite),$("#modal-change-company-info .company-city").val(c.city),$("#modal-change-company-info .company-state").val(c.state),$("#modal-change-company-info .company-postal").val(c.postal_code),$("#modal-change-company-info .company-country").val(c.country),$("#modal-change-company-info .company-phone").val(c.phone_num),$("#modal-change-company-info .company-email").val(c.email),$("#modal-change-company-info .percentage-fee").val(parseFloat(100*c.percentage_fee).toFixed(2)),$("#modal-change-company-info .fixed-fee").val(c.fixed_fee.toFixed(2)),$("#modal-change-company-info .statement-descriptor").val(c.statement_descriptor),a.html(""),void $("#company-info-submit").prop("disabled",!1)}})}),$("#modal-change-company-info").on("hidden.bs.modal",function(){return $("#modal-change-company-info .msg").html(""),$("#company-info-submit").prop("disabled",!0),void $("#modal-change-company-info input").val("")}),$("#form-change-company-info").submit(function(a){a.preventDefault();var b=$("#modal-change-company-info .company-name").val(),c=$("#modal-change-company-info .company-street").val(),f=$("#modal-change-company-info .company-suite").val(),g=$("#modal-change-company-info .company-city").val(),h=$("#modal-change-company-info .company-state").val(),k=$("#modal-change-company-info .company-postal").val(),l=$("#modal-change-company-info .company-country").val(),m=$("#modal-change-company-info .company-phone").val(),n=$("#modal-change-company-info .company-email").val(),o=parseFloat($("#modal-change-company-info .percentage-fee").val()),p=parseFloat($("#modal-change-company-info .fixed-fee").val()),q=$("#modal-change-company-info .statement-descriptor").val(),s=$("#modal-change-company-info .msg"),t=$("#company-info-submit");return 2<h.length?void showModalMessage("State must be a two character abbreviation.","danger",s):6<k.length?void showModalMessage("Postal code must be 5 or 6 alphanumeric characters.","danger",s):3<l.length?void showModalMessage("Country must be a 2 or 3 character abbreviation.","danger",s):0>o||100<o||isNaN(o)?void showModalMessage("Percentage fee must be a number such as 2.95.","danger",s):0>p||100<p||isNaN(p)?void showModalMessage("Fixed fee must be a number such as 0.30.","danger",s):5>q.length||22<q.length?void showModalMessage("Statement descriptor must be between 5 and 22 characters long.  It is currently "+q.length+" characters.","danger",s):($.ajax({type:"POST",url:"/company/set/",data:{name:b,street:c,suite:f,city:g,state:h,postal:k,country:l,phone:m,email:n,percentFee:o,fixedFee:p,descriptor:q},beforeSend:function(){showModalMessage("Saving company information...","info",s),t.prop("disabled",!0)},error:function(v){var w=JSON.parse(v.responseText);if(!1===w.ok)return void showModalMessage("An error occured and your company info could not be saved.","danger",s)},success:function(){return showModalMessage("Company information was saved!","success",s),t.prop("disabled",!1),void setTimeout(function(){s.html("")},3e3)}}),!1)}),$("#modal-app-settings").on("show.bs.modal",function(){var a=$("#modal-app-settings .msg");$.ajax({type:"GET",url:"/app-settings/get/",beforeSend:function(){showModalMessage("Loading app settings...","info",a)},error:function(b){var c=JSON.parse(b.responseText);if(!1===c.ok)return showModalMessage("An error occured and your app settings could not be loaded.  Please try again.","danger",a),void $("#app-settings-submit").prop("disabled",!0)},success:function(b){var c=b.data;return c.require_cust_id?$("#form-change-app-settings .require-cust-id input[value=true]").attr("checked",!0).parent().addClass("active"):$("#form-change-app-settings .require-cust-id input[value=false]").attr("checked",!0).parent().addClass("active"),$("#modal-app-settings .cust-id-format").val(c.cust_id_format),$("#modal-app-settings .cust-id-regex").val(c.cust_id_regex),$("#modal-app-settings .report-timezone").val(c.report_timezone),""===c.api_key?$("#api-key-displayed").val("Not created yet."):$("#api-key-displayed").val(c.api_key),a.html(""),void $("#app-settings-submit").prop("disabled",!1)}})}),$("#modal-app-settings").on("hidden.bs.modal",function(){return $("#modal-app-settings .msg").html(""),$("#app-settings-submit").prop("disabled",!0),void $("#modal-app-settings input").val("")}),$("#form-change-app-settings").submit(function(a){a.preventDefault();var b=$("#modal-app-settings .require-cust-id label.active input").val(),c=$("#modal-app-settings .cust-id-format").val(),f=$("#modal-app-settings .cust-id-regex").val(),g=$("#modal-app-settings .report-timezone").val(),h=$("#modal-app-settings .msg"),k=$("#app-settings-submit");return $.ajax({type:"POST",url:"/app-settings/set/",data:{requireCustID:b,custIDFormat:c,custIDRegex:f,guiTimezone:g},beforeSend:function(){showModalMessage("Saving app settings...","info",h),k.prop("disabled",!0)},error:function(l){var m=JSON.parse(l.responseText);if(!1===m.ok)return void showModalMessage("An error occured and your app settings could not be saved.","danger",h)},success:function(){return showModalMessage("App settings saved! Refresh the app to see the changes applied.","success",h),k.prop("disabled",!1),void setTimeout(function(){h.html("")},5e3)}}),!1}),$("#form-change-app-settings").on("click","#generate-api-key",function(){var a=$("#modal-app-settings .msg");$.ajax({type:"GET",url:"/app-settings/generate-api-key/",beforeSend:function(){showModalMessage("Getting new API key...","info",a)},error:function(b){var c=JSON.parse(b.responseText);if(!1===c.ok)return void showModalMessage("An error occured and an API key could not be generated.  Try again.","danger",a)},success:function(b){return $("#api-key-displayed").val(b.data),showModalMessage("New API key generated.","success",a),void setTimeout(function(){a.html("")},3e3)}})});
\ No newline at end of file
+const MIN_PASSWORD_LENGTH=8;const BAD_PASSWORDS=["password","password1","12345678","123456789","123123123","00000000","1234567890","asdfasdf","asdfghjkl","testtest","admin@example.com"];const MIN_CHARGE=0.5;const MAX_STATEMENT_DESCRIPTOR_LENGTH=22;function validateEmail(email){var regex=/^(([^<>()[\]\\.,;:\s@\"]+(\.[^<>()[\]\\.,;:\s@\"]+)*)|(\".+\"))@((\[[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\])|(([a-zA-Z\-0-9]+\.)+[a-zA-Z]{2,}))$/;return regex.test(email);}function validateEmailList(list){var emails=list.split(/[,;]/);for(var i=0;i<emails.length;i++){var email=emails[i].trim();if(email!==''&&validateEmail(email)===false){return false;}}return true;}function doWordsMatch(word1,word2){if(word1===word2){return true;}return false;}function isLongPassword(password){if(password.length<MIN_PASSWORD_LENGTH){return false;}return true;}function isSimplePassword(password){if(BAD_PASSWORDS.indexOf(password)!==-1){return true;}return false;}function showPanelMessage(msg,type,elem){elem.html('<div class="alert alert-'+type+'">'+msg+'</div>');return;}function showModalMessage(msg,type,elem){elem.html('<div class="alert alert-'+type+'">'+msg+'</div>');return;}$('body').on('click','.action-btn',function(){const PANEL_TRANSITION_SPEED='fast';var dataAction=$(this).data("action");var panelToShow=$('#'+dataAction);if(panelToShow.hasClass('show')){return;}var panelToHide=$('.action-panels.show');panelToHide.fadeOut(PANEL_TRANSITION_SPEED,function(){panelToHide.removeClass('show');panelToShow.fadeIn(PANEL_TRANSITION_SPEED,function(){panelToShow.addClass('show');return;});return;});resetAddCardPanel();resetChargeCardPanel(true);resetScheduledChargePanel();});$('#create-init-admin').submit(function(e){var pass1=$('#password1').val();var pass2=$('#password2').val();var msg=$('#create-init-admin .msg');if(doWordsMatch(pass1,pass2)===false){e.preventDefault();showPanelMessage("The passwords do not match.",'danger',msg);return false;}if(isLongPassword(pass1)===false){e.preventDefault();showPanelMessage("Your password is too short. It must be at least "+MIN_PASSWORD_LENGTH+" characters.",'danger',msg);return false;}if(isSimplePassword(pass1)===true){e.preventDefault();showPanelMessage("The password you provided is too simple. Please choose a better password.",'danger',msg);return false;}});$(function(){$('[data-toggle="tooltip"]').tooltip();$.ajaxSetup({dataType:'json'});$('#charge-card .charge-card-id').trigger('change');return;});function getCards(){var customerList=$('#customer-list');$.ajax({type:"GET",url:"/card/get/all/",beforeSend:function(){console.log("Loading cards...");customerList.html('<option value="Loading...">');return;},error:function(r){customerList.html('<option value="Could Not Load">');return;},success:function(j){console.log("Loading cards...done!");var data=j['data'];customerList.html('');if(data===null||data.length===0){customerList.html('<option value="None exist yet!" data-id="0">');return;}data.forEach(function(elem,index){var name=elem['customer_name'];var id=elem['id'];customerList.append('<option value="'+name+'" data-id="'+id+'">');});return;}});}function getCardIdFromDataList(autocompleteElement){var selectedOptionValue=autocompleteElement.val();var options=$('#customer-list option');var id="";options.each(function(){var elemValue=$(this).val();var elemId=$(this).data('id');if(selectedOptionValue===elemValue){id=elemId;return false;}});return id;}function generateExpirationYears(){console.log("Loading expiration years...");var elem=$('#card-exp-year, #update-card-exp-year');elem.html('');var d=new Date();var year=d.getFullYear();elem.append('<option value="0">Please choose.</option>');for(var i=year;i<year+11;i++){elem.append('<option value='+i+'>'+i+'</option>');}console.log('Loading expiration years...done!');return;}function getUsers(){var userList=$('.user-list');$.ajax({type:"GET",url:"/users/get/all/",beforeSend:function(){userList.html('<option value="0">Loading...</option>').attr('disabled',true);return;},error:function(r){userList.html('<option value="0">Error (please see dev tools)</option>');return;},success:function(r){userList.html('');userList.append("<option value='0'>Please choose...</option>").attr('disabled',false);var users=r['data'];users.forEach(function(u,index){if(u['username']==="administrator"){return;}userList.append('<option value="'+u['id']+'">'+u['username']+'</option>');return;});return;}});}$('#form-new-user').submit(function(e){var username=$('#form-new-user .username').val();var password1=$('#form-new-user .password1').val();var password2=$('#form-new-user .password2').val();var addCards=$('#form-new-user .can-add-cards input:checked').val();var removeCards=$('#form-new-user .can-remove-cards input:checked').val();var chargeCards=$('#form-new-user .can-charge-cards input:checked').val();var reports=$('#form-new-user .can-view-reports input:checked').val();var disputes=$('#form-new-user .can-manage-disputes input:checked').val();var admin=$('#form-new-user .is-admin input:checked').val();var active=$('#form-new-user .is-active input:checked').val();var msgElem=$('#form-new-user .msg');var submit=$('#form-new-user-submit');if(validateEmail(username)===false){e.preventDefault();showModalMessage('You must provide an email address as a username.','danger',msgElem);return false;}if(doWordsMatch(password1,password2)===false){e.preventDefault();showModalMessage('The passwords do not match.','danger',msgElem);return false;}if(isLongPassword(password1)===false){e.preventDefault();showModalMessage('Your password is too short. It must be at least '+MIN_PASSWORD_LENGTH+' characters.','danger',msgElem);return false;}if(isSimplePassword(password1)===true){e.preventDefault();showModalMessage('Your password too simple. Choose a more complex password.','danger',msgElem);return false;}msgElem.html('');e.preventDefault();$.ajax({type:'POST',url:'/users/add/',data:{username:username,password1:password1,password2:password2,addCards:addCards,removeCards:removeCards,chargeCards:chargeCards,reports:reports,disputes:disputes,admin:admin,active:active},beforeSend:function(){submit.attr("disabled",true);showModalMessage("Saving user...","info",msgElem);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage(j['data']['error_msg'],'danger',msgElem);return;}submit.attr("disabled",false);return;},success:function(r){showModalMessage("New user was saved sucessfully!","success",msgElem);setTimeout(function(){submit.attr("disabled",false);resetAddUserModal();},3000);}});return false;});function resetAddUserModal(){$('#form-new-user .username, #form-new-user .password1, #form-new-user .password2').val('');$('#form-new-user .default').attr("checked",true).parent('label').addClass('active').siblings('label').removeClass('active');$('.msg').html('');return;}$('#modal-new-user').on('hidden.bs.modal',function(){resetAddUserModal();return;});$('#modal-change-pwd, #modal-update-user').on('show.bs.modal',function(){getUsers();return;});$('#form-change-pwd').submit(function(e){var id=$('#form-change-pwd .user-list').val();var pass1=$('#form-change-pwd .password1').val();var pass2=$('#form-change-pwd .password2').val();var msgElem=$('#form-change-pwd .msg');var submit=$('#change-password-submit');if(doWordsMatch(pass1,pass2)===false){e.preventDefault();showModalMessage("The passwords do not match.","danger",msgElem);return false;}if(isLongPassword(pass1)===false){e.preventDefault();showModalMessage("Your password is too short. It must be at least "+MIN_PASSWORD_LENGTH+" characters.","danger",msgElem);return false;}if(isSimplePassword(pass1)===true){e.preventDefault();showModalMessage("Your password too simple. Choose a more complex password.","danger",msgElem);return false;}$.ajax({type:"POST",url:"/users/change-pwd/",data:{userId:id,pass1:pass1,pass2:pass2},beforeSend:function(){submit.attr("disabled",true);showModalMessage("Saving new password...","info",msgElem);return;},error:function(r){showModalMessage("An error occured while trying to update this user's password.","danger",msgElem);return;},success:function(r){showModalMessage("This user's password has been updated.","success",msgElem);setTimeout(function(){submit.attr("disabled",false);resetChangePwdModal();},3000);}});e.preventDefault();return false;});function resetChangePwdModal(){$('.user-list').val('0');$('#form-change-pwd .password1').val('');$('#form-change-pwd .password2').val('');$('.msg').html('');return;}$('#modal-change-pwd').on('hidden.bs.modal',function(){resetAddUserModal();return;});function resetUpdateUserModal(){$('#form-update-user label.btn').attr('disabled',true).removeClass('active');$('#form-update-user input[type=radio]').attr('disabled',true).attr('checked',false);$('.msg').html('');$('#update-user-submit').attr('disabled',true);return;}$('#modal-update-user').on('hidden.bs.modal',function(){resetUpdateUserModal();return;});$('#form-update-user').on('change','.user-list',function(){var userId=$(this).val();var msgElem=$('#form-update-user .msg');if(userId===0){resetUpdateUserModal();return;}$.ajax({type:"GET",url:"/users/get/",data:{userId:userId},beforeSend:function(){resetUpdateUserModal();showModalMessage("Retrieving user's permissions...","info",msgElem);return;},error:function(r){showModalMessage("An error occured while trying to retrieve this users data. Please try again.","danger",msgElem);return;},success:function(j){msgElem.html('');$('#form-update-user label.btn').attr('disabled',false);$('#form-update-user input[type=radio]').attr('disabled',false);$('#update-user-submit').attr('disabled',false);var data=j['data'];if(data['add_cards']){$('#form-update-user .can-add-cards input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-update-user .can-add-cards input[value=false]').attr('checked',true).parent().addClass('active');}if(data['remove_cards']){$('#form-update-user .can-remove-cards input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-update-user .can-remove-cards input[value=false]').attr('checked',true).parent().addClass('active');}if(data['charge_cards']){$('#form-update-user .can-charge-cards input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-update-user .can-charge-cards input[value=false]').attr('checked',true).parent().addClass('active');}if(data['view_reports']){$('#form-update-user .can-view-reports input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-update-user .can-view-reports input[value=false]').attr('checked',true).parent().addClass('active');}if(data['manage_disputes']){$('#form-update-user .can-manage-disputes input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-update-user .can-manage-disputes input[value=false]').attr('checked',true).parent().addClass('active');}if(data['is_admin']){$('#form-update-user .is-admin input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-update-user .is-admin input[value=false]').attr('checked',true).parent().addClass('active');}if(data['is_active']){$('#form-update-user .is-active input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-update-user .is-active input[value=false]').attr('checked',true).parent().addClass('active');}return;}});return;});$('#form-update-user').submit(function(e){var userId=$('#form-update-user .user-list').val();var addCards=$('#form-update-user .can-add-cards label.active input').val();var removeCards=$('#form-update-user .can-remove-cards label.active input').val();var chargeCards=$('#form-update-user .can-charge-cards label.active input').val();var reports=$('#form-update-user .can-view-reports label.active input').val();var disputes=$('#form-update-user .can-manage-disputes label.active input').val();var admin=$('#form-update-user .is-admin label.active input').val();var active=$('#form-update-user .is-active label.active input').val();var msgElem=$('#form-update-user .msg');var submit=$('#update-user-submit');if(userId.length===0){e.preventDefault();showModalMessage("A user must be chosen first.","danger",msgElem);return;}e.preventDefault();$.ajax({type:"POST",url:"/users/update/",data:{userId:userId,addCards:addCards,removeCards:removeCards,chargeCards:chargeCards,reports:reports,disputes:disputes,admin:admin,active:active},beforeSend:function(){submit.attr('disabled',true);showModalMessage("Saving updated permissions...","info",msgElem);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage(j['data']['error_msg'],'danger',msgElem);return;}return;},success:function(j){showModalMessage("User updated successfully!","success",msgElem);setTimeout(function(){submit.attr('disabled',false);msgElem.html('');},3000);return;}});return false;});$('#add-card, #update-card').on('change','#card-exp-month, #update-card-exp-month',function(){var expMonth=$(this).val();var yearSelect=$(this).closest('form').find('#card-exp-year, #update-card-exp-year');var d=new Date();var currentMonth=d.getMonth()+1;var currentYear=d.getFullYear();if(expMonth<currentMonth){yearSelect.find('option[value='+currentYear+']').css({"display":"none"});}else{yearSelect.find('option[value='+currentYear+']').css({"display":"block"});}return;});function validateCard(cardNum,expMonth,expYear,cvc,postal){var cardType=Stripe.card.cardType(cardNum);var cardNumLength=cardNum.length;if(cardNumLength<14||cardNumLength>16){return'The card number you provided is '+cardNumLength+' digits long, however, it must be exactly 15 or 16 digits.';}if(Stripe.card.validateCardNumber(cardNum)===false){return'The card number you provided is not valid.';}var d=new Date();var nowMonth=d.getMonth()+1;var nowYear=d.getFullYear();if(expMonth===0||expMonth==='0'){return'Please choose the card\'s expiration month.';}if(expYear===0||expYear==='0'){return'Please choose the card\'s expiration year.';}if(expYear===nowYear&&expMonth<nowMonth){return'The card\'s expiration must be in the future.';}if(Stripe.card.validateExpiry(expMonth,expYear)===false){return'The card\'s expiration must be in the future.';}if(Stripe.card.validateCVC(cvc)===false){return'The security code you provided is invalid.';}if(cardType==="American Express"&&cvc.length!==4){return'You provided an American Express card but your security code is invalid. The security code must be exactly 4 numbers long.';}if(cardType!=="American Express"&&cvc.length!==3){return'You provided an '+cardType+' card but your security code is invalid. The security code must be exactly 3 numbers long.';}if(postal.length<5||postal.length>6){return'The postal code must be exactly 5 numeric or 6 alphanumeric characters.';}return'';}function showAddPaymentTypeFields(){var bankAccount=($('#add-payment-type').val()==='bank_account');$('#add-card .add-card-fields').toggle(!bankAccount);$('#add-card .add-card-fields input').prop('required',!bankAccount);$('#add-card .add-bank-fields').toggle(bankAccount);$('#add-card .add-bank-fields input').prop('required',bankAccount);if(bankAccount){$('#add-card .cardholder-label').text('Account Holder: ');$('#cardholder-name').attr('placeholder','The name on the bank account.');}else{$('#add-card .cardholder-label').text('Cardholder: ');$('#cardholder-name').attr('placeholder','The name on the card.');}return;}$('#add-card').on('change','#add-payment-type',function(){showAddPaymentTypeFields();return;});$('#add-card').submit(function(e){var form=$('#add-card');var paymentType=$('#add-payment-type').val();var customerId=$('#customer-id').val().trim();var customerName=$('#customer-name').val().trim();var cardholder=$('#cardholder-name').val().trim();var currency=$('#customer-currency').val().trim();var billingEmail=$('#customer-billing-email').val().trim();var cardNum=$('#card-number').val().trim().replace(' ','').replace('-','');var expYear=parseInt($('#card-exp-year').val());var expMonth=parseInt($('#card-exp-month').val());var cvc=$('#card-cvc').val().trim();var postal=$('#card-postal-code').val().trim();var routingNum=$('#bank-routing-number').val().trim();var accountNum=$('#bank-account-number').val().trim();var holderType=$('#bank-account-holder-type').val();var makeDefault=$('#card-make-default').prop('checked');var submitBtn=$('#add-card .submit-form-btn');var msg=$('#add-card .msg');msg.html('');if(customerName.length<2){e.preventDefault();showPanelMessage('You must provide a customer name. This can be the same as the cardholder or the name of a company. This is used to lookup cards when you want to create a charge.',"danger",msg);return false;}if(cardholder.length<2){e.preventDefault();if(paymentType==='bank_account'){showPanelMessage('Please provide the name of the account holder as it is given on the bank account.','danger',msg);}else{showPanelMessage('Please provide the name of the cardholder as it is given on the card.','danger',msg);}return false;}if(billingEmail!==''&&validateEmail(billingEmail)===false){e.preventDefault();showPanelMessage('The billing email must be a valid email address. Leave it blank if the customer does not have one.','danger',msg);return false;}if(paymentType==='bank_account'){if(currency!==''&&currency.toLowerCase()!=='usd'){e.preventDefault();showPanelMessage('Bank accounts can only be charged in USD. Leave the currency blank or use USD.','danger',msg);return false;}if(/^[0-9]{9}$/.test(routingNum)===false){e.preventDefault();showPanelMessage('The routing number must be 9 digits.','danger',msg);return false;}if(/^[0-9]{4,17}$/.test(accountNum)===false){e.preventDefault();showPanelMessage('The account number must be between 4 and 17 digits.','danger',msg);return false;}}else{var cardErr=validateCard(cardNum,expMonth,expYear,cvc,postal);if(cardErr!==''){e.preventDefault();showPanelMessage(cardErr,'danger',msg);return false;}}submitBtn.prop("disabled",true);if(paymentType==='bank_account'){showPanelMessage('Saving bank account...','info',msg);Stripe.bankAccount.createToken({country:'US',currency:'usd',routing_number:routingNum,account_number:accountNum,account_holder_name:cardholder,account_holder_type:holderType},createBankTokenCallback);}else{showPanelMessage('Saving card...','info',msg);Stripe.card.createToken({name:cardholder,number:cardNum,cvc:cvc,exp_month:expMonth,exp_year:expYear,address_zip:postal},createTokenCallback);}function createTokenCallback(status,response){if(response.error){showPanelMessage('The credit card could not be saved. Please contact an administrator. Message: '+response.error.message+'.','danger',msg);return;}addCard({paymentType:'card',cardToken:response['id'],cardExp:response['card']['exp_month']+"/"+response['card']['exp_year'],cardLast4:response['card']['last4']});return;}function createBankTokenCallback(status,response){if(response.error){showPanelMessage('The bank account could not be saved. Please check the routing and account numbers. Message: '+response.error.message+'.','danger',msg);submitBtn.prop("disabled",false);return;}addCard({paymentType:'bank_account',cardToken:response['id'],cardLast4:response['bank_account']['last4'],bankName:response['bank_account']['bank_name']});return;}function addCard(token){$.ajax({type:"POST",url:"/card/add/",data:$.extend({customerId:customerId,customerName:customerName,cardholder:cardholder,currency:currency,billingEmail:billingEmail,makeDefault:makeDefault},token),error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']==false){showPanelMessage(j['data']['error_msg'],'danger',msg);submitBtn.prop("disabled",false).text("Add Card");return;}return;},success:function(r){resetAddCardPanel();if(token['paymentType']==='bank_account'){showPanelMessage("Bank account was saved! Verify it once Stripe's two small deposits arrive in the bank account, then it can be charged.",'success',msg);}else if(r['type']==="addCardToCustomer"){showPanelMessage("Card was added to the existing customer!",'success',msg);}else{showPanelMessage("Card was saved!",'success',msg);}setTimeout(function(){msg.html('');submitBtn.prop("disabled",false).text("Add Card");getCards();},500);return;}});return;}e.preventDefault();return false;});function resetAddCardPanel(){$('#customer-id').val('');$('#customer-name').val('');$('#cardholder-name').val('');$('#customer-currency').val('');$('#customer-billing-email').val('');$('#card-number').val('');$('#card-exp-year').val('0');$('#card-exp-month').val('0');$('#card-cvc').val('');$('#card-postal-code').val('');$('#bank-routing-number').val('');$('#bank-account-number').val('');$('#bank-account-holder-type').val('company');$('#add-payment-type').val('card');$('#card-make-default').prop('checked',false);showAddPaymentTypeFields();return;}$('#panel-add-card').on('click','.clear-form-btn',function(){resetAddCardPanel();$('#add-card .msg').html('');return;});function showUpdateCardDetails(){var option=$('#update-card .update-card-id option:selected');var history=$('#update-card .update-card-history');if(option.length===0){$('#update-cardholder-name').val('');history.text('');return;}$('#update-cardholder-name').val(option.attr('data-cardholder'));var updatedBy=option.attr('data-updated-by');if(updatedBy){history.text('Last updated by '+updatedBy+' on '+option.attr('data-updated')+' (UTC).');}else{history.text('This card has not been updated before.');}return;}$('#update-card').on('change','.customer-name',function(){var input=$('#update-card .customer-name');var custId=getCardIdFromDataList(input);var select=$('#update-card .update-card-id');select.html('');showUpdateCardDetails();if(custId===""||custId===0){return;}$.ajax({type:"GET",url:"/card/get/",data:{customerId:custId},success:function(j){var cards=j['data']['cards']||[];cards.forEach(function(card){select.append(cardOption(card));});showUpdateCardDetails();return;}});return;});$('#update-card').on('change','.update-card-id',function(){showUpdateCardDetails();return;});$('#update-card').submit(function(e){var input=$('#update-card .customer-name');var custId=getCardIdFromDataList(input);var cardId=$('#update-card .update-card-id').val();var cardholder=$('#update-cardholder-name').val().trim();var cardNum=$('#update-card-number').val().trim().replace(' ','').replace('-','');var expYear=parseInt($('#update-card-exp-year').val());var expMonth=parseInt($('#update-card-exp-month').val());var cvc=$('#update-card-cvc').val().trim();var postal=$('#update-card-postal-code').val().trim();var submitBtn=$('#panel-update-card .submit-form-btn');var msg=$('#update-card .msg');msg.html('');if(custId===0||custId==="0"||custId.length===0||cardId===null){e.preventDefault();showPanelMessage("You must choose a customer and the card to update.","danger",msg);return false;}if(cardholder.length<2){e.preventDefault();showPanelMessage('Please provide the name of the cardholder as it is given on the card.','danger',msg);return false;}var cardErr=validateCard(cardNum,expMonth,expYear,cvc,postal);if(cardErr!==''){e.preventDefault();showPanelMessage(cardErr,'danger',msg);return false;}submitBtn.prop("disabled",true);showPanelMessage('Updating card...','info',msg);Stripe.card.createToken({name:cardholder,number:cardNum,cvc:cvc,exp_month:expMonth,exp_year:expYear,address_zip:postal},createTokenCallback);function createTokenCallback(status,response){if(response.error){showPanelMessage('The credit card could not be saved. Please contact an administrator. Message: '+response.error.message+'.','danger',msg);submitBtn.prop("disabled",false);return;}$.ajax({type:"POST",url:"/card/update/",data:{customerId:custId,cardId:cardId,cardholder:cardholder,cardToken:response['id'],cardExp:response['card']['exp_month']+"/"+response['card']['exp_year'],cardLast4:response['card']['last4']},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']==false){showPanelMessage(j['data']['error_msg'],'danger',msg);submitBtn.prop("disabled",false);return;}return;},success:function(r){resetUpdateCardPanel();showPanelMessage("Card was updated!",'success',msg);setTimeout(function(){msg.html('');submitBtn.prop("disabled",false);},500);return;}});return;}e.preventDefault();return false;});function resetUpdateCardPanel(){$('#update-card .customer-name').val('');$('#update-card .update-card-id').html('');$('#update-card .update-card-history').text('');$('#update-cardholder-name').val('');$('#update-card-number').val('');$('#update-card-exp-year').val('0');$('#update-card-exp-month').val('0');$('#update-card-cvc').val('');$('#update-card-postal-code').val('');return;}$('#panel-update-card').on('click','.clear-form-btn',function(){resetUpdateCardPanel();$('#update-card .msg').html('');return;});$('#verify-bank-account').on('change','.customer-name',function(){var input=$('#verify-bank-account .customer-name');var custId=getCardIdFromDataList(input);var select=$('#verify-bank-account .verify-bank-account-id');var msg=$('#verify-bank-account .msg');select.html('');msg.html('');if(custId===""||custId===0){return;}$.ajax({type:"GET",url:"/card/get/",data:{customerId:custId},success:function(j){var cards=j['data']['cards']||[];cards.forEach(function(card){if(card['payment_type']!=='bank_account'||card['bank_account_status']==='verified'){return;}select.append(cardOption(card));});if(select.find('option').length===0){showPanelMessage('This customer does not have any bank accounts that need to be verified.','info',msg);}return;}});return;});$('#verify-bank-account').submit(function(e){var input=$('#verify-bank-account .customer-name');var custId=getCardIdFromDataList(input);var cardId=$('#verify-bank-account .verify-bank-account-id').val();var amount1=parseInt($('#verify-amount-1').val());var amount2=parseInt($('#verify-amount-2').val());var submitBtn=$('#panel-verify-bank-account .submit-form-btn');var msg=$('#verify-bank-account .msg');e.preventDefault();msg.html('');if(custId===0||custId==="0"||custId.length===0){showPanelMessage("You must choose a customer.","danger",msg);return false;}if(!cardId){showPanelMessage("You must choose a bank account.","danger",msg);return false;}if(isNaN(amount1)||isNaN(amount2)||amount1<1||amount1>99||amount2<1||amount2>99){showPanelMessage("Each deposit amount must be a whole number of cents between 1 and 99, i.e.: 32 for $0.32.","danger",msg);return false;}$.ajax({type:"POST",url:"/card/bank-account/verify/",data:{customerId:custId,cardId:cardId,amount1:amount1,amount2:amount2},beforeSend:function(){submitBtn.prop('disabled',true);showPanelMessage('Verifying bank account...','info',msg);return;},error:function(r){var j=JSON.parse(r['responseText']);submitBtn.prop('disabled',false);if(j['ok']===false){showPanelMessage(j['data']['error_msg'],'danger',msg);}return;},success:function(j){resetVerifyBankAccountPanel();showPanelMessage('Bank account was verified! It can now be charged.','success',msg);setTimeout(function(){msg.html('');submitBtn.prop('disabled',false);},500);return;}});return false;});function resetVerifyBankAccountPanel(){$('#verify-bank-account .customer-name').val('');$('#verify-bank-account .verify-bank-account-id').html('');$('#verify-amount-1').val('');$('#verify-amount-2').val('');return;}$('#panel-verify-bank-account').on('click','.clear-form-btn',function(){resetVerifyBankAccountPanel();$('#verify-bank-account .msg').html('');return;});$('#remove-card').on('change','.customer-name',function(){var input=$('#remove-card .customer-name');var custId=getCardIdFromDataList(input);var select=$('#remove-card .remove-card-id');select.find('option').not('[value="0"]').remove();if(custId===""||custId===0){return;}$.ajax({type:"GET",url:"/card/get/",data:{customerId:custId},success:function(j){var cards=j['data']['cards']||[];cards.forEach(function(card){if(card['id']===0){return;}select.append(cardOption(card));});return;}});return;});$('#remove-card').submit(function(e){var input=$('#remove-card .customer-name');var custName=input.val();var custId=getCardIdFromDataList(input);var cardSelect=$('#remove-card .remove-card-id');var cardId=cardSelect.val();var btn=$('#remove-card .submit-form-btn');var msg=$('#remove-card .msg');if(custId===0||custId==="0"||custId.length===0){e.preventDefault();showPanelMessage("You must choose a customer.","danger",msg);return;}$.ajax({type:"POST",url:"/card/remove/",data:{customerId:custId,customerName:custName,cardId:cardId},beforeSend:function(){btn.prop('disabled',true);showPanelMessage('Removing card...','info',msg);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){btn.prop('disabled',false);if(j['data']['error_type']==="card: cannot remove the only card of a customer"){showPanelMessage(j['data']['error_msg'],'danger',msg);return;}showPanelMessage('An error occured while removing this card. Do not refresh or leave this screen! Please contact an administrator.','danger',msg);}return;},success:function(j){btn.prop('disabled',false);showPanelMessage('Card was removed!','success',msg);input.val('');cardSelect.find('option').not('[value="0"]').remove();setTimeout(function(){msg.html('');getCards();},500);return;}});e.preventDefault();return false;});$('#charge-card').on('change','.customer-name',function(){var input=$('#charge-card .customer-name');var custId=getCardIdFromDataList(input);var msg=$('#charge-card .msg');msg.html('');if(custId===""||custId===0){showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.","danger",msg);return;}$.ajax({type:"GET",url:"/card/get/",data:{customerId:custId},beforeSend:function(){$('#charge-card .customer-cardholder, #charge-card .card-last-four, #charge-card .card-expiration').val("Loading...");$('#charge-card .charge-card-id').html('');return;},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",msg);return;},success:function(j){var data=j['data'];$('#charge-card .customer-cardholder').val(data['cardholder_name']);$('#charge-card .card-last-four').val(data['card_last4']);$('#charge-card .card-expiration').val(data['card_expiration']);var select=$('#charge-card .charge-card-id');var cards=data['cards']||[];cards.forEach(function(card){select.append(cardOption(card));});select.trigger('change');var currencyInput=$('#charge-card .charge-currency');currencyInput.val(data['currency']||currencyInput.data('default'));$('#charge-card .charge-email-receipt').attr('placeholder',data['billing_email']||'ap@example.com, buyer@example.com');$('#charge-card .charge-amount, #charge-card .charge-currency, #charge-card .charge-invoice, #charge-card .charge-po, #charge-card .charge-email-receipt').prop('disabled',false);return;}});return;});$('#charge-card').on('change','.charge-card-id',function(){var option=$(this).find('option:selected');if(option.length===0){$('#charge-card-make-default').prop('disabled',true);return;}$('#charge-card .customer-cardholder').val(option.data('cardholder'));$('#charge-card .card-last-four').val(option.data('last4'));$('#charge-card .card-expiration').val(option.data('expiration'));var isDefault=option.data('default')===true||option.data('default')==="true";$('#charge-card-make-default').prop('disabled',isDefault||option.val()==="0");return;});$('#charge-card').on('click','#charge-card-make-default',function(){var input=$('#charge-card .customer-name');var custId=getCardIdFromDataList(input);var cardId=$('#charge-card .charge-card-id').val();var btn=$(this);var msg=$('#charge-card .msg');$.ajax({type:"POST",url:"/card/default/",data:{customerId:custId,cardId:cardId},beforeSend:function(){btn.prop('disabled',true);return;},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],'danger',msg);btn.prop('disabled',false);return;},success:function(j){$('#charge-card .customer-name').trigger('change');return;}});return;});function cardOption(card){var text="ending in "+card['card_last4']+" ("+card['card_expiration']+")";if(card['payment_type']==='bank_account'){text="Bank account ending in "+card['card_last4'];if(card['card_brand']){text+=" ("+card['card_brand']+")";}if(card['bank_account_status']!=='verified'){text+=" - not verified";}}else if(card['card_brand']){text=card['card_brand']+" "+text;}if(card['is_default']){text+=" - default";}var option=$('<option>').val(card['id']).text(text);option.attr('data-cardholder',card['cardholder_name']);option.attr('data-last4',card['card_last4']);option.attr('data-expiration',card['card_expiration']);option.attr('data-default',card['is_default']);option.attr('data-updated-by',card['updated_by']);option.attr('data-updated',card['datetime_updated']);return option;}$('#charge-card').submit(function(e){var customerNameInput=$('#charge-card .customer-name');var customerName=customerNameInput.val();var datastoreId=getCardIdFromDataList(customerNameInput);var cardId=$('#charge-card .charge-card-id').val();var amountElem=$('#charge-card .charge-amount');var amount=parseFloat(amountElem.val());var currencyElem=$('#charge-card .charge-currency');var currency=currencyElem.val().trim();var invoiceElem=$('#charge-card .charge-invoice');var invoice=invoiceElem.val();var poElem=$('#charge-card .charge-po');var po=poElem.val();var emailReceiptElem=$('#charge-card .charge-email-receipt');var emailReceipt=(emailReceiptElem.val()||'').trim();var msg=$('#charge-card .msg');var btn=$('#charge-card-submit');var dropdownBtn=btn.siblings('.dropdown-toggle');var chargeAndRemove=btn.data("chargeandremove")||false;var authorizeOnly=btn.data("authorizeonly")||false;e.preventDefault();console.log("charging...",amount,MIN_CHARGE);if(amount<MIN_CHARGE||isNaN(amount)){e.preventDefault();showPanelMessage("You must provide an amount to charge greater than the minimum charge ("+MIN_CHARGE+").","danger",msg);return;}if(validateEmailList(emailReceipt)===false){showPanelMessage("One of the email addresses to send the receipt to is not valid. Separate addresses with commas.","danger",msg);return;}btn.data("chargeandremove","");$.ajax({type:"POST",url:"/card/charge/",data:{datastoreId:datastoreId,cardId:cardId,customerName:customerName,amount:amount,currency:currency,invoice:invoice,po:po,emailReceipt:emailReceipt,chargeAndRemove:chargeAndRemove,authorizeOnly:authorizeOnly,},beforeSend:function(){customerNameInput.prop('disabled',true);amountElem.prop('disabled',true);currencyElem.prop('disabled',true);invoiceElem.prop('disabled',true);poElem.prop('disabled',true);emailReceiptElem.prop('disabled',true);btn.prop('disabled',true);dropdownBtn.prop('disabled',true);if(authorizeOnly){showPanelMessage("Authorizing charge...",'info',msg);}else{showPanelMessage("Charging card...",'info',msg);}resetChargeSuccessPanel();return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){if(j['data']['error_type']==="card: requires_action"){showPanelMessage(j['data']['error_msg'],'warning',msg);return;}showPanelMessage(j['data']['error_msg'],'danger',msg);}return;},success:function(j){var successPanel=$('#panel-charge-success');var data=j['data'];successPanel.find('.customer-name').text(data['customer_name']);successPanel.find('.cardholder').text(data['cardholder_name']);successPanel.find('.card-last4').text(data['card_last4']);successPanel.find('.card-exp').text(data['card_expiration']);successPanel.find('.amount').text(data['currency_symbol']+data['amount']);successPanel.find('.invoice').text(data['invoice']);successPanel.find('.po').text(data['po']);var emailedTo=data['receipt_emailed_to']||[];if(emailedTo.length>0){successPanel.find('.receipt-emailed-to').text(emailedTo.join(', '));successPanel.find('.receipt-emailed').show();}if(data['receipt_email_error']){showPanelMessage(data['receipt_email_error'],'warning',successPanel.find('.receipt-email-error'));}var href="/card/receipt/?chg_id="+data['charge_id'];$('#show-receipt').attr('href',href);$('#show-receipt-pdf').attr('href',"/card/receipt/pdf/?chg_id="+data['charge_id']);successPanel.find('.panel-body .info.info-pending').toggle(data['pending']===true);if(data['authorized_only']===true){successPanel.find('.panel-title').text("Authorization Successful!");successPanel.find('.panel-body .info.info-authorize').show();$('#show-receipt, #show-receipt-pdf').attr('disabled',true);}else{successPanel.find('.panel-title').text("Charge Successful!");successPanel.find('.panel-body .info.info-authorize').hide();$('#show-receipt, #show-receipt-pdf').attr('disabled',false);}var chargeCardPanel=$('#panel-charge-card');var allBtns=$('.action-btn');allBtns.attr("disabled",true).children("input").attr("disabled",true);chargeCardPanel.fadeOut(200,function(){chargeCardPanel.removeClass("show");successPanel.fadeIn(200,function(){successPanel.addClass("show");allBtns.attr("disabled",false).children("input").attr("disabled",false);});});allBtns.removeClass('active');resetChargeCardPanel(true);if(chargeAndRemove){setTimeout(function(){getCards();},500);}return;}});return false;});$('.dropdown-menu.charge-card-options').on('click','#charge-and-remove-card',function(){$('#charge-card-submit').data("chargeandremove",true);$('#charge-card').submit();return;});$('.dropdown-menu.charge-card-options').on('click','#auth-charge-only',function(){$('#charge-card-submit').data("authorizeonly",true);$('#charge-card').submit();return;});function resetChargeCardPanel(msgRemove){$('#charge-card .customer-name').val('').prop('disabled',false);$('#charge-card .customer-cardholder').val('');$('#charge-card .card-last-four').val('');$('#charge-card .card-expiration').val('');$('#charge-card .charge-card-id').html('');$('#charge-card-make-default').prop('disabled',true);$('#charge-card .charge-amount').val('');$('#charge-card .charge-currency').val('');$('#charge-card .charge-invoice').val('');$('#charge-card .charge-po').val('');$('#charge-card .charge-email-receipt').val('').attr('placeholder','ap@example.com, buyer@example.com');$('#charge-card-submit').prop('disabled',false);$('#charge-card-submit').siblings('.dropdown-toggle').prop('disabled',false);$('#charge-card .charge-amount, #charge-card .charge-currency, #charge-card .charge-invoice, #charge-card .charge-po, #charge-card .charge-email-receipt').prop('disabled',true);$('#charge-card-submit').removeData();if(msgRemove){$('#charge-card .msg').html('');}return;}$('#panel-charge-card').on('click','.clear-form-btn',function(){resetChargeCardPanel(true);return;});function resetChargeSuccessPanel(){$('#panel-charge-success .customer-name').text('');$('#panel-charge-success .cardholder').text('');$('#panel-charge-success .card-last4').text('');$('#panel-charge-success .card-exp').text('');$('#panel-charge-success .amount').text('');$('#panel-charge-success .invoice').text('');$('#panel-charge-success .po').text('');$('#panel-charge-success .receipt-emailed-to').text('');$('#panel-charge-success .receipt-emailed').hide();$('#panel-charge-success .receipt-email-error').html('');$('#show-receipt, #show-receipt-pdf').attr('href','');return;}$('#scheduled-charge').on('change','.customer-name',function(){var input=$('#scheduled-charge .customer-name');var custId=getCardIdFromDataList(input);var msg=$('#scheduled-charge .msg');msg.html('');resetScheduledChargeCards();$('#scheduled-charges-list').html('');if(custId===""||custId===0){showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.","danger",msg);return;}$.ajax({type:"GET",url:"/card/get/",data:{customerId:custId},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",msg);return;},success:function(j){var data=j['data'];var select=$('#scheduled-charge .scheduled-card-id');var cards=data['cards']||[];cards.forEach(function(card){select.append(cardOption(card));});var currencyInput=$('#scheduled-charge .scheduled-currency');currencyInput.val(data['currency']||currencyInput.data('default'));return;}});getScheduledCharges(custId);return;});function getScheduledCharges(custId){var list=$('#scheduled-charges-list');$.ajax({type:"GET",url:"/card/scheduled/",data:{customerId:custId},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",list);return;},success:function(j){list.html('');var schedules=j['data']||[];if(schedules.length===0){return;}list.append('<hr class="hr-panel">');schedules.forEach(function(s){list.append(scheduledChargeRow(s));});return;}});return;}function scheduledChargeRow(s){var repeat="Monthly";if(s['interval']==="weekly"){repeat="Weekly";}else if(s['interval']==="custom"){repeat="Every "+s['interval_days']+" days";}var card="Default card";if(s['saved_card_id']!==0){card="Card removed";if(s['card']['card_last4']){card="Card ending in "+s['card']['card_last4'];}}var status="Paused";if(s['active']){status="Next charge "+s['next_run_date'];}else if(s['next_run_date']===""){status="Ended";}var row=$('<div class="scheduled-charge">').attr('data-id',s['id']);var heading=$('<p>');heading.append($('<strong>').text(s['amount']+" "+s['currency'].toUpperCase()+" - "+repeat));heading.append($('<br>'));heading.append(document.createTextNode(card+", from "+s['start_date']+(s['end_date']?" to "+s['end_date']:"")+". "+status+"."));if(s['invoice_template']||s['po_template']){heading.append($('<br>'));heading.append(document.createTextNode("Invoice: "+(s['invoice_template']||"-")+", PO: "+(s['po_template']||"-")));}row.append(heading);var buttons=$('<div class="btn-group btn-group-sm">');if(s['active']){buttons.append('<button class="btn btn-default pause-scheduled-charge" type="button">Pause</button>');}else if(s['next_run_date']!==""||s['end_date']===""){buttons.append('<button class="btn btn-default resume-scheduled-charge" type="button">Resume</button>');}buttons.append('<button class="btn btn-danger remove-scheduled-charge" type="button">Remove</button>');row.append(buttons);var runs=s['runs']||[];if(runs.length>0){var table=$('<table class="table table-condensed">');table.append('<thead><tr><th>Date</th><th>Status</th><th>Invoice</th><th>Details</th></tr></thead>');var tbody=$('<tbody>');runs.forEach(function(run){var tr=$('<tr>');tr.append($('<td>').text(run['run_date']));tr.append($('<td>').text(run['status']));tr.append($('<td>').text(run['invoice']));tr.append($('<td>').text(run['status']==="failed"?run['error']:run['charge_id']));tbody.append(tr);});table.append(tbody);row.append(table);}row.append('<hr class="hr-panel">');return row;}$('#scheduled-charge').on('change','.scheduled-interval',function(){var group=$('#scheduled-charge .scheduled-interval-days-group');if($(this).val()==="custom"){group.show();}else{group.hide();}return;});$('#scheduled-charge').submit(function(e){e.preventDefault();var input=$('#scheduled-charge .customer-name');var custId=getCardIdFromDataList(input);var msg=$('#scheduled-charge .msg');var btn=$('#panel-scheduled-charges .submit-form-btn');if(custId===""||custId===0){showPanelMessage("The customer name you provided is not a real customer. Please choose a customer from the list.","danger",msg);return;}$.ajax({type:"POST",url:"/card/scheduled/add/",data:{customerId:custId,cardId:$('#scheduled-charge .scheduled-card-id').val(),amount:$('#scheduled-charge .scheduled-amount').val(),currency:$('#scheduled-charge .scheduled-currency').val(),interval:$('#scheduled-charge .scheduled-interval').val(),intervalDays:$('#scheduled-charge .scheduled-interval-days').val(),startDate:$('#scheduled-charge .scheduled-start-date').val(),endDate:$('#scheduled-charge .scheduled-end-date').val(),invoice:$('#scheduled-charge .scheduled-invoice').val(),po:$('#scheduled-charge .scheduled-po').val()},beforeSend:function(){btn.prop('disabled',true);msg.html('');return;},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",msg);btn.prop('disabled',false);return;},success:function(j){showPanelMessage("The charge was scheduled.  The first charge will be made on "+j['data']['next_run_date']+".","success",msg);btn.prop('disabled',false);getScheduledCharges(custId);return;}});return;});$('#scheduled-charges-list').on('click','.pause-scheduled-charge, .resume-scheduled-charge, .remove-scheduled-charge',function(){var btn=$(this);var id=btn.closest('.scheduled-charge').data('id');var custId=getCardIdFromDataList($('#scheduled-charge .customer-name'));var msg=$('#scheduled-charge .msg');var url="/card/scheduled/pause/";if(btn.hasClass('resume-scheduled-charge')){url="/card/scheduled/resume/";}else if(btn.hasClass('remove-scheduled-charge')){if(!confirm("Remove this scheduled charge?  No more charges will be made.")){return;}url="/card/scheduled/remove/";}$.ajax({type:"POST",url:url,data:{id:id},beforeSend:function(){btn.prop('disabled',true);msg.html('');return;},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",msg);btn.prop('disabled',false);return;},success:function(j){getScheduledCharges(custId);return;}});return;});function resetScheduledChargeCards(){$('#scheduled-charge .scheduled-card-id option').not('[value="0"]').remove();return;}function resetScheduledChargePanel(){resetScheduledChargeCards();$('#scheduled-charge .customer-name, #scheduled-charge .scheduled-amount, #scheduled-charge .scheduled-currency, #scheduled-charge .scheduled-interval-days, #scheduled-charge .scheduled-start-date, #scheduled-charge .scheduled-end-date, #scheduled-charge .scheduled-invoice, #scheduled-charge .scheduled-po').val('');$('#scheduled-charge .scheduled-interval').val('monthly').trigger('change');$('#scheduled-charge .msg').html('');$('#scheduled-charges-list').html('');return;}$('#panel-scheduled-charges').on('click','.clear-form-btn',function(){resetScheduledChargePanel();return;});$('#batch-charge').submit(function(e){e.preventDefault();var msg=$('#batch-charge .msg');var chargeBtn=$('#panel-batch-charge .batch-charge-submit');$.ajax({type:"POST",url:"/card/batch/preview/",data:new FormData(this),processData:false,contentType:false,beforeSend:function(){showPanelMessage("Checking file...","info",msg);chargeBtn.prop('disabled',true).removeData('batch-id');stopBatchProgress();$('#panel-batch-charge .batch-download-results').hide();return;},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",msg);showBatchRows(null);return;},success:function(j){var b=j['data'];if(b['started']){showBatchProgress(b);return;}showBatchRows(b);if(b['num_valid']===0){showPanelMessage("None of the rows can be charged. Please fix the file and preview it again.","danger",msg);return;}var text=b['num_valid']+" row(s) are ready to charge.";if(b['num_invalid']>0){text+="  "+b['num_invalid']+" row(s) have errors and will be skipped.";}showPanelMessage(text,b['num_invalid']>0?"warning":"success",msg);chargeBtn.text("Charge "+b['num_valid']+" Card(s)").data('batch-id',b['id']).prop('disabled',false);return;}});return;});$('#batch-charge').on('change','.batch-file',function(){stopBatchProgress();$('#batch-charge .msg').html('');$('#panel-batch-charge .batch-charge-submit').text("Charge").prop('disabled',true).removeData('batch-id');$('#panel-batch-charge .batch-download-results').hide();showBatchRows(null);return;});$('#panel-batch-charge').on('click','.batch-charge-submit',function(){var btn=$(this);var msg=$('#batch-charge .msg');var batchId=btn.data('batch-id');if(!confirm("Charge the cards in this file? This cannot be undone.")){return;}var data=new FormData($('#batch-charge')[0]);data.append('batchId',batchId);$.ajax({type:"POST",url:"/card/batch/charge/",data:data,processData:false,contentType:false,beforeSend:function(){showPanelMessage("Starting to charge cards...","info",msg);btn.prop('disabled',true);return;},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",msg);btn.prop('disabled',false);return;},success:function(j){btn.text("Charge").removeData('batch-id');showBatchProgress(j['data']);return;}});return;});var batchProgressTimer=null;function showBatchProgress(b){var msg=$('#batch-charge .msg');showBatchRows(b);$('#panel-batch-charge .batch-download-results').data('batch-id',b['id']).show();var text=b['num_charged']+" card(s) were charged.";if(b['num_failed']>0){text+="  "+b['num_failed']+" charge(s) failed.";}if(b['done']){showPanelMessage("This file was charged by "+b['username']+".  "+text,b['num_failed']>0?"warning":"success",msg);return;}showPanelMessage("Charging cards, "+b['num_pending']+" of "+b['num_valid']+" left.  "+text+"  The cards are charged in the background so you can leave this page, preview the same file again to see the progress.","info",msg);stopBatchProgress();batchProgressTimer=setTimeout(function(){$.ajax({type:"GET",url:"/card/batch/status/",data:{batchId:b['id']},error:function(r){var j=JSON.parse(r['responseText']);showPanelMessage(j['data']['error_msg'],"danger",msg);return;},success:function(j){if(batchProgressTimer!==null){showBatchProgress(j['data']);}return;}});return;},3000);return;}function stopBatchProgress(){clearTimeout(batchProgressTimer);batchProgressTimer=null;return;}function showBatchRows(b){var table=$('#batch-charge-rows');var tbody=table.find('tbody');var totals=$('#batch-charge-totals');tbody.html('');totals.html('');if(b===null){table.hide();return;}b['rows'].forEach(function(row){var tr=$('<tr>');tr.append($('<td>').text(row['row']));tr.append($('<td>').text(row['customer_name']||row['customer_id']));tr.append($('<td>').text(row['card_last4']));tr.append($('<td class="charge-amount-column">').text(row['amount']?row['amount']+" "+row['currency'].toUpperCase():""));tr.append($('<td>').text(row['invoice']));tr.append($('<td>').text(row['po']));tr.append($('<td>').text(row['status']));var details=row['charge_id']||row['error'];if(row['email_error']){details+=" (Receipt not emailed: "+row['email_error']+")";}tr.append($('<td>').text(details));if(row['status']==="invalid"||row['status']==="failed"){tr.addClass('danger');}tbody.append(tr);});(b['totals']||[]).forEach(function(t){totals.append($('<p>').append($('<strong>').text("Total "+t['currency'].toUpperCase()+": "+t['amount']+" ("+t['count']+" charges)")));});table.show();return;}$('#panel-batch-charge').on('click','.batch-download-results',function(){window.location.href="/card/batch/results/?batchId="+encodeURIComponent($(this).data('batch-id'));return;});$('#panel-batch-charge').on('click','.clear-form-btn',function(){stopBatchProgress();$('#batch-charge .batch-file').val('');$('#batch-charge .msg').html('');$('#panel-batch-charge .batch-charge-submit').text("Charge").prop('disabled',true).removeData('batch-id');$('#panel-batch-charge .batch-download-results').hide();showBatchRows(null);return;});$('#reports').submit(function(e){var customerNameInput=$('#reports .customer-name');var customerName=customerNameInput.val();var customerId=getCardIdFromDataList(customerNameInput);var startDate=$('#reports .start-date').val();var endDate=$('#reports .end-date').val();var msg=$('#reports .msg');var btn=$('#reports-submit');msg.html('');if(startDate===""){e.preventDefault();showPanelMessage("You must choose a Start Date.","danger",msg);return;}if(endDate===""){e.preventDefault();showPanelMessage("You must choose an End Date.","danger",msg);return;}if(endDate<startDate){e.preventDefault();showPanelMessage("The Start Date must be before the End Date.","danger",msg);return;}var d=new Date();var offset=(d.getTimezoneOffset()/60)*-1;$('#timezone').val(offset);var customerNameInput=$('#reports .customer-name');var datastoreId=getCardIdFromDataList(customerNameInput);$('#report-customer-id').val(datastoreId);return;});$('#report-rows').on('click','.refund',function(){var refundBtn=$(this);var amountDollars=refundBtn.parent().siblings('td.amount-dollars').children('.amount').first().text().replace(/,/g,"");var chargeId=refundBtn.data("chgid");var refundAmount=$('#refund-amount');refundAmount.val(amountDollars).attr("max",amountDollars);$('#refund-chg-id').val(chargeId);return;});$('#form-refund').submit(function(e){var chargeId=$('#refund-chg-id').val();var amount=$('#refund-amount').val();var reason=$('#refund-reason').val();var emailReceipt=($('#refund-email-receipt').val()||'').trim();var msg=$('#form-refund .msg');var btn=$('#refund-submit');msg.html('');if(chargeId.length===0){e.preventDefault();showModalMessage("A charge ID was not submitted.  Please refresh your browser and try again.","danger",msg);return;}if(amount.length===0||parseFloat(amount)<0){e.preventDefault();showModalMessage("You must provide an amount to refund that is greater than zero but less than the amount charged.","danger",msg);return;}if(validateEmailList(emailReceipt)===false){e.preventDefault();showModalMessage("One of the email addresses to send the receipt to is not valid. Separate addresses with commas.","danger",msg);return;}e.preventDefault();$.ajax({type:"POST",url:"/card/refund/",data:{chargeId:chargeId,amount:amount,reason:reason,emailReceipt:emailReceipt},beforeSend:function(){showModalMessage("Refunding charge...","info",msg);btn.prop('disabled',true);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage(j['data']['error_msg'],'danger',msg);btn.prop('disabled',false);}return;},success:function(j){var data=j['data']||{};var emailedTo=data['receipt_emailed_to']||[];if(data['receipt_email_error']){showModalMessage("Refund successful! "+data['receipt_email_error'],"warning",msg);}else if(emailedTo.length>0){showModalMessage("Refund successful! The receipt was emailed to "+emailedTo.join(', ')+".","success",msg);}else{showModalMessage("Refund successful!","success",msg);}btn.prop('disabled',false);$('#refund-amount').val("");$('#refund-reason').val("0");$('#refund-email-receipt').val("");setTimeout(function(){msg.html('');},2000);return;}});return false;});$('body').on('click','.link-to-capture',function(){var chargeID=$(this).parents('tr').data("charge-id");var amount=$(this).data('amount');$('#capture-charge-id').val(chargeID);$('#capture-amount').val(amount).attr('max',amount);$('#release-reason').val('abandoned');$('#release-notes').val('');$('#modal-capture .msg').html('');$('#capture-submit, #release-submit').prop('disabled',false);return;});$('#form-capture').submit(function(e){e.preventDefault();var msg=$('#modal-capture .msg');var btns=$('#capture-submit, #release-submit');$.ajax({type:"POST",url:"/card/capture/",data:{chargeID:$('#capture-charge-id').val(),amount:$('#capture-amount').val()},beforeSend:function(){showModalMessage("Capturing...","info",msg);btns.prop('disabled',true);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage(j['data']['error_msg'],'danger',msg);btns.prop('disabled',false);}return;},success:function(j){showModalMessage("Capture successful!","success",msg);setTimeout(function(){window.location.reload();},1500);return;}});return false;});$('#form-release').submit(function(e){e.preventDefault();var msg=$('#modal-capture .msg');var btns=$('#capture-submit, #release-submit');if(!confirm("Release this authorization? It cannot be captured once it is released.")){return false;}$.ajax({type:"POST",url:"/card/release/",data:{chargeID:$('#capture-charge-id').val(),reason:$('#release-reason').val(),notes:$('#release-notes').val()},beforeSend:function(){showModalMessage("Releasing...","info",msg);btns.prop('disabled',true);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage(j['data']['error_msg'],'danger',msg);btns.prop('disabled',false);}return;},success:function(j){showModalMessage("Authorization released!","success",msg);setTimeout(function(){window.location.reload();},1500);return;}});return false;});$('#form-dispute-evidence').on('click','.dispute-evidence-submit',function(){$('#form-dispute-evidence').data('submit',$(this).data('submit'));return;});$('#form-dispute-evidence').submit(function(e){e.preventDefault();var form=$(this);var submit=form.data('submit')===true;var msg=$('#form-dispute-evidence .msg');var btns=$('#form-dispute-evidence .dispute-evidence-submit');if(submit&&!confirm("Evidence cannot be changed once it is submitted. Submit this evidence to Stripe?")){return false;}var data=new FormData(this);data.append('submit',submit);$.ajax({type:"POST",url:"/card/disputes/evidence/",data:data,processData:false,contentType:false,beforeSend:function(){showPanelMessage((submit?"Submitting":"Saving")+" evidence...","info",msg);btns.prop('disabled',true);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showPanelMessage(j['data']['error_msg'],'danger',msg);btns.prop('disabled',false);}return;},success:function(j){showPanelMessage("Evidence "+(submit?"submitted":"saved")+"!","success",msg);setTimeout(function(){window.location.reload();},1500);return;}});return false;});$('#modal-change-company-info').on('show.bs.modal',function(){var msg=$('#modal-change-company-info .msg');$.ajax({type:"GET",url:"/company/get/",beforeSend:function(){showModalMessage("Loading company information...","info",msg);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){if(j['data']['error_type']==="companyInfoDoesNotExist"){showModalMessage("You do have any company info set. Your recipts will show up blank without setting the fields above.","info",msg);return;$('#company-info-submit').prop('disabled',false);return;}showModalMessage("An error occured and your company data could not be loaded.  Please try again.","danger",msg);$('#company-info-submit').prop('disabled',true);return;}},success:function(j){var data=j['data'];$('#modal-change-company-info .company-name').val(data['company_name']);$('#modal-change-company-info .company-street').val(data['street']);$('#modal-change-company-info .company-suite').val(data['suite']);$('#modal-change-company-info .company-city').val(data['city']);$('#modal-change-company-info .company-state').val(data['state']);$('#modal-change-company-info .company-postal').val(data['postal_code']);$('#modal-change-company-info .company-country').val(data['country']);$('#modal-change-company-info .company-phone').val(data['phone_num']);$('#modal-change-company-info .company-email').val(data['email']);$('#modal-change-company-info .percentage-fee').val(parseFloat(data['percentage_fee']*100).toFixed(2));$('#modal-change-company-info .fixed-fee').val(data['fixed_fee'].toFixed(2));$('#modal-change-company-info .statement-descriptor').val(data['statement_descriptor']);msg.html('');$('#company-info-submit').prop('disabled',false);return;}});return;});$('#modal-change-company-info').on('hidden.bs.modal',function(){$('#modal-change-company-info .msg').html('');$('#company-info-submit').prop('disabled',true);$('#modal-change-company-info input').val('');return;});$('#form-change-company-info').submit(function(e){e.preventDefault();var name=$('#modal-change-company-info .company-name').val();var street=$('#modal-change-company-info .company-street').val();var suite=$('#modal-change-company-info .company-suite').val();var city=$('#modal-change-company-info .company-city').val();var state=$('#modal-change-company-info .company-state').val();var postal=$('#modal-change-company-info .company-postal').val();var country=$('#modal-change-company-info .company-country').val();var phone=$('#modal-change-company-info .company-phone').val();var email=$('#modal-change-company-info .company-email').val();var percentFee=parseFloat($('#modal-change-company-info .percentage-fee').val());var fixedFee=parseFloat($('#modal-change-company-info .fixed-fee').val());var descriptor=$('#modal-change-company-info .statement-descriptor').val();var msg=$('#modal-change-company-info .msg');var btn=$('#company-info-submit');if(state.length>2){showModalMessage("State must be a two character abbreviation.","danger",msg);return;}if(postal.length>6){showModalMessage("Postal code must be 5 or 6 alphanumeric characters.","danger",msg);return;}if(country.length>3){showModalMessage("Country must be a 2 or 3 character abbreviation.","danger",msg);return;}if(percentFee<0||percentFee>100||isNaN(percentFee)){showModalMessage("Percentage fee must be a number such as 2.95.","danger",msg);return;}if(fixedFee<0||fixedFee>100||isNaN(fixedFee)){showModalMessage("Fixed fee must be a number such as 0.30.","danger",msg);return;}if(descriptor.length<5||descriptor.length>22){showModalMessage("Statement descriptor must be between 5 and 22 characters long.  It is currently "+descriptor.length+" characters.","danger",msg);return;}$.ajax({type:"POST",url:"/company/set/",data:{name:name,street:street,suite:suite,city:city,state:state,postal:postal,country:country,phone:phone,email:email,percentFee:percentFee,fixedFee:fixedFee,descriptor:descriptor,},beforeSend:function(){showModalMessage("Saving company information...","info",msg);btn.prop("disabled",true);},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage("An error occured and your company info could not be saved.","danger",msg);return;}},success:function(j){showModalMessage("Company information was saved!","success",msg);btn.prop('disabled',false);setTimeout(function(){msg.html('');return;},3000);return;}});return false;});$('#modal-app-settings').on('show.bs.modal',function(){var msg=$('#modal-app-settings .msg');$.ajax({type:"GET",url:"/app-settings/get/",beforeSend:function(){showModalMessage("Loading app settings...","info",msg);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage("An error occured and your app settings could not be loaded.  Please try again.","danger",msg);$('#app-settings-submit').prop('disabled',true);return;}},success:function(j){var data=j['data'];if(data['require_cust_id']){$('#form-change-app-settings .require-cust-id input[value=true]').attr('checked',true).parent().addClass('active');}else{$('#form-change-app-settings .require-cust-id input[value=false]').attr('checked',true).parent().addClass('active');}$('#modal-app-settings .cust-id-format').val(data['cust_id_format']);$('#modal-app-settings .cust-id-regex').val(data['cust_id_regex']);$('#modal-app-settings .report-timezone').val(data['report_timezone']);$('#modal-app-settings .default-currency').val(data['default_currency']);if(data['api_key']===''){$('#api-key-displayed').val("Not created yet.");}else{$('#api-key-displayed').val(data['api_key']);}msg.html('');$('#app-settings-submit').prop('disabled',false);return;}});return;});$('#modal-app-settings').on('hidden.bs.modal',function(){$('#modal-app-settings .msg').html('');$('#app-settings-submit').prop('disabled',true);$('#modal-app-settings input').val('');return;});$('#form-change-app-settings').submit(function(e){e.preventDefault();var requireCustID=$('#modal-app-settings .require-cust-id label.active input').val();var custIDFormat=$('#modal-app-settings .cust-id-format').val();var custIDRegex=$('#modal-app-settings .cust-id-regex').val();var guiTimezone=$('#modal-app-settings .report-timezone').val();var defaultCurrency=$('#modal-app-settings .default-currency').val();var msg=$('#modal-app-settings .msg');var btn=$('#app-settings-submit');$.ajax({type:"POST",url:"/app-settings/set/",data:{requireCustID:requireCustID,custIDFormat:custIDFormat,custIDRegex:custIDRegex,guiTimezone:guiTimezone,defaultCurrency:defaultCurrency,},beforeSend:function(){showModalMessage("Saving app settings...","info",msg);btn.prop("disabled",true);},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage("An error occured and your app settings could not be saved.","danger",msg);return;}},success:function(j){showModalMessage("App settings saved! Refresh the app to see the changes applied.","success",msg);btn.prop('disabled',false);setTimeout(function(){msg.html('');return;},5000);return;}});return false;});$('#form-change-app-settings').on('click','#generate-api-key',function(){var msg=$('#modal-app-settings .msg');$.ajax({type:"GET",url:"/app-settings/generate-api-key/",beforeSend:function(){showModalMessage("Getting new API key...","info",msg);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage("An error occured and an API key could not be generated.  Try again.","danger",msg);return;}},success:function(j){$('#api-key-displayed').val(j['data']);showModalMessage("New API key generated.","success",msg);setTimeout(function(){msg.html('');return;},3000);return;}});return;});function getBackups(){var msg=$('#modal-backups .msg');var list=$('#backups-list');$.ajax({type:"GET",url:"/app-settings/backup/list/",beforeSend:function(){showModalMessage("Loading backups...","info",msg);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage("An error occured and the list of backups could not be loaded.  Please try again.","danger",msg);return;}},success:function(j){var data=j['data'];list.html('');if(data.length===0){list.append('<tr><td colspan="3">No backups have been made yet.</td></tr>');}for(var i=0;i<data.length;i++){var b=data[i];var sizeKB=(b['size']/1024).toFixed(1)+" KB";var link='<a href="/app-settings/backup/download/?name='+encodeURIComponent(b['name'])+'">Download</a>';list.append('<tr><td>'+b['datetime']+'</td><td>'+sizeKB+'</td><td>'+link+'</td></tr>');}msg.html('');return;}});return;}$('#modal-backups').on('show.bs.modal',function(){getBackups();return;});$('#modal-backups').on('hidden.bs.modal',function(){$('#modal-backups .msg').html('');$('#backups-list').html('');return;});$('#backup-now').click(function(){var msg=$('#modal-backups .msg');var btn=$(this);$.ajax({type:"POST",url:"/app-settings/backup/",beforeSend:function(){showModalMessage("Backing up the database...","info",msg);btn.prop('disabled',true);return;},error:function(r){var j=JSON.parse(r['responseText']);if(j['ok']===false){showModalMessage("An error occured and a backup could not be made.  Please try again.","danger",msg);btn.prop('disabled',false);return;}},success:function(j){btn.prop('disabled',false);getBackups();return;}});return;});